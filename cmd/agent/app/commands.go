@@ -0,0 +1,213 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// checkTimeout bounds connecting to the proxy server in the check command.
+const checkTimeout = 10 * time.Second
+
+// certExpiryWarning is how long before its expiry the check command warns
+// about the agent certificate.
+const certExpiryWarning = 7 * 24 * time.Hour
+
+func newRunCommand(a *Agent, o *options.GrpcProxyAgentOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "run",
+		Short: "Run the agent. This is the default if no command is given.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			return a.run(o)
+		},
+	}
+}
+
+func newCheckCommand(o *options.GrpcProxyAgentOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Check the configuration and the connectivity to the proxy server, then exit.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			return check(cmd.OutOrStdout(), o)
+		},
+	}
+}
+
+func newVersionCommand() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and the protocol capabilities of the agent.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printVersion(cmd.OutOrStdout(), output)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "json", "Output format, either 'json' or 'text'.")
+	return cmd
+}
+
+func newDumpConfigCommand(o *options.GrpcProxyAgentOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump-config",
+		Short: "Print the effective configuration as JSON, with credentials redacted.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			return dumpConfig(cmd.OutOrStdout(), o)
+		},
+	}
+}
+
+// agentVersion is the output of the version command.
+type agentVersion struct {
+	util.VersionInfo
+	ProtocolCapabilities []agent.Capability `json:"protocolCapabilities"`
+}
+
+func printVersion(w io.Writer, output string) error {
+	v := agentVersion{
+		VersionInfo:          util.GetVersionInfo(),
+		ProtocolCapabilities: agent.SupportedCapabilities,
+	}
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "text":
+		_, err := fmt.Fprintf(w, "Version: %s\nCommit: %s\nGo: %s\nPlatform: %s\nProtocol capabilities: %s\n",
+			v.GitVersion, v.GitCommit, v.GoVersion, v.Platform, agent.FormatCapabilities(v.ProtocolCapabilities))
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, must be 'json' or 'text'", output)
+	}
+}
+
+func dumpConfig(w io.Writer, o *options.GrpcProxyAgentOptions) error {
+	redacted := *o
+	redacted.EgressProxyURL = util.RedactURL(o.EgressProxyURL)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(redacted)
+}
+
+// check validates the options, the agent credentials and that a
+// connection to the proxy server can be established, reporting each step
+// to w.
+func check(w io.Writer, o *options.GrpcProxyAgentOptions) error {
+	if err := o.Validate(); err != nil {
+		fmt.Fprintf(w, "[FAIL] options: %v\n", err)
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	fmt.Fprintln(w, "[OK] options")
+
+	tlsConfig, err := util.GetClientTLSConfig(o.CaCert, o.AgentCert, o.AgentKey, o.ProxyServerHost, o.AlpnProtos)
+	if err != nil {
+		fmt.Fprintf(w, "[FAIL] credentials: %v\n", err)
+		return fmt.Errorf("failed to load credentials: %v", err)
+	}
+	if err := checkCertificateExpiry(w, tlsConfig, time.Now()); err != nil {
+		fmt.Fprintf(w, "[FAIL] certificate: %v\n", err)
+		return err
+	}
+	fmt.Fprintln(w, "[OK] credentials")
+
+	address := fmt.Sprintf("%s:%d", o.ProxyServerHost, o.ProxyServerPort)
+	if err := checkConnection(o, tlsConfig, address); err != nil {
+		fmt.Fprintf(w, "[FAIL] connection to %s: %v\n", address, err)
+		return fmt.Errorf("failed to connect to the proxy server: %v", err)
+	}
+	fmt.Fprintf(w, "[OK] connection to %s\n", address)
+	return nil
+}
+
+// checkCertificateExpiry fails if the agent certificate is not valid at
+// now, and warns if it expires soon.
+func checkCertificateExpiry(w io.Writer, tlsConfig *tls.Config, now time.Time) error {
+	if len(tlsConfig.Certificates) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse the agent certificate: %v", err)
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("the agent certificate is not valid before %v", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("the agent certificate expired at %v", cert.NotAfter)
+	}
+	if cert.NotAfter.Sub(now) < certExpiryWarning {
+		fmt.Fprintf(w, "[WARN] the agent certificate expires at %v\n", cert.NotAfter)
+	}
+	return nil
+}
+
+// checkConnection dials the proxy server the way the agent does and
+// completes the TLS handshake.
+func checkConnection(o *options.GrpcProxyAgentOptions, tlsConfig *tls.Config, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	var egressProxy *url.URL
+	if o.EgressProxyURL != "" {
+		var err error
+		if egressProxy, err = url.Parse(o.EgressProxyURL); err != nil {
+			return err
+		}
+	}
+	transport := agent.TransportType(o.ProxyServerTransport)
+	conn, err := agent.NewTransportDialer(transport, egressProxy, tlsConfig)(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if transport == agent.TransportWebSocket {
+		// The websocket dialer completed the TLS handshake.
+		return nil
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = o.ProxyServerHost
+	}
+	return tls.Client(conn, tlsConfig).HandshakeContext(ctx)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/conformance"
+)
+
+// conformanceOptions configures the agent conformance suite.
+type conformanceOptions struct {
+	bindAddress       string
+	port              int
+	serverCert        string
+	serverKey         string
+	caCert            string
+	agentBinary       string
+	agentArgs         []string
+	cases             []string
+	stepTimeout       time.Duration
+	connectTimeout    time.Duration
+	largeTransferSize int
+	report            string
+}
+
+func newConformanceCommand() *cobra.Command {
+	o := &conformanceOptions{
+		bindAddress:       "127.0.0.1",
+		port:              8091,
+		stepTimeout:       conformance.DefaultStepTimeout,
+		connectTimeout:    time.Minute,
+		largeTransferSize: conformance.DefaultLargeTransferSize,
+	}
+	var caseNames []string
+	for _, c := range conformance.AgentCases() {
+		caseNames = append(caseNames, fmt.Sprintf("  %-18s %s", c.Name, c.Description))
+	}
+	cmd := &cobra.Command{
+		Use:   "conformance",
+		Short: "Verify that an agent build speaks the agent protocol of this proxy server.",
+		Long: `Serves agents like a proxy server does and runs the conformance cases against the first agent
+connecting, over the wire protocol, then prints a pass/fail report and fails if a case failed.
+The agent is started with --agent-binary and --agent-args, pointed at the suite with
+--proxy-server-host and --proxy-server-port, or started separately. The cases are:
+
+` + strings.Join(caseNames, "\n"),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := o.validate(); err != nil {
+				return err
+			}
+			return o.run()
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.bindAddress, "conformance-bind-address", o.bindAddress, "Address the suite listens on for the agent.")
+	flags.IntVar(&o.port, "conformance-port", o.port, "Port the suite listens on for the agent.")
+	flags.StringVar(&o.serverCert, "conformance-server-cert", o.serverCert, "Certificate the suite presents to the agent.")
+	flags.StringVar(&o.serverKey, "conformance-server-key", o.serverKey, "Private key of --conformance-server-cert.")
+	flags.StringVar(&o.caCert, "conformance-ca-cert", o.caCert, "If non-empty, the CA the suite verifies the agent certificate with.")
+	flags.StringVar(&o.agentBinary, "agent-binary", o.agentBinary, "Agent binary to start and test. If empty, the suite waits for an agent started separately.")
+	flags.StringSliceVar(&o.agentArgs, "agent-args", o.agentArgs, "Arguments of --agent-binary, e.g. its certificates, besides --proxy-server-host and --proxy-server-port.")
+	flags.StringSliceVar(&o.cases, "cases", o.cases, "Cases to run, all if empty.")
+	flags.DurationVar(&o.stepTimeout, "step-timeout", o.stepTimeout, "How long a step waits for the agent.")
+	flags.DurationVar(&o.connectTimeout, "connect-timeout", o.connectTimeout, "How long the suite waits for the agent to connect.")
+	flags.IntVar(&o.largeTransferSize, "large-transfer-size", o.largeTransferSize, "Bytes echoed through the agent by the large-transfer case.")
+	flags.StringVar(&o.report, "report", o.report, "If non-empty, file the report is written to as JSON.")
+	return cmd
+}
+
+func (o *conformanceOptions) validate() error {
+	if o.serverCert == "" || o.serverKey == "" {
+		return fmt.Errorf("--conformance-server-cert and --conformance-server-key are required")
+	}
+	if o.port < 0 || o.port > 49151 {
+		return fmt.Errorf("port %d must be between 0 and 49151", o.port)
+	}
+	if o.stepTimeout <= 0 {
+		return fmt.Errorf("step timeout %v must be positive", o.stepTimeout)
+	}
+	if o.connectTimeout <= 0 {
+		return fmt.Errorf("connect timeout %v must be positive", o.connectTimeout)
+	}
+	if o.largeTransferSize <= 0 {
+		return fmt.Errorf("large transfer size %d must be positive", o.largeTransferSize)
+	}
+	return nil
+}
+
+func (o *conformanceOptions) run() error {
+	tlsConfig, err := simulatedServerTLSConfig(o.serverCert, o.serverKey, o.caCert)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(o.bindAddress, strconv.Itoa(o.port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	suite, err := conformance.NewAgentSuite(conformance.AgentConfig{
+		ServerOptions:     []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))},
+		StepTimeout:       o.stepTimeout,
+		LargeTransferSize: o.largeTransferSize,
+		Cases:             o.cases,
+	}, lis)
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	defer suite.Close()
+	klog.InfoS("Conformance suite listening for the agent", "address", lis.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if o.agentBinary != "" {
+		host, port, _ := net.SplitHostPort(lis.Addr().String())
+		args := append(append([]string{}, o.agentArgs...), "--proxy-server-host="+host, "--proxy-server-port="+port)
+		agentCmd := exec.CommandContext(ctx, o.agentBinary, args...) /* #nosec G204 */
+		agentCmd.Stdout = os.Stderr
+		agentCmd.Stderr = os.Stderr
+		if err := agentCmd.Start(); err != nil {
+			return fmt.Errorf("failed to start the agent %s: %v", o.agentBinary, err)
+		}
+		defer func() {
+			cancel()
+			agentCmd.Wait() /* #nosec G104 */
+		}()
+	}
+
+	connectCtx, connectCancel := context.WithTimeout(ctx, o.connectTimeout)
+	defer connectCancel()
+	report, err := suite.Run(connectCtx)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteText(os.Stdout); err != nil {
+		return err
+	}
+	if o.report != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(o.report, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write the report: %v", err)
+		}
+	}
+	if !report.Passed() {
+		return fmt.Errorf("the agent failed the conformance suite")
+	}
+	return nil
+}
@@ -5,8 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/pprof"
-	"runtime"
+	"net/url"
 	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -14,9 +13,13 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
@@ -25,9 +28,20 @@ func NewAgentCommand(a *Agent, o *options.GrpcProxyAgentOptions) *cobra.Command
 		Use:  "agent",
 		Long: `A gRPC agent, Connects to the proxy and then allows traffic to be forwarded to it.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
 			return a.run(o)
 		},
 	}
+	cmd.AddCommand(
+		newRunCommand(a, o),
+		newCheckCommand(o),
+		newVersionCommand(),
+		newDumpConfigCommand(o),
+		newSimulateServerCommand(),
+		newConformanceCommand(),
+	)
 
 	return cmd
 }
@@ -40,46 +54,151 @@ func (a *Agent) run(o *options.GrpcProxyAgentOptions) error {
 	if err := o.Validate(); err != nil {
 		return fmt.Errorf("failed to validate agent options with %v", err)
 	}
+	if err := util.ConfigureLogging(o.LogFormat, o.LogLevels); err != nil {
+		return fmt.Errorf("failed to configure logging with %v", err)
+	}
+	agent.RecordBuildInfo()
+	if o.WindowsService {
+		return runService(func(stopCh <-chan struct{}) error {
+			return a.serve(o, stopCh)
+		})
+	}
+	return a.serve(o, setupSignalHandler())
+}
 
-	stopCh := make(chan struct{})
-	if err := a.runProxyConnection(o, stopCh); err != nil {
+// serve runs the agent until stopCh is closed.
+func (a *Agent) serve(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) error {
+	cs, err := a.runProxyConnection(o, stopCh)
+	if err != nil {
 		return fmt.Errorf("failed to run proxy connection with %v", err)
 	}
 
-	if err := a.runHealthServer(o); err != nil {
+	if err := a.runHealthServer(o, stopCh); err != nil {
 		return fmt.Errorf("failed to run health server with %v", err)
 	}
 
-	if err := a.runAdminServer(o); err != nil {
+	if err := a.runAdminServer(o, cs, stopCh); err != nil {
 		return fmt.Errorf("failed to run admin server with %v", err)
 	}
 
 	<-stopCh
+	klog.V(1).Infoln("Shutting down agent.")
 
 	return nil
 }
 
-func (a *Agent) runProxyConnection(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) error {
+func (a *Agent) runProxyConnection(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) (*agent.ClientSet, error) {
 	var tlsConfig *tls.Config
 	var err error
 	if tlsConfig, err = util.GetClientTLSConfig(o.CaCert, o.AgentCert, o.AgentKey, o.ProxyServerHost, o.AlpnProtos); err != nil {
-		return err
+		return nil, err
 	}
+	// Resume TLS sessions when reconnecting, sparing the proxy server full
+	// handshakes when many agents reconnect at once.
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 	dialOptions := []grpc.DialOption{
-		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
 		grpc.WithKeepaliveParams(keepalive.ClientParameters{
 			Time:                o.KeepaliveTime,
 			PermitWithoutStream: true,
 		}),
 	}
+	var egressProxy *url.URL
+	if o.EgressProxyURL != "" {
+		if egressProxy, err = url.Parse(o.EgressProxyURL); err != nil {
+			return nil, err
+		}
+	}
+	transport := agent.TransportType(o.ProxyServerTransport)
+	if egressProxy != nil || transport == agent.TransportWebSocket {
+		dialOptions = append(dialOptions, grpc.WithContextDialer(agent.NewTransportDialer(transport, egressProxy, tlsConfig)))
+	}
+	if transport == agent.TransportWebSocket {
+		// TLS is terminated by the websocket dialer.
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	} else {
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
 	cc := o.ClientSetConfig(dialOptions...)
+	if o.TracingOTLPEndpoint != "" {
+		cc.Tracer = tracing.NewTracer("konnectivity-agent", tracing.NewOTLPExporter(o.TracingOTLPEndpoint))
+	}
+	if cc.Redactor, err = o.Redactor(); err != nil {
+		return nil, err
+	}
+	if rc, err := o.ResolverConfig(); err != nil {
+		return nil, err
+	} else if rc != nil {
+		if cc.Resolver, err = agent.NewResolver(*rc); err != nil {
+			return nil, err
+		}
+	}
+	if cc.NetworkNamespaces, err = agent.ParseNetworkNamespaces(o.NetworkNamespaces); err != nil {
+		return nil, err
+	}
+	if cc.ServerCounter, err = newServerCounter(o, stopCh); err != nil {
+		return nil, err
+	}
+	if o.LeaseNamespace != "" {
+		client, err := newKubernetesClient(o)
+		if err != nil {
+			return nil, err
+		}
+		go agent.NewLeaseHolder(client, o.LeaseNamespace, o.AgentID, o.LeaseDuration).Run(stopCh)
+	}
 	cs := cc.NewAgentClientSet(stopCh)
+	if o.ConfigOverridesNamespace != "" {
+		client, err := newKubernetesClient(o)
+		if err != nil {
+			return nil, err
+		}
+		agent.NewOverridesWatcher(client, o.ConfigOverridesNamespace, o.ConfigOverridesName, cs.SetOverrides).Start(stopCh)
+	}
 	cs.Serve()
 
-	return nil
+	rules, err := agent.ParseForwardRules(o.PortForward)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := cs.ServeForward(rule); err != nil {
+			return nil, fmt.Errorf("failed to listen for port forwarding on %s: %v", rule.ListenAddress, err)
+		}
+	}
+
+	return cs, nil
 }
 
-func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions) error {
+// newServerCounter returns the ServerCounter of the configured server count
+// source, nil to trust the count reported by the proxy servers.
+func newServerCounter(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) (agent.ServerCounter, error) {
+	if o.ServerCountSource == options.ServerCountSourceHeader {
+		return nil, nil
+	}
+	client, err := newKubernetesClient(o)
+	if err != nil {
+		return nil, err
+	}
+	if o.ServerCountSource == options.ServerCountSourceLease {
+		return agent.NewLeaseServerCounter(client, o.ServerCountNamespace, o.ServerCountLabelSelector, stopCh)
+	}
+	return agent.NewEndpointSliceServerCounter(client, o.ServerCountNamespace, o.ServerCountLabelSelector, stopCh)
+}
+
+// newKubernetesClient returns a client of the cluster the proxy servers
+// run in.
+func newKubernetesClient(o *options.GrpcProxyAgentOptions) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", o.ServerCountKubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes clientset: %v", err)
+	}
+	return client, nil
+}
+
+func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) error {
 	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
@@ -99,18 +218,13 @@ func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions) error {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	go func() {
-		err := healthServer.ListenAndServe()
-		if err != nil {
-			klog.ErrorS(err, "health server could not listen")
-		}
-		klog.V(0).Infoln("Health server stopped listening")
-	}()
-
-	return nil
+	if o.HealthServerSocket != "" {
+		healthServer.Addr = o.HealthServerSocket
+	}
+	return serveHTTP(healthServer, o.HealthServerSocket, "health", stopCh)
 }
 
-func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions) error {
+func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions, cs *agent.ClientSet, stopCh <-chan struct{}) error {
 	muxHandler := http.NewServeMux()
 	muxHandler.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host, _, err := net.SplitHostPort(r.Host)
@@ -121,11 +235,14 @@ func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions) error {
 		}
 		http.Redirect(w, r, fmt.Sprintf("%s:%d%s", host, o.HealthServerPort, r.URL.Path), http.StatusMovedPermanently)
 	}))
+	if dialFailures := cs.DialFailures(); dialFailures != nil {
+		muxHandler.Handle("/debug/dial-failures", dialFailures)
+	}
+	util.InstallLogLevels(muxHandler)
 	if o.EnableProfiling {
-		muxHandler.HandleFunc("/debug/pprof", util.RedirectTo("/debug/pprof/"))
-		muxHandler.HandleFunc("/debug/pprof/", pprof.Index)
+		util.InstallProfiling(muxHandler)
 		if o.EnableContentionProfiling {
-			runtime.SetBlockProfileRate(1)
+			util.SetBlockProfileRate(1)
 		}
 	}
 
@@ -135,13 +252,34 @@ func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions) error {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	if o.AdminServerSocket != "" {
+		adminServer.Addr = o.AdminServerSocket
+	}
+	return serveHTTP(adminServer, o.AdminServerSocket, "admin", stopCh)
+}
+
+// serveHTTP serves srv on its TCP address, or on the local socket if
+// non-empty, until stopCh is closed.
+func serveHTTP(srv *http.Server, socket, name string, stopCh <-chan struct{}) error {
+	var lis net.Listener
+	var err error
+	if socket != "" {
+		lis, err = util.ListenLocal(socket)
+	} else {
+		lis, err = net.Listen("tcp", srv.Addr)
+	}
+	if err != nil {
+		return err
+	}
 	go func() {
-		err := adminServer.ListenAndServe()
-		if err != nil {
-			klog.ErrorS(err, "admin server could not listen")
+		<-stopCh
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "server stopped serving", "server", name)
 		}
-		klog.V(0).Infoln("Admin server stopped listening")
+		klog.V(0).InfoS("Server stopped listening", "server", name)
 	}()
-
 	return nil
 }
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/svc"
+	"k8s.io/klog/v2"
+)
+
+// serviceName is the name the agent registers with the service control
+// manager. It is ignored for services running in their own process.
+const serviceName = "konnectivity-agent"
+
+// runService runs the agent as a Windows service until the service control
+// manager stops it or the system shuts down.
+func runService(run func(stopCh <-chan struct{}) error) error {
+	s := &agentService{run: run}
+	if err := svc.Run(serviceName, s); err != nil {
+		return fmt.Errorf("failed to run as Windows service: %v", err)
+	}
+	return s.err
+}
+
+type agentService struct {
+	run func(stopCh <-chan struct{}) error
+	err error
+}
+
+var _ svc.Handler = &agentService{}
+
+// Execute runs the agent and reports its state to the service control
+// manager.
+func (s *agentService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+
+	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.run(stopCh)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case s.err = <-errCh:
+			if s.err != nil {
+				klog.ErrorS(s.err, "Agent service failed")
+				// A service specific exit code of 1.
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				klog.V(1).InfoS("Stopping agent service", "command", req.Cmd)
+				changes <- svc.Status{State: svc.StopPending}
+				close(stopCh)
+				s.err = <-errCh
+				klog.Flush()
+				return false, 0
+			default:
+				klog.V(2).InfoS("Ignoring unexpected service control request", "command", req.Cmd)
+			}
+		}
+	}
+}
@@ -0,0 +1,486 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// simulateServerOptions configures the simulated proxy server.
+type simulateServerOptions struct {
+	bindAddress     string
+	port            int
+	serverCert      string
+	serverKey       string
+	caCert          string
+	serverID        string
+	serverCount     int
+	script          string
+	stepTimeout     time.Duration
+	exitAfterScript bool
+}
+
+func newSimulateServerCommand() *cobra.Command {
+	o := &simulateServerOptions{
+		port:        8091,
+		serverID:    "simulated-server",
+		serverCount: 1,
+		stepTimeout: 10 * time.Second,
+	}
+	cmd := &cobra.Command{
+		Use:   "simulate-server",
+		Short: "Run a minimal proxy server that plays a script against the agents connecting to it.",
+		Long: `Accepts agent connections like the proxy server does and runs the script in --script against
+each connected agent. The script has one step per line, empty lines and lines starting with # are
+ignored:
+
+  dial <address>         dial address over tcp and wait for the agent to succeed
+  dial-error <address>   dial address over tcp and wait for the agent to fail
+  send <text>            send text on the dialed connection
+  expect <text>          wait until the data received on the dialed connection contains text
+  expect-close           wait until the agent closes the dialed connection
+  close                  close the dialed connection and wait for the agent to confirm
+  sleep <duration>       wait, e.g. sleep 500ms
+
+Text may be a double-quoted Go string to include escapes like \r\n.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := o.validate(); err != nil {
+				return err
+			}
+			steps, err := loadSimulationScript(o.script)
+			if err != nil {
+				return err
+			}
+			return o.run(steps)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.bindAddress, "simulated-server-bind-address", o.bindAddress, "Address the simulated server listens on for agents, all addresses if empty.")
+	flags.IntVar(&o.port, "simulated-server-port", o.port, "Port the simulated server listens on for agents.")
+	flags.StringVar(&o.serverCert, "simulated-server-cert", o.serverCert, "Certificate the simulated server presents to the agents.")
+	flags.StringVar(&o.serverKey, "simulated-server-key", o.serverKey, "Private key of --simulated-server-cert.")
+	flags.StringVar(&o.caCert, "simulated-server-ca-cert", o.caCert, "If non-empty, the CA the simulated server verifies the agent certificates with.")
+	flags.StringVar(&o.serverID, "simulated-server-id", o.serverID, "Server ID the simulated server reports to the agents.")
+	flags.IntVar(&o.serverCount, "simulated-server-count", o.serverCount, "Server count the simulated server reports to the agents.")
+	flags.StringVar(&o.script, "script", o.script, "File with the script to run against each connected agent, - for stdin.")
+	flags.DurationVar(&o.stepTimeout, "step-timeout", o.stepTimeout, "How long a step waits for the agent.")
+	flags.BoolVar(&o.exitAfterScript, "exit-after-script", o.exitAfterScript, "Exit once the script ran against the first agent, failing if the script failed.")
+	return cmd
+}
+
+func (o *simulateServerOptions) validate() error {
+	if o.serverCert == "" || o.serverKey == "" {
+		return fmt.Errorf("--simulated-server-cert and --simulated-server-key are required")
+	}
+	if o.port < 0 || o.port > 49151 {
+		return fmt.Errorf("port %d must be between 0 and 49151", o.port)
+	}
+	if o.serverCount < 1 {
+		return fmt.Errorf("server count %d must be positive", o.serverCount)
+	}
+	if o.script == "" {
+		return fmt.Errorf("--script is required")
+	}
+	if o.stepTimeout <= 0 {
+		return fmt.Errorf("step timeout %v must be positive", o.stepTimeout)
+	}
+	return nil
+}
+
+func (o *simulateServerOptions) tlsConfig() (*tls.Config, error) {
+	return simulatedServerTLSConfig(o.serverCert, o.serverKey, o.caCert)
+}
+
+// simulatedServerTLSConfig returns the TLS configuration of a server
+// agents connect to, presenting serverCert and verifying the agent
+// certificates against caCert if not empty.
+func simulatedServerTLSConfig(serverCert, serverKey, caCert string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the simulated server certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA certificate %s: %v", caCert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse the CA certificate %s", caCert)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// run serves agents until interrupted, or until the script ran against the
+// first agent with --exit-after-script.
+func (o *simulateServerOptions) run(steps []scriptStep) error {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(o.bindAddress, strconv.Itoa(o.port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	s := &simulatedServer{
+		serverID:    o.serverID,
+		serverCount: o.serverCount,
+		steps:       steps,
+		stepTimeout: o.stepTimeout,
+		results:     make(chan error, 1),
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	agent.RegisterAgentServiceServer(grpcServer, s)
+	go grpcServer.Serve(lis) /* #nosec G104 */
+	defer grpcServer.Stop()
+	klog.InfoS("Simulated server listening for agents", "address", lis.Addr(), "steps", len(steps))
+
+	signalCh := setupSignalHandler()
+	for {
+		select {
+		case <-signalCh:
+			klog.V(1).Infoln("Shutting down the simulated server.")
+			return nil
+		case err := <-s.results:
+			if o.exitAfterScript {
+				return err
+			}
+		}
+	}
+}
+
+// scriptStep is a step of a simulation script.
+type scriptStep struct {
+	op  string
+	arg string
+}
+
+func (s scriptStep) String() string {
+	if s.arg == "" {
+		return s.op
+	}
+	return s.op + " " + s.arg
+}
+
+func loadSimulationScript(path string) ([]scriptStep, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the script: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseSimulationScript(r)
+}
+
+// parseSimulationScript parses a script with one step per line.
+func parseSimulationScript(r io.Reader) ([]scriptStep, error) {
+	var steps []scriptStep
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		op, arg := text, ""
+		if i := strings.IndexAny(text, " \t"); i > 0 {
+			op, arg = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		switch op {
+		case "dial", "dial-error":
+			if _, _, err := net.SplitHostPort(arg); err != nil {
+				return nil, fmt.Errorf("line %d: address %q must be host:port: %v", line, arg, err)
+			}
+		case "send", "expect":
+			if strings.HasPrefix(arg, `"`) {
+				unquoted, err := strconv.Unquote(arg)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid quoted text %s: %v", line, arg, err)
+				}
+				arg = unquoted
+			}
+			if arg == "" {
+				return nil, fmt.Errorf("line %d: %s needs a text", line, op)
+			}
+		case "sleep":
+			if _, err := time.ParseDuration(arg); err != nil {
+				return nil, fmt.Errorf("line %d: invalid duration %q: %v", line, arg, err)
+			}
+		case "close", "expect-close":
+			if arg != "" {
+				return nil, fmt.Errorf("line %d: %s takes no argument", line, op)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown step %q", line, op)
+		}
+		steps = append(steps, scriptStep{op: op, arg: arg})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the script: %v", err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("the script has no steps")
+	}
+	return steps, nil
+}
+
+// simulatedServer accepts agent connections and runs the script against
+// each of them.
+type simulatedServer struct {
+	agent.UnimplementedAgentServiceServer
+
+	serverID    string
+	serverCount int
+	steps       []scriptStep
+	stepTimeout time.Duration
+	nextDialID  int64
+
+	// results receives the result of each script run, if not busy.
+	results chan error
+}
+
+func (s *simulatedServer) Connect(stream agent.AgentService_ConnectServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	agentID := strings.Join(md.Get(header.AgentID), ",")
+	klog.InfoS("Agent connected", "agentID", agentID, "agentIdentifiers", md.Get(header.AgentIdentifiers),
+		"capabilities", md.Get(header.AgentCapabilities), "protocolVersion", md.Get(header.ProtocolVersion))
+
+	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.serverCount))
+	if err := stream.SendHeader(h); err != nil {
+		klog.ErrorS(err, "Failed to send the headers", "agentID", agentID)
+		return err
+	}
+
+	packets := make(chan *client.Packet, 10)
+	go func() {
+		defer close(packets)
+		for {
+			pkt, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					klog.V(2).InfoS("Stream from agent ended", "agentID", agentID, "err", err)
+				}
+				return
+			}
+			packets <- pkt
+		}
+	}()
+
+	r := &scriptRun{server: s, stream: stream, packets: packets}
+	err := r.run(s.steps)
+	if err != nil {
+		klog.ErrorS(err, "Script failed", "agentID", agentID)
+	} else {
+		klog.InfoS("Script passed", "agentID", agentID)
+	}
+	select {
+	case s.results <- err:
+	default:
+	}
+
+	// Keep the agent connected, so it does not reconnect and run the
+	// script again.
+	for range packets {
+	}
+	klog.InfoS("Agent disconnected", "agentID", agentID)
+	return nil
+}
+
+// scriptRun runs a script against one agent.
+type scriptRun struct {
+	server  *simulatedServer
+	stream  agent.AgentService_ConnectServer
+	packets <-chan *client.Packet
+
+	// connectID is the connection of the last dial, 0 if none.
+	connectID int64
+	// received is the data received on the connection not matched yet.
+	received []byte
+}
+
+func (r *scriptRun) run(steps []scriptStep) error {
+	for i, step := range steps {
+		klog.V(2).InfoS("Running step", "step", i+1, "op", step.op, "arg", step.arg)
+		if err := r.step(step); err != nil {
+			return fmt.Errorf("step %d (%s): %v", i+1, step, err)
+		}
+	}
+	return nil
+}
+
+func (r *scriptRun) step(step scriptStep) error {
+	switch step.op {
+	case "dial", "dial-error":
+		return r.dial(step.arg, step.op == "dial-error")
+	case "send":
+		if r.connectID == 0 {
+			return fmt.Errorf("no connection dialed")
+		}
+		return r.stream.Send(&client.Packet{
+			Type:    client.PacketType_DATA,
+			Payload: &client.Packet_Data{Data: &client.Data{ConnectID: r.connectID, Data: []byte(step.arg)}},
+		})
+	case "expect":
+		want := []byte(step.arg)
+		matched := func() bool {
+			i := bytes.Index(r.received, want)
+			if i < 0 {
+				return false
+			}
+			r.received = r.received[i+len(want):]
+			return true
+		}
+		if matched() {
+			return nil
+		}
+		_, err := r.await(func(pkt *client.Packet) bool {
+			return pkt.Type == client.PacketType_DATA && matched()
+		})
+		return err
+	case "expect-close":
+		if r.connectID == 0 {
+			return fmt.Errorf("no connection dialed")
+		}
+		connectID := r.connectID
+		_, err := r.await(func(pkt *client.Packet) bool {
+			return pkt.Type == client.PacketType_CLOSE_RSP && pkt.GetCloseResponse().ConnectID == connectID
+		})
+		r.connectID = 0
+		return err
+	case "close":
+		if r.connectID == 0 {
+			return fmt.Errorf("no connection dialed")
+		}
+		connectID := r.connectID
+		err := r.stream.Send(&client.Packet{
+			Type:    client.PacketType_CLOSE_REQ,
+			Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connectID}},
+		})
+		if err != nil {
+			return err
+		}
+		pkt, err := r.await(func(pkt *client.Packet) bool {
+			return pkt.Type == client.PacketType_CLOSE_RSP && pkt.GetCloseResponse().ConnectID == connectID
+		})
+		r.connectID = 0
+		if err != nil {
+			return err
+		}
+		if e := pkt.GetCloseResponse().Error; e != "" {
+			return fmt.Errorf("agent failed to close the connection: %s", e)
+		}
+		return nil
+	case "sleep":
+		d, _ := time.ParseDuration(step.arg)
+		time.Sleep(d)
+		return nil
+	}
+	return fmt.Errorf("unknown step %q", step.op)
+}
+
+// dial sends a DIAL_REQ for address and waits for the DIAL_RSP.
+func (r *scriptRun) dial(address string, wantError bool) error {
+	random := atomic.AddInt64(&r.server.nextDialID, 1)
+	err := r.stream.Send(&client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: "tcp",
+			Address:  address,
+			Random:   random,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	pkt, err := r.await(func(pkt *client.Packet) bool {
+		return pkt.Type == client.PacketType_DIAL_RSP && pkt.GetDialResponse().Random == random
+	})
+	if err != nil {
+		return err
+	}
+	resp := pkt.GetDialResponse()
+	switch {
+	case wantError && resp.Error == "":
+		return fmt.Errorf("expected the dial of %s to fail, got connection %d", address, resp.ConnectID)
+	case wantError:
+		klog.V(2).InfoS("Dial failed as expected", "address", address, "err", resp.Error)
+		return nil
+	case resp.Error != "":
+		return fmt.Errorf("dial of %s failed: %s", address, resp.Error)
+	}
+	r.connectID = resp.ConnectID
+	r.received = nil
+	return nil
+}
+
+// await waits up to the step timeout for a packet matching match, keeping
+// the data received on the dialed connection meanwhile.
+func (r *scriptRun) await(match func(*client.Packet) bool) (*client.Packet, error) {
+	timer := time.NewTimer(r.server.stepTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case pkt, ok := <-r.packets:
+			if !ok {
+				return nil, fmt.Errorf("agent disconnected")
+			}
+			if pkt.Type == client.PacketType_DATA && r.connectID != 0 && pkt.GetData().ConnectID == r.connectID {
+				r.received = append(r.received, pkt.GetData().Data...)
+			}
+			if match(pkt) {
+				return pkt, nil
+			}
+			klog.V(4).InfoS("Ignoring packet", "type", pkt.Type)
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out after %v", r.server.stepTimeout)
+		}
+	}
+}
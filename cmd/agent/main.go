@@ -32,7 +32,8 @@ func main() {
 	agent := &app.Agent{}
 	o := options.NewGrpcProxyAgentOptions()
 	command := app.NewAgentCommand(agent, o)
-	flags := command.Flags()
+	// Persistent flags are shared by the subcommands.
+	flags := command.PersistentFlags()
 	flags.AddFlagSet(o.Flags())
 	local := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	klog.InitFlags(local)
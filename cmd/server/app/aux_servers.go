@@ -0,0 +1,185 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// auxServer is an auxiliary HTTP server of the proxy server, serving the
+// health checks, the admin endpoints or the metrics.
+type auxServer struct {
+	name     string
+	server   *http.Server
+	listener net.Listener
+}
+
+// newAuxServer binds the auxiliary server name to bindAddress:port. It
+// serves TLS with the key pair of certFile and keyFile if set.
+func newAuxServer(name, bindAddress string, port uint, certFile, keyFile string, handler http.Handler) (*auxServer, error) {
+	srv := &http.Server{
+		Addr:           net.JoinHostPort(bindAddress, strconv.FormatUint(uint64(port), 10)),
+		Handler:        handler,
+		MaxHeaderBytes: 1 << 20,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load X509 key pair %s and %s of the %s server: %v", certFile, keyFile, name, err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s for the %s server: %v", srv.Addr, name, err)
+	}
+	if srv.TLSConfig != nil {
+		lis = tls.NewListener(lis, srv.TLSConfig)
+	}
+	return &auxServer{name: name, server: srv, listener: lis}, nil
+}
+
+// serve serves the requests until the server is shut down.
+func (s *auxServer) serve() {
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "Auxiliary server stopped serving", "server", s.name)
+		}
+		klog.V(1).InfoS("Auxiliary server stopped listening", "server", s.name)
+	}()
+}
+
+// shutdown stops the server from accepting requests, and waits up to
+// timeout for the requests in flight before closing their connections.
+func (s *auxServer) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		klog.ErrorS(err, "Auxiliary server did not shut down gracefully", "server", s.name)
+		s.server.Close() /* #nosec G104 */
+	}
+}
+
+// runAuxServers starts the enabled health, admin and metrics servers.
+func (p *Proxy) runAuxServers(o *options.ProxyRunOptions, s *server.ProxyServer) ([]*auxServer, error) {
+	var servers []*auxServer
+	start := func(name, bindAddress string, port uint, certFile, keyFile string, handler http.Handler) error {
+		klog.V(1).InfoS("Starting auxiliary server", "server", name, "address", bindAddress, "port", port, "tls", certFile != "")
+		srv, err := newAuxServer(name, bindAddress, port, certFile, keyFile, handler)
+		if err != nil {
+			return err
+		}
+		srv.serve()
+		servers = append(servers, srv)
+		return nil
+	}
+	var err error
+	if o.HealthPort != 0 {
+		err = start("health", o.HealthBindAddress, o.HealthPort, o.HealthCert, o.HealthKey, healthHandler(s))
+	}
+	if err == nil && o.AdminPort != 0 {
+		err = start("admin", o.AdminBindAddress, o.AdminPort, o.AdminCert, o.AdminKey, adminHandler(o, s, o.MetricsPort == 0))
+	}
+	if err == nil && o.MetricsPort != 0 {
+		err = start("metrics", o.MetricsBindAddress, o.MetricsPort, o.MetricsCert, o.MetricsKey, metricsHandler())
+	}
+	if err != nil {
+		shutdownAuxServers(servers, 0)
+		return nil, err
+	}
+	return servers, nil
+}
+
+// shutdownAuxServers shuts the servers down concurrently, within timeout.
+func shutdownAuxServers(servers []*auxServer, timeout time.Duration) {
+	done := make(chan struct{}, len(servers))
+	for _, srv := range servers {
+		go func(srv *auxServer) {
+			srv.shutdown(timeout)
+			done <- struct{}{}
+		}(srv)
+	}
+	for range servers {
+		<-done
+	}
+}
+
+// healthHandler serves the liveness and readiness of s, and its scaling
+// hints.
+func healthHandler(s *server.ProxyServer) http.Handler {
+	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	readinessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, msg := s.Readiness.Ready()
+		if ready {
+			w.WriteHeader(200)
+			fmt.Fprintf(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, msg)
+	})
+
+	muxHandler := http.NewServeMux()
+	muxHandler.HandleFunc("/healthz", livenessHandler)
+	// "/ready" is deprecated but being maintained for backward compatibility
+	muxHandler.HandleFunc("/ready", readinessHandler)
+	muxHandler.HandleFunc("/readyz", readinessHandler)
+	muxHandler.HandleFunc("/scale-hints", s.ServeScaleHints)
+	return muxHandler
+}
+
+// adminHandler serves the debug endpoints of s, and the metrics if
+// withMetrics.
+func adminHandler(o *options.ProxyRunOptions, s *server.ProxyServer, withMetrics bool) http.Handler {
+	muxHandler := http.NewServeMux()
+	if withMetrics {
+		muxHandler.Handle("/metrics", promhttp.Handler())
+	}
+	muxHandler.HandleFunc("/debug/peaks", s.ServePeaks)
+	muxHandler.HandleFunc("/debug/circuit-breakers", s.ServeCircuitBreakers)
+	muxHandler.HandleFunc("/debug/anomalies", s.ServeAnomalies)
+	util.InstallLogLevels(muxHandler)
+	if o.EnableProfiling {
+		util.InstallProfiling(muxHandler)
+		if o.EnableContentionProfiling {
+			util.SetBlockProfileRate(1)
+		}
+	}
+	return muxHandler
+}
+
+// metricsHandler serves the metrics alone.
+func metricsHandler() http.Handler {
+	muxHandler := http.NewServeMux()
+	muxHandler.Handle("/metrics", promhttp.Handler())
+	return muxHandler
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+type fakeReadiness struct {
+	ready bool
+}
+
+func (r fakeReadiness) Ready() (bool, string) {
+	if r.ready {
+		return true, ""
+	}
+	return false, "no connection to any proxy agent"
+}
+
+func serveStatus(h http.Handler, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	for _, ready := range []bool{true, false} {
+		h := healthHandler(&server.ProxyServer{Readiness: fakeReadiness{ready: ready}})
+		if code := serveStatus(h, "/healthz"); code != http.StatusOK {
+			t.Errorf("ready %v: expected /healthz status %d, got %d", ready, http.StatusOK, code)
+		}
+		want := http.StatusOK
+		if !ready {
+			want = http.StatusServiceUnavailable
+		}
+		for _, path := range []string{"/ready", "/readyz"} {
+			if code := serveStatus(h, path); code != want {
+				t.Errorf("ready %v: expected %s status %d, got %d", ready, path, want, code)
+			}
+		}
+	}
+}
+
+func TestAdminHandlerMetrics(t *testing.T) {
+	o := options.NewProxyRunOptions()
+	s := &server.ProxyServer{}
+	if code := serveStatus(adminHandler(o, s, true), "/metrics"); code != http.StatusOK {
+		t.Errorf("expected /metrics status %d on the admin server, got %d", http.StatusOK, code)
+	}
+	if code := serveStatus(adminHandler(o, s, false), "/metrics"); code != http.StatusNotFound {
+		t.Errorf("expected /metrics status %d on the admin server with a metrics server, got %d", http.StatusNotFound, code)
+	}
+	if code := serveStatus(metricsHandler(), "/metrics"); code != http.StatusOK {
+		t.Errorf("expected /metrics status %d on the metrics server, got %d", http.StatusOK, code)
+	}
+	if code := serveStatus(metricsHandler(), "/debug/peaks"); code != http.StatusNotFound {
+		t.Errorf("expected /debug/peaks status %d on the metrics server, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestAuxServerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("ok"))
+	})
+	srv, err := newAuxServer("test", "127.0.0.1", 0, "", "", handler)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	srv.serve()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + srv.listener.Addr().String() + "/")
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resCh <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.shutdown(wait.ForeverTestTimeout)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("expected shutdown to wait for the request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	res := <-resCh
+	if res.err != nil || res.body != "ok" {
+		t.Errorf("expected the request in flight to complete, got %q, %v", res.body, res.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected shutdown to complete")
+	}
+	if _, err := http.Get("http://" + srv.listener.Addr().String() + "/"); err == nil {
+		t.Error("expected the server to refuse requests after shutdown")
+	}
+}
+
+func TestNewAuxServerMissingCert(t *testing.T) {
+	if _, err := newAuxServer("test", "127.0.0.1", 0, "missing.crt", "missing.key", http.NotFoundHandler()); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+func newRunCommand(p *Proxy, o *options.ProxyRunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "run",
+		Short: "Run the proxy server. This is the default if no command is given.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			return p.run(o)
+		},
+	}
+}
+
+func newValidateCommand(p *Proxy, o *options.ProxyRunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the configuration and load the certificates, then exit.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			return p.validate(cmd.OutOrStdout(), o)
+		},
+	}
+}
+
+func newVersionCommand() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and the supported features of the proxy server.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printVersion(cmd.OutOrStdout(), output)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "json", "Output format, either 'json' or 'text'.")
+	return cmd
+}
+
+func newDumpConfigCommand(o *options.ProxyRunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump-config",
+		Short: "Print the effective configuration as JSON, after applying the config file and the profile.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(o)
+		},
+	}
+}
+
+// serverVersion is the output of the version command.
+type serverVersion struct {
+	util.VersionInfo
+	ProxyStrategies []server.ProxyStrategy `json:"proxyStrategies"`
+	DataCompression []string               `json:"dataCompression"`
+	Profiles        []string               `json:"profiles"`
+}
+
+func printVersion(w io.Writer, output string) error {
+	v := serverVersion{
+		VersionInfo:     util.GetVersionInfo(),
+		ProxyStrategies: []server.ProxyStrategy{server.ProxyStrategyDefault, server.ProxyStrategyDestHost, server.ProxyStrategyDestHostHash, server.ProxyStrategyDefaultRoute, server.ProxyStrategyLabelSelector},
+		DataCompression: []string{util.CompressionGzip},
+		Profiles:        options.ProfileNames(),
+	}
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "text":
+		_, err := fmt.Fprintf(w, "Version: %s\nCommit: %s\nGo: %s\nPlatform: %s\nProxy strategies: %v\nData compression: %v\nProfiles: %v\n",
+			v.GitVersion, v.GitCommit, v.GoVersion, v.Platform, v.ProxyStrategies, v.DataCompression, v.Profiles)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, must be 'json' or 'text'", output)
+	}
+}
+
+// validate validates the options and loads the configured certificates,
+// reporting each step to w.
+func (p *Proxy) validate(w io.Writer, o *options.ProxyRunOptions) error {
+	if err := o.Validate(); err != nil {
+		fmt.Fprintf(w, "[FAIL] options: %v\n", err)
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	fmt.Fprintln(w, "[OK] options")
+
+	if o.ServerCert != "" {
+		if _, err := p.getTLSConfig(o.ServerCaCert, o.ServerCert, o.ServerKey, o.CipherSuites); err != nil {
+			fmt.Fprintf(w, "[FAIL] frontend credentials: %v\n", err)
+			return err
+		}
+		fmt.Fprintln(w, "[OK] frontend credentials")
+	}
+	if o.ClusterCert != "" {
+		if _, err := p.getClusterTLSConfig(o); err != nil {
+			fmt.Fprintf(w, "[FAIL] agent credentials: %v\n", err)
+			return err
+		}
+		fmt.Fprintln(w, "[OK] agent credentials")
+	}
+	if _, err := server.GenProxyStrategiesFromStr(o.ProxyStrategies); err != nil {
+		fmt.Fprintf(w, "[FAIL] proxy strategies: %v\n", err)
+		return err
+	}
+	fmt.Fprintln(w, "[OK] proxy strategies")
+	return nil
+}
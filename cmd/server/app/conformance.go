@@ -0,0 +1,205 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/conformance"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// conformanceOptions configures the server conformance suite.
+type conformanceOptions struct {
+	agentAddress            string
+	agentCACert             string
+	agentCert               string
+	agentKey                string
+	serviceAccountTokenPath string
+	frontendAddress         string
+	frontendCACert          string
+	frontendCert            string
+	frontendKey             string
+	serverBinary            string
+	serverArgs              []string
+	cases                   []string
+	stepTimeout             time.Duration
+	connectTimeout          time.Duration
+	report                  string
+}
+
+func newConformanceCommand() *cobra.Command {
+	o := &conformanceOptions{
+		agentAddress:    "127.0.0.1:8091",
+		frontendAddress: "127.0.0.1:8090",
+		stepTimeout:     conformance.DefaultStepTimeout,
+		connectTimeout:  time.Minute,
+	}
+	var caseNames []string
+	for _, c := range conformance.ServerCases() {
+		caseNames = append(caseNames, fmt.Sprintf("  %-18s %s", c.Name, c.Description))
+	}
+	cmd := &cobra.Command{
+		Use:   "conformance",
+		Short: "Verify that a proxy server build speaks the agent and client protocols of this agent.",
+		Long: `Connects to a proxy server as a fake agent and as a client, runs the conformance cases over the
+wire protocol, then prints a pass/fail report and fails if a case failed. The server must have no other
+agent connected. It is started with --server-binary and --server-args, listening on --agent-address and
+--frontend-address, or started separately. The cases are:
+
+` + strings.Join(caseNames, "\n"),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := o.validate(); err != nil {
+				return err
+			}
+			return o.run()
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&o.agentAddress, "agent-address", o.agentAddress, "host:port of the agent port of the proxy server.")
+	flags.StringVar(&o.agentCACert, "agent-ca-cert", o.agentCACert, "If non-empty, the CA the fake agent verifies the proxy server with, the system CAs otherwise.")
+	flags.StringVar(&o.agentCert, "agent-cert", o.agentCert, "If non-empty, the client certificate of the fake agent.")
+	flags.StringVar(&o.agentKey, "agent-key", o.agentKey, "Private key of --agent-cert.")
+	flags.StringVar(&o.serviceAccountTokenPath, "agent-service-account-token-path", o.serviceAccountTokenPath, "If non-empty, the fake agent authenticates with the service account token in this file.")
+	flags.StringVar(&o.frontendAddress, "frontend-address", o.frontendAddress, "host:port of the gRPC frontend port of the proxy server, or unix:///path of its UDS.")
+	flags.StringVar(&o.frontendCACert, "frontend-ca-cert", o.frontendCACert, "If non-empty, the CA the client verifies the proxy server with, the system CAs otherwise. Ignored for a UDS.")
+	flags.StringVar(&o.frontendCert, "frontend-cert", o.frontendCert, "If non-empty, the client certificate of the client.")
+	flags.StringVar(&o.frontendKey, "frontend-key", o.frontendKey, "Private key of --frontend-cert.")
+	flags.StringVar(&o.serverBinary, "server-binary", o.serverBinary, "Proxy server binary to start and test. If empty, the suite connects to a server started separately.")
+	flags.StringSliceVar(&o.serverArgs, "server-args", o.serverArgs, "Arguments of --server-binary, e.g. its certificates and ports.")
+	flags.StringSliceVar(&o.cases, "cases", o.cases, "Cases to run, all if empty.")
+	flags.DurationVar(&o.stepTimeout, "step-timeout", o.stepTimeout, "How long a step waits for the server.")
+	flags.DurationVar(&o.connectTimeout, "connect-timeout", o.connectTimeout, "How long the suite waits for the fake agent to connect.")
+	flags.StringVar(&o.report, "report", o.report, "If non-empty, file the report is written to as JSON.")
+	return cmd
+}
+
+func (o *conformanceOptions) validate() error {
+	if _, _, err := net.SplitHostPort(o.agentAddress); err != nil {
+		return fmt.Errorf("agent address %q must be host:port: %v", o.agentAddress, err)
+	}
+	if !strings.HasPrefix(o.frontendAddress, "unix://") {
+		if _, _, err := net.SplitHostPort(o.frontendAddress); err != nil {
+			return fmt.Errorf("frontend address %q must be host:port or unix:///path: %v", o.frontendAddress, err)
+		}
+	}
+	if (o.agentCert == "") != (o.agentKey == "") {
+		return fmt.Errorf("--agent-cert and --agent-key must be set together")
+	}
+	if (o.frontendCert == "") != (o.frontendKey == "") {
+		return fmt.Errorf("--frontend-cert and --frontend-key must be set together")
+	}
+	if o.stepTimeout <= 0 {
+		return fmt.Errorf("step timeout %v must be positive", o.stepTimeout)
+	}
+	if o.connectTimeout <= 0 {
+		return fmt.Errorf("connect timeout %v must be positive", o.connectTimeout)
+	}
+	return nil
+}
+
+func (o *conformanceOptions) run() error {
+	host, _, _ := net.SplitHostPort(o.agentAddress)
+	agentTLSConfig, err := util.GetClientTLSConfig(o.agentCACert, o.agentCert, o.agentKey, host, nil)
+	if err != nil {
+		return err
+	}
+	// The frontend UDS of the proxy server is not secured with TLS.
+	frontendCreds := grpc.WithInsecure()
+	if !strings.HasPrefix(o.frontendAddress, "unix://") {
+		host, _, _ := net.SplitHostPort(o.frontendAddress)
+		frontendTLSConfig, err := util.GetClientTLSConfig(o.frontendCACert, o.frontendCert, o.frontendKey, host, nil)
+		if err != nil {
+			return err
+		}
+		frontendCreds = grpc.WithTransportCredentials(credentials.NewTLS(frontendTLSConfig))
+	}
+	var token string
+	if o.serviceAccountTokenPath != "" {
+		data, err := ioutil.ReadFile(o.serviceAccountTokenPath)
+		if err != nil {
+			return fmt.Errorf("failed to read the service account token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	suite, err := conformance.NewServerSuite(conformance.ServerConfig{
+		AgentAddress:        o.agentAddress,
+		AgentDialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(agentTLSConfig))},
+		AgentToken:          token,
+		FrontendAddress:     o.frontendAddress,
+		FrontendDialOptions: []grpc.DialOption{frontendCreds},
+		StepTimeout:         o.stepTimeout,
+		Cases:               o.cases,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if o.serverBinary != "" {
+		serverCmd := exec.CommandContext(ctx, o.serverBinary, o.serverArgs...) /* #nosec G204 */
+		serverCmd.Stdout = os.Stderr
+		serverCmd.Stderr = os.Stderr
+		if err := serverCmd.Start(); err != nil {
+			return fmt.Errorf("failed to start the proxy server %s: %v", o.serverBinary, err)
+		}
+		defer func() {
+			cancel()
+			serverCmd.Wait() /* #nosec G104 */
+		}()
+	}
+	klog.InfoS("Connecting the conformance suite to the proxy server", "agentAddress", o.agentAddress, "frontendAddress", o.frontendAddress)
+
+	connectCtx, connectCancel := context.WithTimeout(ctx, o.connectTimeout)
+	defer connectCancel()
+	report, err := suite.Run(connectCtx)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteText(os.Stdout); err != nil {
+		return err
+	}
+	if o.report != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(o.report, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write the report: %v", err)
+		}
+	}
+	if !report.Passed() {
+		return fmt.Errorf("the proxy server failed the conformance suite")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/apis/config"
+)
+
+// Complete applies the config file and then the profile to the flags not
+// set on the command line. It must be called after the flags have been
+// parsed.
+func (o *ProxyRunOptions) Complete(flags *pflag.FlagSet) error {
+	o.flags = flags
+	o.commandLine = make(map[string]bool)
+	flags.Visit(func(f *pflag.Flag) {
+		o.commandLine[f.Name] = true
+	})
+	if o.ConfigFile != "" {
+		c, err := config.Load(o.ConfigFile, config.KindProxyServer)
+		if err != nil {
+			return err
+		}
+		if err := c.Apply(flags); err != nil {
+			return err
+		}
+	}
+	return o.ApplyProfile(flags)
+}
+
+// Reload reads the config file again and returns the validated options it
+// results in, leaving o unchanged. Flags set on the command line keep
+// their value, as do options removed from the file until a restart. Flags
+// not owned by the options, such as the log verbosity, take effect right
+// away.
+func (o *ProxyRunOptions) Reload() (*ProxyRunOptions, error) {
+	if o.ConfigFile == "" || o.flags == nil {
+		return nil, fmt.Errorf("no config file to reload")
+	}
+	c, err := config.Load(o.ConfigFile, config.KindProxyServer)
+	if err != nil {
+		return nil, err
+	}
+	reloaded := *o
+	flags := reloaded.Flags()
+	o.flags.VisitAll(func(f *pflag.Flag) {
+		if flags.Lookup(f.Name) == nil {
+			// Shares the value, but not whether it was set.
+			shared := *f
+			shared.Changed = false
+			flags.AddFlag(&shared)
+		}
+	})
+	for name := range o.commandLine {
+		if f := flags.Lookup(name); f != nil {
+			f.Changed = true
+		}
+	}
+	if err := c.Apply(flags); err != nil {
+		return nil, err
+	}
+	if err := reloaded.Validate(); err != nil {
+		return nil, err
+	}
+	return &reloaded, nil
+}
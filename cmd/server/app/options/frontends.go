@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Frontend modes.
+const (
+	ModeGRPC        = "grpc"
+	ModeHTTPConnect = "http-connect"
+)
+
+// FrontendListener is a listener serving frontends in one mode, on a TCP
+// port or on a unix domain socket.
+type FrontendListener struct {
+	// Mode is ModeGRPC or ModeHTTPConnect.
+	Mode string
+	// Port is the TCP port, 0 for a unix domain socket.
+	Port uint
+	// UdsName is the name of the unix domain socket, empty for TCP.
+	UdsName string
+}
+
+func (l FrontendListener) String() string {
+	if l.UdsName != "" {
+		return l.Mode + "=" + l.UdsName
+	}
+	return l.Mode + "=" + strconv.FormatUint(uint64(l.Port), 10)
+}
+
+// ParseFrontendListener parses mode=port or mode=uds-name, e.g.
+// "http-connect=8093" or "grpc=/var/run/konnectivity-server.sock".
+func ParseFrontendListener(spec string) (FrontendListener, error) {
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return FrontendListener{}, fmt.Errorf("frontend %q must be mode=port or mode=uds-name", spec)
+	}
+	l := FrontendListener{Mode: kv[0]}
+	if l.Mode != ModeGRPC && l.Mode != ModeHTTPConnect {
+		return FrontendListener{}, fmt.Errorf("frontend %q: mode must be either 'grpc' or 'http-connect' not %q", spec, l.Mode)
+	}
+	if port, err := strconv.ParseUint(kv[1], 10, 16); err == nil {
+		l.Port = uint(port)
+	} else {
+		l.UdsName = kv[1]
+	}
+	return l, nil
+}
+
+// FrontendListeners returns the listener of --mode, --server-port and
+// --uds-name, followed by the AdditionalFrontends.
+func (o *ProxyRunOptions) FrontendListeners() ([]FrontendListener, error) {
+	listeners := []FrontendListener{{Mode: o.Mode, Port: o.ServerPort, UdsName: o.UdsName}}
+	if o.UdsName != "" {
+		listeners[0].Port = 0
+	}
+	for _, spec := range o.AdditionalFrontends {
+		l, err := ParseFrontendListener(spec)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// hasFrontend reports whether a frontend listener matches.
+func (o *ProxyRunOptions) hasFrontend(match func(FrontendListener) bool) bool {
+	listeners, _ := o.FrontendListeners()
+	for _, l := range listeners {
+		if match(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// servesOnlyGRPC reports whether all frontends are served in grpc mode.
+func (o *ProxyRunOptions) servesOnlyGRPC() bool {
+	return !o.hasFrontend(func(l FrontendListener) bool { return l.Mode != ModeGRPC })
+}
+
+// servesTCP reports whether frontends are served on a TCP port, over mTLS.
+func (o *ProxyRunOptions) servesTCP() bool {
+	return o.hasFrontend(func(l FrontendListener) bool { return l.UdsName == "" })
+}
+
+// validateAdditionalFrontends checks the AdditionalFrontends, and that no
+// two frontend listeners share a port or a socket.
+func (o *ProxyRunOptions) validateAdditionalFrontends() error {
+	listeners, err := o.FrontendListeners()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for i, l := range listeners {
+		addr := l.UdsName
+		if addr == "" {
+			addr = ":" + strconv.FormatUint(uint64(l.Port), 10)
+		}
+		if seen[addr] {
+			return fmt.Errorf("frontend listener %s is configured more than once", addr)
+		}
+		seen[addr] = true
+		if i == 0 {
+			// validated as --mode, --server-port and --uds-name
+			continue
+		}
+		if l.UdsName == "" {
+			if l.Port < 1024 || l.Port > 49151 {
+				return fmt.Errorf("frontend %s: port must be between 1024 and 49151", l)
+			}
+			continue
+		}
+		if IsAbstractSocket(l.UdsName) {
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("abstract unix domain socket %q is only supported on Linux", l.UdsName)
+			}
+			if o.UDSMode != "" || o.UDSUID != -1 || o.UDSGID != -1 {
+				return fmt.Errorf("abstract unix domain socket %q has no file mode or owner", l.UdsName)
+			}
+		}
+		if (len(o.UDSAllowedPeerUIDs) > 0 || len(o.UDSAllowedPeerGIDs) > 0) && runtime.GOOS != "linux" {
+			return fmt.Errorf("unix domain socket peer verification is only supported on Linux")
+		}
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package options
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,37 +15,271 @@ import (
 	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
 
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/apis/config"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
 type ProxyRunOptions struct {
+	// Path to a versioned YAML or JSON configuration file setting flags.
+	// Flags set on the command line take precedence over the file.
+	ConfigFile string
+	// flags are the parsed flags and commandLine the names of the flags
+	// set on the command line, recorded by Complete to reload ConfigFile.
+	flags       *pflag.FlagSet
+	commandLine map[string]bool
+	// Named preset of flag values for a common deployment shape. Explicitly
+	// set flags take precedence over the profile.
+	Profile string
+
 	// Certificate setup for securing communication to the "client" i.e. the Kube API Server.
 	ServerCert   string
 	ServerKey    string
 	ServerCaCert string
+	// Methods authenticating the frontends in grpc mode, "certificate"
+	// and "token", the names client certificates must have, and the
+	// static token file.
+	FrontendAuthentication []string
+	FrontendAllowedNames   []string
+	FrontendTokenAuthFile  string
+	// subject=destination rules of the destinations frontends may dial.
+	// Empty allows any.
+	FrontendAuthorizationRules []string
+	// namespace/name of the ConfigMap holding the EgressPolicy enforced on
+	// the dials of the frontends, and whether any dial is allowed while
+	// it does not exist rather than none.
+	EgressPolicyConfigMap    string
+	EgressPolicyAllowMissing bool
+	// Proxy-Authorization schemes of the CONNECT requests in http-connect
+	// mode, "basic" and "bearer", with the static files and the token
+	// review webhook verifying them. Empty accepts any request.
+	ConnectAuthentication     []string
+	ConnectBasicAuthFile      string
+	ConnectTokenAuthFile      string
+	ConnectAuthWebhookURL     string
+	ConnectAuthWebhookCACert  string
+	ConnectAuthWebhookTimeout time.Duration
+	// Limits of the request headers of CONNECT requests, in bytes and in
+	// number of headers. Larger requests are rejected. 0 means no limit.
+	HTTPConnectMaxHeaderBytes int
+	HTTPConnectMaxHeaderCount int
 	// Certificate setup for securing communication to the "agent" i.e. the managed cluster.
 	ClusterCert   string
 	ClusterKey    string
 	ClusterCaCert string
+	// File of base64 encoded TLS session ticket keys of the agent
+	// listener, shared by all proxy server instances so that agents can
+	// resume their sessions with any of them. Empty uses random keys.
+	ClusterSessionTicketKeyFile string
+	// Maximum number of concurrent TLS handshakes of agent connections.
+	// 0 leaves them unbounded.
+	MaxConcurrentAgentHandshakes int
+	// How long an agent TLS handshake waits for the handshake budget
+	// before the connection is rejected.
+	AgentHandshakeQueueTimeout time.Duration
 	// Flag to switch between gRPC and HTTP Connect
 	Mode string
 	// Location for use by the "unix" network. Setting enables UDS for server connections.
 	UdsName string
 	// If file UdsName already exists, delete the file before listen on that UDS file.
 	DeleteUDSFile bool
+	// Octal file mode and owner of the UdsName socket file. An empty mode
+	// and IDs of -1 keep the defaults.
+	UDSMode string
+	UDSUID  int
+	UDSGID  int
+	// If non-empty, only processes running as one of these users or in
+	// one of these groups may connect to the UdsName socket.
+	UDSAllowedPeerUIDs []uint
+	UDSAllowedPeerGIDs []uint
+	// Further frontend listeners, mode=port or mode=uds-name, served
+	// along with the one of Mode, ServerPort and UdsName.
+	AdditionalFrontends []string
 	// Port we listen for server connections on.
 	ServerPort uint
 	// Port we listen for agent connections on.
 	AgentPort uint
-	// Port we listen for admin connections on.
+	// Port we listen for agent connections tunneled over WebSocket on. 0 disables it.
+	AgentWebSocketPort uint
+	// Port we listen for admin connections on. 0 disables the admin server.
 	AdminPort uint
-	// Port we listen for health connections on.
+	// Address the admin server binds to.
+	AdminBindAddress string
+	// Certificate and key the admin server serves TLS with, plain HTTP if
+	// unset.
+	AdminCert string
+	AdminKey  string
+	// Port we serve the metrics on. 0 serves them on the admin server.
+	MetricsPort uint
+	// Address the metrics server binds to.
+	MetricsBindAddress string
+	// Certificate and key the metrics server serves TLS with, plain HTTP
+	// if unset.
+	MetricsCert string
+	MetricsKey  string
+	// Port we serve the backend registration to peer proxy servers on,
+	// over TLS with the cluster certificates. 0 disables sharing
+	// registrations. Requires PeerTLSServerName.
+	PeerPort uint
+	// host:port addresses of the peer proxy servers, host names are
+	// resolved to all their addresses, e.g. of a headless service.
+	PeerAddresses []string
+	// Address frontends can reach this proxy server at, advertised to
+	// the peers.
+	PeerAdvertiseAddress string
+	// Interval between fetching the registrations of the peers.
+	PeerSyncInterval time.Duration
+	// Server name verified in the TLS certificates of the peers, both
+	// when serving and when fetching their registrations.
+	PeerTLSServerName string
+	// Relay dials without a local backend to a peer proxy server with
+	// one over the peer port, instead of failing them.
+	PeerRelay bool
+	// Return hints to connecting agents about the peer proxy servers in
+	// their zone, which agents may prefer to connect to directly.
+	TopologyHints bool
+	// Zone of this proxy server, shared with the peers.
+	Zone string
+	// Agent label holding the zone of the agents.
+	AgentZoneLabel string
+	// Route dials through the agents in the zone of this proxy server,
+	// spilling over to the other zones once their utilization exceeds
+	// the threshold.
+	ZoneAffinity           bool
+	ZoneSpilloverThreshold float64
+	// Address agents can reach this proxy server at directly, shared with
+	// the peers for their topology hints.
+	AgentAdvertiseAddress string
+	// Namespace of the Leases held by the agents. If non-empty, agents
+	// whose Lease expired more than AgentLeaseGracePeriod ago are evicted.
+	AgentLeaseNamespace   string
+	AgentLeaseGracePeriod time.Duration
+	// Percentage of the dials routed through agents announced as canary,
+	// the other dials avoid them. 0 disables canary routing.
+	CanaryPercent float64
+	// Retries of packets an agent stream failed to send transiently, with
+	// a backoff doubling from BackendSendRetryBackoff up to
+	// BackendSendRetryMaxBackoff. Each agent stream may retry
+	// BackendSendRetryBudget packets per minute.
+	BackendSendRetries         int
+	BackendSendRetryBackoff    time.Duration
+	BackendSendRetryMaxBackoff time.Duration
+	BackendSendRetryBudget     int
+	// Bytes per second of DATA proxied in each direction per connection
+	// and per agent. 0 leaves the bandwidth unlimited.
+	BandwidthLimitPerConnection int64
+	BandwidthLimitPerAgent      int64
+	// Number of packets from the agent queued per connection, and what a
+	// full queue does: block, drop or spill to SendQueueSpillDir. 0 sends
+	// them from the agent stream.
+	SendQueueDepth    int
+	SendQueuePolicy   string
+	SendQueueSpillDir string
+	// Schedule the packets sent to each agent by the priority of their
+	// connections, weighted by PriorityWeights.
+	PriorityScheduling bool
+	PriorityWeights    string
+	// How often byte-count checkpoints are exchanged with agents on each
+	// connection to detect lost data. 0 disables checkpoints.
+	DataCheckpointInterval time.Duration
+	// How long the connections of an agent whose stream broke are kept for
+	// it to resume its session, 0 disables resumption, and the DATA
+	// payload bytes kept per connection to be sent again.
+	AgentSessionGrace            time.Duration
+	AgentSessionReplayBufferSize int
+	// How long connections dialed as migratable wait for another agent
+	// once theirs disconnected. 0 disables connection migration.
+	ConnectionMigrationTimeout time.Duration
+	// Highest protocol version negotiated with agents.
+	MaxAgentProtocolVersion int
+	// How often the scale hints served on /scale-hints are refreshed, and
+	// the targets of a replica they are computed against.
+	ScaleHintsInterval      time.Duration
+	ScaleTargetConnections  int
+	ScaleTargetPendingDials int
+	ScaleTargetCPU          float64
+	// Rolling window of the peaks served on /debug/peaks, and the file the
+	// lifetime peaks are persisted in.
+	PeaksWindow time.Duration
+	PeaksFile   string
+	// Interval between the sweeps of the pending dials and connections,
+	// and the idle time after which they are reaped, 0 never reaps.
+	ConnTableSweepInterval time.Duration
+	ConnTableTTL           time.Duration
+	// How long established connections may go without DATA, and may last,
+	// before they are closed. 0 disables either.
+	ConnectionIdleTimeout time.Duration
+	ConnectionMaxLifetime time.Duration
+	// Maximum age of the Connect streams of agents, the fraction of it by
+	// which it is randomly shortened, and how long the connections of an
+	// aged stream are waited for.
+	MaxAgentConnectionAge       time.Duration
+	AgentConnectionAgeJitter    float64
+	AgentConnectionDrainTimeout time.Duration
+	// Consecutive failed dials through an agent after which it is skipped
+	// for the cooldown, 0 never skips agents.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	// Window over which the new destinations of each frontend identity
+	// are counted, 0 disables the anomaly detection, the z-score beyond
+	// which a window is reported, and the least count reported.
+	AnomalyWindow          time.Duration
+	AnomalyThreshold       float64
+	AnomalyMinDestinations int
+	// Strategies routing the hostnames dialed by the addresses they
+	// resolve to, how long resolutions and failed ones are cached, the
+	// timeout of the resolutions and the nameservers queried.
+	DestHostDNSStrategies  []string
+	DestHostDNSTTL         time.Duration
+	DestHostDNSNegativeTTL time.Duration
+	DestHostDNSTimeout     time.Duration
+	DestHostDNSNameservers []string
+	// Format of the logs, text or json, and the comma separated
+	// subsystem=level verbosity overrides of the log subsystems.
+	LogFormat string
+	LogLevels string
+	// host:port destinations agents may forward the connections of their
+	// port-forward listeners to, and the timeout of their dials.
+	PortForwardDestinations []string
+	PortForwardDialTimeout  time.Duration
+	// Interval the backend updates of registering agents are batched
+	// over, and how long the server stays ready after its last agent
+	// disconnected.
+	BackendUpdateBatchInterval time.Duration
+	ReadinessGracePeriod       time.Duration
+	// Least number of backends of the last proxy strategy, and type=value
+	// agent identifiers which must be registered, for the server to be
+	// ready.
+	ReadinessRequiresBackends int
+	ReadinessRequiredAgents   []string
+	// Port we listen for health connections on. 0 disables the health
+	// server.
 	HealthPort uint
+	// Address the health server binds to, all addresses if empty.
+	HealthBindAddress string
+	// Certificate and key the health server serves TLS with, plain HTTP if
+	// unset.
+	HealthCert string
+	HealthKey  string
+	// Time the health, admin and metrics servers wait for their requests in
+	// flight when shutting down.
+	AuxServerShutdownTimeout time.Duration
 	// After a duration of this time if the server doesn't see any activity it
 	// pings the client to see if the transport is still alive.
 	KeepaliveTime         time.Duration
 	FrontendKeepaliveTime time.Duration
+	// How long the server waits for the ack of a keepalive ping before
+	// closing the transport, 0 uses the gRPC default of 20s.
+	KeepaliveTimeout         time.Duration
+	FrontendKeepaliveTimeout time.Duration
+	// Minimum time between the keepalive pings of clients, pinging more
+	// often closes their transport with too_many_pings, and whether clients
+	// may ping without active streams.
+	KeepaliveMinTime            time.Duration
+	KeepalivePermitIdle         bool
+	FrontendKeepaliveMinTime    time.Duration
+	FrontendKeepalivePermitIdle bool
 	// Enables pprof at host:AdminPort/debug/pprof.
 	EnableProfiling bool
 	// If EnableProfiling is true, this enables the lock contention
@@ -57,6 +296,9 @@ type ProxyRunOptions struct {
 	AgentServiceAccount string
 	// Token's audience for token-based agent authentication
 	AuthenticationAudience string
+	// Require agents to present both a client certificate verified
+	// against ClusterCaCert and a valid service account token.
+	AgentDualAuthentication bool
 	// Path to kubeconfig (used by kubernetes client)
 	KubeconfigPath string
 	// Client maximum QPS.
@@ -85,57 +327,313 @@ type ProxyRunOptions struct {
 	// NOTE that cipher suites are not configurable for TLS1.3,
 	// see: https://pkg.go.dev/crypto/tls#Config, so in that case, this option won't have any effect.
 	CipherSuites string
+
+	// Compression algorithm requested for DATA payloads exchanged with
+	// agents. Empty disables compression.
+	DataCompression string
+
+	// Path of the audit log recording dials and closes as JSON lines.
+	// "-" writes to stdout, empty disables audit logging.
+	AuditLogPath string
+	// Size in megabytes at which the audit log file is rotated.
+	AuditLogMaxSize int
+	// Number of rotated audit log files to keep.
+	AuditLogMaxBackups int
+	// Directory of the on-disk queue holding the audit events while the
+	// audit log cannot be written. Empty drops them.
+	AuditQueueDir string
+	// Size in megabytes of the audit queue.
+	AuditQueueMaxSize int
+	// How long recording an audit event waits for room in a full queue
+	// before dropping it.
+	AuditQueueMaxWait time.Duration
+	// Interval between attempts to deliver the queued audit events.
+	AuditQueueRetryInterval time.Duration
+
+	// Number of distinct agent IDs used as agent_id label values of the
+	// dial latency metric. 0 leaves the label empty.
+	MetricsAgentIDLabelLimit int
+
+	// OTLP/HTTP endpoint spans of traced dials are exported to. Empty
+	// disables tracing.
+	TracingOTLPEndpoint string
+
+	// Size of the buffers HTTP CONNECT frontends are read into, which
+	// bounds the payload of the DATA packets sent to agents.
+	PacketChunkSize int
 }
 
 func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
 	flags := pflag.NewFlagSet("proxy-server", pflag.ContinueOnError)
+	flags.StringVar(&o.ConfigFile, config.ConfigFlag, o.ConfigFile, "Path to a YAML or JSON file of kind "+config.KindProxyServer+" (apiVersion "+config.APIVersion+") setting flags by name under 'options'. Flags set on the command line override the file, which overrides the profile. The file is reloaded on SIGHUP or when it changes: the log verbosity, --log-levels, --metrics-agent-id-label-limit and --agent-lease-grace-period take effect right away, other changes after a restart.")
+	flags.StringVar(&o.Profile, "profile", o.Profile, fmt.Sprintf("Preset of flag values for a common deployment shape, one of: %s. Flags set explicitly override the profile.", strings.Join(ProfileNames(), ", ")))
 	flags.StringVar(&o.ServerCert, "server-cert", o.ServerCert, "If non-empty secure communication with this cert.")
 	flags.StringVar(&o.ServerKey, "server-key", o.ServerKey, "If non-empty secure communication with this key.")
 	flags.StringVar(&o.ServerCaCert, "server-ca-cert", o.ServerCaCert, "If non-empty the CA we use to validate KAS clients.")
+	flags.StringSliceVar(&o.FrontendAuthentication, "frontend-authentication", o.FrontendAuthentication, "Comma separated methods authenticating the frontends in grpc mode, any of which may succeed: 'certificate' verifies the client certificate against --server-ca-cert, 'token' the bearer token of the authorization metadata against --frontend-token-auth-file. Empty accepts any frontend.")
+	flags.StringSliceVar(&o.FrontendAllowedNames, "frontend-allowed-names", o.FrontendAllowedNames, "Comma separated common names or DNS, URI and email subject alternative names of which frontend client certificates must have one. Empty accepts any certificate signed by --server-ca-cert.")
+	flags.StringVar(&o.FrontendTokenAuthFile, "frontend-token-auth-file", o.FrontendTokenAuthFile, "CSV file of the bearer tokens of the frontends, in the format of the static token file of the kube-apiserver: token,user,uid,\"group1,group2\".")
+	flags.StringSliceVar(&o.FrontendAuthorizationRules, "frontend-authorization-rules", o.FrontendAuthorizationRules, "Comma separated subject=destination rules of the destinations frontends may dial. The subject is the name of a frontend, group:<group> or * for any frontend, the destination a host:port in which * matches anything, e.g. system:apiserver=*:10250. Empty allows any dial.")
+	flags.StringVar(&o.EgressPolicyConfigMap, "egress-policy-configmap", o.EgressPolicyConfigMap, "If non-empty, namespace/name of a ConfigMap whose policy.yaml describes which frontends may dial which destinations through which agents. Dials are denied until it is synced and once it is deleted, see --egress-policy-allow-missing. Uses --kubeconfig or the in-cluster config.")
+	flags.BoolVar(&o.EgressPolicyAllowMissing, "egress-policy-allow-missing", o.EgressPolicyAllowMissing, "If true, dials are not restricted while the --egress-policy-configmap does not exist, rather than denied.")
+	flags.StringSliceVar(&o.ConnectAuthentication, "connect-authentication", o.ConnectAuthentication, "Comma separated Proxy-Authorization schemes of the CONNECT requests in http-connect mode, 'basic' and 'bearer'. Credentials are verified against --connect-basic-auth-file, --connect-token-auth-file and --connect-auth-webhook-url. Empty accepts any request.")
+	flags.StringVar(&o.ConnectBasicAuthFile, "connect-basic-auth-file", o.ConnectBasicAuthFile, "CSV file of the basic credentials of CONNECT requests: password,user,uid,\"group1,group2\".")
+	flags.StringVar(&o.ConnectTokenAuthFile, "connect-token-auth-file", o.ConnectTokenAuthFile, "CSV file of the bearer tokens of CONNECT requests, in the format of the static token file of the kube-apiserver: token,user,uid,\"group1,group2\".")
+	flags.StringVar(&o.ConnectAuthWebhookURL, "connect-auth-webhook-url", o.ConnectAuthWebhookURL, "If non-empty, URL TokenReviews of the credentials of CONNECT requests are posted to, like the token webhook of the kube-apiserver. Basic credentials are reviewed by their password, and the reviewed user must be their user.")
+	flags.StringVar(&o.ConnectAuthWebhookCACert, "connect-auth-webhook-ca-cert", o.ConnectAuthWebhookCACert, "If non-empty, the CA the token review webhook is verified with, the system CAs otherwise.")
+	flags.DurationVar(&o.ConnectAuthWebhookTimeout, "connect-auth-webhook-timeout", o.ConnectAuthWebhookTimeout, "How long to wait for a token review of the webhook.")
+	flags.IntVar(&o.HTTPConnectMaxHeaderBytes, "http-connect-max-header-bytes", o.HTTPConnectMaxHeaderBytes, "Maximum size in bytes of the request line and headers of CONNECT requests in http-connect mode. Larger requests are rejected with 431 Request Header Fields Too Large. Set to 0 for the net/http default of 1MB.")
+	flags.IntVar(&o.HTTPConnectMaxHeaderCount, "http-connect-max-header-count", o.HTTPConnectMaxHeaderCount, "Maximum number of headers of CONNECT requests in http-connect mode. Requests with more headers are rejected with 431 Request Header Fields Too Large. Set to 0 for no limit.")
 	flags.StringVar(&o.ClusterCert, "cluster-cert", o.ClusterCert, "If non-empty secure communication with this cert.")
 	flags.StringVar(&o.ClusterKey, "cluster-key", o.ClusterKey, "If non-empty secure communication with this key.")
 	flags.StringVar(&o.ClusterCaCert, "cluster-ca-cert", o.ClusterCaCert, "If non-empty the CA we use to validate Agent clients.")
 	flags.StringVar(&o.Mode, "mode", o.Mode, "mode can be either 'grpc' or 'http-connect'.")
 	flags.StringVar(&o.UdsName, "uds-name", o.UdsName, "uds-name should be empty for TCP traffic. For UDS set to its name.")
 	flags.BoolVar(&o.DeleteUDSFile, "delete-existing-uds-file", o.DeleteUDSFile, "If true and if file UdsName already exists, delete the file before listen on that UDS file")
+	flags.StringVar(&o.UDSMode, "uds-mode", o.UDSMode, "Octal file mode of the --uds-name socket, e.g. 0660. Defaults to 0770.")
+	flags.IntVar(&o.UDSUID, "uds-uid", o.UDSUID, "User ID owning the --uds-name socket. Set to -1 to keep the user of the proxy server.")
+	flags.IntVar(&o.UDSGID, "uds-gid", o.UDSGID, "Group ID owning the --uds-name socket. Set to -1 to keep the group of the proxy server.")
+	flags.UintSliceVar(&o.UDSAllowedPeerUIDs, "uds-allowed-peer-uids", o.UDSAllowedPeerUIDs, "If non-empty, only processes running as one of these user IDs, or in one of --uds-allowed-peer-gids, may connect to the --uds-name socket. Checked with SO_PEERCRED, Linux only.")
+	flags.UintSliceVar(&o.UDSAllowedPeerGIDs, "uds-allowed-peer-gids", o.UDSAllowedPeerGIDs, "If non-empty, only processes running in one of these group IDs, or as one of --uds-allowed-peer-uids, may connect to the --uds-name socket. Checked with SO_PEERCRED, Linux only.")
 	flags.UintVar(&o.ServerPort, "server-port", o.ServerPort, "Port we listen for server connections on. Set to 0 for UDS.")
+	flags.StringSliceVar(&o.AdditionalFrontends, "additional-frontends", o.AdditionalFrontends, "Comma separated further frontend listeners, served along with the one of --mode, --server-port and --uds-name, each mode=port or mode=uds-name, e.g. http-connect=8093,grpc=/var/run/konnectivity-server.sock. TCP listeners use the server cert, key and ca cert, unix domain sockets the uds options.")
 	flags.UintVar(&o.AgentPort, "agent-port", o.AgentPort, "Port we listen for agent connections on.")
-	flags.UintVar(&o.AdminPort, "admin-port", o.AdminPort, "Port we listen for admin connections on.")
-	flags.UintVar(&o.HealthPort, "health-port", o.HealthPort, "Port we listen for health connections on.")
+	flags.UintVar(&o.AgentWebSocketPort, "agent-websocket-port", o.AgentWebSocketPort, "Port we listen for agent connections tunneled over WebSocket (HTTPS) on. Used by agents running with --proxy-server-transport=websocket. Set to 0 to disable.")
+	flags.UintVar(&o.AdminPort, "admin-port", o.AdminPort, "Port we listen for admin connections on. Set to 0 to disable the admin server.")
+	flags.StringVar(&o.AdminBindAddress, "admin-bind-address", o.AdminBindAddress, "Address the admin server binds to.")
+	flags.StringVar(&o.AdminCert, "admin-cert", o.AdminCert, "If non-empty, the admin server serves TLS with this certificate.")
+	flags.StringVar(&o.AdminKey, "admin-key", o.AdminKey, "Private key of --admin-cert.")
+	flags.UintVar(&o.MetricsPort, "metrics-port", o.MetricsPort, "If non-zero, port we serve the metrics on, instead of the admin port.")
+	flags.StringVar(&o.MetricsBindAddress, "metrics-bind-address", o.MetricsBindAddress, "Address the metrics server binds to, all addresses if empty.")
+	flags.StringVar(&o.MetricsCert, "metrics-cert", o.MetricsCert, "If non-empty, the metrics server serves TLS with this certificate.")
+	flags.StringVar(&o.MetricsKey, "metrics-key", o.MetricsKey, "Private key of --metrics-cert.")
+	flags.UintVar(&o.HealthPort, "health-port", o.HealthPort, "Port we listen for health connections on. Set to 0 to disable the health server.")
+	flags.StringVar(&o.HealthBindAddress, "health-bind-address", o.HealthBindAddress, "Address the health server binds to, all addresses if empty.")
+	flags.StringVar(&o.HealthCert, "health-cert", o.HealthCert, "If non-empty, the health server serves TLS with this certificate.")
+	flags.StringVar(&o.HealthKey, "health-key", o.HealthKey, "Private key of --health-cert.")
+	flags.DurationVar(&o.AuxServerShutdownTimeout, "aux-server-shutdown-timeout", o.AuxServerShutdownTimeout, "Time the health, admin and metrics servers wait for their requests in flight when shutting down.")
+	flags.UintVar(&o.PeerPort, "peer-port", o.PeerPort, "Port we share the registrations of the connected agents with the peer proxy servers on, secured with the cluster certificates and CA. Requires --peer-tls-server-name. Dials without a local backend are answered with the ID and advertised address of a peer with one. Set to 0 to disable.")
+	flags.StringSliceVar(&o.PeerAddresses, "peer-addresses", o.PeerAddresses, "Comma separated host:port addresses of the peer-port of the peer proxy servers. Host names are resolved to all their addresses, so a headless service lists all replicas.")
+	flags.StringVar(&o.PeerAdvertiseAddress, "peer-advertise-address", o.PeerAdvertiseAddress, "Address frontends can reach this proxy server at, advertised to the peer proxy servers.")
+	flags.DurationVar(&o.PeerSyncInterval, "peer-sync-interval", o.PeerSyncInterval, "Interval between fetching the agent registrations of the peer proxy servers.")
+	flags.StringVar(&o.PeerTLSServerName, "peer-tls-server-name", o.PeerTLSServerName, "Server name verified in the certificates of the peer proxy servers, whose client certificates must be valid for it too. Required with --peer-port.")
+	flags.BoolVar(&o.PeerRelay, "peer-relay", o.PeerRelay, "Relay dials without a local backend over the peer port to a peer proxy server with one, instead of failing them. Requires the peer port. Relayed dials are only accepted from peers with a certificate for --peer-tls-server-name.")
+	flags.BoolVar(&o.TopologyHints, "topology-hints", o.TopologyHints, "Return the ID and --agent-advertise-address of the peer proxy servers in the zone of connecting agents, read from their --agent-zone-label label, so that agents preferring topology hints connect to them directly. Requires the peer port.")
+	flags.StringVar(&o.Zone, "zone", o.Zone, "Zone of this proxy server, shared with the peer proxy servers for their topology hints.")
+	flags.StringVar(&o.AgentZoneLabel, "agent-zone-label", o.AgentZoneLabel, "Agent label holding the zone of the agents, for the topology hints and zone affinity.")
+	flags.BoolVar(&o.ZoneAffinity, "zone-affinity", o.ZoneAffinity, "Route dials through the agents in the --zone of this proxy server, read from their --agent-zone-label label, and through the agents of the other zones if none is available. Requires --zone.")
+	flags.Float64Var(&o.ZoneSpilloverThreshold, "zone-spillover-threshold", o.ZoneSpilloverThreshold, "Utilization of the connection capacity the agents in the zone advertised with --max-connections-per-server, between 0 and 1, beyond which dials spill over to the other zones with zone affinity. The share of spilled dials grows linearly from none at the threshold to all at full utilization, and is reported by the zone_spillover_dials_total metric.")
+	flags.StringVar(&o.AgentAdvertiseAddress, "agent-advertise-address", o.AgentAdvertiseAddress, "host:port address agents can reach this proxy server at directly, shared with the peer proxy servers for their topology hints. Proxy servers without one are not hinted.")
+	flags.StringVar(&o.AgentLeaseNamespace, "agent-lease-namespace", o.AgentLeaseNamespace, "If non-empty, watch the Leases held by the agents in this namespace (see the agent's --lease-namespace) and evict the connections of agents whose Lease expired more than --agent-lease-grace-period ago, e.g. because their node froze. Uses --kubeconfig or the in-cluster config.")
+	flags.DurationVar(&o.AgentLeaseGracePeriod, "agent-lease-grace-period", o.AgentLeaseGracePeriod, "How long after its Lease expired an agent is evicted.")
+	flags.Float64Var(&o.CanaryPercent, "canary-percent", o.CanaryPercent, "Percentage of the dials routed through agents started with --canary by the strategies picking a random agent (default and defaultRoute), with the dial latency reported separately for canary and stable agents. The other dials avoid canary agents. Dials fall back to agents of the other kind if none is connected. Set to 0 to disable canary routing.")
+	flags.IntVar(&o.BackendSendRetries, "backend-send-retries", o.BackendSendRetries, "Maximum number of retries of a packet an agent connection failed to send transiently. The connection and the frontend connections through it are closed once a packet can't be sent. Set to 0 to disable retrying.")
+	flags.DurationVar(&o.BackendSendRetryBackoff, "backend-send-retry-backoff", o.BackendSendRetryBackoff, "Backoff before the first retry of a packet sent to an agent, doubled for each further retry.")
+	flags.DurationVar(&o.BackendSendRetryMaxBackoff, "backend-send-retry-max-backoff", o.BackendSendRetryMaxBackoff, "Maximum backoff between retries of a packet sent to an agent.")
+	flags.Int64Var(&o.BandwidthLimitPerConnection, "bandwidth-limit-per-connection", o.BandwidthLimitPerConnection, "Bytes per second of data proxied in each direction of a connection. 0 leaves the bandwidth unlimited.")
+	flags.Int64Var(&o.BandwidthLimitPerAgent, "bandwidth-limit-per-agent", o.BandwidthLimitPerAgent, "Bytes per second of data proxied in each direction through an agent, shared by its connections. 0 leaves the bandwidth unlimited.")
+	flags.IntVar(&o.SendQueueDepth, "send-queue-depth", o.SendQueueDepth, "Number of packets from the agent queued per connection until the frontend receives them. Set to 0 to send them from the agent stream, without a queue.")
+	flags.StringVar(&o.SendQueuePolicy, "send-queue-overflow-policy", o.SendQueuePolicy, "What a full send queue does with further packets: block (apply backpressure to the agent stream), drop (drop the packets and close the connection) or spill (write them to --send-queue-spill-dir).")
+	flags.StringVar(&o.SendQueueSpillDir, "send-queue-spill-dir", o.SendQueueSpillDir, "Directory the spill overflow policy writes the packets to, the default directory for temporary files if empty.")
+	flags.BoolVar(&o.PriorityScheduling, "priority-scheduling", o.PriorityScheduling, "Send the data of higher priority connections to an agent first when its connection is congested, e.g. exec sessions before bulk copies. Frontends set the priority when dialing.")
+	flags.StringVar(&o.PriorityWeights, "priority-weights", o.PriorityWeights, "Shares of the agent connection bandwidth of each priority with --priority-scheduling, as comma separated priority=weight pairs of the high, medium and low priorities.")
+	flags.DurationVar(&o.DataCheckpointInterval, "data-checkpoint-interval", o.DataCheckpointInterval, "How often the proxy server and agents exchange the number of bytes sent on each connection, to detect data lost between them. Discrepancies are counted by the data_checkpoints_total metrics. Set to 0 to disable.")
+	flags.DurationVar(&o.AgentSessionGrace, "agent-session-grace", o.AgentSessionGrace, "If positive, agents with --session-resumption-grace whose stream broke may reconnect within this duration and resume their session: their connections are kept, and the DATA lost with the stream is sent again. Set to 0 to disable.")
+	flags.IntVar(&o.AgentSessionReplayBufferSize, "agent-session-replay-buffer-size", o.AgentSessionReplayBufferSize, "Number of DATA payload bytes kept per agent connection until acknowledged by the agent, to be sent again when lost or when the session resumes. Connections missing more are closed.")
+	flags.DurationVar(&o.ConnectionMigrationTimeout, "connection-migration-timeout", o.ConnectionMigrationTimeout, "If positive, connections which frontends dialed as migratable are not closed when their agent disconnects, e.g. when it is replaced during an upgrade: the destination is dialed again through another agent, within this duration, and the connection resumes through it. Set to 0 to disable.")
+	flags.IntVar(&o.MaxAgentProtocolVersion, "max-agent-protocol-version", o.MaxAgentProtocolVersion, "Highest protocol version negotiated with agents. Version 2 numbers and acknowledges DATA to detect and recover lost packets, version 3 exchanges HELLO packets advertising features; 1 disables both.")
+	flags.DurationVar(&o.ScaleHintsInterval, "scale-hints-interval", o.ScaleHintsInterval, "How often the CPU utilization is sampled and the scale hints served on /scale-hints of the health port and exported as scale_hints metrics are refreshed.")
+	flags.IntVar(&o.ScaleTargetConnections, "scale-target-connections", o.ScaleTargetConnections, "Active frontend connections a replica should serve. The load scale hint is the highest ratio of the figures to their targets; 0 ignores the connections.")
+	flags.IntVar(&o.ScaleTargetPendingDials, "scale-target-pending-dials", o.ScaleTargetPendingDials, "Pending dials a replica should have at most. 0 ignores the pending dials in the load scale hint.")
+	flags.Float64Var(&o.ScaleTargetCPU, "scale-target-cpu", o.ScaleTargetCPU, "Share of its CPUs a replica should use, between 0 and 1. 0 ignores the CPU utilization in the load scale hint.")
+	flags.DurationVar(&o.PeaksWindow, "peaks-window", o.PeaksWindow, "Length of the rolling window of the peak load figures served on /debug/peaks of the admin port, besides the lifetime peaks.")
+	flags.StringVar(&o.PeaksFile, "peaks-file", o.PeaksFile, "If non-empty, the lifetime peak load figures are persisted in this file, so that they survive restarts.")
+	flags.DurationVar(&o.ConnTableSweepInterval, "conn-table-sweep-interval", o.ConnTableSweepInterval, "Interval between the sweeps of the pending dials and established connections, which refresh the connection_table_entries metric and reap the entries idle beyond conn-table-ttl.")
+	flags.DurationVar(&o.MaxAgentConnectionAge, "max-agent-connection-age", o.MaxAgentConnectionAge, "If non-zero, agent connections are ended after this age, so that agents authenticate again and reconnect through the load balancer. No dials are routed through an aged connection. Its connections migrate to the new connection if the agent resumes its session, otherwise it ends once they closed.")
+	flags.Float64Var(&o.AgentConnectionAgeJitter, "agent-connection-age-jitter", o.AgentConnectionAgeJitter, "Fraction of max-agent-connection-age by which the age of each agent connection is randomly shortened, so that the connections established together are not ended together.")
+	flags.DurationVar(&o.AgentConnectionDrainTimeout, "agent-connection-drain-timeout", o.AgentConnectionDrainTimeout, "How long the connections of an aged agent connection which cannot be resumed are waited for before it is ended. 0 waits until they closed.")
+	flags.IntVar(&o.CircuitBreakerFailures, "circuit-breaker-failures", o.CircuitBreakerFailures, "If non-zero, the circuit breaker of an agent trips after this many consecutive failed dials through it, and the agent is skipped when picking backends for circuit-breaker-cooldown. The tripped breakers are served on /debug/circuit-breakers of the admin port.")
+	flags.DurationVar(&o.CircuitBreakerCooldown, "circuit-breaker-cooldown", o.CircuitBreakerCooldown, "How long an agent whose circuit breaker tripped is skipped. Afterwards dials are routed through it again, and the breaker closes after the first successful one or trips again after the first failed one.")
+	flags.DurationVar(&o.AnomalyWindow, "anomaly-window", o.AnomalyWindow, "If non-zero, count the destinations each frontend identity never dialed before over windows of this length, and report the identities dialing unusually many of them against their previous windows in the logs, the destination_anomalies_total metric and on /debug/anomalies of the admin port.")
+	flags.Float64Var(&o.AnomalyThreshold, "anomaly-threshold", o.AnomalyThreshold, "Z-score of the count of new destinations of a window, against the previous windows of the identity, beyond which it is reported.")
+	flags.IntVar(&o.AnomalyMinDestinations, "anomaly-min-destinations", o.AnomalyMinDestinations, "Least count of new destinations in a window that is reported.")
+	flags.StringSliceVar(&o.DestHostDNSStrategies, "dest-host-dns-strategies", o.DestHostDNSStrategies, "Comma separated proxy strategies, destHost or destHostHash, routing the dials to hostnames by the addresses they resolve to on the server. The destHost strategy then reaches agents registered by their IPs, and the destHostHash strategy routes all the hostnames of a destination through the same agent. Hostnames are not resolved if empty.")
+	flags.DurationVar(&o.DestHostDNSTTL, "dest-host-dns-ttl", o.DestHostDNSTTL, "How long the addresses of a resolved destination hostname are cached. 0 resolves the hostname of each dial.")
+	flags.DurationVar(&o.DestHostDNSNegativeTTL, "dest-host-dns-negative-ttl", o.DestHostDNSNegativeTTL, "How long a destination hostname which failed to resolve is not resolved again. Dials to it are routed by the hostname meanwhile.")
+	flags.DurationVar(&o.DestHostDNSTimeout, "dest-host-dns-timeout", o.DestHostDNSTimeout, "Timeout of the resolution of a destination hostname. 0 does not time out.")
+	flags.StringSliceVar(&o.DestHostDNSNameservers, "dest-host-dns-nameservers", o.DestHostDNSNameservers, "Comma separated IP[:port] of the DNS servers destination hostnames are resolved with, the resolver of the host if empty.")
+	flags.StringVar(&o.LogFormat, "log-format", o.LogFormat, "Format of the logs written to stderr, either 'text' or 'json'. JSON logs hold one object per line, with the key/value pairs of structured log entries as fields.")
+	flags.StringVar(&o.LogLevels, "log-levels", o.LogLevels, "Comma separated subsystem=level verbosity overrides of the log subsystems "+strings.Join(util.LogSubsystems, ", ")+", e.g. backend-manager=5. The levels and the global verbosity can be changed at runtime on /debug/log-levels of the admin port.")
+	flags.StringSliceVar(&o.PortForwardDestinations, "port-forward-destinations", o.PortForwardDestinations, "Comma separated host:port destinations agents may forward the connections of their --port-forward listeners to, e.g. kubernetes.default.svc:443. Port forwarding is disabled if empty.")
+	flags.DurationVar(&o.PortForwardDialTimeout, "port-forward-dial-timeout", o.PortForwardDialTimeout, "Timeout of the dials of port forwarding destinations. 0 does not time out.")
+	flags.DurationVar(&o.BackendUpdateBatchInterval, "backend-update-batch-interval", o.BackendUpdateBatchInterval, "If non-zero, the registrations and removals of agent connections are batched over this interval, so that dial routing does not slow down while thousands of agents reconnect. Agents become routable up to this long after they connected.")
+	flags.DurationVar(&o.ReadinessGracePeriod, "readiness-grace-period", o.ReadinessGracePeriod, "How long the server stays ready after its last agent disconnected, so that its readiness does not flap while agents reconnect. 0 reports it unready immediately.")
+	flags.IntVar(&o.ReadinessRequiresBackends, "readiness-requires-backends", o.ReadinessRequiresBackends, "If non-zero, /readyz returns 503 until this many backends are registered with the last of the --proxy-strategies, which routes the dials the others did not: agents, or agent hosts and addresses for destHost.")
+	flags.StringSliceVar(&o.ReadinessRequiredAgents, "readiness-required-agent-identifiers", o.ReadinessRequiredAgents, "Comma separated type=value agent identifiers, e.g. host=node-1 or uid=agent-1, for which /readyz returns 503 until an agent registered with them. Each type must be used by one of the --proxy-strategies: ipv4, ipv6 and host by destHost, uid by default and labelSelector, default-route by defaultRoute.")
+	flags.DurationVar(&o.ConnTableTTL, "conn-table-ttl", o.ConnTableTTL, "If non-zero, pending dials without a DIAL_RSP and established connections without DATA for longer are reaped, failing the dial or closing the connection on both ends. This cleans up the entries leaked when CLOSE packets are lost.")
+	flags.DurationVar(&o.ConnectionIdleTimeout, "connection-idle-timeout", o.ConnectionIdleTimeout, "If non-zero, established connections without DATA in either direction for longer are closed on both ends. Enforced at each conn-table-sweep-interval.")
+	flags.DurationVar(&o.ConnectionMaxLifetime, "connection-max-lifetime", o.ConnectionMaxLifetime, "If non-zero, established connections are closed on both ends once they last longer since their dial. Enforced at each conn-table-sweep-interval.")
+	flags.IntVar(&o.BackendSendRetryBudget, "backend-send-retry-budget", o.BackendSendRetryBudget, "Number of retries each agent connection may spend per minute. The connection is closed if it fails to send a packet once the budget is spent.")
+	flags.StringVar(&o.ClusterSessionTicketKeyFile, "cluster-session-ticket-key-file", o.ClusterSessionTicketKeyFile, "If non-empty, TLS session tickets of agent connections are encrypted with the keys in this file, one base64 encoded 32 byte key per line. The first key encrypts new tickets, the others are accepted for rotation. Share the file across proxy server instances so that reconnecting agents resume their sessions on any instance.")
+	flags.IntVar(&o.MaxConcurrentAgentHandshakes, "max-concurrent-agent-handshakes", o.MaxConcurrentAgentHandshakes, "Maximum number of concurrent TLS handshakes of agent connections. Further handshakes wait up to --agent-handshake-queue-timeout and are rejected afterwards. Set to 0 for no limit.")
+	flags.DurationVar(&o.AgentHandshakeQueueTimeout, "agent-handshake-queue-timeout", o.AgentHandshakeQueueTimeout, "How long an agent TLS handshake waits for the --max-concurrent-agent-handshakes budget before the connection is rejected.")
 	flags.DurationVar(&o.KeepaliveTime, "keepalive-time", o.KeepaliveTime, "Time for gRPC agent server keepalive.")
 	flags.DurationVar(&o.FrontendKeepaliveTime, "frontend-keepalive-time", o.FrontendKeepaliveTime, "Time for gRPC frontend server keepalive.")
-	flags.BoolVar(&o.EnableProfiling, "enable-profiling", o.EnableProfiling, "enable pprof at host:admin-port/debug/pprof")
+	flags.DurationVar(&o.KeepaliveTimeout, "keepalive-timeout", o.KeepaliveTimeout, "How long the gRPC agent server waits for the ack of a keepalive ping before closing the connection. 0 uses the gRPC default of 20s.")
+	flags.DurationVar(&o.FrontendKeepaliveTimeout, "frontend-keepalive-timeout", o.FrontendKeepaliveTimeout, "How long the gRPC frontend server waits for the ack of a keepalive ping before closing the connection. 0 uses the gRPC default of 20s.")
+	flags.DurationVar(&o.KeepaliveMinTime, "keepalive-min-time", o.KeepaliveMinTime, "Minimum time between the keepalive pings of agents. Agents pinging more often are disconnected with too_many_pings, so it must not exceed the --keepalive-time of the agents.")
+	flags.BoolVar(&o.KeepalivePermitIdle, "keepalive-permit-without-stream", o.KeepalivePermitIdle, "Allow agents to send keepalive pings without active streams.")
+	flags.DurationVar(&o.FrontendKeepaliveMinTime, "frontend-keepalive-min-time", o.FrontendKeepaliveMinTime, "Minimum time between the keepalive pings of frontends. Frontends pinging more often are disconnected with too_many_pings.")
+	flags.BoolVar(&o.FrontendKeepalivePermitIdle, "frontend-keepalive-permit-without-stream", o.FrontendKeepalivePermitIdle, "Allow frontends to send keepalive pings without active streams.")
+	flags.BoolVar(&o.EnableProfiling, "enable-profiling", o.EnableProfiling, "enable pprof at host:admin-port/debug/pprof, and toggling the block and mutex profile rates at host:admin-port/debug/runtime")
 	flags.BoolVar(&o.EnableContentionProfiling, "enable-contention-profiling", o.EnableContentionProfiling, "enable contention profiling at host:admin-port/debug/pprof/block. \"--enable-profiling\" must also be set.")
 	flags.StringVar(&o.ServerID, "server-id", o.ServerID, "The unique ID of this server.")
 	flags.UintVar(&o.ServerCount, "server-count", o.ServerCount, "The number of proxy server instances, should be 1 unless it is an HA server.")
 	flags.StringVar(&o.AgentNamespace, "agent-namespace", o.AgentNamespace, "Expected agent's namespace during agent authentication (used with agent-service-account, authentication-audience, kubeconfig).")
 	flags.StringVar(&o.AgentServiceAccount, "agent-service-account", o.AgentServiceAccount, "Expected agent's service account during agent authentication (used with agent-namespace, authentication-audience, kubeconfig).")
-	flags.StringVar(&o.KubeconfigPath, "kubeconfig", o.KubeconfigPath, "absolute path to the kubeconfig file (used with agent-namespace, agent-service-account, authentication-audience).")
+	flags.StringVar(&o.KubeconfigPath, "kubeconfig", o.KubeconfigPath, "absolute path to the kubeconfig file (used with agent-namespace, agent-service-account, authentication-audience, or with agent-lease-namespace or egress-policy-configmap).")
 	flags.Float32Var(&o.KubeconfigQPS, "kubeconfig-qps", o.KubeconfigQPS, "Maximum client QPS (proxy server uses this client to authenticate agent tokens).")
 	flags.IntVar(&o.KubeconfigBurst, "kubeconfig-burst", o.KubeconfigBurst, "Maximum client burst (proxy server uses this client to authenticate agent tokens).")
+	flags.BoolVar(&o.AgentDualAuthentication, "agent-dual-authentication", o.AgentDualAuthentication, "Require agents to present both a client certificate verified against cluster-ca-cert and a valid service account token (see agent-namespace, agent-service-account, authentication-audience), so that a single leaked credential does not let an agent connect.")
 	flags.StringVar(&o.AuthenticationAudience, "authentication-audience", o.AuthenticationAudience, "Expected agent's token authentication audience (used with agent-namespace, agent-service-account, kubeconfig).")
-	flags.StringVar(&o.ProxyStrategies, "proxy-strategies", o.ProxyStrategies, "The list of proxy strategies used by the server to pick a backend/tunnel, available strategies are: default, destHost.")
+	flags.StringVar(&o.ProxyStrategies, "proxy-strategies", o.ProxyStrategies, "The list of proxy strategies used by the server to pick a backend/tunnel, available strategies are: default, destHost, destHostHash, defaultRoute, labelSelector. The destHostHash strategy routes the dials to a destination host through the same agent, picked on a consistent hash ring of the agents. The labelSelector strategy routes dials carrying a label selector (the label-selector dial metadata for grpc frontends, the X-Konnectivity-Label-Selector header for http-connect ones) through agents whose --agent-labels match it.")
 	flags.BoolVar(&o.WarnOnChannelLimit, "warn-on-channel-limit", o.WarnOnChannelLimit, "Turns on a warning if the system is going to push to a full channel. The check involves an unsafe read.")
 	flags.StringVar(&o.CipherSuites, "cipher-suites", o.CipherSuites, "The comma separated list of allowed cipher suites. Has no effect on TLS1.3. Empty means allow default list.")
+	flags.StringVar(&o.DataCompression, "data-compression", o.DataCompression, "Compression requested for data exchanged with agents, negotiated per connection at dial time. Agents must run with --enable-data-compression. Only gzip is supported, snappy and zstd are not implemented as they would need new dependencies. Empty disables compression.")
+	flags.StringVar(&o.AuditLogPath, "audit-log-path", o.AuditLogPath, "If set, dials and closes of tunneled connections are recorded as JSON lines to this file. '-' means standard out.")
+	flags.IntVar(&o.AuditLogMaxSize, "audit-log-max-size", o.AuditLogMaxSize, "The maximum size in megabytes of the audit log file before it gets rotated. 0 disables rotation.")
+	flags.IntVar(&o.AuditLogMaxBackups, "audit-log-max-backups", o.AuditLogMaxBackups, "The maximum number of rotated audit log files to retain.")
+	flags.StringVar(&o.AuditQueueDir, "audit-queue-dir", o.AuditQueueDir, "If set, audit events which cannot be written to the audit log are queued in this directory and delivered in order once it recovers, including after restarts. Empty drops them.")
+	flags.IntVar(&o.AuditQueueMaxSize, "audit-queue-max-size", o.AuditQueueMaxSize, "The maximum size in megabytes of the audit queue.")
+	flags.DurationVar(&o.AuditQueueMaxWait, "audit-queue-max-wait", o.AuditQueueMaxWait, "How long dials and closes wait for room in a full audit queue before their audit events are dropped. Waiting slows down the tunnels rather than losing events.")
+	flags.DurationVar(&o.AuditQueueRetryInterval, "audit-queue-retry-interval", o.AuditQueueRetryInterval, "Interval between attempts to deliver the queued audit events to the audit log.")
+	flags.StringVar(&o.TracingOTLPEndpoint, "tracing-otlp-endpoint", o.TracingOTLPEndpoint, "If non-empty, spans of dials traced by the frontend are exported to this OTLP/HTTP endpoint, e.g. http://otel-collector:4318/v1/traces. gRPC frontends propagate the trace context in the dial metadata, HTTP CONNECT frontends in the traceparent header.")
+	flags.IntVar(&o.MetricsAgentIDLabelLimit, "metrics-agent-id-label-limit", o.MetricsAgentIDLabelLimit, "Maximum number of distinct agent IDs used as agent_id label of the dial latency metric, further agents are reported as \"other\". Set to 0 to omit the agent ID.")
+	flags.IntVar(&o.PacketChunkSize, "packet-chunk-size", o.PacketChunkSize, "Size in bytes of the data chunks read from HTTP CONNECT clients and sent to agents. Read buffers of this size are pooled and reused.")
 	return flags
 }
 
 func (o *ProxyRunOptions) Print() {
+	klog.V(1).Infof("ConfigFile set to %q.\n", o.ConfigFile)
+	klog.V(1).Infof("Profile set to %q.\n", o.Profile)
 	klog.V(1).Infof("ServerCert set to %q.\n", o.ServerCert)
 	klog.V(1).Infof("ServerKey set to %q.\n", o.ServerKey)
 	klog.V(1).Infof("ServerCACert set to %q.\n", o.ServerCaCert)
+	klog.V(1).Infof("FrontendAuthentication set to %v.\n", o.FrontendAuthentication)
+	klog.V(1).Infof("FrontendAllowedNames set to %v.\n", o.FrontendAllowedNames)
+	klog.V(1).Infof("FrontendTokenAuthFile set to %q.\n", o.FrontendTokenAuthFile)
+	klog.V(1).Infof("FrontendAuthorizationRules set to %v.\n", o.FrontendAuthorizationRules)
+	klog.V(1).Infof("EgressPolicyConfigMap set to %q.\n", o.EgressPolicyConfigMap)
+	klog.V(1).Infof("EgressPolicyAllowMissing set to %t.\n", o.EgressPolicyAllowMissing)
+	klog.V(1).Infof("ConnectAuthentication set to %v.\n", o.ConnectAuthentication)
+	klog.V(1).Infof("ConnectBasicAuthFile set to %q.\n", o.ConnectBasicAuthFile)
+	klog.V(1).Infof("ConnectTokenAuthFile set to %q.\n", o.ConnectTokenAuthFile)
+	klog.V(1).Infof("ConnectAuthWebhookURL set to %q.\n", o.ConnectAuthWebhookURL)
+	klog.V(1).Infof("ConnectAuthWebhookCACert set to %q.\n", o.ConnectAuthWebhookCACert)
+	klog.V(1).Infof("ConnectAuthWebhookTimeout set to %v.\n", o.ConnectAuthWebhookTimeout)
+	klog.V(1).Infof("HTTPConnectMaxHeaderBytes set to %d.\n", o.HTTPConnectMaxHeaderBytes)
+	klog.V(1).Infof("HTTPConnectMaxHeaderCount set to %d.\n", o.HTTPConnectMaxHeaderCount)
 	klog.V(1).Infof("ClusterCert set to %q.\n", o.ClusterCert)
 	klog.V(1).Infof("ClusterKey set to %q.\n", o.ClusterKey)
 	klog.V(1).Infof("ClusterCACert set to %q.\n", o.ClusterCaCert)
 	klog.V(1).Infof("Mode set to %q.\n", o.Mode)
 	klog.V(1).Infof("UDSName set to %q.\n", o.UdsName)
 	klog.V(1).Infof("DeleteUDSFile set to %v.\n", o.DeleteUDSFile)
+	klog.V(1).Infof("UDSMode set to %q.\n", o.UDSMode)
+	klog.V(1).Infof("UDSUID set to %d.\n", o.UDSUID)
+	klog.V(1).Infof("UDSGID set to %d.\n", o.UDSGID)
+	klog.V(1).Infof("UDSAllowedPeerUIDs set to %v.\n", o.UDSAllowedPeerUIDs)
+	klog.V(1).Infof("UDSAllowedPeerGIDs set to %v.\n", o.UDSAllowedPeerGIDs)
 	klog.V(1).Infof("Server port set to %d.\n", o.ServerPort)
+	klog.V(1).Infof("AdditionalFrontends set to %q.\n", o.AdditionalFrontends)
 	klog.V(1).Infof("Agent port set to %d.\n", o.AgentPort)
+	klog.V(1).Infof("Agent websocket port set to %d.\n", o.AgentWebSocketPort)
 	klog.V(1).Infof("Admin port set to %d.\n", o.AdminPort)
+	klog.V(1).Infof("Admin bind address set to %q.\n", o.AdminBindAddress)
+	klog.V(1).Infof("Admin cert set to %q.\n", o.AdminCert)
+	klog.V(1).Infof("Admin key set to %q.\n", o.AdminKey)
+	klog.V(1).Infof("Metrics port set to %d.\n", o.MetricsPort)
+	klog.V(1).Infof("Metrics bind address set to %q.\n", o.MetricsBindAddress)
+	klog.V(1).Infof("Metrics cert set to %q.\n", o.MetricsCert)
+	klog.V(1).Infof("Metrics key set to %q.\n", o.MetricsKey)
 	klog.V(1).Infof("Health port set to %d.\n", o.HealthPort)
+	klog.V(1).Infof("Health bind address set to %q.\n", o.HealthBindAddress)
+	klog.V(1).Infof("Health cert set to %q.\n", o.HealthCert)
+	klog.V(1).Infof("Health key set to %q.\n", o.HealthKey)
+	klog.V(1).Infof("AuxServerShutdownTimeout set to %v.\n", o.AuxServerShutdownTimeout)
+	klog.V(1).Infof("Peer port set to %d.\n", o.PeerPort)
+	klog.V(1).Infof("PeerAddresses set to %v.\n", o.PeerAddresses)
+	klog.V(1).Infof("PeerAdvertiseAddress set to %q.\n", o.PeerAdvertiseAddress)
+	klog.V(1).Infof("PeerSyncInterval set to %v.\n", o.PeerSyncInterval)
+	klog.V(1).Infof("PeerTLSServerName set to %q.\n", o.PeerTLSServerName)
+	klog.V(1).Infof("PeerRelay set to %v.\n", o.PeerRelay)
+	klog.V(1).Infof("TopologyHints set to %v.\n", o.TopologyHints)
+	klog.V(1).Infof("Zone set to %q.\n", o.Zone)
+	klog.V(1).Infof("AgentZoneLabel set to %q.\n", o.AgentZoneLabel)
+	klog.V(1).Infof("ZoneAffinity set to %v.\n", o.ZoneAffinity)
+	klog.V(1).Infof("ZoneSpilloverThreshold set to %v.\n", o.ZoneSpilloverThreshold)
+	klog.V(1).Infof("AgentAdvertiseAddress set to %q.\n", o.AgentAdvertiseAddress)
+	klog.V(1).Infof("AgentLeaseNamespace set to %q.\n", o.AgentLeaseNamespace)
+	klog.V(1).Infof("AgentLeaseGracePeriod set to %v.\n", o.AgentLeaseGracePeriod)
+	klog.V(1).Infof("CanaryPercent set to %v.\n", o.CanaryPercent)
+	klog.V(1).Infof("BackendSendRetries set to %d.\n", o.BackendSendRetries)
+	klog.V(1).Infof("BackendSendRetryBackoff set to %v.\n", o.BackendSendRetryBackoff)
+	klog.V(1).Infof("BackendSendRetryMaxBackoff set to %v.\n", o.BackendSendRetryMaxBackoff)
+	klog.V(1).Infof("BackendSendRetryBudget set to %d.\n", o.BackendSendRetryBudget)
+	klog.V(1).Infof("BandwidthLimitPerConnection set to %d.\n", o.BandwidthLimitPerConnection)
+	klog.V(1).Infof("BandwidthLimitPerAgent set to %d.\n", o.BandwidthLimitPerAgent)
+	klog.V(1).Infof("SendQueueDepth set to %d.\n", o.SendQueueDepth)
+	klog.V(1).Infof("SendQueuePolicy set to %q.\n", o.SendQueuePolicy)
+	klog.V(1).Infof("SendQueueSpillDir set to %q.\n", o.SendQueueSpillDir)
+	klog.V(1).Infof("PriorityScheduling set to %v.\n", o.PriorityScheduling)
+	klog.V(1).Infof("PriorityWeights set to %q.\n", o.PriorityWeights)
+	klog.V(1).Infof("DataCheckpointInterval set to %v.\n", o.DataCheckpointInterval)
+	klog.V(1).Infof("AgentSessionGrace set to %v.\n", o.AgentSessionGrace)
+	klog.V(1).Infof("AgentSessionReplayBufferSize set to %d.\n", o.AgentSessionReplayBufferSize)
+	klog.V(1).Infof("ConnectionMigrationTimeout set to %v.\n", o.ConnectionMigrationTimeout)
+	klog.V(1).Infof("MaxAgentProtocolVersion set to %d.\n", o.MaxAgentProtocolVersion)
+	klog.V(1).Infof("ScaleHintsInterval set to %v.\n", o.ScaleHintsInterval)
+	klog.V(1).Infof("ScaleTargetConnections set to %d.\n", o.ScaleTargetConnections)
+	klog.V(1).Infof("ScaleTargetPendingDials set to %d.\n", o.ScaleTargetPendingDials)
+	klog.V(1).Infof("ScaleTargetCPU set to %v.\n", o.ScaleTargetCPU)
+	klog.V(1).Infof("PeaksWindow set to %v.\n", o.PeaksWindow)
+	klog.V(1).Infof("PeaksFile set to %q.\n", o.PeaksFile)
+	klog.V(1).Infof("ConnTableSweepInterval set to %v.\n", o.ConnTableSweepInterval)
+	klog.V(1).Infof("ConnTableTTL set to %v.\n", o.ConnTableTTL)
+	klog.V(1).Infof("ConnectionIdleTimeout set to %v.\n", o.ConnectionIdleTimeout)
+	klog.V(1).Infof("ConnectionMaxLifetime set to %v.\n", o.ConnectionMaxLifetime)
+	klog.V(1).Infof("MaxAgentConnectionAge set to %v.\n", o.MaxAgentConnectionAge)
+	klog.V(1).Infof("AgentConnectionAgeJitter set to %v.\n", o.AgentConnectionAgeJitter)
+	klog.V(1).Infof("AgentConnectionDrainTimeout set to %v.\n", o.AgentConnectionDrainTimeout)
+	klog.V(1).Infof("CircuitBreakerFailures set to %d.\n", o.CircuitBreakerFailures)
+	klog.V(1).Infof("CircuitBreakerCooldown set to %v.\n", o.CircuitBreakerCooldown)
+	klog.V(1).Infof("AnomalyWindow set to %v.\n", o.AnomalyWindow)
+	klog.V(1).Infof("AnomalyThreshold set to %v.\n", o.AnomalyThreshold)
+	klog.V(1).Infof("AnomalyMinDestinations set to %d.\n", o.AnomalyMinDestinations)
+	klog.V(1).Infof("DestHostDNSStrategies set to %v.\n", o.DestHostDNSStrategies)
+	klog.V(1).Infof("DestHostDNSTTL set to %v.\n", o.DestHostDNSTTL)
+	klog.V(1).Infof("DestHostDNSNegativeTTL set to %v.\n", o.DestHostDNSNegativeTTL)
+	klog.V(1).Infof("DestHostDNSTimeout set to %v.\n", o.DestHostDNSTimeout)
+	klog.V(1).Infof("DestHostDNSNameservers set to %v.\n", o.DestHostDNSNameservers)
+	klog.V(1).Infof("LogFormat set to %q.\n", o.LogFormat)
+	klog.V(1).Infof("LogLevels set to %q.\n", o.LogLevels)
+	klog.V(1).Infof("PortForwardDestinations set to %v.\n", o.PortForwardDestinations)
+	klog.V(1).Infof("PortForwardDialTimeout set to %v.\n", o.PortForwardDialTimeout)
+	klog.V(1).Infof("BackendUpdateBatchInterval set to %v.\n", o.BackendUpdateBatchInterval)
+	klog.V(1).Infof("ReadinessGracePeriod set to %v.\n", o.ReadinessGracePeriod)
+	klog.V(1).Infof("ReadinessRequiresBackends set to %d.\n", o.ReadinessRequiresBackends)
+	klog.V(1).Infof("ReadinessRequiredAgents set to %v.\n", o.ReadinessRequiredAgents)
+	klog.V(1).Infof("ClusterSessionTicketKeyFile set to %q.\n", o.ClusterSessionTicketKeyFile)
+	klog.V(1).Infof("MaxConcurrentAgentHandshakes set to %d.\n", o.MaxConcurrentAgentHandshakes)
+	klog.V(1).Infof("AgentHandshakeQueueTimeout set to %v.\n", o.AgentHandshakeQueueTimeout)
 	klog.V(1).Infof("Keepalive time set to %v.\n", o.KeepaliveTime)
 	klog.V(1).Infof("Frontend keepalive time set to %v.\n", o.FrontendKeepaliveTime)
+	klog.V(1).Infof("Keepalive timeout set to %v.\n", o.KeepaliveTimeout)
+	klog.V(1).Infof("Frontend keepalive timeout set to %v.\n", o.FrontendKeepaliveTimeout)
+	klog.V(1).Infof("Keepalive min time set to %v.\n", o.KeepaliveMinTime)
+	klog.V(1).Infof("Keepalive permit without stream set to %v.\n", o.KeepalivePermitIdle)
+	klog.V(1).Infof("Frontend keepalive min time set to %v.\n", o.FrontendKeepaliveMinTime)
+	klog.V(1).Infof("Frontend keepalive permit without stream set to %v.\n", o.FrontendKeepalivePermitIdle)
 	klog.V(1).Infof("EnableProfiling set to %v.\n", o.EnableProfiling)
 	klog.V(1).Infof("EnableContentionProfiling set to %v.\n", o.EnableContentionProfiling)
 	klog.V(1).Infof("ServerID set to %s.\n", o.ServerID)
@@ -143,12 +641,24 @@ func (o *ProxyRunOptions) Print() {
 	klog.V(1).Infof("AgentNamespace set to %q.\n", o.AgentNamespace)
 	klog.V(1).Infof("AgentServiceAccount set to %q.\n", o.AgentServiceAccount)
 	klog.V(1).Infof("AuthenticationAudience set to %q.\n", o.AuthenticationAudience)
+	klog.V(1).Infof("AgentDualAuthentication set to %v.\n", o.AgentDualAuthentication)
 	klog.V(1).Infof("KubeconfigPath set to %q.\n", o.KubeconfigPath)
 	klog.V(1).Infof("KubeconfigQPS set to %f.\n", o.KubeconfigQPS)
 	klog.V(1).Infof("KubeconfigBurst set to %d.\n", o.KubeconfigBurst)
 	klog.V(1).Infof("ProxyStrategies set to %q.\n", o.ProxyStrategies)
 	klog.V(1).Infof("WarnOnChannelLimit set to %t.\n", o.WarnOnChannelLimit)
 	klog.V(1).Infof("CipherSuites set to %q.\n", o.CipherSuites)
+	klog.V(1).Infof("DataCompression set to %q.\n", o.DataCompression)
+	klog.V(1).Infof("AuditLogPath set to %q.\n", o.AuditLogPath)
+	klog.V(1).Infof("AuditLogMaxSize set to %d.\n", o.AuditLogMaxSize)
+	klog.V(1).Infof("AuditLogMaxBackups set to %d.\n", o.AuditLogMaxBackups)
+	klog.V(1).Infof("AuditQueueDir set to %q.\n", o.AuditQueueDir)
+	klog.V(1).Infof("AuditQueueMaxSize set to %d.\n", o.AuditQueueMaxSize)
+	klog.V(1).Infof("AuditQueueMaxWait set to %v.\n", o.AuditQueueMaxWait)
+	klog.V(1).Infof("AuditQueueRetryInterval set to %v.\n", o.AuditQueueRetryInterval)
+	klog.V(1).Infof("MetricsAgentIDLabelLimit set to %d.\n", o.MetricsAgentIDLabelLimit)
+	klog.V(1).Infof("TracingOTLPEndpoint set to %q.\n", o.TracingOTLPEndpoint)
+	klog.V(1).Infof("PacketChunkSize set to %d.\n", o.PacketChunkSize)
 }
 
 func (o *ProxyRunOptions) Validate() error {
@@ -194,22 +704,73 @@ func (o *ProxyRunOptions) Validate() error {
 			return fmt.Errorf("error checking cluster CA cert %s, got %v", o.ClusterCaCert, err)
 		}
 	}
-	if o.Mode != "grpc" && o.Mode != "http-connect" {
+	if o.ClusterSessionTicketKeyFile != "" {
+		if _, err := util.LoadSessionTicketKeys(o.ClusterSessionTicketKeyFile); err != nil {
+			return err
+		}
+	}
+	if o.HTTPConnectMaxHeaderBytes < 0 {
+		return fmt.Errorf("http connect max header bytes %d must not be negative", o.HTTPConnectMaxHeaderBytes)
+	}
+	if o.HTTPConnectMaxHeaderCount < 0 {
+		return fmt.Errorf("http connect max header count %d must not be negative", o.HTTPConnectMaxHeaderCount)
+	}
+	if o.MaxConcurrentAgentHandshakes < 0 {
+		return fmt.Errorf("max concurrent agent handshakes %d must not be negative", o.MaxConcurrentAgentHandshakes)
+	}
+	if o.AgentHandshakeQueueTimeout < 0 {
+		return fmt.Errorf("agent handshake queue timeout %v must not be negative", o.AgentHandshakeQueueTimeout)
+	}
+	for name, d := range map[string]time.Duration{
+		"keepalive time":              o.KeepaliveTime,
+		"frontend keepalive time":     o.FrontendKeepaliveTime,
+		"keepalive timeout":           o.KeepaliveTimeout,
+		"frontend keepalive timeout":  o.FrontendKeepaliveTimeout,
+		"keepalive min time":          o.KeepaliveMinTime,
+		"frontend keepalive min time": o.FrontendKeepaliveMinTime,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s %v must not be negative", name, d)
+		}
+	}
+	if o.Mode != ModeGRPC && o.Mode != ModeHTTPConnect {
 		return fmt.Errorf("mode must be set to either 'grpc' or 'http-connect' not %q", o.Mode)
 	}
+	if err := o.validateAdditionalFrontends(); err != nil {
+		return err
+	}
 	if o.UdsName != "" {
 		if o.ServerPort != 0 {
 			return fmt.Errorf("server port should be set to 0 not %d for UDS", o.ServerPort)
 		}
-		if o.ServerKey != "" {
-			return fmt.Errorf("server key should not be set for UDS")
+		if !o.servesTCP() {
+			if o.ServerKey != "" {
+				return fmt.Errorf("server key should not be set for UDS")
+			}
+			if o.ServerCert != "" {
+				return fmt.Errorf("server cert should not be set for UDS")
+			}
+			if o.ServerCaCert != "" {
+				return fmt.Errorf("server ca cert should not be set for UDS")
+			}
 		}
-		if o.ServerCert != "" {
-			return fmt.Errorf("server cert should not be set for UDS")
+		if _, err := o.UDSFileMode(); err != nil {
+			return err
 		}
-		if o.ServerCaCert != "" {
-			return fmt.Errorf("server ca cert should not be set for UDS")
+		if IsAbstractSocket(o.UdsName) {
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("abstract unix domain socket %q is only supported on Linux", o.UdsName)
+			}
+			if o.UDSMode != "" || o.UDSUID != -1 || o.UDSGID != -1 {
+				return fmt.Errorf("abstract unix domain socket %q has no file mode or owner", o.UdsName)
+			}
 		}
+		if (len(o.UDSAllowedPeerUIDs) > 0 || len(o.UDSAllowedPeerGIDs) > 0) && runtime.GOOS != "linux" {
+			return fmt.Errorf("unix domain socket peer verification is only supported on Linux")
+		}
+	}
+	if err := o.validateFrontendAuth(); err != nil {
+		return err
 	}
 	if o.ServerPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the server port", o.ServerPort)
@@ -217,12 +778,18 @@ func (o *ProxyRunOptions) Validate() error {
 	if o.AgentPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the agent port", o.AgentPort)
 	}
+	if o.AgentWebSocketPort > 49151 {
+		return fmt.Errorf("please do not try to use ephemeral port %d for the agent websocket port", o.AgentWebSocketPort)
+	}
 	if o.AdminPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the admin port", o.AdminPort)
 	}
 	if o.HealthPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the health port", o.HealthPort)
 	}
+	if o.MetricsPort > 49151 {
+		return fmt.Errorf("please do not try to use ephemeral port %d for the metrics port", o.MetricsPort)
+	}
 
 	if o.ServerPort < 1024 {
 		if o.UdsName == "" {
@@ -232,21 +799,236 @@ func (o *ProxyRunOptions) Validate() error {
 	if o.AgentPort < 1024 {
 		return fmt.Errorf("please do not try to use reserved port %d for the agent port", o.AgentPort)
 	}
-	if o.AdminPort < 1024 {
+	if o.AgentWebSocketPort != 0 && o.AgentWebSocketPort < 1024 {
+		return fmt.Errorf("please do not try to use reserved port %d for the agent websocket port", o.AgentWebSocketPort)
+	}
+	if o.AdminPort != 0 && o.AdminPort < 1024 {
 		return fmt.Errorf("please do not try to use reserved port %d for the admin port", o.AdminPort)
 	}
-	if o.HealthPort < 1024 {
+	if o.HealthPort != 0 && o.HealthPort < 1024 {
 		return fmt.Errorf("please do not try to use reserved port %d for the health port", o.HealthPort)
 	}
+	if o.MetricsPort != 0 && o.MetricsPort < 1024 {
+		return fmt.Errorf("please do not try to use reserved port %d for the metrics port", o.MetricsPort)
+	}
+	for _, aux := range []struct{ name, cert, key string }{
+		{"admin", o.AdminCert, o.AdminKey},
+		{"metrics", o.MetricsCert, o.MetricsKey},
+		{"health", o.HealthCert, o.HealthKey},
+	} {
+		if (aux.cert == "") != (aux.key == "") {
+			return fmt.Errorf("--%s-cert and --%s-key must be set together", aux.name, aux.name)
+		}
+		if aux.cert != "" {
+			if _, err := os.Stat(aux.cert); os.IsNotExist(err) {
+				return fmt.Errorf("error checking %s cert %s, got %v", aux.name, aux.cert, err)
+			}
+			if _, err := os.Stat(aux.key); os.IsNotExist(err) {
+				return fmt.Errorf("error checking %s key %s, got %v", aux.name, aux.key, err)
+			}
+		}
+	}
+	if o.AuxServerShutdownTimeout < 0 {
+		return fmt.Errorf("aux server shutdown timeout %v must not be negative", o.AuxServerShutdownTimeout)
+	}
+	if o.PeerPort > 49151 {
+		return fmt.Errorf("please do not try to use ephemeral port %d for the peer port", o.PeerPort)
+	}
+	if o.PeerPort != 0 && o.PeerPort < 1024 {
+		return fmt.Errorf("please do not try to use reserved port %d for the peer port", o.PeerPort)
+	}
+	if o.PeerPort != 0 && o.PeerSyncInterval <= 0 {
+		return fmt.Errorf("peer sync interval %v must be positive", o.PeerSyncInterval)
+	}
+	if o.PeerPort != 0 && (o.ClusterCert == "" || o.ClusterCaCert == "") {
+		return fmt.Errorf("--peer-port requires the cluster certificates and CA to authenticate the peers")
+	}
+	if o.PeerPort != 0 && o.PeerTLSServerName == "" {
+		// The cluster CA also signs the agent certificates, so any
+		// certificate it issued would otherwise be accepted as a peer.
+		return fmt.Errorf("--peer-port requires --peer-tls-server-name to tell the peers apart from other holders of cluster certificates")
+	}
+	if o.PeerRelay && o.PeerPort == 0 {
+		return fmt.Errorf("--peer-relay requires --peer-port")
+	}
+	if o.TopologyHints && o.PeerPort == 0 {
+		return fmt.Errorf("--topology-hints requires --peer-port")
+	}
+	if o.TopologyHints && o.AgentZoneLabel == "" {
+		return fmt.Errorf("--topology-hints requires --agent-zone-label")
+	}
+	if o.ZoneAffinity && (o.Zone == "" || o.AgentZoneLabel == "") {
+		return fmt.Errorf("--zone-affinity requires --zone and --agent-zone-label")
+	}
+	if o.ZoneSpilloverThreshold <= 0 || o.ZoneSpilloverThreshold > 1 {
+		return fmt.Errorf("zone spillover threshold %v must be in (0, 1]", o.ZoneSpilloverThreshold)
+	}
+	if o.AgentAdvertiseAddress != "" {
+		if _, _, err := net.SplitHostPort(o.AgentAdvertiseAddress); err != nil {
+			return fmt.Errorf("agent advertise address %q must be host:port: %v", o.AgentAdvertiseAddress, err)
+		}
+	}
+	if o.AgentLeaseNamespace != "" && o.AgentLeaseGracePeriod < 0 {
+		return fmt.Errorf("agent lease grace period %v must not be negative", o.AgentLeaseGracePeriod)
+	}
+	if o.CanaryPercent < 0 || o.CanaryPercent > 100 {
+		return fmt.Errorf("canary percent %v must be between 0 and 100", o.CanaryPercent)
+	}
+	if o.BackendSendRetries < 0 {
+		return fmt.Errorf("backend send retries %d must not be negative", o.BackendSendRetries)
+	}
+	if o.BackendSendRetries > 0 {
+		if o.BackendSendRetryBackoff <= 0 || o.BackendSendRetryMaxBackoff < o.BackendSendRetryBackoff {
+			return fmt.Errorf("backend send retry backoff %v must be positive and at most the max backoff %v", o.BackendSendRetryBackoff, o.BackendSendRetryMaxBackoff)
+		}
+		if o.BackendSendRetryBudget < 1 {
+			return fmt.Errorf("backend send retry budget %d must be positive", o.BackendSendRetryBudget)
+		}
+	}
+	if o.BandwidthLimitPerConnection < 0 {
+		return fmt.Errorf("bandwidth limit per connection %d must not be negative", o.BandwidthLimitPerConnection)
+	}
+	if o.BandwidthLimitPerAgent < 0 {
+		return fmt.Errorf("bandwidth limit per agent %d must not be negative", o.BandwidthLimitPerAgent)
+	}
+	if o.SendQueueDepth < 0 {
+		return fmt.Errorf("send queue depth %d must not be negative", o.SendQueueDepth)
+	}
+	if _, err := server.ParseSendQueuePolicy(o.SendQueuePolicy); err != nil {
+		return err
+	}
+	if o.SendQueueSpillDir != "" {
+		if info, err := os.Stat(o.SendQueueSpillDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("send queue spill dir %s must be a directory", o.SendQueueSpillDir)
+		}
+	}
+	if _, err := server.ParsePriorityWeights(o.PriorityWeights); err != nil {
+		return err
+	}
+	if o.DataCheckpointInterval < 0 {
+		return fmt.Errorf("data checkpoint interval %v must not be negative", o.DataCheckpointInterval)
+	}
+	if o.AgentSessionGrace < 0 {
+		return fmt.Errorf("agent session grace %v must not be negative", o.AgentSessionGrace)
+	}
+	if o.AgentSessionReplayBufferSize <= 0 {
+		return fmt.Errorf("agent session replay buffer size %d must be positive", o.AgentSessionReplayBufferSize)
+	}
+	if o.ConnectionMigrationTimeout < 0 {
+		return fmt.Errorf("connection migration timeout %v must not be negative", o.ConnectionMigrationTimeout)
+	}
+	if err := agent.ValidateProtocolVersion(o.MaxAgentProtocolVersion); err != nil {
+		return err
+	}
+	if o.ScaleHintsInterval <= 0 {
+		return fmt.Errorf("scale hints interval %v must be positive", o.ScaleHintsInterval)
+	}
+	if o.ScaleTargetConnections < 0 || o.ScaleTargetPendingDials < 0 {
+		return fmt.Errorf("scale targets must not be negative")
+	}
+	if o.ScaleTargetCPU < 0 || o.ScaleTargetCPU > 1 {
+		return fmt.Errorf("scale target cpu %v must be between 0 and 1", o.ScaleTargetCPU)
+	}
+	if o.PeaksWindow <= 0 {
+		return fmt.Errorf("peaks window %v must be positive", o.PeaksWindow)
+	}
+	if o.ConnTableSweepInterval <= 0 {
+		return fmt.Errorf("conn table sweep interval %v must be positive", o.ConnTableSweepInterval)
+	}
+	if o.ConnTableTTL < 0 {
+		return fmt.Errorf("conn table ttl %v must not be negative", o.ConnTableTTL)
+	}
+	if o.ConnectionIdleTimeout < 0 {
+		return fmt.Errorf("connection idle timeout %v must not be negative", o.ConnectionIdleTimeout)
+	}
+	if o.ConnectionMaxLifetime < 0 {
+		return fmt.Errorf("connection max lifetime %v must not be negative", o.ConnectionMaxLifetime)
+	}
+	if o.MaxAgentConnectionAge < 0 {
+		return fmt.Errorf("max agent connection age %v must not be negative", o.MaxAgentConnectionAge)
+	}
+	if o.AgentConnectionAgeJitter < 0 || o.AgentConnectionAgeJitter >= 1 {
+		return fmt.Errorf("agent connection age jitter %v must be in [0, 1)", o.AgentConnectionAgeJitter)
+	}
+	if o.AgentConnectionDrainTimeout < 0 {
+		return fmt.Errorf("agent connection drain timeout %v must not be negative", o.AgentConnectionDrainTimeout)
+	}
+	if o.CircuitBreakerFailures < 0 {
+		return fmt.Errorf("circuit breaker failures %d must not be negative", o.CircuitBreakerFailures)
+	}
+	if o.CircuitBreakerFailures > 0 && o.CircuitBreakerCooldown <= 0 {
+		return fmt.Errorf("circuit breaker cooldown %v must be positive", o.CircuitBreakerCooldown)
+	}
+	if o.AnomalyWindow < 0 {
+		return fmt.Errorf("anomaly window %v must not be negative", o.AnomalyWindow)
+	}
+	if o.AnomalyWindow > 0 && o.AnomalyThreshold <= 0 {
+		return fmt.Errorf("anomaly threshold %v must be positive", o.AnomalyThreshold)
+	}
+	if o.AnomalyMinDestinations < 1 {
+		return fmt.Errorf("anomaly min destinations %d must be at least 1", o.AnomalyMinDestinations)
+	}
+	for _, ps := range o.DestHostDNSStrategies {
+		switch ps {
+		case string(server.ProxyStrategyDestHost), string(server.ProxyStrategyDestHostHash):
+		default:
+			return fmt.Errorf("dest host dns strategy %q must be %s or %s", ps, server.ProxyStrategyDestHost, server.ProxyStrategyDestHostHash)
+		}
+	}
+	if o.DestHostDNSTTL < 0 || o.DestHostDNSNegativeTTL < 0 {
+		return fmt.Errorf("dest host dns ttls must not be negative")
+	}
+	if o.DestHostDNSTimeout < 0 {
+		return fmt.Errorf("dest host dns timeout %v must not be negative", o.DestHostDNSTimeout)
+	}
+	resolverConfig := agent.ResolverConfig{Nameservers: o.DestHostDNSNameservers}
+	if err := resolverConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid dest host dns nameservers: %v", err)
+	}
+	if o.LogFormat != util.LogFormatText && o.LogFormat != util.LogFormatJSON {
+		return fmt.Errorf("log format %q must be %q or %q", o.LogFormat, util.LogFormatText, util.LogFormatJSON)
+	}
+	if _, err := util.ParseLogLevels(o.LogLevels); err != nil {
+		return fmt.Errorf("invalid log levels: %v", err)
+	}
+	for _, dest := range o.PortForwardDestinations {
+		if _, _, err := net.SplitHostPort(dest); err != nil {
+			return fmt.Errorf("invalid port forward destination %q: %v", dest, err)
+		}
+	}
+	if o.BackendUpdateBatchInterval < 0 {
+		return fmt.Errorf("backend update batch interval %v must not be negative", o.BackendUpdateBatchInterval)
+	}
+	if o.ReadinessGracePeriod < 0 {
+		return fmt.Errorf("readiness grace period %v must not be negative", o.ReadinessGracePeriod)
+	}
+	if o.ReadinessRequiresBackends < 0 {
+		return fmt.Errorf("readiness required backends %d must not be negative", o.ReadinessRequiresBackends)
+	}
+	for _, id := range o.ReadinessRequiredAgents {
+		if parts := strings.SplitN(id, "=", 2); len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("readiness required agent identifier %q must be type=value", id)
+		}
+	}
+	if o.PortForwardDialTimeout < 0 {
+		return fmt.Errorf("port forward dial timeout %v must not be negative", o.PortForwardDialTimeout)
+	}
+	for _, peer := range o.PeerAddresses {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("invalid peer address %q: %v", peer, err)
+		}
+	}
 	if o.EnableContentionProfiling && !o.EnableProfiling {
 		return fmt.Errorf("if --enable-contention-profiling is set, --enable-profiling must also be set")
 	}
 
 	// validate agent authentication params
 	// all 4 parameters must be empty or must have value (except KubeconfigPath that might be empty)
-	if o.AgentNamespace != "" || o.AgentServiceAccount != "" || o.AuthenticationAudience != "" || o.KubeconfigPath != "" {
-		if o.ClusterCaCert != "" {
-			return fmt.Errorf("ClusterCaCert can not be used when service account authentication is enabled")
+	// KubeconfigPath may also be used on its own to watch the agent Leases
+	// or the egress policy.
+	if o.AgentNamespace != "" || o.AgentServiceAccount != "" || o.AuthenticationAudience != "" || (o.KubeconfigPath != "" && o.AgentLeaseNamespace == "" && o.EgressPolicyConfigMap == "") {
+		if o.ClusterCaCert != "" && !o.AgentDualAuthentication {
+			return fmt.Errorf("ClusterCaCert can not be used when service account authentication is enabled, unless AgentDualAuthentication is set")
 		}
 		if o.AgentNamespace == "" {
 			return fmt.Errorf("AgentNamespace cannot be empty when agent authentication is enabled")
@@ -264,16 +1046,27 @@ func (o *ProxyRunOptions) Validate() error {
 		}
 	}
 
+	if o.AgentDualAuthentication {
+		if o.ClusterCaCert == "" {
+			return fmt.Errorf("ClusterCaCert cannot be empty when AgentDualAuthentication is set")
+		}
+		if o.AgentNamespace == "" {
+			return fmt.Errorf("service account authentication must be enabled when AgentDualAuthentication is set")
+		}
+	}
+
 	// validate the proxy strategies
 	if o.ProxyStrategies != "" {
 		pss := strings.Split(o.ProxyStrategies, ",")
 		for _, ps := range pss {
 			switch ps {
 			case string(server.ProxyStrategyDestHost):
+			case string(server.ProxyStrategyDestHostHash):
 			case string(server.ProxyStrategyDefault):
 			case string(server.ProxyStrategyDefaultRoute):
+			case string(server.ProxyStrategyLabelSelector):
 			default:
-				return fmt.Errorf("unknown proxy strategy: %s, available strategy are: default, destHost, defaultRoute", ps)
+				return fmt.Errorf("unknown proxy strategy: %s, available strategy are: default, destHost, destHostHash, defaultRoute, labelSelector", ps)
 			}
 		}
 	}
@@ -290,39 +1083,381 @@ func (o *ProxyRunOptions) Validate() error {
 		}
 	}
 
+	if err := o.validateProfile(); err != nil {
+		return err
+	}
+
+	if o.DataCompression != "" && !util.SupportedCompression(o.DataCompression) {
+		return fmt.Errorf("data compression %q is not supported, available compressions are: %s", o.DataCompression, util.CompressionGzip)
+	}
+	if o.AuditLogMaxSize < 0 {
+		return fmt.Errorf("audit log max size %d must not be negative", o.AuditLogMaxSize)
+	}
+	if o.AuditLogMaxBackups < 0 {
+		return fmt.Errorf("audit log max backups %d must not be negative", o.AuditLogMaxBackups)
+	}
+	if o.AuditQueueDir != "" {
+		if o.AuditLogPath == "" {
+			return fmt.Errorf("--audit-queue-dir requires --audit-log-path")
+		}
+		if o.AuditQueueMaxSize <= 0 {
+			return fmt.Errorf("audit queue max size %d must be positive", o.AuditQueueMaxSize)
+		}
+		if o.AuditQueueMaxWait < 0 {
+			return fmt.Errorf("audit queue max wait %v must not be negative", o.AuditQueueMaxWait)
+		}
+		if o.AuditQueueRetryInterval <= 0 {
+			return fmt.Errorf("audit queue retry interval %v must be positive", o.AuditQueueRetryInterval)
+		}
+	}
+	if o.MetricsAgentIDLabelLimit < 0 {
+		return fmt.Errorf("metrics agent ID label limit %d must not be negative", o.MetricsAgentIDLabelLimit)
+	}
+	if o.TracingOTLPEndpoint != "" {
+		u, err := url.Parse(o.TracingOTLPEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing OTLP endpoint %q must be an http or https URL", o.TracingOTLPEndpoint)
+		}
+	}
+	if o.PacketChunkSize <= 0 {
+		return fmt.Errorf("packet chunk size %d must be positive", o.PacketChunkSize)
+	}
+
 	return nil
 }
 
 func NewProxyRunOptions() *ProxyRunOptions {
 	o := ProxyRunOptions{
-		ServerCert:                "",
-		ServerKey:                 "",
-		ServerCaCert:              "",
-		ClusterCert:               "",
-		ClusterKey:                "",
-		ClusterCaCert:             "",
-		Mode:                      "grpc",
-		UdsName:                   "",
-		DeleteUDSFile:             false,
-		ServerPort:                8090,
-		AgentPort:                 8091,
-		HealthPort:                8092,
-		AdminPort:                 8095,
-		KeepaliveTime:             1 * time.Hour,
-		FrontendKeepaliveTime:     1 * time.Hour,
-		EnableProfiling:           false,
-		EnableContentionProfiling: false,
-		ServerID:                  uuid.New().String(),
-		ServerCount:               1,
-		AgentNamespace:            "",
-		AgentServiceAccount:       "",
-		KubeconfigPath:            "",
-		KubeconfigQPS:             0,
-		KubeconfigBurst:           0,
-		AuthenticationAudience:    "",
-		ProxyStrategies:           "default",
-		WarnOnChannelLimit:        false,
-		CipherSuites:              "",
+		ConfigFile:                   "",
+		Profile:                      "",
+		ServerCert:                   "",
+		ServerKey:                    "",
+		ServerCaCert:                 "",
+		FrontendAuthentication:       nil,
+		FrontendAllowedNames:         nil,
+		FrontendTokenAuthFile:        "",
+		FrontendAuthorizationRules:   nil,
+		EgressPolicyConfigMap:        "",
+		EgressPolicyAllowMissing:     false,
+		ConnectAuthentication:        nil,
+		ConnectBasicAuthFile:         "",
+		ConnectTokenAuthFile:         "",
+		ConnectAuthWebhookURL:        "",
+		ConnectAuthWebhookCACert:     "",
+		ConnectAuthWebhookTimeout:    10 * time.Second,
+		HTTPConnectMaxHeaderBytes:    64 * 1024,
+		HTTPConnectMaxHeaderCount:    100,
+		ClusterCert:                  "",
+		ClusterKey:                   "",
+		ClusterCaCert:                "",
+		Mode:                         "grpc",
+		UdsName:                      "",
+		DeleteUDSFile:                false,
+		UDSMode:                      "",
+		UDSUID:                       -1,
+		UDSGID:                       -1,
+		UDSAllowedPeerUIDs:           nil,
+		UDSAllowedPeerGIDs:           nil,
+		AdditionalFrontends:          nil,
+		ServerPort:                   8090,
+		AgentPort:                    8091,
+		AgentWebSocketPort:           0,
+		HealthPort:                   8092,
+		HealthBindAddress:            "",
+		HealthCert:                   "",
+		HealthKey:                    "",
+		AdminPort:                    8095,
+		AdminBindAddress:             "127.0.0.1",
+		AdminCert:                    "",
+		AdminKey:                     "",
+		MetricsPort:                  0,
+		MetricsBindAddress:           "",
+		MetricsCert:                  "",
+		MetricsKey:                   "",
+		AuxServerShutdownTimeout:     10 * time.Second,
+		PeerPort:                     0,
+		PeerAddresses:                nil,
+		PeerAdvertiseAddress:         "",
+		PeerSyncInterval:             10 * time.Second,
+		PeerTLSServerName:            "",
+		PeerRelay:                    false,
+		TopologyHints:                false,
+		Zone:                         "",
+		AgentZoneLabel:               server.DefaultTopologyZoneLabel,
+		ZoneAffinity:                 false,
+		ZoneSpilloverThreshold:       server.DefaultSpilloverThreshold,
+		AgentAdvertiseAddress:        "",
+		AgentLeaseNamespace:          "",
+		AgentLeaseGracePeriod:        time.Minute,
+		CanaryPercent:                0,
+		BackendSendRetries:           3,
+		BackendSendRetryBackoff:      10 * time.Millisecond,
+		BackendSendRetryMaxBackoff:   200 * time.Millisecond,
+		BackendSendRetryBudget:       60,
+		BandwidthLimitPerConnection:  0,
+		BandwidthLimitPerAgent:       0,
+		SendQueueDepth:               0,
+		SendQueuePolicy:              string(server.SendQueueBlock),
+		SendQueueSpillDir:            "",
+		PriorityScheduling:           false,
+		PriorityWeights:              "high=8,medium=4,low=1",
+		DataCheckpointInterval:       0,
+		AgentSessionGrace:            0,
+		AgentSessionReplayBufferSize: 256 * 1024,
+		ConnectionMigrationTimeout:   0,
+		MaxAgentProtocolVersion:      agent.ProtocolVersion,
+		ScaleHintsInterval:           15 * time.Second,
+		ScaleTargetConnections:       1000,
+		ScaleTargetPendingDials:      100,
+		ScaleTargetCPU:               0.7,
+		PeaksWindow:                  24 * time.Hour,
+		PeaksFile:                    "",
+		ConnTableSweepInterval:       server.DefaultConnJanitorInterval,
+		ConnTableTTL:                 0,
+		ConnectionIdleTimeout:        0,
+		ConnectionMaxLifetime:        0,
+		MaxAgentConnectionAge:        0,
+		AgentConnectionAgeJitter:     0.1,
+		AgentConnectionDrainTimeout:  5 * time.Minute,
+		CircuitBreakerFailures:       0,
+		CircuitBreakerCooldown:       30 * time.Second,
+		AnomalyWindow:                0,
+		AnomalyThreshold:             3,
+		AnomalyMinDestinations:       10,
+		DestHostDNSStrategies:        nil,
+		DestHostDNSTTL:               30 * time.Second,
+		DestHostDNSNegativeTTL:       5 * time.Second,
+		DestHostDNSTimeout:           time.Second,
+		DestHostDNSNameservers:       nil,
+		LogFormat:                    util.LogFormatText,
+		LogLevels:                    "",
+		PortForwardDestinations:      nil,
+		PortForwardDialTimeout:       10 * time.Second,
+		BackendUpdateBatchInterval:   0,
+		ReadinessGracePeriod:         0,
+		ReadinessRequiresBackends:    0,
+		ReadinessRequiredAgents:      nil,
+		ClusterSessionTicketKeyFile:  "",
+		MaxConcurrentAgentHandshakes: 0,
+		AgentHandshakeQueueTimeout:   10 * time.Second,
+		KeepaliveTime:                1 * time.Hour,
+		FrontendKeepaliveTime:        1 * time.Hour,
+		KeepaliveTimeout:             0,
+		FrontendKeepaliveTimeout:     0,
+		KeepaliveMinTime:             5 * time.Minute,
+		KeepalivePermitIdle:          false,
+		FrontendKeepaliveMinTime:     5 * time.Minute,
+		FrontendKeepalivePermitIdle:  false,
+		EnableProfiling:              false,
+		EnableContentionProfiling:    false,
+		ServerID:                     uuid.New().String(),
+		ServerCount:                  1,
+		AgentNamespace:               "",
+		AgentServiceAccount:          "",
+		KubeconfigPath:               "",
+		KubeconfigQPS:                0,
+		KubeconfigBurst:              0,
+		AuthenticationAudience:       "",
+		AgentDualAuthentication:      false,
+		ProxyStrategies:              "default",
+		WarnOnChannelLimit:           false,
+		CipherSuites:                 "",
+		DataCompression:              "",
+		AuditLogPath:                 "",
+		AuditLogMaxSize:              100,
+		AuditLogMaxBackups:           5,
+		AuditQueueDir:                "",
+		AuditQueueMaxSize:            100,
+		AuditQueueMaxWait:            5 * time.Second,
+		AuditQueueRetryInterval:      10 * time.Second,
+		MetricsAgentIDLabelLimit:     100,
+		TracingOTLPEndpoint:          "",
+		PacketChunkSize:              server.DefaultPacketChunkSize,
 	}
 	return &o
 }
+
+// IsAbstractSocket reports if the unix domain socket name is in the Linux
+// abstract namespace, i.e. starts with @.
+func IsAbstractSocket(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// UDSFileMode returns the file mode of the UdsName socket, 0 to keep the
+// default.
+func (o *ProxyRunOptions) UDSFileMode() (os.FileMode, error) {
+	if o.UDSMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(o.UDSMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix domain socket mode %q, must be octal permissions such as 0660", o.UDSMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Frontend authentication methods of FrontendAuthentication.
+const (
+	FrontendAuthCertificate = "certificate"
+	FrontendAuthToken       = "token"
+)
+
+func (o *ProxyRunOptions) validateFrontendAuth() error {
+	if len(o.FrontendAuthentication) > 0 && !o.servesOnlyGRPC() {
+		return fmt.Errorf("frontend authentication is only supported in grpc mode, use --connect-authentication in http-connect mode")
+	}
+	for _, method := range o.FrontendAuthentication {
+		switch method {
+		case FrontendAuthCertificate:
+			if o.ServerCaCert == "" {
+				return fmt.Errorf("frontend certificate authentication requires the server ca cert")
+			}
+		case FrontendAuthToken:
+			if o.FrontendTokenAuthFile == "" {
+				return fmt.Errorf("frontend token authentication requires the frontend token auth file")
+			}
+		default:
+			return fmt.Errorf("frontend authentication method %q must be %q or %q", method, FrontendAuthCertificate, FrontendAuthToken)
+		}
+	}
+	if _, err := server.ParseFrontendAuthorizationRules(o.FrontendAuthorizationRules); err != nil {
+		return fmt.Errorf("frontend authorization rules are invalid: %v", err)
+	}
+	if o.EgressPolicyConfigMap != "" {
+		if _, _, err := o.EgressPolicyRef(); err != nil {
+			return err
+		}
+	}
+	if o.EgressPolicyAllowMissing && o.EgressPolicyConfigMap == "" {
+		return fmt.Errorf("egress policy allow missing requires an egress policy configmap")
+	}
+	return o.validateConnectAuth()
+}
+
+func (o *ProxyRunOptions) validateConnectAuth() error {
+	if len(o.ConnectAuthentication) == 0 {
+		return nil
+	}
+	if !o.hasFrontend(func(l FrontendListener) bool { return l.Mode == ModeHTTPConnect }) {
+		return fmt.Errorf("connect authentication requires a frontend in http-connect mode")
+	}
+	for _, scheme := range o.ConnectAuthentication {
+		switch scheme {
+		case server.ProxyAuthBasic:
+			if o.ConnectBasicAuthFile == "" && o.ConnectAuthWebhookURL == "" {
+				return fmt.Errorf("connect basic authentication requires the connect basic auth file or the connect auth webhook url")
+			}
+		case server.ProxyAuthBearer:
+			if o.ConnectTokenAuthFile == "" && o.ConnectAuthWebhookURL == "" {
+				return fmt.Errorf("connect bearer authentication requires the connect token auth file or the connect auth webhook url")
+			}
+		default:
+			return fmt.Errorf("connect authentication scheme %q must be %q or %q", scheme, server.ProxyAuthBasic, server.ProxyAuthBearer)
+		}
+	}
+	if o.ConnectAuthWebhookURL != "" {
+		u, err := url.Parse(o.ConnectAuthWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("connect auth webhook url %q must be an http or https URL", o.ConnectAuthWebhookURL)
+		}
+		if o.ConnectAuthWebhookTimeout <= 0 {
+			return fmt.Errorf("connect auth webhook timeout %v must be positive", o.ConnectAuthWebhookTimeout)
+		}
+	}
+	return nil
+}
+
+// EgressPolicyRef returns the namespace and the name of the
+// EgressPolicyConfigMap.
+func (o *ProxyRunOptions) EgressPolicyRef() (string, string, error) {
+	parts := strings.Split(o.EgressPolicyConfigMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("egress policy configmap %q must be namespace/name", o.EgressPolicyConfigMap)
+	}
+	return parts[0], parts[1], nil
+}
+
+// FrontendAuth returns the authenticators and the authorizer of the
+// frontends, nil if they are disabled.
+func (o *ProxyRunOptions) FrontendAuth() ([]server.FrontendAuthenticator, server.FrontendAuthorizer, error) {
+	var authenticators []server.FrontendAuthenticator
+	for _, method := range o.FrontendAuthentication {
+		switch method {
+		case FrontendAuthCertificate:
+			authenticators = append(authenticators, &server.CertificateAuthenticator{AllowedNames: o.FrontendAllowedNames})
+		case FrontendAuthToken:
+			a, err := server.NewTokenAuthenticatorFromFile(o.FrontendTokenAuthFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			authenticators = append(authenticators, a)
+		}
+	}
+	authorizer, err := o.FrontendAuthorizer()
+	if err != nil {
+		return nil, nil, err
+	}
+	return authenticators, authorizer, nil
+}
+
+// FrontendAuthorizer returns the authorizer of the dials of the frontends,
+// nil if any dial is allowed.
+func (o *ProxyRunOptions) FrontendAuthorizer() (server.FrontendAuthorizer, error) {
+	if len(o.FrontendAuthorizationRules) == 0 {
+		return nil, nil
+	}
+	rules, err := server.ParseFrontendAuthorizationRules(o.FrontendAuthorizationRules)
+	if err != nil {
+		return nil, err
+	}
+	return &server.RuleAuthorizer{Rules: rules}, nil
+}
+
+// ConnectAuth returns the authenticator of the CONNECT requests, nil if
+// they are not authenticated.
+func (o *ProxyRunOptions) ConnectAuth() (*server.ConnectAuthenticator, error) {
+	if len(o.ConnectAuthentication) == 0 {
+		return nil, nil
+	}
+	a := &server.ConnectAuthenticator{Schemes: o.ConnectAuthentication}
+	if o.ConnectBasicAuthFile != "" || o.ConnectTokenAuthFile != "" {
+		v, err := server.NewStaticProxyCredentialVerifier(o.ConnectBasicAuthFile, o.ConnectTokenAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		a.Verifiers = append(a.Verifiers, v)
+	}
+	if o.ConnectAuthWebhookURL != "" {
+		var tlsConfig *tls.Config
+		if o.ConnectAuthWebhookCACert != "" {
+			u, _ := url.Parse(o.ConnectAuthWebhookURL)
+			var err error
+			if tlsConfig, err = util.GetClientTLSConfig(o.ConnectAuthWebhookCACert, "", "", u.Hostname(), nil); err != nil {
+				return nil, err
+			}
+		}
+		a.Verifiers = append(a.Verifiers, server.NewWebhookProxyCredentialVerifier(o.ConnectAuthWebhookURL, tlsConfig, o.ConnectAuthWebhookTimeout))
+	}
+	return a, nil
+}
+
+// DestHostResolution returns the configuration of the resolution of the
+// hostnames dialed with the destHost strategies.
+func (o *ProxyRunOptions) DestHostResolution() (server.DestHostResolutionConfig, error) {
+	c := server.DestHostResolutionConfig{
+		TTL:         o.DestHostDNSTTL,
+		NegativeTTL: o.DestHostDNSNegativeTTL,
+		Timeout:     o.DestHostDNSTimeout,
+	}
+	for _, ps := range o.DestHostDNSStrategies {
+		c.Strategies = append(c.Strategies, server.ProxyStrategy(ps))
+	}
+	if len(o.DestHostDNSNameservers) > 0 {
+		resolver, err := agent.NewResolver(agent.ResolverConfig{Nameservers: o.DestHostDNSNameservers})
+		if err != nil {
+			return c, err
+		}
+		c.Resolver = resolver
+	}
+	return c, nil
+}
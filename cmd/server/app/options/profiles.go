@@ -0,0 +1,129 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+const (
+	// ProfileSidecar runs the server next to the kube-apiserver, serving
+	// the frontend over a unix domain socket shared in the pod.
+	ProfileSidecar = "sidecar"
+	// ProfileGateway runs the server as a standalone deployment, serving
+	// HTTP CONNECT frontends over mTLS and routing by destination host.
+	ProfileGateway = "gateway"
+	// ProfileMultiTenant serves agents of several tenants. Traffic is only
+	// routed to agents that advertise the destination, never to a random one.
+	ProfileMultiTenant = "multi-tenant"
+)
+
+// profiles maps a profile name to the flag values it sets. Flags given
+// explicitly on the command line always win over the profile.
+var profiles = map[string]map[string]string{
+	ProfileSidecar: {
+		"mode":                     "grpc",
+		"uds-name":                 "/etc/kubernetes/konnectivity-server/konnectivity-server.socket",
+		"delete-existing-uds-file": "true",
+		"server-port":              "0",
+		"proxy-strategies":         "default",
+	},
+	ProfileGateway: {
+		"mode":                    "http-connect",
+		"server-port":             "8090",
+		"agent-port":              "8091",
+		"proxy-strategies":        "destHost,default",
+		"keepalive-time":          "30s",
+		"frontend-keepalive-time": "30s",
+	},
+	ProfileMultiTenant: {
+		"mode":             "grpc",
+		"proxy-strategies": "destHost",
+		"keepalive-time":   "30s",
+	},
+}
+
+// ProfileNames returns the names of the available profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyProfile sets the flags of the selected profile that were not set
+// explicitly. It must be called after the flags have been parsed.
+func (o *ProxyRunOptions) ApplyProfile(flags *pflag.FlagSet) error {
+	if o.Profile == "" {
+		return nil
+	}
+	values, ok := profiles[o.Profile]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, available profiles are: %s", o.Profile, strings.Join(ProfileNames(), ", "))
+	}
+	for name, value := range values {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("profile %q sets unknown flag --%s", o.Profile, name)
+		}
+		if flag.Changed {
+			klog.V(1).Infof("Flag --%s=%s overrides profile %q.\n", name, flag.Value, o.Profile)
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("profile %q failed to set --%s=%s: %v", o.Profile, name, value, err)
+		}
+	}
+	return nil
+}
+
+// validateProfile checks the requirements of the selected profile that
+// cannot be expressed as flag defaults.
+func (o *ProxyRunOptions) validateProfile() error {
+	switch o.Profile {
+	case ProfileSidecar:
+		if o.UdsName == "" {
+			return fmt.Errorf("profile %q requires --uds-name", o.Profile)
+		}
+	case ProfileGateway:
+		if o.ServerCert == "" || o.ServerCaCert == "" {
+			return fmt.Errorf("profile %q requires mTLS for the frontend: set --server-cert, --server-key and --server-ca-cert", o.Profile)
+		}
+	case ProfileMultiTenant:
+		if o.AgentNamespace == "" && o.ClusterCaCert == "" {
+			return fmt.Errorf("profile %q requires agent authentication: set --cluster-ca-cert or --agent-namespace", o.Profile)
+		}
+		for _, ps := range strings.Split(o.ProxyStrategies, ",") {
+			if ps == string(server.ProxyStrategyDefault) {
+				return fmt.Errorf("profile %q must not use the %q proxy strategy, which may route traffic to another tenant's agent", o.Profile, ps)
+			}
+		}
+	case "":
+	default:
+		return fmt.Errorf("unknown profile %q, available profiles are: %s", o.Profile, strings.Join(ProfileNames(), ", "))
+	}
+	return nil
+}
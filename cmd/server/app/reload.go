@@ -0,0 +1,152 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// configCheckInterval is the interval between checks of the config file
+// for changes.
+const configCheckInterval = 10 * time.Second
+
+// configReloader reloads the config file on SIGHUP or when it changes, and
+// applies the settings that can change without dropping agent or frontend
+// connections. Changes to other settings are reported and need a restart.
+// Flags not owned by the options, such as the log verbosity (v), always
+// take effect.
+type configReloader struct {
+	// o are the options in effect.
+	o      *options.ProxyRunOptions
+	server *server.ProxyServer
+	// reaper is nil unless agent leases are watched.
+	reaper  *server.AgentLeaseReaper
+	modTime time.Time
+}
+
+func newConfigReloader(o *options.ProxyRunOptions, s *server.ProxyServer, reaper *server.AgentLeaseReaper) *configReloader {
+	r := &configReloader{o: o, server: s, reaper: reaper}
+	r.modTime, _ = r.configModTime()
+	return r
+}
+
+func (r *configReloader) run(stopCh <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			klog.InfoS("Received SIGHUP, reloading the config file", "path", r.o.ConfigFile)
+			r.reload()
+		case <-ticker.C:
+			modTime, err := r.configModTime()
+			if err != nil || modTime.Equal(r.modTime) {
+				continue
+			}
+			r.modTime = modTime
+			klog.InfoS("Config file changed, reloading it", "path", r.o.ConfigFile)
+			r.reload()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (r *configReloader) configModTime() (time.Time, error) {
+	info, err := os.Stat(r.o.ConfigFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (r *configReloader) reload() {
+	reloaded, err := r.o.Reload()
+	if err != nil {
+		klog.ErrorS(err, "Failed to reload the config file, keeping the current configuration", "path", r.o.ConfigFile)
+		return
+	}
+	applied := *r.o
+	if reloaded.MetricsAgentIDLabelLimit != applied.MetricsAgentIDLabelLimit {
+		metrics.Metrics.SetAgentIDLabelLimit(reloaded.MetricsAgentIDLabelLimit)
+		applied.MetricsAgentIDLabelLimit = reloaded.MetricsAgentIDLabelLimit
+		klog.InfoS("Reloaded setting", "option", "metrics-agent-id-label-limit", "value", reloaded.MetricsAgentIDLabelLimit)
+	}
+	if reloaded.AgentLeaseGracePeriod != applied.AgentLeaseGracePeriod && r.reaper != nil {
+		r.reaper.SetGracePeriod(reloaded.AgentLeaseGracePeriod)
+		applied.AgentLeaseGracePeriod = reloaded.AgentLeaseGracePeriod
+		klog.InfoS("Reloaded setting", "option", "agent-lease-grace-period", "value", reloaded.AgentLeaseGracePeriod)
+	}
+	if reloaded.LogLevels != applied.LogLevels {
+		levels, _ := util.ParseLogLevels(reloaded.LogLevels)
+		util.SetLogLevels(levels)
+		applied.LogLevels = reloaded.LogLevels
+		klog.InfoS("Reloaded setting", "option", "log-levels", "value", reloaded.LogLevels)
+	}
+	if reloaded.BandwidthLimitPerConnection != applied.BandwidthLimitPerConnection || reloaded.BandwidthLimitPerAgent != applied.BandwidthLimitPerAgent {
+		r.server.SetBandwidth(server.BandwidthLimits{
+			PerConnection: reloaded.BandwidthLimitPerConnection,
+			PerAgent:      reloaded.BandwidthLimitPerAgent,
+		})
+		applied.BandwidthLimitPerConnection = reloaded.BandwidthLimitPerConnection
+		applied.BandwidthLimitPerAgent = reloaded.BandwidthLimitPerAgent
+		klog.InfoS("Reloaded setting", "option", "bandwidth-limit", "perConnection", reloaded.BandwidthLimitPerConnection, "perAgent", reloaded.BandwidthLimitPerAgent)
+	}
+	if !reflect.DeepEqual(reloaded.FrontendAuthorizationRules, applied.FrontendAuthorizationRules) {
+		// Validated by Reload.
+		authorizer, _ := reloaded.FrontendAuthorizer()
+		r.server.SetFrontendAuthorizer(authorizer)
+		applied.FrontendAuthorizationRules = reloaded.FrontendAuthorizationRules
+		klog.InfoS("Reloaded setting", "option", "frontend-authorization-rules", "value", reloaded.FrontendAuthorizationRules)
+	}
+	if pending := changedOptions(&applied, reloaded); len(pending) > 0 {
+		klog.InfoS("Changed settings take effect after a restart", "options", pending)
+	}
+	r.o = &applied
+}
+
+// changedOptions returns the names of the options fields which differ
+// between a and b.
+func changedOptions(a, b *options.ProxyRunOptions) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
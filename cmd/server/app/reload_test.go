@@ -0,0 +1,73 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+func writeServerConfig(t *testing.T, path, options string) {
+	content := "apiVersion: konnectivity.k8s.io/v1alpha1\nkind: ProxyServerConfiguration\noptions:\n" + options
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connectStatus returns the status of a CONNECT request to host. Authorized
+// requests fail with 500 as the recorder can't be hijacked.
+func connectStatus(s *server.ProxyServer, host string) int {
+	rec := httptest.NewRecorder()
+	(&server.Tunnel{Server: s}).ServeHTTP(rec, httptest.NewRequest(http.MethodConnect, host, nil))
+	return rec.Code
+}
+
+func TestReloadFrontendAuthorizationRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeServerConfig(t, path, "  mode: http-connect\n")
+	o := options.NewProxyRunOptions()
+	flags := o.Flags()
+	if err := flags.Parse([]string{"--config=" + path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Complete(flags); err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewProxyServer("server-1", []server.ProxyStrategy{server.ProxyStrategyDefault}, 1, nil, false)
+	r := newConfigReloader(o, s, nil)
+
+	if code := connectStatus(s, "node1:22"); code == http.StatusForbidden {
+		t.Fatal("expected any dial to be allowed")
+	}
+	writeServerConfig(t, path, "  mode: http-connect\n  frontend-authorization-rules: \"*=*:10250\"\n")
+	r.reload()
+	if code := connectStatus(s, "node1:22"); code != http.StatusForbidden {
+		t.Errorf("expected the dial to be denied by the reloaded rules, got status %d", code)
+	}
+	if code := connectStatus(s, "node1:10250"); code == http.StatusForbidden {
+		t.Error("expected the dial to be allowed by the reloaded rules")
+	}
+	if changed := changedOptions(r.o, o); len(changed) != 1 || changed[0] != "FrontendAuthorizationRules" {
+		t.Errorf("expected the reloaded rules to be applied, got changes %v", changed)
+	}
+}
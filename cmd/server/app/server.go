@@ -5,19 +5,17 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 	"syscall"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -29,6 +27,8 @@ import (
 	"sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
@@ -40,9 +40,20 @@ func NewProxyCommand(p *Proxy, o *options.ProxyRunOptions) *cobra.Command {
 		Use:  "proxy",
 		Long: `A gRPC proxy server, receives requests from the API server and forwards to the agent.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Complete(cmd.Flags()); err != nil {
+				return err
+			}
 			return p.run(o)
 		},
 	}
+	cmd.AddCommand(
+		newRunCommand(p, o),
+		newValidateCommand(p, o),
+		newVersionCommand(),
+		newDumpConfigCommand(o),
+		newSimulateAgentsCommand(),
+		newConformanceCommand(),
+	)
 
 	return cmd
 }
@@ -71,11 +82,15 @@ func (p *Proxy) run(o *options.ProxyRunOptions) error {
 	if err := o.Validate(); err != nil {
 		return fmt.Errorf("failed to validate server options with %v", err)
 	}
+	if err := util.ConfigureLogging(o.LogFormat, o.LogLevels); err != nil {
+		return fmt.Errorf("failed to configure logging with %v", err)
+	}
+	server.RecordBuildInfo()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	var k8sClient *kubernetes.Clientset
-	if o.AgentNamespace != "" {
+	if o.AgentNamespace != "" || o.AgentLeaseNamespace != "" || o.EgressPolicyConfigMap != "" {
 		config, err := clientcmd.BuildConfigFromFlags("", o.KubeconfigPath)
 		if err != nil {
 			return fmt.Errorf("failed to load kubernetes client config: %v", err)
@@ -107,7 +122,155 @@ func (p *Proxy) run(o *options.ProxyRunOptions) error {
 	if err != nil {
 		return err
 	}
+	metrics.Metrics.SetAgentIDLabelLimit(o.MetricsAgentIDLabelLimit)
+	var auditLogger *server.AuditLogger
+	if o.AuditLogPath != "" {
+		auditLog, err := openAuditLog(o)
+		if err != nil {
+			return fmt.Errorf("failed to open the audit log: %v", err)
+		}
+		defer auditLog.Close()
+		if o.AuditQueueDir != "" {
+			queue, err := server.OpenAuditQueue(o.AuditQueueDir, int64(o.AuditQueueMaxSize)*1024*1024)
+			if err != nil {
+				return fmt.Errorf("failed to open the audit queue: %v", err)
+			}
+			defer queue.Close()
+			auditLogger = server.NewQueuedAuditLogger(auditLog, queue, o.AuditQueueMaxWait)
+			go auditLogger.RunDelivery(o.AuditQueueRetryInterval, ctx.Done())
+		} else {
+			auditLogger = server.NewAuditLogger(auditLog)
+		}
+	}
+	var peers *server.PeerRegistry
+	if o.PeerPort != 0 {
+		if peers, err = p.newPeerRegistry(o); err != nil {
+			return fmt.Errorf("failed to create the peer registry: %v", err)
+		}
+	}
+	var peerRelay *server.PeerRelay
+	if o.PeerRelay {
+		if peerRelay, err = p.newPeerRelay(o); err != nil {
+			return fmt.Errorf("failed to create the peer relay: %v", err)
+		}
+		defer peerRelay.Close()
+	}
+	var reaper *server.AgentLeaseReaper
+	sendRetry := server.SendRetryConfig{
+		MaxRetries:     o.BackendSendRetries,
+		InitialBackoff: o.BackendSendRetryBackoff,
+		MaxBackoff:     o.BackendSendRetryMaxBackoff,
+		Budget:         o.BackendSendRetryBudget,
+	}
+	bandwidth := server.BandwidthLimits{
+		PerConnection: o.BandwidthLimitPerConnection,
+		PerAgent:      o.BandwidthLimitPerAgent,
+	}
+	sendQueuePolicy, err := server.ParseSendQueuePolicy(o.SendQueuePolicy)
+	if err != nil {
+		return err
+	}
+	topology := server.TopologyConfig{
+		Hints:                 o.TopologyHints,
+		Zone:                  o.Zone,
+		ZoneLabel:             o.AgentZoneLabel,
+		ZoneAffinity:          o.ZoneAffinity,
+		SpilloverThreshold:    o.ZoneSpilloverThreshold,
+		AgentAdvertiseAddress: o.AgentAdvertiseAddress,
+	}
+	sendQueue := server.SendQueueConfig{
+		Depth:    o.SendQueueDepth,
+		Policy:   sendQueuePolicy,
+		SpillDir: o.SendQueueSpillDir,
+	}
+	backendUpdates := server.BackendUpdateConfig{
+		BatchInterval:  o.BackendUpdateBatchInterval,
+		ReadinessGrace: o.ReadinessGracePeriod,
+	}
+	var priorityWeights server.PriorityWeights
+	if o.PriorityScheduling {
+		if priorityWeights, err = server.ParsePriorityWeights(o.PriorityWeights); err != nil {
+			return err
+		}
+	}
+	frontendAuthenticators, frontendAuthorizer, err := o.FrontendAuth()
+	if err != nil {
+		return fmt.Errorf("failed to set up the frontend authentication: %v", err)
+	}
 	server := server.NewProxyServer(o.ServerID, ps, int(o.ServerCount), authOpt, o.WarnOnChannelLimit)
+	server.FrontendAuthenticators = frontendAuthenticators
+	server.SetFrontendAuthorizer(frontendAuthorizer)
+	if server.ConnectAuthenticator, err = o.ConnectAuth(); err != nil {
+		return fmt.Errorf("failed to set up the connect authentication: %v", err)
+	}
+	server.DataCompression = o.DataCompression
+	server.RequireAgentCertificate = o.AgentDualAuthentication
+	server.AuditLog = auditLogger
+	server.PacketBuffers = util.NewBufferPool(o.PacketChunkSize)
+	server.PeerAdvertiseAddress = o.PeerAdvertiseAddress
+	server.Peers = peers
+	server.PeerRelay = peerRelay
+	server.Topology = topology
+	server.CanaryPercent = o.CanaryPercent
+	server.SendRetry = sendRetry
+	server.SetBandwidth(bandwidth)
+	server.SendQueue = sendQueue
+	server.PriorityWeights = priorityWeights
+	server.CheckpointInterval = o.DataCheckpointInterval
+	server.Sessions.Grace = o.AgentSessionGrace
+	server.Sessions.ReplayBufferSize = o.AgentSessionReplayBufferSize
+	server.Migration.Timeout = o.ConnectionMigrationTimeout
+	server.MaxAgentProtocolVersion = o.MaxAgentProtocolVersion
+	server.ScaleHints.Interval = o.ScaleHintsInterval
+	server.ScaleHints.TargetConnections = o.ScaleTargetConnections
+	server.ScaleHints.TargetPendingDials = o.ScaleTargetPendingDials
+	server.ScaleHints.TargetCPU = o.ScaleTargetCPU
+	server.Peaks.Window = o.PeaksWindow
+	server.Peaks.File = o.PeaksFile
+	server.ConnJanitor.Interval = o.ConnTableSweepInterval
+	server.ConnJanitor.TTL = o.ConnTableTTL
+	server.ConnJanitor.IdleTimeout = o.ConnectionIdleTimeout
+	server.ConnJanitor.MaxLifetime = o.ConnectionMaxLifetime
+	server.AgentConnectionAge.MaxAge = o.MaxAgentConnectionAge
+	server.AgentConnectionAge.Jitter = o.AgentConnectionAgeJitter
+	server.AgentConnectionAge.DrainTimeout = o.AgentConnectionDrainTimeout
+	server.CircuitBreaker.Failures = o.CircuitBreakerFailures
+	server.CircuitBreaker.Cooldown = o.CircuitBreakerCooldown
+	server.AnomalyDetection.Window = o.AnomalyWindow
+	server.AnomalyDetection.Threshold = o.AnomalyThreshold
+	server.AnomalyDetection.MinDestinations = o.AnomalyMinDestinations
+	server.PortForward.Destinations = o.PortForwardDestinations
+	server.PortForward.DialTimeout = o.PortForwardDialTimeout
+	if server.DestHostResolution, err = o.DestHostResolution(); err != nil {
+		return fmt.Errorf("failed to set up the dest host resolution: %v", err)
+	}
+	server.SetBackendUpdates(backendUpdates)
+	if o.ReadinessRequiresBackends > 0 || len(o.ReadinessRequiredAgents) > 0 {
+		if err := server.RequireBackends(p.backendReadiness(o)); err != nil {
+			return fmt.Errorf("invalid readiness requirements: %v", err)
+		}
+	}
+	if o.TracingOTLPEndpoint != "" {
+		exporter := tracing.NewOTLPExporter(o.TracingOTLPEndpoint)
+		defer exporter.Stop()
+		server.Tracer = tracing.NewTracer("konnectivity-server", exporter)
+	}
+
+	go server.RunScaleHints(ctx.Done())
+	go server.RunPeaks(ctx.Done())
+	go server.RunConnJanitor(ctx.Done())
+	if o.AgentLeaseNamespace != "" {
+		klog.V(1).Infoln("Starting agent lease reaper.")
+		reaper = p.runAgentLeaseReaper(ctx, o, server, k8sClient)
+	}
+	if o.EgressPolicyConfigMap != "" {
+		klog.V(1).Infoln("Watching the egress policy.")
+		p.runEgressPolicyWatcher(ctx, o, server, k8sClient)
+	}
+	if o.ConfigFile != "" {
+		klog.V(1).Infoln("Watching the config file for changes.")
+		go newConfigReloader(o, server, reaper).run(ctx.Done())
+	}
 
 	frontendStop, err := p.runFrontendServer(ctx, o, server)
 	if err != nil {
@@ -119,15 +282,22 @@ func (p *Proxy) run(o *options.ProxyRunOptions) error {
 	if err != nil {
 		return fmt.Errorf("failed to run the agent server: %v", err)
 	}
-	klog.V(1).Infoln("Starting admin server for debug connections.")
-	err = p.runAdminServer(o, server)
-	if err != nil {
-		return fmt.Errorf("failed to run the admin server: %v", err)
+	if o.AgentWebSocketPort != 0 {
+		klog.V(1).Infoln("Starting agent websocket server for tunnel connections.")
+		err = p.runAgentWebSocketServer(o, server)
+		if err != nil {
+			return fmt.Errorf("failed to run the agent websocket server: %v", err)
+		}
+	}
+	if o.PeerPort != 0 {
+		klog.V(1).Infoln("Starting peer server for sharing agent registrations.")
+		if err := p.runPeerServer(ctx, o, server); err != nil {
+			return fmt.Errorf("failed to run the peer server: %v", err)
+		}
 	}
-	klog.V(1).Infoln("Starting health server for healthchecks.")
-	err = p.runHealthServer(o, server)
+	auxServers, err := p.runAuxServers(o, server)
 	if err != nil {
-		return fmt.Errorf("failed to run the health server: %v", err)
+		return fmt.Errorf("failed to run the auxiliary servers: %v", err)
 	}
 
 	stopCh := SetupSignalHandler()
@@ -137,10 +307,42 @@ func (p *Proxy) run(o *options.ProxyRunOptions) error {
 	if frontendStop != nil {
 		frontendStop()
 	}
+	shutdownAuxServers(auxServers, o.AuxServerShutdownTimeout)
 
 	return nil
 }
 
+func (p *Proxy) runAgentLeaseReaper(ctx context.Context, o *options.ProxyRunOptions, s *server.ProxyServer, client kubernetes.Interface) *server.AgentLeaseReaper {
+	reaper := server.NewAgentLeaseReaper(s, client, o.AgentLeaseNamespace, o.AgentLeaseGracePeriod, ctx.Done())
+	go reaper.Run(ctx.Done())
+	return reaper
+}
+
+func (p *Proxy) backendReadiness(o *options.ProxyRunOptions) server.BackendReadinessConfig {
+	return server.BackendReadinessConfig{
+		MinBackends:         o.ReadinessRequiresBackends,
+		RequiredIdentifiers: o.ReadinessRequiredAgents,
+	}
+}
+
+func (p *Proxy) runEgressPolicyWatcher(ctx context.Context, o *options.ProxyRunOptions, s *server.ProxyServer, client kubernetes.Interface) {
+	namespace, name, _ := o.EgressPolicyRef()
+	server.NewEgressPolicyWatcher(s, client, namespace, name, o.EgressPolicyAllowMissing).Start(ctx.Done())
+}
+
+func openAuditLog(o *options.ProxyRunOptions) (io.WriteCloser, error) {
+	if o.AuditLogPath == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return util.NewRotatingFile(o.AuditLogPath, int64(o.AuditLogMaxSize)*1024*1024, o.AuditLogMaxBackups)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
 var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
 
 func SetupSignalHandler() (stopCh <-chan struct{}) {
@@ -157,7 +359,7 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 	return stop
 }
 
-func getUDSListener(ctx context.Context, udsName string) (net.Listener, error) {
+func getUDSListener(ctx context.Context, o *options.ProxyRunOptions, udsName string) (net.Listener, error) {
 	udsListenerLock.Lock()
 	defer udsListenerLock.Unlock()
 	oldUmask := syscall.Umask(0007)
@@ -167,30 +369,89 @@ func getUDSListener(ctx context.Context, udsName string) (net.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen(unix) name %s: %v", udsName, err)
 	}
+	if err := setUDSOwnership(o, udsName); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if len(o.UDSAllowedPeerUIDs) > 0 || len(o.UDSAllowedPeerGIDs) > 0 {
+		lis = util.NewPeerCredentialListener(lis.(*net.UnixListener), toUint32s(o.UDSAllowedPeerUIDs), toUint32s(o.UDSAllowedPeerGIDs))
+	}
 	return lis, nil
 }
 
+// setUDSOwnership applies the configured file mode and owner to the socket
+// file udsName. Abstract sockets have no file.
+func setUDSOwnership(o *options.ProxyRunOptions, udsName string) error {
+	if options.IsAbstractSocket(udsName) {
+		return nil
+	}
+	mode, err := o.UDSFileMode()
+	if err != nil {
+		return err
+	}
+	if mode != 0 {
+		if err := os.Chmod(udsName, mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %v", udsName, err)
+		}
+	}
+	if o.UDSUID != -1 || o.UDSGID != -1 {
+		if err := os.Chown(udsName, o.UDSUID, o.UDSGID); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %v", udsName, err)
+		}
+	}
+	return nil
+}
+
+func toUint32s(ids []uint) []uint32 {
+	ids32 := make([]uint32, len(ids))
+	for i, id := range ids {
+		ids32[i] = uint32(id)
+	}
+	return ids32
+}
+
+// runFrontendServer serves the frontends on each of their listeners. The
+// returned StopFunc stops all of them.
 func (p *Proxy) runFrontendServer(ctx context.Context, o *options.ProxyRunOptions, server *server.ProxyServer) (StopFunc, error) {
-	if o.UdsName != "" {
-		return p.runUDSFrontendServer(ctx, o, server)
+	listeners, err := o.FrontendListeners()
+	if err != nil {
+		return nil, err
+	}
+	var stops []StopFunc
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
 	}
-	return p.runMTLSFrontendServer(ctx, o, server)
+	for _, l := range listeners {
+		klog.V(1).InfoS("Starting frontend server", "listener", l.String())
+		var stop StopFunc
+		if l.UdsName != "" {
+			stop, err = p.runUDSFrontendServer(ctx, o, l, server)
+		} else {
+			stop, err = p.runMTLSFrontendServer(ctx, o, l, server)
+		}
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("frontend %s: %v", l, err)
+		}
+		stops = append(stops, stop)
+	}
+	return stopAll, nil
 }
 
-func (p *Proxy) runUDSFrontendServer(ctx context.Context, o *options.ProxyRunOptions, s *server.ProxyServer) (StopFunc, error) {
-	if o.DeleteUDSFile {
-		if err := os.Remove(o.UdsName); err != nil && !os.IsNotExist(err) {
-			klog.ErrorS(err, "failed to delete file", "file", o.UdsName)
+func (p *Proxy) runUDSFrontendServer(ctx context.Context, o *options.ProxyRunOptions, l options.FrontendListener, s *server.ProxyServer) (StopFunc, error) {
+	if o.DeleteUDSFile && !options.IsAbstractSocket(l.UdsName) {
+		if err := os.Remove(l.UdsName); err != nil && !os.IsNotExist(err) {
+			klog.ErrorS(err, "failed to delete file", "file", l.UdsName)
 		}
 	}
 	var stop StopFunc
-	if o.Mode == "grpc" {
-		frontendServerOptions := []grpc.ServerOption{
-			grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.FrontendKeepaliveTime}),
-		}
+	if l.Mode == options.ModeGRPC {
+		frontendServerOptions := frontendKeepaliveOptions(o)
 		grpcServer := grpc.NewServer(frontendServerOptions...)
 		client.RegisterProxyServiceServer(grpcServer, s)
-		lis, err := getUDSListener(ctx, o.UdsName)
+		lis, err := getUDSListener(ctx, o, l.UdsName)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get uds listener: %v", err)
 		}
@@ -198,17 +459,17 @@ func (p *Proxy) runUDSFrontendServer(ctx context.Context, o *options.ProxyRunOpt
 		stop = grpcServer.GracefulStop
 	} else {
 		// http-connect
+		tunnel := httpConnectTunnel(o, s)
 		server := &http.Server{
-			Handler: &server.Tunnel{
-				Server: s,
-			},
+			Handler:        tunnel,
+			MaxHeaderBytes: tunnel.HTTPServerMaxHeaderBytes(),
 		}
 		stop = func() {
 			err := server.Shutdown(ctx)
 			klog.ErrorS(err, "error shutting down server")
 		}
 		go func() {
-			udsListener, err := getUDSListener(ctx, o.UdsName)
+			udsListener, err := getUDSListener(ctx, o, l.UdsName)
 			if err != nil {
 				klog.ErrorS(err, "failed to get uds listener")
 			}
@@ -259,7 +520,23 @@ func (p *Proxy) getTLSConfig(caFile, certFile, keyFile, cipherSuites string) (*t
 	return tlsConfig, nil
 }
 
-func (p *Proxy) runMTLSFrontendServer(ctx context.Context, o *options.ProxyRunOptions, s *server.ProxyServer) (StopFunc, error) {
+// getClusterTLSConfig returns the TLS config of the agent listeners.
+func (p *Proxy) getClusterTLSConfig(o *options.ProxyRunOptions) (*tls.Config, error) {
+	tlsConfig, err := p.getTLSConfig(o.ClusterCaCert, o.ClusterCert, o.ClusterKey, o.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if o.ClusterSessionTicketKeyFile != "" {
+		keys, err := util.LoadSessionTicketKeys(o.ClusterSessionTicketKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+	return tlsConfig, nil
+}
+
+func (p *Proxy) runMTLSFrontendServer(ctx context.Context, o *options.ProxyRunOptions, l options.FrontendListener, s *server.ProxyServer) (StopFunc, error) {
 	var stop StopFunc
 
 	var tlsConfig *tls.Config
@@ -268,13 +545,13 @@ func (p *Proxy) runMTLSFrontendServer(ctx context.Context, o *options.ProxyRunOp
 		return nil, err
 	}
 
-	addr := fmt.Sprintf(":%d", o.ServerPort)
+	addr := fmt.Sprintf(":%d", l.Port)
 
-	if o.Mode == "grpc" {
+	if l.Mode == options.ModeGRPC {
 		frontendServerOptions := []grpc.ServerOption{
 			grpc.Creds(credentials.NewTLS(tlsConfig)),
-			grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.FrontendKeepaliveTime}),
 		}
+		frontendServerOptions = append(frontendServerOptions, frontendKeepaliveOptions(o)...)
 		grpcServer := grpc.NewServer(frontendServerOptions...)
 		client.RegisterProxyServiceServer(grpcServer, s)
 		lis, err := net.Listen("tcp", addr)
@@ -285,13 +562,13 @@ func (p *Proxy) runMTLSFrontendServer(ctx context.Context, o *options.ProxyRunOp
 		stop = grpcServer.GracefulStop
 	} else {
 		// http-connect
+		tunnel := httpConnectTunnel(o, s)
 		server := &http.Server{
-			Addr:      addr,
-			TLSConfig: tlsConfig,
-			Handler: &server.Tunnel{
-				Server: s,
-			},
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+			Addr:           addr,
+			TLSConfig:      tlsConfig,
+			Handler:        tunnel,
+			MaxHeaderBytes: tunnel.HTTPServerMaxHeaderBytes(),
+			TLSNextProto:   make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 		}
 		stop = func() {
 			err := server.Shutdown(ctx)
@@ -310,20 +587,48 @@ func (p *Proxy) runMTLSFrontendServer(ctx context.Context, o *options.ProxyRunOp
 	return stop, nil
 }
 
-func (p *Proxy) runAgentServer(o *options.ProxyRunOptions, server *server.ProxyServer) error {
+// httpConnectTunnel returns the handler of the frontends in http-connect
+// mode, limiting the request headers of the CONNECT requests.
+func httpConnectTunnel(o *options.ProxyRunOptions, s *server.ProxyServer) *server.Tunnel {
+	return &server.Tunnel{
+		Server:         s,
+		MaxHeaderBytes: o.HTTPConnectMaxHeaderBytes,
+		MaxHeaderCount: o.HTTPConnectMaxHeaderCount,
+	}
+}
+
+// agentKeepaliveOptions returns the keepalive parameters and enforcement
+// policy of the agent servers.
+func agentKeepaliveOptions(o *options.ProxyRunOptions) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.KeepaliveTime, Timeout: o.KeepaliveTimeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: o.KeepaliveMinTime, PermitWithoutStream: o.KeepalivePermitIdle}),
+	}
+}
+
+// frontendKeepaliveOptions returns the keepalive parameters and enforcement
+// policy of the gRPC frontend servers.
+func frontendKeepaliveOptions(o *options.ProxyRunOptions) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.FrontendKeepaliveTime, Timeout: o.FrontendKeepaliveTimeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: o.FrontendKeepaliveMinTime, PermitWithoutStream: o.FrontendKeepalivePermitIdle}),
+	}
+}
+
+func (p *Proxy) runAgentServer(o *options.ProxyRunOptions, s *server.ProxyServer) error {
 	var tlsConfig *tls.Config
 	var err error
-	if tlsConfig, err = p.getTLSConfig(o.ClusterCaCert, o.ClusterCert, o.ClusterKey, o.CipherSuites); err != nil {
+	if tlsConfig, err = p.getClusterTLSConfig(o); err != nil {
 		return err
 	}
 
 	addr := fmt.Sprintf(":%d", o.AgentPort)
 	agentServerOptions := []grpc.ServerOption{
-		grpc.Creds(credentials.NewTLS(tlsConfig)),
-		grpc.KeepaliveParams(keepalive.ServerParameters{Time: o.KeepaliveTime}),
+		grpc.Creds(server.NewHandshakeCredentials(credentials.NewTLS(tlsConfig), o.MaxConcurrentAgentHandshakes, o.AgentHandshakeQueueTimeout)),
 	}
+	agentServerOptions = append(agentServerOptions, agentKeepaliveOptions(o)...)
 	grpcServer := grpc.NewServer(agentServerOptions...)
-	agent.RegisterAgentServiceServer(grpcServer, server)
+	agent.RegisterAgentServiceServer(grpcServer, s)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %v", addr, err)
@@ -333,66 +638,154 @@ func (p *Proxy) runAgentServer(o *options.ProxyRunOptions, server *server.ProxyS
 	return nil
 }
 
-func (p *Proxy) runAdminServer(o *options.ProxyRunOptions, server *server.ProxyServer) error {
-	muxHandler := http.NewServeMux()
-	muxHandler.Handle("/metrics", promhttp.Handler())
-	if o.EnableProfiling {
-		muxHandler.HandleFunc("/debug/pprof", util.RedirectTo("/debug/pprof/"))
-		muxHandler.HandleFunc("/debug/pprof/", pprof.Index)
-		if o.EnableContentionProfiling {
-			runtime.SetBlockProfileRate(1)
-		}
-	}
-	adminServer := &http.Server{
-		Addr:           fmt.Sprintf("127.0.0.1:%d", o.AdminPort),
-		Handler:        muxHandler,
-		MaxHeaderBytes: 1 << 20,
+func (p *Proxy) runAgentWebSocketServer(o *options.ProxyRunOptions, s *server.ProxyServer) error {
+	var tlsConfig *tls.Config
+	var err error
+	if tlsConfig, err = p.getClusterTLSConfig(o); err != nil {
+		return err
 	}
 
+	addr := fmt.Sprintf(":%d", o.AgentWebSocketPort)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	wsListener := server.NewWebSocketListener(lis.Addr())
+
+	// TLS is terminated by the HTTP server, the credentials of the gRPC
+	// server only report the TLS state of the upgraded connections.
+	serverOptions := append(agentKeepaliveOptions(o), grpc.Creds(server.WebSocketCredentials()))
+	grpcServer := grpc.NewServer(serverOptions...)
+	agent.RegisterAgentServiceServer(grpcServer, s)
+	go grpcServer.Serve(wsListener)
+
+	httpServer := &http.Server{
+		Handler: wsListener,
+		// WebSocket upgrades are only defined for HTTP/1.1.
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
 	go func() {
-		err := adminServer.ListenAndServe()
+		err := httpServer.Serve(tls.NewListener(lis, tlsConfig))
 		if err != nil {
-			klog.ErrorS(err, "admin server could not listen")
+			klog.ErrorS(err, "agent websocket server could not serve")
 		}
-		klog.V(1).Infoln("Admin server stopped listening")
+		wsListener.Close() /* #nosec G104 */
 	}()
 
 	return nil
 }
 
-func (p *Proxy) runHealthServer(o *options.ProxyRunOptions, server *server.ProxyServer) error {
-	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
-	})
-	readinessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ready, msg := server.Readiness.Ready()
-		if ready {
-			w.WriteHeader(200)
-			fmt.Fprintf(w, "ok")
+// runPeerServer serves the agent registrations of s to the peer proxy
+// servers and fetches theirs until ctx is done. With relaying enabled,
+// the dials relayed by the peers are served as well.
+func (p *Proxy) runPeerServer(ctx context.Context, o *options.ProxyRunOptions, s *server.ProxyServer) error {
+	muxHandler := http.NewServeMux()
+	muxHandler.HandleFunc(server.PeerRegistrationPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyPeer(r.TLS, o.PeerTLSServerName); err != nil {
+			klog.ErrorS(err, "Rejected peer registration request", "remoteAddr", r.RemoteAddr)
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-		w.WriteHeader(500)
-		fmt.Fprintf(w, msg)
+		s.ServePeerRegistration(w, r)
 	})
-
-	muxHandler := http.NewServeMux()
-	muxHandler.HandleFunc("/healthz", livenessHandler)
-	// "/ready" is deprecated but being maintained for backward compatibility
-	muxHandler.HandleFunc("/ready", readinessHandler)
-	muxHandler.HandleFunc("/readyz", readinessHandler)
-	healthServer := &http.Server{
-		Addr:           fmt.Sprintf(":%d", o.HealthPort),
+	peerServer := &http.Server{
+		Addr:           fmt.Sprintf(":%d", o.PeerPort),
 		Handler:        muxHandler,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if o.PeerRelay {
+		relayServer := grpc.NewServer()
+		client.RegisterProxyServiceServer(relayServer, s.RelayService())
+		peerServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				muxHandler.ServeHTTP(w, r)
+				return
+			}
+			if err := verifyPeer(r.TLS, o.PeerTLSServerName); err != nil {
+				klog.ErrorS(err, "Rejected relayed dial", "remoteAddr", r.RemoteAddr)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			relayServer.ServeHTTP(w, r)
+		})
+		go func() {
+			<-ctx.Done()
+			relayServer.Stop()
+		}()
+	}
+	tlsConfig, err := p.getClusterTLSConfig(o)
+	if err != nil {
+		return err
+	}
+	peerServer.TLSConfig = tlsConfig
 
+	lis, err := net.Listen("tcp", peerServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", peerServer.Addr, err)
+	}
 	go func() {
-		err := healthServer.ListenAndServe()
-		if err != nil {
-			klog.ErrorS(err, "health server could not listen")
+		err := peerServer.ServeTLS(lis, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "peer server could not serve")
 		}
-		klog.V(1).Infoln("Health server stopped listening")
+	}()
+	go func() {
+		<-ctx.Done()
+		peerServer.Close() /* #nosec G104 */
 	}()
 
+	go s.Peers.Run(ctx.Done())
 	return nil
 }
+
+// newPeerRegistry returns the registry of the agent registrations of the
+// peer proxy servers. Peers are authenticated with the cluster
+// certificates, which they present like this server does to agents.
+func (p *Proxy) newPeerRegistry(o *options.ProxyRunOptions) (*server.PeerRegistry, error) {
+	tlsConfig, err := p.getPeerClientTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	peerClient := &http.Client{
+		Timeout:   o.PeerSyncInterval,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return server.NewPeerRegistry(o.ServerID, o.PeerAddresses, peerClient, o.PeerSyncInterval)
+}
+
+// newPeerRelay returns the relay of dials to the peer proxy servers,
+// authenticated like the peer registry.
+func (p *Proxy) newPeerRelay(o *options.ProxyRunOptions) (*server.PeerRelay, error) {
+	tlsConfig, err := p.getPeerClientTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewPeerRelay(
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithUserAgent("proxy-server/"+o.ServerID),
+	), nil
+}
+
+// getPeerClientTLSConfig returns the TLS config to connect to the peer
+// port of the peers with.
+func (p *Proxy) getPeerClientTLSConfig(o *options.ProxyRunOptions) (*tls.Config, error) {
+	tlsConfig, err := p.getTLSConfig(o.ClusterCaCert, o.ClusterCert, o.ClusterKey, o.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: tlsConfig.Certificates,
+		RootCAs:      tlsConfig.ClientCAs,
+		ServerName:   o.PeerTLSServerName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// verifyPeer checks that a request to the peer port comes from a peer, i.e.
+// that it presented a client certificate valid for serverName.
+func verifyPeer(state *tls.ConnectionState, serverName string) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	return state.PeerCertificates[0].VerifyHostname(serverName)
+}
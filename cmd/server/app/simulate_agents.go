@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// simulateAgentsOptions configures the simulated agents.
+type simulateAgentsOptions struct {
+	count                   int
+	address                 string
+	caCert                  string
+	agentCert               string
+	agentKey                string
+	serviceAccountTokenPath string
+	agentIDPrefix           string
+	agentIdentifiers        string
+	agentLabels             string
+	syncInterval            time.Duration
+	dialLatency             time.Duration
+	dialFailureRate         float64
+	duration                time.Duration
+}
+
+func newSimulateAgentsCommand() *cobra.Command {
+	o := &simulateAgentsOptions{
+		count:         10,
+		address:       "127.0.0.1:8091",
+		agentIDPrefix: "simulated-agent-",
+		syncInterval:  time.Second,
+	}
+	cmd := &cobra.Command{
+		Use:   "simulate-agents",
+		Short: "Connect simulated agents to a proxy server, for routing and scale tests.",
+		Long: `Runs --count agents in this process, speaking the agent protocol with the proxy server at
+--proxy-server-address. The destinations of their dials are simulated: each connection echoes the data
+sent to it. The agent identifiers and labels may contain {index}, replaced by the index of each agent.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.validate(); err != nil {
+				return err
+			}
+			return o.run()
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&o.count, "count", o.count, "Number of simulated agents.")
+	flags.StringVar(&o.address, "proxy-server-address", o.address, "host:port of the agent port of the proxy server.")
+	flags.StringVar(&o.caCert, "agent-ca-cert", o.caCert, "If non-empty, the CA the simulated agents verify the proxy server with, the system CAs otherwise.")
+	flags.StringVar(&o.agentCert, "agent-cert", o.agentCert, "If non-empty, the client certificate of the simulated agents.")
+	flags.StringVar(&o.agentKey, "agent-key", o.agentKey, "Private key of --agent-cert.")
+	flags.StringVar(&o.serviceAccountTokenPath, "agent-service-account-token-path", o.serviceAccountTokenPath, "If non-empty, the simulated agents authenticate with the service account token in this file.")
+	flags.StringVar(&o.agentIDPrefix, "agent-id-prefix", o.agentIDPrefix, "Prefix of the IDs of the simulated agents, followed by their index.")
+	flags.StringVar(&o.agentIdentifiers, "agent-identifiers", o.agentIdentifiers, "Identifiers of the simulated agents, e.g. host=node-{index}.")
+	flags.StringVar(&o.agentLabels, "agent-labels", o.agentLabels, "Labels of the simulated agents, e.g. zone=zone-{index}.")
+	flags.DurationVar(&o.syncInterval, "sync-interval", o.syncInterval, "Interval the simulated agents sync their connections to the proxy servers.")
+	flags.DurationVar(&o.dialLatency, "dial-latency", o.dialLatency, "Time each simulated dial takes.")
+	flags.Float64Var(&o.dialFailureRate, "dial-failure-rate", o.dialFailureRate, "Share of the simulated dials that fail, between 0 and 1.")
+	flags.DurationVar(&o.duration, "duration", o.duration, "How long to run the simulated agents, until interrupted if 0.")
+	return cmd
+}
+
+func (o *simulateAgentsOptions) validate() error {
+	if o.count < 1 {
+		return fmt.Errorf("count %d must be positive", o.count)
+	}
+	if _, _, err := net.SplitHostPort(o.address); err != nil {
+		return fmt.Errorf("proxy server address %q must be host:port: %v", o.address, err)
+	}
+	if (o.agentCert == "") != (o.agentKey == "") {
+		return fmt.Errorf("--agent-cert and --agent-key must be set together")
+	}
+	if o.dialFailureRate < 0 || o.dialFailureRate > 1 {
+		return fmt.Errorf("dial failure rate %v must be between 0 and 1", o.dialFailureRate)
+	}
+	if o.syncInterval <= 0 {
+		return fmt.Errorf("sync interval %v must be positive", o.syncInterval)
+	}
+	if o.dialLatency < 0 || o.duration < 0 {
+		return fmt.Errorf("dial latency and duration must not be negative")
+	}
+	return nil
+}
+
+// run connects the simulated agents and serves them until interrupted or
+// the duration passed.
+func (o *simulateAgentsOptions) run() error {
+	host, _, _ := net.SplitHostPort(o.address)
+	tlsConfig, err := util.GetClientTLSConfig(o.caCert, o.agentCert, o.agentKey, host, nil)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	stopCh := make(chan struct{})
+	signalCh := SetupSignalHandler()
+	go func() {
+		var timeout <-chan time.Time
+		if o.duration > 0 {
+			timeout = time.After(o.duration)
+		}
+		select {
+		case <-signalCh:
+		case <-timeout:
+		}
+		close(stopCh)
+	}()
+
+	for i := 0; i < o.count; i++ {
+		index := strconv.Itoa(i)
+		cc := &agent.ClientSetConfig{
+			Address:                 o.address,
+			AgentID:                 o.agentIDPrefix + index,
+			AgentIdentifiers:        strings.ReplaceAll(o.agentIdentifiers, "{index}", index),
+			AgentLabels:             strings.ReplaceAll(o.agentLabels, "{index}", index),
+			SyncInterval:            o.syncInterval,
+			ProbeInterval:           o.syncInterval,
+			SyncIntervalCap:         10 * o.syncInterval,
+			DialOptions:             []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))},
+			ServiceAccountTokenPath: o.serviceAccountTokenPath,
+			SyncForever:             true,
+			Dialer:                  o.dial,
+		}
+		cc.NewAgentClientSet(stopCh).Serve()
+	}
+	klog.InfoS("Started simulated agents", "count", o.count, "address", o.address)
+
+	<-stopCh
+	klog.V(1).Infoln("Shutting down simulated agents.")
+	return nil
+}
+
+// dial simulates the dial of a destination, returning a connection that
+// echoes the data written to it.
+func (o *simulateAgentsOptions) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if o.dialLatency > 0 {
+		select {
+		case <-time.After(o.dialLatency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if o.dialFailureRate > 0 && rand.Float64() < o.dialFailureRate /* #nosec G404 */ {
+		return nil, fmt.Errorf("simulated dial failure of %s %s", network, address)
+	}
+	conn, destination := net.Pipe()
+	go func() {
+		io.Copy(destination, destination) /* #nosec G104 */
+		destination.Close()               /* #nosec G104 */
+	}()
+	return conn, nil
+}
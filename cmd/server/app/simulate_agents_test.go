@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestSimulatedDial(t *testing.T) {
+	o := &simulateAgentsOptions{}
+	conn, err := o.dial(context.Background(), "tcp", "10.0.0.1:443")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected the data to be echoed, got %q, %v", buf, err)
+	}
+
+	o.dialFailureRate = 1
+	if _, err := o.dial(context.Background(), "tcp", "10.0.0.1:443"); err == nil {
+		t.Error("expected the dial to fail")
+	}
+}
+
+func TestSimulateAgentsOptionsValidate(t *testing.T) {
+	for name, o := range map[string]*simulateAgentsOptions{
+		"no agents":        {count: 0, address: "127.0.0.1:8091", syncInterval: 1},
+		"no port":          {count: 1, address: "127.0.0.1", syncInterval: 1},
+		"cert without key": {count: 1, address: "127.0.0.1:8091", syncInterval: 1, agentCert: "agent.crt"},
+		"failure rate":     {count: 1, address: "127.0.0.1:8091", syncInterval: 1, dialFailureRate: 2},
+	} {
+		if err := o.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
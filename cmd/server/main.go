@@ -33,7 +33,8 @@ func main() {
 	proxy := &app.Proxy{}
 	o := options.NewProxyRunOptions()
 	command := app.NewProxyCommand(proxy, o)
-	flags := command.Flags()
+	// Persistent flags are shared by the subcommands.
+	flags := command.PersistentFlags()
 	flags.AddFlagSet(o.Flags())
 	local := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	klog.InitFlags(local)
@@ -0,0 +1,152 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command benchgate compares the output of go test -bench read from stdin
+// against a stored baseline, failing if a benchmark regressed by more than
+// the threshold.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metrics compared against the baseline, lower is better.
+var metrics = []string{"ns/op", "B/op", "allocs/op"}
+
+// result is the best of the metrics of a benchmark over its runs, the
+// least disturbed by the noise of the machine.
+type result struct {
+	values map[string]float64
+	runs   int
+}
+
+// parseResults parses the benchmark lines of go test -bench output, e.g.
+// "BenchmarkDial-8  1000  1234 ns/op  56 B/op  7 allocs/op", keeping the
+// lowest value of each metric over the runs of a benchmark. The
+// GOMAXPROCS suffix is dropped from the names.
+func parseResults(r io.Reader) (map[string]*result, error) {
+	results := make(map[string]*result)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		name := fields[0]
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+		res, ok := results[name]
+		if !ok {
+			res = &result{values: make(map[string]float64)}
+			results[name] = res
+		}
+		res.runs++
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of %s in %q", fields[i], fields[i+1], scanner.Text())
+			}
+			if best, ok := res.values[fields[i+1]]; !ok || v < best {
+				res.values[fields[i+1]] = v
+			}
+		}
+	}
+	return results, scanner.Err()
+}
+
+// regressions lists the metrics of current exceeding those of baseline by
+// more than threshold, a fraction of the baseline. Benchmarks missing
+// from either side are ignored.
+func regressions(baseline, current map[string]*result, threshold float64) []string {
+	var out []string
+	for name, cur := range current {
+		base, ok := baseline[name]
+		if !ok {
+			continue
+		}
+		for _, m := range metrics {
+			b, okb := base.values[m]
+			c, okc := cur.values[m]
+			if !okb || !okc {
+				continue
+			}
+			if c > b*(1+threshold) && c-b >= 1 {
+				out = append(out, fmt.Sprintf("%s: %s regressed from %.0f to %.0f (%+.1f%%)", name, m, b, c, (c-b)/b*100))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func run(stdin io.Reader, stdout io.Writer, args []string) error {
+	fs := flag.NewFlagSet("benchgate", flag.ContinueOnError)
+	baselineFile := fs.String("baseline", "hack/benchmark-baseline.txt", "File holding the go test -bench output to compare against.")
+	threshold := fs.Float64("threshold", 0.1, "Fraction a metric may exceed its baseline by.")
+	update := fs.Bool("update", false, "Store the results as the new baseline instead of comparing.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	input, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	if *update {
+		return os.WriteFile(*baselineFile, input, 0644)
+	}
+	current, err := parseResults(bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return fmt.Errorf("no benchmark results read")
+	}
+	f, err := os.Open(*baselineFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the baseline, record one with make bench-baseline: %v", err)
+	}
+	defer f.Close()
+	baseline, err := parseResults(f)
+	if err != nil {
+		return fmt.Errorf("invalid baseline %s: %v", *baselineFile, err)
+	}
+	if regressed := regressions(baseline, current, *threshold); len(regressed) > 0 {
+		for _, r := range regressed {
+			fmt.Fprintln(stdout, r)
+		}
+		return fmt.Errorf("%d metrics regressed by more than %.0f%%", len(regressed), *threshold*100)
+	}
+	fmt.Fprintf(stdout, "%d benchmarks within %.0f%% of the baseline\n", len(current), *threshold*100)
+	return nil
+}
+
+func main() {
+	if err := run(os.Stdin, os.Stdout, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const baselineOutput = `goos: linux
+goarch: amd64
+pkg: sigs.k8s.io/apiserver-network-proxy/pkg/testing
+BenchmarkDataPathRoundTrip/1KB-8   	   10000	    100000 ns/op	  10.24 MB/s	    2000 B/op	      40 allocs/op
+BenchmarkDataPathRoundTrip/1KB-8   	   10000	    120000 ns/op	   8.53 MB/s	    2000 B/op	      40 allocs/op
+BenchmarkDial-8   	    1000	   1000000 ns/op	   50000 B/op	     500 allocs/op
+PASS
+`
+
+func TestParseResults(t *testing.T) {
+	results, err := parseResults(strings.NewReader(baselineOutput))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 benchmarks, got %d", len(results))
+	}
+	rt := results["BenchmarkDataPathRoundTrip/1KB"]
+	if rt == nil || rt.runs != 2 || rt.values["ns/op"] != 100000 || rt.values["allocs/op"] != 40 {
+		t.Errorf("expected the best of 2 runs, got %+v", rt)
+	}
+}
+
+func TestRegressions(t *testing.T) {
+	baseline, err := parseResults(strings.NewReader(baselineOutput))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	current, err := parseResults(strings.NewReader(`BenchmarkDataPathRoundTrip/1KB-16 	   10000	    105000 ns/op	    2000 B/op	      48 allocs/op
+BenchmarkDial-16   	    1000	   1500000 ns/op	   50000 B/op	     500 allocs/op
+BenchmarkNew-16   	    1000	   1500000 ns/op
+`))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []string{
+		"BenchmarkDataPathRoundTrip/1KB: allocs/op regressed from 40 to 48 (+20.0%)",
+		"BenchmarkDial: ns/op regressed from 1000000 to 1500000 (+50.0%)",
+	}
+	if got := regressions(baseline, current, 0.1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
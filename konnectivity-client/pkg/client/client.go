@@ -18,12 +18,13 @@ package client
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -36,31 +37,177 @@ type Tunnel interface {
 	// Dial connects to the address on the named network, similar to
 	// what net.Dial does. The only supported protocol is tcp.
 	DialContext(requestCtx context.Context, protocol, address string) (net.Conn, error)
+
+	// Done returns a channel that is closed when the tunnel stopped
+	// serving its gRPC stream and can no longer be used.
+	Done() <-chan struct{}
+
+	// Ready reports whether the tunnel can be dialed, i.e. its gRPC
+	// stream is served and its gRPC connection is ready.
+	Ready() bool
+
+	// HealthCheck waits until the tunnel can be dialed. It returns an
+	// error if the tunnel is closed, its gRPC connection failed or ctx is
+	// done first.
+	HealthCheck(ctx context.Context) error
 }
 
 type dialResult struct {
 	err    string
+	code   client.DialErrorCode
 	connid int64
+	// epoch of the connection connid was bound to
+	epoch uint64
+	// closed is set when the proxy server abandoned the dial with DIAL_CLS.
+	closed bool
+	// agentID and strategy report how the proxy server routed the dial.
+	agentID  string
+	strategy string
+}
+
+type dialMetadataKey struct{}
+
+// WithDialMetadata returns a context carrying metadata that DialContext
+// attaches to the dial request, e.g. a request UID. Agents may use it for
+// policy decisions and audit logs. Keys prefixed with "konnectivity.io/"
+// are reserved for the proxy server and dropped.
+func WithDialMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, dialMetadataKey{}, metadata)
+}
+
+// DialBudgetTokenKey is the dial metadata key of the budget token set by
+// WithDialBudgetToken.
+const DialBudgetTokenKey = "dial-budget-token"
+
+// WithDialBudgetToken returns a context carrying a budget token that
+// DialContext attaches to the dial request. Callers re-dialing the same
+// destination after a failure should pass the same token on each attempt,
+// so that the proxy server accounts the cumulative time spent across the
+// attempts. The token is opaque to the server, NewDialBudgetToken returns
+// a suitable one.
+func WithDialBudgetToken(ctx context.Context, token string) context.Context {
+	return withDialMetadataValue(ctx, DialBudgetTokenKey, token)
+}
+
+// TraceParentKey is the dial metadata key of the trace context set by
+// WithTraceParent.
+const TraceParentKey = "traceparent"
+
+// WithTraceParent returns a context carrying the W3C traceparent of the
+// caller's span, which DialContext attaches to the dial request. The proxy
+// server and the agent record their spans of the dial and of the
+// connection as children of this span. Callers instrumented with
+// OpenTelemetry can obtain the value by injecting their span context with
+// the W3C TraceContext propagator.
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+	return withDialMetadataValue(ctx, TraceParentKey, traceParent)
 }
 
-type pendingDial struct {
-	// resultCh is the channel to send the dial result to
-	resultCh chan<- dialResult
-	// cancelCh is the channel closed when resultCh no longer has a receiver
-	cancelCh <-chan struct{}
+// LabelSelectorKey is the dial metadata key of the label selector set by
+// WithLabelSelector.
+const LabelSelectorKey = "label-selector"
+
+// WithLabelSelector returns a context carrying a label selector, e.g.
+// "zone=us-east-1a,network=mgmt", which DialContext attaches to the dial
+// request. Proxy servers with the labelSelector strategy route the dial
+// through an agent whose labels match the selector.
+func WithLabelSelector(ctx context.Context, selector string) context.Context {
+	return withDialMetadataValue(ctx, LabelSelectorKey, selector)
+}
+
+// NetworkNamespaceKey is the dial metadata key of the network namespace set
+// by WithNetworkNamespace.
+const NetworkNamespaceKey = "network-namespace"
+
+// WithNetworkNamespace returns a context carrying the name of a network
+// namespace of the agent's node, which DialContext attaches to the dial
+// request. The agent dials the destination inside that namespace, e.g. of
+// a VM, if it is one of the namespaces the agent allows.
+func WithNetworkNamespace(ctx context.Context, name string) context.Context {
+	return withDialMetadataValue(ctx, NetworkNamespaceKey, name)
+}
+
+// MigratableKey is the dial metadata key set by WithMigration.
+const MigratableKey = "migratable"
+
+// WithMigration returns a context which DialContext marks the dial request
+// with as migratable. If the agent serving the connection disconnects,
+// proxy servers with connection migration enabled dial the destination
+// again through another agent and splice the new connection in, rather
+// than closing it. This suits long-lived sessions whose destination
+// tolerates the connection being dialed again, e.g. an idempotent stream.
+func WithMigration(ctx context.Context) context.Context {
+	return withDialMetadataValue(ctx, MigratableKey, "true")
+}
+
+// withDialMetadataValue adds key to the dial metadata of ctx, without
+// modifying the map passed to WithDialMetadata.
+func withDialMetadataValue(ctx context.Context, key, value string) context.Context {
+	metadata := map[string]string{key: value}
+	for k, v := range dialMetadataFrom(ctx) {
+		if k != key {
+			metadata[k] = v
+		}
+	}
+	return WithDialMetadata(ctx, metadata)
+}
+
+// NewDialBudgetToken returns a random dial budget token.
+func NewDialBudgetToken() string {
+	return strconv.FormatUint(rand.Uint64(), 36) /* #nosec G404 */
+}
+
+func dialMetadataFrom(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(dialMetadataKey{}).(map[string]string)
+	return metadata
 }
 
 // grpcTunnel implements Tunnel
 type grpcTunnel struct {
-	stream          client.ProxyService_ProxyClient
-	pendingDial     map[int64]pendingDial
-	conns           map[int64]*conn
-	pendingDialLock sync.RWMutex
-	connsLock       sync.RWMutex
+	stream       client.ProxyService_ProxyClient
+	pendingDials pendingDials
+	conns        map[int64]*conn
+	connsLock    sync.RWMutex
 
 	// The tunnel will be closed if the caller fails to read via conn.Read()
 	// more than readTimeoutSeconds after a packet has been received.
 	readTimeoutSeconds int
+
+	// done is closed once serve() returns and the stream is no longer read.
+	done chan struct{}
+
+	// clientConn is closed to stop serve() when a retried dial gives up,
+	// nil if the tunnel has no connection of its own.
+	clientConn clientConn
+
+	// limiter bounds the dials in flight and the open connections, nil
+	// if the tunnel is unlimited.
+	limiter *concurrencyLimiter
+
+	// connIDs binds the connection IDs assigned by the proxy server to
+	// the connections of the tunnel.
+	connIDs connIDs
+
+	// serverHello is the HELLO of the proxy server, nil until received.
+	helloLock   sync.Mutex
+	serverHello *client.Hello
+
+	// metrics receives the events of the tunnel, nil if not reported.
+	metrics Metrics
+}
+
+// serializedStream serializes the packets sent on the stream of a tunnel,
+// which its connections write to concurrently, as a gRPC stream must not
+// be sent on from several goroutines at once.
+type serializedStream struct {
+	client.ProxyService_ProxyClient
+	sendLock sync.Mutex
+}
+
+func (s *serializedStream) Send(pkt *client.Packet) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.ProxyService_ProxyClient.Send(pkt)
 }
 
 type clientConn interface {
@@ -84,6 +231,7 @@ func CreateSingleUseGrpcTunnel(tunnelCtx context.Context, address string, opts .
 // The tunnel is normally closed when the connection is terminated.
 // If createCtx is cancelled before tunnel creation, an error will be returned.
 // If tunnelCtx is cancelled while the tunnel is still in use, the tunnel (and any in flight connections) will be closed.
+// Options passed to createCtx with WithTunnelOptions apply to the tunnel.
 // The Dial() method of the returned tunnel should only be called once
 func CreateSingleUseGrpcTunnelWithContext(createCtx, tunnelCtx context.Context, address string, opts ...grpc.DialOption) (Tunnel, error) {
 	c, err := grpc.DialContext(createCtx, address, opts...)
@@ -98,13 +246,23 @@ func CreateSingleUseGrpcTunnelWithContext(createCtx, tunnelCtx context.Context,
 		c.Close()
 		return nil, err
 	}
+	if err := stream.Send(helloPacket()); err != nil {
+		c.Close()
+		return nil, err
+	}
 
 	tunnel := &grpcTunnel{
-		stream:             stream,
-		pendingDial:        make(map[int64]pendingDial),
+		stream:             &serializedStream{ProxyService_ProxyClient: stream},
 		conns:              make(map[int64]*conn),
 		readTimeoutSeconds: 10,
+		done:               make(chan struct{}),
+		clientConn:         c,
 	}
+	o := newTunnelOptions(createCtx)
+	if o.maxConcurrent > 0 {
+		tunnel.limiter = newConcurrencyLimiter(o.maxConcurrent, o.queueTimeout)
+	}
+	tunnel.metrics = o.metrics
 
 	go tunnel.serve(tunnelCtx, c)
 
@@ -114,6 +272,9 @@ func CreateSingleUseGrpcTunnelWithContext(createCtx, tunnelCtx context.Context,
 func (t *grpcTunnel) serve(tunnelCtx context.Context, c clientConn) {
 	defer func() {
 		c.Close()
+		if t.done != nil {
+			close(t.done)
+		}
 
 		// A connection in t.conns after serve() returns means
 		// we never received a CLOSE_RSP for it, so we need to
@@ -121,10 +282,18 @@ func (t *grpcTunnel) serve(tunnelCtx context.Context, c clientConn) {
 		t.connsLock.Lock()
 		for _, conn := range t.conns {
 			close(conn.readCh)
+			conn.endIdleWarnings()
+			conn.releaseSlot()
 		}
 		t.connsLock.Unlock()
 	}()
 
+	// A single timer bounds the delivery of every DATA packet, rather
+	// than allocating one per packet.
+	readTimer := time.NewTimer(0)
+	stopTimer(readTimer)
+	defer readTimer.Stop()
+
 	for {
 		pkt, err := t.stream.Recv()
 		if err == io.EOF {
@@ -135,83 +304,167 @@ func (t *grpcTunnel) serve(tunnelCtx context.Context, c clientConn) {
 			return
 		}
 
-		klog.V(5).InfoS("[tracing] recv packet", "type", pkt.Type)
+		// Checking the verbosity first keeps the hot path from
+		// allocating the arguments of a disabled log.
+		if klogV := klog.V(5); klogV.Enabled() {
+			klogV.InfoS("[tracing] recv packet", "type", pkt.Type)
+		}
 
 		switch pkt.Type {
 		case client.PacketType_DIAL_RSP:
 			resp := pkt.GetDialResponse()
-			t.pendingDialLock.RLock()
-			pendingDial, ok := t.pendingDial[resp.Random]
-			t.pendingDialLock.RUnlock()
-
-			if !ok {
-				klog.V(1).InfoS("DialResp not recognized; dropped", "connectionID", resp.ConnectID, "dialID", resp.Random)
-				return
-			} else {
-				result := dialResult{
-					err:    resp.Error,
-					connid: resp.ConnectID,
-				}
-				select {
-				// try to send to the result channel
-				case pendingDial.resultCh <- result:
-				// unblock if the cancel channel is closed
-				case <-pendingDial.cancelCh:
-					// If there are no readers of the pending dial channel above, it means one of two things:
-					//   1. There was a second DIAL_RSP for the connection request (this is very unlikely but possible)
-					//   2. grpcTunnel.DialContext() returned early due to a dial timeout or the client canceling the context
-					//
-					// In either scenario, we should return here as this tunnel is no longer needed.
-					klog.V(1).InfoS("Pending dial has been cancelled; dropped", "connectionID", resp.ConnectID, "dialID", resp.Random)
-					return
-				case <-tunnelCtx.Done():
-					klog.V(1).InfoS("Tunnel has been closed; dropped", "connectionID", resp.ConnectID, "dialID", resp.Random)
-					return
+			result := dialResult{
+				err:      resp.Error,
+				code:     resp.ErrorCode,
+				connid:   resp.ConnectID,
+				agentID:  resp.AgentID,
+				strategy: resp.Strategy,
+			}
+			if resp.Error == "" {
+				epoch, err := t.connIDs.bind(resp.ConnectID)
+				if err != nil {
+					t.connIDViolation(pkt, resp.ConnectID, err)
+					result.err = err.Error()
 				}
+				result.epoch = epoch
+			}
+			outcome, retriable := t.pendingDials.resolve(resp.Random, result)
+			switch outcome {
+			case resolveUnknown:
+				t.dropPacket(pkt, DropUnknownDial, resp.ConnectID, resp.Random)
+				return
+			case resolveDuplicate:
+				// The proxy server answered the dial twice, the tunnel
+				// can no longer be trusted.
+				t.dropPacket(pkt, DropDuplicateDial, resp.ConnectID, resp.Random)
+				return
+			case resolveCanceled:
+				// DialContext returned early due to a dial timeout or the
+				// client canceling the context, so this tunnel is no
+				// longer needed.
+				t.dropPacket(pkt, DropCanceledDial, resp.ConnectID, resp.Random)
+				return
+			}
+			if result.err != resp.Error {
+				// The proxy server reused a connection ID, the tunnel can
+				// no longer be trusted.
+				return
 			}
 
 			if resp.Error != "" {
+				if retriable && retriableDialErrorCode(resp.ErrorCode) {
+					// The dial is retried on this tunnel.
+					continue
+				}
 				// On dial error, avoid leaking serve goroutine.
 				return
 			}
 
+		case client.PacketType_DIAL_CLS:
+			resp := pkt.GetCloseDial()
+			switch outcome, _ := t.pendingDials.resolve(resp.Random, dialResult{closed: true}); outcome {
+			case resolveUnknown:
+				t.dropPacket(pkt, DropUnknownDial, 0, resp.Random)
+				continue
+			case resolveDuplicate:
+				t.dropPacket(pkt, DropDuplicateDial, 0, resp.Random)
+			}
+			// The only pending dial on this single use tunnel was abandoned.
+			return
+
 		case client.PacketType_DATA:
 			resp := pkt.GetData()
 			// TODO: flow control
 			t.connsLock.RLock()
 			conn, ok := t.conns[resp.ConnectID]
 			t.connsLock.RUnlock()
+			if err := t.connIDs.check(resp.ConnectID, conn); err != nil {
+				t.connIDViolation(pkt, resp.ConnectID, err)
+				continue
+			}
 
 			if ok {
-				timer := time.NewTimer((time.Duration)(t.readTimeoutSeconds) * time.Second)
-				select {
-				case conn.readCh <- resp.Data:
-					timer.Stop()
-				case <-timer.C:
-					klog.ErrorS(fmt.Errorf("timeout"), "readTimeout has been reached, the grpc connection to the proxy server will be closed", "connectionID", conn.connID, "readTimeoutSeconds", t.readTimeoutSeconds)
-					return
-				case <-tunnelCtx.Done():
-					klog.V(1).InfoS("Tunnel has been closed, the grpc connection to the proxy server will be closed", "connectionID", conn.connID)
+				readTimer.Reset((time.Duration)(t.readTimeoutSeconds) * time.Second)
+			deliver:
+				for {
+					// A nil channel blocks the delivery until Read drains
+					// the connection below its buffered bytes limit.
+					var readCh chan []byte
+					if conn.hasBufferSpace() {
+						readCh = conn.readCh
+					}
+					select {
+					case readCh <- resp.Data:
+						stopTimer(readTimer)
+						if conn.maxBuffered > 0 {
+							atomic.AddInt64(&conn.buffered, int64(len(resp.Data)))
+						}
+						break deliver
+					case <-conn.drained:
+					case <-readTimer.C:
+						klog.ErrorS(fmt.Errorf("timeout"), "readTimeout has been reached, the grpc connection to the proxy server will be closed", "connectionID", conn.connID, "readTimeoutSeconds", t.readTimeoutSeconds)
+						return
+					case <-tunnelCtx.Done():
+						stopTimer(readTimer)
+						klog.V(1).InfoS("Tunnel has been closed, the grpc connection to the proxy server will be closed", "connectionID", conn.connID)
+						break deliver
+					}
 				}
 			} else {
-				klog.V(1).InfoS("connection not recognized", "connectionID", resp.ConnectID)
+				t.dropPacket(pkt, DropUnknownConnection, resp.ConnectID, 0)
 			}
 		case client.PacketType_CLOSE_RSP:
 			resp := pkt.GetCloseResponse()
 			t.connsLock.RLock()
 			conn, ok := t.conns[resp.ConnectID]
 			t.connsLock.RUnlock()
+			if err := t.connIDs.check(resp.ConnectID, conn); err != nil {
+				t.connIDViolation(pkt, resp.ConnectID, err)
+				continue
+			}
+			t.connIDs.close(resp.ConnectID)
 
 			if ok {
+				conn.reset = resp.Reason == client.CloseReason_CLOSE_REASON_RESET
 				close(conn.readCh)
+				conn.endIdleWarnings()
 				conn.closeCh <- resp.Error
 				close(conn.closeCh)
 				t.connsLock.Lock()
 				delete(t.conns, resp.ConnectID)
 				t.connsLock.Unlock()
+				conn.releaseSlot()
 				return
 			}
-			klog.V(1).InfoS("connection not recognized", "connectionID", resp.ConnectID)
+			t.dropPacket(pkt, DropUnknownConnection, resp.ConnectID, 0)
+
+		case client.PacketType_HELLO:
+			t.handleHello(pkt.GetHello())
+
+		case client.PacketType_IDLE_WARNING:
+			warning := pkt.GetIdleWarning()
+			t.connsLock.RLock()
+			conn, ok := t.conns[warning.ConnectID]
+			t.connsLock.RUnlock()
+			if !ok {
+				t.dropPacket(pkt, DropUnknownConnection, warning.ConnectID, 0)
+				continue
+			}
+			klog.V(4).InfoS("Agent warned of idle connection", "connectionID", warning.ConnectID, "closeIn", warning.CloseIn)
+			conn.warnIdle(time.Now().Add(time.Duration(warning.CloseIn) * time.Millisecond))
+
+		default:
+			t.dropPacket(pkt, DropUnhandledType, 0, 0)
+		}
+	}
+}
+
+// stopTimer stops t and drains its channel, so that it can be Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
 		}
 	}
 }
@@ -220,34 +473,84 @@ func (t *grpcTunnel) serve(tunnelCtx context.Context, c clientConn) {
 // what net.Dial does. The only supported protocol is tcp.
 func (t *grpcTunnel) DialContext(requestCtx context.Context, protocol, address string) (net.Conn, error) {
 	if protocol != "tcp" {
-		return nil, errors.New("protocol not supported")
+		return nil, newOpError("dial", nil, net.UnknownNetworkError(protocol))
+	}
+	if t.limiter != nil {
+		if err := t.limiter.acquire(requestCtx, t.done); err != nil {
+			reason := ReasonConcurrencyLimit
+			if err == errTunnelClosed {
+				reason = ReasonTunnelClosed
+			}
+			return nil, newOpError("dial", &tunnelAddr{network: protocol, address: address}, &TunnelError{Reason: reason, Err: err})
+		}
 	}
+	c, err := t.dialWithRetry(requestCtx, protocol, address)
+	if err != nil && t.limiter != nil {
+		t.limiter.release()
+	}
+	return c, err
+}
 
-	random := rand.Int63() /* #nosec G404 */
+// dialWithRetry dials once, or until an agent is available with
+// WithDialRetry.
+func (t *grpcTunnel) dialWithRetry(requestCtx context.Context, protocol, address string) (net.Conn, error) {
+	opts := newDialOptions(requestCtx)
+	if opts.retry == nil {
+		return t.dial(requestCtx, protocol, address, opts)
+	}
+
+	backoff := newDialBackoff(*opts.retry)
+	for {
+		c, err := t.dial(requestCtx, protocol, address, opts)
+		if !isAgentUnavailable(err) {
+			return c, err
+		}
+		delay := backoff.next()
+		if deadline, ok := requestCtx.Deadline(); ok && time.Until(deadline) < delay {
+			t.closeRetried()
+			return nil, err
+		}
+		klog.V(3).InfoS("No agent available for the dial, retrying", "address", address, "backoff", delay, "err", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-requestCtx.Done():
+			timer.Stop()
+			t.closeRetried()
+			return nil, err
+		case <-t.done:
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
 
-	// This channel is closed once we're returning and no longer waiting on resultCh
-	cancelCh := make(chan struct{})
-	defer close(cancelCh)
+// closeRetried closes the tunnel kept open for a retried dial that gave up.
+func (t *grpcTunnel) closeRetried() {
+	if t.clientConn != nil {
+		t.clientConn.Close() /* #nosec G104 */
+	}
+}
 
-	// This channel MUST NOT be buffered. The sender needs to know when we are not receiving things, so they can abort.
-	resCh := make(chan dialResult)
+func (t *grpcTunnel) dial(requestCtx context.Context, protocol, address string, opts dialOptions) (net.Conn, error) {
+	addr := &tunnelAddr{network: protocol, address: address}
 
-	t.pendingDialLock.Lock()
-	t.pendingDial[random] = pendingDial{resultCh: resCh, cancelCh: cancelCh}
-	t.pendingDialLock.Unlock()
-	defer func() {
-		t.pendingDialLock.Lock()
-		delete(t.pendingDial, random)
-		t.pendingDialLock.Unlock()
-	}()
+	random := rand.Int63() /* #nosec G404 */
+
+	generation, resCh := t.pendingDials.register(random, opts.retry != nil)
+	defer t.pendingDials.remove(random, generation)
 
 	req := &client.Packet{
 		Type: client.PacketType_DIAL_REQ,
 		Payload: &client.Packet_DialRequest{
 			DialRequest: &client.DialRequest{
-				Protocol: protocol,
-				Address:  address,
-				Random:   random,
+				Protocol:   protocol,
+				Address:    address,
+				Random:     random,
+				Metadata:   dialMetadataFrom(requestCtx),
+				Hostname:   opts.hostname,
+				Candidates: opts.candidates,
+				Priority:   opts.priority,
 			},
 		},
 	}
@@ -255,31 +558,76 @@ func (t *grpcTunnel) DialContext(requestCtx context.Context, protocol, address s
 
 	err := t.stream.Send(req)
 	if err != nil {
-		return nil, err
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonTunnelClosed, Err: err})
 	}
 
 	klog.V(5).Infoln("DIAL_REQ sent to proxy server")
 
-	c := &conn{stream: t.stream, random: random}
+	c := &conn{
+		stream:       t.stream,
+		random:       random,
+		addr:         addr,
+		maxBuffered:  opts.maxBufferedBytes,
+		asyncClose:   opts.asyncClose,
+		closeTimeout: opts.closeTimeout,
+		tunnelDone:   t.done,
+	}
 
+	// A dial answered before it could be canceled completes: the proxy
+	// server considers the connection established, giving it up would
+	// leak it.
+	var res dialResult
+	var answered bool
 	select {
-	case res := <-resCh:
-		if res.err != "" {
-			return nil, errors.New(res.err)
-		}
-		c.connID = res.connid
-		c.readCh = make(chan []byte, 10)
-		c.closeCh = make(chan string, 1)
-		t.connsLock.Lock()
-		t.conns[res.connid] = c
-		t.connsLock.Unlock()
+	case res = <-resCh:
 	case <-time.After(30 * time.Second):
-		klog.V(5).InfoS("Timed out waiting for DialResp", "dialID", random)
-		return nil, errors.New("dial timeout, backstop")
+		if res, answered = t.pendingDials.cancel(random, generation); !answered {
+			klog.V(5).InfoS("Timed out waiting for DialResp", "dialID", random)
+			return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonDialTimeout, Message: "backstop"})
+		}
 	case <-requestCtx.Done():
-		klog.V(5).InfoS("Context canceled waiting for DialResp", "ctxErr", requestCtx.Err(), "dialID", random)
-		return nil, errors.New("dial timeout, context")
+		if res, answered = t.pendingDials.cancel(random, generation); !answered {
+			klog.V(5).InfoS("Context canceled waiting for DialResp", "ctxErr", requestCtx.Err(), "dialID", random)
+			reason := ReasonDialCanceled
+			if requestCtx.Err() == context.DeadlineExceeded {
+				reason = ReasonDialTimeout
+			}
+			return nil, newOpError("dial", addr, &TunnelError{Reason: reason, Err: requestCtx.Err()})
+		}
+	case <-t.done:
+		klog.V(5).InfoS("Tunnel closed waiting for DialResp", "dialID", random)
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonTunnelClosed})
+	}
+
+	if res.closed {
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonDialClosed})
+	}
+	if res.code == client.DialErrorCode_DIAL_ERROR_NO_AGENT {
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonNoAgent, Message: res.err})
+	}
+	if res.code == client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED {
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonAgentsSaturated, Message: res.err})
+	}
+	if res.code == client.DialErrorCode_DIAL_ERROR_QUARANTINED {
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonQuarantined, Message: res.err})
+	}
+	if res.err != "" {
+		return nil, newOpError("dial", addr, &TunnelError{Reason: ReasonDialFailed, Message: res.err})
+	}
+	c.connID = res.connid
+	c.epoch = res.epoch
+	c.agentID = res.agentID
+	c.strategy = res.strategy
+	c.readCh = make(chan []byte, opts.readQueueLength)
+	c.drained = make(chan struct{}, 1)
+	c.closeCh = make(chan string, 1)
+	c.idleWarning = make(chan time.Time, 1)
+	if t.limiter != nil {
+		c.release = t.limiter.release
 	}
+	t.connsLock.Lock()
+	t.conns[res.connid] = c
+	t.connsLock.Unlock()
 
 	return c, nil
 }
@@ -19,13 +19,22 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"go.uber.org/goleak"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 )
@@ -41,9 +50,228 @@ func TestDial(t *testing.T) {
 	defer s.Close()
 
 	tunnel := &grpcTunnel{
-		stream:      s,
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	_, err := tunnel.DialContext(WithDialOptions(ctx, WithDestinationHostname("localhost")), "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	if ts.packets[0].Type != client.PacketType_DIAL_REQ {
+		t.Fatalf("expect packet.type %v; got %v", client.PacketType_DIAL_REQ, ts.packets[0].Type)
+	}
+
+	if ts.packets[0].GetDialRequest().Address != "127.0.0.1:80" {
+		t.Errorf("expect packet.address %v; got %v", "127.0.0.1:80", ts.packets[0].GetDialRequest().Address)
+	}
+
+	if ts.packets[0].GetDialRequest().Hostname != "localhost" {
+		t.Errorf("expect packet.hostname %v; got %v", "localhost", ts.packets[0].GetDialRequest().Hostname)
+	}
+}
+
+func TestDialReportsRouting(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+	ts.handle(client.PacketType_DIAL_REQ, func(pkt *client.Packet) *client.Packet {
+		resp := ts.handleDial(pkt)
+		resp.GetDialResponse().AgentID = "agent-1"
+		resp.GetDialResponse().Strategy = "destHost"
+		return resp
+	})
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	c, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	rc, ok := c.(RoutedConn)
+	if !ok {
+		t.Fatalf("expect a RoutedConn; got %T", c)
+	}
+	if rc.AgentID() != "agent-1" || rc.Strategy() != "destHost" {
+		t.Errorf("expect agent-1 and destHost; got %q and %q", rc.AgentID(), rc.Strategy())
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	// The first attempt finds no agent, the second saturated agents.
+	attempts := 0
+	ts.handle(client.PacketType_DIAL_REQ, func(pkt *client.Packet) *client.Packet {
+		attempts++
+		resp := ts.handleDial(pkt)
+		switch attempts {
+		case 1:
+			resp.GetDialResponse().Error = "No agent available"
+			resp.GetDialResponse().ErrorCode = client.DialErrorCode_DIAL_ERROR_NO_AGENT
+		case 2:
+			resp.GetDialResponse().Error = "All agents reached their connection capacity"
+			resp.GetDialResponse().ErrorCode = client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED
+		}
+		return resp
+	})
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	dialCtx := WithDialOptions(ctx, WithDialRetry(DialRetryPolicy{InitialBackoff: time.Millisecond}))
+	_, err := tunnel.DialContext(dialCtx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expect 3 dial attempts; got %d", attempts)
+	}
+}
+
+func TestDialConcurrencyLimit(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+		limiter:            newConcurrencyLimiter(1, 10*time.Millisecond),
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	c, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	// The open connection holds the only slot.
+	_, err = tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	var tunnelErr *TunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Reason != ReasonConcurrencyLimit {
+		t.Fatalf("expect %q; got %v", ReasonConcurrencyLimit, err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a net.Error timeout, got %#v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if err := tunnel.limiter.acquire(ctx, nil); err != nil {
+		t.Errorf("expected the slot to be released on close, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	ctx := context.Background()
+	l := newConcurrencyLimiter(1, 0)
+	if err := l.acquire(ctx, nil); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	// A waiter giving up leaves the queue.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.acquire(canceled, nil); err != context.Canceled {
+		t.Fatalf("expect %v; got %v", context.Canceled, err)
+	}
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			if err := l.acquire(ctx, nil); err != nil {
+				t.Error(err)
+			}
+			order <- i
+		}()
+		// Wait for the waiter to be queued before starting the next.
+		for {
+			l.mu.Lock()
+			queued := len(l.waiters)
+			l.mu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		l.release()
+		if got := <-order; got != i {
+			t.Errorf("expect waiter %d to acquire; got %d", i, got)
+		}
+	}
+	l.release()
+	if l.active != 0 || len(l.waiters) != 0 {
+		t.Errorf("expect an idle limiter; got %d active and %d waiters", l.active, len(l.waiters))
+	}
+
+	done := make(chan struct{})
+	close(done)
+	l.active = 1
+	if err := l.acquire(ctx, done); err != errTunnelClosed {
+		t.Errorf("expect %v; got %v", errTunnelClosed, err)
+	}
+}
+
+// TestDialRace exercises the scenario where serve() observes and handles DIAL_RSP
+// before DialContext() does any work after sending the DIAL_REQ.
+func TestDialRace(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		// artificially delay after calling Send, ensure handoff of result from serve to DialContext still works
+		stream:             fakeSlowSend{s},
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
 	}
 
 	go tunnel.serve(ctx, &fakeConn{})
@@ -54,260 +282,1371 @@ func TestDial(t *testing.T) {
 		t.Fatalf("expect nil; got %v", err)
 	}
 
-	if ts.packets[0].Type != client.PacketType_DIAL_REQ {
-		t.Fatalf("expect packet.type %v; got %v", client.PacketType_DIAL_REQ, ts.packets[0].Type)
+	if ts.packets[0].Type != client.PacketType_DIAL_REQ {
+		t.Fatalf("expect packet.type %v; got %v", client.PacketType_DIAL_REQ, ts.packets[0].Type)
+	}
+
+	if ts.packets[0].GetDialRequest().Address != "127.0.0.1:80" {
+		t.Errorf("expect packet.address %v; got %v", "127.0.0.1:80", ts.packets[0].GetDialRequest().Address)
+	}
+}
+
+// fakeSlowSend wraps ProxyService_ProxyClient and adds an artificial 1 second delay after calling Send
+type fakeSlowSend struct {
+	client.ProxyService_ProxyClient
+}
+
+func (s fakeSlowSend) Send(p *client.Packet) error {
+	// send the request so it can start being processed immediately
+	err := s.ProxyService_ProxyClient.Send(p)
+	// delay returning to simulate slowness on the client side,
+	// to exercise serve() observing/handling the DIAL_RSP before
+	// the client does any post-Send() work
+	time.Sleep(time.Second)
+	return err
+}
+
+func TestData(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	datas := [][]byte{
+		[]byte("hello"),
+		[]byte(", "),
+		[]byte("world."),
+	}
+
+	// send data using conn.Write
+	for _, data := range datas {
+		n, err := conn.Write(data)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != len(data) {
+			t.Errorf("expect n=%d len(%q); got %d", len(data), string(data), n)
+		}
+	}
+
+	// test server should echo data back
+	var buf [64]byte
+	for _, data := range datas {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(buf[:n]) != "echo: "+string(data) {
+			t.Errorf("expect 'echo: %s'; got %s", string(data), string(buf[:n]))
+		}
+	}
+
+	// verify test server received data
+	if ts.data.String() != "hello, world." {
+		t.Errorf("expect server received %v; got %v", "hello, world.", ts.data.String())
+	}
+}
+
+func TestDataBufferLimits(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	dialCtx := WithDialOptions(ctx, WithReadQueueLength(2), WithMaxBufferedBytes(4))
+	c, err := tunnel.DialContext(dialCtx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if got := cap(c.(*conn).readCh); got != 2 {
+		t.Errorf("expect a read queue of 2 packets; got %d", got)
+	}
+
+	datas := []string{"hello", ", ", "world."}
+	for _, data := range datas {
+		if _, err := c.Write([]byte(data)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Each echo exceeds the limit, so a packet is only delivered once the
+	// short reads below drained the connection below the limit.
+	var got []byte
+	var buf [3]byte
+	for want := len("echo: hello") + len("echo: , ") + len("echo: world."); len(got) < want; {
+		n, err := c.Read(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffered := atomic.LoadInt64(&c.(*conn).buffered); buffered >= 4+int64(len("echo: world.")) {
+			t.Errorf("expect at most one packet buffered beyond the limit; got %d bytes", buffered)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "echo: helloecho: , echo: world." {
+		t.Errorf("unexpected data %q", got)
+	}
+}
+
+func TestConnWriteTo(t *testing.T) {
+	c := &conn{readCh: make(chan []byte, 3)}
+	c.readCh <- []byte("hello")
+	c.readCh <- []byte(", ")
+	c.readCh <- []byte("world.")
+	close(c.readCh)
+
+	// A failed write keeps the unwritten data for subsequent reads.
+	if _, err := c.WriteTo(&failingWriter{limit: 3}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	var buf bytes.Buffer
+	n, err := c.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if buf.String() != "lo, world." || n != int64(buf.Len()) {
+		t.Errorf("expect %q; got %q (n=%d)", "lo, world.", buf.String(), n)
+	}
+}
+
+// failingWriter fails once limit bytes have been written.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("write failed")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestConnReadFrom(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	data := strings.Repeat("x", readFromChunkSize+1)
+	// Hide strings.Reader's WriteTo, so that io.Copy uses conn.ReadFrom.
+	n, err := io.Copy(conn, struct{ io.Reader }{strings.NewReader(data)})
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("expect %d bytes copied; got %d", len(data), n)
+	}
+
+	// The copy is sent in two packets, each echoed by the test server.
+	echo := make([]byte, len(data)+2*len("echo: "))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if ts.data.String() != data {
+		t.Errorf("expect server received %d bytes; got %d", len(data), ts.data.Len())
+	}
+}
+
+// trickleReader returns at most chunk bytes per Read, reporting the rest
+// as buffered.
+type trickleReader struct {
+	data  []byte
+	chunk int
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	chunk := r.data
+	if len(chunk) > r.chunk {
+		chunk = chunk[:r.chunk]
+	}
+	n := copy(p, chunk)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *trickleReader) Buffered() int {
+	return len(r.data)
+}
+
+func TestConnReadFromBatchesBufferedData(t *testing.T) {
+	s, ps := pipe()
+	c := &conn{stream: s, connID: 1}
+
+	data := strings.Repeat("x", 100)
+	n, err := c.ReadFrom(&trickleReader{data: []byte(data), chunk: 7})
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("expect %d bytes sent; got %d", len(data), n)
+	}
+
+	pkt, err := ps.Recv()
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if got := string(pkt.GetData().Data); got != data {
+		t.Errorf("expect the data batched in one packet; got %d bytes", len(got))
+	}
+	select {
+	case pkt := <-ps.r:
+		t.Errorf("expect a single packet; got %v", pkt)
+	default:
+	}
+}
+
+func TestDialer(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	var tunnelCtx context.Context
+	d := &Dialer{
+		Address: "konnectivity-server:8090",
+		Timeout: time.Minute,
+		newTunnel: func(createCtx, ctx context.Context, address string, opts ...grpc.DialOption) (Tunnel, error) {
+			if address != "konnectivity-server:8090" {
+				t.Errorf("expect the tunnel to the proxy server; got %q", address)
+			}
+			tunnelCtx = ctx
+			s, ps := pipeWithContext(ctx)
+			tunnel := &grpcTunnel{
+				stream:             s,
+				conns:              make(map[int64]*conn),
+				readTimeoutSeconds: 10,
+				done:               make(chan struct{}),
+			}
+			go tunnel.serve(ctx, &fakeConn{})
+			go testServer(ps, 100).serve()
+			return tunnel, nil
+		},
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	echo := make([]byte, len("echo: hello"))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "echo: hello" {
+		t.Fatalf("expect %q; got %q, %v", "echo: hello", echo, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	select {
+	case <-tunnelCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("expect the tunnel to be closed with the connection")
+	}
+}
+
+func TestDialerTunnelFailure(t *testing.T) {
+	d := &Dialer{
+		newTunnel: func(createCtx, tunnelCtx context.Context, address string, opts ...grpc.DialOption) (Tunnel, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	_, err := d.Dial("tcp", "127.0.0.1:80")
+	var tunnelErr *TunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Reason != ReasonTunnelClosed {
+		t.Errorf("expect a tunnel closed error; got %v", err)
+	}
+}
+
+func TestDialerHTTPTransport(t *testing.T) {
+	d := &Dialer{}
+	transport := d.HTTPTransport(nil)
+	if transport.Proxy != nil {
+		t.Error("expect environment proxies to be ignored")
+	}
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expect TLS 1.2 at least; got %x", transport.TLSClientConfig.MinVersion)
+	}
+	tlsConfig := &tls.Config{ServerName: "kubelet", MinVersion: tls.VersionTLS13}
+	transport = d.HTTPTransport(tlsConfig)
+	if transport.TLSClientConfig == tlsConfig || transport.TLSClientConfig.ServerName != "kubelet" || transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expect a copy of the TLS config; got %+v", transport.TLSClientConfig)
+	}
+}
+
+func TestClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if ts.packets[1].Type != client.PacketType_CLOSE_REQ {
+		t.Fatalf("expect packet.type %v; got %v", client.PacketType_CLOSE_REQ, ts.packets[1].Type)
+	}
+	if ts.packets[1].GetCloseRequest().ConnectID != 100 {
+		t.Errorf("expect connectID=100; got %d", ts.packets[1].GetCloseRequest().ConnectID)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	// sending a nil response for close handler should trigger the timeout
+	// since we never receive CLOSE_RSP
+	ts.handlers[client.PacketType_CLOSE_REQ] = func(pkt *client.Packet) *client.Packet {
+		return nil
+	}
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 10)
+		_, err := conn.Read(buf)
+		if err != io.EOF {
+			t.Errorf("expected %v: got %v", io.EOF, err)
+		}
+	}()
+
+	err = conn.Close()
+	if !errors.Is(err, errConnCloseTimeout) {
+		t.Errorf("expected %v but got %v", errConnCloseTimeout, err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected close timeout to be a net.Error timeout, got %#v", err)
+	}
+
+}
+
+func TestCloseTunnelDone(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	// the tunnel ends instead of answering CLOSE_REQ
+	ts.handlers[client.PacketType_CLOSE_REQ] = func(pkt *client.Packet) *client.Packet {
+		ps.Close()
+		return nil
+	}
+
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+		done:               make(chan struct{}),
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	start := time.Now()
+	err = conn.Close()
+	var tunnelErr *TunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Reason != ReasonTunnelClosed {
+		t.Errorf("expect %q; got %v", ReasonTunnelClosed, err)
+	}
+	if elapsed := time.Since(start); elapsed >= CloseTimeout {
+		t.Errorf("expect Close to return once the tunnel is done; got %v", elapsed)
+	}
+}
+
+func TestAsyncClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := WithDialOptions(context.Background(), WithAsyncClose(time.Second))
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+
+	// Hold back CLOSE_RSP until Close returned.
+	release := make(chan struct{})
+	ts.handlers[client.PacketType_CLOSE_REQ] = func(pkt *client.Packet) *client.Packet {
+		<-release
+		return ts.handleClose(pkt)
+	}
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	close(release)
+
+	// The connection is closed once CLOSE_RSP arrives.
+	if _, err := conn.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("expected %v: got %v", io.EOF, err)
+	}
+	if ts.packets[1].Type != client.PacketType_CLOSE_REQ {
+		t.Fatalf("expect packet.type %v; got %v", client.PacketType_CLOSE_REQ, ts.packets[1].Type)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	testcases := []struct {
+		reason  client.CloseReason
+		wantEOF bool
+	}{
+		{client.CloseReason_CLOSE_REASON_UNSPECIFIED, true},
+		{client.CloseReason_CLOSE_REASON_EOF, true},
+		{client.CloseReason_CLOSE_REASON_RESET, false},
+		{client.CloseReason_CLOSE_REASON_IDLE, true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.reason.String(), func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			ctx := context.Background()
+			s, ps := pipe()
+			ts := testServer(ps, 100)
+			// The destination closes the connection upon receiving data.
+			ts.handlers[client.PacketType_DATA] = func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_CLOSE_RSP,
+					Payload: &client.Packet_CloseResponse{
+						CloseResponse: &client.CloseResponse{
+							ConnectID: pkt.GetData().ConnectID,
+							Reason:    tc.reason,
+						},
+					},
+				}
+			}
+
+			defer ps.Close()
+			defer s.Close()
+
+			tunnel := &grpcTunnel{
+				stream:             s,
+				conns:              make(map[int64]*conn),
+				readTimeoutSeconds: 10,
+			}
+
+			go tunnel.serve(ctx, &fakeConn{})
+			go ts.serve()
+
+			conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+			if err != nil {
+				t.Fatalf("expect nil; got %v", err)
+			}
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = conn.Read(make([]byte, 10))
+			if tc.wantEOF {
+				if err != io.EOF {
+					t.Errorf("expected %v: got %v", io.EOF, err)
+				}
+				return
+			}
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("expected an error matching %v: got %v", syscall.ECONNRESET, err)
+			}
+			if _, ok := err.(*net.OpError); !ok {
+				t.Errorf("expected a *net.OpError: got %T", err)
+			}
+		})
+	}
+}
+
+func TestIdleWarning(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx := context.Background()
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+	// The agent warns of the idle connection upon receiving data.
+	ts.handlers[client.PacketType_DATA] = func(pkt *client.Packet) *client.Packet {
+		return &client.Packet{
+			Type: client.PacketType_IDLE_WARNING,
+			Payload: &client.Packet_IdleWarning{
+				IdleWarning: &client.IdleWarning{
+					ConnectID: pkt.GetData().ConnectID,
+					CloseIn:   30000,
+				},
+			},
+		}
+	}
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	iw, ok := conn.(IdleWarner)
+	if !ok {
+		t.Fatalf("expect the connection to implement IdleWarner; got %T", conn)
+	}
+	start := time.Now()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case closeAt := <-iw.IdleWarning():
+		if closeAt.Before(start.Add(30*time.Second)) || closeAt.After(time.Now().Add(30*time.Second)) {
+			t.Errorf("expect the connection to be closed in 30s; got %v", closeAt.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect an idle warning")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-iw.IdleWarning(); ok {
+		t.Error("expect the idle warnings to end once the connection closed")
+	}
+}
+
+func TestDialErrorsAreOpErrors(t *testing.T) {
+	testcases := []struct {
+		name      string
+		handler   handler
+		reason    TunnelErrorReason
+		temporary bool
+	}{
+		{
+			name: "dial failure",
+			handler: func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_DIAL_RSP,
+					Payload: &client.Packet_DialResponse{
+						DialResponse: &client.DialResponse{
+							Random: pkt.GetDialRequest().Random,
+							Error:  "connection refused",
+						},
+					},
+				}
+			},
+			reason: ReasonDialFailed,
+		},
+		{
+			name: "no agent",
+			handler: func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_DIAL_RSP,
+					Payload: &client.Packet_DialResponse{
+						DialResponse: &client.DialResponse{
+							Random:    pkt.GetDialRequest().Random,
+							Error:     "No agent available",
+							ErrorCode: client.DialErrorCode_DIAL_ERROR_NO_AGENT,
+						},
+					},
+				}
+			},
+			reason:    ReasonNoAgent,
+			temporary: true,
+		},
+		{
+			name: "quarantined",
+			handler: func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_DIAL_RSP,
+					Payload: &client.Packet_DialResponse{
+						DialResponse: &client.DialResponse{
+							Random:    pkt.GetDialRequest().Random,
+							Error:     "destination 127.0.0.1:80 quarantined",
+							ErrorCode: client.DialErrorCode_DIAL_ERROR_QUARANTINED,
+						},
+					},
+				}
+			},
+			reason:    ReasonQuarantined,
+			temporary: true,
+		},
+		{
+			name: "agents saturated",
+			handler: func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_DIAL_RSP,
+					Payload: &client.Packet_DialResponse{
+						DialResponse: &client.DialResponse{
+							Random:    pkt.GetDialRequest().Random,
+							Error:     "All agents reached their connection capacity",
+							ErrorCode: client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED,
+						},
+					},
+				}
+			},
+			reason:    ReasonAgentsSaturated,
+			temporary: true,
+		},
+		{
+			name: "dial closed",
+			handler: func(pkt *client.Packet) *client.Packet {
+				return &client.Packet{
+					Type: client.PacketType_DIAL_CLS,
+					Payload: &client.Packet_CloseDial{
+						CloseDial: &client.CloseDial{
+							Random: pkt.GetDialRequest().Random,
+						},
+					},
+				}
+			},
+			reason:    ReasonDialClosed,
+			temporary: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			ctx := context.Background()
+			s, ps := pipe()
+			ts := testServer(ps, 100)
+			ts.handlers[client.PacketType_DIAL_REQ] = tc.handler
+
+			defer ps.Close()
+			defer s.Close()
+
+			tunnel := &grpcTunnel{
+				stream:             s,
+				conns:              make(map[int64]*conn),
+				readTimeoutSeconds: 10,
+			}
+
+			go tunnel.serve(ctx, &fakeConn{})
+			go ts.serve()
+
+			_, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) {
+				t.Fatalf("expected *net.OpError; got %#v", err)
+			}
+			if opErr.Op != "dial" || opErr.Net != "tcp" || opErr.Addr.String() != "127.0.0.1:80" {
+				t.Errorf("unexpected OpError fields: op=%q net=%q addr=%v", opErr.Op, opErr.Net, opErr.Addr)
+			}
+			var tunnelErr *TunnelError
+			if !errors.As(err, &tunnelErr) {
+				t.Fatalf("expected *TunnelError; got %#v", opErr.Err)
+			}
+			if tunnelErr.Reason != tc.reason {
+				t.Errorf("expected reason %q; got %q", tc.reason, tunnelErr.Reason)
+			}
+			if opErr.Temporary() != tc.temporary {
+				t.Errorf("expected Temporary()=%v; got %v", tc.temporary, opErr.Temporary())
+			}
+		})
+	}
+}
+
+func TestDialContextDeadlineIsTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	s, ps := pipe()
+	ts := testServer(ps, 100)
+	// never answer the dial
+	ts.handlers[client.PacketType_DIAL_REQ] = func(pkt *client.Packet) *client.Packet {
+		return nil
+	}
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go ts.serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("expected a net.Error timeout; got %#v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap %v; got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCreateSingleUseGrpcTunnel_NoLeakOnFailure(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	tunnel, err := CreateSingleUseGrpcTunnel(context.Background(), "127.0.0.1:12345", grpc.WithInsecure())
+	if tunnel != nil {
+		t.Fatal("expected nil tunnel when calling CreateSingleUseGrpcTunnel")
+	}
+	if err == nil {
+		t.Fatal("expected error when calling CreateSingleUseGrpcTunnel")
+	}
+}
+
+func TestCreateSingleUseGrpcTunnelWithContext_NoLeakOnFailure(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	tunnel, err := CreateSingleUseGrpcTunnelWithContext(context.Background(), context.Background(), "127.0.0.1:12345", grpc.WithInsecure())
+	if tunnel != nil {
+		t.Fatal("expected nil tunnel when calling CreateSingleUseGrpcTunnelWithContext")
+	}
+	if err == nil {
+		t.Fatal("expected error when calling CreateSingleUseGrpcTunnelWithContext")
+	}
+}
+
+func TestDialAfterTunnelCancelled(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s, ps := pipeWithContext(ctx)
+	ts := testServer(ps, 100)
+
+	defer ps.Close()
+	defer s.Close()
+
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+
+	go tunnel.serve(ctx, &fakeConn{})
+	go ts.serve()
+
+	_, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	if err == nil {
+		t.Fatalf("expect err when dialing after tunnel closed")
+	}
+
+	// try to avoid race with deferred Close()
+	time.Sleep(time.Second)
+}
+
+func TestTunnelHealth(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, ps := pipeWithContext(ctx)
+	defer ps.Close()
+	defer s.Close()
+
+	stateConn := newFakeStateConn(connectivity.Connecting)
+	tunnel := &grpcTunnel{
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+		done:               make(chan struct{}),
+		clientConn:         stateConn,
+	}
+	go tunnel.serve(ctx, stateConn)
+
+	if tunnel.Ready() {
+		t.Error("expect a connecting tunnel not to be ready")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stateConn.setState(connectivity.Ready)
+	}()
+	checkCtx, checkCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer checkCancel()
+	if err := tunnel.HealthCheck(checkCtx); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	if !tunnel.Ready() {
+		t.Error("expect a connected tunnel to be ready")
+	}
+
+	stateConn.setState(connectivity.TransientFailure)
+	var tunnelErr *TunnelError
+	if err := tunnel.HealthCheck(checkCtx); !errors.As(err, &tunnelErr) || tunnelErr.Reason != ReasonTunnelClosed {
+		t.Errorf("expect %q; got %v", ReasonTunnelClosed, err)
 	}
 
-	if ts.packets[0].GetDialRequest().Address != "127.0.0.1:80" {
-		t.Errorf("expect packet.address %v; got %v", "127.0.0.1:80", ts.packets[0].GetDialRequest().Address)
+	// The tunnel is done once its stream ends.
+	stateConn.setState(connectivity.Ready)
+	cancel()
+	select {
+	case <-tunnel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the tunnel to be done")
+	}
+	if tunnel.Ready() {
+		t.Error("expect a done tunnel not to be ready")
+	}
+	if err := tunnel.HealthCheck(context.Background()); !errors.As(err, &tunnelErr) || tunnelErr.Reason != ReasonTunnelClosed {
+		t.Errorf("expect %q; got %v", ReasonTunnelClosed, err)
 	}
 }
 
-// TestDialRace exercises the scenario where serve() observes and handles DIAL_RSP
-// before DialContext() does any work after sending the DIAL_REQ.
-func TestDialRace(t *testing.T) {
+func TestServerFeatures(t *testing.T) {
 	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
 
-	ctx := context.Background()
-	s, ps := pipe()
-	ts := testServer(ps, 100)
-
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, ps := pipeWithContext(ctx)
 	defer ps.Close()
 	defer s.Close()
 
 	tunnel := &grpcTunnel{
-		// artificially delay after calling Send, ensure handoff of result from serve to DialContext still works
-		stream:      fakeSlowSend{s},
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+		done:               make(chan struct{}),
 	}
-
 	go tunnel.serve(ctx, &fakeConn{})
-	go ts.serve()
 
-	_, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
-	if err != nil {
-		t.Fatalf("expect nil; got %v", err)
+	fr, ok := Tunnel(tunnel).(FeatureReporter)
+	if !ok {
+		t.Fatal("expect the tunnel to report the server features")
 	}
-
-	if ts.packets[0].Type != client.PacketType_DIAL_REQ {
-		t.Fatalf("expect packet.type %v; got %v", client.PacketType_DIAL_REQ, ts.packets[0].Type)
+	if _, ok := fr.ServerFeatures(); ok {
+		t.Error("expect no server features before the server said hello")
 	}
-
-	if ts.packets[0].GetDialRequest().Address != "127.0.0.1:80" {
-		t.Errorf("expect packet.address %v; got %v", "127.0.0.1:80", ts.packets[0].GetDialRequest().Address)
+	hello := helloPacket().GetHello()
+	if hello.ProtocolVersion != ProtocolVersion {
+		t.Errorf("expect protocol version %d; got %d", ProtocolVersion, hello.ProtocolVersion)
 	}
-}
 
-// fakeSlowSend wraps ProxyService_ProxyClient and adds an artificial 1 second delay after calling Send
-type fakeSlowSend struct {
-	client.ProxyService_ProxyClient
-}
+	ps.Send(&client.Packet{
+		Type:    client.PacketType_HELLO,
+		Payload: &client.Packet_Hello{Hello: &client.Hello{ProtocolVersion: 1, Features: []string{FeatureIdleWarning}}},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		features, ok := fr.ServerFeatures()
+		if ok {
+			if len(features) != 1 || features[0] != FeatureIdleWarning {
+				t.Errorf("expect [%s]; got %v", FeatureIdleWarning, features)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect the server features to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
-func (s fakeSlowSend) Send(p *client.Packet) error {
-	// send the request so it can start being processed immediately
-	err := s.ProxyService_ProxyClient.Send(p)
-	// delay returning to simulate slowness on the client side,
-	// to exercise serve() observing/handling the DIAL_RSP before
-	// the client does any post-Send() work
-	time.Sleep(time.Second)
-	return err
+	cancel()
+	<-tunnel.Done()
 }
 
-func TestData(t *testing.T) {
+func TestConnIDViolations(t *testing.T) {
 	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
 
 	ctx := context.Background()
 	s, ps := pipe()
 	ts := testServer(ps, 100)
+	// The server echoes the data to a connection ID it did not assign.
+	ts.handlers[client.PacketType_DATA] = func(pkt *client.Packet) *client.Packet {
+		return &client.Packet{
+			Type: client.PacketType_DATA,
+			Payload: &client.Packet_Data{
+				Data: &client.Data{ConnectID: 101, Data: pkt.GetData().Data},
+			},
+		}
+	}
 
 	defer ps.Close()
 	defer s.Close()
 
 	tunnel := &grpcTunnel{
-		stream:      s,
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
 	}
 
 	go tunnel.serve(ctx, &fakeConn{})
 	go ts.serve()
 
-	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	violations := ConnIDViolations()
+	c, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
 	if err != nil {
 		t.Fatalf("expect nil; got %v", err)
 	}
-
-	datas := [][]byte{
-		[]byte("hello"),
-		[]byte(", "),
-		[]byte("world."),
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
 	}
-
-	// send data using conn.Write
-	for _, data := range datas {
-		n, err := conn.Write(data)
-		if err != nil {
-			t.Error(err)
-		}
-		if n != len(data) {
-			t.Errorf("expect n=%d len(%q); got %d", len(data), string(data), n)
+	deadline := time.Now().Add(5 * time.Second)
+	for ConnIDViolations() == violations {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the stray DATA to be counted")
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
-
-	// test server should echo data back
-	var buf [64]byte
-	for _, data := range datas {
-		n, err := conn.Read(buf[:])
-		if err != nil {
-			t.Error(err)
-		}
-
-		if string(buf[:n]) != "echo: "+string(data) {
-			t.Errorf("expect 'echo: %s'; got %s", string(data), string(buf[:n]))
-		}
+	if n := len(c.(*conn).readCh); n != 0 {
+		t.Errorf("expect the stray DATA to be dropped; got %d payloads", n)
 	}
 
-	// verify test server received data
-	if ts.data.String() != "hello, world." {
-		t.Errorf("expect server received %v; got %v", "hello, world.", ts.data.String())
+	if err := c.Close(); err != nil {
+		t.Fatalf("expect nil; got %v", err)
 	}
 }
 
-func TestClose(t *testing.T) {
-	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+type fakeMetrics struct {
+	mu    sync.Mutex
+	drops map[string]int
+}
 
-	ctx := context.Background()
-	s, ps := pipe()
-	ts := testServer(ps, 100)
+func (m *fakeMetrics) PacketDropped(packetType client.PacketType, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drops[packetType.String()+"/"+reason]++
+}
 
-	defer ps.Close()
-	defer s.Close()
+func (m *fakeMetrics) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, c := range m.drops {
+		n += c
+	}
+	return n
+}
+
+func TestDroppedPackets(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s, ps := pipeWithContext(ctx)
+	metrics := &fakeMetrics{drops: make(map[string]int)}
 	tunnel := &grpcTunnel{
-		stream:      s,
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
+		stream:             s,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+		done:               make(chan struct{}),
+		metrics:            metrics,
 	}
-
 	go tunnel.serve(ctx, &fakeConn{})
-	go ts.serve()
 
-	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
+	for _, pkt := range []*client.Packet{
+		{Type: client.PacketType_DIAL_CLS, Payload: &client.Packet_CloseDial{CloseDial: &client.CloseDial{Random: 1}}},
+		{Type: client.PacketType_DATA, Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 101}}},
+		{Type: client.PacketType_ACK, Payload: &client.Packet_Ack{Ack: &client.Ack{ConnectID: 101}}},
+	} {
+		if err := ps.Send(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 3 dropped packets; got %v", metrics.drops)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range []string{"DIAL_CLS/" + DropUnknownDial, "DATA/" + DropInvalidConnectionID, "ACK/" + DropUnhandledType} {
+		metrics.mu.Lock()
+		n := metrics.drops[key]
+		metrics.mu.Unlock()
+		if n != 1 {
+			t.Errorf("expect 1 drop of %s; got %d", key, n)
+		}
+	}
+
+	cancel()
+	<-tunnel.done
+}
+
+func TestLogBudget(t *testing.T) {
+	b := &logBudget{burst: 2, interval: time.Minute}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.allow(now); !ok {
+			t.Fatalf("expect line %d to be logged", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(now); ok {
+			t.Fatal("expect lines over the burst to be suppressed")
+		}
+	}
+	ok, suppressed := b.allow(now.Add(time.Minute))
+	if !ok || suppressed != 3 {
+		t.Errorf("expect a line with 3 suppressed lines after the interval; got %v, %d", ok, suppressed)
+	}
+}
+
+func TestConnIDs(t *testing.T) {
+	var ids connIDs
+	epoch, err := ids.bind(1)
 	if err != nil {
 		t.Fatalf("expect nil; got %v", err)
 	}
+	if err := ids.check(1, &conn{epoch: epoch}); err != nil {
+		t.Errorf("expect nil; got %v", err)
+	}
+	if err := ids.check(1, &conn{epoch: epoch + 1}); err == nil {
+		t.Error("expect packets of another epoch to be rejected")
+	}
+	if err := ids.check(2, nil); err == nil {
+		t.Error("expect unassigned connection IDs to be rejected")
+	}
 
-	if err := conn.Close(); err != nil {
-		t.Error(err)
+	ids.close(1)
+	if err := ids.check(1, nil); err == nil {
+		t.Error("expect closed connection IDs to be rejected")
 	}
+	if _, err := ids.bind(1); err == nil {
+		t.Error("expect connection IDs not to be reused")
+	}
+	if next, err := ids.bind(2); err != nil || next == epoch {
+		t.Errorf("expect a new epoch; got %d (%v)", next, err)
+	}
+}
 
-	if ts.packets[1].Type != client.PacketType_CLOSE_REQ {
-		t.Fatalf("expect packet.type %v; got %v", client.PacketType_CLOSE_REQ, ts.packets[1].Type)
+func TestParseStaticEndpoint(t *testing.T) {
+	addrs, err := parseStaticEndpoint("10.0.0.1:8090, 10.0.0.2:8090,")
+	if err != nil {
+		t.Fatalf("expect nil; got %v", err)
 	}
-	if ts.packets[1].GetCloseRequest().ConnectID != 100 {
-		t.Errorf("expect connectID=100; got %d", ts.packets[1].GetCloseRequest().ConnectID)
+	if len(addrs) != 2 || addrs[0] != "10.0.0.1:8090" || addrs[1] != "10.0.0.2:8090" {
+		t.Errorf("expect 2 addresses; got %v", addrs)
+	}
+	if _, err := parseStaticEndpoint(" , "); err == nil {
+		t.Error("expect targets without addresses to be rejected")
 	}
 }
 
-func TestCloseTimeout(t *testing.T) {
-	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+func TestStaticTargetFailover(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
 
-	ctx := context.Background()
-	s, ps := pipe()
-	ts := testServer(ps, 100)
+	streams := make(chan string, 10)
+	var live []string
+	for _, name := range []string{"replica-1", "replica-2"} {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := grpc.NewServer()
+		client.RegisterProxyServiceServer(s, &recordingProxyServer{name: name, streams: streams})
+		go s.Serve(lis)
+		defer s.Stop()
+		live = append(live, lis.Addr().String())
+	}
 
-	// sending a nil response for close handler should trigger the timeout
-	// since we never receive CLOSE_RSP
-	ts.handlers[client.PacketType_CLOSE_REQ] = func(pkt *client.Packet) *client.Packet {
-		return nil
+	for _, tc := range []struct {
+		policy   LoadBalancingPolicy
+		target   string
+		replicas map[string]bool
+	}{
+		{PickFirst, StaticTarget(deadAddr, live[0]), map[string]bool{"replica-1": true}},
+		{RoundRobin, StaticTarget(deadAddr, live[0], live[1]), map[string]bool{"replica-1": true, "replica-2": true}},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tunnel, err := CreateSingleUseGrpcTunnelWithContext(ctx, ctx, tc.target, grpc.WithInsecure(), WithLoadBalancing(tc.policy))
+		if err != nil {
+			cancel()
+			t.Fatalf("%s: expect a tunnel; got %v", tc.policy, err)
+		}
+		select {
+		case replica := <-streams:
+			if !tc.replicas[replica] {
+				t.Errorf("%s: expect the tunnel to reach one of %v; got %s", tc.policy, tc.replicas, replica)
+			}
+		case <-ctx.Done():
+			t.Errorf("%s: expect the tunnel to reach a replica", tc.policy)
+		}
+		cancel()
+		<-tunnel.Done()
 	}
+}
 
-	defer ps.Close()
-	defer s.Close()
+func TestPendingDials(t *testing.T) {
+	var p pendingDials
 
-	tunnel := &grpcTunnel{
-		stream:      s,
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
+	// dial answered
+	gen, resCh := p.register(1, true)
+	if outcome, retriable := p.resolve(1, dialResult{connid: 10}); outcome != resolveDelivered || !retriable {
+		t.Errorf("expect a delivered retriable dial; got %v, %v", outcome, retriable)
+	}
+	if res := <-resCh; res.connid != 10 {
+		t.Errorf("expect connection 10; got %d", res.connid)
 	}
 
-	go tunnel.serve(ctx, &fakeConn{})
-	go ts.serve()
-
-	conn, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
-	if err != nil {
-		t.Fatalf("expect nil; got %v", err)
+	// duplicate DIAL_RSP, while the dialer still holds the dial
+	if outcome, _ := p.resolve(1, dialResult{connid: 11}); outcome != resolveDuplicate {
+		t.Errorf("expect a duplicate answer; got %v", outcome)
+	}
+	p.remove(1, gen)
+	if outcome, _ := p.resolve(1, dialResult{connid: 11}); outcome != resolveUnknown {
+		t.Errorf("expect an unknown dial once removed; got %v", outcome)
 	}
 
-	go func() {
-		buf := make([]byte, 10)
-		_, err = conn.Read(buf)
-		if err != io.EOF {
-			t.Errorf("expected %v: got %v", io.EOF, err)
-		}
-	}()
+	// late DIAL_RSP after the dialer gave up
+	gen, _ = p.register(2, false)
+	if _, answered := p.cancel(2, gen); answered {
+		t.Error("expect the pending dial to be canceled")
+	}
+	if outcome, _ := p.resolve(2, dialResult{connid: 20}); outcome != resolveCanceled {
+		t.Errorf("expect a canceled dial; got %v", outcome)
+	}
+	p.remove(2, gen)
 
-	if err := conn.Close(); err != errConnCloseTimeout {
-		t.Errorf("expected %v but got %v", errConnCloseTimeout, err)
+	// DIAL_RSP winning the race with the cancellation
+	gen, _ = p.register(3, false)
+	if outcome, _ := p.resolve(3, dialResult{connid: 30}); outcome != resolveDelivered {
+		t.Errorf("expect a delivered dial; got %v", outcome)
+	}
+	if res, answered := p.cancel(3, gen); !answered || res.connid != 30 {
+		t.Errorf("expect the answer to win over the cancellation; got %v, %v", res, answered)
 	}
+	p.remove(3, gen)
+
+	// registrations of another generation are left alone
+	old, _ := p.register(4, false)
+	gen, _ = p.register(4, false)
+	p.cancel(4, old)
+	p.remove(4, old)
+	if outcome, _ := p.resolve(4, dialResult{connid: 40}); outcome != resolveDelivered {
+		t.Errorf("expect the newer registration to be answered; got %v", outcome)
+	}
+	p.remove(4, gen)
 
+	if n := p.count(); n != 0 {
+		t.Errorf("expect no dials left; got %d", n)
+	}
 }
 
-func TestCreateSingleUseGrpcTunnel_NoLeakOnFailure(t *testing.T) {
-	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
-
-	tunnel, err := CreateSingleUseGrpcTunnel(context.Background(), "127.0.0.1:12345", grpc.WithInsecure())
-	if tunnel != nil {
-		t.Fatal("expected nil tunnel when calling CreateSingleUseGrpcTunnel")
-	}
-	if err == nil {
-		t.Fatal("expected error when calling CreateSingleUseGrpcTunnel")
+func TestPendingDialsRace(t *testing.T) {
+	var p pendingDials
+	for i := int64(0); i < 100; i++ {
+		gen, resCh := p.register(i, false)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var outcome resolveOutcome
+		go func() {
+			defer wg.Done()
+			outcome, _ = p.resolve(i, dialResult{connid: i + 1})
+		}()
+		_, answered := p.cancel(i, gen)
+		wg.Wait()
+		// exactly one of the answer and the cancellation wins
+		if answered != (outcome == resolveDelivered) {
+			t.Fatalf("expect a single winner; got answered %v, outcome %v", answered, outcome)
+		}
+		select {
+		case <-resCh:
+			t.Fatal("expect the result to be taken by cancel or dropped")
+		default:
+		}
+		p.remove(i, gen)
 	}
 }
 
-func TestCreateSingleUseGrpcTunnelWithContext_NoLeakOnFailure(t *testing.T) {
-	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+// BenchmarkConnWrite measures the DATA packets sent by Write, serialized
+// like a gRPC stream does.
+func BenchmarkConnWrite(b *testing.B) {
+	c := &conn{stream: &marshalStream{buf: proto.NewBuffer(nil)}, connID: 1}
+	data := make([]byte, 4096)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
 
-	tunnel, err := CreateSingleUseGrpcTunnelWithContext(context.Background(), context.Background(), "127.0.0.1:12345", grpc.WithInsecure())
-	if tunnel != nil {
-		t.Fatal("expected nil tunnel when calling CreateSingleUseGrpcTunnelWithContext")
+// BenchmarkTunnelServeData measures the DATA packets received by the
+// tunnel and copied out of the connection.
+func BenchmarkTunnelServeData(b *testing.B) {
+	data := make([]byte, 4096)
+	stream := &dataStream{
+		pkt: &client.Packet{
+			Type:    client.PacketType_DATA,
+			Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: data}},
+		},
+		n: b.N,
 	}
-	if err == nil {
-		t.Fatal("expected error when calling CreateSingleUseGrpcTunnelWithContext")
+	tunnel := &grpcTunnel{
+		stream:             stream,
+		conns:              make(map[int64]*conn),
+		readTimeoutSeconds: 10,
+	}
+	epoch, err := tunnel.connIDs.bind(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := &conn{connID: 1, epoch: epoch, readCh: make(chan []byte, 64)}
+	tunnel.conns[1] = c
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	go tunnel.serve(context.Background(), &fakeConn{})
+	n, err := c.WriteTo(ioutil.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if want := int64(b.N * len(data)); n != want {
+		b.Errorf("expect %d bytes; got %d", want, n)
 	}
 }
 
-func TestDialAfterTunnelCancelled(t *testing.T) {
-	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+// marshalStream serializes the packets sent into a reused buffer, like a
+// gRPC stream does, and drops them.
+type marshalStream struct {
+	grpc.ClientStream
+	buf *proto.Buffer
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-	s, ps := pipeWithContext(ctx)
-	ts := testServer(ps, 100)
+func (s *marshalStream) Send(packet *client.Packet) error {
+	s.buf.Reset()
+	return s.buf.Marshal(packet)
+}
 
-	defer ps.Close()
-	defer s.Close()
+func (s *marshalStream) Recv() (*client.Packet, error) {
+	return nil, io.EOF
+}
 
-	tunnel := &grpcTunnel{
-		stream:      s,
-		pendingDial: make(map[int64]pendingDial),
-		conns:       make(map[int64]*conn),
-	}
+// dataStream receives the same DATA packet n times.
+type dataStream struct {
+	grpc.ClientStream
+	pkt *client.Packet
+	n   int
+}
 
-	go tunnel.serve(ctx, &fakeConn{})
-	go ts.serve()
+func (s *dataStream) Send(*client.Packet) error {
+	return nil
+}
 
-	_, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:80")
-	if err == nil {
-		t.Fatalf("expect err when dialing after tunnel closed")
+func (s *dataStream) Recv() (*client.Packet, error) {
+	if s.n == 0 {
+		return nil, io.EOF
 	}
-
-	// try to avoid race with deferred Close()
-	time.Sleep(time.Second)
+	s.n--
+	return s.pkt, nil
 }
 
-// TODO: Move to common testing library
+// The fakes below stay here, as this module cannot import the in-memory
+// proxy of sigs.k8s.io/apiserver-network-proxy/pkg/testing.
 
 // fakeStream implements ProxyService_ProxyClient
 type fakeStream struct {
@@ -315,6 +1654,13 @@ type fakeStream struct {
 	r    <-chan *client.Packet
 	w    chan<- *client.Packet
 	done <-chan struct{}
+
+	// rclosed and wclosed are closed by Close of the peer and of this
+	// stream, rather than w itself, so that Close doesn't race with a
+	// Send of the peer.
+	rclosed   <-chan struct{}
+	wclosed   chan struct{}
+	closeOnce sync.Once
 }
 
 type fakeConn struct {
@@ -326,6 +1672,50 @@ func (f *fakeConn) Close() error {
 
 var _ clientConn = &fakeConn{}
 
+// fakeStateConn is a clientConn with a connectivity state.
+type fakeStateConn struct {
+	fakeConn
+	mu      sync.Mutex
+	state   connectivity.State
+	changed chan struct{}
+}
+
+var _ connState = &fakeStateConn{}
+
+func newFakeStateConn(state connectivity.State) *fakeStateConn {
+	return &fakeStateConn{state: state, changed: make(chan struct{})}
+}
+
+func (f *fakeStateConn) GetState() connectivity.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *fakeStateConn) WaitForStateChange(ctx context.Context, sourceState connectivity.State) bool {
+	for {
+		f.mu.Lock()
+		state, changed := f.state, f.changed
+		f.mu.Unlock()
+		if state != sourceState {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (f *fakeStateConn) setState(state connectivity.State) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
 var _ client.ProxyService_ProxyClient = &fakeStream{}
 
 func pipe() (*fakeStream, *fakeStream) {
@@ -334,9 +1724,10 @@ func pipe() (*fakeStream, *fakeStream) {
 
 func pipeWithContext(context context.Context) (*fakeStream, *fakeStream) {
 	r, w := make(chan *client.Packet, 2), make(chan *client.Packet, 2)
+	rclosed, wclosed := make(chan struct{}), make(chan struct{})
 	s1, s2 := &fakeStream{done: context.Done()}, &fakeStream{done: context.Done()}
-	s1.r, s1.w = r, w
-	s2.r, s2.w = w, r
+	s1.r, s1.w, s1.rclosed, s1.wclosed = r, w, rclosed, wclosed
+	s2.r, s2.w, s2.rclosed, s2.wclosed = w, r, wclosed, rclosed
 	return s1, s2
 }
 
@@ -345,9 +1736,14 @@ func (s *fakeStream) Send(packet *client.Packet) error {
 	if packet == nil {
 		return nil
 	}
+	// Like a gRPC stream, which serializes the packet before Send returns,
+	// don't let the receiver share the sender's buffers.
+	packet = proto.Clone(packet).(*client.Packet)
 	select {
 	case <-s.done:
 		return errors.New("Send on cancelled stream")
+	case <-s.wclosed:
+		return errors.New("Send on closed stream")
 	case s.w <- packet:
 		return nil
 	}
@@ -360,13 +1756,22 @@ func (s *fakeStream) Recv() (*client.Packet, error) {
 	case pkt := <-s.r:
 		klog.V(4).InfoS("[DEBUG] recv", "packet", pkt)
 		return pkt, nil
+	case <-s.rclosed:
+		// Drain what the peer sent before closing, then report the end of
+		// the stream with a nil packet.
+		select {
+		case pkt := <-s.r:
+			return pkt, nil
+		default:
+			return nil, nil
+		}
 	case <-time.After(5 * time.Second):
 		return nil, errors.New("timeout recv")
 	}
 }
 
 func (s *fakeStream) Close() {
-	close(s.w)
+	s.closeOnce.Do(func() { close(s.wclosed) })
 }
 
 type proxyServer struct {
@@ -460,3 +1865,16 @@ func (s *proxyServer) handleData(pkt *client.Packet) *client.Packet {
 		},
 	}
 }
+
+// recordingProxyServer reports the Proxy streams it serves.
+type recordingProxyServer struct {
+	client.UnimplementedProxyServiceServer
+	name    string
+	streams chan<- string
+}
+
+func (s *recordingProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
+	s.streams <- s.name
+	<-stream.Context().Done()
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueTimeout = errors.New("timed out waiting for a free connection slot")
+	errTunnelClosed = errors.New("tunnel closed")
+)
+
+type tunnelOptionsKey struct{}
+
+// tunnelOptions configures a tunnel.
+type tunnelOptions struct {
+	maxConcurrent int
+	queueTimeout  time.Duration
+	metrics       Metrics
+}
+
+// TunnelOption configures a tunnel created with
+// CreateSingleUseGrpcTunnelWithContext.
+type TunnelOption func(*tunnelOptions)
+
+// WithConcurrencyLimit limits the dials in flight plus the open connections
+// of the tunnel to limit, so that a misbehaving caller can't overwhelm the
+// flow control of the tunnel's gRPC stream. Further dials wait in FIFO
+// order until a connection is closed, up to queueTimeout or until their
+// context is done. A queueTimeout of 0 or less only waits for the context.
+// A limit of 0 or less leaves the tunnel unlimited.
+func WithConcurrencyLimit(limit int, queueTimeout time.Duration) TunnelOption {
+	return func(o *tunnelOptions) {
+		o.maxConcurrent = limit
+		o.queueTimeout = queueTimeout
+	}
+}
+
+// WithTunnelOptions returns a context carrying opts. Pass it as createCtx
+// to CreateSingleUseGrpcTunnelWithContext to apply opts to the tunnel.
+func WithTunnelOptions(ctx context.Context, opts ...TunnelOption) context.Context {
+	prev, _ := ctx.Value(tunnelOptionsKey{}).([]TunnelOption)
+	return context.WithValue(ctx, tunnelOptionsKey{}, append(append([]TunnelOption(nil), prev...), opts...))
+}
+
+func newTunnelOptions(ctx context.Context) tunnelOptions {
+	var o tunnelOptions
+	opts, _ := ctx.Value(tunnelOptionsKey{}).([]TunnelOption)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// concurrencyLimiter hands out a limited number of slots, in the order
+// they were requested.
+type concurrencyLimiter struct {
+	limit        int
+	queueTimeout time.Duration
+
+	mu      sync.Mutex // mu protects active and waiters
+	active  int
+	waiters []chan struct{}
+}
+
+func newConcurrencyLimiter(limit int, queueTimeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: limit, queueTimeout: queueTimeout}
+}
+
+// acquire waits for a slot until ctx or done is done, or the queue timeout
+// passes.
+func (l *concurrencyLimiter) acquire(ctx context.Context, done <-chan struct{}) error {
+	l.mu.Lock()
+	if l.active < l.limit && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errQueueTimeout
+	case <-done:
+		err = errTunnelClosed
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return err
+		}
+	}
+	// The slot was handed over while giving up, pass it on.
+	l.releaseLocked()
+	return err
+}
+
+// release returns a slot, handing it over to the longest waiting caller.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *concurrencyLimiter) releaseLocked() {
+	if len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.active--
+}
@@ -17,9 +17,14 @@ limitations under the License.
 package client
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -30,20 +35,110 @@ import (
 // successful delivery of CLOSE_REQ.
 const CloseTimeout = 10 * time.Second
 
-var errConnCloseTimeout = errors.New("close timeout")
+var errConnCloseTimeout = &TunnelError{Reason: ReasonCloseTimeout}
+
+// readFromChunkSize is the size of the DATA payloads sent by ReadFrom,
+// matching the gRPC window size.
+const readFromChunkSize = 1 << 15
+
+var readFromBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, readFromChunkSize)
+		return &buf
+	},
+}
 
 // conn is an implementation of net.Conn, where the data is transported
 // over an established tunnel defined by a gRPC service ProxyService.
 type conn struct {
 	stream  client.ProxyService_ProxyClient
 	connID  int64
+	epoch   uint64
 	random  int64
+	addr    *tunnelAddr
 	readCh  chan []byte
 	closeCh chan string
 	rdata   []byte
+
+	// reset is set if the destination aborted the connection, before
+	// readCh is closed.
+	reset bool
+
+	// asyncClose makes Close return before the close completes, which
+	// then waits up to closeTimeout for CLOSE_RSP.
+	asyncClose   bool
+	closeTimeout time.Duration
+
+	// tunnelDone is closed once the tunnel no longer reads its stream, no
+	// CLOSE_RSP can be received after.
+	tunnelDone <-chan struct{}
+
+	// maxBuffered bounds the bytes received but not yet read, 0 leaves
+	// them unbounded. buffered is accessed atomically, drained is
+	// signaled whenever Read consumes buffered bytes.
+	maxBuffered int64
+	buffered    int64
+	drained     chan struct{}
+
+	// release returns the concurrency limiter slot held by the
+	// connection, nil if the tunnel is unlimited.
+	release     func()
+	releaseOnce sync.Once
+
+	// agentID and strategy are reported by the proxy server in the
+	// DIAL_RSP, empty if it does not report them.
+	agentID  string
+	strategy string
+
+	// idleWarning receives the time the agent closes the connection at
+	// for being idle. It is only sent to and closed by the goroutine
+	// serving the tunnel.
+	idleWarning chan time.Time
+}
+
+// RoutedConn is implemented by the connections returned by Tunnel.DialContext,
+// telling how the proxy server routed them, e.g. to log which agent served
+// each connection:
+//
+//	if rc, ok := conn.(client.RoutedConn); ok {
+//		klog.InfoS("Dialed", "agentID", rc.AgentID(), "strategy", rc.Strategy())
+//	}
+type RoutedConn interface {
+	net.Conn
+	// AgentID returns the ID of the agent serving the connection, empty
+	// if the proxy server did not report it.
+	AgentID() string
+	// Strategy returns the proxy strategy which selected the agent, empty
+	// if the proxy server did not report it.
+	Strategy() string
+}
+
+// IdleWarner is implemented by the connections returned by
+// Tunnel.DialContext, telling when the agent is about to close the
+// connection for being idle, so that long idle connections such as watches
+// can be refreshed beforehand rather than found dead on the next write:
+//
+//	if iw, ok := conn.(client.IdleWarner); ok {
+//		go func() {
+//			for closeAt := range iw.IdleWarning() {
+//				klog.InfoS("Refreshing idle connection", "closeAt", closeAt)
+//			}
+//		}()
+//	}
+type IdleWarner interface {
+	net.Conn
+	// IdleWarning returns a channel receiving the time the agent closes
+	// the connection at, unless data flows on it before. Agents only warn
+	// if they close idle connections, with proxy servers forwarding the
+	// warnings. The channel is closed once the connection is.
+	IdleWarning() <-chan time.Time
 }
 
 var _ net.Conn = &conn{}
+var _ RoutedConn = &conn{}
+var _ IdleWarner = &conn{}
+var _ io.WriterTo = &conn{}
+var _ io.ReaderFrom = &conn{}
 
 // Write sends the data thru the connection over proxy service
 func (c *conn) Write(data []byte) (n int, err error) {
@@ -57,11 +152,13 @@ func (c *conn) Write(data []byte) (n int, err error) {
 		},
 	}
 
-	klog.V(5).InfoS("[tracing] send req", "type", req.Type)
+	if klogV := klog.V(5); klogV.Enabled() {
+		klogV.InfoS("[tracing] send req", "type", req.Type)
+	}
 
 	err = c.stream.Send(req)
 	if err != nil {
-		return 0, err
+		return 0, newOpError("write", c.addr, &TunnelError{Reason: ReasonTunnelClosed, Err: err})
 	}
 	return len(data), err
 }
@@ -77,21 +174,187 @@ func (c *conn) Read(b []byte) (n int, err error) {
 	}
 
 	if data == nil {
-		return 0, io.EOF
+		return 0, c.readError()
 	}
 
 	if len(data) > len(b) {
 		copy(b, data[:len(b)])
 		c.rdata = data[len(b):]
+		c.consumed(len(b))
 		return len(b), nil
 	}
 
 	c.rdata = nil
 	copy(b, data)
+	c.consumed(len(data))
 
 	return len(data), nil
 }
 
+// WriteTo writes the data received on the connection to w until the
+// connection is closed, implementing io.WriterTo. io.Copy from the
+// connection hands the received payloads to w without copying them through
+// an intermediate buffer, and payloads queued up meanwhile are written at
+// once as net.Buffers, i.e. with writev if w is a network connection.
+func (c *conn) WriteTo(w io.Writer) (n int64, err error) {
+	// batch backs the net.Buffers of every write, as writing consumes
+	// them. Its payloads are dropped after each write, so that it doesn't
+	// retain them.
+	var batch net.Buffers
+	for {
+		bufs, closed := c.received(batch[:0])
+		batch = bufs
+		if len(bufs) > 0 {
+			written, err := bufs.WriteTo(w)
+			n += written
+			c.consumed(int(written))
+			if err != nil {
+				// Keep what was not written for subsequent reads.
+				if len(bufs) > 0 {
+					c.rdata = bytes.Join(bufs, nil)
+				}
+				return n, err
+			}
+		}
+		for i := range batch {
+			batch[i] = nil
+		}
+		if closed {
+			if c.reset {
+				return n, c.readError()
+			}
+			return n, nil
+		}
+	}
+}
+
+// readError returns the error reading from the connection once the remote
+// end closed it: io.EOF if the destination closed it gracefully, or an
+// error matching syscall.ECONNRESET if it reset the connection, as a read
+// from a direct connection would.
+func (c *conn) readError() error {
+	if c.reset {
+		return newOpError("read", c.addr, os.NewSyscallError("read", syscall.ECONNRESET))
+	}
+	return io.EOF
+}
+
+// received blocks until data is received on the connection and returns
+// all the data received so far appended to bufs, and whether the
+// connection was closed.
+func (c *conn) received(bufs net.Buffers) (net.Buffers, bool) {
+	if c.rdata != nil {
+		bufs = append(bufs, c.rdata)
+		c.rdata = nil
+	} else {
+		data := <-c.readCh
+		if data == nil {
+			return bufs, true
+		}
+		bufs = append(bufs, data)
+	}
+	for {
+		select {
+		case data := <-c.readCh:
+			if data == nil {
+				return bufs, true
+			}
+			bufs = append(bufs, data)
+		default:
+			return bufs, false
+		}
+	}
+}
+
+// bufferedReader is implemented by readers reporting how many bytes they
+// can return without blocking, e.g. bufio.Reader.
+type bufferedReader interface {
+	Buffered() int
+}
+
+// ReadFrom sends the data read from r until EOF, implementing
+// io.ReaderFrom. io.Copy to the connection reads straight into a pooled
+// buffer backing the DATA packets, rather than allocating a buffer per
+// copy. The buffer is reused once a packet is sent, as the stream
+// serializes packets on Send. If r reports buffered data, short reads are
+// batched into the same packet as long as r can return more without
+// blocking.
+func (c *conn) ReadFrom(r io.Reader) (n int64, err error) {
+	bufp := readFromBuffers.Get().(*[]byte)
+	defer readFromBuffers.Put(bufp)
+	buf := *bufp
+	br, _ := r.(bufferedReader)
+	for {
+		nr, rerr := r.Read(buf)
+		for br != nil && rerr == nil && nr < len(buf) && br.Buffered() > 0 {
+			var m int
+			m, rerr = r.Read(buf[nr:])
+			nr += m
+		}
+		if nr > 0 {
+			if _, err := c.Write(buf[:nr]); err != nil {
+				return n, err
+			}
+			n += int64(nr)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// hasBufferSpace reports whether another DATA packet can be delivered to
+// the connection without exceeding its buffered bytes limit.
+func (c *conn) hasBufferSpace() bool {
+	return c.maxBuffered == 0 || atomic.LoadInt64(&c.buffered) < c.maxBuffered
+}
+
+// consumed releases n buffered bytes and wakes up a delivery blocked on
+// the limit.
+func (c *conn) consumed(n int) {
+	if c.maxBuffered == 0 {
+		return
+	}
+	atomic.AddInt64(&c.buffered, -int64(n))
+	select {
+	case c.drained <- struct{}{}:
+	default:
+	}
+}
+
+// AgentID returns the ID of the agent serving the connection.
+func (c *conn) AgentID() string {
+	return c.agentID
+}
+
+// Strategy returns the proxy strategy which selected the agent.
+func (c *conn) Strategy() string {
+	return c.strategy
+}
+
+// IdleWarning implements IdleWarner.
+func (c *conn) IdleWarning() <-chan time.Time {
+	return c.idleWarning
+}
+
+// warnIdle delivers an idle warning, unless the previous one was not
+// received yet.
+func (c *conn) warnIdle(closeAt time.Time) {
+	select {
+	case c.idleWarning <- closeAt:
+	default:
+	}
+}
+
+func (c *conn) endIdleWarnings() {
+	if c.idleWarning != nil {
+		close(c.idleWarning)
+	}
+}
+
 func (c *conn) LocalAddr() net.Addr {
 	return nil
 }
@@ -113,9 +376,27 @@ func (c *conn) SetWriteDeadline(t time.Time) error {
 }
 
 // Close closes the connection. It also sends CLOSE_REQ packet over
-// proxy service to notify remote to drop the connection.
+// proxy service to notify remote to drop the connection. With
+// WithAsyncClose it returns right away and the close completes in the
+// background.
 func (c *conn) Close() error {
 	klog.V(4).Infoln("closing connection")
+	if c.asyncClose {
+		go func() {
+			if err := c.close(c.closeTimeout); err != nil {
+				klog.V(2).InfoS("Failed to close connection in the background", "connectionID", c.connID, "err", err)
+			}
+		}()
+		return nil
+	}
+	return c.close(CloseTimeout)
+}
+
+// close sends CLOSE_REQ, or DIAL_CLS if the dial was not answered, and
+// waits up to timeout for CLOSE_RSP.
+func (c *conn) close(timeout time.Duration) error {
+	defer c.releaseSlot()
+
 	var req *client.Packet
 	if c.connID != 0 {
 		req = &client.Packet{
@@ -141,17 +422,38 @@ func (c *conn) Close() error {
 	klog.V(5).InfoS("[tracing] send req", "type", req.Type)
 
 	if err := c.stream.Send(req); err != nil {
-		return err
+		return newOpError("close", c.addr, &TunnelError{Reason: ReasonTunnelClosed, Err: err})
 	}
 
 	select {
 	case errMsg := <-c.closeCh:
-		if errMsg != "" {
-			return errors.New(errMsg)
+		return c.closeResult(errMsg)
+	case <-c.tunnelDone:
+		// the CLOSE_RSP may have been the last packet of the tunnel
+		select {
+		case errMsg := <-c.closeCh:
+			return c.closeResult(errMsg)
+		default:
 		}
-		return nil
-	case <-time.After(CloseTimeout):
+		return newOpError("close", c.addr, &TunnelError{Reason: ReasonTunnelClosed})
+	case <-time.After(timeout):
 	}
 
-	return errConnCloseTimeout
+	return newOpError("close", c.addr, errConnCloseTimeout)
+}
+
+// closeResult returns the error of the CLOSE_RSP.
+func (c *conn) closeResult(errMsg string) error {
+	if errMsg != "" {
+		return newOpError("close", c.addr, &TunnelError{Reason: ReasonCloseFailed, Message: errMsg})
+	}
+	return nil
+}
+
+// releaseSlot returns the concurrency limiter slot of the connection once
+// it is closed.
+func (c *conn) releaseSlot() {
+	if c.release != nil {
+		c.releaseOnce.Do(c.release)
+	}
 }
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// connIDViolations counts the packets dropped by tunnels because of their
+// connection ID, accessed atomically.
+var connIDViolations uint64
+
+// ConnIDViolations returns the number of packets the tunnels of this
+// process dropped because the proxy server reassigned a connection ID in
+// use, or sent DATA or CLOSE_RSP for a connection ID it did not assign to
+// the tunnel or which was closed already. Such packets are the sign of a
+// faulty or malicious proxy server, and never reach another connection.
+func ConnIDViolations() uint64 {
+	return atomic.LoadUint64(&connIDViolations)
+}
+
+// connBinding is the connection a connection ID was assigned to.
+type connBinding struct {
+	// epoch tells apart the connections of a tunnel, it is copied to the
+	// conn of the dial
+	epoch  uint64
+	closed bool
+}
+
+// connIDs binds the connection IDs assigned by the proxy server in
+// DIAL_RSP packets to the connections of a tunnel. Bindings are kept once
+// closed, so that an ID is never reused. It is only accessed by the
+// goroutine serving the stream.
+type connIDs struct {
+	bindings map[int64]*connBinding
+	epoch    uint64
+}
+
+// bind assigns connID to a new connection, returning its epoch.
+func (c *connIDs) bind(connID int64) (uint64, error) {
+	if c.bindings == nil {
+		c.bindings = make(map[int64]*connBinding)
+	}
+	if _, ok := c.bindings[connID]; ok {
+		return 0, fmt.Errorf("connection ID %d assigned twice", connID)
+	}
+	c.epoch++
+	c.bindings[connID] = &connBinding{epoch: c.epoch}
+	return c.epoch, nil
+}
+
+// check verifies that connID is assigned to an open connection, conn if
+// not nil.
+func (c *connIDs) check(connID int64, conn *conn) error {
+	b, ok := c.bindings[connID]
+	if !ok {
+		return fmt.Errorf("connection ID %d was not assigned", connID)
+	}
+	if b.closed {
+		return fmt.Errorf("connection %d is closed", connID)
+	}
+	if conn != nil && conn.epoch != b.epoch {
+		return fmt.Errorf("connection %d of epoch %d received the packets of epoch %d", connID, conn.epoch, b.epoch)
+	}
+	return nil
+}
+
+// close marks the connection connID is assigned to as closed.
+func (c *connIDs) close(connID int64) {
+	if b, ok := c.bindings[connID]; ok {
+		b.closed = true
+	}
+}
+
+// isClosed reports whether connID is assigned to a closed connection.
+func (c *connIDs) isClosed(connID int64) bool {
+	b, ok := c.bindings[connID]
+	return ok && b.closed
+}
+
+// connIDViolation records a packet dropped because of its connection ID.
+func (t *grpcTunnel) connIDViolation(pkt *client.Packet, connID int64, err error) {
+	atomic.AddUint64(&connIDViolations, 1)
+	klog.ErrorS(err, "Dropping packet of the proxy server with an invalid connection ID", "type", pkt.Type)
+	if t.metrics != nil {
+		reason := DropInvalidConnectionID
+		if pkt.Type != client.PacketType_DIAL_RSP && t.connIDs.isClosed(connID) {
+			reason = DropClosedConnection
+		}
+		t.metrics.PacketDropped(pkt.Type, reason)
+	}
+}
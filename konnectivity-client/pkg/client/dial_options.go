@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// DefaultReadQueueLength is the number of DATA packets a connection
+// buffers before the tunnel stops delivering to it.
+const DefaultReadQueueLength = 10
+
+type dialOptionsKey struct{}
+
+// dialOptions configures the dial and the buffering of a connection.
+type dialOptions struct {
+	readQueueLength  int
+	maxBufferedBytes int64
+	hostname         string
+	candidates       []string
+	priority         client.Priority
+	retry            *DialRetryPolicy
+	asyncClose       bool
+	closeTimeout     time.Duration
+}
+
+// DialOption configures a connection dialed with DialContext.
+type DialOption func(*dialOptions)
+
+// WithReadQueueLength sets the number of received DATA packets buffered
+// for the connection until they are consumed by Read. Latency sensitive
+// callers can use a short queue, bulk transfers a longer one. Values
+// lower than 1 are ignored.
+func WithReadQueueLength(n int) DialOption {
+	return func(o *dialOptions) {
+		if n > 0 {
+			o.readQueueLength = n
+		}
+	}
+}
+
+// WithMaxBufferedBytes bounds the number of received bytes buffered for
+// the connection until they are consumed by Read, regardless of the read
+// queue length. 0, the default, leaves the buffered bytes unbounded.
+//
+// Delivery to a connection whose buffer is full blocks the whole tunnel
+// and is subject to the same read timeout as a full read queue.
+func WithMaxBufferedBytes(n int64) DialOption {
+	return func(o *dialOptions) {
+		if n >= 0 {
+			o.maxBufferedBytes = n
+		}
+	}
+}
+
+// WithDestinationHostname sets the host name the dialed address was
+// resolved from, for callers resolving names before dialing. The name is
+// sent along with the address, so that agent policies and the logs of the
+// proxy server and the agent can refer to it. Only the address is dialed.
+func WithDestinationHostname(hostname string) DialOption {
+	return func(o *dialOptions) {
+		o.hostname = hostname
+	}
+}
+
+// WithCandidates sets further ip:port addresses of the destination, e.g.
+// the addresses of the other address family the destination hostname
+// resolved to. Agents race them with the dialed address using Happy
+// Eyeballs and use the first connection established; agents without
+// Happy Eyeballs support dial the address only.
+func WithCandidates(addrs ...string) DialOption {
+	return func(o *dialOptions) {
+		o.candidates = append(o.candidates, addrs...)
+	}
+}
+
+// WithPriority sets how latency sensitive the traffic of the connection
+// is, e.g. Priority_PRIORITY_HIGH for exec and attach sessions and
+// Priority_PRIORITY_LOW for bulk transfers. Proxy servers scheduling by
+// priority send the data of higher priority connections first when the
+// connection to the agent is congested.
+func WithPriority(priority client.Priority) DialOption {
+	return func(o *dialOptions) {
+		o.priority = priority
+	}
+}
+
+// WithAsyncClose makes Close return right away, instead of blocking until
+// the proxy server confirms the close or CloseTimeout passes. The close
+// completes in the background, waiting up to timeout for the confirmation,
+// and failures are only logged. A timeout of 0 or less waits CloseTimeout.
+func WithAsyncClose(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.asyncClose = true
+		if timeout > 0 {
+			o.closeTimeout = timeout
+		}
+	}
+}
+
+// WithDialOptions returns a context carrying opts, which DialContext
+// applies to the connection it dials.
+func WithDialOptions(ctx context.Context, opts ...DialOption) context.Context {
+	return context.WithValue(ctx, dialOptionsKey{}, append(dialOptionsFrom(ctx), opts...))
+}
+
+func dialOptionsFrom(ctx context.Context) []DialOption {
+	opts, _ := ctx.Value(dialOptionsKey{}).([]DialOption)
+	// Copy, so that contexts derived from the same parent don't share
+	// the backing array.
+	return append([]DialOption(nil), opts...)
+}
+
+func newDialOptions(ctx context.Context) dialOptions {
+	o := dialOptions{readQueueLength: DefaultReadQueueLength, closeTimeout: CloseTimeout}
+	for _, opt := range dialOptionsFrom(ctx) {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// Defaults of DialRetryPolicy.
+const (
+	DefaultDialRetryInitialBackoff = 100 * time.Millisecond
+	DefaultDialRetryMaxBackoff     = 5 * time.Second
+	DefaultDialRetryMultiplier     = 2
+)
+
+// DialRetryPolicy configures the retries of dials failing because the
+// proxy server has no agent available, e.g. while the cluster bootstraps,
+// or all its agents reached their connection capacity. Other failures are
+// not retried.
+type DialRetryPolicy struct {
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each retry.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it, so that
+	// many clients don't retry in lockstep. 0 disables it.
+	Jitter float64
+}
+
+// WithDialRetry retries the dial with exponential backoff while the proxy
+// server has no agent available or all its agents are saturated, until
+// the context of the dial is done.
+// A retry that would start after the deadline of the context isn't made.
+// Zero fields of policy take their defaults.
+//
+// The retries reuse the tunnel, which requires a proxy server reporting
+// the no agent failure with DIAL_ERROR_NO_AGENT. Against older servers
+// the dial fails on the first attempt.
+func WithDialRetry(policy DialRetryPolicy) DialOption {
+	return func(o *dialOptions) {
+		if policy.InitialBackoff <= 0 {
+			policy.InitialBackoff = DefaultDialRetryInitialBackoff
+		}
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = DefaultDialRetryMaxBackoff
+		}
+		if policy.Multiplier < 1 {
+			policy.Multiplier = DefaultDialRetryMultiplier
+		}
+		o.retry = &policy
+	}
+}
+
+// dialBackoff computes the delays between the retries of a dial.
+type dialBackoff struct {
+	policy DialRetryPolicy
+	delay  time.Duration
+}
+
+func newDialBackoff(policy DialRetryPolicy) *dialBackoff {
+	return &dialBackoff{policy: policy, delay: policy.InitialBackoff}
+}
+
+// next returns the delay before the next retry.
+func (b *dialBackoff) next() time.Duration {
+	delay := b.delay
+	b.delay = time.Duration(float64(b.delay) * b.policy.Multiplier)
+	if b.delay > b.policy.MaxBackoff {
+		b.delay = b.policy.MaxBackoff
+	}
+	if b.policy.Jitter > 0 {
+		delay += time.Duration(b.policy.Jitter * float64(delay) * (2*rand.Float64() - 1)) /* #nosec G404 */
+	}
+	return delay
+}
+
+// isAgentUnavailable reports whether err is a dial failure because the
+// proxy server had no agent available, or all its agents were saturated.
+func isAgentUnavailable(err error) bool {
+	var tunnelErr *TunnelError
+	return errors.As(err, &tunnelErr) && (tunnelErr.Reason == ReasonNoAgent || tunnelErr.Reason == ReasonAgentsSaturated)
+}
+
+// retriableDialErrorCode reports whether a dial failed with code may be
+// retried on the same stream.
+func retriableDialErrorCode(code client.DialErrorCode) bool {
+	return code == client.DialErrorCode_DIAL_ERROR_NO_AGENT || code == client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED
+}
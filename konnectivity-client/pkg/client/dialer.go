@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Dialer dials connections through the proxy server at Address, each over
+// a single-use tunnel of its own. Its DialContext has the signature of
+// net.Dialer's, to be plugged into http.Transport, gRPC or database
+// drivers:
+//
+//	d := &client.Dialer{Address: "konnectivity-server:8090", DialOptions: opts}
+//	httpClient := &http.Client{Transport: d.HTTPTransport(nil)}
+//	resp, err := httpClient.Get("https://10.0.0.1:10250/healthz")
+type Dialer struct {
+	// Address is the gRPC address of the proxy server. Targets resolving
+	// to several replicas, like StaticTarget or "dns:///" ones, spread
+	// the tunnels over them with LoadBalancing.
+	Address string
+	// LoadBalancing is how the tunnels are spread over the replicas
+	// Address resolves to. Empty uses gRPC's default, PickFirst.
+	LoadBalancing LoadBalancingPolicy
+	// DialOptions are the options of the gRPC connections to the proxy
+	// server, e.g. its transport credentials.
+	DialOptions []grpc.DialOption
+	// TunnelOptions apply to each tunnel, e.g. WithConcurrencyLimit.
+	TunnelOptions []TunnelOption
+	// Timeout bounds establishing the tunnel and dialing through it, on
+	// top of the deadline of the context. 0 leaves it unbounded.
+	Timeout time.Duration
+
+	// newTunnel creates the tunnels, CreateSingleUseGrpcTunnelWithContext
+	// if nil.
+	newTunnel func(createCtx, tunnelCtx context.Context, address string, opts ...grpc.DialOption) (Tunnel, error)
+}
+
+// DialContext connects to address on network through a new tunnel. The
+// tunnel is closed with the connection. Dial options, metadata and the
+// like set on ctx with WithDialOptions, WithDialMetadata and so on apply
+// to the dial.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	newTunnel := d.newTunnel
+	if newTunnel == nil {
+		newTunnel = CreateSingleUseGrpcTunnelWithContext
+	}
+	// The tunnel outlives ctx, it serves the connection until closed.
+	tunnelCtx, cancelTunnel := context.WithCancel(context.Background())
+	dialOptions := d.DialOptions
+	if d.LoadBalancing != "" {
+		dialOptions = append([]grpc.DialOption{WithLoadBalancing(d.LoadBalancing)}, dialOptions...)
+	}
+	tunnel, err := newTunnel(WithTunnelOptions(ctx, d.TunnelOptions...), tunnelCtx, d.Address, dialOptions...)
+	if err != nil {
+		cancelTunnel()
+		return nil, newOpError("dial", &tunnelAddr{network: network, address: address}, &TunnelError{Reason: ReasonTunnelClosed, Err: err})
+	}
+	conn, err := tunnel.DialContext(ctx, network, address)
+	if err != nil {
+		cancelTunnel()
+		return nil, err
+	}
+	go func() {
+		<-tunnel.Done()
+		cancelTunnel()
+	}()
+	return conn, nil
+}
+
+// Dial connects to address on network through a new tunnel.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// HTTPTransport returns an *http.Transport dialing through the tunnel, with
+// the TLS configuration tlsConfig for https URLs. A nil tlsConfig verifies
+// the destinations with the system roots. Environment proxies are ignored,
+// the tunnel being the proxy, and idle connections are pooled like by
+// http.DefaultTransport, each keeping its tunnel open.
+func (d *Dialer) HTTPTransport(tlsConfig *tls.Config) *http.Transport {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return &http.Transport{
+		DialContext:           d.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// Reasons a tunnel drops a packet received from the proxy server, passed
+// to Metrics.PacketDropped.
+const (
+	// DropUnknownDial is the reason of DIAL_RSP and DIAL_CLS packets for
+	// dials the tunnel is not waiting for.
+	DropUnknownDial = "unknown_dial"
+	// DropCanceledDial is the reason of DIAL_RSP packets received after
+	// the caller gave up the dial.
+	DropCanceledDial = "canceled_dial"
+	// DropDuplicateDial is the reason of DIAL_RSP and DIAL_CLS packets
+	// for dials answered already.
+	DropDuplicateDial = "duplicate_dial"
+	// DropUnknownConnection is the reason of DATA and CLOSE_RSP packets
+	// for connections the tunnel doesn't serve.
+	DropUnknownConnection = "unknown_connection"
+	// DropClosedConnection is the reason of DATA and CLOSE_RSP packets
+	// for connections which were closed already.
+	DropClosedConnection = "closed_connection"
+	// DropInvalidConnectionID is the reason of packets whose connection
+	// ID the proxy server did not assign to the tunnel, or reassigned.
+	DropInvalidConnectionID = "invalid_connection_id"
+	// DropUnhandledType is the reason of packets of a type tunnels don't
+	// handle.
+	DropUnhandledType = "unhandled_type"
+)
+
+// Metrics receives the events of tunnels, for callers to export them with
+// the metrics library of their choice. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// PacketDropped is called for each packet received from the proxy
+	// server that the tunnel dropped, with the reason it was dropped.
+	PacketDropped(packetType client.PacketType, reason string)
+}
+
+// WithMetrics reports the events of the tunnel to metrics.
+func WithMetrics(metrics Metrics) TunnelOption {
+	return func(o *tunnelOptions) {
+		o.metrics = metrics
+	}
+}
+
+const (
+	// dropLogBurst is the number of warnings about dropped packets
+	// logged per dropLogInterval, further warnings are suppressed and
+	// counted.
+	dropLogBurst    = 10
+	dropLogInterval = time.Minute
+)
+
+// dropLog is the budget of warnings about dropped packets shared by the
+// tunnels of the process, so that a faulty proxy server can't flood the
+// log.
+var dropLog = &logBudget{burst: dropLogBurst, interval: dropLogInterval}
+
+// logBudget allows burst log lines per interval.
+type logBudget struct {
+	burst    int
+	interval time.Duration
+
+	mu         sync.Mutex // mu protects the following
+	start      time.Time
+	logged     int
+	suppressed int
+}
+
+// allow reports whether a line may be logged at now and, if so, the
+// number of lines suppressed since the last line logged.
+func (b *logBudget) allow(now time.Time) (bool, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.start) >= b.interval {
+		b.start = now
+		b.logged = 0
+	}
+	if b.logged >= b.burst {
+		b.suppressed++
+		return false, 0
+	}
+	b.logged++
+	suppressed := b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
+
+// dropPacket records that pkt of connection connID, or of dial dialID,
+// was dropped for reason.
+func (t *grpcTunnel) dropPacket(pkt *client.Packet, reason string, connID, dialID int64) {
+	if t.metrics != nil {
+		t.metrics.PacketDropped(pkt.Type, reason)
+	}
+	if ok, suppressed := dropLog.allow(time.Now()); ok {
+		klog.Warningf("Dropped %v packet of the proxy server: reason=%s connectionID=%d dialID=%d suppressedWarnings=%d", pkt.Type, reason, connID, dialID, suppressed)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"net"
+)
+
+// TunnelErrorReason classifies a TunnelError.
+type TunnelErrorReason string
+
+const (
+	// ReasonDialFailed means the remote end reported an error for the dial.
+	ReasonDialFailed TunnelErrorReason = "dial failed"
+	// ReasonNoAgent means the proxy server had no agent to serve the dial.
+	ReasonNoAgent TunnelErrorReason = "no agent available"
+	// ReasonQuarantined means the agent quarantined the destination after
+	// repeated failed dials and failed the dial without attempting it.
+	ReasonQuarantined TunnelErrorReason = "destination quarantined"
+	// ReasonAgentsSaturated means every agent able to serve the dial
+	// reached the concurrent connection capacity it advertised.
+	ReasonAgentsSaturated TunnelErrorReason = "agents saturated"
+	// ReasonDialTimeout means no dial response was received in time.
+	ReasonDialTimeout TunnelErrorReason = "dial timeout"
+	// ReasonDialCanceled means the caller canceled the dial.
+	ReasonDialCanceled TunnelErrorReason = "dial canceled"
+	// ReasonDialClosed means the proxy server abandoned the pending dial (DIAL_CLS).
+	ReasonDialClosed TunnelErrorReason = "dial closed"
+	// ReasonTunnelClosed means the underlying gRPC stream is no longer usable.
+	ReasonTunnelClosed TunnelErrorReason = "tunnel closed"
+	// ReasonCloseTimeout means no CLOSE_RSP was received in time.
+	ReasonCloseTimeout TunnelErrorReason = "close timeout"
+	// ReasonCloseFailed means the remote end reported an error closing the connection.
+	ReasonCloseFailed TunnelErrorReason = "close failed"
+	// ReasonConcurrencyLimit means the dial gave up waiting for the
+	// concurrency limit of the tunnel, see WithConcurrencyLimit.
+	ReasonConcurrencyLimit TunnelErrorReason = "concurrency limit reached"
+)
+
+// TunnelError is the underlying error of every *net.OpError returned by a
+// Tunnel or by connections dialed through it. It implements net.Error so
+// that Timeout() and Temporary() behave as they would for a direct
+// connection.
+type TunnelError struct {
+	Reason TunnelErrorReason
+	// Message holds the error reported by the remote end, if any.
+	Message string
+	// Err is the local cause, if any.
+	Err error
+}
+
+var _ net.Error = &TunnelError{}
+
+func (e *TunnelError) Error() string {
+	switch {
+	case e.Message != "":
+		return string(e.Reason) + ": " + e.Message
+	case e.Err != nil:
+		return string(e.Reason) + ": " + e.Err.Error()
+	}
+	return string(e.Reason)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the failure was caused by a deadline expiring.
+func (e *TunnelError) Timeout() bool {
+	return e.Reason == ReasonDialTimeout || e.Reason == ReasonCloseTimeout || e.Reason == ReasonConcurrencyLimit
+}
+
+// Temporary reports whether retrying the operation may succeed.
+func (e *TunnelError) Temporary() bool {
+	return e.Reason == ReasonDialTimeout || e.Reason == ReasonDialClosed || e.Reason == ReasonNoAgent || e.Reason == ReasonAgentsSaturated || e.Reason == ReasonConcurrencyLimit || e.Reason == ReasonQuarantined
+}
+
+// tunnelAddr is the net.Addr of a destination reached through the tunnel.
+type tunnelAddr struct {
+	network string
+	address string
+}
+
+func (a *tunnelAddr) Network() string { return a.network }
+func (a *tunnelAddr) String() string  { return a.address }
+
+func newOpError(op string, addr *tunnelAddr, err error) *net.OpError {
+	opErr := &net.OpError{Op: op, Err: err}
+	if addr != nil {
+		opErr.Net = addr.network
+		opErr.Addr = addr
+	}
+	return opErr
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// connState is the connectivity state of the gRPC connection of a tunnel,
+// implemented by *grpc.ClientConn.
+type connState interface {
+	GetState() connectivity.State
+	WaitForStateChange(ctx context.Context, sourceState connectivity.State) bool
+}
+
+// Done returns a channel closed once the tunnel stopped serving its gRPC
+// stream. Connections dialed through the tunnel are closed then, and
+// further dials fail.
+func (t *grpcTunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Ready reports whether the tunnel is serving its gRPC stream and its
+// gRPC connection is ready.
+func (t *grpcTunnel) Ready() bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	if cs, ok := t.clientConn.(connState); ok {
+		return cs.GetState() == connectivity.Ready
+	}
+	return true
+}
+
+// HealthCheck waits until the gRPC connection of the tunnel is ready. It
+// returns a TunnelError if the tunnel is closed or its connection failed,
+// and the error of ctx if it is done first.
+func (t *grpcTunnel) HealthCheck(ctx context.Context) error {
+	for {
+		select {
+		case <-t.done:
+			return &TunnelError{Reason: ReasonTunnelClosed}
+		default:
+		}
+		cs, ok := t.clientConn.(connState)
+		if !ok {
+			return nil
+		}
+		state := cs.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return &TunnelError{Reason: ReasonTunnelClosed, Message: "connection " + state.String()}
+		}
+		if !cs.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
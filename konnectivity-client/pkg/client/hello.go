@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// Features a peer may advertise in its HELLO.
+const (
+	// FeatureFlowControl means the peer acknowledges the DATA it
+	// received, so that the sender can bound the data in flight.
+	FeatureFlowControl = "flow-control"
+	// FeatureUDP means the peer relays UDP connections. Reserved, no
+	// build relays UDP yet.
+	FeatureUDP = "udp"
+	// FeatureCompression means the peer compresses DATA payloads.
+	FeatureCompression = "compression"
+	// FeatureResumption means the peer resumes its session after the
+	// stream broke.
+	FeatureResumption = "resumption"
+	// FeatureIdleWarning means the peer takes part in idle warnings:
+	// agents send IDLE_WARNING packets before they close idle connections,
+	// proxy servers forward them to the frontends, which handle them.
+	FeatureIdleWarning = "idle-warning"
+)
+
+// ProtocolVersion is the version of the protocol between the tunnel and
+// the proxy server spoken by this client.
+const ProtocolVersion = 1
+
+// features are the optional features advertised by this client. Proxy
+// servers only use features listed here with the tunnel.
+var features = []string{FeatureIdleWarning}
+
+// helloPacket returns the HELLO a tunnel sends when its stream is
+// established. Proxy servers predating HELLO ignore it.
+func helloPacket() *client.Packet {
+	return &client.Packet{
+		Type: client.PacketType_HELLO,
+		Payload: &client.Packet_Hello{
+			Hello: &client.Hello{
+				ProtocolVersion: ProtocolVersion,
+				Features:        features,
+			},
+		},
+	}
+}
+
+// FeatureReporter is implemented by the tunnels returned by
+// CreateSingleUseGrpcTunnel and CreateSingleUseGrpcTunnelWithContext,
+// telling the optional features the proxy server advertised:
+//
+//	if fr, ok := tunnel.(client.FeatureReporter); ok {
+//		features, _ := fr.ServerFeatures()
+//		klog.InfoS("Tunnel established", "serverFeatures", features)
+//	}
+type FeatureReporter interface {
+	// ServerFeatures returns the optional features the proxy server
+	// advertised when the tunnel was established. ok is false until the
+	// server answered, and with servers not advertising features.
+	ServerFeatures() (features []string, ok bool)
+}
+
+var _ FeatureReporter = &grpcTunnel{}
+
+// handleHello records the HELLO of the proxy server.
+func (t *grpcTunnel) handleHello(hello *client.Hello) {
+	klog.V(4).InfoS("Proxy server said hello", "protocolVersion", hello.ProtocolVersion, "features", hello.Features)
+	t.helloLock.Lock()
+	defer t.helloLock.Unlock()
+	t.serverHello = hello
+}
+
+// ServerFeatures returns the features the proxy server advertised in its
+// HELLO. ok is false until the server answered the HELLO of the tunnel,
+// and with servers predating HELLO.
+func (t *grpcTunnel) ServerFeatures() (features []string, ok bool) {
+	t.helloLock.Lock()
+	defer t.helloLock.Unlock()
+	if t.serverHello == nil {
+		return nil, false
+	}
+	return t.serverHello.Features, true
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"sync"
+)
+
+// dialState is the state of a dial registered with pendingDials.
+type dialState int
+
+const (
+	// dialPending dials wait for their DIAL_RSP or DIAL_CLS.
+	dialPending dialState = iota
+	// dialAnswered dials got their result, their dialer takes it.
+	dialAnswered
+	// dialCanceled dials were given up by their dialer before an answer.
+	dialCanceled
+)
+
+// resolveOutcome is what became of an answer to a dial.
+type resolveOutcome int
+
+const (
+	// resolveDelivered answers were delivered to the dialer.
+	resolveDelivered resolveOutcome = iota
+	// resolveUnknown answers are for dials the tunnel never registered,
+	// or which are done.
+	resolveUnknown
+	// resolveDuplicate answers are for dials answered already.
+	resolveDuplicate
+	// resolveCanceled answers came after the dialer gave up.
+	resolveCanceled
+)
+
+// pendingDial is a dial registered with pendingDials.
+type pendingDial struct {
+	// generation tells the registrations of a dial ID apart, so that a
+	// dialer only ever cancels or removes its own.
+	generation uint64
+	state      dialState
+	// resultCh receives the result of the dial. It is buffered, so that
+	// answering never waits for the dialer.
+	resultCh chan dialResult
+	// retriable is set if the dial is retried on this tunnel when no
+	// agent is available, so the tunnel must be kept open.
+	retriable bool
+}
+
+// pendingDials tracks the dials of a tunnel by dial ID, from their
+// DIAL_REQ until their dialer is done with them. Each dial goes from
+// pending to either answered or canceled, exactly once, so an answer and
+// a cancellation racing each other have a single winner. The zero value
+// is ready to use.
+type pendingDials struct {
+	mu         sync.Mutex
+	dials      map[int64]*pendingDial
+	generation uint64
+}
+
+// register adds a pending dial with ID random, replacing any dial
+// registered with the same ID. It returns the generation of the
+// registration and the channel its result is delivered to.
+func (p *pendingDials) register(random int64, retriable bool) (uint64, <-chan dialResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dials == nil {
+		p.dials = make(map[int64]*pendingDial)
+	}
+	p.generation++
+	d := &pendingDial{generation: p.generation, resultCh: make(chan dialResult, 1), retriable: retriable}
+	p.dials[random] = d
+	return d.generation, d.resultCh
+}
+
+// resolve delivers result to the pending dial with ID random. retriable
+// reports whether the dial is retried on the tunnel, if it was delivered.
+func (p *pendingDials) resolve(random int64, result dialResult) (outcome resolveOutcome, retriable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dials[random]
+	if !ok {
+		return resolveUnknown, false
+	}
+	switch d.state {
+	case dialAnswered:
+		return resolveDuplicate, false
+	case dialCanceled:
+		return resolveCanceled, false
+	}
+	d.state = dialAnswered
+	d.resultCh <- result
+	return resolveDelivered, d.retriable
+}
+
+// cancel gives up the dial with ID random of generation, unless it was
+// answered already. Then its result is returned for the dialer to use, as
+// the proxy server considers the dial done.
+func (p *pendingDials) cancel(random int64, generation uint64) (dialResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dials[random]
+	if !ok || d.generation != generation {
+		return dialResult{}, false
+	}
+	if d.state == dialAnswered {
+		select {
+		case result := <-d.resultCh:
+			return result, true
+		default:
+			// taken by the dialer already
+			return dialResult{}, false
+		}
+	}
+	d.state = dialCanceled
+	return dialResult{}, false
+}
+
+// remove forgets the dial with ID random of generation, once its dialer
+// is done with it. Later answers are unknown.
+func (p *pendingDials) remove(random int64, generation uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d, ok := p.dials[random]; ok && d.generation == generation {
+		delete(p.dials, random)
+	}
+}
+
+// count returns the number of dials registered.
+func (p *pendingDials) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.dials)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+)
+
+// StaticResolverScheme is the scheme of gRPC targets listing the addresses
+// of the proxy server replicas, separated by commas, e.g.
+// "konnectivity-static:///10.0.0.1:8090,10.0.0.2:8090". Other targets
+// resolving to several addresses work too, e.g. "dns:///konnectivity:8090"
+// or those of resolvers registered with gRPC.
+const StaticResolverScheme = "konnectivity-static"
+
+func init() {
+	resolver.Register(staticResolverBuilder{})
+}
+
+// StaticTarget returns the gRPC target resolving to addrs.
+func StaticTarget(addrs ...string) string {
+	return StaticResolverScheme + ":///" + strings.Join(addrs, ",")
+}
+
+// LoadBalancingPolicy is how the tunnels are spread over the proxy server
+// replicas a target resolves to.
+type LoadBalancingPolicy string
+
+const (
+	// PickFirst tunnels through the first replica the client connects
+	// to, trying them in order, and fails over to the next one when its
+	// connection breaks. This is gRPC's default.
+	PickFirst LoadBalancingPolicy = "pick_first"
+	// RoundRobin spreads the tunnels over all the reachable replicas.
+	RoundRobin LoadBalancingPolicy = "round_robin"
+)
+
+// WithLoadBalancing returns the gRPC dial option spreading the tunnels over
+// the proxy server replicas with policy, unless the resolver of the target
+// provides a service config of its own.
+func WithLoadBalancing(policy LoadBalancingPolicy) grpc.DialOption {
+	return grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, policy))
+}
+
+// staticResolverBuilder builds the resolvers of StaticResolverScheme
+// targets.
+type staticResolverBuilder struct{}
+
+func (staticResolverBuilder) Scheme() string {
+	return StaticResolverScheme
+}
+
+func (staticResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	addrs, err := parseStaticEndpoint(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	state := resolver.State{}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	cc.UpdateState(state)
+	return staticResolver{}, nil
+}
+
+// parseStaticEndpoint splits the endpoint of a StaticResolverScheme target
+// into its addresses.
+func parseStaticEndpoint(endpoint string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(endpoint, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s target lists no address", StaticResolverScheme)
+	}
+	return addrs, nil
+}
+
+// staticResolver has nothing to resolve again, its addresses never change.
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (staticResolver) Close() {}
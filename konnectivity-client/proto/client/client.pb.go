@@ -48,24 +48,54 @@ const (
 	PacketType_CLOSE_RSP PacketType = 3
 	PacketType_DATA      PacketType = 4
 	PacketType_DIAL_CLS  PacketType = 5
+	// NACK answers a packet of a type the receiver does not know, e.g. a
+	// packet type introduced after the receiver was built.
+	PacketType_NACK PacketType = 6
+	// CHECKPOINT carries the number of DATA payload bytes sent on a
+	// connection so far, so that the receiver can detect lost data.
+	PacketType_CHECKPOINT PacketType = 7
+	// RESUME opens a resumed agent session, telling the peer the last DATA
+	// received on each connection so that it sends the rest again.
+	PacketType_RESUME PacketType = 8
+	// ACK acknowledges the DATA received on a connection in order, or asks
+	// the peer to send again the DATA following a gap.
+	PacketType_ACK PacketType = 9
+	// HELLO advertises the protocol version and the features of its
+	// sender when a stream is established. The peer answers with its own.
+	PacketType_HELLO PacketType = 10
+	// IDLE_WARNING tells the frontend that the agent is about to close an
+	// idle connection, so that the client can refresh it beforehand.
+	PacketType_IDLE_WARNING PacketType = 11
 )
 
 var PacketType_name = map[int32]string{
-	0: "DIAL_REQ",
-	1: "DIAL_RSP",
-	2: "CLOSE_REQ",
-	3: "CLOSE_RSP",
-	4: "DATA",
-	5: "DIAL_CLS",
+	0:  "DIAL_REQ",
+	1:  "DIAL_RSP",
+	2:  "CLOSE_REQ",
+	3:  "CLOSE_RSP",
+	4:  "DATA",
+	5:  "DIAL_CLS",
+	6:  "NACK",
+	7:  "CHECKPOINT",
+	8:  "RESUME",
+	9:  "ACK",
+	10: "HELLO",
+	11: "IDLE_WARNING",
 }
 
 var PacketType_value = map[string]int32{
-	"DIAL_REQ":  0,
-	"DIAL_RSP":  1,
-	"CLOSE_REQ": 2,
-	"CLOSE_RSP": 3,
-	"DATA":      4,
-	"DIAL_CLS":  5,
+	"DIAL_REQ":     0,
+	"DIAL_RSP":     1,
+	"CLOSE_REQ":    2,
+	"CLOSE_RSP":    3,
+	"DATA":         4,
+	"DIAL_CLS":     5,
+	"NACK":         6,
+	"CHECKPOINT":   7,
+	"RESUME":       8,
+	"ACK":          9,
+	"HELLO":        10,
+	"IDLE_WARNING": 11,
 }
 
 func (x PacketType) String() string {
@@ -98,6 +128,119 @@ func (Error) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_fec4258d9ecd175d, []int{1}
 }
 
+type DialErrorCode int32
+
+const (
+	// the error is described by the error message only
+	DialErrorCode_DIAL_ERROR_UNSPECIFIED DialErrorCode = 0
+	// no agent is available to serve the dial. The frontend may retry the
+	// dial on the same stream once an agent connected.
+	DialErrorCode_DIAL_ERROR_NO_AGENT DialErrorCode = 1
+	// the agent quarantined the destination after repeated failed dials,
+	// and failed the dial without attempting it. Dials through other agents
+	// may succeed.
+	DialErrorCode_DIAL_ERROR_QUARANTINED DialErrorCode = 2
+	// every agent able to serve the dial reached the concurrent connection
+	// capacity it advertised. The frontend may retry the dial on the same
+	// stream once connections closed.
+	DialErrorCode_DIAL_ERROR_AGENTS_SATURATED DialErrorCode = 3
+)
+
+var DialErrorCode_name = map[int32]string{
+	0: "DIAL_ERROR_UNSPECIFIED",
+	1: "DIAL_ERROR_NO_AGENT",
+	2: "DIAL_ERROR_QUARANTINED",
+	3: "DIAL_ERROR_AGENTS_SATURATED",
+}
+
+var DialErrorCode_value = map[string]int32{
+	"DIAL_ERROR_UNSPECIFIED":      0,
+	"DIAL_ERROR_NO_AGENT":         1,
+	"DIAL_ERROR_QUARANTINED":      2,
+	"DIAL_ERROR_AGENTS_SATURATED": 3,
+}
+
+func (x DialErrorCode) String() string {
+	return proto.EnumName(DialErrorCode_name, int32(x))
+}
+
+func (DialErrorCode) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{2}
+}
+
+type CloseReason int32
+
+const (
+	// the reason is unknown, e.g. the agent predates close reasons
+	CloseReason_CLOSE_REASON_UNSPECIFIED CloseReason = 0
+	// the destination closed the connection gracefully (FIN)
+	CloseReason_CLOSE_REASON_EOF CloseReason = 1
+	// the destination aborted the connection (RST)
+	CloseReason_CLOSE_REASON_RESET CloseReason = 2
+	// the agent closed the connection after it was idle for too long
+	CloseReason_CLOSE_REASON_IDLE CloseReason = 3
+)
+
+var CloseReason_name = map[int32]string{
+	0: "CLOSE_REASON_UNSPECIFIED",
+	1: "CLOSE_REASON_EOF",
+	2: "CLOSE_REASON_RESET",
+	3: "CLOSE_REASON_IDLE",
+}
+
+var CloseReason_value = map[string]int32{
+	"CLOSE_REASON_UNSPECIFIED": 0,
+	"CLOSE_REASON_EOF":         1,
+	"CLOSE_REASON_RESET":       2,
+	"CLOSE_REASON_IDLE":        3,
+}
+
+func (x CloseReason) String() string {
+	return proto.EnumName(CloseReason_name, int32(x))
+}
+
+func (CloseReason) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{3}
+}
+
+// Priority hints how latency sensitive the traffic of a connection is.
+// Under load, proxy servers scheduling by priority send the DATA of
+// higher priority connections to the agent first.
+type Priority int32
+
+const (
+	// the default priority of the proxy server, medium
+	Priority_PRIORITY_UNSPECIFIED Priority = 0
+	// interactive sessions, e.g. exec and attach
+	Priority_PRIORITY_HIGH Priority = 1
+	// streaming, e.g. logs
+	Priority_PRIORITY_MEDIUM Priority = 2
+	// bulk transfers, e.g. cp
+	Priority_PRIORITY_LOW Priority = 3
+)
+
+var Priority_name = map[int32]string{
+	0: "PRIORITY_UNSPECIFIED",
+	1: "PRIORITY_HIGH",
+	2: "PRIORITY_MEDIUM",
+	3: "PRIORITY_LOW",
+}
+
+var Priority_value = map[string]int32{
+	"PRIORITY_UNSPECIFIED": 0,
+	"PRIORITY_HIGH":        1,
+	"PRIORITY_MEDIUM":      2,
+	"PRIORITY_LOW":         3,
+}
+
+func (x Priority) String() string {
+	return proto.EnumName(Priority_name, int32(x))
+}
+
+func (Priority) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{4}
+}
+
 type Packet struct {
 	Type PacketType `protobuf:"varint,1,opt,name=type,proto3,enum=PacketType" json:"type,omitempty"`
 	// Types that are valid to be assigned to Payload:
@@ -107,6 +250,12 @@ type Packet struct {
 	//	*Packet_CloseRequest
 	//	*Packet_CloseResponse
 	//	*Packet_CloseDial
+	//	*Packet_Nack
+	//	*Packet_Checkpoint
+	//	*Packet_Resume
+	//	*Packet_Ack
+	//	*Packet_Hello
+	//	*Packet_IdleWarning
 	Payload              isPacket_Payload `protobuf_oneof:"payload"`
 	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
 	XXX_unrecognized     []byte           `json:"-"`
@@ -173,6 +322,30 @@ type Packet_CloseDial struct {
 	CloseDial *CloseDial `protobuf:"bytes,7,opt,name=closeDial,proto3,oneof"`
 }
 
+type Packet_Nack struct {
+	Nack *Nack `protobuf:"bytes,8,opt,name=nack,proto3,oneof"`
+}
+
+type Packet_Checkpoint struct {
+	Checkpoint *Checkpoint `protobuf:"bytes,9,opt,name=checkpoint,proto3,oneof"`
+}
+
+type Packet_Resume struct {
+	Resume *Resume `protobuf:"bytes,10,opt,name=resume,proto3,oneof"`
+}
+
+type Packet_Ack struct {
+	Ack *Ack `protobuf:"bytes,11,opt,name=ack,proto3,oneof"`
+}
+
+type Packet_Hello struct {
+	Hello *Hello `protobuf:"bytes,12,opt,name=hello,proto3,oneof"`
+}
+
+type Packet_IdleWarning struct {
+	IdleWarning *IdleWarning `protobuf:"bytes,13,opt,name=idleWarning,proto3,oneof"`
+}
+
 func (*Packet_DialRequest) isPacket_Payload() {}
 
 func (*Packet_DialResponse) isPacket_Payload() {}
@@ -185,6 +358,18 @@ func (*Packet_CloseResponse) isPacket_Payload() {}
 
 func (*Packet_CloseDial) isPacket_Payload() {}
 
+func (*Packet_Nack) isPacket_Payload() {}
+
+func (*Packet_Checkpoint) isPacket_Payload() {}
+
+func (*Packet_Resume) isPacket_Payload() {}
+
+func (*Packet_Ack) isPacket_Payload() {}
+
+func (*Packet_Hello) isPacket_Payload() {}
+
+func (*Packet_IdleWarning) isPacket_Payload() {}
+
 func (m *Packet) GetPayload() isPacket_Payload {
 	if m != nil {
 		return m.Payload
@@ -234,6 +419,48 @@ func (m *Packet) GetCloseDial() *CloseDial {
 	return nil
 }
 
+func (m *Packet) GetNack() *Nack {
+	if x, ok := m.GetPayload().(*Packet_Nack); ok {
+		return x.Nack
+	}
+	return nil
+}
+
+func (m *Packet) GetCheckpoint() *Checkpoint {
+	if x, ok := m.GetPayload().(*Packet_Checkpoint); ok {
+		return x.Checkpoint
+	}
+	return nil
+}
+
+func (m *Packet) GetResume() *Resume {
+	if x, ok := m.GetPayload().(*Packet_Resume); ok {
+		return x.Resume
+	}
+	return nil
+}
+
+func (m *Packet) GetAck() *Ack {
+	if x, ok := m.GetPayload().(*Packet_Ack); ok {
+		return x.Ack
+	}
+	return nil
+}
+
+func (m *Packet) GetHello() *Hello {
+	if x, ok := m.GetPayload().(*Packet_Hello); ok {
+		return x.Hello
+	}
+	return nil
+}
+
+func (m *Packet) GetIdleWarning() *IdleWarning {
+	if x, ok := m.GetPayload().(*Packet_IdleWarning); ok {
+		return x.IdleWarning
+	}
+	return nil
+}
+
 // XXX_OneofWrappers is for the internal use of the proto package.
 func (*Packet) XXX_OneofWrappers() []interface{} {
 	return []interface{}{
@@ -243,6 +470,12 @@ func (*Packet) XXX_OneofWrappers() []interface{} {
 		(*Packet_CloseRequest)(nil),
 		(*Packet_CloseResponse)(nil),
 		(*Packet_CloseDial)(nil),
+		(*Packet_Nack)(nil),
+		(*Packet_Checkpoint)(nil),
+		(*Packet_Resume)(nil),
+		(*Packet_Ack)(nil),
+		(*Packet_Hello)(nil),
+		(*Packet_IdleWarning)(nil),
 	}
 }
 
@@ -252,10 +485,36 @@ type DialRequest struct {
 	// node:port
 	Address string `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
 	// random id for client, maybe should be longer
-	Random               int64    `protobuf:"varint,3,opt,name=random,proto3" json:"random,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Random int64 `protobuf:"varint,3,opt,name=random,proto3" json:"random,omitempty"`
+	// compression algorithm requested for the DATA payloads of this
+	// connection, e.g. gzip. Empty means no compression.
+	Compression string `protobuf:"bytes,4,opt,name=compression,proto3" json:"compression,omitempty"`
+	// metadata is an opaque key/value map describing the origin of the
+	// dial, e.g. a request UID. Keys prefixed with "konnectivity.io/" are
+	// reserved and attested by the proxy server, which overwrites them.
+	Metadata map[string]string `protobuf:"bytes,5,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// hostname is the destination host name the client resolved address
+	// from, if any. It is informational: address is dialed, but policies
+	// and logs can refer to the original name.
+	Hostname string `protobuf:"bytes,6,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// candidates are further ip:port addresses of the destination, e.g.
+	// the other address family hostname resolved to. Agents supporting
+	// Happy Eyeballs race them with address; others dial address only.
+	Candidates []string `protobuf:"bytes,7,rep,name=candidates,proto3" json:"candidates,omitempty"`
+	// priority of the traffic of the connection
+	Priority Priority `protobuf:"varint,8,opt,name=priority,proto3,enum=Priority" json:"priority,omitempty"`
+	// checkpointInterval, in milliseconds, asks the agent to follow the
+	// DATA it sends on the connection with a CHECKPOINT at most that often.
+	// Zero means no checkpoints are requested.
+	CheckpointInterval int64 `protobuf:"varint,9,opt,name=checkpointInterval,proto3" json:"checkpointInterval,omitempty"`
+	// resume, if set, migrates a connection of another agent, which
+	// disconnected, to the agent dialing address: the agent keeps its
+	// connectID and counts the DATA of the connection from its byte
+	// offsets. Agents not advertising the migrate capability ignore it.
+	Resume               *ResumeConnection `protobuf:"bytes,10,opt,name=resume,proto3" json:"resume,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *DialRequest) Reset()         { *m = DialRequest{} }
@@ -304,13 +563,77 @@ func (m *DialRequest) GetRandom() int64 {
 	return 0
 }
 
+func (m *DialRequest) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *DialRequest) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *DialRequest) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *DialRequest) GetCandidates() []string {
+	if m != nil {
+		return m.Candidates
+	}
+	return nil
+}
+
+func (m *DialRequest) GetPriority() Priority {
+	if m != nil {
+		return m.Priority
+	}
+	return Priority_PRIORITY_UNSPECIFIED
+}
+
+func (m *DialRequest) GetCheckpointInterval() int64 {
+	if m != nil {
+		return m.CheckpointInterval
+	}
+	return 0
+}
+
+func (m *DialRequest) GetResume() *ResumeConnection {
+	if m != nil {
+		return m.Resume
+	}
+	return nil
+}
+
 type DialResponse struct {
 	// error failed reason; enum?
 	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
 	// connectID indicates the identifier of the connection
 	ConnectID int64 `protobuf:"varint,2,opt,name=connectID,proto3" json:"connectID,omitempty"`
 	// random copied from DialRequest
-	Random               int64    `protobuf:"varint,3,opt,name=random,proto3" json:"random,omitempty"`
+	Random int64 `protobuf:"varint,3,opt,name=random,proto3" json:"random,omitempty"`
+	// compression algorithm accepted for the DATA payloads of this
+	// connection. Empty means the request was declined.
+	Compression string `protobuf:"bytes,4,opt,name=compression,proto3" json:"compression,omitempty"`
+	// errorCode classifies error, if the server knows its cause.
+	ErrorCode DialErrorCode `protobuf:"varint,5,opt,name=errorCode,proto3,enum=DialErrorCode" json:"errorCode,omitempty"`
+	// agentID of the agent serving the connection, set by the proxy
+	// server for debugging the routing of dials.
+	AgentID string `protobuf:"bytes,6,opt,name=agentID,proto3" json:"agentID,omitempty"`
+	// strategy of the proxy server which selected the agent, e.g.
+	// "destHost". Dials relayed to a peer proxy server are reported as
+	// "peerRelay:" followed by the strategy of the peer.
+	Strategy string `protobuf:"bytes,7,opt,name=strategy,proto3" json:"strategy,omitempty"`
+	// resumed is set by agents which honored the resume of the
+	// DialRequest.
+	Resumed              bool     `protobuf:"varint,8,opt,name=resumed,proto3" json:"resumed,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -362,6 +685,41 @@ func (m *DialResponse) GetRandom() int64 {
 	return 0
 }
 
+func (m *DialResponse) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *DialResponse) GetErrorCode() DialErrorCode {
+	if m != nil {
+		return m.ErrorCode
+	}
+	return DialErrorCode_DIAL_ERROR_UNSPECIFIED
+}
+
+func (m *DialResponse) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *DialResponse) GetStrategy() string {
+	if m != nil {
+		return m.Strategy
+	}
+	return ""
+}
+
+func (m *DialResponse) GetResumed() bool {
+	if m != nil {
+		return m.Resumed
+	}
+	return false
+}
+
 type CloseRequest struct {
 	// connectID of the stream to close
 	ConnectID            int64    `protobuf:"varint,1,opt,name=connectID,proto3" json:"connectID,omitempty"`
@@ -406,10 +764,12 @@ type CloseResponse struct {
 	// error message
 	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
 	// connectID indicates the identifier of the connection
-	ConnectID            int64    `protobuf:"varint,2,opt,name=connectID,proto3" json:"connectID,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	ConnectID int64 `protobuf:"varint,2,opt,name=connectID,proto3" json:"connectID,omitempty"`
+	// reason tells how the destination closed the connection, if it did
+	Reason               CloseReason `protobuf:"varint,3,opt,name=reason,proto3,enum=CloseReason" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
 }
 
 func (m *CloseResponse) Reset()         { *m = CloseResponse{} }
@@ -451,6 +811,13 @@ func (m *CloseResponse) GetConnectID() int64 {
 	return 0
 }
 
+func (m *CloseResponse) GetReason() CloseReason {
+	if m != nil {
+		return m.Reason
+	}
+	return CloseReason_CLOSE_REASON_UNSPECIFIED
+}
+
 type CloseDial struct {
 	// random id of the DialRequest
 	Random               int64    `protobuf:"varint,1,opt,name=random,proto3" json:"random,omitempty"`
@@ -497,7 +864,14 @@ type Data struct {
 	// error message if error happens
 	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
 	// stream data
-	Data                 []byte   `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Data []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	// compressed is true if data is compressed with the algorithm
+	// negotiated at dial time
+	Compressed bool `protobuf:"varint,4,opt,name=compressed,proto3" json:"compressed,omitempty"`
+	// seq numbers the DATA of the connection in each direction from 1 on
+	// resumable agent sessions, and with agents and servers negotiating
+	// protocol version 2 or later. 0 means the DATA is not numbered.
+	Seq                  int64    `protobuf:"varint,5,opt,name=seq,proto3" json:"seq,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -549,16 +923,409 @@ func (m *Data) GetData() []byte {
 	return nil
 }
 
+func (m *Data) GetCompressed() bool {
+	if m != nil {
+		return m.Compressed
+	}
+	return false
+}
+
+func (m *Data) GetSeq() int64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+type Nack struct {
+	// type of the packet that was not understood
+	Type PacketType `protobuf:"varint,1,opt,name=type,proto3,enum=PacketType" json:"type,omitempty"`
+	// capabilities the sender of the NACK supports, so that the peer can
+	// fall back to features both sides understand
+	Capabilities         []string `protobuf:"bytes,2,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Nack) Reset()         { *m = Nack{} }
+func (m *Nack) String() string { return proto.CompactTextString(m) }
+func (*Nack) ProtoMessage()    {}
+func (*Nack) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{7}
+}
+
+func (m *Nack) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Nack.Unmarshal(m, b)
+}
+func (m *Nack) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Nack.Marshal(b, m, deterministic)
+}
+func (m *Nack) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Nack.Merge(m, src)
+}
+func (m *Nack) XXX_Size() int {
+	return xxx_messageInfo_Nack.Size(m)
+}
+func (m *Nack) XXX_DiscardUnknown() {
+	xxx_messageInfo_Nack.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Nack proto.InternalMessageInfo
+
+func (m *Nack) GetType() PacketType {
+	if m != nil {
+		return m.Type
+	}
+	return PacketType_DIAL_REQ
+}
+
+func (m *Nack) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+type Checkpoint struct {
+	// connectID of the connection
+	ConnectID int64 `protobuf:"varint,1,opt,name=connectID,proto3" json:"connectID,omitempty"`
+	// bytes is the number of uncompressed DATA payload bytes the sender
+	// sent on the connection before this packet
+	Bytes                int64    `protobuf:"varint,2,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Checkpoint) Reset()         { *m = Checkpoint{} }
+func (m *Checkpoint) String() string { return proto.CompactTextString(m) }
+func (*Checkpoint) ProtoMessage()    {}
+func (*Checkpoint) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{8}
+}
+
+func (m *Checkpoint) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Checkpoint.Unmarshal(m, b)
+}
+func (m *Checkpoint) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Checkpoint.Marshal(b, m, deterministic)
+}
+func (m *Checkpoint) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Checkpoint.Merge(m, src)
+}
+func (m *Checkpoint) XXX_Size() int {
+	return xxx_messageInfo_Checkpoint.Size(m)
+}
+func (m *Checkpoint) XXX_DiscardUnknown() {
+	xxx_messageInfo_Checkpoint.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Checkpoint proto.InternalMessageInfo
+
+func (m *Checkpoint) GetConnectID() int64 {
+	if m != nil {
+		return m.ConnectID
+	}
+	return 0
+}
+
+func (m *Checkpoint) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+type Resume struct {
+	// connections known to the sender, with the last DATA it received
+	Connections          []*ResumeConnection `protobuf:"bytes,1,rep,name=connections,proto3" json:"connections,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *Resume) Reset()         { *m = Resume{} }
+func (m *Resume) String() string { return proto.CompactTextString(m) }
+func (*Resume) ProtoMessage()    {}
+func (*Resume) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{9}
+}
+
+func (m *Resume) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Resume.Unmarshal(m, b)
+}
+func (m *Resume) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Resume.Marshal(b, m, deterministic)
+}
+func (m *Resume) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Resume.Merge(m, src)
+}
+func (m *Resume) XXX_Size() int {
+	return xxx_messageInfo_Resume.Size(m)
+}
+func (m *Resume) XXX_DiscardUnknown() {
+	xxx_messageInfo_Resume.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Resume proto.InternalMessageInfo
+
+func (m *Resume) GetConnections() []*ResumeConnection {
+	if m != nil {
+		return m.Connections
+	}
+	return nil
+}
+
+type ResumeConnection struct {
+	// connectID of the connection
+	ConnectID int64 `protobuf:"varint,1,opt,name=connectID,proto3" json:"connectID,omitempty"`
+	// lastSeq is the seq of the last DATA received on the connection, 0
+	// if none was
+	LastSeq int64 `protobuf:"varint,2,opt,name=lastSeq,proto3" json:"lastSeq,omitempty"`
+	// bytesToAgent and bytesFromAgent are the DATA payload bytes the
+	// connection carried in each direction, set when it migrates to
+	// another agent
+	BytesToAgent         int64    `protobuf:"varint,3,opt,name=bytesToAgent,proto3" json:"bytesToAgent,omitempty"`
+	BytesFromAgent       int64    `protobuf:"varint,4,opt,name=bytesFromAgent,proto3" json:"bytesFromAgent,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ResumeConnection) Reset()         { *m = ResumeConnection{} }
+func (m *ResumeConnection) String() string { return proto.CompactTextString(m) }
+func (*ResumeConnection) ProtoMessage()    {}
+func (*ResumeConnection) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{10}
+}
+
+func (m *ResumeConnection) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ResumeConnection.Unmarshal(m, b)
+}
+func (m *ResumeConnection) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ResumeConnection.Marshal(b, m, deterministic)
+}
+func (m *ResumeConnection) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ResumeConnection.Merge(m, src)
+}
+func (m *ResumeConnection) XXX_Size() int {
+	return xxx_messageInfo_ResumeConnection.Size(m)
+}
+func (m *ResumeConnection) XXX_DiscardUnknown() {
+	xxx_messageInfo_ResumeConnection.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ResumeConnection proto.InternalMessageInfo
+
+func (m *ResumeConnection) GetConnectID() int64 {
+	if m != nil {
+		return m.ConnectID
+	}
+	return 0
+}
+
+func (m *ResumeConnection) GetLastSeq() int64 {
+	if m != nil {
+		return m.LastSeq
+	}
+	return 0
+}
+
+func (m *ResumeConnection) GetBytesToAgent() int64 {
+	if m != nil {
+		return m.BytesToAgent
+	}
+	return 0
+}
+
+func (m *ResumeConnection) GetBytesFromAgent() int64 {
+	if m != nil {
+		return m.BytesFromAgent
+	}
+	return 0
+}
+
+type Ack struct {
+	// connectID of the connection
+	ConnectID int64 `protobuf:"varint,1,opt,name=connectID,proto3" json:"connectID,omitempty"`
+	// seq of the last DATA received in order on the connection
+	Seq int64 `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	// retransmit asks the peer to send again the DATA following seq, as
+	// the sender received later DATA out of order
+	Retransmit           bool     `protobuf:"varint,3,opt,name=retransmit,proto3" json:"retransmit,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Ack) Reset()         { *m = Ack{} }
+func (m *Ack) String() string { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()    {}
+func (*Ack) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{11}
+}
+
+func (m *Ack) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Ack.Unmarshal(m, b)
+}
+func (m *Ack) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Ack.Marshal(b, m, deterministic)
+}
+func (m *Ack) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Ack.Merge(m, src)
+}
+func (m *Ack) XXX_Size() int {
+	return xxx_messageInfo_Ack.Size(m)
+}
+func (m *Ack) XXX_DiscardUnknown() {
+	xxx_messageInfo_Ack.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Ack proto.InternalMessageInfo
+
+func (m *Ack) GetConnectID() int64 {
+	if m != nil {
+		return m.ConnectID
+	}
+	return 0
+}
+
+func (m *Ack) GetSeq() int64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *Ack) GetRetransmit() bool {
+	if m != nil {
+		return m.Retransmit
+	}
+	return false
+}
+
+type Hello struct {
+	// protocolVersion is the highest protocol version the sender speaks,
+	// or the version negotiated when answering a HELLO
+	ProtocolVersion int32 `protobuf:"varint,1,opt,name=protocolVersion,proto3" json:"protocolVersion,omitempty"`
+	// features are the optional features supported by the sender
+	Features             []string `protobuf:"bytes,2,rep,name=features,proto3" json:"features,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+func (*Hello) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{12}
+}
+
+func (m *Hello) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Hello.Unmarshal(m, b)
+}
+func (m *Hello) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Hello.Marshal(b, m, deterministic)
+}
+func (m *Hello) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Hello.Merge(m, src)
+}
+func (m *Hello) XXX_Size() int {
+	return xxx_messageInfo_Hello.Size(m)
+}
+func (m *Hello) XXX_DiscardUnknown() {
+	xxx_messageInfo_Hello.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Hello proto.InternalMessageInfo
+
+func (m *Hello) GetProtocolVersion() int32 {
+	if m != nil {
+		return m.ProtocolVersion
+	}
+	return 0
+}
+
+func (m *Hello) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+type IdleWarning struct {
+	// connectID of the idle connection
+	ConnectID int64 `protobuf:"varint,1,opt,name=connectID,proto3" json:"connectID,omitempty"`
+	// closeIn, in milliseconds, is how long the agent waits before it
+	// closes the connection, unless DATA flows on it meanwhile
+	CloseIn              int64    `protobuf:"varint,2,opt,name=closeIn,proto3" json:"closeIn,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *IdleWarning) Reset()         { *m = IdleWarning{} }
+func (m *IdleWarning) String() string { return proto.CompactTextString(m) }
+func (*IdleWarning) ProtoMessage()    {}
+func (*IdleWarning) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{13}
+}
+
+func (m *IdleWarning) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_IdleWarning.Unmarshal(m, b)
+}
+func (m *IdleWarning) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_IdleWarning.Marshal(b, m, deterministic)
+}
+func (m *IdleWarning) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IdleWarning.Merge(m, src)
+}
+func (m *IdleWarning) XXX_Size() int {
+	return xxx_messageInfo_IdleWarning.Size(m)
+}
+func (m *IdleWarning) XXX_DiscardUnknown() {
+	xxx_messageInfo_IdleWarning.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_IdleWarning proto.InternalMessageInfo
+
+func (m *IdleWarning) GetConnectID() int64 {
+	if m != nil {
+		return m.ConnectID
+	}
+	return 0
+}
+
+func (m *IdleWarning) GetCloseIn() int64 {
+	if m != nil {
+		return m.CloseIn
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("PacketType", PacketType_name, PacketType_value)
 	proto.RegisterEnum("Error", Error_name, Error_value)
+	proto.RegisterEnum("DialErrorCode", DialErrorCode_name, DialErrorCode_value)
+	proto.RegisterEnum("CloseReason", CloseReason_name, CloseReason_value)
+	proto.RegisterEnum("Priority", Priority_name, Priority_value)
 	proto.RegisterType((*Packet)(nil), "Packet")
 	proto.RegisterType((*DialRequest)(nil), "DialRequest")
+	proto.RegisterMapType((map[string]string)(nil), "DialRequest.MetadataEntry")
 	proto.RegisterType((*DialResponse)(nil), "DialResponse")
 	proto.RegisterType((*CloseRequest)(nil), "CloseRequest")
 	proto.RegisterType((*CloseResponse)(nil), "CloseResponse")
 	proto.RegisterType((*CloseDial)(nil), "CloseDial")
 	proto.RegisterType((*Data)(nil), "Data")
+	proto.RegisterType((*Nack)(nil), "Nack")
+	proto.RegisterType((*Checkpoint)(nil), "Checkpoint")
+	proto.RegisterType((*Resume)(nil), "Resume")
+	proto.RegisterType((*ResumeConnection)(nil), "ResumeConnection")
+	proto.RegisterType((*Ack)(nil), "Ack")
+	proto.RegisterType((*Hello)(nil), "Hello")
+	proto.RegisterType((*IdleWarning)(nil), "IdleWarning")
 }
 
 func init() {
@@ -566,39 +1333,87 @@ func init() {
 }
 
 var fileDescriptor_fec4258d9ecd175d = []byte{
-	// 505 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0x51, 0x8b, 0xd3, 0x40,
-	0x18, 0x4c, 0xda, 0xa4, 0x6d, 0xbe, 0xa6, 0x47, 0x58, 0x44, 0xc2, 0x29, 0xdc, 0x11, 0x5f, 0x4a,
-	0xb1, 0xe9, 0xd1, 0x03, 0xf1, 0xb5, 0xd7, 0xf4, 0xe8, 0x41, 0xf1, 0xea, 0xf6, 0x9e, 0x4e, 0x50,
-	0xd6, 0x64, 0x91, 0xd0, 0x98, 0x8d, 0xbb, 0x6b, 0x35, 0x3f, 0xd3, 0x7f, 0x24, 0xd9, 0xa4, 0x4d,
-	0x22, 0xa8, 0x70, 0x4f, 0xed, 0xcc, 0x7e, 0x33, 0x3b, 0x19, 0xbe, 0x85, 0xe9, 0x9e, 0xa5, 0x29,
-	0x0d, 0x65, 0x7c, 0x88, 0x65, 0x3e, 0x0d, 0x93, 0x98, 0xa6, 0x72, 0x96, 0x71, 0x26, 0xd9, 0xac,
-	0x02, 0xe5, 0x8f, 0xaf, 0x38, 0xef, 0x57, 0x07, 0x7a, 0x5b, 0x12, 0xee, 0xa9, 0x44, 0x17, 0x60,
-	0xc8, 0x3c, 0xa3, 0xae, 0x7e, 0xa9, 0x8f, 0xcf, 0xe6, 0x43, 0xbf, 0xa4, 0x1f, 0xf2, 0x8c, 0x62,
-	0x75, 0x80, 0xae, 0x60, 0x18, 0xc5, 0x24, 0xc1, 0xf4, 0xdb, 0x77, 0x2a, 0xa4, 0xdb, 0xb9, 0xd4,
-	0xc7, 0xc3, 0xb9, 0xed, 0x07, 0x35, 0xb7, 0xd6, 0x70, 0x73, 0x04, 0x5d, 0x83, 0x5d, 0x42, 0x91,
-	0xb1, 0x54, 0x50, 0xb7, 0xab, 0x24, 0xa3, 0x4a, 0x52, 0x92, 0x6b, 0x0d, 0xb7, 0x86, 0xd0, 0x0b,
-	0x30, 0x22, 0x22, 0x89, 0x6b, 0xa8, 0x61, 0xd3, 0x0f, 0x88, 0x24, 0x6b, 0x0d, 0x2b, 0xb2, 0x70,
-	0x0c, 0x13, 0x26, 0xe8, 0x31, 0x84, 0x59, 0x39, 0x2e, 0x1b, 0x64, 0xe1, 0xd8, 0x1c, 0x42, 0x6f,
-	0x60, 0x54, 0xe1, 0x2a, 0x47, 0x4f, 0xa9, 0xce, 0x8e, 0xaa, 0x53, 0x90, 0xf6, 0x18, 0x9a, 0x80,
-	0xa5, 0x88, 0x22, 0xae, 0xdb, 0x57, 0x1a, 0x28, 0x35, 0x05, 0xb3, 0xd6, 0x70, 0x7d, 0x7c, 0x63,
-	0x41, 0x3f, 0x23, 0x79, 0xc2, 0x48, 0xe4, 0x7d, 0x80, 0x61, 0xa3, 0x13, 0x74, 0x0e, 0x03, 0xd5,
-	0x75, 0xc8, 0x12, 0xd5, 0xad, 0x85, 0x4f, 0x18, 0xb9, 0xd0, 0x27, 0x51, 0xc4, 0xa9, 0x10, 0xaa,
-	0x4e, 0x0b, 0x1f, 0x21, 0x7a, 0x0e, 0x3d, 0x4e, 0xd2, 0x88, 0x7d, 0x55, 0xa5, 0x75, 0x71, 0x85,
-	0xbc, 0x47, 0xb0, 0x9b, 0xed, 0xa1, 0x67, 0x60, 0x52, 0xce, 0x19, 0xaf, 0xac, 0x4b, 0x80, 0x5e,
-	0x82, 0x15, 0x96, 0x7b, 0x70, 0x17, 0x28, 0xe7, 0x2e, 0xae, 0x89, 0xbf, 0x7a, 0xbf, 0x06, 0xbb,
-	0xd9, 0x63, 0xdb, 0x45, 0xff, 0xc3, 0xc5, 0x5b, 0xc2, 0xa8, 0xd5, 0xdf, 0x53, 0xa2, 0x78, 0xaf,
-	0xc0, 0x3a, 0x15, 0xda, 0xc8, 0xa5, 0xb7, 0x72, 0xbd, 0x03, 0xa3, 0x58, 0x82, 0x7f, 0xe7, 0xa9,
-	0xaf, 0xef, 0x34, 0xaf, 0x47, 0xd5, 0x36, 0x15, 0x5f, 0x6a, 0x97, 0x4b, 0x34, 0xf9, 0x08, 0x50,
-	0x2f, 0x37, 0xb2, 0x61, 0x10, 0xdc, 0x2d, 0x36, 0x9f, 0xf0, 0xea, 0xbd, 0xa3, 0xd5, 0x68, 0xb7,
-	0x75, 0x74, 0x34, 0x02, 0x6b, 0xb9, 0xb9, 0xdf, 0xad, 0xd4, 0x61, 0xa7, 0x01, 0x77, 0x5b, 0xa7,
-	0x8b, 0x06, 0x60, 0x04, 0x8b, 0x87, 0x85, 0x63, 0x9c, 0x54, 0xcb, 0xcd, 0xce, 0x31, 0x27, 0x0e,
-	0x98, 0x2b, 0x75, 0x79, 0x1f, 0xba, 0xab, 0xfb, 0x5b, 0x47, 0x9b, 0xcf, 0xc0, 0xde, 0x72, 0xf6,
-	0x33, 0xdf, 0x51, 0x7e, 0x88, 0x43, 0x8a, 0x2e, 0xc0, 0x54, 0x18, 0xf5, 0xab, 0x67, 0x76, 0x7e,
-	0xfc, 0xe3, 0x69, 0x63, 0xfd, 0x4a, 0xbf, 0xb9, 0x7d, 0x0c, 0x44, 0xfc, 0x45, 0xf8, 0xfb, 0xb7,
-	0xc2, 0x8f, 0xd9, 0x8c, 0x64, 0xb1, 0xa0, 0xfc, 0x40, 0xf9, 0x34, 0xa5, 0xf2, 0x07, 0xe3, 0xfb,
-	0x69, 0x56, 0xc8, 0x67, 0xff, 0x7b, 0xec, 0x9f, 0x7b, 0x0a, 0x5d, 0xff, 0x0e, 0x00, 0x00, 0xff,
-	0xff, 0x38, 0x1b, 0xf6, 0x4f, 0x17, 0x04, 0x00, 0x00,
+	// 1279 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x56, 0x5d, 0x8f, 0xdb, 0x44,
+	0x14, 0x8d, 0xe3, 0x7c, 0xf9, 0xe6, 0xa3, 0xd3, 0x69, 0x29, 0xd6, 0xb6, 0x6a, 0x17, 0xf3, 0xa1,
+	0x65, 0xd5, 0xf5, 0x56, 0xa9, 0x54, 0x55, 0x20, 0x24, 0xdc, 0xc4, 0x5b, 0x5b, 0xcd, 0x26, 0xe9,
+	0x24, 0x4b, 0x05, 0x0f, 0xac, 0xa6, 0xce, 0xb0, 0xb5, 0x92, 0xd8, 0xa9, 0xed, 0x5d, 0xc8, 0x1b,
+	0xfc, 0x09, 0x7e, 0x04, 0xe2, 0x81, 0xdf, 0xc7, 0x13, 0x9a, 0xf1, 0xd8, 0x71, 0xa2, 0x8a, 0x48,
+	0xf0, 0x14, 0x9f, 0x73, 0xcf, 0x78, 0xee, 0xdc, 0x73, 0xe7, 0x3a, 0x70, 0x32, 0x0f, 0x83, 0x80,
+	0x79, 0x89, 0x7f, 0xe3, 0x27, 0xeb, 0x13, 0x6f, 0xe1, 0xb3, 0x20, 0x39, 0x5d, 0x45, 0x61, 0x12,
+	0x9e, 0x4a, 0x90, 0xfe, 0x98, 0x82, 0x33, 0xfe, 0xac, 0x40, 0x6d, 0x4c, 0xbd, 0x39, 0x4b, 0xf0,
+	0x23, 0xa8, 0x24, 0xeb, 0x15, 0xd3, 0x95, 0x43, 0xe5, 0xa8, 0xd3, 0x6d, 0x9a, 0x29, 0x3d, 0x5d,
+	0xaf, 0x18, 0x11, 0x01, 0xfc, 0x04, 0x9a, 0x33, 0x9f, 0x2e, 0x08, 0x7b, 0x7f, 0xcd, 0xe2, 0x44,
+	0x2f, 0x1f, 0x2a, 0x47, 0xcd, 0x6e, 0xcb, 0xec, 0x6f, 0x38, 0xa7, 0x44, 0x8a, 0x12, 0xfc, 0x14,
+	0x5a, 0x29, 0x8c, 0x57, 0x61, 0x10, 0x33, 0x5d, 0x15, 0x4b, 0xda, 0x66, 0xbf, 0x40, 0x3a, 0x25,
+	0xb2, 0x25, 0xc2, 0xf7, 0xa1, 0x32, 0xa3, 0x09, 0xd5, 0x2b, 0x42, 0x5c, 0x35, 0xfb, 0x34, 0xa1,
+	0x4e, 0x89, 0x08, 0x92, 0xbf, 0xd1, 0x5b, 0x84, 0x31, 0xcb, 0x92, 0xa8, 0xca, 0x37, 0xf6, 0x0a,
+	0x24, 0x7f, 0x63, 0x51, 0x84, 0x9f, 0x41, 0x5b, 0x62, 0x99, 0x47, 0x4d, 0xac, 0xea, 0x98, 0xbd,
+	0x22, 0xeb, 0x94, 0xc8, 0xb6, 0x0c, 0x1f, 0x83, 0x26, 0x08, 0x9e, 0xae, 0x5e, 0x17, 0x6b, 0xc0,
+	0xec, 0x65, 0x8c, 0x53, 0x22, 0x9b, 0x30, 0xcf, 0x3a, 0xa0, 0xde, 0x5c, 0x6f, 0xc8, 0xac, 0x87,
+	0xd4, 0x9b, 0xf3, 0xac, 0x39, 0x89, 0x4f, 0x00, 0xbc, 0x77, 0xcc, 0x9b, 0xaf, 0x42, 0x3f, 0x48,
+	0x74, 0x4d, 0x48, 0x9a, 0x66, 0x2f, 0xa7, 0x9c, 0x12, 0x29, 0x08, 0xf0, 0x27, 0x50, 0x8b, 0x58,
+	0x7c, 0xbd, 0x64, 0x3a, 0x08, 0x69, 0xdd, 0x24, 0x02, 0x3a, 0x25, 0x22, 0x03, 0x58, 0x07, 0x95,
+	0xef, 0xd6, 0x14, 0xf1, 0x8a, 0x69, 0x89, 0xcd, 0x38, 0x85, 0x1f, 0x42, 0xf5, 0x1d, 0x5b, 0x2c,
+	0x42, 0xbd, 0x25, 0x62, 0x35, 0xd3, 0xe1, 0xc8, 0x29, 0x91, 0x94, 0xe6, 0x2e, 0xfa, 0xb3, 0x05,
+	0x7b, 0x43, 0xa3, 0xc0, 0x0f, 0xae, 0xf4, 0xb6, 0x74, 0xd1, 0xdd, 0x70, 0xdc, 0xc5, 0x82, 0xe4,
+	0x85, 0x06, 0xf5, 0x15, 0x5d, 0x2f, 0x42, 0x3a, 0x33, 0xfe, 0x52, 0xa1, 0x59, 0xf0, 0x1b, 0x1f,
+	0x40, 0x43, 0xf4, 0x91, 0x17, 0x2e, 0x44, 0xdf, 0x68, 0x24, 0xc7, 0x58, 0x87, 0x3a, 0x9d, 0xcd,
+	0x22, 0x16, 0xc7, 0xa2, 0x55, 0x34, 0x92, 0x41, 0x7c, 0x0f, 0x6a, 0x11, 0x0d, 0x66, 0xe1, 0x52,
+	0x34, 0x84, 0x4a, 0x24, 0xc2, 0x87, 0xd0, 0xf4, 0xc2, 0xe5, 0x8a, 0x6b, 0xfc, 0x30, 0x10, 0x0d,
+	0xa0, 0x91, 0x22, 0x85, 0x9f, 0x41, 0x63, 0xc9, 0x12, 0x2a, 0xfa, 0xa3, 0x7a, 0xa8, 0x1e, 0x35,
+	0xbb, 0x07, 0xc5, 0xfe, 0x33, 0xcf, 0x65, 0xd0, 0x0e, 0x92, 0x68, 0x4d, 0x72, 0x2d, 0xcf, 0xf3,
+	0x5d, 0x18, 0x27, 0x01, 0x5d, 0xa6, 0xe6, 0x6b, 0x24, 0xc7, 0xf8, 0x21, 0x80, 0x47, 0x83, 0x99,
+	0x3f, 0xa3, 0x09, 0x8b, 0xf5, 0xfa, 0xa1, 0x7a, 0xa4, 0x91, 0x02, 0x83, 0x3f, 0xe7, 0x67, 0xf4,
+	0xc3, 0xc8, 0x4f, 0xd6, 0xc2, 0xdd, 0x4e, 0x57, 0x33, 0xc7, 0x92, 0x20, 0x79, 0x08, 0x9b, 0x80,
+	0x37, 0x16, 0xba, 0x41, 0xc2, 0xa2, 0x1b, 0xba, 0x10, 0x5e, 0xab, 0xe4, 0x03, 0x11, 0xfc, 0xe5,
+	0x8e, 0xc9, 0xb7, 0xa5, 0xc9, 0x3d, 0x79, 0x7f, 0xc3, 0x20, 0x33, 0xfb, 0xe0, 0x6b, 0x68, 0x6f,
+	0x1d, 0x0c, 0x23, 0x50, 0xe7, 0x6c, 0x2d, 0x2b, 0xce, 0x1f, 0xf1, 0x5d, 0xa8, 0xde, 0xd0, 0xc5,
+	0x35, 0x93, 0xa5, 0x4e, 0xc1, 0x57, 0xe5, 0xe7, 0x8a, 0xf1, 0xb7, 0x02, 0xad, 0xe2, 0x7d, 0xe3,
+	0x52, 0x16, 0x45, 0x61, 0x24, 0x97, 0xa7, 0x00, 0x3f, 0x00, 0xcd, 0x4b, 0x77, 0x76, 0xfb, 0xe2,
+	0x25, 0x2a, 0xd9, 0x10, 0xff, 0xc3, 0xb1, 0xc7, 0xa0, 0x89, 0x0d, 0x7a, 0xe1, 0x8c, 0x89, 0xdb,
+	0xda, 0xe9, 0x76, 0x84, 0x65, 0x76, 0xc6, 0x92, 0x8d, 0x40, 0xf4, 0xcc, 0x15, 0x0b, 0x78, 0x0e,
+	0x35, 0xd9, 0x33, 0x29, 0xe4, 0x0e, 0xc6, 0x49, 0x44, 0x13, 0x76, 0xb5, 0x16, 0x57, 0x51, 0x23,
+	0x39, 0xe6, 0xab, 0xd2, 0x4a, 0xcd, 0x84, 0x41, 0x0d, 0x92, 0x41, 0xe3, 0x31, 0xb4, 0x8a, 0x93,
+	0x61, 0xfb, 0x94, 0xca, 0xce, 0x29, 0x0d, 0x1f, 0xda, 0x5b, 0x13, 0xe1, 0x3f, 0x95, 0xea, 0x33,
+	0xee, 0x2b, 0x8d, 0xc3, 0x40, 0x94, 0xaa, 0xd3, 0x6d, 0x65, 0x53, 0x86, 0xc6, 0xa9, 0xa5, 0xfc,
+	0xd7, 0xf8, 0x14, 0xb4, 0x7c, 0x90, 0x14, 0xaa, 0xab, 0x14, 0xab, 0x6b, 0xfc, 0xaa, 0x40, 0x85,
+	0x4f, 0xbf, 0x7f, 0x4f, 0x7b, 0x93, 0x65, 0xb9, 0x98, 0x25, 0x96, 0x63, 0x94, 0x67, 0xd1, 0x92,
+	0xd3, 0x93, 0xb7, 0xba, 0xf4, 0x86, 0xcd, 0x84, 0x5b, 0x0d, 0x52, 0x60, 0x78, 0x5f, 0xc5, 0xec,
+	0xbd, 0xb0, 0x49, 0x25, 0xfc, 0xd1, 0x78, 0x05, 0x15, 0x3e, 0xc9, 0xf6, 0x7f, 0x1c, 0x0c, 0x68,
+	0x79, 0x74, 0x45, 0xdf, 0xfa, 0x0b, 0x3f, 0xf1, 0x19, 0xbf, 0xf2, 0xfc, 0x1e, 0x6d, 0x71, 0xc6,
+	0xb7, 0x00, 0x9b, 0x99, 0xb7, 0xff, 0x50, 0x6f, 0xd7, 0x09, 0x8b, 0x65, 0x81, 0x53, 0x60, 0x7c,
+	0x03, 0xb5, 0xf4, 0x96, 0xe0, 0xa7, 0xd0, 0x94, 0x62, 0x3f, 0x0c, 0x62, 0x5d, 0x39, 0x54, 0x3f,
+	0x7c, 0x87, 0x8a, 0x2a, 0xe3, 0x77, 0x05, 0xd0, 0xae, 0x62, 0x4f, 0x1e, 0x3a, 0xd4, 0x17, 0x34,
+	0x4e, 0x26, 0xec, 0xbd, 0xcc, 0x24, 0x83, 0xfc, 0xc4, 0x22, 0xa9, 0x69, 0x68, 0xf1, 0x1e, 0x95,
+	0x37, 0x63, 0x8b, 0xc3, 0x5f, 0x40, 0x47, 0xe0, 0xb3, 0x28, 0x5c, 0xa6, 0xaa, 0x8a, 0x50, 0xed,
+	0xb0, 0xc6, 0x05, 0xa8, 0x96, 0x37, 0xdf, 0x93, 0x8a, 0x74, 0xa7, 0x9c, 0xbb, 0xc3, 0xfd, 0x8c,
+	0x58, 0x12, 0xd1, 0x20, 0x5e, 0xfa, 0x69, 0x02, 0x0d, 0x52, 0x60, 0x8c, 0x73, 0xa8, 0x8a, 0xe9,
+	0x8f, 0x8f, 0xe0, 0x56, 0x36, 0x97, 0xbf, 0x63, 0x91, 0xb8, 0xab, 0xfc, 0xf5, 0x55, 0xb2, 0x4b,
+	0xf3, 0x7b, 0xf6, 0x13, 0xa3, 0xc9, 0x75, 0x94, 0x7b, 0x98, 0x63, 0xc3, 0x86, 0x66, 0xe1, 0x33,
+	0xb1, 0xbf, 0x70, 0xe2, 0xeb, 0xe8, 0x06, 0x59, 0xe1, 0x24, 0x3c, 0xfe, 0x43, 0x01, 0xd8, 0xf4,
+	0x0f, 0x6e, 0x41, 0xa3, 0xef, 0x5a, 0x83, 0x4b, 0x62, 0xbf, 0x46, 0xa5, 0x0d, 0x9a, 0x8c, 0x91,
+	0x82, 0xdb, 0xa0, 0xf5, 0x06, 0xa3, 0x89, 0x2d, 0x82, 0xe5, 0x02, 0x9c, 0x8c, 0x91, 0x8a, 0x1b,
+	0x50, 0xe9, 0x5b, 0x53, 0x0b, 0x55, 0xf2, 0x55, 0xbd, 0xc1, 0x04, 0x55, 0x39, 0x3f, 0xb4, 0x7a,
+	0xaf, 0x50, 0x0d, 0x77, 0x00, 0x7a, 0x8e, 0xdd, 0x7b, 0x35, 0x1e, 0xb9, 0xc3, 0x29, 0xaa, 0x63,
+	0x80, 0x1a, 0xb1, 0x27, 0x17, 0xe7, 0x36, 0x6a, 0xe0, 0x3a, 0xa8, 0x5c, 0xa4, 0x61, 0x0d, 0xaa,
+	0x8e, 0x3d, 0x18, 0x8c, 0x10, 0x60, 0x04, 0x2d, 0xb7, 0x3f, 0xb0, 0x2f, 0xdf, 0x58, 0x64, 0xe8,
+	0x0e, 0x5f, 0xa2, 0xe6, 0x31, 0x82, 0xaa, 0x98, 0x54, 0x5c, 0x6e, 0x8f, 0xce, 0x50, 0xe9, 0xf8,
+	0x37, 0x05, 0xda, 0x5b, 0x03, 0x0c, 0x1f, 0xc0, 0x3d, 0xb1, 0xbb, 0x4d, 0xc8, 0x88, 0x5c, 0x5e,
+	0x0c, 0x27, 0x63, 0xbb, 0xe7, 0x9e, 0xb9, 0x76, 0x1f, 0x95, 0xf0, 0xc7, 0x70, 0xa7, 0x10, 0x1b,
+	0x8e, 0x2e, 0xad, 0x97, 0xf6, 0x70, 0x8a, 0x94, 0x9d, 0x45, 0xaf, 0x2f, 0x2c, 0x62, 0x0d, 0xa7,
+	0xee, 0xd0, 0xee, 0xa3, 0x32, 0x7e, 0x04, 0xf7, 0x0b, 0x31, 0xb1, 0x62, 0x72, 0x39, 0xb1, 0xa6,
+	0x17, 0xc4, 0x9a, 0xda, 0x7d, 0xa4, 0x1e, 0xaf, 0xa0, 0x59, 0x98, 0x2a, 0xf8, 0x01, 0xe8, 0x59,
+	0x99, 0xac, 0xc9, 0x68, 0xb8, 0x93, 0xc2, 0x5d, 0x40, 0x5b, 0x51, 0x7e, 0x0c, 0x05, 0xdf, 0x03,
+	0xbc, 0xc5, 0x12, 0x7b, 0x62, 0x4f, 0x51, 0x19, 0x7f, 0x04, 0xb7, 0xb7, 0x78, 0x5e, 0x0f, 0xa4,
+	0x1e, 0xff, 0x08, 0x8d, 0xec, 0xa3, 0x87, 0x75, 0xb8, 0x3b, 0x26, 0xee, 0x88, 0xb8, 0xd3, 0xef,
+	0x77, 0xb6, 0xba, 0x0d, 0xed, 0x3c, 0xe2, 0xb8, 0x2f, 0x1d, 0xa4, 0xe0, 0x3b, 0x70, 0x2b, 0xa7,
+	0xce, 0xed, 0xbe, 0x7b, 0x71, 0x8e, 0xca, 0xbc, 0xce, 0x39, 0x39, 0x18, 0xbd, 0x41, 0x6a, 0xf7,
+	0x14, 0x5a, 0xe3, 0x28, 0xfc, 0x65, 0x3d, 0x61, 0xd1, 0x8d, 0xef, 0x31, 0xfc, 0x08, 0xaa, 0x02,
+	0xe3, 0xba, 0x9c, 0x35, 0x07, 0xd9, 0x83, 0x51, 0x3a, 0x52, 0x9e, 0x28, 0x2f, 0xce, 0x7e, 0xe8,
+	0xc7, 0xfe, 0x55, 0x6c, 0xce, 0x9f, 0xc7, 0xa6, 0x1f, 0x9e, 0xd2, 0x95, 0x1f, 0xb3, 0xe8, 0x86,
+	0x45, 0x27, 0x01, 0x4b, 0x7e, 0x0e, 0xa3, 0xf9, 0xc9, 0x8a, 0x2f, 0x3f, 0xdd, 0xf7, 0x77, 0xf8,
+	0x6d, 0x4d, 0xa0, 0xa7, 0xff, 0x0c, 0x00, 0x41, 0x0a, 0xb6, 0x61, 0x39, 0x0b, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -0,0 +1,61 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// sendAck sends an ACK of the DATA received from the proxy server. ACKs
+// asking to retransmit report DATA lost on the way.
+func (a *Client) sendAck(ack *client.Packet) {
+	if ack.GetAck().Retransmit {
+		klog.V(2).InfoS("DATA lost, requesting retransmission", "connectionID", ack.GetAck().ConnectID, "lastSeq", ack.GetAck().Seq)
+		metrics.Metrics.DataSequenceGapInc()
+	}
+	if err := a.Send(ack); err != nil {
+		klog.ErrorS(err, "ack send failure", "connectionID", ack.GetAck().ConnectID)
+	}
+}
+
+// handleAck drops the DATA acknowledged by the proxy server from the
+// retransmit buffer of the connection, and sends the following DATA again
+// if the server asks to. The connection is closed if some of it was
+// evicted from the buffer already.
+func (a *Client) handleAck(ctx *connContext, ack *client.Ack) {
+	if ctx.replay == nil {
+		return
+	}
+	ctx.replay.Ack(ack.Seq)
+	if !ack.Retransmit {
+		return
+	}
+	packets, ok := ctx.replay.Since(ack.Seq)
+	if !ok {
+		klog.V(2).InfoS("Closing connection missing data evicted from the retransmit buffer", "connectionID", ctx.connID, "lastSeq", ack.Seq)
+		go ctx.cleanup()
+		return
+	}
+	for _, pkt := range packets {
+		if err := a.Send(pkt); err != nil {
+			klog.ErrorS(err, "retransmit failure", "connectionID", ctx.connID)
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestHandleAck(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+	}
+	testClient.stream, stream = pipe()
+	ctx := &connContext{connID: 1, replay: util.NewReplayBuffer(1024)}
+	for i := 0; i < 3; i++ {
+		ctx.replay.Add(newDataPacket(1, []byte("a")))
+	}
+
+	testClient.handleAck(ctx, &client.Ack{ConnectID: 1, Seq: 1})
+	testClient.handleAck(ctx, &client.Ack{ConnectID: 1, Seq: 1, Retransmit: true})
+	for _, want := range []int64{2, 3} {
+		pkt, _ := stream.Recv()
+		if pkt == nil || pkt.Type != client.PacketType_DATA || pkt.GetData().Seq != want {
+			t.Fatalf("expect DATA %d to be sent again; got %v", want, pkt)
+		}
+	}
+	if _, ok := ctx.replay.Since(0); ok {
+		t.Error("expect acknowledged DATA to be dropped")
+	}
+}
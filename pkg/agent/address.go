@@ -0,0 +1,29 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// isIPLiteral reports whether host is an IP address rather than a name to
+// resolve. IPv6 addresses may carry a zone, e.g. fe80::1%eth0, which is
+// passed on to the dialer.
+func isIPLiteral(host string) bool {
+	ip, _ := util.ParseIPZone(host)
+	return ip != nil
+}
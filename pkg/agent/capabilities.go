@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"strings"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// Capability is an optional protocol feature an agent advertises to the
+// proxy server when it connects, so that dials requiring the feature are
+// only routed to agents supporting it.
+type Capability string
+
+const (
+	// CapabilityUDP means the agent can dial UDP destinations.
+	CapabilityUDP Capability = "udp"
+	// CapabilityDataCompression means the agent accepts compressing DATA
+	// payloads when the server requests it.
+	CapabilityDataCompression Capability = "data-compression"
+	// CapabilityNack means the agent answers packets of types it does not
+	// know with NACK, rather than ignoring them.
+	CapabilityNack Capability = "nack"
+	// CapabilityCheckpoint means the agent verifies byte-count CHECKPOINT
+	// packets, and sends its own when the dial request asks for them.
+	CapabilityCheckpoint Capability = "checkpoint"
+	// CapabilityResume means the agent resumes its session with the proxy
+	// server after the stream broke, and numbers the DATA it sends.
+	CapabilityResume Capability = "resume"
+	// CapabilityMigrate means the agent honors the resume of dial requests
+	// migrating a connection from another agent: it keeps the connectID
+	// and the byte offsets of the connection.
+	CapabilityMigrate Capability = "migrate"
+)
+
+// SupportedCapabilities are the capabilities this build of the agent can
+// advertise.
+var SupportedCapabilities = []Capability{CapabilityUDP, CapabilityDataCompression, CapabilityNack, CapabilityCheckpoint, CapabilityResume, CapabilityMigrate}
+
+// RecordBuildInfo sets the konnectivity_build_info metric of the agent to
+// the running build, protocol version and supported capabilities.
+func RecordBuildInfo() {
+	v := util.GetVersionInfo()
+	metrics.Metrics.SetBuildInfo(v.GitVersion, v.GitCommit, v.GoVersion, ProtocolVersion, FormatCapabilities(SupportedCapabilities))
+}
+
+// LegacyCapabilities are assumed for agents that connect without
+// advertising any capabilities. Such agents dial any protocol supported by
+// the Go net package.
+var LegacyCapabilities = []Capability{CapabilityUDP}
+
+// ParseCapabilities parses a comma separated list of capabilities.
+func ParseCapabilities(s string) []Capability {
+	var caps []Capability
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps = append(caps, Capability(c))
+		}
+	}
+	return caps
+}
+
+// FormatCapabilities is the inverse of ParseCapabilities.
+func FormatCapabilities(caps []Capability) string {
+	return strings.Join(capabilityStrings(caps), ",")
+}
+
+// capabilities returns the capabilities advertised by the agent.
+func (a *Client) capabilities() []Capability {
+	caps := []Capability{CapabilityUDP, CapabilityCheckpoint, CapabilityMigrate}
+	if a.enableDataCompression {
+		caps = append(caps, CapabilityDataCompression)
+	}
+	if a.currentUnknownPacketPolicy() == UnknownPacketNack {
+		caps = append(caps, CapabilityNack)
+	}
+	if a.sessionGrace > 0 {
+		caps = append(caps, CapabilityResume)
+	}
+	return caps
+}
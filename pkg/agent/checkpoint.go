@@ -0,0 +1,65 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// checkpointToServer counts n payload bytes sent to the proxy server on
+// the connection, and follows them with a CHECKPOINT once the interval
+// requested by the server elapsed. It must be called by remoteToProxy
+// right after sending the DATA, so that the stream orders the checkpoint
+// after the DATA it covers.
+func (a *Client) checkpointToServer(ctx *connContext, n int) {
+	if ctx.checkpointInterval <= 0 {
+		return
+	}
+	ctx.bytesSent += int64(n)
+	if time.Since(ctx.lastCheckpoint) < ctx.checkpointInterval {
+		return
+	}
+	ctx.lastCheckpoint = time.Now()
+	pkt := &client.Packet{
+		Type: client.PacketType_CHECKPOINT,
+		Payload: &client.Packet_Checkpoint{Checkpoint: &client.Checkpoint{
+			ConnectID: ctx.connID,
+			Bytes:     ctx.bytesSent,
+		}},
+	}
+	if err := a.Send(pkt); err != nil {
+		klog.ErrorS(err, "checkpoint send failure", "connectionID", ctx.connID)
+	}
+}
+
+// verifyCheckpoint compares a CHECKPOINT from the proxy server with the
+// payload bytes received on the connection. As the stream is ordered, any
+// difference means DATA was lost or duplicated on the way. The count is
+// then resynchronized, so that each discrepancy is reported once.
+func verifyCheckpoint(ctx *connContext, checkpoint *client.Checkpoint) {
+	if ctx.bytesReceived == checkpoint.Bytes {
+		metrics.Metrics.ObserveDataCheckpoint(true)
+		return
+	}
+	klog.ErrorS(nil, "Data checkpoint mismatch", "connectionID", ctx.connID, "bytesReceived", ctx.bytesReceived, "bytesSent", checkpoint.Bytes)
+	metrics.Metrics.ObserveDataCheckpoint(false)
+	ctx.bytesReceived = checkpoint.Bytes
+}
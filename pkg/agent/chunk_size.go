@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultDataChunkSize is the size of DATA payloads read from
+	// destination connections when the path to the proxy server cannot be
+	// probed.
+	DefaultDataChunkSize = 1 << 12
+
+	// dataPacketOverhead approximates the bytes a DATA packet adds on the
+	// wire on top of its payload: the TLS record, the HTTP/2 frame header,
+	// the gRPC message prefix and the protobuf envelope.
+	dataPacketOverhead = 64
+
+	// maxDataChunkSize keeps a DATA packet within one HTTP/2 frame of the
+	// default maximum frame size, so that gRPC never splits it.
+	maxDataChunkSize = 1<<14 - dataPacketOverhead
+
+	linkProbeTimeout = 5 * time.Second
+)
+
+// ProbeDataChunkSize opens a TCP connection to address and derives the DATA
+// chunk size from the maximum segment size negotiated with the peer. The
+// segment size reflects the MTU of the local route, e.g. of a VPN or overlay
+// device, and the one advertised by the server, so that chunks sized to
+// whole segments avoid trailing undersized segments and IP fragmentation.
+func ProbeDataChunkSize(address string) (int, error) {
+	conn, err := net.DialTimeout("tcp", address, linkProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close() /* #nosec G307 */
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	mss, err := tcpMaxSegmentSize(tcpConn)
+	if err != nil {
+		return 0, err
+	}
+	return chunkSizeForMSS(mss), nil
+}
+
+// chunkSizeForMSS returns the largest chunk size whose DATA packet fills a
+// whole number of segments of size mss without exceeding maxDataChunkSize.
+func chunkSizeForMSS(mss int) int {
+	if mss <= dataPacketOverhead {
+		return DefaultDataChunkSize
+	}
+	segments := (maxDataChunkSize + dataPacketOverhead) / mss
+	if segments < 1 {
+		return maxDataChunkSize
+	}
+	return segments*mss - dataPacketOverhead
+}
+
+// dataChunkSize returns the size of DATA payloads read from destination
+// connections.
+func (a *Client) dataChunkSize() int {
+	if a.chunkSize > 0 {
+		return a.chunkSize
+	}
+	return DefaultDataChunkSize
+}
+
+// getBuffer returns a buffer of dataChunkSize bytes, to be released with
+// putBuffer once it is no longer referenced.
+func (a *Client) getBuffer() []byte {
+	if a.buffers == nil {
+		return make([]byte, a.dataChunkSize())
+	}
+	return a.buffers.Get()
+}
+
+func (a *Client) putBuffer(buf []byte) {
+	if a.buffers != nil {
+		a.buffers.Put(buf)
+	}
+}
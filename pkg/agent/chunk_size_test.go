@@ -0,0 +1,42 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+)
+
+func TestChunkSizeForMSS(t *testing.T) {
+	testcases := []struct {
+		mss  int
+		want int
+	}{
+		{mss: 1448, want: 11*1448 - dataPacketOverhead}, // ethernet
+		{mss: 1368, want: 11*1368 - dataPacketOverhead}, // IPsec or WireGuard underlay
+		{mss: 65483, want: maxDataChunkSize},            // loopback
+		{mss: 0, want: DefaultDataChunkSize},
+	}
+	for _, tc := range testcases {
+		got := chunkSizeForMSS(tc.mss)
+		if got != tc.want {
+			t.Errorf("chunkSizeForMSS(%d) = %d, want %d", tc.mss, got, tc.want)
+		}
+		if got > maxDataChunkSize {
+			t.Errorf("chunkSizeForMSS(%d) = %d exceeds %d", tc.mss, got, maxDataChunkSize)
+		}
+	}
+}
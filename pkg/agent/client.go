@@ -18,6 +18,7 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -26,14 +27,18 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
@@ -50,6 +55,38 @@ type connContext struct {
 	cleanOnce sync.Once
 	warnChLim bool
 	dialDone  chan struct{}
+	// compression is the DATA compression negotiated at dial time.
+	compression string
+	// span of the connection lifetime, nil unless the dial is traced.
+	span *tracing.Span
+	// closeReason is the client.CloseReason of the destination closing
+	// the connection, reported with CLOSE_RSP. Accessed atomically.
+	closeReason int32
+	// closeError holds the error string reported with CLOSE_RSP when the
+	// agent closes the connection on an error.
+	closeError atomic.Value
+
+	// checkpointInterval is how often the server asked for CHECKPOINTs,
+	// zero if it did not. bytesSent and lastCheckpoint are only accessed
+	// by remoteToProxy, bytesReceived by the goroutine serving the stream.
+	checkpointInterval time.Duration
+	bytesSent          int64
+	lastCheckpoint     time.Time
+	bytesReceived      int64
+
+	// replay numbers the DATA sent to the server and keeps it until
+	// acknowledged, to be sent again when lost or when the session
+	// resumes. It is nil if DATA is not numbered. received is only
+	// accessed by the goroutine serving the stream.
+	replay   *util.ReplayBuffer
+	received util.ReceiveWindow
+
+	// lastActive is the time DATA last flowed on the connection in unix
+	// nanoseconds, accessed atomically. idleWarned is set once the
+	// frontend was warned of its idleness, only accessed by the idle
+	// sweeper.
+	lastActive int64
+	idleWarned bool
 }
 
 func (c *connContext) cleanup() {
@@ -65,7 +102,7 @@ func (c *connContext) send(msg []byte) {
 		}
 	}()
 	if c.warnChLim && len(c.dataCh) >= xfrChannelSize {
-		klog.V(2).InfoS("Data channel on agent is full", "connectionID", c.connID)
+		util.V(util.LogAgentStream, 2).InfoS("Data channel on agent is full", "connectionID", c.connID)
 	}
 
 	c.dataCh <- msg
@@ -74,11 +111,26 @@ func (c *connContext) send(msg []byte) {
 type connectionManager struct {
 	mu          sync.RWMutex
 	connections map[int64]*connContext
+	// reserved are the connectIDs of the connections being dialed.
+	reserved map[int64]bool
+}
+
+// Reserve reserves connID for a connection being dialed, returning false
+// if it is in use. The reservation ends with Add or Delete.
+func (cm *connectionManager) Reserve(connID int64) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.connections[connID]; ok || cm.reserved[connID] {
+		return false
+	}
+	cm.reserved[connID] = true
+	return true
 }
 
 func (cm *connectionManager) Add(connID int64, ctx *connContext) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	delete(cm.reserved, connID)
 	cm.connections[connID] = ctx
 }
 
@@ -92,6 +144,7 @@ func (cm *connectionManager) Get(connID int64) (*connContext, bool) {
 func (cm *connectionManager) Delete(connID int64) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	delete(cm.reserved, connID)
 	delete(cm.connections, connID)
 }
 
@@ -108,6 +161,7 @@ func (cm *connectionManager) List() []*connContext {
 func newConnectionManager() *connectionManager {
 	return &connectionManager{
 		connections: make(map[int64]*connContext),
+		reserved:    make(map[int64]bool),
 	}
 }
 
@@ -163,6 +217,24 @@ func GenAgentIdentifiers(addrs string) (Identifiers, error) {
 	return agentIDs, nil
 }
 
+// ParseAgentLabels parses the labels of an agent from the input string, a
+// comma-separated list of key=value pairs, e.g. zone=us-east-1a,network=mgmt.
+// Keys and values must be valid Kubernetes label keys and values.
+func ParseAgentLabels(s string) (labels.Set, error) {
+	if s == "" {
+		return labels.Set{}, nil
+	}
+	return labels.ConvertSelectorToLabelsMap(s)
+}
+
+// DialPolicy decides whether the agent may dial a destination requested
+// by the proxy server. hostname is the name the frontend resolved address
+// from, empty if it sent none; it is not verified to resolve to address.
+// metadata is the DialRequest metadata, whose "konnectivity.io/" keys are
+// attested by the server. Returning an error rejects the dial; the error
+// is reported back to the frontend.
+type DialPolicy func(protocol, address, hostname string, metadata map[string]string) error
+
 // Client runs on the node network side. It connects to proxy server and establishes
 // a stream connection from which it sends and receives network traffic.
 type Client struct {
@@ -180,11 +252,12 @@ type Client struct {
 	// connect opts
 	address string
 	opts    []grpc.DialOption
-	conn    *grpc.ClientConn
+	conn    *grpc.ClientConn // protected by connLock, replaced when the session resumes
 	stopCh  chan struct{}
 	// locks
 	sendLock      sync.Mutex
 	recvLock      sync.Mutex
+	connLock      sync.Mutex
 	probeInterval time.Duration // interval between probe pings
 
 	// file path contains service account token.
@@ -192,8 +265,89 @@ type Client struct {
 	serviceAccountTokenPath string
 
 	warnOnChannelLimit bool
+
+	// accept DATA compression requested by the server
+	enableDataCompression bool
+
+	dialFailures *DialFailureRecorder
+
+	// fails the dials of destinations whose dials kept failing, nil
+	// dials every destination
+	quarantine *DestinationQuarantine
+
+	dialPolicy DialPolicy
+
+	// translates the destinations of dials before they are dialed
+	nat NATTable
+
+	// size of DATA payloads read from destination connections, probed
+	// from the path to the proxy server if not configured
+	chunkSize int
+	// buffers of chunkSize bytes reused across destination reads
+	buffers *util.BufferPool
+
+	tracer *tracing.Tracer
+
+	// announce the agent as canary
+	canary bool
+
+	// labels announced to the server, formatted as key=value pairs
+	agentLabels string
+
+	// connection capacity announced to the server, 0 is unlimited
+	maxConnections int
+
+	// resolves destination hostnames, nil uses the system resolver
+	resolver *Resolver
+
+	// paths of the network namespaces dials may request by name
+	networkNamespaces map[string]string
+
+	// races the addresses of dual-stack destinations, nil dials the
+	// requested address only
+	happyEyeballs *HappyEyeballsDialer
+
+	// redacts addresses and identifiers in logs, nil logs them as is
+	redactor *util.Redactor
+
+	// response to packets of unknown types
+	unknownPacketPolicy UnknownPacketPolicy
+
+	// how long to try resuming the session after the stream broke, and
+	// the DATA payload bytes kept per connection to be sent again
+	sessionGrace     time.Duration
+	replayBufferSize int
+	// token of the session, empty if the server does not offer to resume it
+	sessionToken string
+
+	// highest protocol version announced to the server, and the version
+	// negotiated with it
+	maxProtocolVersion int
+	protocolVersion    int
+	// features advertised by the server in its HELLO, only accessed by
+	// the goroutine serving the stream
+	serverHello    bool
+	serverFeatures []string
+	// idleWarnings is 1 if the server advertised FeatureIdleWarning,
+	// accessed atomically by the idle sweeper
+	idleWarnings int32
+
+	// dials the destinations, nil dials the network
+	dialer DestinationDialer
+
+	// closes the destination connections idle for idleTimeout, warning
+	// the frontend idleWarning before. Zero keeps them open.
+	idleTimeout time.Duration
+	idleWarning time.Duration
+
+	// topology hints sent by the server, by server ID
+	topologyHints map[string]string
 }
 
+// DestinationDialer dials the destination address of a dial request on
+// the named network.
+type DestinationDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
 func newAgentClient(address, agentID, agentIdentifiers string, cs *ClientSet, opts ...grpc.DialOption) (*Client, int, error) {
 	a := &Client{
 		cs:                      cs,
@@ -206,65 +360,170 @@ func newAgentClient(address, agentID, agentIdentifiers string, cs *ClientSet, op
 		serviceAccountTokenPath: cs.serviceAccountTokenPath,
 		connManager:             newConnectionManager(),
 		warnOnChannelLimit:      cs.warnOnChannelLimit,
+		enableDataCompression:   cs.enableDataCompression,
+		dialFailures:            cs.dialFailures,
+		quarantine:              cs.quarantine,
+		dialPolicy:              cs.dialPolicy,
+		nat:                     cs.nat,
+		chunkSize:               cs.dataChunkSize,
+		tracer:                  cs.tracer,
+		canary:                  cs.canary,
+		agentLabels:             cs.agentLabels,
+		maxConnections:          cs.maxConnectionsPerServer,
+		resolver:                cs.resolver,
+		networkNamespaces:       cs.networkNamespaces,
+		redactor:                cs.redactor,
+		unknownPacketPolicy:     cs.unknownPacketPolicy,
+		sessionGrace:            cs.sessionGrace,
+		replayBufferSize:        cs.replayBufferSize,
+		maxProtocolVersion:      cs.maxProtocolVersion,
+		dialer:                  cs.dialer,
+		idleTimeout:             cs.idleTimeout,
+		idleWarning:             cs.idleWarning,
+	}
+	if a.maxProtocolVersion == 0 {
+		a.maxProtocolVersion = ProtocolVersion
+	}
+	if cs.happyEyeballs {
+		a.happyEyeballs = &HappyEyeballsDialer{
+			Prefer:       cs.addressFamilyPreference,
+			AttemptDelay: cs.dialAttemptDelay,
+			Resolver:     cs.resolver,
+		}
 	}
 	serverCount, err := a.Connect()
 	if err != nil {
 		return nil, 0, err
 	}
+	if a.chunkSize == 0 {
+		if a.chunkSize, err = ProbeDataChunkSize(address); err != nil {
+			klog.V(2).InfoS("Failed to probe the path to the proxy server, using the default chunk size", "serverID", a.serverID, "chunkSize", DefaultDataChunkSize, "err", err)
+		} else {
+			klog.V(2).InfoS("Probed the path to the proxy server", "serverID", a.serverID, "chunkSize", a.chunkSize)
+		}
+	}
+	a.buffers = util.NewBufferPool(a.dataChunkSize())
 	return a, serverCount, nil
 }
 
 // Connect makes the grpc dial to the proxy server. It returns the serverID
 // it connects to.
 func (a *Client) Connect() (int, error) {
-	conn, err := grpc.Dial(a.address, a.opts...)
+	conn, stream, err := a.dialServer("")
 	if err != nil {
 		return 0, err
 	}
-	ctx := metadata.AppendToOutgoingContext(context.Background(),
-		header.AgentID, a.agentID,
-		header.AgentIdentifiers, a.agentIdentifiers)
-	if a.serviceAccountTokenPath != "" {
-		if ctx, err = a.initializeAuthContext(ctx); err != nil {
-			err := conn.Close()
-			if err != nil {
-				klog.ErrorS(err, "failed to close connection")
-			}
-			return 0, err
-		}
+	serverID, err := serverID(stream)
+	if err != nil {
+		conn.Close() /* #nosec G104 */
+		return 0, err
 	}
-	stream, err := agent.NewAgentServiceClient(conn).Connect(ctx)
+	serverCount, err := serverCount(stream)
 	if err != nil {
 		conn.Close() /* #nosec G104 */
 		return 0, err
 	}
-	serverID, err := serverID(stream)
+	token, err := sessionToken(stream)
 	if err != nil {
 		conn.Close() /* #nosec G104 */
 		return 0, err
 	}
-	serverCount, err := serverCount(stream)
+	version, err := protocolVersion(stream)
 	if err != nil {
 		conn.Close() /* #nosec G104 */
 		return 0, err
 	}
-	a.conn = conn
+	a.setConn(conn)
 	a.stream = stream
 	a.serverID = serverID
-	klog.V(2).InfoS("Connect to", "server", serverID)
+	a.sessionToken = token
+	a.protocolVersion = NegotiateProtocolVersion(a.maxProtocolVersion, version)
+	a.topologyHints = topologyHints(stream)
+	klog.V(2).InfoS("Connect to", "server", serverID, "resumable", token != "", "protocolVersion", a.protocolVersion, "deadline", connectionDeadline(stream))
+	if a.protocolVersion >= ProtocolVersionHello {
+		if err := stream.Send(a.helloPacket()); err != nil {
+			conn.Close() /* #nosec G104 */
+			return 0, err
+		}
+	}
 	return serverCount, nil
 }
 
+// dialServer opens a Connect stream to the proxy server, resuming the
+// session of token if not empty.
+func (a *Client) dialServer(token string) (*grpc.ClientConn, agent.AgentService_ConnectClient, error) {
+	conn, err := grpc.Dial(a.address, a.opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := a.streamContext(context.Background(), token)
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			klog.ErrorS(err, "failed to close connection")
+		}
+		return nil, nil, err
+	}
+	stream, err := agent.NewAgentServiceClient(conn).Connect(ctx)
+	if err != nil {
+		conn.Close() /* #nosec G104 */
+		return nil, nil, err
+	}
+	return conn, stream, nil
+}
+
+// streamContext returns ctx carrying the metadata identifying the agent on
+// its streams, and the session token if not empty.
+func (a *Client) streamContext(ctx context.Context, token string) (context.Context, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		header.AgentID, a.agentID,
+		header.AgentIdentifiers, a.agentIdentifiers,
+		header.AgentCapabilities, FormatCapabilities(a.capabilities()),
+		header.ProtocolVersion, strconv.Itoa(a.maxProtocolVersion))
+	if a.canary {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.AgentCanary, "true")
+	}
+	if a.agentLabels != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.AgentLabels, a.agentLabels)
+	}
+	if a.maxConnections > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.AgentMaxConnections, strconv.Itoa(a.maxConnections))
+	}
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.SessionToken, token)
+	}
+	if a.serviceAccountTokenPath != "" {
+		return a.initializeAuthContext(ctx)
+	}
+	return ctx, nil
+}
+
+func (a *Client) currentConn() *grpc.ClientConn {
+	a.connLock.Lock()
+	defer a.connLock.Unlock()
+	return a.conn
+}
+
+// setConn replaces the underlying connection, returning the previous one.
+func (a *Client) setConn(conn *grpc.ClientConn) *grpc.ClientConn {
+	a.connLock.Lock()
+	defer a.connLock.Unlock()
+	prev := a.conn
+	a.conn = conn
+	return prev
+}
+
 // Close closes the underlying connection.
 func (a *Client) Close() {
-	if a.conn == nil {
+	// Stop first, so that Serve does not resume the session.
+	close(a.stopCh)
+	conn := a.currentConn()
+	if conn == nil {
 		klog.Errorln("Unexpected empty AgentClient.conn")
 	}
-	err := a.conn.Close()
+	err := conn.Close()
 	if err != nil {
 		klog.ErrorS(err, "failed to close underlying connection")
 	}
-	close(a.stopCh)
 }
 
 func (a *Client) Send(pkt *client.Packet) error {
@@ -274,7 +533,10 @@ func (a *Client) Send(pkt *client.Packet) error {
 	err := a.stream.Send(pkt)
 	if err != nil && err != io.EOF {
 		metrics.Metrics.ObserveFailure(metrics.DirectionToServer)
-		a.cs.RemoveClient(a.serverID)
+		// Serve resumes resumable sessions once the stream failed.
+		if a.sessionToken == "" {
+			a.cs.RemoveClient(a.serverID)
+		}
 	}
 	return err
 }
@@ -316,6 +578,54 @@ func serverID(stream agent.AgentService_ConnectClient) (string, error) {
 	return sids[0], nil
 }
 
+// sessionToken returns the token of the session the server offers to
+// resume, empty if it does not.
+func sessionToken(stream agent.AgentService_ConnectClient) (string, error) {
+	md, err := stream.Header()
+	if err != nil {
+		return "", err
+	}
+	tokens := md.Get(header.SessionToken)
+	if len(tokens) != 1 {
+		return "", nil
+	}
+	return tokens[0], nil
+}
+
+// sessionResumed returns whether the server resumed the session of the
+// token sent on stream.
+func sessionResumed(stream agent.AgentService_ConnectClient) (bool, error) {
+	md, err := stream.Header()
+	if err != nil {
+		return false, err
+	}
+	resumed := md.Get(header.SessionResumed)
+	return len(resumed) == 1 && resumed[0] == "true", nil
+}
+
+// connectionDeadline returns when the server ends stream for having
+// reached its maximum age, empty if it does not.
+func connectionDeadline(stream agent.AgentService_ConnectClient) string {
+	md, err := stream.Header()
+	if err != nil {
+		return ""
+	}
+	deadlines := md.Get(header.ConnectionDeadline)
+	if len(deadlines) != 1 {
+		return ""
+	}
+	return deadlines[0]
+}
+
+// protocolVersion returns the protocol version negotiated by the server.
+func protocolVersion(stream agent.AgentService_ConnectClient) (int, error) {
+	md, err := stream.Header()
+	if err != nil {
+		return 0, err
+	}
+	return ParseProtocolVersion(md.Get(header.ProtocolVersion))
+}
+
 func (a *Client) initializeAuthContext(ctx context.Context) (context.Context, error) {
 	var err error
 	var b []byte
@@ -350,39 +660,47 @@ func (a *Client) Serve() {
 		for _, connCtx := range a.connManager.List() {
 			connCtx.cleanup()
 		}
-		klog.V(2).InfoS("cleanup all of conn contexts when client exits", "agentID", a.agentID)
+		util.V(util.LogAgentStream, 2).InfoS("cleanup all of conn contexts when client exits", "agentID", a.redactor.Identifier(a.agentID))
 	}()
 
-	klog.V(2).InfoS("Start serving", "serverID", a.serverID)
+	util.V(util.LogAgentStream, 2).InfoS("Start serving", "serverID", a.serverID)
 	go a.probe()
+	go a.sweepIdleConnections()
+	acksDone := make(chan struct{})
+	defer close(acksDone)
+	acks := util.NewAckQueue()
+	go acks.Run(acksDone, a.sendAck)
 	for {
 		select {
 		case <-a.stopCh:
-			klog.V(2).InfoS("stop agent client.")
+			util.V(util.LogAgentStream, 2).InfoS("stop agent client.")
 			return
 		default:
 		}
 
 		pkt, err := a.Recv()
 		if err != nil {
+			if a.resumeSession() {
+				continue
+			}
 			if err == io.EOF {
-				klog.V(2).InfoS("received EOF, exit")
+				util.V(util.LogAgentStream, 2).InfoS("received EOF, exit")
 				return
 			}
 			klog.ErrorS(err, "could not read stream")
 			return
 		}
 
-		klog.V(5).InfoS("[tracing] recv packet", "type", pkt.Type)
+		util.V(util.LogAgentStream, 5).InfoS("[tracing] recv packet", "type", pkt.Type)
 
 		if pkt == nil {
-			klog.V(3).InfoS("empty packet received")
+			util.V(util.LogAgentStream, 3).InfoS("empty packet received")
 			continue
 		}
 
 		switch pkt.Type {
 		case client.PacketType_DIAL_REQ:
-			klog.V(4).InfoS("received DIAL_REQ")
+			util.V(util.LogAgentStream, 4).InfoS("received DIAL_REQ")
 			dialResp := &client.Packet{
 				Type:    client.PacketType_DIAL_RSP,
 				Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{}},
@@ -391,24 +709,70 @@ func (a *Client) Serve() {
 			dialReq := pkt.GetDialRequest()
 			dialResp.GetDialResponse().Random = dialReq.Random
 
-			connID := atomic.AddInt64(&a.nextConnID, 1)
+			util.V(util.LogAgentStream, 2).InfoS("Dial requested", "protocol", dialReq.Protocol, "address", a.redactor.Address(dialReq.Address), "hostname", a.redactor.Address(dialReq.Hostname), "dialID", dialReq.Random, "metadata", dialReq.Metadata)
+			if a.dialPolicy != nil {
+				if err := a.dialPolicy(dialReq.Protocol, dialReq.Address, dialReq.Hostname, dialReq.Metadata); err != nil {
+					util.V(util.LogAgentStream, 2).InfoS("Dial rejected by policy", "address", a.redactor.Address(dialReq.Address), "hostname", a.redactor.Address(dialReq.Hostname), "dialID", dialReq.Random, "metadata", dialReq.Metadata, "err", err)
+					metrics.Metrics.ObserveDial(metrics.DialRejected, destinationPort(dialReq.Address))
+					dialResp.GetDialResponse().Error = fmt.Sprintf("dial rejected by agent policy: %v", err)
+					if err := a.Send(dialResp); err != nil {
+						klog.ErrorS(err, "could not send dialResp")
+					}
+					continue
+				}
+			}
+
+			resume := dialReq.GetResume()
+			var connID int64
+			if resume != nil {
+				if !a.reserveMigratedConnectionID(resume.ConnectID) {
+					util.V(util.LogAgentStream, 2).InfoS("Cannot resume migrated connection, its connection ID is in use", "connectionID", resume.ConnectID, "dialID", dialReq.Random)
+					dialResp.GetDialResponse().Error = fmt.Sprintf("connection ID %d of the migrated connection is in use", resume.ConnectID)
+					if err := a.Send(dialResp); err != nil {
+						klog.ErrorS(err, "could not send dialResp")
+					}
+					continue
+				}
+				connID = resume.ConnectID
+			} else {
+				connID = a.newConnectionID()
+			}
 			dataCh := make(chan []byte, xfrChannelSize)
 			dialDone := make(chan struct{})
 			connCtx := &connContext{
+				connID:    connID,
 				dataCh:    dataCh,
 				dialDone:  dialDone,
 				warnChLim: a.warnOnChannelLimit,
 			}
+			if a.enableDataCompression && a.serverSupports(header.FeatureCompression) && util.SupportedCompression(dialReq.Compression) {
+				connCtx.compression = dialReq.Compression
+				dialResp.GetDialResponse().Compression = dialReq.Compression
+			}
+			connCtx.checkpointInterval = time.Duration(dialReq.CheckpointInterval) * time.Millisecond
+			if a.sessionToken != "" || a.protocolVersion >= ProtocolVersionAck {
+				connCtx.replay = util.NewReplayBuffer(a.replayBufferSize)
+			}
+			if resume != nil {
+				// count the DATA of the connection from where the
+				// previous agent left off, like the server does
+				connCtx.bytesReceived = resume.BytesToAgent
+				connCtx.bytesSent = resume.BytesFromAgent
+				dialResp.GetDialResponse().Resumed = true
+			}
 			connCtx.cleanFunc = func() {
 				// block on purpose
 				<-dialDone
 				if connCtx.conn != nil {
-					klog.V(4).InfoS("close connection", "connectionID", connID)
+					util.V(util.LogAgentStream, 4).InfoS("close connection", "connectionID", connID)
+					metrics.Metrics.OpenConnectionDec()
 					closeResp := &client.Packet{
 						Type:    client.PacketType_CLOSE_RSP,
 						Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{}},
 					}
 					closeResp.GetCloseResponse().ConnectID = connID
+					closeResp.GetCloseResponse().Reason = client.CloseReason(atomic.LoadInt32(&connCtx.closeReason))
+					closeResp.GetCloseResponse().Error, _ = connCtx.closeError.Load().(string)
 					if err := a.Send(closeResp); err != nil {
 						klog.ErrorS(err, "close response failure")
 					}
@@ -417,54 +781,117 @@ func (a *Client) Serve() {
 					if err := connCtx.conn.Close(); err != nil {
 						klog.ErrorS(err, "failed to close connection")
 					}
+					connCtx.span.Finish("")
 				} else {
 					klog.ErrorS(fmt.Errorf("connection is nil"), "cannot send CLOSE_RESP to nil connection")
 				}
 			}
 			go func() {
 				defer close(dialDone)
+				traceParent := dialReq.Metadata[tracing.TraceParentKey]
+				dialSpan := a.tracer.StartSpan("konnectivity-agent.dial", traceParent)
+				dialSpan.SetAttribute("destination", dialReq.Address)
+				if dialReq.Hostname != "" {
+					dialSpan.SetAttribute("destination.hostname", dialReq.Hostname)
+				}
+				dialSpan.SetAttribute("protocol", dialReq.Protocol)
 				start := time.Now()
-				conn, err := net.DialTimeout(dialReq.Protocol, dialReq.Address, dialTimeout)
+				destination := quarantineKey(dialReq.Protocol, dialReq.Address, dialReq.Metadata[header.DialNetworkNamespace])
+				if err := a.quarantine.Check(destination, start); err != nil {
+					util.V(util.LogAgentStream, 2).InfoS("Failing dial of quarantined destination", "address", a.redactor.Address(dialReq.Address), "dialID", dialReq.Random, "err", err)
+					metrics.Metrics.QuarantinedDialInc()
+					metrics.Metrics.ObserveDial(metrics.DialQuarantined, destinationPort(dialReq.Address))
+					dialSpan.Finish(err.Error())
+					dialResp.GetDialResponse().Error = err.Error()
+					dialResp.GetDialResponse().ErrorCode = client.DialErrorCode_DIAL_ERROR_QUARANTINED
+					a.connManager.Delete(connID)
+					if err := a.Send(dialResp); err != nil {
+						klog.ErrorS(err, "could not send dialResp")
+					}
+					return
+				}
+				conn, err := a.dial(dialReq)
+				a.quarantine.Record(destination, err, time.Now())
 				if err != nil {
+					dialSpan.Finish(err.Error())
+					metrics.Metrics.ObserveFailedDialLatency(time.Since(start))
+					metrics.Metrics.ObserveDial(metrics.DialFailure, destinationPort(dialReq.Address))
+					a.dialFailures.Record(dialReq.Protocol, dialReq.Address, err)
 					dialResp.GetDialResponse().Error = err.Error()
+					a.connManager.Delete(connID)
 					if err := a.Send(dialResp); err != nil {
 						klog.ErrorS(err, "could not send dialResp")
 					}
 					return
 				}
 				metrics.Metrics.ObserveDialLatency(time.Since(start))
+				metrics.Metrics.ObserveDial(metrics.DialSuccess, destinationPort(dialReq.Address))
+				dialSpan.Finish("")
+				connCtx.span = a.tracer.StartSpan("konnectivity-agent.connection", traceParent)
+				connCtx.span.SetAttribute("destination", dialReq.Address)
+				connCtx.span.SetAttribute("connection.id", strconv.FormatInt(connID, 10))
 				connCtx.conn = conn
+				a.touch(connCtx)
 				a.connManager.Add(connID, connCtx)
+				metrics.Metrics.OpenConnectionInc()
 				dialResp.GetDialResponse().ConnectID = connID
 				if err := a.Send(dialResp); err != nil {
 					klog.ErrorS(err, "could not send dialResp")
 					return
 				}
-				klog.V(3).InfoS("Proxying new connection", "connectionID", connID)
+				util.V(util.LogAgentStream, 3).InfoS("Proxying new connection", "connectionID", connID)
 				go a.remoteToProxy(connID, connCtx)
 				go a.proxyToRemote(connID, connCtx)
 			}()
 
 		case client.PacketType_DATA:
 			data := pkt.GetData()
-			klog.V(4).InfoS("received DATA", "connectionID", data.ConnectID)
+			util.V(util.LogAgentStream, 4).InfoS("received DATA", "connectionID", data.ConnectID)
 
 			ctx, ok := a.connManager.Get(data.ConnectID)
 			if ok {
+				deliver, ack := ctx.received.Receive(data.ConnectID, data.Seq)
+				if ack != nil {
+					acks.Add(ack)
+				}
+				if !deliver {
+					util.V(util.LogAgentStream, 4).InfoS("dropping DATA out of sequence", "connectionID", data.ConnectID, "seq", data.Seq, "lastSeq", ctx.received.Last)
+					continue
+				}
+				if data.Compressed {
+					decompressed, err := util.Decompress(ctx.compression, data.Data)
+					if err != nil {
+						// The bytes lost would corrupt the stream.
+						klog.ErrorS(err, "failed to decompress data, closing the connection", "connectionID", data.ConnectID)
+						ctx.closeError.Store(fmt.Sprintf("failed to decompress data from the server: %v", err))
+						ctx.cleanup()
+						continue
+					}
+					data.Data = decompressed
+				}
+				ctx.bytesReceived += int64(len(data.Data))
+				a.touch(ctx)
 				ctx.send(data.Data)
 			}
 
+		case client.PacketType_CHECKPOINT:
+			checkpoint := pkt.GetCheckpoint()
+			util.V(util.LogAgentStream, 5).InfoS("received CHECKPOINT", "connectionID", checkpoint.ConnectID, "bytes", checkpoint.Bytes)
+			if ctx, ok := a.connManager.Get(checkpoint.ConnectID); ok {
+				verifyCheckpoint(ctx, checkpoint)
+			}
+
 		case client.PacketType_CLOSE_REQ:
 			closeReq := pkt.GetCloseRequest()
 			connID := closeReq.ConnectID
 
-			klog.V(4).InfoS("received CLOSE_REQ", "connectionID", connID)
+			util.V(util.LogAgentStream, 4).InfoS("received CLOSE_REQ", "connectionID", connID)
 
 			ctx, ok := a.connManager.Get(connID)
 			if ok {
 				ctx.cleanup()
 			} else {
-				klog.V(4).InfoS("Failed to find connection context for close", "connectionID", connID)
+				util.V(util.LogAgentStream, 4).InfoS("Failed to find connection context for close", "connectionID", connID)
 				resp := &client.Packet{
 					Type:    client.PacketType_CLOSE_RSP,
 					Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{}},
@@ -477,50 +904,123 @@ func (a *Client) Serve() {
 				}
 			}
 
+		case client.PacketType_ACK:
+			ack := pkt.GetAck()
+			util.V(util.LogAgentStream, 5).InfoS("received ACK", "connectionID", ack.ConnectID, "seq", ack.Seq, "retransmit", ack.Retransmit)
+			if ctx, ok := a.connManager.Get(ack.ConnectID); ok {
+				a.handleAck(ctx, ack)
+			}
+
+		case client.PacketType_NACK:
+			a.handleNack(pkt.GetNack())
+
+		case client.PacketType_HELLO:
+			a.handleHello(pkt.GetHello())
+
 		default:
-			klog.V(2).InfoS("unrecognized packet", "type", pkt)
+			if !a.handleUnknownPacket(pkt) {
+				return
+			}
 		}
 	}
 }
 
+// dial connects to the destination of a dial request, resolving its host
+// with the configured resolver if any. With Happy Eyeballs enabled, the
+// resolved addresses and the candidates of the request are raced.
+func (a *Client) dial(dialReq *client.DialRequest) (net.Conn, error) {
+	if translated := a.nat.translateDialRequest(dialReq); translated != dialReq {
+		util.V(util.LogAgentStream, 2).InfoS("Translated dial destination", "address", a.redactor.Address(dialReq.Address), "translated", a.redactor.Address(translated.Address), "dialID", dialReq.Random)
+		dialReq = translated
+	}
+	if a.dialer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.currentDialTimeout())
+		defer cancel()
+		return a.dialer(ctx, dialReq.Protocol, dialReq.Address)
+	}
+	if name := dialReq.Metadata[header.DialNetworkNamespace]; name != "" {
+		return a.dialInNetworkNamespace(name, dialReq)
+	}
+	if a.resolver == nil && a.happyEyeballs == nil {
+		return net.DialTimeout(dialReq.Protocol, dialReq.Address, a.currentDialTimeout())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.currentDialTimeout())
+	defer cancel()
+	if a.happyEyeballs != nil {
+		return a.happyEyeballs.DialContext(ctx, dialReq.Protocol, dialReq.Address, dialReq.Candidates)
+	}
+	return a.resolver.DialContext(ctx, dialReq.Protocol, dialReq.Address)
+}
+
+// destinationPort returns the port of the host:port address, for metrics.
+func destinationPort(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
 func (a *Client) remoteToProxy(connID int64, ctx *connContext) {
 	defer func() {
 		if panicInfo := recover(); panicInfo != nil {
-			klog.V(2).InfoS("Exiting remoteToProxy with recovery", "panicInfo", panicInfo, "connectionID", connID)
+			util.V(util.LogAgentStream, 2).InfoS("Exiting remoteToProxy with recovery", "panicInfo", panicInfo, "connectionID", connID)
 		} else {
-			klog.V(3).InfoS("Exiting remoteToProxy", "connectionID", connID)
+			util.V(util.LogAgentStream, 3).InfoS("Exiting remoteToProxy", "connectionID", connID)
 		}
 	}()
 	defer ctx.cleanup()
 
-	var buf [1 << 12]byte
+	buf := a.getBuffer()
+	defer a.putBuffer(buf)
 	resp := &client.Packet{
 		Type: client.PacketType_DATA,
 	}
 
 	for {
 		n, err := ctx.conn.Read(buf[:])
-		klog.V(5).InfoS("received data from remote", "bytes", n, "connectionID", connID)
+		util.V(util.LogAgentStream, 5).InfoS("received data from remote", "bytes", n, "connectionID", connID)
 
 		if err == io.EOF {
-			klog.V(2).InfoS("connection EOF", "connectionID", connID)
+			util.V(util.LogAgentStream, 2).InfoS("connection EOF", "connectionID", connID)
+			atomic.StoreInt32(&ctx.closeReason, int32(client.CloseReason_CLOSE_REASON_EOF))
 			return
 		} else if err != nil {
+			if errors.Is(err, syscall.ECONNRESET) {
+				util.V(util.LogAgentStream, 2).InfoS("connection reset by destination", "connectionID", connID)
+				atomic.StoreInt32(&ctx.closeReason, int32(client.CloseReason_CLOSE_REASON_RESET))
+				return
+			}
 			// "use of closed network connection" errors are expected upon receiving CLOSE_REQ
 			// If connID doesn't exist in connManager, we assume the connection was meant to be closed.
 			if _, ok := a.connManager.Get(connID); !ok {
-				klog.V(5).InfoS("reading from a closed connection", "connectionID", connID, "err", err)
+				util.V(util.LogAgentStream, 5).InfoS("reading from a closed connection", "connectionID", connID, "err", err)
 			} else {
 				klog.ErrorS(err, "connection read failure", "connectionID", connID)
 			}
 			return
 		} else {
+			metrics.Metrics.ObserveBytes(metrics.DirectionFromDestination, n)
+			a.touch(ctx)
+			data, compressed := buf[:n], false
+			if ctx.compression != "" {
+				if data, compressed, err = util.Compress(ctx.compression, data); err != nil {
+					klog.ErrorS(err, "failed to compress data, sending uncompressed", "connectionID", connID)
+					data, compressed = buf[:n], false
+				}
+			}
 			resp.Payload = &client.Packet_Data{Data: &client.Data{
-				Data:      buf[:n],
-				ConnectID: connID,
+				Data:       data,
+				ConnectID:  connID,
+				Compressed: compressed,
 			}}
+			if ctx.replay != nil {
+				ctx.replay.Add(resp)
+			}
 			if err := a.Send(resp); err != nil {
 				klog.ErrorS(err, "stream send failure", "connectionID", connID)
+			} else {
+				a.checkpointToServer(ctx, n)
 			}
 		}
 	}
@@ -529,9 +1029,9 @@ func (a *Client) remoteToProxy(connID int64, ctx *connContext) {
 func (a *Client) proxyToRemote(connID int64, ctx *connContext) {
 	defer func() {
 		if panicInfo := recover(); panicInfo != nil {
-			klog.V(2).InfoS("Exiting proxyToRemote with recovery", "panicInfo", panicInfo, "connectionID", connID)
+			util.V(util.LogAgentStream, 2).InfoS("Exiting proxyToRemote with recovery", "panicInfo", panicInfo, "connectionID", connID)
 		} else {
-			klog.V(3).InfoS("Exiting proxyToRemote", "connectionID", connID)
+			util.V(util.LogAgentStream, 3).InfoS("Exiting proxyToRemote", "connectionID", connID)
 		}
 	}()
 	defer ctx.cleanup()
@@ -540,8 +1040,9 @@ func (a *Client) proxyToRemote(connID int64, ctx *connContext) {
 		pos := 0
 		for {
 			n, err := ctx.conn.Write(d[pos:])
+			metrics.Metrics.ObserveBytes(metrics.DirectionToDestination, n)
 			if err == nil {
-				klog.V(4).InfoS("write to remote", "connectionID", connID, "lastData", n, "dataSize", len(d))
+				util.V(util.LogAgentStream, 4).InfoS("write to remote", "connectionID", connID, "lastData", n, "dataSize", len(d))
 				break
 			} else if n > 0 {
 				// https://golang.org/pkg/io/#Writer specifies return non nil error if n < len(d)
@@ -551,7 +1052,7 @@ func (a *Client) proxyToRemote(connID int64, ctx *connContext) {
 				// "use of closed network connection" errors are expected upon receiving CLOSE_REQ
 				// If connID doesn't exist in connManager, we assume the connection was meant to be closed.
 				if _, ok := a.connManager.Get(connID); !ok {
-					klog.V(5).InfoS("writing to a closed connection", "connectionID", connID, "err", err)
+					util.V(util.LogAgentStream, 5).InfoS("writing to a closed connection", "connectionID", connID, "err", err)
 				} else {
 					klog.ErrorS(err, "conn write failure", "connectionID", connID)
 				}
@@ -568,15 +1069,20 @@ func (a *Client) probe() {
 		case <-a.stopCh:
 			return
 		case <-time.After(a.probeInterval):
-			if a.conn == nil {
+			conn := a.currentConn()
+			if conn == nil {
 				continue
 			}
 			// health check
-			if a.conn.GetState() == connectivity.Ready {
+			if conn.GetState() == connectivity.Ready {
+				continue
+			}
+			// Serve resumes resumable sessions once the stream failed.
+			if a.sessionToken != "" {
 				continue
 			}
+			klog.V(1).InfoS("Removing client used for server connection", "state", conn.GetState(), "serverID", a.serverID)
 		}
-		klog.V(1).InfoS("Removing client used for server connection", "state", a.conn.GetState(), "serverID", a.serverID)
 		a.cs.RemoveClient(a.serverID)
 		return
 	}
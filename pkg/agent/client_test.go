@@ -10,9 +10,12 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
 
 func TestServeData_HTTP(t *testing.T) {
@@ -195,6 +198,222 @@ func TestClose_Client(t *testing.T) {
 
 }
 
+func TestUndecompressableData(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &Client{
+		connManager:           newConnectionManager(),
+		stopCh:                stopCh,
+		enableDataCompression: true,
+	}
+	testClient.stream, stream = pipe()
+
+	go testClient.Serve()
+	defer close(stopCh)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dialPacket := newDialPacket("tcp", ts.URL[len("http://"):], 111)
+	dialPacket.GetDialRequest().Compression = util.CompressionGzip
+	if err := stream.Send(dialPacket); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkg)
+	}
+	if compression := pkg.GetDialResponse().Compression; compression != util.CompressionGzip {
+		t.Fatalf("expect gzip compression; got %q", compression)
+	}
+	connID := pkg.GetDialResponse().ConnectID
+
+	dataPacket := newDataPacket(connID, []byte("not gzip"))
+	dataPacket.GetData().Compressed = true
+	if err := stream.Send(dataPacket); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %v", pkg)
+	}
+	if closeErr := pkg.GetCloseResponse().Error; !strings.Contains(closeErr, "failed to decompress") {
+		t.Errorf("expect the decompression error; got %q", closeErr)
+	}
+	if _, ok := testClient.connManager.Get(connID); ok {
+		t.Error("client.connContext not released")
+	}
+}
+
+func TestDataCheckpoints(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+	}
+	testClient.stream, stream = pipe()
+	ctx := &connContext{connID: 1, checkpointInterval: time.Hour}
+
+	// The first DATA is checkpointed right away, the next ones once the
+	// interval elapsed.
+	testClient.checkpointToServer(ctx, 10)
+	testClient.checkpointToServer(ctx, 20)
+	ctx.lastCheckpoint = time.Now().Add(-time.Hour)
+	testClient.checkpointToServer(ctx, 30)
+	for _, want := range []int64{10, 60} {
+		pkt, _ := stream.Recv()
+		if pkt == nil || pkt.Type != client.PacketType_CHECKPOINT {
+			t.Fatalf("expect PacketType_CHECKPOINT; got %v", pkt)
+		}
+		if checkpoint := pkt.GetCheckpoint(); checkpoint.ConnectID != 1 || checkpoint.Bytes != want {
+			t.Errorf("expect a checkpoint of %d bytes for connection 1; got %v", want, checkpoint)
+		}
+	}
+
+	ctx.bytesReceived = 100
+	verifyCheckpoint(ctx, &client.Checkpoint{ConnectID: 1, Bytes: 100})
+	if ctx.bytesReceived != 100 {
+		t.Errorf("expect 100 bytes received; got %d", ctx.bytesReceived)
+	}
+	// DATA was lost: the count is resynchronized with the server.
+	verifyCheckpoint(ctx, &client.Checkpoint{ConnectID: 1, Bytes: 150})
+	if ctx.bytesReceived != 150 {
+		t.Errorf("expect the count to be resynchronized to 150 bytes; got %d", ctx.bytesReceived)
+	}
+}
+
+// headerStream is a stream whose server sent header md.
+type headerStream struct {
+	agent.AgentService_ConnectClient
+	md metadata.MD
+}
+
+func (s *headerStream) Header() (metadata.MD, error) {
+	return s.md, nil
+}
+
+func TestResumeStream(t *testing.T) {
+	testClient := &Client{
+		connManager:  newConnectionManager(),
+		stopCh:       make(chan struct{}),
+		serverID:     "server",
+		sessionToken: "token",
+	}
+	// Connection 1 missed DATA 2 and 3 of the server, connection 2 missed
+	// evicted DATA.
+	replayed := &connContext{connID: 1, received: util.ReceiveWindow{Last: 5}, replay: util.NewReplayBuffer(1024)}
+	evicted := &connContext{connID: 2, replay: util.NewReplayBuffer(1)}
+	for i := 0; i < 3; i++ {
+		replayed.replay.Add(newDataPacket(1, []byte("a")))
+		evicted.replay.Add(newDataPacket(2, []byte("a")))
+	}
+	testClient.connManager.Add(1, replayed)
+	testClient.connManager.Add(2, evicted)
+
+	agentStream, serverStream := pipe()
+	resumedStream := &headerStream{agentStream, metadata.Pairs(header.ServerID, "server", header.SessionResumed, "true")}
+	type result struct {
+		cleanups []*connContext
+		err      error
+	}
+	resultCh := make(chan result)
+	go func() {
+		cleanups, err := testClient.resumeStream(resumedStream)
+		resultCh <- result{cleanups, err}
+	}()
+
+	pkt, _ := serverStream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_RESUME {
+		t.Fatalf("expect PacketType_RESUME; got %v", pkt)
+	}
+	lastSeqs := make(map[int64]int64)
+	for _, c := range pkt.GetResume().Connections {
+		lastSeqs[c.ConnectID] = c.LastSeq
+	}
+	if len(lastSeqs) != 2 || lastSeqs[1] != 5 || lastSeqs[2] != 0 {
+		t.Errorf("expect the agent to resume connections 1 and 2; got %v", lastSeqs)
+	}
+	serverStream.Send(&client.Packet{
+		Type: client.PacketType_RESUME,
+		Payload: &client.Packet_Resume{Resume: &client.Resume{Connections: []*client.ResumeConnection{
+			{ConnectID: 1, LastSeq: 1},
+			{ConnectID: 2, LastSeq: 0},
+		}}},
+	})
+	for _, want := range []int64{2, 3} {
+		pkt, _ := serverStream.Recv()
+		if pkt == nil || pkt.Type != client.PacketType_DATA || pkt.GetData().Seq != want {
+			t.Fatalf("expect DATA %d to be sent again; got %v", want, pkt)
+		}
+	}
+	res := <-resultCh
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.cleanups) != 1 || res.cleanups[0] != evicted {
+		t.Errorf("expect connection 2 to be closed; got %v", res.cleanups)
+	}
+
+	// Another server answered.
+	otherStream := &headerStream{agentStream, metadata.Pairs(header.ServerID, "other")}
+	if _, err := testClient.resumeStream(otherStream); !errors.Is(err, errSessionNotResumed) {
+		t.Errorf("expect %v; got %v", errSessionNotResumed, err)
+	}
+}
+
+func TestUnknownPacket(t *testing.T) {
+	unknown := &client.Packet{Type: client.PacketType(42)}
+
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &Client{
+		connManager:         newConnectionManager(),
+		stopCh:              stopCh,
+		unknownPacketPolicy: UnknownPacketNack,
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+	defer close(stopCh)
+
+	if err := stream.Send(unknown); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_NACK {
+		t.Fatalf("expect PacketType_NACK; got %v", pkg)
+	}
+	nack := pkg.GetNack()
+	if nack.Type != unknown.Type {
+		t.Errorf("expect NACK of packet type %v; got %v", unknown.Type, nack.Type)
+	}
+	if caps := strings.Join(nack.Capabilities, ","); !strings.Contains(caps, string(CapabilityNack)) {
+		t.Errorf("expect capabilities to include %q; got %q", CapabilityNack, caps)
+	}
+
+	// The close policy ends serving the proxy server.
+	// Serve removes the client from its clientset once it stops serving.
+	closingClient := &Client{
+		cs:                  &ClientSet{},
+		connManager:         newConnectionManager(),
+		stopCh:              make(chan struct{}),
+		unknownPacketPolicy: UnknownPacketClose,
+	}
+	closingClient.stream, stream = pipe()
+	served := make(chan struct{})
+	go func() {
+		closingClient.Serve()
+		close(served)
+	}()
+	if err := stream.Send(unknown); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("expect the client to stop serving after an unknown packet")
+	}
+}
+
 // fakeStream implements AgentService_ConnectClient
 type fakeStream struct {
 	grpc.ClientStream
@@ -261,3 +480,16 @@ func newClosePacket(connID int64) *client.Packet {
 		},
 	}
 }
+
+func TestDestinationPort(t *testing.T) {
+	for address, expected := range map[string]string{
+		"10.0.0.1:443":      "443",
+		"[fd00::1]:10250":   "10250",
+		"example.com:53":    "53",
+		"missing-port.test": "",
+	} {
+		if port := destinationPort(address); port != expected {
+			t.Errorf("expect port %q of %s; got %q", expected, address, port)
+		}
+	}
+}
@@ -19,12 +19,17 @@ package agent
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
 // ClientSet consists of clients connected to each instance of an HA proxy server.
@@ -51,6 +56,8 @@ type ClientSet struct {
 	serviceAccountTokenPath string
 	// channel to signal shutting down the client set. Primarily for test.
 	stopCh <-chan struct{}
+	// syncDone is closed once the sync loop stopped and closed the clients.
+	syncDone chan struct{}
 
 	agentIdentifiers string // The identifiers of the agent, which will be used
 	// by the server when choosing agent
@@ -58,6 +65,57 @@ type ClientSet struct {
 	warnOnChannelLimit bool
 
 	syncForever bool // Continue syncing (support dynamic server count).
+
+	enableDataCompression bool // Accept DATA compression requested by the server.
+
+	dialFailures *DialFailureRecorder // Recent dial failures, nil if disabled.
+
+	quarantine *DestinationQuarantine // Destinations whose dials keep failing, nil if disabled.
+
+	dialPolicy DialPolicy // Optional hook to reject dials.
+
+	nat NATTable // Translates the destinations of dials, empty if disabled.
+
+	dataChunkSize int // Size of DATA payloads, 0 probes the path to each server.
+
+	tracer *tracing.Tracer // Records spans of traced dials, nil disables tracing.
+
+	serverCounter ServerCounter // Counts the proxy server instances.
+
+	canary bool // Announce the agent as canary to the servers.
+
+	agentLabels string // Labels announced to the servers, e.g. zone=us-east-1a.
+
+	maxConnectionsPerServer int // Connection capacity announced to each server, 0 is unlimited.
+
+	resolver *Resolver // Resolves destination hostnames, nil uses the system resolver.
+
+	networkNamespaces map[string]string // Paths of the network namespaces dials may request by name.
+
+	happyEyeballs           bool          // Race the addresses of dual-stack destinations.
+	addressFamilyPreference AddressFamily // Address family raced first.
+	dialAttemptDelay        time.Duration // Delay between raced connection attempts.
+
+	redactor *util.Redactor // Redacts addresses and identifiers in logs, nil disables it.
+
+	unknownPacketPolicy UnknownPacketPolicy // Response to packets of unknown types.
+
+	sessionGrace     time.Duration // How long to try resuming a broken session, 0 disables it.
+	replayBufferSize int           // DATA payload bytes kept per connection until acknowledged.
+
+	maxProtocolVersion int // Highest protocol version announced to the servers.
+
+	dialer DestinationDialer // Dials the destinations, nil dials the network.
+
+	idleTimeout time.Duration // Close destination connections idle that long, 0 disables it.
+	idleWarning time.Duration // Warn the frontend that long before closing an idle connection.
+
+	preferTopologyHints bool              // Connect to the servers hinted in the agent's zone first.
+	topologyHints       map[string]string // Addresses of the hinted servers by ID, protected by mu.
+
+	overrides         atomic.Value // *Overrides tuned at runtime, see SetOverrides.
+	baseVerbosityOnce sync.Once
+	baseVerbosity     klog.Level // klog verbosity configured by flags.
 }
 
 func (cs *ClientSet) ClientsCount() int {
@@ -79,6 +137,12 @@ func (cs *ClientSet) HealthyClientsCount() int {
 
 }
 
+// DialFailures returns the recorder of recent dial failures, or nil if
+// recording is disabled.
+func (cs *ClientSet) DialFailures() *DialFailureRecorder {
+	return cs.dialFailures
+}
+
 func (cs *ClientSet) hasIDLocked(serverID string) bool {
 	_, ok := cs.clients[serverID]
 	return ok
@@ -134,6 +198,75 @@ type ClientSetConfig struct {
 	ServiceAccountTokenPath string
 	WarnOnChannelLimit      bool
 	SyncForever             bool
+	EnableDataCompression   bool
+	DialFailureHistory      int
+	DialPolicy              DialPolicy
+	DataChunkSize           int
+	Tracer                  *tracing.Tracer
+	// Quarantine fails the dials of destinations whose dials kept
+	// failing for a while, without dialing them.
+	Quarantine QuarantineConfig
+	// NAT translates the destinations of dials before they are dialed.
+	// Empty dials them as requested.
+	NAT NATTable
+	// ServerCounter counts the proxy server instances. Nil trusts the
+	// count reported by the proxy servers.
+	ServerCounter ServerCounter
+	// Canary announces the agent as canary, proxy servers with canary
+	// routing send a share of the dials through canary agents only.
+	Canary bool
+	// AgentLabels are the comma-separated key=value labels announced to
+	// the proxy servers, which route dials by label selector on them.
+	AgentLabels string
+	// MaxConnectionsPerServer is the number of connections the agent
+	// serves concurrently for each proxy server, announced to the servers
+	// which route further dials through other agents. 0 is unlimited.
+	MaxConnectionsPerServer int
+	// Resolver resolves the hostnames of dialed destinations. Nil uses
+	// the resolver of the agent's host.
+	Resolver *Resolver
+	// NetworkNamespaces are the paths of the network namespaces, by name,
+	// which dials may request to be made in. Dials requesting any other
+	// namespace are rejected.
+	NetworkNamespaces map[string]string
+	// HappyEyeballs races the addresses a destination resolves to and the
+	// candidates of its dial request as specified by RFC 8305, starting
+	// with AddressFamilyPreference and waiting DialAttemptDelay between
+	// connection attempts.
+	HappyEyeballs           bool
+	AddressFamilyPreference AddressFamily
+	DialAttemptDelay        time.Duration
+	// Redactor redacts destination addresses and agent identifiers in
+	// logs. Nil logs them as is.
+	Redactor *util.Redactor
+	// UnknownPacketPolicy is the response to packets of types the agent
+	// does not know, e.g. sent by newer proxy servers.
+	UnknownPacketPolicy UnknownPacketPolicy
+	// SessionGrace is how long the agent tries to resume its session with
+	// a proxy server after the stream broke, keeping its connections. 0
+	// disables resumption.
+	SessionGrace time.Duration
+	// ReplayBufferSize is the number of DATA payload bytes kept per
+	// connection until acknowledged, to be sent again when lost or when
+	// the session resumes.
+	ReplayBufferSize int
+	// MaxProtocolVersion is the highest protocol version announced to
+	// the proxy servers, 0 is ProtocolVersion.
+	MaxProtocolVersion int
+	// Dialer dials the destinations in place of the network, e.g. for
+	// simulated agents. Nil dials the network.
+	Dialer DestinationDialer
+	// IdleTimeout closes the destination connections without DATA in
+	// either direction for that long. 0 keeps idle connections open.
+	IdleTimeout time.Duration
+	// IdleWarning is how long before closing an idle connection the
+	// agent sends an IDLE_WARNING to its frontend, so that the client
+	// can refresh it. 0 closes idle connections without warning.
+	IdleWarning time.Duration
+	// PreferTopologyHints connects to the proxy servers the servers hint
+	// in the zone of the agent directly, before the servers behind
+	// Address.
+	PreferTopologyHints bool
 }
 
 func (cc *ClientSetConfig) NewAgentClientSet(stopCh <-chan struct{}) *ClientSet {
@@ -149,12 +282,39 @@ func (cc *ClientSetConfig) NewAgentClientSet(stopCh <-chan struct{}) *ClientSet
 		serviceAccountTokenPath: cc.ServiceAccountTokenPath,
 		warnOnChannelLimit:      cc.WarnOnChannelLimit,
 		syncForever:             cc.SyncForever,
+		enableDataCompression:   cc.EnableDataCompression,
+		dialFailures:            NewDialFailureRecorder(cc.DialFailureHistory),
+		quarantine:              NewDestinationQuarantine(cc.Quarantine),
+		dialPolicy:              cc.DialPolicy,
+		nat:                     cc.NAT,
+		dataChunkSize:           cc.DataChunkSize,
+		tracer:                  cc.Tracer,
+		serverCounter:           cc.ServerCounter,
+		canary:                  cc.Canary,
+		agentLabels:             cc.AgentLabels,
+		maxConnectionsPerServer: cc.MaxConnectionsPerServer,
+		resolver:                cc.Resolver,
+		networkNamespaces:       cc.NetworkNamespaces,
+		happyEyeballs:           cc.HappyEyeballs,
+		addressFamilyPreference: cc.AddressFamilyPreference,
+		dialAttemptDelay:        cc.DialAttemptDelay,
+		redactor:                cc.Redactor,
+		unknownPacketPolicy:     cc.UnknownPacketPolicy,
+		sessionGrace:            cc.SessionGrace,
+		replayBufferSize:        cc.ReplayBufferSize,
+		maxProtocolVersion:      cc.MaxProtocolVersion,
+		dialer:                  cc.Dialer,
+		idleTimeout:             cc.IdleTimeout,
+		idleWarning:             cc.IdleWarning,
+		preferTopologyHints:     cc.PreferTopologyHints,
+		topologyHints:           make(map[string]string),
 		stopCh:                  stopCh,
+		syncDone:                make(chan struct{}),
 	}
 }
 
-func (cs *ClientSet) newAgentClient() (*Client, int, error) {
-	return newAgentClient(cs.address, cs.agentID, cs.agentIdentifiers, cs, cs.dialOptions...)
+func (cs *ClientSet) newAgentClient(address string) (*Client, int, error) {
+	return newAgentClient(address, cs.agentID, cs.agentIdentifiers, cs, cs.dialOptions...)
 }
 
 func (cs *ClientSet) resetBackoff() *wait.Backoff {
@@ -169,6 +329,7 @@ func (cs *ClientSet) resetBackoff() *wait.Backoff {
 
 // sync makes sure that #clients >= #proxy servers
 func (cs *ClientSet) sync() {
+	defer close(cs.syncDone)
 	defer cs.shutdown()
 	backoff := cs.resetBackoff()
 	var duration time.Duration
@@ -187,21 +348,42 @@ func (cs *ClientSet) sync() {
 			backoff = cs.resetBackoff()
 			duration = wait.Jitter(backoff.Duration, backoff.Jitter)
 		}
-		time.Sleep(duration)
 		select {
 		case <-cs.stopCh:
 			return
-		default:
+		case <-time.After(duration):
 		}
 	}
 }
 
+// countServers returns the number of proxy server instances, given the
+// count suggested by a proxy server.
+func (cs *ClientSet) countServers(suggested int) int {
+	if cs.serverCounter == nil {
+		return suggested
+	}
+	return cs.serverCounter.CountServers(suggested)
+}
+
 func (cs *ClientSet) connectOnce() error {
+	// Server counters watching the proxy servers may report a new count
+	// before any server does.
+	cs.serverCount = cs.countServers(cs.serverCount)
 	if !cs.syncForever && cs.serverCount != 0 && cs.ClientsCount() >= cs.serverCount {
 		return nil
 	}
-	c, serverCount, err := cs.newAgentClient()
+	address := cs.address
+	hintedID, hintedAddress := cs.nextTopologyHint()
+	if hintedAddress != "" {
+		klog.V(2).InfoS("Connecting to a proxy server hinted in the zone of the agent", "serverID", hintedID, "address", hintedAddress)
+		address = hintedAddress
+	}
+	c, serverCount, err := cs.newAgentClient(address)
 	if err != nil {
+		if hintedAddress != "" {
+			cs.dropTopologyHint(hintedID)
+		}
+		metrics.Metrics.ObserveServerConnect(metrics.ServerConnectFailed)
 		return err
 	}
 	if cs.serverCount != 0 && cs.serverCount != serverCount {
@@ -209,17 +391,21 @@ func (cs *ClientSet) connectOnce() error {
 			"current", cs.serverCount, "serverID", c.serverID, "actual", serverCount)
 
 	}
-	cs.serverCount = serverCount
+	cs.serverCount = cs.countServers(serverCount)
 	if err := cs.AddClient(c.serverID, c); err != nil {
 		if dse, ok := err.(*DuplicateServerError); ok {
 			klog.V(4).InfoS("closing connection to duplicate server", "serverID", dse.ServerID)
+			metrics.Metrics.ObserveServerConnect(metrics.ServerDuplicate)
 		} else {
 			klog.ErrorS(err, "closing connection failure when adding a client")
+			metrics.Metrics.ObserveServerConnect(metrics.ServerConnectFailed)
 		}
 		c.Close()
 		return err
 	}
+	metrics.Metrics.ObserveServerConnect(metrics.ServerConnected)
 	klog.V(2).InfoS("sync added client connecting to proxy server", "serverID", c.serverID)
+	cs.addTopologyHints(c.topologyHints)
 	go c.Serve()
 	return nil
 }
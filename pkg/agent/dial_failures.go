@@ -0,0 +1,168 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxDialFailureDestinations bounds the number of destinations for which
+// dial failures are kept. The destination whose last failure is the oldest
+// is forgotten first.
+const maxDialFailureDestinations = 256
+
+// DialErrorClass is a coarse classification of a dial error.
+type DialErrorClass string
+
+const (
+	DialErrorTimeout     DialErrorClass = "timeout"
+	DialErrorRefused     DialErrorClass = "refused"
+	DialErrorUnreachable DialErrorClass = "unreachable"
+	DialErrorDNS         DialErrorClass = "dns"
+	DialErrorOther       DialErrorClass = "other"
+)
+
+// DialFailure describes a failed attempt to dial a destination on behalf of
+// the proxy server.
+type DialFailure struct {
+	Destination string         `json:"destination"`
+	Protocol    string         `json:"protocol"`
+	Class       DialErrorClass `json:"class"`
+	Error       string         `json:"error"`
+	Timestamp   time.Time      `json:"timestamp"`
+}
+
+// ClassifyDialError returns the DialErrorClass of err.
+func ClassifyDialError(err error) DialErrorClass {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return DialErrorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return DialErrorRefused
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return DialErrorUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DialErrorTimeout
+	}
+	return DialErrorOther
+}
+
+// DialFailureRecorder keeps the last few dial failures of each destination
+// for node-local debugging. A nil *DialFailureRecorder records nothing.
+type DialFailureRecorder struct {
+	mu       sync.Mutex
+	size     int
+	failures map[string][]DialFailure // destination -> oldest first
+}
+
+// NewDialFailureRecorder returns a recorder keeping the last size failures
+// per destination, or nil if size is not positive.
+func NewDialFailureRecorder(size int) *DialFailureRecorder {
+	if size <= 0 {
+		return nil
+	}
+	return &DialFailureRecorder{
+		size:     size,
+		failures: make(map[string][]DialFailure),
+	}
+}
+
+// Record stores a failed dial of address.
+func (r *DialFailureRecorder) Record(protocol, address string, err error) {
+	if r == nil {
+		return
+	}
+	failure := DialFailure{
+		Destination: address,
+		Protocol:    protocol,
+		Class:       ClassifyDialError(err),
+		Error:       err.Error(),
+		Timestamp:   time.Now(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring, ok := r.failures[address]
+	if !ok && len(r.failures) >= maxDialFailureDestinations {
+		r.evictOldestLocked()
+	}
+	if len(ring) >= r.size {
+		ring = append(ring[:0], ring[1:]...)
+	}
+	r.failures[address] = append(ring, failure)
+}
+
+func (r *DialFailureRecorder) evictOldestLocked() {
+	var oldest string
+	var oldestTime time.Time
+	for dest, ring := range r.failures {
+		last := ring[len(ring)-1].Timestamp
+		if oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = dest, last
+		}
+	}
+	delete(r.failures, oldest)
+}
+
+// List returns the recorded failures, most recent first. If destination is
+// non-empty only failures of that destination are returned.
+func (r *DialFailureRecorder) List(destination string) []DialFailure {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	var list []DialFailure
+	for dest, ring := range r.failures {
+		if destination == "" || destination == dest {
+			for i := len(ring) - 1; i >= 0; i-- {
+				list = append(list, ring[i])
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Timestamp.After(list[j].Timestamp)
+	})
+	return list
+}
+
+// ServeHTTP writes the recorded failures as JSON. The optional
+// "destination" query parameter restricts the output to one destination.
+func (r *DialFailureRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	failures := r.List(req.URL.Query().Get("destination"))
+	if failures == nil {
+		failures = []DialFailure{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(failures); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
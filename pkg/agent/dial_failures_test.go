@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyDialError(t *testing.T) {
+	testcases := []struct {
+		err  error
+		want DialErrorClass
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, DialErrorRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, DialErrorUnreachable},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "kubelet.invalid"}}, DialErrorDNS},
+		{&net.OpError{Op: "dial", Err: &timeoutError{}}, DialErrorTimeout},
+		{errors.New("boom"), DialErrorOther},
+	}
+	for _, tc := range testcases {
+		if got := ClassifyDialError(tc.err); got != tc.want {
+			t.Errorf("ClassifyDialError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDialFailureRecorder(t *testing.T) {
+	r := NewDialFailureRecorder(2)
+	for i := 0; i < 3; i++ {
+		r.Record("tcp", "10.0.0.1:10250", fmt.Errorf("failure %d", i))
+	}
+	r.Record("tcp", "10.0.0.2:10250", errors.New("other"))
+
+	got := r.List("10.0.0.1:10250")
+	if len(got) != 2 {
+		t.Fatalf("expected the last 2 failures, got %d", len(got))
+	}
+	if got[0].Error != "failure 2" || got[1].Error != "failure 1" {
+		t.Errorf("expected most recent failures first, got %q, %q", got[0].Error, got[1].Error)
+	}
+	if all := r.List(""); len(all) != 3 {
+		t.Errorf("expected 3 failures across destinations, got %d", len(all))
+	}
+
+	var disabled *DialFailureRecorder
+	disabled.Record("tcp", "10.0.0.1:10250", errors.New("ignored"))
+	if disabled.List("") != nil {
+		t.Error("expected nil recorder to record nothing")
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+// This file is the embedding API of the agent, for programs running it
+// in-process instead of as the proxy-agent binary. Options, Agent and the
+// functions and methods on them are kept backward compatible: fields and
+// methods may be added, but none are removed or change meaning without a
+// deprecation first. The ClientSet returned by Agent.ClientSet and the
+// rest of this package carry no such guarantee.
+
+const (
+	// defaultEmbeddedSyncInterval is the default interval between the
+	// connection syncs of embedded agents, as of the binary.
+	defaultEmbeddedSyncInterval = time.Second
+	// defaultEmbeddedSyncIntervalCap is the default cap of the backoff of
+	// the syncs of embedded agents, as of the binary.
+	defaultEmbeddedSyncIntervalCap = 10 * time.Second
+	// defaultEmbeddedProbeInterval is the default interval between the
+	// readiness probes of embedded agents, as of the binary.
+	defaultEmbeddedProbeInterval = time.Second
+)
+
+// Options configures an embedded Agent.
+type Options struct {
+	// ProxyServerAddress is the host:port of the agent endpoint of the
+	// proxy servers. It is required.
+	ProxyServerAddress string
+	// AgentID is the unique ID of the agent. It is required.
+	AgentID string
+	// AgentIdentifiers are the identifiers the proxy servers route dials
+	// by, e.g. "ipv4=10.0.0.1&host=node-1".
+	AgentIdentifiers string
+	// AgentLabels are the comma-separated key=value labels announced to
+	// the proxy servers, which route dials by label selector on them.
+	AgentLabels string
+	// MaxConnectionsPerServer is the number of connections the agent
+	// serves concurrently for each proxy server, 0 is unlimited.
+	MaxConnectionsPerServer int
+	// DialOptions are the options dialing the proxy servers, e.g. their
+	// transport credentials.
+	DialOptions []grpc.DialOption
+	// ServiceAccountTokenPath is the path of the token the agent
+	// authenticates with. Empty sends none.
+	ServiceAccountTokenPath string
+	// SyncInterval is how often the agent checks it is connected to all
+	// the proxy servers, 0 is 1s. SyncIntervalCap caps its backoff while
+	// failing to connect, 0 is 10s.
+	SyncInterval    time.Duration
+	SyncIntervalCap time.Duration
+	// ProbeInterval is how often the connections to the proxy servers are
+	// probed, 0 is 1s.
+	ProbeInterval time.Duration
+	// SyncForever keeps syncing once connected to all the proxy servers,
+	// following changes of their count.
+	SyncForever bool
+	// Dialer dials the destinations in place of the network. Nil dials
+	// the network.
+	Dialer DestinationDialer
+	// IdleTimeout closes the destination connections without DATA for
+	// that long, warning their frontend IdleWarning before. 0 keeps idle
+	// connections open.
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
+}
+
+// Agent is a proxy agent embedded in another program.
+type Agent struct {
+	clientSet *ClientSet
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+
+	// mu protects running.
+	mu      sync.Mutex
+	running bool
+}
+
+// New returns an embedded Agent configured with opts.
+func New(opts Options) (*Agent, error) {
+	if opts.ProxyServerAddress == "" {
+		return nil, fmt.Errorf("proxy server address is required")
+	}
+	if opts.AgentID == "" {
+		return nil, fmt.Errorf("agent ID is required")
+	}
+	for name, d := range map[string]time.Duration{
+		"sync interval":     opts.SyncInterval,
+		"sync interval cap": opts.SyncIntervalCap,
+		"probe interval":    opts.ProbeInterval,
+		"idle timeout":      opts.IdleTimeout,
+		"idle warning":      opts.IdleWarning,
+	} {
+		if d < 0 {
+			return nil, fmt.Errorf("%s %v must not be negative", name, d)
+		}
+	}
+	if opts.IdleTimeout > 0 && opts.IdleWarning >= opts.IdleTimeout {
+		return nil, fmt.Errorf("idle warning %v must be shorter than the idle timeout %v", opts.IdleWarning, opts.IdleTimeout)
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = defaultEmbeddedSyncInterval
+	}
+	if opts.SyncIntervalCap == 0 {
+		opts.SyncIntervalCap = defaultEmbeddedSyncIntervalCap
+	}
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = defaultEmbeddedProbeInterval
+	}
+
+	cc := &ClientSetConfig{
+		Address:                 opts.ProxyServerAddress,
+		AgentID:                 opts.AgentID,
+		AgentIdentifiers:        opts.AgentIdentifiers,
+		AgentLabels:             opts.AgentLabels,
+		MaxConnectionsPerServer: opts.MaxConnectionsPerServer,
+		DialOptions:             opts.DialOptions,
+		ServiceAccountTokenPath: opts.ServiceAccountTokenPath,
+		SyncInterval:            opts.SyncInterval,
+		SyncIntervalCap:         opts.SyncIntervalCap,
+		ProbeInterval:           opts.ProbeInterval,
+		SyncForever:             opts.SyncForever,
+		Dialer:                  opts.Dialer,
+		IdleTimeout:             opts.IdleTimeout,
+		IdleWarning:             opts.IdleWarning,
+	}
+	stopCh := make(chan struct{})
+	return &Agent{clientSet: cc.NewAgentClientSet(stopCh), stopCh: stopCh}, nil
+}
+
+// ClientSet returns the underlying client set, e.g. for its metrics of
+// the connections to the proxy servers. It is not covered by the
+// compatibility guarantees of the embedding API.
+func (a *Agent) ClientSet() *ClientSet {
+	return a.clientSet
+}
+
+// Ready reports if the agent has a healthy connection to a proxy server.
+func (a *Agent) Ready() bool {
+	return a.clientSet.HealthyClientsCount() > 0
+}
+
+// Run connects to the proxy servers and serves their dials until ctx is
+// done or Stop is called, then closes the connections. An Agent runs
+// once.
+func (a *Agent) Run(ctx context.Context) error {
+	a.mu.Lock()
+	if a.running {
+		a.mu.Unlock()
+		return fmt.Errorf("agent is already running")
+	}
+	a.running = true
+	a.mu.Unlock()
+
+	select {
+	case <-a.stopCh:
+		return nil
+	default:
+	}
+	a.clientSet.Serve()
+	klog.V(1).InfoS("Embedded agent started", "agentID", a.clientSet.agentID, "address", a.clientSet.address)
+	select {
+	case <-ctx.Done():
+		a.Stop()
+	case <-a.stopCh:
+	}
+	<-a.clientSet.syncDone
+	klog.V(1).InfoS("Embedded agent stopped", "agentID", a.clientSet.agentID)
+	return nil
+}
+
+// Stop stops Run. It may be called any number of times, also before Run,
+// which then returns at once.
+func (a *Agent) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stopCh)
+	})
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestNewOptions(t *testing.T) {
+	testcases := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "defaults", opts: Options{ProxyServerAddress: "127.0.0.1:8091", AgentID: "agent"}},
+		{name: "no address", opts: Options{AgentID: "agent"}, wantErr: true},
+		{name: "no agent ID", opts: Options{ProxyServerAddress: "127.0.0.1:8091"}, wantErr: true},
+		{name: "negative interval", opts: Options{ProxyServerAddress: "127.0.0.1:8091", AgentID: "agent", SyncInterval: -time.Second}, wantErr: true},
+		{name: "idle warning beyond timeout", opts: Options{ProxyServerAddress: "127.0.0.1:8091", AgentID: "agent", IdleTimeout: time.Minute, IdleWarning: time.Minute}, wantErr: true},
+		{name: "idle timeout", opts: Options{ProxyServerAddress: "127.0.0.1:8091", AgentID: "agent", IdleTimeout: time.Minute, IdleWarning: time.Second}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := New(tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expect an error; got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect no error; got %v", err)
+			}
+			cs := a.ClientSet()
+			if cs.syncInterval != defaultEmbeddedSyncInterval || cs.syncIntervalCap != defaultEmbeddedSyncIntervalCap || cs.probeInterval != defaultEmbeddedProbeInterval {
+				t.Errorf("expect default intervals; got sync %v, cap %v, probe %v", cs.syncInterval, cs.syncIntervalCap, cs.probeInterval)
+			}
+			if cs.idleTimeout != tc.opts.IdleTimeout || cs.idleWarning != tc.opts.IdleWarning {
+				t.Errorf("expect idle timeout %v and warning %v; got %v and %v", tc.opts.IdleTimeout, tc.opts.IdleWarning, cs.idleTimeout, cs.idleWarning)
+			}
+		})
+	}
+}
+
+func TestRunStop(t *testing.T) {
+	a, err := New(Options{
+		// Nothing listens on the port, the agent keeps retrying.
+		ProxyServerAddress: "127.0.0.1:1",
+		AgentID:            "agent",
+		DialOptions:        []grpc.DialOption{grpc.WithInsecure()},
+		SyncInterval:       10 * time.Millisecond,
+		SyncIntervalCap:    10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if a.Ready() {
+		t.Errorf("expect the agent not ready without proxy server; got ready")
+	}
+	a.Stop()
+	a.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expect Run to return nil; got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expect Run to return after Stop; got none")
+	}
+	if err := a.Run(context.Background()); err == nil {
+		t.Errorf("expect an error running the agent twice; got none")
+	}
+}
+
+func TestRunContextDone(t *testing.T) {
+	a, err := New(Options{ProxyServerAddress: "127.0.0.1:1", AgentID: "agent", DialOptions: []grpc.DialOption{grpc.WithInsecure()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expect Run to return nil; got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expect Run to return once the context is done; got none")
+	}
+}
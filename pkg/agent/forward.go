@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/connectivity"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// ForwardRule exposes a local listener of the agent whose connections are
+// tunneled through the proxy server to a destination on its network, e.g.
+// for cluster components to reach the apiserver.
+type ForwardRule struct {
+	// ListenAddress is the host:port the agent listens on.
+	ListenAddress string
+	// Destination is the host:port dialed by the proxy server, which
+	// must allow it.
+	Destination string
+}
+
+// ParseForwardRules parses comma-separated listen=destination rules, e.g.
+// 0.0.0.0:9443=kubernetes.default.svc:443.
+func ParseForwardRules(s string) ([]ForwardRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []ForwardRule
+	for _, rule := range strings.Split(s, ",") {
+		parts := strings.Split(rule, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rule %q is not of the form listen=destination", rule)
+		}
+		for _, address := range parts {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rule, err)
+			}
+		}
+		rules = append(rules, ForwardRule{ListenAddress: parts[0], Destination: parts[1]})
+	}
+	return rules, nil
+}
+
+// ServeForward listens on the address of rule until the client set is
+// stopped, forwarding the accepted connections through a connected proxy
+// server.
+func (cs *ClientSet) ServeForward(rule ForwardRule) error {
+	lis, err := net.Listen("tcp", rule.ListenAddress)
+	if err != nil {
+		return err
+	}
+	klog.V(1).InfoS("Forwarding local connections", "listenAddress", lis.Addr().String(), "destination", rule.Destination)
+	go func() {
+		<-cs.stopCh
+		lis.Close()
+	}()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				klog.V(2).InfoS("Stopped forwarding local connections", "listenAddress", rule.ListenAddress, "err", err)
+				return
+			}
+			go cs.forward(conn, rule.Destination)
+		}
+	}()
+	return nil
+}
+
+// forward tunnels conn to destination through a connected proxy server.
+func (cs *ClientSet) forward(conn net.Conn, destination string) {
+	defer conn.Close()
+	c := cs.forwardingClient()
+	if c == nil {
+		klog.V(2).InfoS("No proxy server to forward the connection through", "destination", destination)
+		return
+	}
+	if err := c.forward(conn, destination); err != nil {
+		klog.V(2).InfoS("Failed to forward connection", "serverID", c.serverID, "destination", destination, "err", err)
+	}
+}
+
+// forwardingClient returns a random client whose connection is ready, nil
+// if there is none.
+func (cs *ClientSet) forwardingClient() *Client {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var ready []*Client
+	for _, c := range cs.clients {
+		if conn := c.currentConn(); conn != nil && conn.GetState() == connectivity.Ready {
+			ready = append(ready, c)
+		}
+	}
+	if len(ready) == 0 {
+		return nil
+	}
+	return ready[rand.Intn(len(ready))]
+}
+
+// forward tunnels conn to destination on a Forward stream to the proxy
+// server.
+func (a *Client) forward(conn net.Conn, destination string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, err := a.streamContext(ctx, "")
+	if err != nil {
+		return err
+	}
+	stream, err := agent.NewAgentServiceClient(a.currentConn()).Forward(ctx)
+	if err != nil {
+		return err
+	}
+	dialReq := &client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: "tcp",
+			Address:  destination,
+			Random:   rand.Int63(),
+		}},
+	}
+	if err := stream.Send(dialReq); err != nil {
+		return err
+	}
+	pkt, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if pkt.Type != client.PacketType_DIAL_RSP {
+		return fmt.Errorf("expected DIAL_RSP, got %v", pkt.Type)
+	}
+	if errMsg := pkt.GetDialResponse().Error; errMsg != "" {
+		return fmt.Errorf("proxy server failed to dial: %s", errMsg)
+	}
+	connID := pkt.GetDialResponse().ConnectID
+	klog.V(3).InfoS("Forwarding connection", "serverID", a.serverID, "destination", destination, "connectionID", connID)
+
+	// The local connection is read until it is closed, then the proxy
+	// server is asked to close the destination connection.
+	go func() {
+		buf := a.getBuffer()
+		defer a.putBuffer(buf)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				data := &client.Packet{
+					Type: client.PacketType_DATA,
+					Payload: &client.Packet_Data{Data: &client.Data{
+						ConnectID: connID,
+						Data:      append([]byte(nil), buf[:n]...),
+					}},
+				}
+				if err := stream.Send(data); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		closeReq := &client.Packet{
+			Type:    client.PacketType_CLOSE_REQ,
+			Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connID}},
+		}
+		if err := stream.Send(closeReq); err == nil {
+			stream.CloseSend() /* #nosec G104 */
+		}
+	}()
+
+	for {
+		pkt, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch pkt.Type {
+		case client.PacketType_DATA:
+			if _, err := conn.Write(pkt.GetData().Data); err != nil {
+				return err
+			}
+		case client.PacketType_CLOSE_RSP:
+			return nil
+		}
+	}
+}
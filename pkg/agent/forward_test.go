@@ -0,0 +1,57 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseForwardRules(t *testing.T) {
+	testCases := []struct {
+		input     string
+		want      []ForwardRule
+		wantError bool
+	}{
+		{input: ""},
+		{
+			input: "0.0.0.0:9443=kubernetes.default.svc:443,127.0.0.1:8080=10.0.0.1:80",
+			want: []ForwardRule{
+				{ListenAddress: "0.0.0.0:9443", Destination: "kubernetes.default.svc:443"},
+				{ListenAddress: "127.0.0.1:8080", Destination: "10.0.0.1:80"},
+			},
+		},
+		{input: "0.0.0.0:9443", wantError: true},
+		{input: "0.0.0.0:9443=kubernetes", wantError: true},
+		{input: "9443=kubernetes:443", wantError: true},
+	}
+	for _, tc := range testCases {
+		rules, err := ParseForwardRules(tc.input)
+		if tc.wantError {
+			if err == nil {
+				t.Errorf("expect an error for %q; got %v", tc.input, rules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expect no error for %q; got %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(rules, tc.want) {
+			t.Errorf("expect %v for %q; got %v", tc.want, tc.input, rules)
+		}
+	}
+}
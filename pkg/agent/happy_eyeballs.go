@@ -0,0 +1,222 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// AddressFamily is an IP address family dials may prefer.
+type AddressFamily string
+
+const (
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+)
+
+// DefaultAttemptDelay is the delay between connection attempts recommended
+// by RFC 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// HappyEyeballsDialer dials TCP destinations with several addresses, e.g.
+// dual-stack ones, as specified by RFC 8305. The addresses are sorted
+// alternating address families, starting with the preferred one. Each
+// connection attempt starts AttemptDelay after the previous one, or as
+// soon as it failed, and the first connection established wins.
+type HappyEyeballsDialer struct {
+	// Prefer is the address family tried first, IPv6 if empty.
+	Prefer AddressFamily
+	// AttemptDelay is the delay before the next attempt while the previous
+	// one is pending, DefaultAttemptDelay if 0.
+	AttemptDelay time.Duration
+	// Resolver resolves hostnames, the system resolver is used if nil.
+	Resolver *Resolver
+}
+
+// DialContext connects to address on the named network. If the host of
+// address is a hostname, all addresses it resolves to are tried. The
+// candidates are further ip:port addresses of the destination tried as
+// well. Networks other than tcp dial the first address only.
+func (d *HappyEyeballsDialer) DialContext(ctx context.Context, network, address string, candidates []string) (net.Conn, error) {
+	addrs, err := d.addresses(ctx, address, candidates)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var nd net.Dialer
+	if len(addrs) == 1 || (network != "tcp" && network != "tcp4" && network != "tcp6") {
+		return nd.DialContext(ctx, network, addrs[0])
+	}
+	return d.race(ctx, network, sortAddresses(addrs, d.preferred()))
+}
+
+func (d *HappyEyeballsDialer) preferred() AddressFamily {
+	if d.Prefer == "" {
+		return AddressFamilyIPv6
+	}
+	return d.Prefer
+}
+
+// addresses returns the ip:port addresses of address and candidates,
+// without duplicates.
+func (d *HappyEyeballsDialer) addresses(ctx context.Context, address string, candidates []string) ([]string, error) {
+	addrs := []string{address}
+	host, port, err := net.SplitHostPort(address)
+	if err == nil && !isIPLiteral(host) {
+		var ips []string
+		if d.Resolver != nil {
+			ips, err = d.Resolver.LookupHost(ctx, host)
+		} else {
+			ips, err = net.DefaultResolver.LookupHost(ctx, host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		addrs = addrs[:0]
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	seen := make(map[string]bool, len(addrs)+len(candidates))
+	var unique []string
+	for _, addr := range append(addrs, candidates...) {
+		if !seen[addr] {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique, nil
+}
+
+// sortAddresses orders addrs alternating address families, starting with
+// prefer, and keeping the order within each family.
+func sortAddresses(addrs []string, prefer AddressFamily) []string {
+	var first, second []string
+	for _, addr := range addrs {
+		if addressFamily(addr) == prefer {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	sorted := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+func addressFamily(addr string) AddressFamily {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip, _ := util.ParseIPZone(host); ip != nil && ip.To4() == nil {
+		return AddressFamilyIPv6
+	}
+	return AddressFamilyIPv4
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race dials addrs as specified by RFC 8305 and returns the first
+// connection established, closing the others.
+func (d *HappyEyeballsDialer) race(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	delay := d.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	attempt := func(addr string) {
+		var nd net.Dialer
+		conn, err := nd.DialContext(ctx, network, addr)
+		results <- dialResult{conn, err}
+	}
+
+	next, pending := 0, 0
+	var firstErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closePending(results, pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next == len(addrs) && pending == 0 {
+				return nil, firstErr
+			}
+			if next < len(addrs) {
+				// Start the next attempt right away.
+				stopTimer(timer)
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = fmt.Errorf("dial %s: %v", addrs[0], ctx.Err())
+			}
+			go closePending(results, pending)
+			return nil, firstErr
+		}
+	}
+}
+
+// closePending closes the connections of the attempts still pending once
+// they complete.
+func closePending(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// stopTimer stops t and drains its channel, so that it can be Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
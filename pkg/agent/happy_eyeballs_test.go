@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	addrs := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "[fd00::1]:80", "[fd00::2]:80"}
+	testCases := []struct {
+		prefer AddressFamily
+		want   []string
+	}{
+		{
+			prefer: AddressFamilyIPv6,
+			want:   []string{"[fd00::1]:80", "10.0.0.1:80", "[fd00::2]:80", "10.0.0.2:80", "10.0.0.3:80"},
+		},
+		{
+			prefer: AddressFamilyIPv4,
+			want:   []string{"10.0.0.1:80", "[fd00::1]:80", "10.0.0.2:80", "[fd00::2]:80", "10.0.0.3:80"},
+		},
+	}
+	for _, tc := range testCases {
+		if got := sortAddresses(addrs, tc.prefer); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("prefer %s: expected %v, got %v", tc.prefer, tc.want, got)
+		}
+	}
+}
+
+func TestHappyEyeballsAddresses(t *testing.T) {
+	d := &HappyEyeballsDialer{}
+	got, err := d.addresses(context.Background(), "10.0.0.1:80", []string{"[fd00::1]:80", "10.0.0.1:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:80", "[fd00::1]:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestHappyEyeballsAddressesZoneLiteral(t *testing.T) {
+	d := &HappyEyeballsDialer{}
+	got, err := d.addresses(context.Background(), "[fe80::1%eth0]:80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[fe80::1%eth0]:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if family := addressFamily("[fe80::1%eth0]:80"); family != AddressFamilyIPv6 {
+		t.Errorf("expected %s, got %s", AddressFamilyIPv6, family)
+	}
+}
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// A closed port refuses connections right away.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+
+	d := &HappyEyeballsDialer{Prefer: AddressFamilyIPv4, AttemptDelay: time.Hour}
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", refused, []string{ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("expected connection to %s, got %s", ln.Addr(), got)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the next attempt to start once the previous one failed, took %v", elapsed)
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", refused, []string{refused}); err == nil {
+		t.Error("expected dialing a refused address to fail")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// features returns the features the agent advertises in its HELLO.
+func (a *Client) features() []string {
+	var features []string
+	if a.protocolVersion >= ProtocolVersionAck {
+		features = append(features, header.FeatureFlowControl)
+	}
+	if a.enableDataCompression {
+		features = append(features, header.FeatureCompression)
+	}
+	if a.sessionGrace > 0 {
+		features = append(features, header.FeatureResumption)
+	}
+	if a.idleTimeout > 0 && a.idleWarning > 0 {
+		features = append(features, header.FeatureIdleWarning)
+	}
+	return features
+}
+
+// helloPacket returns the HELLO the agent opens the stream with when it
+// speaks ProtocolVersionHello.
+func (a *Client) helloPacket() *client.Packet {
+	return &client.Packet{
+		Type: client.PacketType_HELLO,
+		Payload: &client.Packet_Hello{
+			Hello: &client.Hello{
+				ProtocolVersion: int32(a.protocolVersion),
+				Features:        a.features(),
+			},
+		},
+	}
+}
+
+// handleHello records the features advertised by the proxy server.
+func (a *Client) handleHello(hello *client.Hello) {
+	klog.V(2).InfoS("Proxy server said hello", "serverID", a.serverID, "protocolVersion", hello.ProtocolVersion, "features", hello.Features)
+	klog.InfoS("Negotiated features with proxy server", "serverID", a.serverID, "protocolVersion", a.protocolVersion, "features", NegotiatedFeatures(a.features(), hello.Features))
+	a.serverHello = true
+	a.serverFeatures = hello.Features
+	var idleWarnings int32
+	if a.serverSupports(header.FeatureIdleWarning) {
+		idleWarnings = 1
+	}
+	atomic.StoreInt32(&a.idleWarnings, idleWarnings)
+}
+
+// serverSupports reports whether the proxy server advertised feature.
+// Servers which did not say hello are assumed to support it, features
+// being gated by the capabilities of the agent then.
+func (a *Client) serverSupports(feature string) bool {
+	if !a.serverHello {
+		return true
+	}
+	for _, f := range a.serverFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiatedFeatures returns the features of local also advertised by the
+// peer, i.e. those used on the stream.
+func NegotiatedFeatures(local, remote []string) []string {
+	var features []string
+	for _, f := range local {
+		for _, r := range remote {
+			if f == r {
+				features = append(features, f)
+				break
+			}
+		}
+	}
+	return features
+}
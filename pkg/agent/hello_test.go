@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestHello(t *testing.T) {
+	testClient := &Client{protocolVersion: ProtocolVersionHello, enableDataCompression: true}
+	hello := testClient.helloPacket().GetHello()
+	if hello.ProtocolVersion != ProtocolVersionHello {
+		t.Errorf("expect protocol version %d; got %d", ProtocolVersionHello, hello.ProtocolVersion)
+	}
+	if e, a := []string{header.FeatureFlowControl, header.FeatureCompression}, hello.Features; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect features %v; got %v", e, a)
+	}
+
+	if !testClient.serverSupports(header.FeatureResumption) {
+		t.Error("expect servers which did not say hello to be assumed to support resumption")
+	}
+	testClient.handleHello(&client.Hello{ProtocolVersion: ProtocolVersionHello, Features: []string{header.FeatureCompression}})
+	if !testClient.serverSupports(header.FeatureCompression) {
+		t.Errorf("expect the server to support %s", header.FeatureCompression)
+	}
+	if testClient.serverSupports(header.FeatureResumption) {
+		t.Errorf("expect the server not to support %s", header.FeatureResumption)
+	}
+}
+
+func TestNegotiatedFeatures(t *testing.T) {
+	local := []string{header.FeatureUDP, header.FeatureFlowControl, header.FeatureCompression}
+	remote := []string{header.FeatureCompression, header.FeatureResumption, header.FeatureUDP}
+	if e, a := []string{header.FeatureUDP, header.FeatureCompression}, NegotiatedFeatures(local, remote); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect negotiated features %v; got %v", e, a)
+	}
+	if a := NegotiatedFeatures(local, nil); len(a) != 0 {
+		t.Errorf("expect no negotiated features with a peer advertising none; got %v", a)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// minIdleSweepInterval bounds how often idle connections are looked for.
+const minIdleSweepInterval = 100 * time.Millisecond
+
+// touch records DATA flowing on the connection, postponing its idle
+// timeout.
+func (a *Client) touch(ctx *connContext) {
+	if a.idleTimeout > 0 {
+		atomic.StoreInt64(&ctx.lastActive, time.Now().UnixNano())
+	}
+}
+
+// idleSweepInterval returns how often connections are looked for, a
+// fraction of the idle warning, or of the idle timeout without warning.
+func idleSweepInterval(timeout, warning time.Duration) time.Duration {
+	interval := timeout / 10
+	if warning > 0 && warning < timeout {
+		interval = warning / 4
+	}
+	if interval < minIdleSweepInterval {
+		return minIdleSweepInterval
+	}
+	return interval
+}
+
+// sweepIdleConnections closes the connections idle for idleTimeout until
+// the client stops.
+func (a *Client) sweepIdleConnections() {
+	if a.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(idleSweepInterval(a.idleTimeout, a.idleWarning))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case now := <-ticker.C:
+			a.sweepIdle(now)
+		}
+	}
+}
+
+// sweepIdle closes the connections idle for idleTimeout at now, and warns
+// the frontends of those to be closed within idleWarning.
+func (a *Client) sweepIdle(now time.Time) {
+	for _, ctx := range a.connManager.List() {
+		idle := now.Sub(time.Unix(0, atomic.LoadInt64(&ctx.lastActive)))
+		switch {
+		case idle >= a.idleTimeout:
+			util.V(util.LogAgentStream, 2).InfoS("Closing idle connection", "connectionID", ctx.connID, "idle", idle)
+			metrics.Metrics.ObserveIdleConnection(metrics.IdleClosed)
+			atomic.StoreInt32(&ctx.closeReason, int32(client.CloseReason_CLOSE_REASON_IDLE))
+			ctx.cleanup()
+		case a.idleWarning > 0 && idle >= a.idleTimeout-a.idleWarning:
+			if !ctx.idleWarned {
+				ctx.idleWarned = true
+				a.warnIdle(ctx, a.idleTimeout-idle)
+			}
+		default:
+			ctx.idleWarned = false
+		}
+	}
+}
+
+// warnIdle tells the frontend of ctx that the connection is closed in
+// closeIn unless DATA flows on it. Servers which did not advertise
+// FeatureIdleWarning in their HELLO are not warned.
+func (a *Client) warnIdle(ctx *connContext, closeIn time.Duration) {
+	if atomic.LoadInt32(&a.idleWarnings) == 0 {
+		return
+	}
+	util.V(util.LogAgentStream, 3).InfoS("Warning of idle connection", "connectionID", ctx.connID, "closeIn", closeIn)
+	metrics.Metrics.ObserveIdleConnection(metrics.IdleWarned)
+	warning := &client.Packet{
+		Type: client.PacketType_IDLE_WARNING,
+		Payload: &client.Packet_IdleWarning{IdleWarning: &client.IdleWarning{
+			ConnectID: ctx.connID,
+			CloseIn:   closeIn.Milliseconds(),
+		}},
+	}
+	if err := a.Send(warning); err != nil {
+		util.V(util.LogAgentStream, 2).InfoS("Failed to send IDLE_WARNING", "connectionID", ctx.connID, "err", err)
+	}
+}
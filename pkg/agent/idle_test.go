@@ -0,0 +1,120 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestSweepIdle(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		idleTimeout: 10 * time.Second,
+		idleWarning: 3 * time.Second,
+	}
+	testClient.stream, stream = pipe()
+	testClient.handleHello(&client.Hello{ProtocolVersion: ProtocolVersionHello, Features: []string{header.FeatureIdleWarning}})
+
+	var cleaned bool
+	ctx := &connContext{connID: 1, cleanFunc: func() { cleaned = true }}
+	base := time.Now()
+	atomic.StoreInt64(&ctx.lastActive, base.UnixNano())
+	testClient.connManager.Add(1, ctx)
+	pending := stream.(*fakeStream).r
+
+	testClient.sweepIdle(base.Add(5 * time.Second))
+	if len(pending) != 0 {
+		t.Fatalf("expect no warning before the idle warning; got %d packets", len(pending))
+	}
+
+	testClient.sweepIdle(base.Add(8 * time.Second))
+	pkt, _ := stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_IDLE_WARNING {
+		t.Fatalf("expect an IDLE_WARNING; got %v", pkt)
+	}
+	if warning := pkt.GetIdleWarning(); warning.ConnectID != 1 || warning.CloseIn != 2000 {
+		t.Errorf("expect connection 1 to be closed in 2000ms; got %v", warning)
+	}
+	testClient.sweepIdle(base.Add(9 * time.Second))
+	if len(pending) != 0 {
+		t.Fatalf("expect a single warning; got %d more packets", len(pending))
+	}
+
+	// DATA postpones the timeout, and the connection is warned again
+	// once it idles.
+	atomic.StoreInt64(&ctx.lastActive, base.Add(9*time.Second).UnixNano())
+	testClient.sweepIdle(base.Add(10 * time.Second))
+	if cleaned || len(pending) != 0 {
+		t.Fatal("expect an active connection to be left alone")
+	}
+	testClient.sweepIdle(base.Add(17 * time.Second))
+	if pkt, _ := stream.Recv(); pkt == nil || pkt.Type != client.PacketType_IDLE_WARNING {
+		t.Fatalf("expect another IDLE_WARNING; got %v", pkt)
+	}
+
+	testClient.sweepIdle(base.Add(19 * time.Second))
+	if !cleaned {
+		t.Fatal("expect the idle connection to be closed")
+	}
+	if reason := client.CloseReason(atomic.LoadInt32(&ctx.closeReason)); reason != client.CloseReason_CLOSE_REASON_IDLE {
+		t.Errorf("expect close reason %v; got %v", client.CloseReason_CLOSE_REASON_IDLE, reason)
+	}
+}
+
+func TestSweepIdleWithoutServerSupport(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		idleTimeout: 10 * time.Second,
+		idleWarning: 3 * time.Second,
+	}
+	testClient.stream, stream = pipe()
+
+	ctx := &connContext{connID: 1, cleanFunc: func() {}}
+	base := time.Now()
+	atomic.StoreInt64(&ctx.lastActive, base.UnixNano())
+	testClient.connManager.Add(1, ctx)
+
+	testClient.sweepIdle(base.Add(8 * time.Second))
+	if pending := stream.(*fakeStream).r; len(pending) != 0 {
+		t.Errorf("expect servers which did not advertise %s not to be warned; got %d packets", header.FeatureIdleWarning, len(pending))
+	}
+}
+
+func TestIdleSweepInterval(t *testing.T) {
+	testcases := []struct {
+		timeout, warning, want time.Duration
+	}{
+		{timeout: 10 * time.Minute, warning: 0, want: time.Minute},
+		{timeout: 10 * time.Minute, warning: 20 * time.Second, want: 5 * time.Second},
+		{timeout: time.Second, warning: 0, want: minIdleSweepInterval},
+	}
+	for _, tc := range testcases {
+		if got := idleSweepInterval(tc.timeout, tc.warning); got != tc.want {
+			t.Errorf("expect interval %v for timeout %v and warning %v; got %v", tc.want, tc.timeout, tc.warning, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// LeaseLabel labels the Leases held by agents. The proxy servers select
+// the agent Leases by it.
+const LeaseLabel = "konnectivity.io/agent-lease"
+
+// LeaseHolder holds and renews a Lease on behalf of an agent. While the
+// Lease is renewed the proxy servers consider the agent alive, regardless
+// of the state of its connections.
+type LeaseHolder struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	agentID   string
+	duration  time.Duration
+}
+
+// NewLeaseHolder returns a LeaseHolder for the Lease of agentID in
+// namespace, valid for duration after each renewal.
+func NewLeaseHolder(client kubernetes.Interface, namespace, agentID string, duration time.Duration) *LeaseHolder {
+	return &LeaseHolder{
+		client:    client,
+		namespace: namespace,
+		name:      leaseName(agentID),
+		agentID:   agentID,
+		duration:  duration,
+	}
+}
+
+// Run renews the Lease three times per lease duration until stopCh is
+// closed.
+func (h *LeaseHolder) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := h.renew(context.Background(), time.Now()); err != nil {
+			klog.ErrorS(err, "Failed to renew agent lease", "namespace", h.namespace, "lease", h.name)
+		}
+	}, h.duration/3, stopCh)
+}
+
+func (h *LeaseHolder) renew(ctx context.Context, now time.Time) error {
+	leases := h.client.CoordinationV1().Leases(h.namespace)
+	renewTime := metav1.NewMicroTime(now)
+	durationSeconds := int32(h.duration / time.Second)
+	lease, err := leases.Get(ctx, h.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   h.name,
+				Labels: map[string]string{LeaseLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &h.agentID,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &h.agentID
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// leaseName derives a valid object name from agentID, replacing the
+// characters not allowed in names.
+func leaseName(agentID string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(agentID))
+	name = "konnectivity-agent-" + strings.Trim(name, "-.")
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = name[:validation.DNS1123SubdomainMaxLength]
+	}
+	return strings.TrimRight(name, "-.")
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaseHolderRenews(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	h := NewLeaseHolder(client, "kube-system", "Node_1", 40*time.Second)
+	ctx := context.Background()
+	created := time.Now().Add(-time.Minute)
+	if err := h.renew(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+	renewed := time.Now()
+	if err := h.renew(ctx, renewed); err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := client.CoordinationV1().Leases("kube-system").Get(ctx, "konnectivity-agent-node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Labels[LeaseLabel] != "true" {
+		t.Errorf("expected label %s, got %v", LeaseLabel, lease.Labels)
+	}
+	if *lease.Spec.HolderIdentity != "Node_1" || *lease.Spec.LeaseDurationSeconds != 40 {
+		t.Errorf("unexpected lease spec %+v", lease.Spec)
+	}
+	if !lease.Spec.AcquireTime.Time.Equal(metav1.NewMicroTime(created).Time) || !lease.Spec.RenewTime.Time.Equal(metav1.NewMicroTime(renewed).Time) {
+		t.Errorf("expected acquire time %v and renew time %v, got %v and %v", created, renewed, lease.Spec.AcquireTime, lease.Spec.RenewTime)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package metrics
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -34,6 +35,31 @@ const (
 	// DirectionFromServer indicates that the agent attempts to receive a
 	// packet from the proxy server.
 	DirectionFromServer Direction = "from_server"
+	// DirectionToDestination and DirectionFromDestination indicate the
+	// bytes the agent writes to and reads from destination connections.
+	DirectionToDestination   Direction = "to_destination"
+	DirectionFromDestination Direction = "from_destination"
+
+	// DialSuccess, DialFailure, DialRejected and DialQuarantined are the
+	// result label values of dials: connected, failed, rejected by the
+	// dial policy and failed as their destination was quarantined.
+	DialSuccess     = "success"
+	DialFailure     = "failure"
+	DialRejected    = "rejected"
+	DialQuarantined = "quarantined"
+
+	// ServerConnected, ServerDuplicate and ServerConnectFailed are the
+	// result label values of the connections of the agent to proxy
+	// servers: connected, closed as already connected to the server, and
+	// failed.
+	ServerConnected     = "connected"
+	ServerDuplicate     = "duplicate"
+	ServerConnectFailed = "failed"
+
+	// IdleWarned and IdleClosed are the event label values of idle
+	// destination connections: warned about to the frontend, and closed.
+	IdleWarned = "warned"
+	IdleClosed = "closed"
 )
 
 var (
@@ -46,8 +72,20 @@ var (
 
 // AgentMetrics includes all the metrics of the proxy agent.
 type AgentMetrics struct {
-	latencies *prometheus.HistogramVec
-	failures  *prometheus.CounterVec
+	latencies   *prometheus.HistogramVec
+	failures    *prometheus.CounterVec
+	checkpoints *prometheus.CounterVec
+	resumptions *prometheus.CounterVec
+	gaps        prometheus.Counter
+	quarantines prometheus.Counter
+	quarantined prometheus.Counter
+	buildInfo   *prometheus.GaugeVec
+	dials       *prometheus.CounterVec
+	failedDials *prometheus.HistogramVec
+	openConns   prometheus.Gauge
+	bytes       *prometheus.CounterVec
+	connects    *prometheus.CounterVec
+	idle        *prometheus.CounterVec
 }
 
 // newAgentMetrics create a new AgentMetrics, configured with default metric names.
@@ -71,15 +109,142 @@ func newAgentMetrics() *AgentMetrics {
 		},
 		[]string{"direction"},
 	)
+	checkpoints := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "data_checkpoints_total",
+			Help:      "Count of byte-count checkpoints received from the proxy server, labeled by whether the bytes received on the connection matched (match or mismatch)",
+		},
+		[]string{"result"},
+	)
+	resumptions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "session_resumptions_total",
+			Help:      "Count of attempts to resume the session with a proxy server after the stream broke, labeled by the result (resumed or failed)",
+		},
+		[]string{"result"},
+	)
+	gaps := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "data_sequence_gaps_total",
+			Help:      "Count of gaps in the sequence numbers of DATA received from the proxy server, i.e. DATA lost on the way and requested again",
+		},
+	)
+	quarantines := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "destination_quarantines_total",
+			Help:      "Count of times a destination was quarantined after repeated failed dials",
+		},
+	)
+	quarantined := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "quarantined_dials_total",
+			Help:      "Count of dials failed without dialing their destination, as it was quarantined",
+		},
+	)
+	dials := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dials_total",
+			Help:      "Count of dials requested by the proxy server, labeled by the result (success, failure, rejected or quarantined) and the destination port",
+		},
+		[]string{"result", "port"},
+	)
+	failedDials := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "failed_dial_duration_seconds",
+			Help:      "Latency of failed dials to the remote endpoint in seconds",
+			Buckets:   latencyBuckets,
+		},
+		[]string{},
+	)
+	openConns := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "open_connections",
+			Help:      "Number of destination connections proxied by the agent",
+		},
+	)
+	bytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "destination_bytes_total",
+			Help:      "Count of bytes proxied to and from destination connections, labeled by the direction (to_destination or from_destination)",
+		},
+		[]string{"direction"},
+	)
+	connects := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "server_connects_total",
+			Help:      "Count of attempts to connect to a proxy server, including reconnects after a stream ended, labeled by the result (connected, duplicate or failed)",
+		},
+		[]string{"result"},
+	)
+	// buildInfo shares its name with the build info of the server, told
+	// apart by the component label.
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "konnectivity_build_info",
+			Help:        "Build of the running binary and the protocol it speaks, always 1",
+			ConstLabels: prometheus.Labels{"component": subsystem},
+		},
+		[]string{"version", "git_commit", "go_version", "protocol_version", "capabilities"},
+	)
+	idle := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "idle_connections_total",
+			Help:      "Count of destination connections idle for too long, labeled by the event (warned to the frontend or closed)",
+		},
+		[]string{"event"},
+	)
 	prometheus.MustRegister(failures)
 	prometheus.MustRegister(latencies)
-	return &AgentMetrics{failures: failures, latencies: latencies}
+	prometheus.MustRegister(checkpoints)
+	prometheus.MustRegister(resumptions)
+	prometheus.MustRegister(gaps)
+	prometheus.MustRegister(quarantines)
+	prometheus.MustRegister(quarantined)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(dials)
+	prometheus.MustRegister(failedDials)
+	prometheus.MustRegister(openConns)
+	prometheus.MustRegister(bytes)
+	prometheus.MustRegister(connects)
+	prometheus.MustRegister(idle)
+	return &AgentMetrics{failures: failures, latencies: latencies, checkpoints: checkpoints, resumptions: resumptions, gaps: gaps, quarantines: quarantines, quarantined: quarantined, buildInfo: buildInfo,
+		dials: dials, failedDials: failedDials, openConns: openConns, bytes: bytes, connects: connects, idle: idle}
 }
 
 // Reset resets the metrics.
 func (a *AgentMetrics) Reset() {
 	a.failures.Reset()
 	a.latencies.Reset()
+	a.checkpoints.Reset()
+	a.resumptions.Reset()
+	a.dials.Reset()
+	a.failedDials.Reset()
+	a.openConns.Set(0)
+	a.bytes.Reset()
+	a.connects.Reset()
+	a.idle.Reset()
 }
 
 // ObserveFailure records a failure to send to or receive from the proxy
@@ -92,3 +257,87 @@ func (a *AgentMetrics) ObserveFailure(direction Direction) {
 func (a *AgentMetrics) ObserveDialLatency(elapsed time.Duration) {
 	a.latencies.WithLabelValues().Observe(elapsed.Seconds())
 }
+
+// ObserveDataCheckpoint records a byte-count checkpoint received from the
+// proxy server, and whether it matched the bytes received.
+func (a *AgentMetrics) ObserveDataCheckpoint(match bool) {
+	result := "match"
+	if !match {
+		result = "mismatch"
+	}
+	a.checkpoints.WithLabelValues(result).Inc()
+}
+
+// ObserveSessionResumption records an attempt to resume the session with a
+// proxy server, and whether it succeeded.
+func (a *AgentMetrics) ObserveSessionResumption(resumed bool) {
+	result := "resumed"
+	if !resumed {
+		result = "failed"
+	}
+	a.resumptions.WithLabelValues(result).Inc()
+}
+
+// DataSequenceGapInc increments the number of gaps detected in the DATA
+// received from the proxy server.
+func (a *AgentMetrics) DataSequenceGapInc() {
+	a.gaps.Inc()
+}
+
+// DestinationQuarantineInc increments the number of times a destination
+// was quarantined.
+func (a *AgentMetrics) DestinationQuarantineInc() {
+	a.quarantines.Inc()
+}
+
+// QuarantinedDialInc increments the number of dials failed as their
+// destination was quarantined.
+func (a *AgentMetrics) QuarantinedDialInc() {
+	a.quarantined.Inc()
+}
+
+// SetBuildInfo records the build of the agent, the highest version of the
+// protocol it speaks and the capabilities it supports.
+func (a *AgentMetrics) SetBuildInfo(version, gitCommit, goVersion string, protocolVersion int, capabilities string) {
+	a.buildInfo.Reset()
+	a.buildInfo.WithLabelValues(version, gitCommit, goVersion, strconv.Itoa(protocolVersion), capabilities).Set(1)
+}
+
+// ObserveDial records a dial requested by the proxy server, labeled by the
+// result and the destination port.
+func (a *AgentMetrics) ObserveDial(result, port string) {
+	a.dials.WithLabelValues(result, port).Inc()
+}
+
+// ObserveFailedDialLatency records the latency of a failed dial to the
+// remote endpoint.
+func (a *AgentMetrics) ObserveFailedDialLatency(elapsed time.Duration) {
+	a.failedDials.WithLabelValues().Observe(elapsed.Seconds())
+}
+
+// OpenConnectionInc and OpenConnectionDec track the number of destination
+// connections proxied by the agent.
+func (a *AgentMetrics) OpenConnectionInc() {
+	a.openConns.Inc()
+}
+
+func (a *AgentMetrics) OpenConnectionDec() {
+	a.openConns.Dec()
+}
+
+// ObserveBytes records n bytes proxied to or from a destination
+// connection.
+func (a *AgentMetrics) ObserveBytes(direction Direction, n int) {
+	a.bytes.WithLabelValues(string(direction)).Add(float64(n))
+}
+
+// ObserveServerConnect records an attempt to connect to a proxy server.
+func (a *AgentMetrics) ObserveServerConnect(result string) {
+	a.connects.WithLabelValues(result).Inc()
+}
+
+// ObserveIdleConnection records an event of an idle destination
+// connection, IdleWarned or IdleClosed.
+func (a *AgentMetrics) ObserveIdleConnection(event string) {
+	a.idle.WithLabelValues(event).Inc()
+}
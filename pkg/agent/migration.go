@@ -0,0 +1,39 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import "sync/atomic"
+
+// newConnectionID reserves the next free connectID for a connection being
+// dialed. IDs kept by connections migrated to the agent are skipped.
+func (a *Client) newConnectionID() int64 {
+	for {
+		if connID := atomic.AddInt64(&a.nextConnID, 1); a.connManager.Reserve(connID) {
+			return connID
+		}
+	}
+}
+
+// reserveMigratedConnectionID reserves connID for a connection migrated to
+// the agent from another one, which the frontend still refers to by the
+// connectID that agent assigned. It returns false if connID is in use.
+func (a *Client) reserveMigratedConnectionID(connID int64) bool {
+	if connID <= 0 {
+		return false
+	}
+	return a.connManager.Reserve(connID)
+}
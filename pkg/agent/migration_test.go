@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestNewConnectionIDSkipsReserved(t *testing.T) {
+	testClient := &Client{connManager: newConnectionManager()}
+	if !testClient.reserveMigratedConnectionID(2) {
+		t.Fatal("expect connection ID 2 to be free")
+	}
+	if testClient.reserveMigratedConnectionID(2) {
+		t.Error("expect connection ID 2 to be in use")
+	}
+	if id := testClient.newConnectionID(); id != 1 {
+		t.Errorf("expect connection ID 1; got %d", id)
+	}
+	if id := testClient.newConnectionID(); id != 3 {
+		t.Errorf("expect connection ID 3; got %d", id)
+	}
+	testClient.connManager.Delete(2)
+	if !testClient.reserveMigratedConnectionID(2) {
+		t.Error("expect connection ID 2 to be free once deleted")
+	}
+}
+
+func TestResumeMigratedConnection(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      stopCh,
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+	defer close(stopCh)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dial := func(random, connID int64) *client.DialResponse {
+		pkt := newDialPacket("tcp", ln.Addr().String(), random)
+		pkt.GetDialRequest().Resume = &client.ResumeConnection{ConnectID: connID, BytesToAgent: 10, BytesFromAgent: 20}
+		if err := stream.Send(pkt); err != nil {
+			t.Fatal(err)
+		}
+		rsp, _ := stream.Recv()
+		if rsp == nil || rsp.Type != client.PacketType_DIAL_RSP {
+			t.Fatalf("expect DIAL_RSP; got %v", rsp)
+		}
+		return rsp.GetDialResponse()
+	}
+
+	resp := dial(111, 5)
+	if resp.Error != "" || !resp.Resumed || resp.ConnectID != 5 {
+		t.Fatalf("expect connection 5 to be resumed; got %v", resp)
+	}
+	if _, ok := testClient.connManager.Get(5); !ok {
+		t.Error("expect connection 5 to be served")
+	}
+
+	resp = dial(112, 5)
+	if resp.Error == "" || resp.Resumed {
+		t.Errorf("expect resuming connection 5 twice to fail; got %v", resp)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// NATRule translates the addresses within From to To, keeping the host
+// bits of the prefix of To. From and To must be of the same address family;
+// they may differ in size, e.g. 10.0.0.0/8 to 192.168.0.0/16 translates
+// 10.1.2.3 to 192.168.2.3.
+type NATRule struct {
+	From *net.IPNet
+	To   *net.IPNet
+}
+
+// NATTable is a static address translation table applied to the
+// destinations of dials before they are dialed, for clusters whose
+// control plane addresses nodes by a virtual range only the node can
+// translate. The rule with the longest From prefix matching a destination
+// applies.
+type NATTable []NATRule
+
+// ParseNATTable parses rules of the form from=to, e.g.
+// 10.0.0.0/8=192.168.0.0/16.
+func ParseNATTable(rules []string) (NATTable, error) {
+	var table NATTable
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("address translation %q must be from=to", rule)
+		}
+		_, from, err := net.ParseCIDR(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address translation %q: %v", rule, err)
+		}
+		_, to, err := net.ParseCIDR(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address translation %q: %v", rule, err)
+		}
+		if len(from.IP) != len(to.IP) {
+			return nil, fmt.Errorf("address translation %q must not change the address family", rule)
+		}
+		table = append(table, NATRule{From: from, To: to})
+	}
+	// Longest From prefix first.
+	sort.SliceStable(table, func(i, j int) bool {
+		oi, _ := table[i].From.Mask.Size()
+		oj, _ := table[j].From.Mask.Size()
+		return oi > oj
+	})
+	return table, nil
+}
+
+// translateIP returns the translation of ip, false if no rule matches.
+func (t NATTable) translateIP(ip net.IP) (net.IP, bool) {
+	for _, rule := range t {
+		if !rule.From.Contains(ip) {
+			continue
+		}
+		if v4 := ip.To4(); v4 != nil && len(rule.To.IP) == net.IPv4len {
+			ip = v4
+		}
+		translated := make(net.IP, len(rule.To.IP))
+		for i := range translated {
+			translated[i] = rule.To.IP[i] | ip[i]&^rule.To.Mask[i]
+		}
+		return translated, true
+	}
+	return nil, false
+}
+
+// Translate returns the translation of the host:port address, and whether
+// a rule matched. Hostnames are never translated. The zone of an IPv6
+// address is kept if it is translated to another IPv6 address.
+func (t NATTable) Translate(address string) (string, bool) {
+	if len(t) == 0 {
+		return address, false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, false
+	}
+	ip, zone := util.ParseIPZone(host)
+	if ip == nil {
+		return address, false
+	}
+	translated, ok := t.translateIP(ip)
+	if !ok {
+		return address, false
+	}
+	if translated.To4() != nil {
+		zone = ""
+	}
+	return net.JoinHostPort(util.JoinIPZone(translated, zone), port), true
+}
+
+// translateDialRequest returns dialReq with its address and candidates
+// translated, or dialReq itself if no rule matched.
+func (t NATTable) translateDialRequest(dialReq *client.DialRequest) *client.DialRequest {
+	address, translated := t.Translate(dialReq.Address)
+	candidates := make([]string, len(dialReq.Candidates))
+	for i, c := range dialReq.Candidates {
+		var ok bool
+		candidates[i], ok = t.Translate(c)
+		translated = translated || ok
+	}
+	if !translated {
+		return dialReq
+	}
+	copied := *dialReq
+	copied.Address = address
+	copied.Candidates = candidates
+	return &copied
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestNATTableTranslate(t *testing.T) {
+	table, err := ParseNATTable([]string{"10.0.0.0/8=192.168.0.0/16", "10.1.0.0/16=172.16.0.0/16", "fd00::/64=fd01::/64"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		address    string
+		expected   string
+		translated bool
+	}{
+		{"10.2.3.4:443", "192.168.3.4:443", true},
+		{"10.1.3.4:443", "172.16.3.4:443", true},
+		{"[fd00::10]:80", "[fd01::10]:80", true},
+		{"[fd00::10%eth0]:80", "[fd01::10%eth0]:80", true},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80", false},
+		{"11.0.0.1:443", "11.0.0.1:443", false},
+		{"kubernetes.default.svc:443", "kubernetes.default.svc:443", false},
+		{"10.2.3.4", "10.2.3.4", false},
+	} {
+		if a, ok := table.Translate(tc.address); a != tc.expected || ok != tc.translated {
+			t.Errorf("expect %s to translate to %s (%v); got %s (%v)", tc.address, tc.expected, tc.translated, a, ok)
+		}
+	}
+}
+
+func TestParseNATTableErrors(t *testing.T) {
+	for _, rule := range []string{"10.0.0.0/8", "10.0.0.0/8=nope", "10.0.0.0=192.168.0.0/16", "10.0.0.0/8=fd00::/64"} {
+		if _, err := ParseNATTable([]string{rule}); err == nil {
+			t.Errorf("expect %q to be rejected", rule)
+		}
+	}
+}
+
+func TestNATTableTranslateDialRequest(t *testing.T) {
+	table, err := ParseNATTable([]string{"10.0.0.0/8=192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dialReq := &client.DialRequest{Protocol: "tcp", Address: "example.com:443", Candidates: []string{"10.0.1.2:443"}, Random: 1}
+	translated := table.translateDialRequest(dialReq)
+	if translated == dialReq {
+		t.Fatal("expect a translated copy of the dial request")
+	}
+	if e, a := []string{"192.168.1.2:443"}, translated.Candidates; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect candidates %v; got %v", e, a)
+	}
+	if translated.Address != "example.com:443" || translated.Random != 1 || dialReq.Candidates[0] != "10.0.1.2:443" {
+		t.Errorf("expect the rest of the request to be kept and the original untouched; got %+v, %+v", translated, dialReq)
+	}
+
+	untouched := &client.DialRequest{Protocol: "tcp", Address: "11.0.0.1:443"}
+	if table.translateDialRequest(untouched) != untouched {
+		t.Error("expect dial requests without matches to be returned as is")
+	}
+	if NATTable(nil).translateDialRequest(untouched) != untouched {
+		t.Error("expect an empty table to return dial requests as is")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// NetworkNamespaceDir is where named network namespaces are mounted, e.g.
+// by "ip netns add".
+const NetworkNamespaceDir = "/var/run/netns"
+
+// ParseNetworkNamespaces parses comma-separated network namespaces which
+// dials may request, each a name, mounted in NetworkNamespaceDir, or a
+// name=path pair, e.g. vm1,vm2=/proc/1234/ns/net.
+func ParseNetworkNamespaces(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	namespaces := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		name, path := entry, ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			name, path = entry[:i], entry[i+1:]
+			if !filepath.IsAbs(path) {
+				return nil, fmt.Errorf("path of network namespace %q must be absolute, got %q", name, path)
+			}
+		} else {
+			path = filepath.Join(NetworkNamespaceDir, name)
+		}
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid network namespace name %q", name)
+		}
+		if _, ok := namespaces[name]; ok {
+			return nil, fmt.Errorf("network namespace %q is given twice", name)
+		}
+		namespaces[name] = filepath.Clean(path)
+	}
+	return namespaces, nil
+}
+
+// dialInNetworkNamespace dials the destination of dialReq inside the
+// network namespace name, if it is allowed. Hostnames are resolved in the
+// network namespace of the agent.
+func (a *Client) dialInNetworkNamespace(name string, dialReq *client.DialRequest) (net.Conn, error) {
+	path, ok := a.networkNamespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("network namespace %q is not allowed", name)
+	}
+	host, port, err := net.SplitHostPort(dialReq.Address)
+	if err != nil {
+		return nil, err
+	}
+	timeout := a.currentDialTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var addrs []string
+	if isIPLiteral(host) {
+		addrs = []string{host}
+	} else if a.resolver != nil {
+		if addrs, err = a.resolver.LookupHost(ctx, host); err != nil {
+			return nil, err
+		}
+	} else if addrs, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dialNetworkNamespace(path, dialReq.Protocol, net.JoinHostPort(addr, port), timeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
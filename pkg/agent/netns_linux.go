@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dialNetworkNamespace dials address from a thread switched into the network
+// namespace mounted at path. The socket stays in that namespace after the
+// thread switches back.
+func dialNetworkNamespace(path, network, address string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		conn, restored, err := dialInThreadNamespace(path, network, address, timeout)
+		if restored {
+			// a thread left in another namespace must not be reused, so it is
+			// only unlocked, and otherwise terminated with the goroutine
+			runtime.UnlockOSThread()
+		}
+		ch <- result{conn, err}
+	}()
+	r := <-ch
+	return r.conn, r.err
+}
+
+func dialInThreadNamespace(path, network, address string, timeout time.Duration) (conn net.Conn, restored bool, err error) {
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer orig.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open network namespace %s: %v", path, err)
+	}
+	defer target.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, true, fmt.Errorf("failed to enter network namespace %s: %v", path, err)
+	}
+	conn, err = net.DialTimeout(network, address, timeout)
+	if serr := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); serr != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, false, fmt.Errorf("failed to restore network namespace: %v", serr)
+	}
+	return conn, true, err
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestParseNetworkNamespaces(t *testing.T) {
+	testCases := []struct {
+		input     string
+		want      map[string]string
+		wantError bool
+	}{
+		{input: ""},
+		{
+			input: "vm1,vm2=/proc/1234/ns/net",
+			want:  map[string]string{"vm1": "/var/run/netns/vm1", "vm2": "/proc/1234/ns/net"},
+		},
+		{input: "vm1,vm1", wantError: true},
+		{input: "vm1=netns/vm1", wantError: true},
+		{input: "=/proc/1234/ns/net", wantError: true},
+		{input: "../vm1", wantError: true},
+	}
+	for _, tc := range testCases {
+		namespaces, err := ParseNetworkNamespaces(tc.input)
+		if tc.wantError {
+			if err == nil {
+				t.Errorf("expect an error for %q; got %v", tc.input, namespaces)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expect no error for %q; got %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(namespaces, tc.want) {
+			t.Errorf("expect %v for %q; got %v", tc.want, tc.input, namespaces)
+		}
+	}
+}
+
+func TestDialRejectsNetworkNamespaceNotAllowed(t *testing.T) {
+	a := &Client{networkNamespaces: map[string]string{"vm1": "/var/run/netns/vm1"}}
+	conn, err := a.dial(&client.DialRequest{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:80",
+		Metadata: map[string]string{header.DialNetworkNamespace: "vm2"},
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("expect the dial to be rejected")
+	}
+	if !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expect the namespace to be not allowed; got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// Keys of the overrides ConfigMap.
+const (
+	// OverrideVerbosity is the klog verbosity level, e.g. "5".
+	OverrideVerbosity = "v"
+	// OverrideDialTimeout is the timeout of dials to destinations, e.g.
+	// "10s".
+	OverrideDialTimeout = "dial-timeout"
+	// OverrideUnknownPacketPolicy is the response to packets of unknown
+	// types: "ignore", "nack" or "close".
+	OverrideUnknownPacketPolicy = "unknown-packet-policy"
+)
+
+// Overrides are settings of the agent tuned at runtime, e.g. to debug a
+// single node without editing the DaemonSet of all agents. Unset fields
+// keep the value configured by flags.
+type Overrides struct {
+	// Verbosity is the klog verbosity level, nil if not overridden.
+	Verbosity *klog.Level
+	// DialTimeout bounds dials to destinations, 0 if not overridden.
+	DialTimeout time.Duration
+	// UnknownPacketPolicy is the response to packets of unknown types,
+	// empty if not overridden.
+	UnknownPacketPolicy UnknownPacketPolicy
+}
+
+// ParseOverrides parses the data of an overrides ConfigMap. Unknown keys
+// are rejected, so that typos do not go unnoticed.
+func ParseOverrides(data map[string]string) (*Overrides, error) {
+	o := &Overrides{}
+	for key, value := range data {
+		switch key {
+		case OverrideVerbosity:
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 || v > util.MaxLogVerbosity {
+				return nil, fmt.Errorf("%s %q must be a verbosity level between 0 and %d", key, value, util.MaxLogVerbosity)
+			}
+			level := klog.Level(v)
+			o.Verbosity = &level
+		case OverrideDialTimeout:
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s %q must be a positive duration", key, value)
+			}
+			o.DialTimeout = d
+		case OverrideUnknownPacketPolicy:
+			policy := UnknownPacketPolicy(value)
+			if err := ValidateUnknownPacketPolicy(policy); err != nil {
+				return nil, err
+			}
+			o.UnknownPacketPolicy = policy
+		default:
+			return nil, fmt.Errorf("unknown override %q", key)
+		}
+	}
+	return o, nil
+}
+
+// SetOverrides applies o to the agent and its connections to the proxy
+// servers. Nil reverts to the settings configured by flags.
+func (cs *ClientSet) SetOverrides(o *Overrides) {
+	if o == nil {
+		o = &Overrides{}
+	}
+	cs.overrides.Store(o)
+	cs.baseVerbosityOnce.Do(func() {
+		cs.baseVerbosity = util.LogVerbosity()
+	})
+	verbosity := cs.baseVerbosity
+	if o.Verbosity != nil {
+		verbosity = *o.Verbosity
+	}
+	if util.LogVerbosity() != verbosity {
+		klog.InfoS("Setting log verbosity", "verbosity", verbosity)
+		if err := verbosity.Set(strconv.Itoa(int(verbosity))); err != nil {
+			klog.ErrorS(err, "Failed to set log verbosity", "verbosity", verbosity)
+		}
+	}
+}
+
+// currentOverrides returns the overrides applied to the agent, never nil.
+func (cs *ClientSet) currentOverrides() *Overrides {
+	if cs != nil {
+		if o, ok := cs.overrides.Load().(*Overrides); ok {
+			return o
+		}
+	}
+	return &Overrides{}
+}
+
+// currentDialTimeout returns the timeout of dials to destinations.
+func (a *Client) currentDialTimeout() time.Duration {
+	if d := a.cs.currentOverrides().DialTimeout; d > 0 {
+		return d
+	}
+	return dialTimeout
+}
+
+// currentUnknownPacketPolicy returns the response to packets of unknown
+// types.
+func (a *Client) currentUnknownPacketPolicy() UnknownPacketPolicy {
+	if policy := a.cs.currentOverrides().UnknownPacketPolicy; policy != "" {
+		return policy
+	}
+	return a.unknownPacketPolicy
+}
+
+// OverridesWatcher watches the ConfigMap holding the overrides of an
+// agent, typically named after its node.
+type OverridesWatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	apply     func(*Overrides)
+}
+
+// NewOverridesWatcher returns an OverridesWatcher passing the overrides
+// of the ConfigMap name in namespace to apply whenever it changes, and
+// nil once it is deleted.
+func NewOverridesWatcher(client kubernetes.Interface, namespace, name string, apply func(*Overrides)) *OverridesWatcher {
+	return &OverridesWatcher{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		apply:     apply,
+	}
+}
+
+// Start watches the ConfigMap until stopCh is closed.
+func (w *OverridesWatcher) Start(stopCh <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(w.client, 0,
+		informers.WithNamespace(w.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.name).String()
+		}))
+	factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: w.update,
+		UpdateFunc: func(_, obj interface{}) {
+			w.update(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err != nil || key != w.namespace+"/"+w.name {
+				return
+			}
+			klog.InfoS("Agent overrides deleted, reverting to flags", "namespace", w.namespace, "configMap", w.name)
+			w.apply(nil)
+		},
+	})
+	factory.Start(stopCh)
+}
+
+func (w *OverridesWatcher) update(obj interface{}) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok || configMap.Name != w.name {
+		return
+	}
+	o, err := ParseOverrides(configMap.Data)
+	if err != nil {
+		// Keep the previous overrides rather than half applying these.
+		klog.ErrorS(err, "Ignoring invalid agent overrides", "namespace", w.namespace, "configMap", w.name)
+		return
+	}
+	klog.InfoS("Applying agent overrides", "namespace", w.namespace, "configMap", w.name, "overrides", configMap.Data)
+	w.apply(o)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseOverrides(t *testing.T) {
+	o, err := ParseOverrides(map[string]string{
+		OverrideVerbosity:           "5",
+		OverrideDialTimeout:         "10s",
+		OverrideUnknownPacketPolicy: "close",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Verbosity == nil || *o.Verbosity != 5 || o.DialTimeout != 10*time.Second || o.UnknownPacketPolicy != UnknownPacketClose {
+		t.Errorf("unexpected overrides %+v", o)
+	}
+
+	for _, data := range []map[string]string{
+		{OverrideVerbosity: "loud"},
+		{OverrideDialTimeout: "-1s"},
+		{OverrideUnknownPacketPolicy: "drop"},
+		{"max-connections": "10"},
+	} {
+		if _, err := ParseOverrides(data); err == nil {
+			t.Errorf("expected overrides %v to be rejected", data)
+		}
+	}
+}
+
+func TestClientOverrides(t *testing.T) {
+	cs := &ClientSet{}
+	a := &Client{cs: cs, unknownPacketPolicy: UnknownPacketNack}
+	if a.currentDialTimeout() != dialTimeout || a.currentUnknownPacketPolicy() != UnknownPacketNack {
+		t.Fatal("expected the settings of the flags without overrides")
+	}
+
+	cs.SetOverrides(&Overrides{DialTimeout: time.Minute, UnknownPacketPolicy: UnknownPacketIgnore})
+	if a.currentDialTimeout() != time.Minute || a.currentUnknownPacketPolicy() != UnknownPacketIgnore {
+		t.Error("expected the overridden settings")
+	}
+
+	cs.SetOverrides(nil)
+	if a.currentDialTimeout() != dialTimeout || a.currentUnknownPacketPolicy() != UnknownPacketNack {
+		t.Error("expected the settings of the flags once the overrides are removed")
+	}
+}
+
+func TestOverridesWatcher(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "konnectivity-agent-node-a", Namespace: "kube-system"},
+		Data:       map[string]string{OverrideDialTimeout: "10s"},
+	}
+	other := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "konnectivity-agent-node-b", Namespace: "kube-system"},
+		Data:       map[string]string{OverrideDialTimeout: "20s"},
+	}
+	client := fake.NewSimpleClientset(configMap, other)
+
+	applied := make(chan *Overrides, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	NewOverridesWatcher(client, "kube-system", configMap.Name, func(o *Overrides) {
+		applied <- o
+	}).Start(stopCh)
+
+	next := func() *Overrides {
+		select {
+		case o := <-applied:
+			return o
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for overrides")
+			return nil
+		}
+	}
+	if o := next(); o == nil || o.DialTimeout != 10*time.Second {
+		t.Fatalf("expected a dial timeout of 10s, got %+v", o)
+	}
+
+	configMaps := client.CoreV1().ConfigMaps("kube-system")
+	configMap.Data = map[string]string{OverrideDialTimeout: "30s"}
+	if _, err := configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if o := next(); o == nil || o.DialTimeout != 30*time.Second {
+		t.Fatalf("expected a dial timeout of 30s, got %+v", o)
+	}
+
+	if err := configMaps.Delete(context.Background(), configMap.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if o := next(); o != nil {
+		t.Fatalf("expected the overrides to be removed, got %+v", o)
+	}
+}
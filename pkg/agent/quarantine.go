@@ -0,0 +1,185 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// maxQuarantineDestinations bounds the number of destinations whose dial
+// failures are counted. The destination whose last failure is the oldest
+// is forgotten first.
+const maxQuarantineDestinations = 1024
+
+// QuarantineConfig configures the quarantine of destinations whose dials
+// keep failing.
+type QuarantineConfig struct {
+	// Failures is the number of consecutive failed dials of a destination
+	// after which it is quarantined. 0 disables the quarantine.
+	Failures int
+	// Duration is how long a destination is first quarantined. The
+	// quarantine doubles, up to MaxDuration, each time a dial after it
+	// ended fails again. Failures older than MaxDuration are forgotten.
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// ErrQuarantined is the error of a dial of a quarantined destination, which
+// failed without the destination being dialed.
+type ErrQuarantined struct {
+	Destination string
+	// Failures is the number of consecutive failed dials of the
+	// destination, and Remaining how long it stays quarantined.
+	Failures  int
+	Remaining time.Duration
+}
+
+func (e *ErrQuarantined) Error() string {
+	return fmt.Sprintf("destination %s quarantined for %v after %d failed dials", e.Destination, e.Remaining.Round(time.Millisecond), e.Failures)
+}
+
+// quarantineEntry counts the failed dials of a destination.
+type quarantineEntry struct {
+	failures    int
+	lastFailure time.Time
+	// duration is the length of the last quarantine, which ends at until,
+	// 0 if the destination was not quarantined yet.
+	duration time.Duration
+	until    time.Time
+}
+
+// DestinationQuarantine fails the dials of destinations whose recent dials
+// kept failing fast, without waiting for them to time out again. A nil
+// *DestinationQuarantine quarantines nothing.
+type DestinationQuarantine struct {
+	config  QuarantineConfig
+	mu      sync.Mutex
+	entries map[string]*quarantineEntry
+}
+
+// NewDestinationQuarantine returns a DestinationQuarantine, or nil if the
+// quarantine is disabled.
+func NewDestinationQuarantine(config QuarantineConfig) *DestinationQuarantine {
+	if config.Failures <= 0 {
+		return nil
+	}
+	return &DestinationQuarantine{
+		config:  config,
+		entries: make(map[string]*quarantineEntry),
+	}
+}
+
+// Check returns an *ErrQuarantined if destination is quarantined at now.
+func (q *DestinationQuarantine) Check(destination string, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[destination]
+	if !ok || !now.Before(e.until) {
+		return nil
+	}
+	return &ErrQuarantined{Destination: destination, Failures: e.failures, Remaining: e.until.Sub(now)}
+}
+
+// Record accounts the result of a dial of destination at now. A successful
+// dial lifts the quarantine. Only the failures hinting at a dead
+// destination are counted, e.g. not those of dials rejected by the agent.
+func (q *DestinationQuarantine) Record(destination string, err error, now time.Time) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil {
+		delete(q.entries, destination)
+		return
+	}
+	if ClassifyDialError(err) == DialErrorOther {
+		return
+	}
+	e, ok := q.entries[destination]
+	if ok && q.staleLocked(e, now) {
+		ok = false
+	}
+	if !ok {
+		if _, tracked := q.entries[destination]; !tracked && len(q.entries) >= maxQuarantineDestinations {
+			q.evictOldestLocked(now)
+		}
+		e = &quarantineEntry{}
+		q.entries[destination] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	switch {
+	case e.duration > 0 && !now.Before(e.until):
+		// a dial after the quarantine ended failed again
+		e.duration *= 2
+		if e.duration > q.config.MaxDuration {
+			e.duration = q.config.MaxDuration
+		}
+	case e.duration == 0 && e.failures >= q.config.Failures:
+		e.duration = q.config.Duration
+	default:
+		return
+	}
+	e.until = now.Add(e.duration)
+	klog.V(2).InfoS("Quarantined destination after failed dials", "destination", destination, "failures", e.failures, "duration", e.duration)
+	metrics.Metrics.DestinationQuarantineInc()
+}
+
+// staleLocked reports whether the failures of e are forgotten at now.
+func (q *DestinationQuarantine) staleLocked(e *quarantineEntry, now time.Time) bool {
+	last := e.lastFailure
+	if e.until.After(last) {
+		last = e.until
+	}
+	return now.Sub(last) > q.config.MaxDuration
+}
+
+func (q *DestinationQuarantine) evictOldestLocked(now time.Time) {
+	var oldest string
+	var oldestTime time.Time
+	for dest, e := range q.entries {
+		if q.staleLocked(e, now) {
+			delete(q.entries, dest)
+			continue
+		}
+		if oldest == "" || e.lastFailure.Before(oldestTime) {
+			oldest, oldestTime = dest, e.lastFailure
+		}
+	}
+	if len(q.entries) >= maxQuarantineDestinations {
+		delete(q.entries, oldest)
+	}
+}
+
+// quarantineKey returns the key of a destination in the quarantine.
+func quarantineKey(protocol, address, networkNamespace string) string {
+	key := protocol + "://" + address
+	if networkNamespace != "" {
+		key += "@" + networkNamespace
+	}
+	return key
+}
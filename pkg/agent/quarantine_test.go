@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDestinationQuarantine(t *testing.T) {
+	q := NewDestinationQuarantine(QuarantineConfig{Failures: 3, Duration: time.Second, MaxDuration: 3 * time.Second})
+	refused := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	dest := quarantineKey("tcp", "10.0.0.1:10250", "")
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		q.Record(dest, refused, now)
+	}
+	// Failures not caused by the destination are not counted.
+	q.Record(dest, errors.New("dial rejected"), now)
+	if err := q.Check(dest, now); err != nil {
+		t.Fatalf("expected the destination not to be quarantined before 3 failures, got %v", err)
+	}
+	q.Record(dest, refused, now)
+	err := q.Check(dest, now.Add(500*time.Millisecond))
+	var quarantined *ErrQuarantined
+	if !errors.As(err, &quarantined) || quarantined.Failures != 3 || quarantined.Remaining != 500*time.Millisecond {
+		t.Fatalf("expected the destination to be quarantined for another 500ms, got %v", err)
+	}
+	if err := q.Check(quarantineKey("tcp", "10.0.0.1:10250", "vm1"), now); err != nil {
+		t.Errorf("expected the destination in another network namespace not to be quarantined, got %v", err)
+	}
+
+	// The quarantine doubles, up to the max duration, while dials after
+	// it keep failing.
+	now = now.Add(time.Second)
+	if err := q.Check(dest, now); err != nil {
+		t.Fatalf("expected the quarantine to end, got %v", err)
+	}
+	q.Record(dest, refused, now)
+	if err := q.Check(dest, now.Add(1999*time.Millisecond)); err == nil {
+		t.Error("expected the quarantine to double")
+	}
+	now = now.Add(2 * time.Second)
+	q.Record(dest, refused, now)
+	if err := q.Check(dest, now.Add(3*time.Second)); err != nil {
+		t.Errorf("expected the quarantine to be capped at the max duration, got %v", err)
+	}
+
+	// A successful dial lifts the quarantine.
+	q.Record(dest, nil, now)
+	if err := q.Check(dest, now); err != nil {
+		t.Errorf("expected a successful dial to lift the quarantine, got %v", err)
+	}
+
+	// Failures older than the max duration are forgotten.
+	q.Record(dest, refused, now)
+	q.Record(dest, refused, now)
+	q.Record(dest, refused, now.Add(4*time.Second))
+	if err := q.Check(dest, now.Add(4*time.Second)); err != nil {
+		t.Errorf("expected the old failures to be forgotten, got %v", err)
+	}
+}
+
+func TestDestinationQuarantineDisabled(t *testing.T) {
+	q := NewDestinationQuarantine(QuarantineConfig{})
+	if q != nil {
+		t.Fatal("expected no quarantine without failures")
+	}
+	q.Record("tcp://10.0.0.1:10250", &net.OpError{Op: "dial", Err: &timeoutError{}}, time.Now())
+	if err := q.Check("tcp://10.0.0.1:10250", time.Now()); err != nil {
+		t.Errorf("expected a nil quarantine to allow any dial, got %v", err)
+	}
+}
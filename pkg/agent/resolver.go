@@ -0,0 +1,213 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultDNSPort = "53"
+
+// ResolverConfig configures how the agent resolves the hostnames of the
+// destinations it dials, in place of the resolver of the agent's host.
+type ResolverConfig struct {
+	// Nameservers are the host[:port] of the DNS servers queried. The
+	// system resolver is queried if empty.
+	Nameservers []string
+	// Search are the domains tried in turn for names with less than Ndots
+	// dots, e.g. svc.cluster.local.
+	Search []string
+	// Ndots is the number of dots from which a name is tried as is before
+	// the Search domains.
+	Ndots int
+	// DomainNameservers are the nameservers queried for the names in each
+	// domain and its subdomains, instead of Nameservers. The longest
+	// matching domain wins.
+	DomainNameservers map[string][]string
+}
+
+// Validate checks that the nameservers are IP addresses with an optional
+// port.
+func (c *ResolverConfig) Validate() error {
+	if c.Ndots < 0 {
+		return fmt.Errorf("ndots %d must not be negative", c.Ndots)
+	}
+	for _, ns := range c.Nameservers {
+		if _, err := nameserverAddress(ns); err != nil {
+			return err
+		}
+	}
+	for domain, nameservers := range c.DomainNameservers {
+		if strings.Trim(domain, ".") == "" {
+			return fmt.Errorf("domain of nameservers %v must not be empty", nameservers)
+		}
+		for _, ns := range nameservers {
+			if _, err := nameserverAddress(ns); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nameserverAddress returns the host:port address of the nameserver ns,
+// defaulting to port 53.
+func nameserverAddress(ns string) (string, error) {
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		host, port = strings.Trim(ns, "[]"), defaultDNSPort
+	}
+	if !isIPLiteral(host) {
+		return "", fmt.Errorf("nameserver %q must be an IP address with an optional port", ns)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Resolver resolves and dials destinations as configured by a
+// ResolverConfig.
+type Resolver struct {
+	search   []string
+	ndots    int
+	resolver *net.Resolver
+	domains  []domainResolver // longest domain first
+}
+
+type domainResolver struct {
+	domain   string // fully qualified, e.g. "cluster.local."
+	resolver *net.Resolver
+}
+
+// NewResolver returns a Resolver configured by c.
+func NewResolver(c ResolverConfig) (*Resolver, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Resolver{
+		ndots:    c.Ndots,
+		resolver: net.DefaultResolver,
+	}
+	for _, domain := range c.Search {
+		if domain = fqdn(domain); domain != "." {
+			r.search = append(r.search, domain)
+		}
+	}
+	if len(c.Nameservers) > 0 {
+		r.resolver = newNetResolver(c.Nameservers)
+	}
+	for domain, nameservers := range c.DomainNameservers {
+		r.domains = append(r.domains, domainResolver{domain: fqdn(domain), resolver: newNetResolver(nameservers)})
+	}
+	sort.Slice(r.domains, func(i, j int) bool {
+		return len(r.domains[i].domain) > len(r.domains[j].domain)
+	})
+	return r, nil
+}
+
+// newNetResolver returns a resolver querying nameservers in turn, so that
+// retried queries go to the next nameserver.
+func newNetResolver(nameservers []string) *net.Resolver {
+	addrs := make([]string, len(nameservers))
+	for i, ns := range nameservers {
+		addrs[i], _ = nameserverAddress(ns)
+	}
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := addrs[int(atomic.AddUint32(&next, 1)-1)%len(addrs)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// names returns the fully qualified names tried for host, in order.
+func (r *Resolver) names(host string) []string {
+	if strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+	var names []string
+	asIs := strings.Count(host, ".") >= r.ndots
+	if asIs {
+		names = append(names, host+".")
+	}
+	for _, domain := range r.search {
+		names = append(names, host+"."+domain)
+	}
+	if !asIs {
+		names = append(names, host+".")
+	}
+	return names
+}
+
+// resolverFor returns the resolver queried for the fully qualified name.
+func (r *Resolver) resolverFor(name string) *net.Resolver {
+	for _, d := range r.domains {
+		if name == d.domain || strings.HasSuffix(name, "."+d.domain) {
+			return d.resolver
+		}
+	}
+	return r.resolver
+}
+
+// LookupHost returns the addresses of host, trying the names derived from
+// the search domains in turn until one resolves.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var lastErr error
+	for _, name := range r.names(host) {
+		addrs, err := r.resolverFor(name).LookupHost(ctx, name)
+		if err == nil && len(addrs) > 0 {
+			return addrs, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+// DialContext connects to address on the named network, resolving its host
+// with r and trying the resolved addresses in turn.
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || isIPLiteral(host) {
+		return d.DialContext(ctx, network, address)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverNames(t *testing.T) {
+	r, err := NewResolver(ResolverConfig{Search: []string{"svc.cluster.local", "cluster.local."}, Ndots: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		host string
+		want []string
+	}{
+		{"kubernetes.default", []string{"kubernetes.default.svc.cluster.local.", "kubernetes.default.cluster.local.", "kubernetes.default."}},
+		{"node-1.example.com", []string{"node-1.example.com.", "node-1.example.com.svc.cluster.local.", "node-1.example.com.cluster.local."}},
+		{"example.com.", []string{"example.com."}},
+	}
+	for _, tc := range testcases {
+		if got := r.names(tc.host); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("names(%q): expected %v, got %v", tc.host, tc.want, got)
+		}
+	}
+}
+
+func TestResolverConfigValidate(t *testing.T) {
+	for _, c := range []ResolverConfig{
+		{Nameservers: []string{"10.96.0.10"}},
+		{Nameservers: []string{"10.96.0.10:5353", "[fd00::10]:53", "fd00::10"}},
+		{DomainNameservers: map[string][]string{"cluster.local": {"10.96.0.10"}}},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", c, err)
+		}
+	}
+	for _, c := range []ResolverConfig{
+		{Nameservers: []string{"dns.example.com"}},
+		{DomainNameservers: map[string][]string{"": {"10.96.0.10"}}},
+		{Ndots: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
+
+func TestResolverDomainNameservers(t *testing.T) {
+	cluster := serveDNS(t, map[string]string{"kubernetes.default.svc.cluster.local.": "10.0.0.1"})
+	internal := serveDNS(t, map[string]string{"api.internal.cluster.local.": "10.0.0.2"})
+	r, err := NewResolver(ResolverConfig{
+		Search: []string{"svc.cluster.local"},
+		Ndots:  5,
+		DomainNameservers: map[string][]string{
+			"cluster.local":          {cluster},
+			"internal.cluster.local": {internal},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		host string
+		want string
+	}{
+		{"kubernetes.default", "10.0.0.1"},
+		{"api.internal.cluster.local", "10.0.0.2"},
+	}
+	for _, tc := range testcases {
+		addrs, err := r.LookupHost(context.Background(), tc.host)
+		if err != nil {
+			t.Errorf("LookupHost(%q): %v", tc.host, err)
+			continue
+		}
+		if len(addrs) != 1 || addrs[0] != tc.want {
+			t.Errorf("LookupHost(%q): expected [%s], got %v", tc.host, tc.want, addrs)
+		}
+	}
+}
+
+// serveDNS answers A queries for the names of records on a local UDP port
+// and returns its address. Other names are not found.
+func serveDNS(t *testing.T, records map[string]string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.RecursionAvailable = true
+			ip, ok := records[q.Name.String()]
+			if !ok {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			} else if q.Type == dnsmessage.TypeA {
+				var a [4]byte
+				copy(a[:], net.ParseIP(ip).To4())
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+					Body:   &dnsmessage.AResource{A: a},
+				}}
+			}
+			resp, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// ServerCounter counts the proxy server instances the agent connects to.
+type ServerCounter interface {
+	// CountServers returns the number of proxy server instances.
+	// suggested is the count reported by the proxy server the agent
+	// connected to most recently, 0 if unknown.
+	CountServers(suggested int) int
+}
+
+// HeaderServerCounter trusts the server count reported by the proxy
+// servers in the header of the Connect stream.
+type HeaderServerCounter struct{}
+
+func (HeaderServerCounter) CountServers(suggested int) int {
+	return suggested
+}
+
+// informerServerCounter counts proxy servers from the objects cached by an
+// informer, falling back to the suggested count while there are none.
+type informerServerCounter struct {
+	count func(now time.Time) (int, error)
+	kind  string
+}
+
+func (c *informerServerCounter) CountServers(suggested int) int {
+	count, err := c.count(time.Now())
+	if err != nil {
+		klog.ErrorS(err, "Failed to count proxy servers", "source", c.kind)
+		return suggested
+	}
+	if count == 0 {
+		return suggested
+	}
+	if suggested != 0 && count != suggested {
+		klog.V(2).InfoS("Server count differs from the count suggested by the server", "source", c.kind, "count", count, "suggested", suggested)
+	}
+	return count
+}
+
+// NewEndpointSliceServerCounter returns a ServerCounter counting the ready
+// endpoints of the EndpointSlices in namespace matching selector, e.g.
+// "kubernetes.io/service-name=konnectivity-server". The informer backing
+// the counter runs until stopCh is closed.
+func NewEndpointSliceServerCounter(client kubernetes.Interface, namespace, selector string, stopCh <-chan struct{}) (ServerCounter, error) {
+	factory, err := newServerCounterInformerFactory(client, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	lister := factory.Discovery().V1beta1().EndpointSlices().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	return &informerServerCounter{
+		kind: "endpointslice",
+		count: func(time.Time) (int, error) {
+			slices, err := lister.EndpointSlices(namespace).List(labels.Everything())
+			if err != nil {
+				return 0, err
+			}
+			return countReadyEndpoints(slices), nil
+		},
+	}, nil
+}
+
+// countReadyEndpoints counts the distinct addresses of ready endpoints.
+// An endpoint may be listed by more than one slice while it is moved.
+func countReadyEndpoints(slices []*discoveryv1beta1.EndpointSlice) int {
+	ready := make(map[string]bool)
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if len(endpoint.Addresses) > 0 {
+				ready[endpoint.Addresses[0]] = true
+			}
+		}
+	}
+	return len(ready)
+}
+
+// NewLeaseServerCounter returns a ServerCounter counting the unexpired
+// Leases in namespace matching selector. Each proxy server instance is
+// expected to hold and renew one such Lease.
+func NewLeaseServerCounter(client kubernetes.Interface, namespace, selector string, stopCh <-chan struct{}) (ServerCounter, error) {
+	factory, err := newServerCounterInformerFactory(client, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	lister := factory.Coordination().V1().Leases().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	return &informerServerCounter{
+		kind: "lease",
+		count: func(now time.Time) (int, error) {
+			leases, err := lister.Leases(namespace).List(labels.Everything())
+			if err != nil {
+				return 0, err
+			}
+			return countValidLeases(leases, now), nil
+		},
+	}, nil
+}
+
+// countValidLeases counts the leases which were renewed within their
+// lease duration.
+func countValidLeases(leases []*coordinationv1.Lease, now time.Time) int {
+	var count int
+	for _, lease := range leases {
+		if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiry) {
+			count++
+		}
+	}
+	return count
+}
+
+func newServerCounterInformerFactory(client kubernetes.Interface, namespace, selector string) (informers.SharedInformerFactory, error) {
+	if _, err := labels.Parse(selector); err != nil {
+		return nil, err
+	}
+	return informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = selector
+		}),
+	), nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpointSliceServerCounter(t *testing.T) {
+	notReady := false
+	slice := func(name, service string, addresses ...string) *discoveryv1beta1.EndpointSlice {
+		s := &discoveryv1beta1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kube-system",
+			Labels:    map[string]string{"kubernetes.io/service-name": service},
+		}}
+		for _, address := range addresses {
+			s.Endpoints = append(s.Endpoints, discoveryv1beta1.Endpoint{Addresses: []string{address}})
+		}
+		return s
+	}
+	unready := slice("konnectivity-server-unready", "konnectivity-server", "10.0.0.4")
+	unready.Endpoints[0].Conditions.Ready = &notReady
+	client := fake.NewSimpleClientset(
+		slice("konnectivity-server-a", "konnectivity-server", "10.0.0.1", "10.0.0.2"),
+		// 10.0.0.2 is being moved between slices.
+		slice("konnectivity-server-b", "konnectivity-server", "10.0.0.2", "10.0.0.3"),
+		unready,
+		slice("other", "other", "10.0.0.5"),
+	)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	counter, err := NewEndpointSliceServerCounter(client, "kube-system", "kubernetes.io/service-name=konnectivity-server", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counter.CountServers(1); got != 3 {
+		t.Errorf("expected 3 servers, got %d", got)
+	}
+}
+
+func TestLeaseServerCounter(t *testing.T) {
+	now := time.Now()
+	lease := func(name string, renewed time.Time) *coordinationv1.Lease {
+		duration := int32(30)
+		renewTime := metav1.NewMicroTime(renewed)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "kube-system",
+				Labels:    map[string]string{"k8s-app": "konnectivity-server"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				RenewTime:            &renewTime,
+				LeaseDurationSeconds: &duration,
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		lease("server-1", now),
+		lease("server-2", now.Add(-10*time.Second)),
+		lease("server-3", now.Add(-time.Minute)),
+	)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	counter, err := NewLeaseServerCounter(client, "kube-system", "k8s-app=konnectivity-server", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counter.CountServers(5); got != 2 {
+		t.Errorf("expected 2 servers, got %d", got)
+	}
+}
+
+func TestServerCounterFallsBackToSuggestedCount(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	counter, err := NewLeaseServerCounter(fake.NewSimpleClientset(), "kube-system", "k8s-app=konnectivity-server", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counter.CountServers(3); got != 3 {
+		t.Errorf("expected the suggested count 3 without leases, got %d", got)
+	}
+	if got := (HeaderServerCounter{}).CountServers(3); got != 3 {
+		t.Errorf("expected the suggested count 3, got %d", got)
+	}
+}
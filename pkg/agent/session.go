@@ -0,0 +1,171 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// errSessionNotResumed is returned when the proxy server did not resume
+// the session, e.g. because it expired or another server answered.
+var errSessionNotResumed = errors.New("session not resumed")
+
+// resumeSession reconnects to the proxy server after the stream broke,
+// and resumes the session until its grace period ends. Sends wait for the
+// session to resume. It returns false if the session is not resumable or
+// could not be resumed.
+func (a *Client) resumeSession() bool {
+	if a.sessionToken == "" || a.sessionGrace <= 0 || !a.serverSupports(header.FeatureResumption) {
+		return false
+	}
+	select {
+	case <-a.stopCh:
+		return false
+	default:
+	}
+
+	a.sendLock.Lock()
+	var cleanups []*connContext
+	defer func() {
+		a.sendLock.Unlock()
+		// Closing connections sends CLOSE_RSP.
+		for _, ctx := range cleanups {
+			go ctx.cleanup()
+		}
+	}()
+
+	klog.V(2).InfoS("Resuming session", "serverID", a.serverID)
+	deadline := time.Now().Add(a.sessionGrace)
+	backoff := wait.Backoff{
+		Steps:    math.MaxInt32,
+		Jitter:   0.1,
+		Factor:   1.5,
+		Duration: 100 * time.Millisecond,
+		Cap:      a.sessionGrace,
+	}
+	for {
+		var err error
+		if cleanups, err = a.resumeOnce(); err == nil {
+			klog.V(2).InfoS("Resumed session", "serverID", a.serverID)
+			metrics.Metrics.ObserveSessionResumption(true)
+			return true
+		}
+		klog.V(2).InfoS("Failed to resume session", "serverID", a.serverID, "err", err)
+		delay := backoff.Step()
+		if errors.Is(err, errSessionNotResumed) || time.Now().Add(delay).After(deadline) {
+			metrics.Metrics.ObserveSessionResumption(false)
+			return false
+		}
+		select {
+		case <-a.stopCh:
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// resumeOnce opens a Connect stream resuming the session, and replaces
+// the broken one with it. It returns the connections to close.
+func (a *Client) resumeOnce() ([]*connContext, error) {
+	conn, stream, err := a.dialServer(a.sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	cleanups, err := a.resumeStream(stream)
+	if err != nil {
+		conn.Close() /* #nosec G104 */
+		return nil, err
+	}
+	a.recvLock.Lock()
+	a.stream = stream
+	a.recvLock.Unlock()
+	if prev := a.setConn(conn); prev != nil {
+		prev.Close() /* #nosec G104 */
+	}
+	return cleanups, nil
+}
+
+// resumeStream exchanges RESUME packets with the proxy server on stream,
+// and sends again the DATA the server missed. It returns the connections
+// missing DATA evicted from the replay buffers, to be closed. The server
+// closes the connections one side does not know anymore.
+func (a *Client) resumeStream(stream agent.AgentService_ConnectClient) ([]*connContext, error) {
+	serverID, err := serverID(stream)
+	if err != nil {
+		return nil, err
+	}
+	if serverID != a.serverID {
+		return nil, fmt.Errorf("%w: connected to server %s", errSessionNotResumed, serverID)
+	}
+	if resumed, err := sessionResumed(stream); err != nil {
+		return nil, err
+	} else if !resumed {
+		return nil, errSessionNotResumed
+	}
+
+	resume := &client.Resume{}
+	for _, ctx := range a.connManager.List() {
+		resume.Connections = append(resume.Connections, &client.ResumeConnection{
+			ConnectID: ctx.connID,
+			LastSeq:   ctx.received.Last,
+		})
+	}
+	if err := stream.Send(&client.Packet{
+		Type:    client.PacketType_RESUME,
+		Payload: &client.Packet_Resume{Resume: resume},
+	}); err != nil {
+		return nil, err
+	}
+	pkt, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != client.PacketType_RESUME {
+		return nil, fmt.Errorf("expected RESUME from server, got %v", pkt.Type)
+	}
+
+	var cleanups []*connContext
+	for _, c := range pkt.GetResume().Connections {
+		ctx, ok := a.connManager.Get(c.ConnectID)
+		if !ok || ctx.replay == nil {
+			continue
+		}
+		packets, ok := ctx.replay.Since(c.LastSeq)
+		if !ok {
+			klog.V(2).InfoS("Closing connection missing data evicted from the replay buffer", "serverID", a.serverID, "connectionID", c.ConnectID)
+			cleanups = append(cleanups, ctx)
+			continue
+		}
+		for _, p := range packets {
+			if err := stream.Send(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cleanups, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// parseTopologyHints parses the comma separated serverID=address topology
+// hints of a proxy server, skipping malformed ones.
+func parseTopologyHints(s string) map[string]string {
+	hints := make(map[string]string)
+	for _, hint := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(hint), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		hints[parts[0]] = parts[1]
+	}
+	return hints
+}
+
+// topologyHints returns the topology hints the proxy server sent on the
+// stream, nil if none.
+func topologyHints(stream agent.AgentService_ConnectClient) map[string]string {
+	md, err := stream.Header()
+	if err != nil {
+		return nil
+	}
+	hints := md.Get(header.TopologyHints)
+	if len(hints) != 1 {
+		return nil
+	}
+	return parseTopologyHints(hints[0])
+}
+
+// addTopologyHints records the hinted proxy servers, if the agent prefers
+// them.
+func (cs *ClientSet) addTopologyHints(hints map[string]string) {
+	if !cs.preferTopologyHints || len(hints) == 0 {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for serverID, address := range hints {
+		if cs.topologyHints[serverID] != address {
+			klog.V(2).InfoS("Proxy server hinted in the zone of the agent", "serverID", serverID, "address", address)
+		}
+		cs.topologyHints[serverID] = address
+	}
+}
+
+// nextTopologyHint returns the ID and address of a hinted proxy server the
+// agent is not connected to, empty if there is none.
+func (cs *ClientSet) nextTopologyHint() (string, string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var serverIDs []string
+	for serverID := range cs.topologyHints {
+		if !cs.hasIDLocked(serverID) {
+			serverIDs = append(serverIDs, serverID)
+		}
+	}
+	if len(serverIDs) == 0 {
+		return "", ""
+	}
+	sort.Strings(serverIDs)
+	return serverIDs[0], cs.topologyHints[serverIDs[0]]
+}
+
+// dropTopologyHint forgets the hinted proxy server the agent failed to
+// connect to, until a server hints it again.
+func (cs *ClientSet) dropTopologyHint(serverID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.topologyHints, serverID)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTopologyHints(t *testing.T) {
+	testcases := []struct {
+		hints string
+		want  map[string]string
+	}{
+		{hints: "", want: map[string]string{}},
+		{hints: "server-a=10.0.1.1:8091", want: map[string]string{"server-a": "10.0.1.1:8091"}},
+		{hints: "server-a=10.0.1.1:8091, server-b=10.0.1.2:8091", want: map[string]string{"server-a": "10.0.1.1:8091", "server-b": "10.0.1.2:8091"}},
+		{hints: "server-a,=10.0.1.2:8091,server-c=", want: map[string]string{}},
+	}
+	for _, tc := range testcases {
+		if got := parseTopologyHints(tc.hints); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseTopologyHints(%q): expect %v; got %v", tc.hints, tc.want, got)
+		}
+	}
+}
+
+func TestNextTopologyHint(t *testing.T) {
+	cs := (&ClientSetConfig{}).NewAgentClientSet(make(chan struct{}))
+	cs.addTopologyHints(map[string]string{"server-a": "10.0.1.1:8091"})
+	if id, address := cs.nextTopologyHint(); id != "" || address != "" {
+		t.Errorf("expect no hint without preference; got %s at %s", id, address)
+	}
+
+	cs.preferTopologyHints = true
+	cs.addTopologyHints(map[string]string{"server-b": "10.0.1.2:8091", "server-a": "10.0.1.1:8091"})
+	if id, address := cs.nextTopologyHint(); id != "server-a" || address != "10.0.1.1:8091" {
+		t.Errorf("expect server-a at 10.0.1.1:8091; got %s at %s", id, address)
+	}
+	cs.clients["server-a"] = &Client{serverID: "server-a"}
+	if id, address := cs.nextTopologyHint(); id != "server-b" || address != "10.0.1.2:8091" {
+		t.Errorf("expect server-b at 10.0.1.2:8091; got %s at %s", id, address)
+	}
+	cs.dropTopologyHint("server-b")
+	if id, address := cs.nextTopologyHint(); id != "" || address != "" {
+		t.Errorf("expect no hint once all connected or dropped; got %s at %s", id, address)
+	}
+}
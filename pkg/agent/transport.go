@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// TransportType selects how the agent carries its gRPC stream to the proxy server.
+type TransportType string
+
+const (
+	// TransportGRPC dials the proxy server agent port directly with gRPC over TLS.
+	TransportGRPC TransportType = "grpc"
+	// TransportWebSocket tunnels the gRPC stream through a WebSocket over TLS,
+	// for networks where only HTTP/1.1 egress is permitted.
+	TransportWebSocket TransportType = "websocket"
+)
+
+// webSocketPath must match the path served by the proxy server.
+const webSocketPath = "/agent"
+
+// NewTransportDialer returns a dialer suitable for grpc.WithContextDialer.
+// When egressProxy is non-nil, connections are tunneled through it with HTTP
+// CONNECT. For TransportWebSocket the returned connection is already TLS
+// protected using tlsConfig, so the gRPC connection must not add transport
+// credentials of its own.
+func NewTransportDialer(transport TransportType, egressProxy *url.URL, tlsConfig *tls.Config) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if egressProxy != nil {
+			conn, err = util.DialThroughHTTPProxy(ctx, egressProxy, addr)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, "tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if transport != TransportWebSocket {
+			return conn, nil
+		}
+		return upgradeWebSocket(ctx, conn, addr, tlsConfig)
+	}
+}
+
+func upgradeWebSocket(ctx context.Context, conn net.Conn, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	cfg := tlsConfig.Clone()
+	// WebSocket upgrades require HTTP/1.1.
+	cfg.NextProtos = []string{"http/1.1"}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close() /* #nosec G104 */
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("websocket TLS handshake with %s failed: %v", addr, err)
+	}
+
+	wsConfig, err := websocket.NewConfig("wss://"+addr+webSocketPath, "https://"+addr)
+	if err != nil {
+		tlsConn.Close() /* #nosec G104 */
+		return nil, err
+	}
+	ws, err := websocket.NewClient(wsConfig, tlsConn)
+	if err != nil {
+		tlsConn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("websocket upgrade with %s failed: %v", addr, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// UnknownPacketPolicy is how the agent responds to packets of a type it
+// does not know, e.g. sent by a newer proxy server.
+type UnknownPacketPolicy string
+
+const (
+	// UnknownPacketIgnore logs and drops the packet.
+	UnknownPacketIgnore UnknownPacketPolicy = "ignore"
+	// UnknownPacketNack answers the packet with a NACK listing the
+	// capabilities of the agent, so that the server can fall back.
+	UnknownPacketNack UnknownPacketPolicy = "nack"
+	// UnknownPacketClose closes the connection to the proxy server.
+	UnknownPacketClose UnknownPacketPolicy = "close"
+)
+
+// ValidateUnknownPacketPolicy returns an error if policy is unknown.
+func ValidateUnknownPacketPolicy(policy UnknownPacketPolicy) error {
+	switch policy {
+	case UnknownPacketIgnore, UnknownPacketNack, UnknownPacketClose:
+		return nil
+	}
+	return fmt.Errorf("unknown packet policy %q must be %q, %q or %q", policy, UnknownPacketIgnore, UnknownPacketNack, UnknownPacketClose)
+}
+
+// handleUnknownPacket responds to pkt of an unknown type according to the
+// unknown packet policy. It returns false if the connection to the proxy
+// server must be closed.
+func (a *Client) handleUnknownPacket(pkt *client.Packet) bool {
+	switch a.currentUnknownPacketPolicy() {
+	case UnknownPacketClose:
+		klog.V(2).InfoS("Closing the connection to the proxy server after an unrecognized packet", "type", pkt.Type, "serverID", a.serverID)
+		return false
+	case UnknownPacketNack:
+		klog.V(2).InfoS("Answering an unrecognized packet with NACK", "type", pkt.Type, "serverID", a.serverID)
+		nack := &client.Packet{
+			Type: client.PacketType_NACK,
+			Payload: &client.Packet_Nack{
+				Nack: &client.Nack{
+					Type:         pkt.Type,
+					Capabilities: capabilityStrings(a.capabilities()),
+				},
+			},
+		}
+		if err := a.Send(nack); err != nil {
+			klog.ErrorS(err, "NACK send failure", "serverID", a.serverID)
+		}
+	default:
+		klog.V(2).InfoS("unrecognized packet", "type", pkt)
+	}
+	return true
+}
+
+// handleNack logs a NACK of the proxy server, answering a packet it did not
+// understand.
+func (a *Client) handleNack(nack *client.Nack) {
+	klog.V(2).InfoS("Proxy server does not support a packet type", "type", nack.Type, "serverID", a.serverID, "serverCapabilities", nack.Capabilities)
+}
+
+func capabilityStrings(caps []Capability) []string {
+	strs := make([]string, len(caps))
+	for i, c := range caps {
+		strs[i] = string(c)
+	}
+	return strs
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// ProtocolVersionLegacy is spoken with peers which do not announce
+	// a protocol version.
+	ProtocolVersionLegacy = 1
+	// ProtocolVersionAck numbers the DATA of each connection and
+	// acknowledges it with ACK packets, so that lost DATA is detected and
+	// sent again from bounded retransmit buffers.
+	ProtocolVersionAck = 2
+	// ProtocolVersionHello opens the stream with HELLO packets, through
+	// which the agent and the proxy server advertise their features.
+	ProtocolVersionHello = 3
+	// ProtocolVersion is the highest protocol version of this build.
+	ProtocolVersion = ProtocolVersionHello
+)
+
+// ParseProtocolVersion parses the protocol version header values of a
+// peer, the legacy version if there are none.
+func ParseProtocolVersion(values []string) (int, error) {
+	if len(values) == 0 {
+		return ProtocolVersionLegacy, nil
+	}
+	if len(values) != 1 {
+		return 0, fmt.Errorf("expected one protocol version, got %v", values)
+	}
+	version, err := strconv.Atoi(values[0])
+	if err != nil || version < ProtocolVersionLegacy {
+		return 0, fmt.Errorf("invalid protocol version %q", values[0])
+	}
+	return version, nil
+}
+
+// NegotiateProtocolVersion returns the protocol version spoken by peers
+// supporting up to local and remote.
+func NegotiateProtocolVersion(local, remote int) int {
+	if remote < local {
+		return remote
+	}
+	return local
+}
+
+// ValidateProtocolVersion checks that this build supports version.
+func ValidateProtocolVersion(version int) error {
+	if version < ProtocolVersionLegacy || version > ProtocolVersion {
+		return fmt.Errorf("protocol version %d must be between %d and %d", version, ProtocolVersionLegacy, ProtocolVersion)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   int
+	}{
+		{values: nil, want: ProtocolVersionLegacy},
+		{values: []string{"2"}, want: 2},
+		{values: []string{"7"}, want: 7},
+	} {
+		got, err := ParseProtocolVersion(tc.values)
+		if err != nil || got != tc.want {
+			t.Errorf("expected version %d from %v, got %d (%v)", tc.want, tc.values, got, err)
+		}
+	}
+	for _, values := range [][]string{{"two"}, {"0"}, {"1", "2"}} {
+		if _, err := ParseProtocolVersion(values); err == nil {
+			t.Errorf("expected %v to be rejected", values)
+		}
+	}
+
+	if v := NegotiateProtocolVersion(ProtocolVersion, 7); v != ProtocolVersion {
+		t.Errorf("expected newer peers to speak version %d, got %d", ProtocolVersion, v)
+	}
+	if v := NegotiateProtocolVersion(ProtocolVersion, ProtocolVersionLegacy); v != ProtocolVersionLegacy {
+		t.Errorf("expected legacy peers to speak version %d, got %d", ProtocolVersionLegacy, v)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigFlag is the name of the flag selecting the configuration file,
+// which cannot be set in the file itself.
+const ConfigFlag = "config"
+
+// Load reads the YAML or JSON configuration file at path and validates it
+// against kind.
+func Load(path, kind string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	c := &Configuration{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %v", path, err)
+	}
+	if err := c.Validate(kind); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks the apiVersion, kind and the types of the options of c.
+// The values themselves are validated by the flags they set.
+func (c *Configuration) Validate(kind string) error {
+	if c.APIVersion != APIVersion {
+		return fmt.Errorf("apiVersion %q must be %q", c.APIVersion, APIVersion)
+	}
+	if c.Kind != kind {
+		return fmt.Errorf("kind %q must be %q", c.Kind, kind)
+	}
+	for name, value := range c.Options {
+		if name == ConfigFlag {
+			return fmt.Errorf("option %q cannot be set in the config file", name)
+		}
+		if _, err := flagValue(value); err != nil {
+			return fmt.Errorf("option %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Apply sets the flags to the options of c, unless they were set on the
+// command line. It must be called after the flags have been parsed and
+// before options derived from other flags, such as profiles, are applied.
+func (c *Configuration) Apply(flags *pflag.FlagSet) error {
+	names := make([]string, 0, len(c.Options))
+	for name := range c.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("config file sets unknown option %q", name)
+		}
+		if flag.Changed {
+			klog.V(1).Infof("Flag --%s=%s overrides the config file.\n", name, flag.Value)
+			continue
+		}
+		value, err := flagValue(c.Options[name])
+		if err != nil {
+			return fmt.Errorf("option %q: %v", name, err)
+		}
+		// Set marks the flag as changed, so that it takes precedence
+		// over profiles.
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("config file failed to set %s=%s: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// flagValue formats an option value as flag value. Lists are joined by
+// commas, as expected by list flags.
+func flagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v of type %T", value, value)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApply(t *testing.T) {
+	path := writeConfig(t, `
+apiVersion: konnectivity.k8s.io/v1alpha1
+kind: ProxyServerConfiguration
+options:
+  mode: http-connect
+  server-port: 8090
+  agent-port: 8091
+  keepalive-time: 30s
+  enable-profiling: true
+  peer-addresses:
+  - server-0:8093
+  - server-1:8093
+`)
+	var (
+		mode          string
+		serverPort    uint
+		agentPort     uint
+		keepalive     time.Duration
+		profiling     bool
+		peerAddresses []string
+	)
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&mode, "mode", "grpc", "")
+	flags.UintVar(&serverPort, "server-port", 8090, "")
+	flags.UintVar(&agentPort, "agent-port", 8091, "")
+	flags.DurationVar(&keepalive, "keepalive-time", time.Hour, "")
+	flags.BoolVar(&profiling, "enable-profiling", false, "")
+	flags.StringSliceVar(&peerAddresses, "peer-addresses", nil, "")
+	if err := flags.Parse([]string{"--agent-port=9091"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path, KindProxyServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "http-connect" || serverPort != 8090 || keepalive != 30*time.Second || !profiling {
+		t.Errorf("unexpected values mode=%q serverPort=%d keepalive=%v profiling=%v", mode, serverPort, keepalive, profiling)
+	}
+	if agentPort != 9091 {
+		t.Errorf("expected the command line to override the agent port, got %d", agentPort)
+	}
+	if expected := []string{"server-0:8093", "server-1:8093"}; !reflect.DeepEqual(peerAddresses, expected) {
+		t.Errorf("expected peer addresses %v, got %v", expected, peerAddresses)
+	}
+	if !flags.Lookup("mode").Changed {
+		t.Error("expected options set by the config file to be marked as changed")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := map[string]string{
+		"wrong apiVersion": "apiVersion: konnectivity.k8s.io/v1\nkind: ProxyServerConfiguration\n",
+		"wrong kind":       "apiVersion: konnectivity.k8s.io/v1alpha1\nkind: ProxyAgentConfiguration\n",
+		"unknown field":    "apiVersion: konnectivity.k8s.io/v1alpha1\nkind: ProxyServerConfiguration\nflags: {}\n",
+		"config option":    "apiVersion: konnectivity.k8s.io/v1alpha1\nkind: ProxyServerConfiguration\noptions:\n  config: other.yaml\n",
+		"map value":        "apiVersion: konnectivity.k8s.io/v1alpha1\nkind: ProxyServerConfiguration\noptions:\n  mode: {grpc: true}\n",
+	}
+	for name, content := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, content), KindProxyServer); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestApplyUnknownOption(t *testing.T) {
+	c := &Configuration{Options: map[string]interface{}{"no-such-flag": "x"}}
+	if err := c.Apply(pflag.NewFlagSet("test", pflag.ContinueOnError)); err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
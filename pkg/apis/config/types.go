@@ -0,0 +1,61 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config contains the API of the configuration files of the
+// proxy-server and proxy-agent.
+package config
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// GroupName is the API group of the configuration files.
+	GroupName = "konnectivity.k8s.io"
+	// Version is the current version of the configuration files.
+	Version = "v1alpha1"
+	// APIVersion is the apiVersion of the configuration files.
+	APIVersion = GroupName + "/" + Version
+
+	// KindProxyServer is the kind of the proxy-server configuration file.
+	KindProxyServer = "ProxyServerConfiguration"
+	// KindProxyAgent is the kind of the proxy-agent configuration file.
+	KindProxyAgent = "ProxyAgentConfiguration"
+)
+
+// Configuration is a configuration file of the proxy-server or the
+// proxy-agent, e.g.
+//
+//	apiVersion: konnectivity.k8s.io/v1alpha1
+//	kind: ProxyServerConfiguration
+//	options:
+//	  mode: http-connect
+//	  server-port: 8090
+//	  proxy-strategies: destHost,default
+//	  peer-addresses:
+//	  - konnectivity-server-0:8093
+//	  - konnectivity-server-1:8093
+//
+// Options not set keep their default. Flags given on the command line
+// take precedence over the options.
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Options sets the flags of the binary by name, without the leading
+	// dashes. Values are strings, numbers, booleans or lists of them for
+	// list flags.
+	Options map[string]interface{} `json:"options,omitempty"`
+}
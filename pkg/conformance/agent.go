@@ -0,0 +1,720 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conformance verifies over the wire protocol that components
+// built from other sources, e.g. downstream forks, interoperate with the
+// proxy servers and agents of this repository.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+const (
+	// DefaultStepTimeout is the default time a step waits for the
+	// component under test.
+	DefaultStepTimeout = 10 * time.Second
+	// DefaultLargeTransferSize is the default number of bytes echoed
+	// through the agent by the large-transfer case.
+	DefaultLargeTransferSize = 8 << 20
+
+	// chunkSize is the size of the DATA payloads sent by the suite.
+	chunkSize = 32 << 10
+	// concurrentDials is the number of dials of the concurrent-dials case.
+	concurrentDials = 8
+	// unknownConnectID is a connection ID no agent hands out in a run.
+	unknownConnectID = 1 << 40
+)
+
+// errAgentDisconnected is returned by steps when the agent ended its stream.
+var errAgentDisconnected = errors.New("agent disconnected")
+
+// AgentConfig configures an AgentSuite.
+type AgentConfig struct {
+	// ServerOptions are the options of the gRPC server the agent connects
+	// to, e.g. its credentials.
+	ServerOptions []grpc.ServerOption
+	// ServerID is the server ID reported to the agent, empty is
+	// "conformance-server".
+	ServerID string
+	// StepTimeout is how long a step waits for the agent, 0 is
+	// DefaultStepTimeout.
+	StepTimeout time.Duration
+	// LargeTransferSize is the number of bytes echoed by the
+	// large-transfer case, 0 is DefaultLargeTransferSize.
+	LargeTransferSize int
+	// Cases are the names of the cases to run, empty runs them all.
+	Cases []string
+}
+
+// AgentCase is a case of the agent conformance suite.
+type AgentCase struct {
+	// Name identifies the case.
+	Name string
+	// Description is what the case verifies.
+	Description string
+
+	run func(r *agentRun) error
+}
+
+// AgentCases returns the cases of the agent conformance suite, in the
+// order they run.
+func AgentCases() []AgentCase {
+	return []AgentCase{
+		{Name: "handshake", Description: "The agent identifies itself when connecting.", run: (*agentRun).handshake},
+		{Name: "dial", Description: "The agent dials a destination and closes the connection on request.", run: (*agentRun).dialAndClose},
+		{Name: "dial-refused", Description: "The agent reports dials it failed.", run: (*agentRun).dialRefused},
+		{Name: "echo", Description: "The agent relays DATA both ways.", run: (*agentRun).echoCase},
+		{Name: "large-transfer", Description: "The agent relays a large transfer both ways without loss or reordering.", run: (*agentRun).largeTransfer},
+		{Name: "concurrent-dials", Description: "The agent serves concurrent dials on separate connections.", run: (*agentRun).concurrentDials},
+		{Name: "remote-close", Description: "The agent reports connections the destination closed.", run: (*agentRun).remoteClose},
+		{Name: "close-unknown", Description: "The agent answers the close of an unknown connection with an error.", run: (*agentRun).closeUnknown},
+		{Name: "data-unknown", Description: "The agent survives DATA for an unknown connection.", run: (*agentRun).dataUnknown},
+		{Name: "unknown-packet", Description: "The agent keeps serving, or reconnects, after a packet of an unknown type.", run: (*agentRun).unknownPacket},
+	}
+}
+
+// AgentSuite serves agents the way a proxy server does and runs the agent
+// conformance cases against the first agent connecting, dialing
+// destinations it runs itself.
+type AgentSuite struct {
+	cfg          AgentConfig
+	cases        []AgentCase
+	grpcServer   *grpc.Server
+	destinations *destinations
+
+	// streams receives the Connect streams of the agents.
+	streams chan *agentStream
+}
+
+// NewAgentSuite returns a suite serving agents on lis, stopped by Close.
+func NewAgentSuite(cfg AgentConfig, lis net.Listener) (*AgentSuite, error) {
+	if cfg.ServerID == "" {
+		cfg.ServerID = "conformance-server"
+	}
+	if cfg.StepTimeout == 0 {
+		cfg.StepTimeout = DefaultStepTimeout
+	}
+	if cfg.LargeTransferSize == 0 {
+		cfg.LargeTransferSize = DefaultLargeTransferSize
+	}
+	if cfg.StepTimeout < 0 || cfg.LargeTransferSize < 0 {
+		return nil, fmt.Errorf("step timeout %v and large transfer size %d must not be negative", cfg.StepTimeout, cfg.LargeTransferSize)
+	}
+	cases, err := selectCases(AgentCases(), cfg.Cases)
+	if err != nil {
+		return nil, err
+	}
+	dests, err := newDestinations()
+	if err != nil {
+		return nil, err
+	}
+	s := &AgentSuite{
+		cfg:          cfg,
+		cases:        cases,
+		grpcServer:   grpc.NewServer(cfg.ServerOptions...),
+		destinations: dests,
+		streams:      make(chan *agentStream),
+	}
+	agent.RegisterAgentServiceServer(s.grpcServer, &agentService{suite: s})
+	go s.grpcServer.Serve(lis) /* #nosec G104 */
+	return s, nil
+}
+
+// selectCases returns the cases named, all if names is empty.
+func selectCases(all []AgentCase, names []string) ([]AgentCase, error) {
+	var known []string
+	for _, c := range all {
+		known = append(known, c.Name)
+	}
+	indexes, err := selectCaseIndexes(known, names)
+	if err != nil {
+		return nil, err
+	}
+	var cases []AgentCase
+	for _, i := range indexes {
+		cases = append(cases, all[i])
+	}
+	return cases, nil
+}
+
+// selectCaseIndexes returns the indexes of the cases named among known,
+// all if names is empty.
+func selectCaseIndexes(known, names []string) ([]int, error) {
+	var indexes []int
+	if len(names) == 0 {
+		for i := range known {
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	}
+	byName := make(map[string]int)
+	for i, name := range known {
+		byName[name] = i
+	}
+	for _, name := range names {
+		i, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown case %q, must be one of %s", name, strings.Join(known, ", "))
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// Close stops serving agents and the destinations.
+func (s *AgentSuite) Close() {
+	s.grpcServer.Stop()
+	s.destinations.close()
+}
+
+// Run waits for an agent to connect and runs the cases against it. It
+// fails if no agent connected before ctx is done.
+func (s *AgentSuite) Run(ctx context.Context) (*Report, error) {
+	var stream *agentStream
+	select {
+	case stream = <-s.streams:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no agent connected: %v", ctx.Err())
+	}
+	klog.InfoS("Agent connected, running the conformance cases", "agentID", stream.agentID, "cases", len(s.cases))
+	r := &agentRun{
+		suite:  s,
+		stream: stream,
+		dials:  make(map[int64]*client.DialResponse),
+		data:   make(map[int64][]byte),
+		closes: make(map[int64]*client.CloseResponse),
+	}
+	defer func() { r.stream.release() }()
+
+	report := &Report{Subject: stream.agentID}
+	for _, c := range s.cases {
+		start := time.Now()
+		err := r.ensureConnected()
+		if err == nil {
+			err = c.run(r)
+		}
+		result := Result{Name: c.Name, Passed: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			klog.V(1).InfoS("Conformance case failed", "case", c.Name, "err", err)
+		} else {
+			klog.V(1).InfoS("Conformance case passed", "case", c.Name)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// agentStream is the Connect stream of an agent.
+type agentStream struct {
+	stream  agent.AgentService_ConnectServer
+	md      metadata.MD
+	agentID string
+	// packets receives the packets of the agent, closed when the stream
+	// ended, as is ended.
+	packets chan *client.Packet
+	ended   chan struct{}
+	// done is closed to end the stream.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (as *agentStream) release() {
+	as.doneOnce.Do(func() { close(as.done) })
+}
+
+// agentService is the AgentService of the suite.
+type agentService struct {
+	agent.UnimplementedAgentServiceServer
+	suite *AgentSuite
+}
+
+func (a *agentService) Connect(stream agent.AgentService_ConnectServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	h := metadata.Pairs(header.ServerID, a.suite.cfg.ServerID, header.ServerCount, "1")
+	if err := stream.SendHeader(h); err != nil {
+		return err
+	}
+	as := &agentStream{
+		stream:  stream,
+		md:      md,
+		agentID: strings.Join(md.Get(header.AgentID), ","),
+		packets: make(chan *client.Packet, 64),
+		ended:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(as.ended)
+		defer close(as.packets)
+		for {
+			pkt, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					klog.V(2).InfoS("Stream from agent ended", "agentID", as.agentID, "err", err)
+				}
+				return
+			}
+			select {
+			case as.packets <- pkt:
+			case <-as.done:
+				return
+			}
+		}
+	}()
+	select {
+	case a.suite.streams <- as:
+	case <-stream.Context().Done():
+		return nil
+	}
+	select {
+	case <-as.done:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+// agentRun runs the cases against an agent, tracking the packets it sent.
+type agentRun struct {
+	suite  *AgentSuite
+	stream *agentStream
+
+	nextRandom int64
+	// dials are the DIAL_RSP by dial random.
+	dials map[int64]*client.DialResponse
+	// data is the DATA received by connection, not consumed yet.
+	data map[int64][]byte
+	// closes are the CLOSE_RSP by connection.
+	closes map[int64]*client.CloseResponse
+}
+
+// ensureConnected waits for the agent to reconnect if its stream ended.
+func (r *agentRun) ensureConnected() error {
+	select {
+	case <-r.stream.ended:
+	default:
+		return nil
+	}
+	r.stream.release()
+	timer := time.NewTimer(r.suite.cfg.StepTimeout)
+	defer timer.Stop()
+	select {
+	case r.stream = <-r.suite.streams:
+		klog.V(1).InfoS("Agent reconnected", "agentID", r.stream.agentID)
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("agent did not reconnect within %v", r.suite.cfg.StepTimeout)
+	}
+}
+
+func (r *agentRun) send(pkt *client.Packet) error {
+	return r.stream.stream.Send(pkt)
+}
+
+// record tracks a packet of the agent.
+func (r *agentRun) record(pkt *client.Packet) {
+	switch pkt.Type {
+	case client.PacketType_DIAL_RSP:
+		resp := pkt.GetDialResponse()
+		r.dials[resp.Random] = resp
+	case client.PacketType_DATA:
+		data := pkt.GetData()
+		r.data[data.ConnectID] = append(r.data[data.ConnectID], data.Data...)
+	case client.PacketType_CLOSE_RSP:
+		resp := pkt.GetCloseResponse()
+		r.closes[resp.ConnectID] = resp
+	default:
+		klog.V(4).InfoS("Ignoring packet", "type", pkt.Type)
+	}
+}
+
+// wait records the packets of the agent until cond holds, failing after
+// the step timeout.
+func (r *agentRun) wait(what string, cond func() bool) error {
+	timer := time.NewTimer(r.suite.cfg.StepTimeout)
+	defer timer.Stop()
+	for !cond() {
+		select {
+		case pkt, ok := <-r.stream.packets:
+			if !ok {
+				return errAgentDisconnected
+			}
+			r.record(pkt)
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v waiting for %s", r.suite.cfg.StepTimeout, what)
+		}
+	}
+	return nil
+}
+
+// sendDial sends a DIAL_REQ for address and returns its random.
+func (r *agentRun) sendDial(address string) (int64, error) {
+	r.nextRandom++
+	random := r.nextRandom
+	return random, r.send(&client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: "tcp",
+			Address:  address,
+			Random:   random,
+		}},
+	})
+}
+
+// dial dials address and returns the DIAL_RSP.
+func (r *agentRun) dial(address string) (*client.DialResponse, error) {
+	random, err := r.sendDial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.wait("the dial response", func() bool { return r.dials[random] != nil }); err != nil {
+		return nil, err
+	}
+	return r.dials[random], nil
+}
+
+// dialOK dials address and returns the connection ID, failing if the dial
+// failed.
+func (r *agentRun) dialOK(address string) (int64, error) {
+	resp, err := r.dial(address)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != "" {
+		return 0, fmt.Errorf("dial of %s failed: %s", address, resp.Error)
+	}
+	if resp.ConnectID == 0 {
+		return 0, fmt.Errorf("dial of %s succeeded without connection ID", address)
+	}
+	return resp.ConnectID, nil
+}
+
+func (r *agentRun) sendData(connectID int64, data []byte) error {
+	return r.send(&client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: connectID, Data: data}},
+	})
+}
+
+func (r *agentRun) sendCloseRequest(connectID int64) error {
+	return r.send(&client.Packet{
+		Type:    client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connectID}},
+	})
+}
+
+// awaitData waits for len(want) bytes on the connection and compares them
+// to want.
+func (r *agentRun) awaitData(connectID int64, want []byte) error {
+	err := r.wait(fmt.Sprintf("%d bytes echoed on connection %d", len(want), connectID), func() bool {
+		return len(r.data[connectID]) >= len(want)
+	})
+	if err != nil {
+		return err
+	}
+	got := r.data[connectID]
+	delete(r.data, connectID)
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("connection %d echoed %d bytes differing from the %d bytes sent", connectID, len(got), len(want))
+	}
+	return nil
+}
+
+// close closes the connection and waits for the agent to confirm.
+func (r *agentRun) close(connectID int64) error {
+	if err := r.sendCloseRequest(connectID); err != nil {
+		return err
+	}
+	err := r.wait(fmt.Sprintf("the close response of connection %d", connectID), func() bool {
+		return r.closes[connectID] != nil
+	})
+	if err != nil {
+		return err
+	}
+	if e := r.closes[connectID].Error; e != "" {
+		return fmt.Errorf("agent failed to close connection %d: %s", connectID, e)
+	}
+	return nil
+}
+
+func (r *agentRun) handshake() error {
+	agentIDs := r.stream.md.Get(header.AgentID)
+	if len(agentIDs) != 1 || agentIDs[0] == "" {
+		return fmt.Errorf("expected one agent ID, got %v", agentIDs)
+	}
+	if versions := r.stream.md.Get(header.ProtocolVersion); len(versions) > 0 {
+		if v, err := strconv.Atoi(versions[0]); len(versions) != 1 || err != nil || v < 1 {
+			return fmt.Errorf("expected one protocol version of at least 1, got %v", versions)
+		}
+	}
+	return nil
+}
+
+func (r *agentRun) dialAndClose() error {
+	connectID, err := r.dialOK(r.suite.destinations.echo)
+	if err != nil {
+		return err
+	}
+	return r.close(connectID)
+}
+
+func (r *agentRun) dialRefused() error {
+	resp, err := r.dial(r.suite.destinations.refused)
+	if err != nil {
+		return err
+	}
+	if resp.Error == "" {
+		return fmt.Errorf("expected the dial of %s to fail, got connection %d", r.suite.destinations.refused, resp.ConnectID)
+	}
+	return nil
+}
+
+func (r *agentRun) echoCase() error {
+	connectID, err := r.dialOK(r.suite.destinations.echo)
+	if err != nil {
+		return err
+	}
+	payload := []byte("konnectivity conformance")
+	if err := r.sendData(connectID, payload); err != nil {
+		return err
+	}
+	if err := r.awaitData(connectID, payload); err != nil {
+		return err
+	}
+	return r.close(connectID)
+}
+
+func (r *agentRun) largeTransfer() error {
+	connectID, err := r.dialOK(r.suite.destinations.echo)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, r.suite.cfg.LargeTransferSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(payload) /* #nosec G404 */
+	// Sent while the echo is received, the agent and the destination
+	// would block otherwise.
+	sent := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(payload); off += chunkSize {
+			end := off + chunkSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			if err := r.sendData(connectID, payload[off:end]); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	if err := r.awaitData(connectID, payload); err != nil {
+		return err
+	}
+	if err := <-sent; err != nil {
+		return err
+	}
+	return r.close(connectID)
+}
+
+func (r *agentRun) concurrentDials() error {
+	var randoms []int64
+	for i := 0; i < concurrentDials; i++ {
+		random, err := r.sendDial(r.suite.destinations.echo)
+		if err != nil {
+			return err
+		}
+		randoms = append(randoms, random)
+	}
+	err := r.wait(fmt.Sprintf("%d dial responses", concurrentDials), func() bool {
+		for _, random := range randoms {
+			if r.dials[random] == nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	connectIDs := make(map[int64]bool)
+	for _, random := range randoms {
+		resp := r.dials[random]
+		if resp.Error != "" {
+			return fmt.Errorf("dial %d failed: %s", random, resp.Error)
+		}
+		if connectIDs[resp.ConnectID] {
+			return fmt.Errorf("connection ID %d handed out twice", resp.ConnectID)
+		}
+		connectIDs[resp.ConnectID] = true
+	}
+	for _, random := range randoms {
+		connectID := r.dials[random].ConnectID
+		if err := r.sendData(connectID, []byte(fmt.Sprintf("connection %d", connectID))); err != nil {
+			return err
+		}
+	}
+	for _, random := range randoms {
+		connectID := r.dials[random].ConnectID
+		if err := r.awaitData(connectID, []byte(fmt.Sprintf("connection %d", connectID))); err != nil {
+			return err
+		}
+	}
+	for _, random := range randoms {
+		if err := r.close(r.dials[random].ConnectID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *agentRun) remoteClose() error {
+	connectID, err := r.dialOK(r.suite.destinations.closing)
+	if err != nil {
+		return err
+	}
+	return r.wait(fmt.Sprintf("the close response of connection %d closed by the destination", connectID), func() bool {
+		return r.closes[connectID] != nil
+	})
+}
+
+func (r *agentRun) closeUnknown() error {
+	if err := r.sendCloseRequest(unknownConnectID); err != nil {
+		return err
+	}
+	err := r.wait("the close response of an unknown connection", func() bool {
+		return r.closes[unknownConnectID] != nil
+	})
+	if err != nil {
+		return err
+	}
+	resp := r.closes[unknownConnectID]
+	delete(r.closes, unknownConnectID)
+	if resp.Error == "" {
+		return fmt.Errorf("expected an error closing unknown connection %d, got none", unknownConnectID)
+	}
+	return nil
+}
+
+func (r *agentRun) dataUnknown() error {
+	if err := r.sendData(unknownConnectID, []byte("unknown")); err != nil {
+		return err
+	}
+	return r.echoCase()
+}
+
+func (r *agentRun) unknownPacket() error {
+	if err := r.send(&client.Packet{Type: client.PacketType(1000)}); err != nil {
+		return err
+	}
+	err := r.echoCase()
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-r.stream.ended:
+	case <-time.After(time.Second):
+		return err
+	}
+	// Agents may close the stream on unknown packets, if they reconnect.
+	if err := r.ensureConnected(); err != nil {
+		return err
+	}
+	return r.echoCase()
+}
+
+// destinations are the destinations the agent dials.
+type destinations struct {
+	// echo is the address of a server echoing the data sent to it.
+	echo string
+	// closing is the address of a server closing the connections it
+	// accepts.
+	closing string
+	// refused is an address nothing listens on.
+	refused string
+
+	listeners []net.Listener
+}
+
+func newDestinations() (*destinations, error) {
+	d := &destinations{}
+	echo, err := d.listen(func(conn net.Conn) {
+		io.Copy(conn, conn) /* #nosec G104 */
+		conn.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	closing, err := d.listen(func(conn net.Conn) {
+		conn.Close()
+	})
+	if err != nil {
+		d.close()
+		return nil, err
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		d.close()
+		return nil, err
+	}
+	refused := lis.Addr().String()
+	lis.Close()
+	d.echo, d.closing, d.refused = echo, closing, refused
+	return d, nil
+}
+
+// listen serves the connections to a new local listener with handle, and
+// returns its address.
+func (d *destinations) listen(handle func(net.Conn)) (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	d.listeners = append(d.listeners, lis)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return lis.Addr().String(), nil
+}
+
+func (d *destinations) close() {
+	for _, lis := range d.listeners {
+		lis.Close()
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func TestAgentSuite(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := NewAgentSuite(AgentConfig{LargeTransferSize: 1 << 20}, lis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	a, err := agent.New(agent.Options{
+		ProxyServerAddress: lis.Addr().String(),
+		AgentID:            "conformance-agent",
+		DialOptions:        []grpc.DialOption{grpc.WithInsecure()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go a.Run(ctx) /* #nosec G104 */
+	defer a.Stop()
+
+	report, err := suite.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(AgentCases()) {
+		t.Errorf("expected %d results, got %d", len(AgentCases()), len(report.Results))
+	}
+	if !report.Passed() {
+		var buf bytes.Buffer
+		report.WriteText(&buf) /* #nosec G104 */
+		t.Errorf("expected the agent to pass, got:\n%s", buf.String())
+	}
+	if report.Subject != "conformance-agent" {
+		t.Errorf("expected subject %q, got %q", "conformance-agent", report.Subject)
+	}
+}
+
+func TestAgentSuiteNoAgent(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := NewAgentSuite(AgentConfig{}, lis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := suite.Run(ctx); err == nil {
+		t.Errorf("expected an error without agent, got none")
+	}
+}
+
+func TestSelectCases(t *testing.T) {
+	cases, err := selectCases(AgentCases(), []string{"echo", "dial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[0].Name != "echo" || cases[1].Name != "dial" {
+		t.Errorf("expected the echo and dial cases, got %v", cases)
+	}
+	if _, err := selectCases(AgentCases(), []string{"unknown"}); err == nil {
+		t.Errorf("expected an error selecting an unknown case, got none")
+	}
+}
+
+func TestReportWriteText(t *testing.T) {
+	report := &Report{
+		Subject: "agent",
+		Results: []Result{
+			{Name: "dial", Passed: true, Duration: time.Millisecond},
+			{Name: "echo", Error: "timed out", Duration: time.Second},
+		},
+	}
+	if report.Passed() {
+		t.Errorf("expected the report to fail")
+	}
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"PASS  dial (1ms)",
+		"FAIL  echo (1s): timed out",
+		"agent: 1/2 cases passed",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("expected report:\n%s\ngot:\n%s", want, got)
+	}
+}
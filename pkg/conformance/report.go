@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Result is the outcome of a conformance case.
+type Result struct {
+	// Name is the name of the case.
+	Name string `json:"name"`
+	// Passed is true if the case passed.
+	Passed bool `json:"passed"`
+	// Error is why the case failed, empty if it passed.
+	Error string `json:"error,omitempty"`
+	// Duration is how long the case ran.
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the outcome of a conformance suite.
+type Report struct {
+	// Subject identifies the component under test, e.g. the agent ID.
+	Subject string `json:"subject"`
+	// Results are the results of the cases, in the order they ran.
+	Results []Result `json:"results"`
+}
+
+// Passed reports whether every case of the report passed.
+func (r *Report) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the report as one line per case followed by a summary.
+func (r *Report) WriteText(w io.Writer) error {
+	passed := 0
+	for _, result := range r.Results {
+		status := "FAIL"
+		if result.Passed {
+			status = "PASS"
+			passed++
+		}
+		line := fmt.Sprintf("%s  %s (%v)", status, result.Name, result.Duration.Round(time.Millisecond))
+		if result.Error != "" {
+			line += ": " + result.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s: %d/%d cases passed\n", r.Subject, passed, len(r.Results))
+	return err
+}
@@ -0,0 +1,863 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+const (
+	// destination is the address the suite dials through the server. The
+	// fake agent answers the dials itself, nothing is dialed.
+	destination = "192.0.2.1:80"
+	// fakeAgentCapabilities are the capabilities the fake agent
+	// advertises: an unknown one, so that the server does not assume the
+	// legacy capabilities, e.g. UDP.
+	fakeAgentCapabilities = "conformance"
+	// noAgentAttempt is how long the no-agent case waits for the answer
+	// to a dial, the server may still be routing dials to the
+	// disconnected agent.
+	noAgentAttempt = time.Second
+	// retryInterval is how often dials failing for lack of an agent are
+	// retried while the fake agent connects.
+	retryInterval = 100 * time.Millisecond
+)
+
+// errServerDisconnected is returned by steps when the server ended the
+// stream of the fake agent.
+var errServerDisconnected = errors.New("server disconnected the agent")
+
+// ServerConfig configures a ServerSuite.
+type ServerConfig struct {
+	// AgentAddress is the host:port of the agent port of the server.
+	AgentAddress string
+	// AgentDialOptions are the options the fake agent dials the server
+	// with, e.g. its credentials.
+	AgentDialOptions []grpc.DialOption
+	// AgentToken, if not empty, is the service account token the fake
+	// agent authenticates with.
+	AgentToken string
+	// AgentID is the ID of the fake agent, empty is "conformance-agent".
+	AgentID string
+	// FrontendAddress is the gRPC target of the frontend port of the
+	// server, e.g. host:port or unix:///path.
+	FrontendAddress string
+	// FrontendDialOptions are the options the client dials the server
+	// with, e.g. its credentials.
+	FrontendDialOptions []grpc.DialOption
+	// StepTimeout is how long a step waits for the server, 0 is
+	// DefaultStepTimeout.
+	StepTimeout time.Duration
+	// Cases are the names of the cases to run, empty runs them all.
+	Cases []string
+}
+
+// ServerCase is a case of the server conformance suite.
+type ServerCase struct {
+	// Name identifies the case.
+	Name string
+	// Description is what the case verifies.
+	Description string
+
+	run func(r *serverRun) error
+}
+
+// ServerCases returns the cases of the server conformance suite, in the
+// order they run.
+func ServerCases() []ServerCase {
+	return []ServerCase{
+		{Name: "handshake", Description: "The server identifies itself to connecting agents.", run: (*serverRun).handshake},
+		{Name: "dial", Description: "The server forwards dials and closes between the client and the agent.", run: (*serverRun).dialAndClose},
+		{Name: "dial-error", Description: "The server forwards the dials the agent failed to the client.", run: (*serverRun).dialError},
+		{Name: "echo", Description: "The server relays DATA both ways.", run: (*serverRun).echoCase},
+		{Name: "concurrent-dials", Description: "The server routes the packets of concurrent connections to their clients.", run: (*serverRun).concurrentDials},
+		{Name: "agent-close", Description: "The server forwards the close of a connection by the agent to the client.", run: (*serverRun).agentClose},
+		{Name: "client-disconnect", Description: "The server closes the connection of a client which went away.", run: (*serverRun).clientDisconnect},
+		{Name: "close-before-dial", Description: "The server keeps serving a client which closed or sent DATA before dialing.", run: (*serverRun).closeBeforeDial},
+		{Name: "capabilities", Description: "The server does not route dials to an agent lacking the capabilities they require.", run: (*serverRun).capabilities},
+		{Name: "no-agent", Description: "The server fails dials with the no-agent error code while no agent is connected.", run: (*serverRun).noAgent},
+	}
+}
+
+// ServerSuite runs the server conformance cases against a running proxy
+// server, connecting to it as a fake agent and as a client. The server
+// should have no other agent connected, so that the dials of the suite
+// are routed through the fake agent.
+type ServerSuite struct {
+	cfg   ServerConfig
+	cases []ServerCase
+}
+
+// NewServerSuite returns a suite running the cases selected by cfg.
+func NewServerSuite(cfg ServerConfig) (*ServerSuite, error) {
+	if cfg.AgentAddress == "" || cfg.FrontendAddress == "" {
+		return nil, fmt.Errorf("agent address and frontend address are required")
+	}
+	if cfg.AgentID == "" {
+		cfg.AgentID = "conformance-agent"
+	}
+	if cfg.StepTimeout == 0 {
+		cfg.StepTimeout = DefaultStepTimeout
+	}
+	if cfg.StepTimeout < 0 {
+		return nil, fmt.Errorf("step timeout %v must not be negative", cfg.StepTimeout)
+	}
+	var known []string
+	all := ServerCases()
+	for _, c := range all {
+		known = append(known, c.Name)
+	}
+	indexes, err := selectCaseIndexes(known, cfg.Cases)
+	if err != nil {
+		return nil, err
+	}
+	s := &ServerSuite{cfg: cfg}
+	for _, i := range indexes {
+		s.cases = append(s.cases, all[i])
+	}
+	return s, nil
+}
+
+// Run connects the fake agent to the server and runs the cases. It fails
+// if the agent could not connect before ctx is done.
+func (s *ServerSuite) Run(ctx context.Context) (*Report, error) {
+	frontendConn, err := grpc.DialContext(ctx, s.cfg.FrontendAddress, s.cfg.FrontendDialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial the frontend port: %v", err)
+	}
+	defer frontendConn.Close()
+	r := &serverRun{
+		suite:        s,
+		frontendConn: frontendConn,
+		events:       make(chan serverEvent, 256),
+		done:         make(chan struct{}),
+		dialReqs:     make(map[int64]*client.DialRequest),
+		data:         make(map[int64][]byte),
+		closeReqs:    make(map[int64]bool),
+	}
+	defer close(r.done)
+	for {
+		if r.agent, err = r.connectAgent(ctx); err == nil {
+			break
+		}
+		klog.V(2).InfoS("Failed to connect the fake agent, retrying", "address", s.cfg.AgentAddress, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("agent could not connect: %v", err)
+		case <-time.After(retryInterval):
+		}
+	}
+	defer func() { r.agent.close() }()
+
+	subject := s.cfg.AgentAddress
+	if ids := r.agent.header.Get(header.ServerID); len(ids) == 1 && ids[0] != "" {
+		subject = ids[0]
+	}
+	klog.InfoS("Agent connected, running the conformance cases", "server", subject, "cases", len(s.cases))
+	report := &Report{Subject: subject}
+	for _, c := range s.cases {
+		start := time.Now()
+		err := r.ensureAgent()
+		if err == nil {
+			err = c.run(r)
+		}
+		r.closeFrontends()
+		result := Result{Name: c.Name, Passed: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			klog.V(1).InfoS("Conformance case failed", "case", c.Name, "err", err)
+		} else {
+			klog.V(1).InfoS("Conformance case passed", "case", c.Name)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// serverEvent is a packet received by the fake agent, if frontend is nil,
+// or by a client stream. pkt is nil once the stream ended.
+type serverEvent struct {
+	agent    *fakeAgent
+	frontend *frontendStream
+	pkt      *client.Packet
+}
+
+// fakeAgent is the Connect stream of the fake agent.
+type fakeAgent struct {
+	conn   *grpc.ClientConn
+	stream agent.AgentService_ConnectClient
+	cancel context.CancelFunc
+	header metadata.MD
+	// ended is set once the stream ended, closed once the suite closed
+	// it.
+	ended  bool
+	closed bool
+}
+
+func (fa *fakeAgent) close() {
+	fa.closed = true
+	fa.cancel()
+	fa.conn.Close() /* #nosec G104 */
+}
+
+// frontendStream is a Proxy stream of the client and the packets it
+// received.
+type frontendStream struct {
+	stream client.ProxyService_ProxyClient
+	cancel context.CancelFunc
+	ended  bool
+	// dials are the DIAL_RSP by dial random, data the DATA by connection
+	// and closes the CLOSE_RSP by connection.
+	dials  map[int64]*client.DialResponse
+	data   map[int64][]byte
+	closes map[int64]*client.CloseResponse
+}
+
+// serverRun runs the cases against a server, tracking the packets the
+// fake agent and the client streams received.
+type serverRun struct {
+	suite        *ServerSuite
+	agent        *fakeAgent
+	frontendConn *grpc.ClientConn
+	frontends    []*frontendStream
+
+	// events receives the packets of the streams until done is closed.
+	events chan serverEvent
+	done   chan struct{}
+
+	nextRandom    int64
+	nextConnectID int64
+	// dialReqs are the DIAL_REQ the fake agent received by dial random,
+	// data the DATA by connection, not consumed yet, and closeReqs the
+	// connections it received a CLOSE_REQ for.
+	dialReqs  map[int64]*client.DialRequest
+	data      map[int64][]byte
+	closeReqs map[int64]bool
+}
+
+// connectAgent connects the fake agent and waits for the headers of the
+// server.
+func (r *serverRun) connectAgent(ctx context.Context) (*fakeAgent, error) {
+	cfg := r.suite.cfg
+	conn, err := grpc.DialContext(ctx, cfg.AgentAddress, cfg.AgentDialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	md := metadata.Pairs(header.AgentID, cfg.AgentID, header.AgentCapabilities, fakeAgentCapabilities)
+	if cfg.AgentToken != "" {
+		md.Append(header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+cfg.AgentToken)
+	}
+	streamCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	fa := &fakeAgent{conn: conn, cancel: cancel}
+	if fa.stream, err = agent.NewAgentServiceClient(conn).Connect(streamCtx); err == nil {
+		fa.header, err = fa.stream.Header()
+	}
+	if err != nil {
+		fa.close()
+		return nil, err
+	}
+	go func() {
+		for {
+			pkt, err := fa.stream.Recv()
+			if err != nil {
+				pkt = nil
+			}
+			select {
+			case r.events <- serverEvent{agent: fa, pkt: pkt}:
+			case <-r.done:
+				return
+			}
+			if pkt == nil {
+				return
+			}
+		}
+	}()
+	return fa, nil
+}
+
+// ensureAgent reconnects the fake agent if its stream ended.
+func (r *serverRun) ensureAgent() error {
+	if !r.agent.ended && !r.agent.closed {
+		return nil
+	}
+	r.agent.close()
+	ctx, cancel := context.WithTimeout(context.Background(), r.suite.cfg.StepTimeout)
+	defer cancel()
+	for {
+		fa, err := r.connectAgent(ctx)
+		if err == nil {
+			r.agent = fa
+			klog.V(1).InfoS("Agent reconnected", "agentID", r.suite.cfg.AgentID)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("agent could not reconnect within %v: %v", r.suite.cfg.StepTimeout, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// openFrontend opens a Proxy stream of the client.
+func (r *serverRun) openFrontend() (*frontendStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.NewProxyServiceClient(r.frontendConn).Proxy(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	fs := &frontendStream{
+		stream: stream,
+		cancel: cancel,
+		dials:  make(map[int64]*client.DialResponse),
+		data:   make(map[int64][]byte),
+		closes: make(map[int64]*client.CloseResponse),
+	}
+	r.frontends = append(r.frontends, fs)
+	go func() {
+		for {
+			pkt, err := stream.Recv()
+			if err != nil {
+				pkt = nil
+			}
+			select {
+			case r.events <- serverEvent{frontend: fs, pkt: pkt}:
+			case <-r.done:
+				return
+			}
+			if pkt == nil {
+				return
+			}
+		}
+	}()
+	return fs, nil
+}
+
+// closeFrontends ends the client streams of a case.
+func (r *serverRun) closeFrontends() {
+	for _, fs := range r.frontends {
+		fs.cancel()
+	}
+	r.frontends = nil
+}
+
+// record tracks a packet received by the fake agent or a client stream.
+// It returns errServerDisconnected if the server ended the stream of the
+// fake agent.
+func (r *serverRun) record(ev serverEvent) error {
+	if fs := ev.frontend; fs != nil {
+		if ev.pkt == nil {
+			fs.ended = true
+			return nil
+		}
+		switch ev.pkt.Type {
+		case client.PacketType_DIAL_RSP:
+			resp := ev.pkt.GetDialResponse()
+			fs.dials[resp.Random] = resp
+		case client.PacketType_DATA:
+			data := ev.pkt.GetData()
+			fs.data[data.ConnectID] = append(fs.data[data.ConnectID], data.Data...)
+		case client.PacketType_CLOSE_RSP:
+			resp := ev.pkt.GetCloseResponse()
+			fs.closes[resp.ConnectID] = resp
+		default:
+			klog.V(4).InfoS("Ignoring packet sent to the client", "type", ev.pkt.Type)
+		}
+		return nil
+	}
+	if ev.agent != r.agent {
+		// a previous stream of the fake agent
+		return nil
+	}
+	if ev.pkt == nil {
+		r.agent.ended = true
+		if r.agent.closed {
+			return nil
+		}
+		return errServerDisconnected
+	}
+	switch ev.pkt.Type {
+	case client.PacketType_DIAL_REQ:
+		req := ev.pkt.GetDialRequest()
+		r.dialReqs[req.Random] = req
+	case client.PacketType_DATA:
+		data := ev.pkt.GetData()
+		r.data[data.ConnectID] = append(r.data[data.ConnectID], data.Data...)
+	case client.PacketType_CLOSE_REQ:
+		r.closeReqs[ev.pkt.GetCloseRequest().ConnectID] = true
+	default:
+		klog.V(4).InfoS("Ignoring packet sent to the agent", "type", ev.pkt.Type)
+	}
+	return nil
+}
+
+// wait records the packets of the streams until cond holds, failing after
+// timeout.
+func (r *serverRun) wait(what string, timeout time.Duration, cond func() bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !cond() {
+		select {
+		case ev := <-r.events:
+			if err := r.record(ev); err != nil {
+				return err
+			}
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v waiting for %s", timeout, what)
+		}
+	}
+	return nil
+}
+
+// waitStep waits for cond for the step timeout.
+func (r *serverRun) waitStep(what string, cond func() bool) error {
+	return r.wait(what, r.suite.cfg.StepTimeout, cond)
+}
+
+func (r *serverRun) sendAgent(pkt *client.Packet) error {
+	return r.agent.stream.Send(pkt)
+}
+
+// sendDial sends a DIAL_REQ for address on fs and returns its random.
+func (r *serverRun) sendDial(fs *frontendStream, protocol, address string) (int64, error) {
+	r.nextRandom++
+	random := r.nextRandom
+	return random, fs.stream.Send(&client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: protocol,
+			Address:  address,
+			Random:   random,
+		}},
+	})
+}
+
+// awaitDialRequest waits for the DIAL_REQ of random at the fake agent, or
+// for the server to answer it. Dials failing for lack of an agent are
+// sent again until the step timeout, the server may not have registered
+// the fake agent yet.
+func (r *serverRun) awaitDialRequest(fs *frontendStream, protocol, address string) (int64, error) {
+	deadline := time.Now().Add(r.suite.cfg.StepTimeout)
+	for {
+		random, err := r.sendDial(fs, protocol, address)
+		if err != nil {
+			return 0, err
+		}
+		err = r.waitStep("the dial request at the agent", func() bool {
+			return r.dialReqs[random] != nil || fs.dials[random] != nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if req := r.dialReqs[random]; req != nil {
+			if req.Protocol != protocol || req.Address != address {
+				return 0, fmt.Errorf("expected a dial of %s %s at the agent, got %s %s", protocol, address, req.Protocol, req.Address)
+			}
+			return random, nil
+		}
+		resp := fs.dials[random]
+		if resp.ErrorCode != client.DialErrorCode_DIAL_ERROR_NO_AGENT || time.Now().After(deadline) {
+			return 0, fmt.Errorf("dial failed before reaching the agent: %s", resp.Error)
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// dial dials destination through the fake agent, which accepts the dial,
+// and returns the connection ID.
+func (r *serverRun) dial(fs *frontendStream) (int64, error) {
+	random, err := r.awaitDialRequest(fs, "tcp", destination)
+	if err != nil {
+		return 0, err
+	}
+	connectID := r.acceptDial(random)
+	if err := r.sendAgent(dialResponsePacket(random, connectID, "")); err != nil {
+		return 0, err
+	}
+	return connectID, r.awaitDialResponse(fs, random, connectID)
+}
+
+// acceptDial returns the connection ID of the dial accepted by the fake
+// agent.
+func (r *serverRun) acceptDial(random int64) int64 {
+	delete(r.dialReqs, random)
+	r.nextConnectID++
+	return r.nextConnectID
+}
+
+// awaitDialResponse waits for the client to receive the successful
+// DIAL_RSP of random.
+func (r *serverRun) awaitDialResponse(fs *frontendStream, random, connectID int64) error {
+	if err := r.waitStep("the dial response at the client", func() bool { return fs.dials[random] != nil }); err != nil {
+		return err
+	}
+	resp := fs.dials[random]
+	if resp.Error != "" {
+		return fmt.Errorf("dial %d failed: %s", random, resp.Error)
+	}
+	if resp.ConnectID != connectID {
+		return fmt.Errorf("expected dial %d to be answered with connection %d, got %d", random, connectID, resp.ConnectID)
+	}
+	return nil
+}
+
+// closeFromClient closes the connection from the client and waits for the
+// close to be confirmed by the fake agent through the server.
+func (r *serverRun) closeFromClient(fs *frontendStream, connectID int64) error {
+	if err := fs.stream.Send(closeRequestPacket(connectID)); err != nil {
+		return err
+	}
+	if err := r.awaitCloseRequest(connectID); err != nil {
+		return err
+	}
+	if err := r.sendAgent(closeResponsePacket(connectID)); err != nil {
+		return err
+	}
+	return r.awaitCloseResponse(fs, connectID)
+}
+
+func (r *serverRun) awaitCloseRequest(connectID int64) error {
+	err := r.waitStep(fmt.Sprintf("the close request of connection %d at the agent", connectID), func() bool {
+		return r.closeReqs[connectID]
+	})
+	delete(r.closeReqs, connectID)
+	return err
+}
+
+func (r *serverRun) awaitCloseResponse(fs *frontendStream, connectID int64) error {
+	err := r.waitStep(fmt.Sprintf("the close response of connection %d at the client", connectID), func() bool {
+		return fs.closes[connectID] != nil
+	})
+	if err != nil {
+		return err
+	}
+	if e := fs.closes[connectID].Error; e != "" {
+		return fmt.Errorf("close of connection %d failed: %s", connectID, e)
+	}
+	return nil
+}
+
+// awaitData waits for want on the connection, received by the fake agent
+// if fs is nil and by fs otherwise.
+func (r *serverRun) awaitData(fs *frontendStream, connectID int64, want string) error {
+	received, where := r.data, "agent"
+	if fs != nil {
+		received, where = fs.data, "client"
+	}
+	err := r.waitStep(fmt.Sprintf("%d bytes on connection %d at the %s", len(want), connectID, where), func() bool {
+		return len(received[connectID]) >= len(want)
+	})
+	if err != nil {
+		return err
+	}
+	got := string(received[connectID])
+	delete(received, connectID)
+	if got != want {
+		return fmt.Errorf("expected %q on connection %d at the %s, got %q", want, connectID, where, got)
+	}
+	return nil
+}
+
+func (r *serverRun) handshake() error {
+	ids := r.agent.header.Get(header.ServerID)
+	if len(ids) != 1 || ids[0] == "" {
+		return fmt.Errorf("expected one server ID, got %v", ids)
+	}
+	counts := r.agent.header.Get(header.ServerCount)
+	if len(counts) != 1 {
+		return fmt.Errorf("expected one server count, got %v", counts)
+	}
+	if n, err := strconv.Atoi(counts[0]); err != nil || n < 1 {
+		return fmt.Errorf("expected a server count of at least 1, got %q", counts[0])
+	}
+	return nil
+}
+
+func (r *serverRun) dialAndClose() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	return r.closeFromClient(fs, connectID)
+}
+
+func (r *serverRun) dialError() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	random, err := r.awaitDialRequest(fs, "tcp", destination)
+	if err != nil {
+		return err
+	}
+	delete(r.dialReqs, random)
+	dialErr := fmt.Sprintf("dial tcp %s: connect: connection refused", destination)
+	if err := r.sendAgent(dialResponsePacket(random, 0, dialErr)); err != nil {
+		return err
+	}
+	if err := r.waitStep("the dial response at the client", func() bool { return fs.dials[random] != nil }); err != nil {
+		return err
+	}
+	if resp := fs.dials[random]; resp.Error == "" {
+		return fmt.Errorf("expected the dial failed by the agent to fail, got connection %d", resp.ConnectID)
+	}
+	return nil
+}
+
+func (r *serverRun) echoCase() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	if err := fs.stream.Send(dataPacket(connectID, "ping")); err != nil {
+		return err
+	}
+	if err := r.awaitData(nil, connectID, "ping"); err != nil {
+		return err
+	}
+	if err := r.sendAgent(dataPacket(connectID, "pong")); err != nil {
+		return err
+	}
+	if err := r.awaitData(fs, connectID, "pong"); err != nil {
+		return err
+	}
+	return r.closeFromClient(fs, connectID)
+}
+
+func (r *serverRun) concurrentDials() error {
+	streams := make([]*frontendStream, concurrentDials)
+	randoms := make([]int64, concurrentDials)
+	for i := range streams {
+		fs, err := r.openFrontend()
+		if err != nil {
+			return err
+		}
+		streams[i] = fs
+		if randoms[i], err = r.sendDial(fs, "tcp", destination); err != nil {
+			return err
+		}
+	}
+	err := r.waitStep(fmt.Sprintf("%d dial requests at the agent", concurrentDials), func() bool {
+		for i, random := range randoms {
+			if r.dialReqs[random] == nil && streams[i].dials[random] == nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// Answered in reverse order, each connection is routed by its ID.
+	connectIDs := make([]int64, concurrentDials)
+	for i := len(randoms) - 1; i >= 0; i-- {
+		if resp := streams[i].dials[randoms[i]]; resp != nil {
+			return fmt.Errorf("dial %d failed before reaching the agent: %s", randoms[i], resp.Error)
+		}
+		connectIDs[i] = r.acceptDial(randoms[i])
+		if err := r.sendAgent(dialResponsePacket(randoms[i], connectIDs[i], "")); err != nil {
+			return err
+		}
+	}
+	for i, fs := range streams {
+		if err := r.awaitDialResponse(fs, randoms[i], connectIDs[i]); err != nil {
+			return err
+		}
+	}
+	for _, connectID := range connectIDs {
+		if err := r.sendAgent(dataPacket(connectID, fmt.Sprintf("connection %d", connectID))); err != nil {
+			return err
+		}
+	}
+	for i, fs := range streams {
+		if err := r.awaitData(fs, connectIDs[i], fmt.Sprintf("connection %d", connectIDs[i])); err != nil {
+			return err
+		}
+		for connectID := range fs.data {
+			return fmt.Errorf("client of connection %d received DATA of connection %d", connectIDs[i], connectID)
+		}
+	}
+	for i, fs := range streams {
+		if err := r.closeFromClient(fs, connectIDs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *serverRun) agentClose() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	if err := r.sendAgent(closeResponsePacket(connectID)); err != nil {
+		return err
+	}
+	return r.awaitCloseResponse(fs, connectID)
+}
+
+func (r *serverRun) clientDisconnect() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	fs.cancel()
+	if err := r.awaitCloseRequest(connectID); err != nil {
+		return err
+	}
+	return r.sendAgent(closeResponsePacket(connectID))
+}
+
+func (r *serverRun) closeBeforeDial() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	if err := fs.stream.Send(closeRequestPacket(unknownConnectID)); err != nil {
+		return err
+	}
+	if err := fs.stream.Send(dataPacket(unknownConnectID, "unknown")); err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	return r.closeFromClient(fs, connectID)
+}
+
+func (r *serverRun) capabilities() error {
+	fs, err := r.openFrontend()
+	if err != nil {
+		return err
+	}
+	random, err := r.sendDial(fs, "udp", destination)
+	if err != nil {
+		return err
+	}
+	err = r.waitStep("the dial response at the client", func() bool {
+		return r.dialReqs[random] != nil || fs.dials[random] != nil
+	})
+	if err != nil {
+		return err
+	}
+	if r.dialReqs[random] != nil {
+		delete(r.dialReqs, random)
+		r.sendAgent(dialResponsePacket(random, 0, "udp not supported")) /* #nosec G104 */
+		return fmt.Errorf("expected the udp dial not to be routed to the agent without the %q capability", "udp")
+	}
+	if resp := fs.dials[random]; resp.Error == "" {
+		return fmt.Errorf("expected the udp dial to fail, got connection %d", resp.ConnectID)
+	}
+	// The server still routes the dials the agent is capable of.
+	if fs, err = r.openFrontend(); err != nil {
+		return err
+	}
+	connectID, err := r.dial(fs)
+	if err != nil {
+		return err
+	}
+	return r.closeFromClient(fs, connectID)
+}
+
+func (r *serverRun) noAgent() error {
+	r.agent.close()
+	deadline := time.Now().Add(r.suite.cfg.StepTimeout)
+	for {
+		// Each attempt uses a new stream, the server may have routed
+		// the previous dial to the disconnected agent.
+		fs, err := r.openFrontend()
+		if err != nil {
+			return err
+		}
+		random, err := r.sendDial(fs, "tcp", destination)
+		if err != nil {
+			return err
+		}
+		err = r.wait("the dial response at the client", noAgentAttempt, func() bool { return fs.dials[random] != nil })
+		if err == nil {
+			resp := fs.dials[random]
+			if resp.ErrorCode == client.DialErrorCode_DIAL_ERROR_NO_AGENT {
+				return nil
+			}
+			return fmt.Errorf("expected the dial to fail with error code %v, got %v: %q", client.DialErrorCode_DIAL_ERROR_NO_AGENT, resp.ErrorCode, resp.Error)
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+func dialResponsePacket(random, connectID int64, dialErr string) *client.Packet {
+	return &client.Packet{
+		Type: client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{
+			Random:    random,
+			ConnectID: connectID,
+			Error:     dialErr,
+		}},
+	}
+}
+
+func dataPacket(connectID int64, data string) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: connectID, Data: []byte(data)}},
+	}
+}
+
+func closeRequestPacket(connectID int64) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connectID}},
+	}
+}
+
+func closeResponsePacket(connectID int64) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: connectID}},
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+func TestServerSuite(t *testing.T) {
+	frontendLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := server.New(server.Options{ServerID: "conformance-server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterFrontend(server.FrontendGRPC, frontendLis); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterBackend(agentLis); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go srv.Run(ctx) /* #nosec G104 */
+
+	suite, err := NewServerSuite(ServerConfig{
+		AgentAddress:        agentLis.Addr().String(),
+		AgentDialOptions:    []grpc.DialOption{grpc.WithInsecure()},
+		FrontendAddress:     frontendLis.Addr().String(),
+		FrontendDialOptions: []grpc.DialOption{grpc.WithInsecure()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := suite.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(ServerCases()) {
+		t.Errorf("expected %d results, got %d", len(ServerCases()), len(report.Results))
+	}
+	if !report.Passed() {
+		var buf bytes.Buffer
+		report.WriteText(&buf) /* #nosec G104 */
+		t.Errorf("expected the server to pass, got:\n%s", buf.String())
+	}
+	if report.Subject != "conformance-server" {
+		t.Errorf("expected subject %q, got %q", "conformance-server", report.Subject)
+	}
+}
+
+func TestServerSuiteNoServer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	suite, err := NewServerSuite(ServerConfig{
+		AgentAddress:        addr,
+		AgentDialOptions:    []grpc.DialOption{grpc.WithInsecure()},
+		FrontendAddress:     addr,
+		FrontendDialOptions: []grpc.DialOption{grpc.WithInsecure()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := suite.Run(ctx); err == nil {
+		t.Errorf("expected an error without server, got none")
+	}
+}
+
+func TestNewServerSuiteSelectsCases(t *testing.T) {
+	suite, err := NewServerSuite(ServerConfig{AgentAddress: "agent", FrontendAddress: "frontend", Cases: []string{"echo", "dial"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suite.cases) != 2 || suite.cases[0].Name != "echo" || suite.cases[1].Name != "dial" {
+		t.Errorf("expected the echo and dial cases, got %v", suite.cases)
+	}
+	if _, err := NewServerSuite(ServerConfig{AgentAddress: "agent", FrontendAddress: "frontend", Cases: []string{"unknown"}}); err == nil {
+		t.Errorf("expected an error selecting an unknown case, got none")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// agentProtocolVersion returns the protocol version negotiated with the
+// agent of the Connect stream context ctx.
+func (s *ProxyServer) agentProtocolVersion(ctx context.Context) int {
+	local := s.MaxAgentProtocolVersion
+	if local == 0 {
+		local = pkgagent.ProtocolVersion
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return pkgagent.ProtocolVersionLegacy
+	}
+	remote, err := pkgagent.ParseProtocolVersion(md.Get(header.ProtocolVersion))
+	if err != nil {
+		klog.V(2).InfoS("Invalid agent protocol version, using the legacy version", "err", err)
+		return pkgagent.ProtocolVersionLegacy
+	}
+	return pkgagent.NegotiateProtocolVersion(local, remote)
+}
+
+// sendAck sends an ACK of the DATA received from the agent. ACKs asking to
+// retransmit report DATA lost on the way.
+func (s *ProxyServer) sendAck(b Backend, agentID string, ack *client.Packet) {
+	if ack.GetAck().Retransmit {
+		klog.V(2).InfoS("DATA lost, requesting retransmission", "agentID", agentID, "connectionID", ack.GetAck().ConnectID, "lastSeq", ack.GetAck().Seq)
+		metrics.Metrics.DataSequenceGapInc()
+	}
+	if err := b.Send(ack); err != nil {
+		klog.ErrorS(err, "ACK to Backend failed", "serverID", s.serverID, "agentID", agentID, "connectionID", ack.GetAck().ConnectID)
+	}
+}
+
+// handleAck drops the DATA acknowledged by the agent from the retransmit
+// buffer of the frontend, and sends the following DATA again if the agent
+// asks to. The connection is closed if some of it was evicted from the
+// buffer already.
+func (s *ProxyServer) handleAck(b Backend, frontend *ProxyClientConnection, ack *client.Ack) {
+	if frontend.replay == nil {
+		return
+	}
+	frontend.replay.Ack(ack.Seq)
+	if !ack.Retransmit {
+		return
+	}
+	packets, ok := frontend.replay.Since(ack.Seq)
+	if !ok {
+		klog.V(2).InfoS("Closing connection missing data evicted from the retransmit buffer", "serverID", s.serverID, "connectionID", ack.ConnectID, "lastSeq", ack.Seq)
+		packets = []*client.Packet{closeRequestPacket(ack.ConnectID)}
+	}
+	for _, pkt := range packets {
+		if err := b.Send(pkt); err != nil {
+			klog.ErrorS(err, "Retransmit to Backend failed", "serverID", s.serverID, "connectionID", ack.ConnectID)
+			return
+		}
+	}
+}
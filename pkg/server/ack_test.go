@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestAgentProtocolVersion(t *testing.T) {
+	versionContext := func(version string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(header.ProtocolVersion, version))
+	}
+	testcases := []struct {
+		name       string
+		maxVersion int
+		ctx        context.Context
+		want       int
+	}{
+		{name: "legacy agent", ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{}), want: pkgagent.ProtocolVersionLegacy},
+		{name: "current agent", ctx: versionContext("2"), want: pkgagent.ProtocolVersionAck},
+		{name: "newer agent", ctx: versionContext("9"), want: pkgagent.ProtocolVersion},
+		{name: "invalid version", ctx: versionContext("latest"), want: pkgagent.ProtocolVersionLegacy},
+		{name: "limited server", maxVersion: 1, ctx: versionContext("2"), want: pkgagent.ProtocolVersionLegacy},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &ProxyServer{MaxAgentProtocolVersion: tc.maxVersion}
+			if got := s.agentProtocolVersion(tc.ctx); got != tc.want {
+				t.Errorf("expected version %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleAck(t *testing.T) {
+	s := &ProxyServer{}
+	frontend := &ProxyClientConnection{connectID: 1, replay: util.NewReplayBuffer(1024)}
+	for i := 0; i < 3; i++ {
+		frontend.replay.Add(dataPacket(1, "a"))
+	}
+
+	b := &recordingBackend{}
+	s.handleAck(b, frontend, &client.Ack{ConnectID: 1, Seq: 1})
+	if len(b.sent) != 0 {
+		t.Fatalf("expected nothing to be sent for an ACK, got %v", b.sent)
+	}
+	s.handleAck(b, frontend, &client.Ack{ConnectID: 1, Seq: 1, Retransmit: true})
+	if len(b.sent) != 2 || b.sent[0].GetData().Seq != 2 || b.sent[1].GetData().Seq != 3 {
+		t.Fatalf("expected DATA 2 and 3 to be sent again, got %v", b.sent)
+	}
+
+	// DATA 1 was acknowledged and dropped, the connection is closed.
+	b = &recordingBackend{}
+	s.handleAck(b, frontend, &client.Ack{ConnectID: 1, Seq: 0, Retransmit: true})
+	if len(b.sent) != 1 || b.sent[0].Type != client.PacketType_CLOSE_REQ {
+		t.Errorf("expected CLOSE_REQ, got %v", b.sent)
+	}
+}
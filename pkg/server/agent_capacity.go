@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// ErrAgentsSaturated indicates that agents are available, but all those
+// allowed to serve the dial reached the connection capacity they
+// advertised. The dial may be retried once connections closed.
+type ErrAgentsSaturated struct{}
+
+// Error returns the error message.
+func (e *ErrAgentsSaturated) Error() string {
+	return "All agents available reached their connection capacity"
+}
+
+// maxConnections returns the connection capacity the agent advertised when
+// it connected, 0 if unlimited or if its stream has no context.
+func (b *backend) maxConnections() int {
+	ctx := b.Context()
+	if ctx == nil {
+		return 0
+	}
+	return contextMaxConnections(ctx)
+}
+
+// contextMaxConnections returns the connection capacity advertised in the
+// metadata of the Connect stream context of an agent, 0 if unlimited.
+func contextMaxConnections(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0
+	}
+	values := md.Get(header.AgentMaxConnections)
+	if len(values) != 1 {
+		return 0
+	}
+	max, err := strconv.Atoi(values[0])
+	if err != nil || max < 0 {
+		return 0
+	}
+	return max
+}
+
+// capacityFilter is the agentFilter of a dial skipping the agents which
+// reached their connection capacity, besides those not allowed. It
+// records whether it skipped any, to tell saturated agents from missing
+// ones. Dials picking an agent concurrently may exceed its capacity by
+// the dials in flight.
+type capacityFilter struct {
+	s       *ProxyServer
+	allowed agentFilter
+	// counts are the connections of each agent, counted the first time
+	// an agent with a capacity is filtered.
+	counts    map[string]int
+	saturated bool
+}
+
+func (f *capacityFilter) filter(b *backend) bool {
+	if f.allowed != nil && !f.allowed(b) {
+		return false
+	}
+	max := b.maxConnections()
+	if max == 0 {
+		return true
+	}
+	if f.connectionCounts()[backendAgentID(b)] < max {
+		return true
+	}
+	f.saturated = true
+	return false
+}
+
+// connectionCounts returns the connections of each agent, counting them
+// on first use.
+func (f *capacityFilter) connectionCounts() map[string]int {
+	if f.counts == nil {
+		f.counts = f.s.agentConnectionCounts()
+	}
+	return f.counts
+}
+
+// agentConnectionCounts returns the number of established and pending
+// connections through each agent.
+func (s *ProxyServer) agentConnectionCounts() map[string]int {
+	counts := make(map[string]int)
+	s.fmu.RLock()
+	for agentID, conns := range s.frontends {
+		counts[agentID] = len(conns)
+	}
+	s.fmu.RUnlock()
+	for _, frontend := range s.PendingDial.list() {
+		if frontend == nil {
+			continue
+		}
+		if agentID := backendAgentID(frontend.backend); agentID != "" {
+			counts[agentID]++
+		}
+	}
+	return counts
+}
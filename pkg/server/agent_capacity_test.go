@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func newFakeLimitedConnectServer(agentID, maxConnections string) *fakeCapableConnectServer {
+	md := metadata.Pairs(header.AgentID, agentID, header.AgentMaxConnections, maxConnections)
+	return &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func TestAgentCapacitySpillsOver(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	for _, agentID := range []string{"agent1", "agent2"} {
+		p.BackendManagers[0].AddBackend(agentID, pkgagent.UID, newFakeLimitedConnectServer(agentID, "1"))
+	}
+
+	be, _, err := p.getBackend("10.0.0.1:80", "tcp", "", nil)
+	if err != nil {
+		t.Fatalf("expected a backend, got %v", err)
+	}
+	first := backendAgentID(be)
+	// the dial is pending until the agent answers
+	p.PendingDial.Add(1, &ProxyClientConnection{backend: be})
+	for i := 0; i < 10; i++ {
+		be, _, err := p.getBackend("10.0.0.1:80", "tcp", "", nil)
+		if err != nil {
+			t.Fatalf("expected a backend, got %v", err)
+		}
+		if agentID := backendAgentID(be); agentID == first {
+			t.Fatalf("expected the dial to spill over from the saturated %s, got %s", first, agentID)
+		}
+	}
+
+	p.PendingDial.Remove(1)
+	p.addFrontend("agent1", 1, &ProxyClientConnection{})
+	p.addFrontend("agent2", 2, &ProxyClientConnection{})
+	_, _, err = p.getBackend("10.0.0.1:80", "tcp", "", nil)
+	if _, ok := err.(*ErrAgentsSaturated); !ok {
+		t.Fatalf("expected ErrAgentsSaturated, got %v", err)
+	}
+	if code := dialErrorCode(err); code != client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED {
+		t.Errorf("expected error code %v, got %v", client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED, code)
+	}
+
+	p.removeFrontend("agent2", 2)
+	be, _, err = p.getBackend("10.0.0.1:80", "tcp", "", nil)
+	if err != nil {
+		t.Fatalf("expected a backend once a connection closed, got %v", err)
+	}
+	if agentID := backendAgentID(be); agentID != "agent2" {
+		t.Errorf("expected agent2 below its capacity, got %s", agentID)
+	}
+}
+
+func TestAgentCapacityUnlimited(t *testing.T) {
+	testCases := []struct {
+		name           string
+		maxConnections string
+	}{
+		{name: "zero", maxConnections: "0"},
+		{name: "invalid", maxConnections: "many"},
+		{name: "negative", maxConnections: "-1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+			p.BackendManagers[0].AddBackend("agent1", pkgagent.UID, newFakeLimitedConnectServer("agent1", tc.maxConnections))
+			for i := int64(0); i < 5; i++ {
+				p.addFrontend("agent1", i, &ProxyClientConnection{})
+			}
+			if _, _, err := p.getBackend("10.0.0.1:80", "tcp", "", nil); err != nil {
+				t.Errorf("expected a backend, got %v", err)
+			}
+		})
+	}
+}
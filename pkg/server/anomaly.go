@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+const (
+	// anomalyHistory is the number of past windows the baseline of an
+	// identity is made of, and anomalyMinHistory the number it needs
+	// before its windows are scored.
+	anomalyHistory    = 12
+	anomalyMinHistory = 3
+	// maxAnomalyIdentities and maxKnownDestinations bound the memory of
+	// the detector. Further identities are not tracked, and further
+	// destinations of an identity are not learned.
+	maxAnomalyIdentities = 1000
+	maxKnownDestinations = 10000
+	// maxAnomalyEvents is the number of anomalies kept for
+	// /debug/anomalies, and maxAnomalySample the number of destinations
+	// listed in each.
+	maxAnomalyEvents = 100
+	maxAnomalySample = 10
+)
+
+// AnomalyConfig configures the detection of frontends suddenly dialing
+// unusual destinations, e.g. scanning the cluster network through the
+// tunnel.
+type AnomalyConfig struct {
+	// Window is the period over which the destinations an identity never
+	// dialed before are counted. 0 disables the detection.
+	Window time.Duration
+	// Threshold is the z-score of the count of new destinations in a
+	// window, against the previous windows of the identity, beyond which
+	// the window is reported.
+	Threshold float64
+	// MinDestinations is the least count of new destinations reported, so
+	// that an identity with a steady baseline is not reported for dialing
+	// a couple of new destinations.
+	MinDestinations int
+}
+
+// Anomaly is an identity dialing unusual destinations, served on
+// /debug/anomalies of the admin port.
+type Anomaly struct {
+	Identity string    `json:"identity"`
+	Time     time.Time `json:"time"`
+	// NewDestinations is the count of destinations the identity never
+	// dialed before in the window, against Baseline on average.
+	NewDestinations int      `json:"newDestinations"`
+	Baseline        float64  `json:"baseline"`
+	ZScore          float64  `json:"zScore"`
+	Sample          []string `json:"sample"`
+}
+
+// destinationBaseline tracks the destinations dialed by an identity.
+type destinationBaseline struct {
+	known map[string]struct{}
+	// windowStart is the start of the current window, in which the new
+	// destinations were dialed.
+	windowStart time.Time
+	newDests    []string
+	newCount    int
+	reported    bool
+	// history are the counts of new destinations of the previous windows,
+	// the oldest first.
+	history []float64
+}
+
+// anomalyDetector tracks the destinations dialed by each identity.
+type anomalyDetector struct {
+	mu        sync.Mutex
+	baselines map[string]*destinationBaseline
+	events    []Anomaly
+}
+
+// roll closes the windows of b elapsed at now.
+func (b *destinationBaseline) roll(now time.Time, window time.Duration) {
+	for i := 0; !now.Before(b.windowStart.Add(window)); i++ {
+		if i == anomalyHistory {
+			// idle for longer than the history
+			b.windowStart = now
+			break
+		}
+		b.history = append(b.history, float64(b.newCount))
+		if len(b.history) > anomalyHistory {
+			b.history = b.history[1:]
+		}
+		b.windowStart = b.windowStart.Add(window)
+		b.newCount, b.newDests, b.reported = 0, nil, false
+	}
+}
+
+// score returns the z-score of count against the history of b, and the
+// mean of the history.
+func (b *destinationBaseline) score(count int) (float64, float64) {
+	var mean float64
+	for _, c := range b.history {
+		mean += c
+	}
+	mean /= float64(len(b.history))
+	var variance float64
+	for _, c := range b.history {
+		variance += (c - mean) * (c - mean)
+	}
+	// A steady baseline has no deviation, count it as 1 so that a single
+	// new destination is not infinitely unusual.
+	stddev := math.Max(math.Sqrt(variance/float64(len(b.history))), 1)
+	return (float64(count) - mean) / stddev, mean
+}
+
+// observeDestination accounts the dial of address by the frontend to the
+// baseline of its identity, and reports the identity once it dialed an
+// unusual number of new destinations in the current window.
+func (s *ProxyServer) observeDestination(frontend *ProxyClientConnection, address string) {
+	if s.AnomalyDetection.Window <= 0 || frontend.relayed {
+		// relayed dials are observed by the relaying peer
+		return
+	}
+	s.detectAnomaly(frontend.identity, address, time.Now())
+}
+
+// detectAnomaly accounts the dial of address by identity at now.
+func (s *ProxyServer) detectAnomaly(identity, address string, now time.Time) {
+	config := s.AnomalyDetection
+	d := &s.anomalies
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b := d.baselines[identity]
+	if b == nil {
+		if len(d.baselines) >= maxAnomalyIdentities {
+			return
+		}
+		if d.baselines == nil {
+			d.baselines = make(map[string]*destinationBaseline)
+		}
+		b = &destinationBaseline{known: make(map[string]struct{}), windowStart: now}
+		d.baselines[identity] = b
+	}
+	b.roll(now, config.Window)
+	if _, ok := b.known[address]; ok || len(b.known) >= maxKnownDestinations {
+		return
+	}
+	b.known[address] = struct{}{}
+	b.newCount++
+	if len(b.newDests) < maxAnomalySample {
+		b.newDests = append(b.newDests, address)
+	}
+	if b.reported || len(b.history) < anomalyMinHistory || b.newCount < config.MinDestinations {
+		return
+	}
+	z, mean := b.score(b.newCount)
+	if z <= config.Threshold {
+		return
+	}
+	b.reported = true
+	anomaly := Anomaly{
+		Identity:        identity,
+		Time:            now,
+		NewDestinations: b.newCount,
+		Baseline:        mean,
+		ZScore:          z,
+		Sample:          append([]string(nil), b.newDests...),
+	}
+	klog.InfoS("Frontend dialing unusual destinations", "serverID", s.serverID, "identity", anomaly.Identity, "newDestinations", anomaly.NewDestinations, "baseline", mean, "zScore", z, "sample", anomaly.Sample)
+	metrics.Metrics.DestinationAnomalyInc()
+	d.events = append(d.events, anomaly)
+	if len(d.events) > maxAnomalyEvents {
+		d.events = d.events[1:]
+	}
+}
+
+// Anomalies returns the last anomalies detected, the oldest first.
+func (s *ProxyServer) Anomalies() []Anomaly {
+	s.anomalies.mu.Lock()
+	defer s.anomalies.mu.Unlock()
+	return append([]Anomaly{}, s.anomalies.events...)
+}
+
+// ServeAnomalies serves the last anomalies detected as JSON.
+func (s *ProxyServer) ServeAnomalies(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Anomalies()); err != nil {
+		klog.ErrorS(err, "Failed to serve the anomalies")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDetectAnomaly(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.AnomalyDetection = AnomalyConfig{Window: time.Minute, Threshold: 3, MinDestinations: 5}
+	start := time.Now()
+
+	// Build a baseline of 2, 1 and 1 new destinations per window.
+	p.detectAnomaly("apiserver", "node1:10250", start)
+	p.detectAnomaly("apiserver", "node2:10250", start)
+	p.detectAnomaly("apiserver", "node3:10250", start.Add(time.Minute))
+	p.detectAnomaly("apiserver", "node1:10250", start.Add(time.Minute))
+	p.detectAnomaly("apiserver", "node4:10250", start.Add(2*time.Minute))
+
+	// A scan in the fourth window is reported once.
+	scan := start.Add(3 * time.Minute)
+	for i := 0; i < 4; i++ {
+		p.detectAnomaly("apiserver", fmt.Sprintf("10.0.0.%d:22", i), scan)
+	}
+	if anomalies := p.Anomalies(); len(anomalies) != 0 {
+		t.Fatalf("expected no anomaly below the min destinations, got %v", anomalies)
+	}
+	for i := 4; i < 20; i++ {
+		p.detectAnomaly("apiserver", fmt.Sprintf("10.0.0.%d:22", i), scan)
+	}
+	anomalies := p.Anomalies()
+	if len(anomalies) != 1 {
+		t.Fatalf("expected 1 anomaly, got %v", anomalies)
+	}
+	if a := anomalies[0]; a.Identity != "apiserver" || a.NewDestinations != 5 || len(a.Sample) != 5 || a.ZScore <= 3 {
+		t.Errorf("expected the apiserver to be reported after 5 new destinations, got %+v", a)
+	}
+
+	// Identities without enough history are not scored.
+	for i := 0; i < 20; i++ {
+		p.detectAnomaly("konnectivity-client", fmt.Sprintf("10.0.1.%d:22", i), scan)
+	}
+	if anomalies := p.Anomalies(); len(anomalies) != 1 {
+		t.Errorf("expected no anomaly without baseline, got %v", anomalies)
+	}
+}
+
+func TestDestinationBaselineRoll(t *testing.T) {
+	start := time.Now()
+	b := &destinationBaseline{windowStart: start, newCount: 3}
+	b.roll(start.Add(90*time.Second), time.Minute)
+	if len(b.history) != 1 || b.history[0] != 3 || b.newCount != 0 || !b.windowStart.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected one window closed, got history %v and window start %v", b.history, b.windowStart.Sub(start))
+	}
+	b.roll(start.Add(time.Hour), time.Minute)
+	if len(b.history) != anomalyHistory {
+		t.Fatalf("expected %d windows of history, got %v", anomalyHistory, b.history)
+	}
+	for _, c := range b.history {
+		if c != 0 {
+			t.Errorf("expected the idle windows to have no new destinations, got %v", b.history)
+			break
+		}
+	}
+	if !b.windowStart.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the window to restart after the idle period, got %v", b.windowStart.Sub(start))
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// AuditEventType is the kind of tunnel event recorded in the audit log.
+type AuditEventType string
+
+const (
+	// AuditDialRequest is recorded when a frontend asks to dial a destination.
+	AuditDialRequest AuditEventType = "dial_request"
+	// AuditDialResponse is recorded once the dial succeeded or failed.
+	AuditDialResponse AuditEventType = "dial_response"
+	// AuditDialCanceled is recorded when the frontend gives up on a pending dial.
+	AuditDialCanceled AuditEventType = "dial_canceled"
+	// AuditClose is recorded when an established connection is closed.
+	AuditClose AuditEventType = "close"
+)
+
+const (
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+)
+
+// AuditEvent is a single line of the audit log.
+type AuditEvent struct {
+	Timestamp        time.Time      `json:"timestamp"`
+	Type             AuditEventType `json:"type"`
+	ServerID         string         `json:"serverID"`
+	FrontendMode     string         `json:"frontendMode,omitempty"`
+	FrontendIdentity string         `json:"frontendIdentity,omitempty"`
+	AgentID          string         `json:"agentID,omitempty"`
+	DialID           int64          `json:"dialID,omitempty"`
+	ConnectionID     int64          `json:"connectionID,omitempty"`
+	Protocol         string         `json:"protocol,omitempty"`
+	Destination      string         `json:"destination,omitempty"`
+	// DestinationHostname is the host name the frontend resolved the
+	// destination from, if it sent one.
+	DestinationHostname string `json:"destinationHostname,omitempty"`
+	Result              string `json:"result,omitempty"`
+	Error               string `json:"error,omitempty"`
+	// BytesToAgent and BytesFromAgent count the uncompressed payload
+	// bytes of the connection, reported on close.
+	BytesToAgent   int64  `json:"bytesToAgent,omitempty"`
+	BytesFromAgent int64  `json:"bytesFromAgent,omitempty"`
+	Duration       string `json:"duration,omitempty"`
+	// BudgetAttempt and BudgetSpent report the dial budget of frontends
+	// re-dialing with a budget token, on dial responses.
+	BudgetAttempt int    `json:"budgetAttempt,omitempty"`
+	BudgetSpent   string `json:"budgetSpent,omitempty"`
+	// Annotations recorded by packet interceptors.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// AuditLogger writes AuditEvents as JSON lines. A nil *AuditLogger
+// discards all events.
+type AuditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// queue holds the events w failed to take until they are delivered.
+	// Nil drops them.
+	queue *AuditQueue
+	// queueWait is how long Log waits for room in a full queue.
+	queueWait time.Duration
+}
+
+// NewAuditLogger returns an AuditLogger writing to w.
+func NewAuditLogger(w io.Writer) *AuditLogger {
+	return &AuditLogger{w: w}
+}
+
+// NewQueuedAuditLogger returns an AuditLogger writing to w, which appends
+// the events to queue while w fails, and while the queue is not delivered
+// yet to keep the events in order. Log blocks up to queueWait while the
+// queue is full, slowing down the tunnels instead of dropping events.
+// RunDelivery delivers the queue.
+func NewQueuedAuditLogger(w io.Writer, queue *AuditQueue, queueWait time.Duration) *AuditLogger {
+	return &AuditLogger{w: w, queue: queue, queueWait: queueWait}
+}
+
+// Log writes ev, stamping it with the current time if it has none.
+func (l *AuditLogger) Log(ev *AuditEvent) {
+	if l == nil {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		klog.ErrorS(err, "failed to encode audit event", "type", ev.Type, "dialID", ev.DialID, "connectionID", ev.ConnectionID)
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queue == nil || l.queue.Len() == 0 {
+		_, err = l.w.Write(line)
+		if err == nil {
+			return
+		}
+		if l.queue == nil {
+			klog.ErrorS(err, "failed to write audit event", "type", ev.Type, "dialID", ev.DialID, "connectionID", ev.ConnectionID)
+			return
+		}
+		klog.ErrorS(err, "failed to write audit event, queuing it", "type", ev.Type, "dialID", ev.DialID, "connectionID", ev.ConnectionID)
+	}
+	if err := l.queue.push(line, l.queueWait); err != nil {
+		klog.ErrorS(err, "dropped audit event", "type", ev.Type, "dialID", ev.DialID, "connectionID", ev.ConnectionID)
+		metrics.Metrics.AuditEventDroppedInc()
+	}
+}
+
+// RunDelivery delivers the queued events to the writer every interval,
+// until stopCh is closed.
+func (l *AuditLogger) RunDelivery(interval time.Duration, stopCh <-chan struct{}) {
+	if l == nil || l.queue == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if err := l.queue.deliver(l.w); err != nil {
+			klog.V(2).InfoS("Failed to deliver the queued audit events, retrying later", "bytes", l.queue.Len(), "err", err)
+		}
+	}
+}
+
+// audit fills in the fields of ev known to the server and the frontend
+// connection, then logs it.
+func (s *ProxyServer) audit(ev *AuditEvent, frontend *ProxyClientConnection) {
+	if s.AuditLog == nil {
+		return
+	}
+	ev.ServerID = s.serverID
+	if frontend != nil {
+		ev.FrontendMode = frontend.Mode
+		ev.FrontendIdentity = frontend.identity
+		ev.Protocol = frontend.protocol
+		ev.Destination = frontend.address
+		ev.DestinationHostname = frontend.hostname
+		if ev.AgentID == "" {
+			ev.AgentID = frontend.agentID
+		}
+		if ev.ConnectionID == 0 {
+			ev.ConnectionID = frontend.connectID
+		}
+		ev.Annotations = frontend.annotationsCopy()
+	}
+	s.AuditLog.Log(ev)
+}
+
+// auditDialRequest records the dial request of frontend and remembers the
+// requested destination for the following events.
+func (s *ProxyServer) auditDialRequest(dialReq *client.DialRequest, frontend *ProxyClientConnection) {
+	frontend.protocol = dialReq.Protocol
+	frontend.address = dialReq.Address
+	frontend.hostname = dialReq.Hostname
+	s.audit(&AuditEvent{Type: AuditDialRequest, DialID: dialReq.Random}, frontend)
+}
+
+// auditDialResponse records the outcome of a dial. dialErr is empty on
+// success.
+func (s *ProxyServer) auditDialResponse(dialID, connID int64, frontend *ProxyClientConnection, agentID, dialErr string) {
+	ev := &AuditEvent{
+		Type:         AuditDialResponse,
+		DialID:       dialID,
+		ConnectionID: connID,
+		AgentID:      agentID,
+		Result:       auditResultSuccess,
+		Error:        dialErr,
+		Duration:     time.Since(frontend.start).String(),
+	}
+	if dialErr != "" {
+		ev.Result = auditResultFailure
+	}
+	if frontend.budgetAttempt > 0 {
+		ev.BudgetAttempt = frontend.budgetAttempt
+		ev.BudgetSpent = frontend.budgetSpent.String()
+	}
+	s.audit(ev, frontend)
+}
+
+// auditClose records the end of an established connection.
+func (s *ProxyServer) auditClose(frontend *ProxyClientConnection) {
+	s.audit(&AuditEvent{
+		Type:           AuditClose,
+		BytesToAgent:   atomic.LoadInt64(&frontend.bytesToAgent),
+		BytesFromAgent: atomic.LoadInt64(&frontend.bytesFromAgent),
+		Duration:       time.Since(frontend.start).String(),
+	}, frontend)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+const (
+	auditQueueEventsFile = "events"
+	auditQueueOffsetFile = "offset"
+	// auditQueueReadSize is the size of the chunks read from the queue
+	// while delivering it.
+	auditQueueReadSize = 64 * 1024
+)
+
+// errAuditQueueFull is returned when an event does not fit in the queue
+// in time.
+var errAuditQueueFull = errors.New("audit queue is full")
+
+// AuditQueue is a bounded on-disk queue of the audit events an AuditLogger
+// failed to write, delivered in order once its writer recovers. The queue
+// survives restarts: the events are appended to a file, along with the
+// offset of the first event not delivered yet.
+type AuditQueue struct {
+	maxSize int64
+
+	mu     sync.Mutex
+	events *os.File
+	offset *os.File
+	// size is the size of the events file, delivered is the offset of
+	// the first event left to deliver.
+	size      int64
+	delivered int64
+	// shrunk is closed and replaced whenever events are delivered.
+	shrunk chan struct{}
+}
+
+// OpenAuditQueue opens the queue stored in dir, creating it if needed,
+// holding at most maxSize bytes of events.
+func OpenAuditQueue(dir string, maxSize int64) (*AuditQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	events, err := os.OpenFile(filepath.Join(dir, auditQueueEventsFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := os.OpenFile(filepath.Join(dir, auditQueueOffsetFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		events.Close()
+		return nil, err
+	}
+	q := &AuditQueue{maxSize: maxSize, events: events, offset: offset, shrunk: make(chan struct{})}
+	if err := q.load(); err != nil {
+		q.Close()
+		return nil, fmt.Errorf("failed to load the audit queue in %s: %v", dir, err)
+	}
+	metrics.Metrics.SetAuditQueueBytes(q.size - q.delivered)
+	if q.size > q.delivered {
+		klog.InfoS("Resuming the delivery of queued audit events", "bytes", q.size-q.delivered)
+	}
+	return q, nil
+}
+
+// load reads the sizes of the queue from its files.
+func (q *AuditQueue) load() error {
+	fi, err := q.events.Stat()
+	if err != nil {
+		return err
+	}
+	q.size = fi.Size()
+	data, err := io.ReadAll(q.offset)
+	if err != nil {
+		return err
+	}
+	if s := strings.TrimSpace(string(data)); s != "" {
+		if q.delivered, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return fmt.Errorf("invalid offset %q: %v", s, err)
+		}
+	}
+	if q.delivered < 0 || q.delivered > q.size {
+		klog.InfoS("Ignoring the invalid offset of the audit queue, delivering it from the start", "offset", q.delivered, "size", q.size)
+		q.delivered = 0
+	}
+	return nil
+}
+
+// Len returns the bytes of events left to deliver.
+func (q *AuditQueue) Len() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.delivered
+}
+
+// push appends the event line to the queue, waiting up to wait for room
+// if the queue is full.
+func (q *AuditQueue) push(line []byte, wait time.Duration) error {
+	n := int64(len(line))
+	if n > q.maxSize {
+		return fmt.Errorf("audit event of %d bytes exceeds the queue size %d", n, q.maxSize)
+	}
+	var timeout <-chan time.Time
+	for {
+		q.mu.Lock()
+		if q.size+n <= q.maxSize {
+			defer q.mu.Unlock()
+			if _, err := q.events.Write(line); err != nil {
+				return err
+			}
+			q.size += n
+			metrics.Metrics.SetAuditQueueBytes(q.size - q.delivered)
+			return nil
+		}
+		shrunk := q.shrunk
+		q.mu.Unlock()
+
+		if timeout == nil {
+			if wait <= 0 {
+				return errAuditQueueFull
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-shrunk:
+		case <-timeout:
+			return errAuditQueueFull
+		}
+	}
+}
+
+// deliver writes the queued events to w in order, until the queue is
+// empty or w fails. The queue is truncated once all events are delivered.
+// Events written to w right before a crash may be delivered again.
+func (q *AuditQueue) deliver(w io.Writer) error {
+	buf := make([]byte, auditQueueReadSize)
+	for {
+		q.mu.Lock()
+		from, to := q.delivered, q.size
+		q.mu.Unlock()
+		if from == to {
+			return nil
+		}
+		chunk := buf
+		if to-from < int64(len(chunk)) {
+			chunk = chunk[:to-from]
+		}
+		n, err := q.events.ReadAt(chunk, from)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+		chunk = chunk[:n]
+		end := bytes.IndexByte(chunk, '\n')
+		switch {
+		case end < 0 && from+int64(n) < to:
+			// the event is larger than buf
+			buf = make([]byte, 2*len(buf))
+			continue
+		case end < 0:
+			// only the start of the last event was written, e.g. before
+			// a crash
+			klog.ErrorS(nil, "Dropping an incomplete audit event from the queue", "offset", from, "bytes", n)
+			metrics.Metrics.AuditEventDroppedInc()
+			if err := q.advance(int64(n)); err != nil {
+				return err
+			}
+			continue
+		}
+		for end >= 0 {
+			if _, err := w.Write(chunk[:end+1]); err != nil {
+				return err
+			}
+			if err := q.advance(int64(end + 1)); err != nil {
+				return err
+			}
+			chunk = chunk[end+1:]
+			end = bytes.IndexByte(chunk, '\n')
+		}
+	}
+}
+
+// advance records n more bytes of events as delivered, truncating the
+// queue once all of them are.
+func (q *AuditQueue) advance(n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.delivered += n
+	if q.delivered == q.size {
+		if err := q.events.Truncate(0); err != nil {
+			return err
+		}
+		q.size, q.delivered = 0, 0
+	}
+	if _, err := q.offset.WriteAt([]byte(fmt.Sprintf("%020d\n", q.delivered)), 0); err != nil {
+		return err
+	}
+	metrics.Metrics.SetAuditQueueBytes(q.size - q.delivered)
+	close(q.shrunk)
+	q.shrunk = make(chan struct{})
+	return nil
+}
+
+// Close closes the files of the queue. The events left are delivered
+// once it is opened again.
+func (q *AuditQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.events.Close()
+	if oerr := q.offset.Close(); err == nil {
+		err = oerr
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyWriter fails its writes while down.
+type flakyWriter struct {
+	bytes.Buffer
+	down bool
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.down {
+		return 0, errors.New("sink unavailable")
+	}
+	return w.Buffer.Write(p)
+}
+
+func decodeAuditEvents(t *testing.T, data []byte) []AuditEvent {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var events []AuditEvent
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestQueuedAuditLogger(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenAuditQueue(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &flakyWriter{}
+	l := NewQueuedAuditLogger(w, queue, 0)
+
+	l.Log(&AuditEvent{Type: AuditDialRequest, DialID: 1})
+	w.down = true
+	l.Log(&AuditEvent{Type: AuditDialRequest, DialID: 2})
+	w.down = false
+	// queued behind event 2 to keep the order
+	l.Log(&AuditEvent{Type: AuditDialRequest, DialID: 3})
+	if queue.Len() == 0 {
+		t.Fatal("expected events 2 and 3 to be queued")
+	}
+	if events := decodeAuditEvents(t, w.Bytes()); len(events) != 1 || events[0].DialID != 1 {
+		t.Fatalf("expected event 1 to be written, got %+v", events)
+	}
+
+	if err := queue.deliver(w); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("expected an empty queue, got %d bytes", queue.Len())
+	}
+	events := decodeAuditEvents(t, w.Bytes())
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	for i, ev := range events {
+		if ev.DialID != int64(i+1) {
+			t.Errorf("expected event %d, got %d", i+1, ev.DialID)
+		}
+	}
+	queue.Close()
+}
+
+func TestAuditQueueResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenAuditQueue(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"{\"dialID\":1}\n", "{\"dialID\":2}\n"} {
+		if err := queue.push([]byte(line), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &flakyWriter{}
+	if err := queue.advance(int64(len("{\"dialID\":1}\n"))); err != nil {
+		t.Fatal(err)
+	}
+	queue.Close()
+
+	queue, err = OpenAuditQueue(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	if err := queue.deliver(w); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := w.String(); got != "{\"dialID\":2}\n" {
+		t.Errorf("expected the undelivered event only, got %q", got)
+	}
+}
+
+func TestAuditQueueFull(t *testing.T) {
+	queue, err := OpenAuditQueue(t.TempDir(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	if err := queue.push([]byte("0123456789\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.push([]byte("0123456789\n"), 0); err != errAuditQueueFull {
+		t.Errorf("expected %v, got %v", errAuditQueueFull, err)
+	}
+
+	// a delivery frees room for a waiting event
+	done := make(chan error)
+	go func() {
+		done <- queue.push([]byte("0123456789\n"), 5*time.Second)
+	}()
+	w := &flakyWriter{}
+	if err := queue.deliver(w); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected the waiting event to be queued, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.AuditLog = NewAuditLogger(&buf)
+
+	frontend := &ProxyClientConnection{Mode: "grpc", identity: "kube-apiserver", start: time.Now()}
+	p.auditDialRequest(&client.DialRequest{Protocol: "tcp", Address: "10.0.0.1:10250", Hostname: "node-1", Random: 42}, frontend)
+	p.auditDialResponse(42, 7, frontend, "agent-1", "")
+	frontend.agentID = "agent-1"
+	frontend.connectID = 7
+	frontend.bytesToAgent = 100
+	frontend.bytesFromAgent = 200
+	p.auditClose(frontend)
+
+	dec := json.NewDecoder(&buf)
+	var events []AuditEvent
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 audit events, got %d", len(events))
+	}
+	for i, typ := range []AuditEventType{AuditDialRequest, AuditDialResponse, AuditClose} {
+		ev := events[i]
+		if ev.Type != typ || ev.ServerID != "server-1" || ev.FrontendIdentity != "kube-apiserver" || ev.Destination != "10.0.0.1:10250" || ev.DestinationHostname != "node-1" {
+			t.Errorf("unexpected event %d: %+v", i, ev)
+		}
+	}
+	if events[1].Result != auditResultSuccess || events[1].AgentID != "agent-1" || events[1].ConnectionID != 7 {
+		t.Errorf("unexpected dial response event: %+v", events[1])
+	}
+	if events[2].BytesToAgent != 100 || events[2].BytesFromAgent != 200 {
+		t.Errorf("unexpected byte counts in close event: %+v", events[2])
+	}
+}
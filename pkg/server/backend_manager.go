@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +29,7 @@ import (
 	client "sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
 
@@ -41,10 +43,19 @@ const (
 	// With this strategy the Proxy Server will pick a backend that has the same
 	// associated host as the request.Host to establish the tunnel.
 	ProxyStrategyDestHost ProxyStrategy = "destHost"
+	// ProxyStrategyDestHostHash maps the destination host to an agent on a
+	// consistent hash ring, so that the dials to a host go through the
+	// same agent as long as it is connected.
+	ProxyStrategyDestHostHash ProxyStrategy = "destHostHash"
 
 	// ProxyStrategyDefaultRoute will only forward traffic to agents that have explicity advertised
 	// they serve the default route through an agent identifier. Typically used in combination with destHost
 	ProxyStrategyDefaultRoute ProxyStrategy = "defaultRoute"
+
+	// ProxyStrategyLabelSelector will forward traffic to agents whose labels
+	// match the label selector sent by the frontend with the dial. Dials
+	// without a label selector are left to the next strategy.
+	ProxyStrategyLabelSelector ProxyStrategy = "labelSelector"
 )
 
 // GenProxyStrategiesFromStr generates the list of proxy strategies from the
@@ -56,10 +67,14 @@ func GenProxyStrategiesFromStr(proxyStrategies string) ([]ProxyStrategy, error)
 		switch s {
 		case string(ProxyStrategyDestHost):
 			ps = append(ps, ProxyStrategyDestHost)
+		case string(ProxyStrategyDestHostHash):
+			ps = append(ps, ProxyStrategyDestHostHash)
 		case string(ProxyStrategyDefault):
 			ps = append(ps, ProxyStrategyDefault)
 		case string(ProxyStrategyDefaultRoute):
 			ps = append(ps, ProxyStrategyDefaultRoute)
+		case string(ProxyStrategyLabelSelector):
+			ps = append(ps, ProxyStrategyLabelSelector)
 		default:
 			return nil, fmt.Errorf("Unknown proxy strategy %s", s)
 		}
@@ -80,6 +95,10 @@ type backend struct {
 	// write it using channel. Let's worry about performance later.
 	mu   sync.Mutex // mu protects conn
 	conn agent.AgentService_ConnectServer
+
+	// hello is the HELLO of the agent, nil if it did not send one
+	helloMu sync.Mutex
+	hello   *client.Hello
 }
 
 func (b *backend) Send(p *client.Packet) error {
@@ -128,9 +147,9 @@ type DefaultBackendManager struct {
 	*DefaultBackendStorage
 }
 
-func (dbm *DefaultBackendManager) Backend(_ context.Context) (Backend, error) {
-	klog.V(5).InfoS("Get a random backend through the DefaultBackendManager")
-	return dbm.DefaultBackendStorage.GetRandomBackend()
+func (dbm *DefaultBackendManager) Backend(ctx context.Context) (Backend, error) {
+	util.V(util.LogBackendManager, 5).InfoS("Get a random backend through the DefaultBackendManager")
+	return dbm.DefaultBackendStorage.getRandomBackend(requiredCapabilitiesFrom(ctx), trackFrom(ctx), agentFilterFrom(ctx))
 }
 
 // DefaultBackendStorage is the default backend storage.
@@ -155,6 +174,15 @@ type DefaultBackendStorage struct {
 	// e.g., when associating to the DestHostBackendManager, it can only use the
 	// identifiers of types, IPv4, IPv6 and Host.
 	idTypes []pkgagent.IdentifierType
+	// emptySince is when the last backend was removed, zero if there are
+	// backends or never were.
+	emptySince time.Time
+	// updates batches the additions and removals of backends, see
+	// BackendUpdateConfig.
+	updates backendUpdates
+	// agentsVersion changes whenever an agent is added to or removed from
+	// agentIDs.
+	agentsVersion uint64
 }
 
 // NewDefaultBackendManager returns a DefaultBackendManager.
@@ -185,18 +213,26 @@ func containIDType(idTypes []pkgagent.IdentifierType, idType pkgagent.Identifier
 // AddBackend adds a backend.
 func (s *DefaultBackendStorage) AddBackend(identifier string, idType pkgagent.IdentifierType, conn agent.AgentService_ConnectServer) Backend {
 	if !containIDType(s.idTypes, idType) {
-		klog.V(4).InfoS("fail to add backend", "backend", identifier, "error", &ErrWrongIDType{idType, s.idTypes})
+		util.V(util.LogBackendManager, 4).InfoS("fail to add backend", "backend", identifier, "error", &ErrWrongIDType{idType, s.idTypes})
 		return nil
 	}
-	klog.V(2).InfoS("Register backend for agent", "connection", conn, "agentID", identifier)
+	util.V(util.LogBackendManager, 2).InfoS("Register backend for agent", "connection", conn, "agentID", identifier)
+	addedBackend := newBackend(conn)
+	if s.batchUpdates(backendUpdate{identifier: identifier, idType: idType, conn: conn, added: addedBackend}) {
+		return addedBackend
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.addBackendLocked(identifier, idType, conn, addedBackend)
+}
+
+func (s *DefaultBackendStorage) addBackendLocked(identifier string, idType pkgagent.IdentifierType, conn agent.AgentService_ConnectServer, addedBackend *backend) *backend {
+	s.emptySince = time.Time{}
 	_, ok := s.backends[identifier]
-	addedBackend := newBackend(conn)
 	if ok {
 		for _, v := range s.backends[identifier] {
 			if v.conn == conn {
-				klog.V(1).InfoS("This should not happen. Adding existing backend for agent", "connection", conn, "agentID", identifier)
+				util.V(util.LogBackendManager, 1).InfoS("This should not happen. Adding existing backend for agent", "connection", conn, "agentID", identifier)
 				return v
 			}
 		}
@@ -206,6 +242,7 @@ func (s *DefaultBackendStorage) AddBackend(identifier string, idType pkgagent.Id
 	s.backends[identifier] = []*backend{addedBackend}
 	metrics.Metrics.SetBackendCount(len(s.backends))
 	s.agentIDs = append(s.agentIDs, identifier)
+	s.agentsVersion++
 	if idType == pkgagent.DefaultRoute {
 		s.defaultRouteAgentIDs = append(s.defaultRouteAgentIDs, identifier)
 	}
@@ -218,12 +255,19 @@ func (s *DefaultBackendStorage) RemoveBackend(identifier string, idType pkgagent
 		klog.ErrorS(&ErrWrongIDType{idType, s.idTypes}, "fail to remove backend")
 		return
 	}
-	klog.V(2).InfoS("Remove connection for agent", "connection", conn, "identifier", identifier)
+	util.V(util.LogBackendManager, 2).InfoS("Remove connection for agent", "connection", conn, "identifier", identifier)
+	if s.batchUpdates(backendUpdate{identifier: identifier, idType: idType, conn: conn}) {
+		return
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.removeBackendLocked(identifier, idType, conn)
+}
+
+func (s *DefaultBackendStorage) removeBackendLocked(identifier string, idType pkgagent.IdentifierType, conn agent.AgentService_ConnectServer) {
 	backends, ok := s.backends[identifier]
 	if !ok {
-		klog.V(1).InfoS("Cannot find agent in backends", "identifier", identifier)
+		util.V(util.LogBackendManager, 1).InfoS("Cannot find agent in backends", "identifier", identifier)
 		return
 	}
 	var found bool
@@ -231,13 +275,14 @@ func (s *DefaultBackendStorage) RemoveBackend(identifier string, idType pkgagent
 		if c.conn == conn {
 			s.backends[identifier] = append(s.backends[identifier][:i], s.backends[identifier][i+1:]...)
 			if i == 0 && len(s.backends[identifier]) != 0 {
-				klog.V(1).InfoS("This should not happen. Removed connection that is not the first connection", "connection", conn, "remainingConnections", s.backends[identifier])
+				util.V(util.LogBackendManager, 1).InfoS("This should not happen. Removed connection that is not the first connection", "connection", conn, "remainingConnections", s.backends[identifier])
 			}
 			found = true
 		}
 	}
 	if len(s.backends[identifier]) == 0 {
 		delete(s.backends, identifier)
+		s.agentsVersion++
 		for i := range s.agentIDs {
 			if s.agentIDs[i] == identifier {
 				s.agentIDs[i] = s.agentIDs[len(s.agentIDs)-1]
@@ -255,7 +300,10 @@ func (s *DefaultBackendStorage) RemoveBackend(identifier string, idType pkgagent
 		}
 	}
 	if !found {
-		klog.V(1).InfoS("Could not find connection matching identifier to remove", "connection", conn, "identifier", identifier)
+		util.V(util.LogBackendManager, 1).InfoS("Could not find connection matching identifier to remove", "connection", conn, "identifier", identifier)
+	}
+	if len(s.backends) == 0 && s.emptySince.IsZero() {
+		s.emptySince = time.Now()
 	}
 	metrics.Metrics.SetBackendCount(len(s.backends))
 }
@@ -267,6 +315,50 @@ func (s *DefaultBackendStorage) NumBackends() int {
 	return len(s.backends)
 }
 
+// identifiers returns the sorted identifiers with backends.
+func (s *DefaultBackendStorage) identifiers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.backends))
+	for id, bes := range s.backends {
+		if len(bes) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// agentFilter reports whether a dial may be routed through the agent of
+// b, e.g. because its circuit breaker is closed.
+type agentFilter func(b *backend) bool
+
+// filterAgentIDs returns the agents among agentIDs allowed by filter, or
+// ErrNotFound if there are none, leaving the dial to the next strategy.
+// It must be called with s.mu held.
+func (s *DefaultBackendStorage) filterAgentIDs(agentIDs []string, filter agentFilter) ([]string, error) {
+	if filter == nil {
+		return agentIDs, nil
+	}
+	var allowed []string
+	for _, agentID := range agentIDs {
+		if bes := s.backends[agentID]; len(bes) > 0 && filter(bes[0]) {
+			allowed = append(allowed, agentID)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &ErrNotFound{}
+	}
+	return allowed, nil
+}
+
+// agentFilterFrom returns the agentFilter getBackend stored in ctx, nil if
+// any agent is allowed.
+func agentFilterFrom(ctx context.Context) agentFilter {
+	filter, _ := ctx.Value(dialAgentFilter).(agentFilter)
+	return filter
+}
+
 // ErrNotFound indicates that no backend can be found.
 type ErrNotFound struct{}
 
@@ -293,13 +385,29 @@ func ignoreNotFound(err error) error {
 
 // GetRandomBackend returns a random backend connection from all connected agents.
 func (s *DefaultBackendStorage) GetRandomBackend() (Backend, error) {
+	return s.getRandomBackend(nil, "", nil)
+}
+
+// getRandomBackend returns a random backend connection from the connected
+// agents advertising all required capabilities, preferring agents on
+// track unless it is empty, among the agents allowed by filter unless it
+// is nil.
+func (s *DefaultBackendStorage) getRandomBackend(required []pkgagent.Capability, track string, filter agentFilter) (Backend, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if len(s.backends) == 0 {
 		return nil, &ErrNotFound{}
 	}
-	agentID := s.agentIDs[s.random.Intn(len(s.agentIDs))]
-	klog.V(4).InfoS("Pick agent as backend", "agentID", agentID)
+	agentIDs, err := s.capableAgentIDs(s.agentIDs, required)
+	if err != nil {
+		return nil, err
+	}
+	if agentIDs, err = s.filterAgentIDs(agentIDs, filter); err != nil {
+		return nil, err
+	}
+	agentIDs = s.trackAgentIDs(agentIDs, track)
+	agentID := agentIDs[s.random.Intn(len(agentIDs))]
+	util.V(util.LogBackendManager, 4).InfoS("Pick agent as backend", "agentID", agentID)
 	// always return the first connection to an agent, because the agent
 	// will close later connections if there are multiple.
 	return s.backends[agentID][0], nil
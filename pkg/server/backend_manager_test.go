@@ -17,17 +17,25 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
+	"google.golang.org/grpc/metadata"
 	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
 
 type fakeAgentServiceConnectServer struct {
 	agent.AgentService_ConnectServer
 }
 
+// Context returns nil, the fake carries no metadata.
+func (f *fakeAgentServiceConnectServer) Context() context.Context {
+	return nil
+}
+
 func TestAddRemoveBackends(t *testing.T) {
 	conn1 := new(fakeAgentServiceConnectServer)
 	conn12 := new(fakeAgentServiceConnectServer)
@@ -124,3 +132,48 @@ func TestAddRemoveBackendsWithDefaultRoute(t *testing.T) {
 		t.Errorf("expected %v, got %v", e, a)
 	}
 }
+
+type fakeCapableConnectServer struct {
+	agent.AgentService_ConnectServer
+	ctx context.Context
+}
+
+func (f *fakeCapableConnectServer) Context() context.Context {
+	return f.ctx
+}
+
+func newFakeCapableConnectServer(capabilities string) *fakeCapableConnectServer {
+	md := metadata.Pairs(header.AgentCapabilities, capabilities)
+	return &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func TestBackendRequiredCapabilities(t *testing.T) {
+	p := NewDefaultBackendManager()
+	p.AddBackend("agent1", pkgagent.UID, newFakeCapableConnectServer(""))
+
+	ctx := genContext(nil, "10.0.0.1:53", "udp")
+	_, err := p.Backend(ctx)
+	missingErr, ok := err.(*ErrMissingCapabilities)
+	if !ok {
+		t.Fatalf("expected ErrMissingCapabilities, got %v", err)
+	}
+	if e, a := []pkgagent.Capability{pkgagent.CapabilityUDP}, missingErr.Missing; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected missing capabilities %v, got %v", e, a)
+	}
+
+	capable := newFakeCapableConnectServer("udp,data-compression")
+	p.AddBackend("agent2", pkgagent.UID, capable)
+	for i := 0; i < 10; i++ {
+		be, err := p.Backend(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be.(*backend).conn != capable {
+			t.Fatal("expected the dial to be routed to the capable agent")
+		}
+	}
+
+	if _, err := p.Backend(genContext(nil, "10.0.0.1:443", "tcp")); err != nil {
+		t.Errorf("expected a backend for a tcp dial, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// BackendUpdateConfig keeps dial routing stable while many agents register
+// at once, e.g. after a proxy server restart.
+type BackendUpdateConfig struct {
+	// BatchInterval defers the additions and removals of backends, which
+	// are applied together at most this long after the first one, so that
+	// dials do not contend with every single registration for the backend
+	// managers. Agents become routable up to BatchInterval after they
+	// connected. 0 applies them immediately.
+	BatchInterval time.Duration
+	// ReadinessGrace keeps the proxy server ready for this long after its
+	// last backend was removed, so that agents reconnecting all at once do
+	// not flap its readiness. 0 reports it unready immediately.
+	ReadinessGrace time.Duration
+}
+
+// backendUpdate is a deferred addition, of added, or removal of a backend.
+type backendUpdate struct {
+	identifier string
+	idType     pkgagent.IdentifierType
+	conn       agent.AgentService_ConnectServer
+	added      *backend
+}
+
+// backendUpdates are the deferred updates of a DefaultBackendStorage.
+type backendUpdates struct {
+	mu             sync.Mutex
+	config         BackendUpdateConfig
+	pending        []backendUpdate
+	flushScheduled bool
+}
+
+// SetBackendUpdates configures the updates of the backend managers.
+func (s *ProxyServer) SetBackendUpdates(config BackendUpdateConfig) {
+	for _, bm := range s.BackendManagers {
+		if storage, ok := bm.(interface{ setUpdateConfig(BackendUpdateConfig) }); ok {
+			storage.setUpdateConfig(config)
+		}
+	}
+}
+
+func (s *DefaultBackendStorage) setUpdateConfig(config BackendUpdateConfig) {
+	s.updates.mu.Lock()
+	defer s.updates.mu.Unlock()
+	s.updates.config = config
+}
+
+// batchUpdates defers update if batching is enabled, returning false if it
+// is to be applied immediately.
+func (s *DefaultBackendStorage) batchUpdates(update backendUpdate) bool {
+	u := &s.updates
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.config.BatchInterval <= 0 {
+		return false
+	}
+	u.pending = append(u.pending, update)
+	if !u.flushScheduled {
+		u.flushScheduled = true
+		time.AfterFunc(u.config.BatchInterval, s.flushUpdates)
+	}
+	return true
+}
+
+// flushUpdates applies the deferred updates in the order they were made.
+func (s *DefaultBackendStorage) flushUpdates() {
+	s.updates.mu.Lock()
+	pending := s.updates.pending
+	s.updates.pending = nil
+	s.updates.flushScheduled = false
+	s.updates.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, update := range pending {
+		if update.added != nil {
+			s.addBackendLocked(update.identifier, update.idType, update.conn, update.added)
+		} else {
+			s.removeBackendLocked(update.identifier, update.idType, update.conn)
+		}
+	}
+	klog.V(4).InfoS("Applied batched backend updates", "count", len(pending), "backends", len(s.backends))
+}
+
+// readinessGrace returns how long the storage stays ready without backends.
+func (s *DefaultBackendStorage) readinessGrace() time.Duration {
+	s.updates.mu.Lock()
+	defer s.updates.mu.Unlock()
+	return s.updates.config.ReadinessGrace
+}
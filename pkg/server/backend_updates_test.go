@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func TestBatchedBackendUpdates(t *testing.T) {
+	conn1 := new(fakeAgentServiceConnectServer)
+	conn2 := new(fakeAgentServiceConnectServer)
+
+	p := NewDefaultBackendManager()
+	p.setUpdateConfig(BackendUpdateConfig{BatchInterval: time.Hour})
+	b1 := p.AddBackend("agent1", pkgagent.UID, conn1)
+	p.AddBackend("agent2", pkgagent.UID, conn2)
+	p.RemoveBackend("agent2", pkgagent.UID, conn2)
+	if n := p.NumBackends(); n != 0 {
+		t.Fatalf("expected the updates to be deferred, got %d backends", n)
+	}
+
+	p.flushUpdates()
+	if n := p.NumBackends(); n != 1 {
+		t.Fatalf("expected 1 backend after the batch, got %d", n)
+	}
+	if b, err := p.GetRandomBackend(); err != nil || b != b1 {
+		t.Errorf("expected the backend returned by AddBackend, got %v, %v", b, err)
+	}
+	if len(p.updates.pending) != 0 || p.updates.flushScheduled {
+		t.Errorf("expected no pending updates, got %v", p.updates.pending)
+	}
+}
+
+func TestReadinessGrace(t *testing.T) {
+	conn := new(fakeAgentServiceConnectServer)
+	p := NewDefaultBackendManager()
+	p.setUpdateConfig(BackendUpdateConfig{ReadinessGrace: time.Hour})
+	if ready, _ := p.Ready(); ready {
+		t.Error("expected not to be ready before any agent connected")
+	}
+	p.AddBackend("agent1", pkgagent.UID, conn)
+	p.RemoveBackend("agent1", pkgagent.UID, conn)
+	if ready, _ := p.Ready(); !ready {
+		t.Error("expected to stay ready within the grace period")
+	}
+
+	p.setUpdateConfig(BackendUpdateConfig{})
+	if ready, _ := p.Ready(); ready {
+		t.Error("expected not to be ready without a grace period")
+	}
+}
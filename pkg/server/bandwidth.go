@@ -0,0 +1,217 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// BandwidthLimits throttles the DATA bytes proxied in each direction, so
+// that a single bulk transfer can't starve the other connections. A limit
+// of 0 leaves the bandwidth unlimited.
+type BandwidthLimits struct {
+	// PerConnection is the bytes per second of each connection.
+	PerConnection int64
+	// PerAgent is the bytes per second of all connections through an
+	// agent.
+	PerAgent int64
+}
+
+// tokenBucket is a bucket of bytes refilled at rate per second, holding
+// up to one second of bytes or a packet, whichever is larger. A rate of 0
+// leaves the bucket unlimited.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex // mu protects rate, burst, tokens and last
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := math.Max(float64(rate), DefaultPacketChunkSize)
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// setRate changes the rate of the bucket, keeping the bytes it holds up to
+// the new burst.
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+	b.burst = math.Max(float64(rate), DefaultPacketChunkSize)
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// has to wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.rate <= 0 {
+		b.tokens, b.last = b.burst, now
+		return 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttle waits until n bytes can be sent in direction through all
+// buckets, nil buckets are unlimited.
+func throttle(direction PacketDirection, n int, buckets ...*tokenBucket) {
+	var delay time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		metrics.Metrics.ObserveBandwidthThrottle(string(direction), delay)
+		time.Sleep(delay)
+	}
+}
+
+// agentBandwidth are the buckets shared by the connections of an agent.
+type agentBandwidth struct {
+	toAgent   *tokenBucket
+	fromAgent *tokenBucket
+	streams   int
+}
+
+// connectionBandwidth are the buckets of a connection. DATA from the agent
+// is delivered through the send queue of the connection, so that
+// throttling a connection doesn't block the agent stream shared with
+// other connections.
+type connectionBandwidth struct {
+	toAgent   *tokenBucket
+	fromAgent *tokenBucket
+	agent     *agentBandwidth
+}
+
+// SetBandwidth changes the bandwidth limits. The per agent limit applies to
+// the connections of the agents right away, the per connection limit to the
+// connections dialed from now on. Connections dialed without any limit stay
+// unlimited.
+func (s *ProxyServer) SetBandwidth(limits BandwidthLimits) {
+	s.bmu.Lock()
+	defer s.bmu.Unlock()
+	s.bandwidth = limits
+	for _, ab := range s.agentBandwidth {
+		ab.toAgent.setRate(limits.PerAgent)
+		ab.fromAgent.setRate(limits.PerAgent)
+	}
+}
+
+// addAgentBandwidth creates the buckets of agentID for its first stream.
+// They are created without a per agent limit too, so that the limit can be
+// set later on.
+func (s *ProxyServer) addAgentBandwidth(agentID string) {
+	s.bmu.Lock()
+	defer s.bmu.Unlock()
+	if s.agentBandwidth == nil {
+		s.agentBandwidth = make(map[string]*agentBandwidth)
+	}
+	ab, ok := s.agentBandwidth[agentID]
+	if !ok {
+		ab = &agentBandwidth{
+			toAgent:   newTokenBucket(s.bandwidth.PerAgent),
+			fromAgent: newTokenBucket(s.bandwidth.PerAgent),
+		}
+		s.agentBandwidth[agentID] = ab
+	}
+	ab.streams++
+}
+
+// removeAgentBandwidth removes the buckets of agentID with its last stream.
+func (s *ProxyServer) removeAgentBandwidth(agentID string) {
+	s.bmu.Lock()
+	defer s.bmu.Unlock()
+	if ab, ok := s.agentBandwidth[agentID]; ok {
+		ab.streams--
+		if ab.streams <= 0 {
+			delete(s.agentBandwidth, agentID)
+		}
+	}
+}
+
+// limitBandwidth sets the buckets of frontend, once it is connected
+// through agentID.
+func (s *ProxyServer) limitBandwidth(agentID string, frontend *ProxyClientConnection) {
+	s.bmu.Lock()
+	limits := s.bandwidth
+	var agent *agentBandwidth
+	if limits.PerConnection > 0 || limits.PerAgent > 0 {
+		agent = s.agentBandwidth[agentID]
+	}
+	s.bmu.Unlock()
+	if limits.PerConnection <= 0 && limits.PerAgent <= 0 {
+		return
+	}
+	bw := &connectionBandwidth{agent: agent}
+	if limits.PerConnection > 0 {
+		bw.toAgent = newTokenBucket(limits.PerConnection)
+		bw.fromAgent = newTokenBucket(limits.PerConnection)
+	}
+	frontend.bandwidth = bw
+	s.queueSends(agentID, frontend)
+}
+
+// throttleToAgent waits until n bytes of frontend can be sent to the agent.
+func throttleToAgent(frontend *ProxyClientConnection, n int) {
+	bw := frontend.bandwidth
+	if bw == nil {
+		return
+	}
+	if bw.agent != nil {
+		throttle(DirectionToAgent, n, bw.toAgent, bw.agent.toAgent)
+		return
+	}
+	throttle(DirectionToAgent, n, bw.toAgent)
+}
+
+// sendFromAgent sends DATA or CLOSE_RSP received from the agent to
+// frontend, throttled by its bandwidth limits. The packets of a frontend
+// with a send queue are queued, and the queue is closed after CLOSE_RSP.
+func (s *ProxyServer) sendFromAgent(frontend *ProxyClientConnection, pkt *client.Packet) error {
+	bw := frontend.bandwidth
+	if bw != nil && bw.agent != nil && pkt.Type == client.PacketType_DATA {
+		throttle(DirectionFromAgent, len(pkt.GetData().Data), bw.agent.fromAgent)
+	}
+	if frontend.sendQueue == nil {
+		return frontend.send(pkt)
+	}
+	err := frontend.sendQueue.enqueue(pkt)
+	if err == errSendQueueOverflow {
+		s.closeOverflowing(frontend)
+	}
+	return err
+}
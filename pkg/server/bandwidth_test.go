@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1 << 20)
+	if delay := b.reserve(1 << 20); delay != 0 {
+		t.Errorf("expected the burst to be sent right away, got a delay of %v", delay)
+	}
+	delay := b.reserve(1 << 19)
+	if delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("expected a delay of about 500ms, got %v", delay)
+	}
+	// Reservations queue up behind each other.
+	if next := b.reserve(1 << 19); next < delay+400*time.Millisecond {
+		t.Errorf("expected a delay of about 1s, got %v", next)
+	}
+}
+
+func TestSetBandwidthPerAgent(t *testing.T) {
+	s := &ProxyServer{}
+	s.addAgentBandwidth("agent")
+	frontend := &ProxyClientConnection{connectID: 1}
+	s.limitBandwidth("agent", frontend)
+	if frontend.bandwidth != nil {
+		t.Fatal("expected no bandwidth limit")
+	}
+
+	s.SetBandwidth(BandwidthLimits{PerAgent: 1 << 20})
+	s.limitBandwidth("agent", frontend)
+	if frontend.bandwidth == nil || frontend.bandwidth.agent == nil {
+		t.Fatal("expected the connection to be limited by the bandwidth of the agent")
+	}
+	ab := frontend.bandwidth.agent
+	if delay := ab.toAgent.reserve(2 << 20); delay < 900*time.Millisecond {
+		t.Errorf("expected the agent limit to apply to an agent connected before, got a delay of %v", delay)
+	}
+	s.SetBandwidth(BandwidthLimits{})
+	if delay := ab.toAgent.reserve(2 << 20); delay != 0 {
+		t.Errorf("expected the agent limit to be lifted, got a delay of %v", delay)
+	}
+}
+
+func TestSendFromAgentThrottled(t *testing.T) {
+	var received bytes.Buffer
+	closed := make(chan struct{})
+	frontend := &ProxyClientConnection{
+		Mode: "http-connect",
+		HTTP: &received,
+		CloseHTTP: func() error {
+			close(closed)
+			return nil
+		},
+		connectID: 1,
+	}
+	s := &ProxyServer{}
+	s.SetBandwidth(BandwidthLimits{PerConnection: 1 << 20})
+	s.limitBandwidth("agent", frontend)
+
+	start := time.Now()
+	// The second packet exceeds the burst of one second by 64KiB.
+	for _, n := range []int{1 << 20, 1 << 16} {
+		if err := s.sendFromAgent(frontend, dataPacket(1, string(make([]byte, n)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeResponse := &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: 1}},
+	}
+	if err := s.sendFromAgent(frontend, closeResponse); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the agent stream not to be blocked, took %v", elapsed)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected CLOSE_RSP to be delivered after the data")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the data to be throttled, delivered after %v", elapsed)
+	}
+	if received.Len() != 1<<20+1<<16 {
+		t.Errorf("expected %d bytes, got %d", 1<<20+1<<16, received.Len())
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"math/rand"
+
+	"google.golang.org/grpc/metadata"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// Tracks of agents. Canary agents announce themselves with the
+// header.AgentCanary header, all others are stable.
+const (
+	trackCanary = "canary"
+	trackStable = "stable"
+)
+
+// isCanary reports whether the agent announced itself as canary when it
+// connected.
+func (b *backend) isCanary() bool {
+	md, ok := metadata.FromIncomingContext(b.Context())
+	if !ok {
+		return false
+	}
+	canary := md.Get(header.AgentCanary)
+	return len(canary) > 0 && canary[0] == "true"
+}
+
+// backendTrack returns the track of the agent behind be.
+func backendTrack(be Backend) string {
+	if b, ok := be.(*backend); ok && b.isCanary() {
+		return trackCanary
+	}
+	return trackStable
+}
+
+// pickTrack picks the track of the agents a dial is routed through, empty
+// if canary routing is disabled. CanaryPercent of the dials are routed
+// through canary agents, the others through stable ones.
+func (s *ProxyServer) pickTrack() string {
+	if s.CanaryPercent <= 0 {
+		return ""
+	}
+	roll := rand.Float64() * 100 /* #nosec G404 */
+	if roll < s.CanaryPercent {
+		return trackCanary
+	}
+	return trackStable
+}
+
+// trackAgentIDs returns the agents among agentIDs on track. A dial is
+// rather routed off its track than failed, so all agentIDs are returned if
+// none is on track. It must be called with s.mu held.
+func (s *DefaultBackendStorage) trackAgentIDs(agentIDs []string, track string) []string {
+	if track == "" {
+		return agentIDs
+	}
+	var onTrack []string
+	for _, agentID := range agentIDs {
+		if bes := s.backends[agentID]; len(bes) > 0 && backendTrack(bes[0]) == track {
+			onTrack = append(onTrack, agentID)
+		}
+	}
+	if len(onTrack) == 0 {
+		return agentIDs
+	}
+	return onTrack
+}
+
+// trackFrom returns the track getBackend stored in ctx.
+func trackFrom(ctx context.Context) string {
+	track, _ := ctx.Value(dialTrack).(string)
+	return track
+}
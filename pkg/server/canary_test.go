@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestCanaryRouting(t *testing.T) {
+	md := metadata.Pairs(header.AgentCanary, "true")
+	canary := &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+	stable := newFakeCapableConnectServer("")
+	p := NewDefaultBackendManager()
+	p.AddBackend("stable", pkgagent.UID, stable)
+
+	canaryCtx := context.WithValue(genContext(nil, "10.0.0.1:443", "tcp"), dialTrack, trackCanary)
+	stableCtx := context.WithValue(genContext(nil, "10.0.0.1:443", "tcp"), dialTrack, trackStable)
+	be, err := p.Backend(canaryCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be.(*backend).conn != stable {
+		t.Error("expected a canary dial to fall back to the stable agent")
+	}
+
+	p.AddBackend("canary", pkgagent.UID, canary)
+	for i := 0; i < 10; i++ {
+		be, err := p.Backend(canaryCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backendTrack(be) != trackCanary {
+			t.Fatal("expected a canary dial to be routed to the canary agent")
+		}
+		if be, err = p.Backend(stableCtx); err != nil {
+			t.Fatal(err)
+		}
+		if backendTrack(be) != trackStable {
+			t.Fatal("expected a stable dial to be routed to the stable agent")
+		}
+	}
+}
+
+func TestPickTrack(t *testing.T) {
+	s := &ProxyServer{}
+	if track := s.pickTrack(); track != "" {
+		t.Errorf("expected no track with canary routing disabled, got %q", track)
+	}
+	s.CanaryPercent = 100
+	if track := s.pickTrack(); track != trackCanary {
+		t.Errorf("expected track %q, got %q", trackCanary, track)
+	}
+	s.CanaryPercent = 0.000001
+	if track := s.pickTrack(); track != trackStable {
+		t.Errorf("expected track %q, got %q", trackStable, track)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// ErrMissingCapabilities indicates that agents are available, but none of
+// them advertised all capabilities required by the dial.
+type ErrMissingCapabilities struct {
+	// Missing lists the required capabilities no candidate agent
+	// advertised. If each of them is supported by some agent, but no agent
+	// supports all of them, Missing lists all required capabilities.
+	Missing []pkgagent.Capability
+}
+
+// Error returns the error message.
+func (e *ErrMissingCapabilities) Error() string {
+	return fmt.Sprintf("no agent supports the required capabilities: %s", pkgagent.FormatCapabilities(e.Missing))
+}
+
+// requiredCapabilities returns the agent capabilities needed to dial
+// protocol.
+func requiredCapabilities(protocol string) []pkgagent.Capability {
+	if strings.HasPrefix(protocol, "udp") {
+		return []pkgagent.Capability{pkgagent.CapabilityUDP}
+	}
+	return nil
+}
+
+// capabilities returns the capabilities advertised by the agent when it
+// connected.
+func (b *backend) capabilities() []pkgagent.Capability {
+	return contextCapabilities(b.Context())
+}
+
+// contextCapabilities returns the capabilities advertised in the metadata
+// of the Connect stream context of an agent.
+func contextCapabilities(ctx context.Context) []pkgagent.Capability {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return pkgagent.LegacyCapabilities
+	}
+	caps := md.Get(header.AgentCapabilities)
+	if len(caps) == 0 {
+		return pkgagent.LegacyCapabilities
+	}
+	return pkgagent.ParseCapabilities(caps[0])
+}
+
+func hasCapabilities(advertised, required []pkgagent.Capability) bool {
+	for _, r := range required {
+		if !containsCapability(advertised, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsCapability(caps []pkgagent.Capability, c pkgagent.Capability) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// capableAgentIDs returns the agents among agentIDs whose preferred
+// connection advertises all required capabilities. It must be called with
+// s.mu held.
+func (s *DefaultBackendStorage) capableAgentIDs(agentIDs []string, required []pkgagent.Capability) ([]string, error) {
+	if len(required) == 0 {
+		return agentIDs, nil
+	}
+	var capable []string
+	var advertised []pkgagent.Capability
+	for _, agentID := range agentIDs {
+		bes := s.backends[agentID]
+		if len(bes) == 0 {
+			continue
+		}
+		caps := bes[0].capabilities()
+		if hasCapabilities(caps, required) {
+			capable = append(capable, agentID)
+		}
+		advertised = append(advertised, caps...)
+	}
+	if len(capable) > 0 {
+		return capable, nil
+	}
+	if len(agentIDs) == 0 {
+		return nil, &ErrNotFound{}
+	}
+	var missing []pkgagent.Capability
+	for _, r := range required {
+		if !containsCapability(advertised, r) {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		missing = required
+	}
+	return nil, &ErrMissingCapabilities{Missing: missing}
+}
+
+// requiredCapabilitiesFrom returns the capabilities genContext stored in
+// ctx.
+func requiredCapabilitiesFrom(ctx context.Context) []pkgagent.Capability {
+	required, _ := ctx.Value(requiredCaps).([]pkgagent.Capability)
+	return required
+}
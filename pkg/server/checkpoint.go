@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// dataCheckpoint counts the DATA payload bytes of a connection for the
+// byte-count checkpoints exchanged with the agent. Checkpoints travel on
+// the agent stream right after the DATA they cover, so that the receiver
+// can compare them exactly with the bytes it received.
+type dataCheckpoint struct {
+	interval time.Duration
+
+	// sent and last, the time of the last checkpoint sent, are only
+	// accessed by the goroutine sending the DATA of the frontend.
+	sent int64
+	last time.Time
+
+	// received is only accessed by the goroutine serving the agent
+	// stream.
+	received int64
+}
+
+// requestCheckpoints enables byte-count checkpoints for the connection
+// being dialed, if the agent of backend supports them, and asks the agent
+// for its own in the dial request.
+func (s *ProxyServer) requestCheckpoints(dialReq *client.DialRequest, b Backend, frontend *ProxyClientConnection) {
+	dialReq.CheckpointInterval = 0
+	if s.CheckpointInterval <= 0 {
+		return
+	}
+	if dialReq.Compression != "" && frontend.requestedCompression == "" {
+		// The frontend compresses end to end: the server would count
+		// compressed bytes and the agent uncompressed ones.
+		return
+	}
+	be, ok := b.(*backend)
+	if !ok || !containsCapability(be.capabilities(), pkgagent.CapabilityCheckpoint) {
+		// relayed dials are checked by the peer serving the agent
+		return
+	}
+	frontend.checkpoint = &dataCheckpoint{interval: s.CheckpointInterval}
+	dialReq.CheckpointInterval = s.CheckpointInterval.Milliseconds()
+}
+
+// checkpointToAgent counts n payload bytes sent to the agent on the
+// connection connID, and follows them with a CHECKPOINT once the interval
+// elapsed. It must be called right after sending the DATA.
+func checkpointToAgent(b Backend, frontend *ProxyClientConnection, connID int64, n int) {
+	cp := frontend.checkpoint
+	if cp == nil {
+		return
+	}
+	cp.sent += int64(n)
+	if time.Since(cp.last) < cp.interval {
+		return
+	}
+	cp.last = time.Now()
+	pkt := &client.Packet{
+		Type: client.PacketType_CHECKPOINT,
+		Payload: &client.Packet_Checkpoint{Checkpoint: &client.Checkpoint{
+			ConnectID: connID,
+			Bytes:     cp.sent,
+		}},
+	}
+	if err := b.Send(pkt); err != nil {
+		klog.ErrorS(err, "CHECKPOINT to Backend failed", "connectionID", connID)
+	}
+}
+
+// countFromAgent counts n payload bytes received from the agent.
+func countFromAgent(frontend *ProxyClientConnection, n int) {
+	if frontend.checkpoint != nil {
+		frontend.checkpoint.received += int64(n)
+	}
+}
+
+// verifyCheckpoint compares a CHECKPOINT from the agent with the payload
+// bytes received on the connection. Any difference means DATA was lost or
+// duplicated on the way. The count is then resynchronized, so that each
+// discrepancy is reported once.
+func verifyCheckpoint(frontend *ProxyClientConnection, checkpoint *client.Checkpoint) {
+	cp := frontend.checkpoint
+	if cp == nil {
+		return
+	}
+	if cp.received == checkpoint.Bytes {
+		metrics.Metrics.ObserveDataCheckpoint(true)
+		return
+	}
+	klog.ErrorS(nil, "Data checkpoint mismatch", "agentID", frontend.agentID, "connectionID", checkpoint.ConnectID, "bytesReceived", cp.received, "bytesSent", checkpoint.Bytes)
+	metrics.Metrics.ObserveDataCheckpoint(false)
+	cp.received = checkpoint.Bytes
+}
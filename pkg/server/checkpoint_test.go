@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestRequestCheckpoints(t *testing.T) {
+	s := &ProxyServer{CheckpointInterval: time.Second}
+	capable := newBackend(newFakeCapableConnectServer("udp,checkpoint"))
+	legacy := newBackend(newFakeCapableConnectServer("udp"))
+
+	testcases := []struct {
+		name        string
+		backend     Backend
+		compression string
+		enabled     bool
+	}{
+		{name: "capable agent", backend: capable, enabled: true},
+		{name: "legacy agent", backend: legacy},
+		{name: "relayed dial", backend: &recordingBackend{}},
+		{name: "end to end compression", backend: capable, compression: "gzip"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialReq := &client.DialRequest{Compression: tc.compression, CheckpointInterval: 5}
+			frontend := &ProxyClientConnection{}
+			s.requestCheckpoints(dialReq, tc.backend, frontend)
+			if enabled := frontend.checkpoint != nil; enabled != tc.enabled {
+				t.Fatalf("expected checkpoints enabled %v, got %v", tc.enabled, enabled)
+			}
+			want := int64(0)
+			if tc.enabled {
+				want = 1000
+			}
+			if dialReq.CheckpointInterval != want {
+				t.Errorf("expected a checkpoint interval of %dms in the dial request, got %d", want, dialReq.CheckpointInterval)
+			}
+		})
+	}
+}
+
+func TestCheckpointToAgent(t *testing.T) {
+	b := &recordingBackend{}
+	frontend := &ProxyClientConnection{checkpoint: &dataCheckpoint{interval: time.Hour}}
+
+	// The first DATA is checkpointed right away, the next ones once the
+	// interval elapsed.
+	checkpointToAgent(b, frontend, 1, 10)
+	checkpointToAgent(b, frontend, 1, 20)
+	frontend.checkpoint.last = time.Now().Add(-time.Hour)
+	checkpointToAgent(b, frontend, 1, 30)
+
+	if len(b.sent) != 2 {
+		t.Fatalf("expected 2 checkpoints, got %d", len(b.sent))
+	}
+	for i, want := range []int64{10, 60} {
+		checkpoint := b.sent[i].GetCheckpoint()
+		if b.sent[i].Type != client.PacketType_CHECKPOINT || checkpoint.ConnectID != 1 || checkpoint.Bytes != want {
+			t.Errorf("expected checkpoint %d to cover %d bytes of connection 1, got %v", i, want, b.sent[i])
+		}
+	}
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	frontend := &ProxyClientConnection{checkpoint: &dataCheckpoint{interval: time.Second}}
+	countFromAgent(frontend, 100)
+	verifyCheckpoint(frontend, &client.Checkpoint{ConnectID: 1, Bytes: 100})
+	if frontend.checkpoint.received != 100 {
+		t.Errorf("expected 100 bytes received, got %d", frontend.checkpoint.received)
+	}
+
+	// DATA was lost: the count is resynchronized with the agent.
+	countFromAgent(frontend, 50)
+	verifyCheckpoint(frontend, &client.Checkpoint{ConnectID: 1, Bytes: 200})
+	if frontend.checkpoint.received != 200 {
+		t.Errorf("expected the count to be resynchronized to 200 bytes, got %d", frontend.checkpoint.received)
+	}
+
+	// Connections without checkpoints ignore them.
+	verifyCheckpoint(&ProxyClientConnection{}, &client.Checkpoint{ConnectID: 2, Bytes: 1})
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// CircuitBreakerConfig configures the circuit breakers of the agents. The
+// breaker of an agent trips after Failures consecutive failed dials, and
+// the agent is skipped by the backend selection for Cooldown. Afterwards
+// the breaker is half-open: dials are routed through the agent again, the
+// breaker closes with the first successful one and trips again with the
+// first failed one.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failed dials which trip the
+	// breaker of an agent. 0 disables the breakers.
+	Failures int
+	// Cooldown is how long a tripped agent is skipped.
+	Cooldown time.Duration
+}
+
+// BreakerStatus is the state of the circuit breaker of an agent, served
+// on /debug/circuit-breakers of the admin port.
+type BreakerStatus struct {
+	AgentID string `json:"agentID"`
+	// State is metrics.BreakerOpen or metrics.BreakerHalfOpen, agents
+	// whose breaker is closed are not listed.
+	State string `json:"state"`
+	// Failures is the number of consecutive failed dials.
+	Failures int `json:"failures"`
+	// TrippedAt is when the breaker last tripped.
+	TrippedAt time.Time `json:"trippedAt,omitempty"`
+	// Until is when the cooldown of the open breaker ends.
+	Until time.Time `json:"until,omitempty"`
+}
+
+// breaker is the circuit breaker of an agent with failed dials.
+type breaker struct {
+	failures  int
+	trippedAt time.Time
+}
+
+// circuitBreakers tracks the breakers of the agents with failed dials.
+// Agents without failed dials since their last successful one have none.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// recordDial records the result of a dial through the agent, tripping its
+// breaker after too many consecutive failures.
+func (s *ProxyServer) recordDial(agentID string, failed bool) {
+	config := s.CircuitBreaker
+	if config.Failures <= 0 || agentID == "" {
+		return
+	}
+	s.breakers.mu.Lock()
+	defer s.breakers.mu.Unlock()
+	b := s.breakers.breakers[agentID]
+	if !failed {
+		if b != nil {
+			delete(s.breakers.breakers, agentID)
+			if !b.trippedAt.IsZero() {
+				klog.V(2).InfoS("Circuit breaker of agent closed", "serverID", s.serverID, "agentID", agentID)
+			}
+			s.updateBreakerMetricsLocked(time.Now())
+		}
+		return
+	}
+	if b == nil {
+		b = &breaker{}
+		if s.breakers.breakers == nil {
+			s.breakers.breakers = make(map[string]*breaker)
+		}
+		s.breakers.breakers[agentID] = b
+	}
+	b.failures++
+	now := time.Now()
+	if b.failures < config.Failures || now.Before(b.trippedAt.Add(config.Cooldown)) {
+		// not enough failures yet, or a dial picked before the breaker
+		// tripped failed during the cooldown
+		return
+	}
+	b.trippedAt = now
+	klog.V(2).InfoS("Circuit breaker of agent tripped", "serverID", s.serverID, "agentID", agentID, "failures", b.failures, "cooldown", config.Cooldown)
+	metrics.Metrics.CircuitBreakerTripInc(agentID)
+	s.updateBreakerMetricsLocked(now)
+	// report the breaker half-open once the cooldown ends
+	time.AfterFunc(config.Cooldown, func() {
+		s.breakers.mu.Lock()
+		defer s.breakers.mu.Unlock()
+		s.updateBreakerMetricsLocked(time.Now())
+	})
+}
+
+// breakerOpen reports whether the breaker of the agent is tripped and
+// within its cooldown.
+func (s *ProxyServer) breakerOpen(agentID string) bool {
+	s.breakers.mu.Lock()
+	defer s.breakers.mu.Unlock()
+	b := s.breakers.breakers[agentID]
+	return b != nil && b.open(time.Now(), s.CircuitBreaker.Cooldown)
+}
+
+func (b *breaker) open(now time.Time, cooldown time.Duration) bool {
+	return !b.trippedAt.IsZero() && now.Before(b.trippedAt.Add(cooldown))
+}
+
+// updateBreakerMetricsLocked must be called with s.breakers.mu held.
+func (s *ProxyServer) updateBreakerMetricsLocked(now time.Time) {
+	var open, halfOpen int
+	for _, b := range s.breakers.breakers {
+		switch {
+		case b.trippedAt.IsZero():
+		case b.open(now, s.CircuitBreaker.Cooldown):
+			open++
+		default:
+			halfOpen++
+		}
+	}
+	metrics.Metrics.SetCircuitBreakerCounts(open, halfOpen)
+}
+
+// BreakerStatuses returns the state of the tripped circuit breakers, by
+// agent ID.
+func (s *ProxyServer) BreakerStatuses() []BreakerStatus {
+	s.breakers.mu.Lock()
+	defer s.breakers.mu.Unlock()
+	now := time.Now()
+	statuses := []BreakerStatus{}
+	for agentID, b := range s.breakers.breakers {
+		if b.trippedAt.IsZero() {
+			continue
+		}
+		status := BreakerStatus{AgentID: agentID, State: metrics.BreakerHalfOpen, Failures: b.failures, TrippedAt: b.trippedAt}
+		if b.open(now, s.CircuitBreaker.Cooldown) {
+			status.State = metrics.BreakerOpen
+			status.Until = b.trippedAt.Add(s.CircuitBreaker.Cooldown)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].AgentID < statuses[j].AgentID })
+	return statuses
+}
+
+// ServeCircuitBreakers serves the state of the tripped circuit breakers as
+// JSON.
+func (s *ProxyServer) ServeCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.BreakerStatuses()); err != nil {
+		klog.ErrorS(err, "Failed to serve the circuit breakers")
+	}
+}
+
+// agentFilter returns the agentFilter of a dial allowed to be routed
+// through the agents allowed, skipping those whose circuit breaker is
+// open. It is nil if any agent is allowed.
+func (s *ProxyServer) agentFilter(allowed agentFilter) agentFilter {
+	if s.CircuitBreaker.Failures <= 0 {
+		return allowed
+	}
+	return func(b *backend) bool {
+		return !s.breakerOpen(backendAgentID(b)) && (allowed == nil || allowed(b))
+	}
+}
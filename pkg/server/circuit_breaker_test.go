@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func newFakeAgentConnectServer(agentID string) *fakeCapableConnectServer {
+	md := metadata.Pairs(header.AgentID, agentID)
+	return &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func TestCircuitBreakerSkipsTrippedAgents(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.CircuitBreaker = CircuitBreakerConfig{Failures: 2, Cooldown: time.Hour}
+	for _, agentID := range []string{"agent1", "agent2"} {
+		p.BackendManagers[0].AddBackend(agentID, pkgagent.UID, newFakeAgentConnectServer(agentID))
+	}
+
+	p.recordDial("agent1", true)
+	if p.breakerOpen("agent1") {
+		t.Fatal("expected the breaker to stay closed after a single failure")
+	}
+	p.recordDial("agent1", true)
+	if !p.breakerOpen("agent1") {
+		t.Fatal("expected the breaker to trip after consecutive failures")
+	}
+	for i := 0; i < 20; i++ {
+		be, _, err := p.getBackend("10.0.0.1:80", "tcp", "", nil)
+		if err != nil {
+			t.Fatalf("expected a backend, got %v", err)
+		}
+		if agentID := backendAgentID(be); agentID != "agent2" {
+			t.Fatalf("expected the dial to skip the tripped agent1, got %s", agentID)
+		}
+	}
+
+	p.recordDial("agent2", true)
+	p.recordDial("agent2", true)
+	if _, _, err := p.getBackend("10.0.0.1:80", "tcp", "", nil); err == nil {
+		t.Fatal("expected no backend with all breakers open")
+	} else if _, ok := err.(*ErrNotFound); !ok {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	statuses := p.BreakerStatuses()
+	if len(statuses) != 2 || statuses[0].AgentID != "agent1" || statuses[0].State != metrics.BreakerOpen {
+		t.Errorf("expected both breakers open, got %+v", statuses)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.CircuitBreaker = CircuitBreakerConfig{Failures: 3, Cooldown: time.Minute}
+	for i := 0; i < 3; i++ {
+		p.recordDial("agent1", true)
+	}
+	// end the cooldown
+	p.breakers.breakers["agent1"].trippedAt = time.Now().Add(-2 * time.Minute)
+	if p.breakerOpen("agent1") {
+		t.Fatal("expected the breaker to be half-open after the cooldown")
+	}
+	if statuses := p.BreakerStatuses(); len(statuses) != 1 || statuses[0].State != metrics.BreakerHalfOpen {
+		t.Errorf("expected the breaker half-open, got %+v", statuses)
+	}
+
+	p.recordDial("agent1", true)
+	if !p.breakerOpen("agent1") {
+		t.Fatal("expected a failure of a half-open breaker to trip it again")
+	}
+
+	p.recordDial("agent1", false)
+	if p.breakerOpen("agent1") {
+		t.Fatal("expected a successful dial to close the breaker")
+	}
+	if statuses := p.BreakerStatuses(); len(statuses) != 0 {
+		t.Errorf("expected no tripped breaker, got %+v", statuses)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	for i := 0; i < 10; i++ {
+		p.recordDial("agent1", true)
+	}
+	if p.breakerOpen("agent1") {
+		t.Error("expected the breakers to be disabled")
+	}
+}
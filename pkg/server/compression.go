@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// requestCompression asks the agent to compress the DATA payloads of the
+// connection being dialed, unless compression is disabled, the agent did
+// not advertise it or the frontend already negotiates it end to end.
+func (s *ProxyServer) requestCompression(dialReq *client.DialRequest, frontend *ProxyClientConnection) {
+	if s.DataCompression == "" || dialReq.Compression != "" || !agentSupports(frontend.backend, header.FeatureCompression) {
+		return
+	}
+	dialReq.Compression = s.DataCompression
+	frontend.requestedCompression = s.DataCompression
+}
+
+// acceptCompression records the outcome of a compression request made by
+// the server. The negotiation is hidden from the frontend, which keeps
+// seeing plain DATA payloads.
+func acceptCompression(dialResp *client.DialResponse, frontend *ProxyClientConnection) {
+	if frontend.requestedCompression == "" {
+		return
+	}
+	if dialResp.Compression == frontend.requestedCompression {
+		frontend.compression = dialResp.Compression
+	}
+	dialResp.Compression = ""
+}
+
+// compressData compresses a DATA packet headed to the agent if the
+// connection negotiated compression.
+func compressData(frontend *ProxyClientConnection, pkt *client.Packet) {
+	data := pkt.GetData()
+	if frontend.compression == "" || data.Compressed {
+		return
+	}
+	compressed, ok, err := util.Compress(frontend.compression, data.Data)
+	if err != nil {
+		klog.ErrorS(err, "failed to compress data, sending uncompressed", "connectionID", data.ConnectID)
+		return
+	}
+	if ok {
+		data.Data = compressed
+		data.Compressed = true
+	}
+}
+
+// decompressData reverses compressData on DATA packets coming from the
+// agent, before they are handed to a frontend that did not ask for
+// compression itself.
+func decompressData(frontend *ProxyClientConnection, pkt *client.Packet) error {
+	data := pkt.GetData()
+	if frontend.compression == "" || !data.Compressed {
+		return nil
+	}
+	decompressed, err := util.Decompress(frontend.compression, data.Data)
+	if err != nil {
+		return err
+	}
+	data.Data = decompressed
+	data.Compressed = false
+	return nil
+}
+
+// closeUndecompressable closes the connection of frontend whose DATA from
+// the agent failed to decompress, as the bytes it lost would corrupt the
+// stream: CLOSE_REQ asks the agent to close it, and CLOSE_RSP reports err
+// to the frontend.
+func (s *ProxyServer) closeUndecompressable(frontend *ProxyClientConnection, err error) {
+	if !s.removeFrontend(frontend.agentID, frontend.connectID) {
+		// closed meanwhile
+		return
+	}
+	s.closeRemovedFrontend(frontend, fmt.Sprintf("failed to decompress data from the agent: %v", err))
+}
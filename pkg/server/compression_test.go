@@ -0,0 +1,53 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestUndecompressableDataClosesConnection(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	backend := &recordingBackend{}
+	stream := &recordingProxyServer{}
+	frontend := &ProxyClientConnection{Mode: "grpc", Grpc: stream, backend: backend, agentID: "agent1", connectID: 1, compression: "gzip"}
+	p.addFrontend("agent1", 1, frontend)
+
+	recvCh := make(chan *client.Packet, 1)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: []byte("not gzip"), Compressed: true}},
+	}
+	close(recvCh)
+	p.serveRecvBackend(backend, nil, "agent1", recvCh)
+
+	if _, err := p.getFrontend("agent1", 1); err == nil {
+		t.Error("expected the connection to be removed")
+	}
+	if len(backend.sent) != 1 || backend.sent[0].Type != client.PacketType_CLOSE_REQ || backend.sent[0].GetCloseRequest().ConnectID != 1 {
+		t.Errorf("expected CLOSE_REQ to the agent, got %v", backend.sent)
+	}
+	if len(stream.sent) != 1 || stream.sent[0].Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expected CLOSE_RSP to the frontend, got %v", stream.sent)
+	}
+	if errMsg := stream.sent[0].GetCloseResponse().Error; !strings.Contains(errMsg, "failed to decompress") {
+		t.Errorf("expected the decompression error, got %q", errMsg)
+	}
+}
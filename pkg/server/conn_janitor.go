@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// DefaultConnJanitorInterval is the default interval between the sweeps of
+// the connection janitor.
+const DefaultConnJanitorInterval = 30 * time.Second
+
+// ConnJanitorConfig configures the connection janitor, which refreshes the
+// connection table metrics and reaps the pending dials and established
+// connections leaked when DIAL_RSP or CLOSE packets are lost.
+type ConnJanitorConfig struct {
+	// Interval between the sweeps of the connection tables.
+	Interval time.Duration
+	// TTL is how long a pending dial may wait for its DIAL_RSP, and an
+	// established connection may go without DATA, before it is reaped.
+	// 0 disables reaping.
+	TTL time.Duration
+	// IdleTimeout is how long an established connection may go without
+	// DATA, and MaxLifetime how long it may last since its dial, before
+	// it is closed on both ends. 0 disables either.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// expired returns why the established connection must be closed at now,
+// empty if it may stay open.
+func (c ConnJanitorConfig) expired(frontend *ProxyClientConnection, now time.Time) string {
+	if c.MaxLifetime > 0 && !frontend.start.IsZero() && now.Sub(frontend.start) > c.MaxLifetime {
+		return metrics.ConnMaxLifetime
+	}
+	if c.IdleTimeout > 0 && frontend.idle(now) > c.IdleTimeout {
+		return metrics.ConnIdleTimeout
+	}
+	return ""
+}
+
+// touch records activity on the connection.
+func (c *ProxyClientConnection) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idle returns how long the connection has been inactive at now, 0 if its
+// activity is not tracked.
+func (c *ProxyClientConnection) idle(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&c.lastActive)
+	if last == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// RunConnJanitor sweeps the connection tables every interval until stopCh
+// is closed.
+func (s *ProxyServer) RunConnJanitor(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(s.ConnJanitor.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		s.sweepConns(time.Now())
+	}
+}
+
+// sweepConns reaps the entries idle beyond the TTL at now, closes the
+// expired connections, and refreshes the connection table metrics.
+func (s *ProxyServer) sweepConns(now time.Time) {
+	ttl := s.ConnJanitor.TTL
+	pending := make(map[string]int)
+	for random, frontend := range s.PendingDial.list() {
+		if ttl > 0 && frontend.idle(now) > ttl {
+			s.reapPendingDial(random, ttl)
+			continue
+		}
+		pending[backendAgentID(frontend.backend)]++
+	}
+
+	established := make(map[string]int)
+	for _, frontend := range s.frontendList() {
+		if ttl > 0 && frontend.idle(now) > ttl {
+			s.reapFrontend(frontend, ttl)
+			continue
+		}
+		if reason := s.ConnJanitor.expired(frontend, now); reason != "" {
+			s.expireFrontend(frontend, reason)
+			continue
+		}
+		established[frontend.agentID]++
+	}
+	metrics.Metrics.SetConnectionTableCounts(pending, established)
+}
+
+// reapPendingDial fails the pending dial which did not get a DIAL_RSP
+// within ttl. The connection of a DIAL_RSP arriving later is closed.
+func (s *ProxyServer) reapPendingDial(random int64, ttl time.Duration) {
+	frontend, ok := s.PendingDial.Take(random)
+	if !ok {
+		// the DIAL_RSP arrived meanwhile
+		return
+	}
+	klog.V(2).InfoS("Reaping pending dial without DIAL_RSP", "serverID", s.serverID, "dialID", random, "ttl", ttl)
+	metrics.Metrics.ConnectionReapedInc(metrics.ConnPendingDial)
+	errMsg := "dial timed out waiting for the agent"
+	s.observeDial(frontend, backendAgentID(frontend.backend), dialErrorTimeout)
+	s.recordDial(backendAgentID(frontend.backend), true)
+	s.auditDialResponse(random, 0, frontend, backendAgentID(frontend.backend), errMsg)
+	resp := &client.Packet{
+		Type: client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{
+			DialResponse: &client.DialResponse{
+				Random: random,
+				Error:  errMsg,
+			},
+		},
+	}
+	if err := frontend.send(resp); err != nil {
+		klog.V(2).InfoS("Failed to send DIAL_RSP of reaped dial", "serverID", s.serverID, "dialID", random, "err", err)
+	}
+}
+
+// reapFrontend closes the established connection without DATA within ttl.
+func (s *ProxyServer) reapFrontend(frontend *ProxyClientConnection, ttl time.Duration) {
+	if !s.removeFrontend(frontend.agentID, frontend.connectID) {
+		// closed meanwhile
+		return
+	}
+	klog.V(2).InfoS("Reaping idle connection", "serverID", s.serverID, "agentID", frontend.agentID, "connectionID", frontend.connectID, "ttl", ttl)
+	metrics.Metrics.ConnectionReapedInc(metrics.ConnEstablished)
+	s.closeRemovedFrontend(frontend, "")
+}
+
+// expireFrontend closes the established connection which expired for
+// reason.
+func (s *ProxyServer) expireFrontend(frontend *ProxyClientConnection, reason string) {
+	if !s.removeFrontend(frontend.agentID, frontend.connectID) {
+		// closed meanwhile
+		return
+	}
+	klog.V(2).InfoS("Closing expired connection", "serverID", s.serverID, "agentID", frontend.agentID, "connectionID", frontend.connectID, "reason", reason)
+	metrics.Metrics.ConnectionExpiredInc(reason)
+	s.closeRemovedFrontend(frontend, "")
+}
+
+// closeRemovedFrontend closes the connection removed from the frontends,
+// sending CLOSE_REQ to the agent and CLOSE_RSP to the frontend, with
+// errMsg if not empty.
+func (s *ProxyServer) closeRemovedFrontend(frontend *ProxyClientConnection, errMsg string) {
+	agentID, connID := frontend.agentID, frontend.connectID
+	if frontend.backend != nil {
+		s.closeOrphan(frontend.backend, agentID, connID)
+	}
+	closeRsp := &client.Packet{
+		Type: client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{
+			CloseResponse: &client.CloseResponse{ConnectID: connID, Error: errMsg},
+		},
+	}
+	if err := s.sendFromAgent(frontend, closeRsp); err != nil {
+		klog.V(2).InfoS("Failed to send CLOSE_RSP of closed connection", "serverID", s.serverID, "agentID", agentID, "connectionID", connID, "err", err)
+	}
+}
+
+// closeOrphan asks the agent to close connID, which has no frontend.
+func (s *ProxyServer) closeOrphan(backend Backend, agentID string, connID int64) {
+	closeReq := &client.Packet{
+		Type: client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{
+			CloseRequest: &client.CloseRequest{ConnectID: connID},
+		},
+	}
+	if err := backend.Send(closeReq); err != nil {
+		klog.V(2).InfoS("Failed to send CLOSE_REQ of orphaned connection", "serverID", s.serverID, "agentID", agentID, "connectionID", connID, "err", err)
+	}
+}
+
+// frontendList returns the established frontend connections.
+func (s *ProxyServer) frontendList() []*ProxyClientConnection {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	var frontends []*ProxyClientConnection
+	for _, conns := range s.frontends {
+		for _, frontend := range conns {
+			frontends = append(frontends, frontend)
+		}
+	}
+	return frontends
+}
+
+// backendAgentID returns the ID of the agent of b, empty if it is unknown,
+// e.g. for dials relayed by a peer.
+func backendAgentID(b Backend) string {
+	if b == nil {
+		return ""
+	}
+	md, ok := metadata.FromIncomingContext(b.Context())
+	if !ok {
+		return ""
+	}
+	if ids := md.Get(header.AgentID); len(ids) == 1 {
+		return ids[0]
+	}
+	return ""
+}
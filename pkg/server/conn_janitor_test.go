@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+func TestSweepConnsReapsIdleEntries(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.ConnJanitor.TTL = time.Minute
+	backend := &recordingBackend{}
+
+	pendingStream := &recordingProxyServer{}
+	pending := &ProxyClientConnection{Mode: "grpc", Grpc: pendingStream, backend: backend, start: time.Now()}
+	p.PendingDial.Add(1, pending)
+
+	idleStream := &recordingProxyServer{}
+	idle := &ProxyClientConnection{Mode: "grpc", Grpc: idleStream, backend: backend, agentID: "agent1", connectID: 10}
+	p.addFrontend("agent1", 10, idle)
+	active := &ProxyClientConnection{Mode: "grpc", Grpc: &recordingProxyServer{}, backend: backend, agentID: "agent1", connectID: 11}
+	p.addFrontend("agent1", 11, active)
+
+	// Nothing is idle yet.
+	p.sweepConns(time.Now())
+	if p.PendingDial.Count() != 1 || p.frontendCount() != 2 {
+		t.Fatalf("expected 1 pending dial and 2 connections, got %d and %d", p.PendingDial.Count(), p.frontendCount())
+	}
+
+	later := time.Now().Add(2 * time.Minute)
+	atomic.StoreInt64(&active.lastActive, later.UnixNano())
+	p.sweepConns(later)
+
+	if p.PendingDial.Count() != 0 {
+		t.Errorf("expected the pending dial to be reaped")
+	}
+	if len(pendingStream.sent) != 1 || pendingStream.sent[0].GetDialResponse().GetError() == "" {
+		t.Errorf("expected a failed DIAL_RSP for the reaped dial, got %v", pendingStream.sent)
+	}
+	if _, err := p.getFrontend("agent1", 10); err == nil {
+		t.Errorf("expected the idle connection to be reaped")
+	}
+	if _, err := p.getFrontend("agent1", 11); err != nil {
+		t.Errorf("expected the active connection to be kept, got %v", err)
+	}
+	if len(idleStream.sent) != 1 || idleStream.sent[0].Type != client.PacketType_CLOSE_RSP || idleStream.sent[0].GetCloseResponse().ConnectID != 10 {
+		t.Errorf("expected CLOSE_RSP for the reaped connection, got %v", idleStream.sent)
+	}
+	if len(backend.sent) != 1 || backend.sent[0].Type != client.PacketType_CLOSE_REQ || backend.sent[0].GetCloseRequest().ConnectID != 10 {
+		t.Errorf("expected CLOSE_REQ to the agent for the reaped connection, got %v", backend.sent)
+	}
+}
+
+func TestSweepConnsWithoutTTL(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.PendingDial.Add(1, &ProxyClientConnection{Mode: "grpc", Grpc: &recordingProxyServer{}})
+	p.addFrontend("agent1", 10, &ProxyClientConnection{Mode: "grpc", Grpc: &recordingProxyServer{}, agentID: "agent1", connectID: 10})
+
+	p.sweepConns(time.Now().Add(24 * time.Hour))
+	if p.PendingDial.Count() != 1 || p.frontendCount() != 1 {
+		t.Errorf("expected nothing to be reaped without a TTL, got %d pending dials and %d connections", p.PendingDial.Count(), p.frontendCount())
+	}
+}
+
+func TestSweepConnsClosesExpiredConnections(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.ConnJanitor.IdleTimeout = time.Minute
+	p.ConnJanitor.MaxLifetime = time.Hour
+	backend := &recordingBackend{}
+	now := time.Now()
+
+	idleStream := &recordingProxyServer{}
+	idle := &ProxyClientConnection{Mode: "grpc", Grpc: idleStream, backend: backend, agentID: "agent1", connectID: 10, start: now}
+	p.addFrontend("agent1", 10, idle)
+	oldStream := &recordingProxyServer{}
+	old := &ProxyClientConnection{Mode: "grpc", Grpc: oldStream, backend: backend, agentID: "agent1", connectID: 11, start: now.Add(-2 * time.Hour)}
+	p.addFrontend("agent1", 11, old)
+	active := &ProxyClientConnection{Mode: "grpc", Grpc: &recordingProxyServer{}, backend: backend, agentID: "agent1", connectID: 12, start: now}
+	p.addFrontend("agent1", 12, active)
+
+	if reason := p.ConnJanitor.expired(old, now); reason != metrics.ConnMaxLifetime {
+		t.Errorf("expected the old connection to exceed its max lifetime, got %q", reason)
+	}
+	later := now.Add(2 * time.Minute)
+	if reason := p.ConnJanitor.expired(idle, later); reason != metrics.ConnIdleTimeout {
+		t.Errorf("expected the idle connection to exceed its idle timeout, got %q", reason)
+	}
+	atomic.StoreInt64(&active.lastActive, later.UnixNano())
+	p.sweepConns(later)
+
+	for _, connID := range []int64{10, 11} {
+		if _, err := p.getFrontend("agent1", connID); err == nil {
+			t.Errorf("expected connection %d to be closed", connID)
+		}
+	}
+	if _, err := p.getFrontend("agent1", 12); err != nil {
+		t.Errorf("expected the active connection to be kept, got %v", err)
+	}
+	for _, stream := range []*recordingProxyServer{idleStream, oldStream} {
+		if len(stream.sent) != 1 || stream.sent[0].Type != client.PacketType_CLOSE_RSP {
+			t.Errorf("expected CLOSE_RSP for the expired connection, got %v", stream.sent)
+		}
+	}
+	if len(backend.sent) != 2 || backend.sent[0].Type != client.PacketType_CLOSE_REQ || backend.sent[1].Type != client.PacketType_CLOSE_REQ {
+		t.Errorf("expected CLOSE_REQ to the agent for the expired connections, got %v", backend.sent)
+	}
+}
+
+func TestRemoveFrontendOnce(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.addFrontend("agent1", 10, &ProxyClientConnection{})
+	if !p.removeFrontend("agent1", 10) {
+		t.Error("expected the frontend to be removed")
+	}
+	if p.removeFrontend("agent1", 10) {
+		t.Error("expected the frontend to be removed only once")
+	}
+}
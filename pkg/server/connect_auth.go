@@ -0,0 +1,284 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// Schemes of the Proxy-Authorization header of CONNECT requests.
+const (
+	ProxyAuthBasic  = "basic"
+	ProxyAuthBearer = "bearer"
+)
+
+// connectAuthRealm is the realm of the Proxy-Authenticate challenges.
+const connectAuthRealm = "konnectivity"
+
+// ProxyCredentials are the credentials of the Proxy-Authorization header
+// of a CONNECT request.
+type ProxyCredentials struct {
+	// Scheme is ProxyAuthBasic or ProxyAuthBearer.
+	Scheme string
+	// User and Password are set for ProxyAuthBasic.
+	User     string
+	Password string
+	// Token is set for ProxyAuthBearer.
+	Token string
+}
+
+// ProxyCredentialVerifier verifies the credentials of CONNECT requests.
+type ProxyCredentialVerifier interface {
+	// Verify returns the identity of the credentials, or an error if they
+	// are not valid.
+	Verify(ctx context.Context, credentials *ProxyCredentials) (*FrontendIdentity, error)
+}
+
+// ParseProxyAuthorization parses the value of a Proxy-Authorization
+// header.
+func ParseProxyAuthorization(value string) (*ProxyCredentials, error) {
+	i := strings.IndexByte(value, ' ')
+	if i <= 0 {
+		return nil, fmt.Errorf("malformed proxy authorization")
+	}
+	scheme, param := strings.ToLower(value[:i]), strings.TrimSpace(value[i+1:])
+	switch scheme {
+	case ProxyAuthBasic:
+		decoded, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return nil, fmt.Errorf("malformed basic credentials: %v", err)
+		}
+		user, password := string(decoded), ""
+		if j := strings.IndexByte(user, ':'); j >= 0 {
+			user, password = user[:j], user[j+1:]
+		} else {
+			return nil, fmt.Errorf("malformed basic credentials: no password")
+		}
+		return &ProxyCredentials{Scheme: ProxyAuthBasic, User: user, Password: password}, nil
+	case ProxyAuthBearer:
+		if param == "" {
+			return nil, fmt.Errorf("malformed bearer credentials: no token")
+		}
+		return &ProxyCredentials{Scheme: ProxyAuthBearer, Token: param}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy authorization scheme %q", value[:i])
+	}
+}
+
+// ConnectAuthenticator authenticates CONNECT requests by their
+// Proxy-Authorization header.
+type ConnectAuthenticator struct {
+	// Schemes are the accepted schemes, ProxyAuthBasic and
+	// ProxyAuthBearer.
+	Schemes []string
+	// Verifiers verify the credentials, any of which may succeed.
+	Verifiers []ProxyCredentialVerifier
+}
+
+// Authenticate returns the identity of the Proxy-Authorization of r.
+func (a *ConnectAuthenticator) Authenticate(r *http.Request) (*FrontendIdentity, error) {
+	value := r.Header.Get("Proxy-Authorization")
+	if value == "" {
+		return nil, fmt.Errorf("no proxy authorization")
+	}
+	credentials, err := ParseProxyAuthorization(value)
+	if err != nil {
+		return nil, err
+	}
+	if !a.accepts(credentials.Scheme) {
+		return nil, fmt.Errorf("proxy authorization scheme %q is not accepted", credentials.Scheme)
+	}
+	var errs []string
+	for _, v := range a.Verifiers {
+		identity, err := v.Verify(r.Context(), credentials)
+		if err == nil {
+			return identity, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("failed to verify %s credentials: %s", credentials.Scheme, strings.Join(errs, "; "))
+}
+
+func (a *ConnectAuthenticator) accepts(scheme string) bool {
+	for _, s := range a.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// challenges returns the Proxy-Authenticate challenges of the accepted
+// schemes.
+func (a *ConnectAuthenticator) challenges() []string {
+	var challenges []string
+	for _, s := range a.Schemes {
+		challenges = append(challenges, fmt.Sprintf("%s%s realm=%q", strings.ToUpper(s[:1]), s[1:], connectAuthRealm))
+	}
+	return challenges
+}
+
+// StaticProxyCredentialVerifier verifies credentials against static files.
+type StaticProxyCredentialVerifier struct {
+	// passwords are the password and the identity of each user.
+	passwords map[string]staticPassword
+	tokens    map[string]*FrontendIdentity
+}
+
+type staticPassword struct {
+	password string
+	identity *FrontendIdentity
+}
+
+var _ ProxyCredentialVerifier = &StaticProxyCredentialVerifier{}
+
+// NewStaticProxyCredentialVerifier returns a StaticProxyCredentialVerifier
+// accepting the basic credentials of basicAuthFile, a CSV file of the
+// format password,user,uid,"group1,group2", and the bearer tokens of
+// tokenFile, in the format of the static token file of the Kubernetes
+// apiserver. Either file may be empty.
+func NewStaticProxyCredentialVerifier(basicAuthFile, tokenFile string) (*StaticProxyCredentialVerifier, error) {
+	v := &StaticProxyCredentialVerifier{passwords: make(map[string]staticPassword)}
+	if basicAuthFile != "" {
+		records, err := readCredentialFile(basicAuthFile, "password")
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if _, ok := v.passwords[record[1]]; ok {
+				return nil, fmt.Errorf("line %d of password file %s repeats user %q", i+1, basicAuthFile, record[1])
+			}
+			v.passwords[record[1]] = staticPassword{password: record[0], identity: credentialIdentity(record)}
+		}
+	}
+	if tokenFile != "" {
+		tokens, err := readTokenFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		v.tokens = tokens
+	}
+	return v, nil
+}
+
+// Verify returns the identity of the user of basic credentials, or of a
+// bearer token.
+func (v *StaticProxyCredentialVerifier) Verify(_ context.Context, credentials *ProxyCredentials) (*FrontendIdentity, error) {
+	switch credentials.Scheme {
+	case ProxyAuthBasic:
+		p, ok := v.passwords[credentials.User]
+		if !ok || subtle.ConstantTimeCompare([]byte(p.password), []byte(credentials.Password)) != 1 {
+			return nil, fmt.Errorf("invalid user or password")
+		}
+		return p.identity, nil
+	case ProxyAuthBearer:
+		for t, identity := range v.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(credentials.Token)) == 1 {
+				return identity, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid token")
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", credentials.Scheme)
+}
+
+// WebhookProxyCredentialVerifier verifies credentials by posting a
+// TokenReview to a webhook, like the token webhook of the Kubernetes
+// apiserver. The token of the review is the bearer token, or the password
+// of basic credentials, whose user must then be the reviewed user.
+type WebhookProxyCredentialVerifier struct {
+	url    string
+	client *http.Client
+}
+
+var _ ProxyCredentialVerifier = &WebhookProxyCredentialVerifier{}
+
+// NewWebhookProxyCredentialVerifier returns a verifier posting to url,
+// with the TLS configuration tlsConfig if not nil, waiting for a review
+// for up to timeout.
+func NewWebhookProxyCredentialVerifier(url string, tlsConfig *tls.Config, timeout time.Duration) *WebhookProxyCredentialVerifier {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &WebhookProxyCredentialVerifier{
+		url:    url,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// Verify returns the user and the groups of the review of the credentials.
+func (v *WebhookProxyCredentialVerifier) Verify(ctx context.Context, credentials *ProxyCredentials) (*FrontendIdentity, error) {
+	token := credentials.Token
+	if credentials.Scheme == ProxyAuthBasic {
+		token = credentials.Password
+	}
+	review := &authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token}}
+	review.APIVersion = authv1.SchemeGroupVersion.String()
+	review.Kind = "TokenReview"
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token review failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("token review failed with status %d", resp.StatusCode)
+	}
+	result := &authv1.TokenReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to decode the token review: %v", err)
+	}
+	if result.Status.Error != "" {
+		return nil, fmt.Errorf("token review failed: %s", result.Status.Error)
+	}
+	if !result.Status.Authenticated {
+		return nil, fmt.Errorf("credentials not authenticated by the token review")
+	}
+	if credentials.Scheme == ProxyAuthBasic && result.Status.User.Username != credentials.User {
+		return nil, fmt.Errorf("token review authenticated %q, not %q", result.Status.User.Username, credentials.User)
+	}
+	return &FrontendIdentity{Name: result.Status.User.Username, Groups: result.Status.User.Groups}, nil
+}
+
+// authenticateConnect returns the identity of the CONNECT request r, nil
+// if CONNECT requests are not authenticated.
+func (s *ProxyServer) authenticateConnect(r *http.Request) (*FrontendIdentity, error) {
+	if s.ConnectAuthenticator == nil {
+		return nil, nil
+	}
+	return s.ConnectAuthenticator.Authenticate(r)
+}
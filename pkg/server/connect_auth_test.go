@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+func TestParseProxyAuthorization(t *testing.T) {
+	testCases := []struct {
+		value     string
+		want      *ProxyCredentials
+		wantError bool
+	}{
+		{value: "Basic dXNlcjpwYXNz", want: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "user", Password: "pass"}},
+		{value: "basic dXNlcjo=", want: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "user"}},
+		{value: "Bearer secret", want: &ProxyCredentials{Scheme: ProxyAuthBearer, Token: "secret"}},
+		{value: "Basic dXNlcg==", wantError: true},
+		{value: "Basic !!", wantError: true},
+		{value: "Bearer ", wantError: true},
+		{value: "Digest username=user", wantError: true},
+		{value: "secret", wantError: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseProxyAuthorization(tc.value)
+		if tc.wantError {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %+v", tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected no error for %q, got %v", tc.value, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %+v for %q, got %+v", tc.want, tc.value, got)
+		}
+	}
+}
+
+func TestStaticProxyCredentialVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connect-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwords := filepath.Join(dir, "passwords.csv")
+	if err := ioutil.WriteFile(passwords, []byte("pass1,alice,uid1,\"developers,admins\"\npass2,bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens := filepath.Join(dir, "tokens.csv")
+	if err := ioutil.WriteFile(tokens, []byte("secret1,ci\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewStaticProxyCredentialVerifier(passwords, tokens)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testCases := []struct {
+		credentials *ProxyCredentials
+		want        *FrontendIdentity
+	}{
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "alice", Password: "pass1"}, want: &FrontendIdentity{Name: "alice", Groups: []string{"developers", "admins"}}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "bob", Password: "pass2"}, want: &FrontendIdentity{Name: "bob"}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "bob", Password: "pass1"}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "carol", Password: "pass1"}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBearer, Token: "secret1"}, want: &FrontendIdentity{Name: "ci"}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBearer, Token: "pass1"}},
+	}
+	for _, tc := range testCases {
+		identity, err := v.Verify(context.Background(), tc.credentials)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("expected an error for %+v, got %v", tc.credentials, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected no error for %+v, got %v", tc.credentials, err)
+		}
+		if !reflect.DeepEqual(identity, tc.want) {
+			t.Errorf("expected %v for %+v, got %v", tc.want, tc.credentials, identity)
+		}
+	}
+
+	if err := ioutil.WriteFile(passwords, []byte("pass1,alice\npass2,alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStaticProxyCredentialVerifier(passwords, ""); err == nil {
+		t.Error("expected an error for a repeated user")
+	}
+}
+
+func TestWebhookProxyCredentialVerifier(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &authv1.TokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+			review.Status.User = authv1.UserInfo{Username: "alice", Groups: []string{"developers"}}
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer webhook.Close()
+	v := NewWebhookProxyCredentialVerifier(webhook.URL, nil, time.Second)
+
+	testCases := []struct {
+		credentials *ProxyCredentials
+		want        *FrontendIdentity
+	}{
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBearer, Token: "valid"}, want: &FrontendIdentity{Name: "alice", Groups: []string{"developers"}}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "alice", Password: "valid"}, want: &FrontendIdentity{Name: "alice", Groups: []string{"developers"}}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBasic, User: "bob", Password: "valid"}},
+		{credentials: &ProxyCredentials{Scheme: ProxyAuthBearer, Token: "invalid"}},
+	}
+	for _, tc := range testCases {
+		identity, err := v.Verify(context.Background(), tc.credentials)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("expected an error for %+v, got %v", tc.credentials, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected no error for %+v, got %v", tc.credentials, err)
+		}
+		if !reflect.DeepEqual(identity, tc.want) {
+			t.Errorf("expected %v for %+v, got %v", tc.want, tc.credentials, identity)
+		}
+	}
+}
+
+// staticVerifier verifies any credentials as identity.
+type staticVerifier struct {
+	identity *FrontendIdentity
+}
+
+func (v *staticVerifier) Verify(context.Context, *ProxyCredentials) (*FrontendIdentity, error) {
+	return v.identity, nil
+}
+
+func TestTunnelConnectAuthentication(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.ConnectAuthenticator = &ConnectAuthenticator{
+		Schemes:   []string{ProxyAuthBasic, ProxyAuthBearer},
+		Verifiers: []ProxyCredentialVerifier{&staticVerifier{identity: &FrontendIdentity{Name: "alice"}}},
+	}
+	p.SetFrontendAuthorizer(&RuleAuthorizer{Rules: []FrontendAuthorizationRule{{Subject: "alice", Destination: "*:443"}}})
+	tunnel := &Tunnel{Server: p}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://node1:22", nil)
+	req.Host = "node1:22"
+	rec := httptest.NewRecorder()
+	tunnel.ServeHTTP(rec, req)
+	if rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected status %d without credentials, got %d", http.StatusProxyAuthRequired, rec.Code)
+	}
+	want := []string{`Basic realm="konnectivity"`, `Bearer realm="konnectivity"`}
+	if got := rec.Header()["Proxy-Authenticate"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected challenges %v, got %v", want, got)
+	}
+
+	req.Header.Set("Proxy-Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	tunnel.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for an unauthorized destination, got %d", http.StatusForbidden, rec.Code)
+	}
+}
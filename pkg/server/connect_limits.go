@@ -0,0 +1,71 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// connectHeaderSize returns the size in bytes of the request line and
+// headers of a CONNECT request as sent on the wire, and the number of its
+// header lines. The Host header, which net/http moves to r.Host, counts
+// as one of them.
+func connectHeaderSize(r *http.Request) (size, count int) {
+	size = len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	if r.Host != "" {
+		size += len("Host: ") + len(r.Host) + 2
+		count++
+	}
+	for key, values := range r.Header {
+		for _, value := range values {
+			size += len(key) + len(value) + 4
+			count++
+		}
+	}
+	return size, count
+}
+
+// checkHeaderLimits records the header size of a CONNECT request and
+// returns an error if the request exceeds MaxHeaderBytes or
+// MaxHeaderCount.
+func (t *Tunnel) checkHeaderLimits(r *http.Request) error {
+	size, count := connectHeaderSize(r)
+	metrics.Metrics.ObserveConnectHeaders(size)
+	if t.MaxHeaderBytes > 0 && size > t.MaxHeaderBytes {
+		metrics.Metrics.ConnectRejectedInc(metrics.ConnectHeaderBytes)
+		return fmt.Errorf("request headers of %d bytes exceed the limit of %d bytes", size, t.MaxHeaderBytes)
+	}
+	if t.MaxHeaderCount > 0 && count > t.MaxHeaderCount {
+		metrics.Metrics.ConnectRejectedInc(metrics.ConnectHeaderCount)
+		return fmt.Errorf("%d request headers exceed the limit of %d headers", count, t.MaxHeaderCount)
+	}
+	return nil
+}
+
+// HTTPServerMaxHeaderBytes returns the MaxHeaderBytes of the http.Server
+// serving the Tunnel. net/http answers requests beyond it before they
+// reach the Tunnel, unaccounted in the metrics, so it is kept at least at
+// the net/http default and the Tunnel enforces MaxHeaderBytes itself.
+func (t *Tunnel) HTTPServerMaxHeaderBytes() int {
+	if t.MaxHeaderBytes > http.DefaultMaxHeaderBytes {
+		return t.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConnectHeaderSize(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "node1:22", nil)
+	req.Host = "node1:22"
+	req.Header.Set("User-Agent", "test")
+	req.Header.Add("X-Trace", "a")
+	req.Header.Add("X-Trace", "b")
+	// CONNECT node1:22 HTTP/1.1\r\n, Host: node1:22\r\n, User-Agent: test\r\n
+	// and X-Trace: a\r\n twice.
+	wantSize := 27 + 16 + 18 + 12 + 12
+	size, count := connectHeaderSize(req)
+	if size != wantSize {
+		t.Errorf("expected size %d, got %d", wantSize, size)
+	}
+	if count != 4 {
+		t.Errorf("expected count 4, got %d", count)
+	}
+}
+
+func TestTunnelHeaderLimits(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	tunnel := &Tunnel{Server: p, MaxHeaderBytes: 256, MaxHeaderCount: 4}
+
+	testcases := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{
+			name:    "within limits",
+			headers: map[string]string{"User-Agent": "test"},
+			want:    http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "too large",
+			headers: map[string]string{"X-Large": strings.Repeat("a", 256)},
+			want:    http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:    "too many",
+			headers: map[string]string{"X-1": "a", "X-2": "b", "X-3": "c", "X-4": "d"},
+			want:    http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// GET requests within the limits are rejected afterwards,
+			// since the tunnel only supports CONNECT.
+			req := httptest.NewRequest(http.MethodGet, "http://node1:22", nil)
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			tunnel.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("expected status %d, got %d", tc.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHTTPServerMaxHeaderBytes(t *testing.T) {
+	for limit, want := range map[int]int{
+		0:        http.DefaultMaxHeaderBytes,
+		64 << 10: http.DefaultMaxHeaderBytes,
+		4 << 20:  4 << 20,
+	} {
+		tunnel := &Tunnel{MaxHeaderBytes: limit}
+		if got := tunnel.HTTPServerMaxHeaderBytes(); got != want {
+			t.Errorf("expected %d for limit %d, got %d", want, limit, got)
+		}
+	}
+}
@@ -19,8 +19,8 @@ package server
 import (
 	"context"
 
-	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
 type DefaultRouteBackendManager struct {
@@ -45,7 +45,15 @@ func (dibm *DefaultRouteBackendManager) Backend(ctx context.Context) (Backend, e
 	if len(dibm.defaultRouteAgentIDs) == 0 {
 		return nil, &ErrNotFound{}
 	}
-	agentID := dibm.defaultRouteAgentIDs[dibm.random.Intn(len(dibm.defaultRouteAgentIDs))]
-	klog.V(4).InfoS("Picked agent as backend", "agentID", agentID)
+	agentIDs, err := dibm.capableAgentIDs(dibm.defaultRouteAgentIDs, requiredCapabilitiesFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if agentIDs, err = dibm.filterAgentIDs(agentIDs, agentFilterFrom(ctx)); err != nil {
+		return nil, err
+	}
+	agentIDs = dibm.trackAgentIDs(agentIDs, trackFrom(ctx))
+	agentID := agentIDs[dibm.random.Intn(len(agentIDs))]
+	util.V(util.LogBackendManager, 4).InfoS("Picked agent as backend", "agentID", agentID)
 	return dibm.backends[agentID][0], nil
 }
@@ -0,0 +1,215 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// maxResolvedHosts bounds the hostnames whose resolution is cached.
+const maxResolvedHosts = 4096
+
+// HostResolver resolves hostnames into addresses, as *net.Resolver and
+// the resolver of the agents do.
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DestHostResolutionConfig configures the resolution of the hostnames
+// dialed with the destHost strategies. Agents register with the destHost
+// strategy by their IPs, so that dials to a hostname only reach them once
+// it is resolved; the destHostHash strategy hashes the resolved address,
+// so that all the hostnames of a destination go through the same agent.
+type DestHostResolutionConfig struct {
+	// Strategies are the strategies routing dials by the resolved
+	// addresses of their hostname, destHost and destHostHash. Empty
+	// disables the resolution.
+	Strategies []ProxyStrategy
+	// Resolver resolves the hostnames, net.DefaultResolver if nil.
+	Resolver HostResolver
+	// TTL is how long resolved addresses are cached, and NegativeTTL how
+	// long failed resolutions are. 0 does not cache them.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Timeout bounds each resolution, 0 does not.
+	Timeout time.Duration
+}
+
+// resolves reports whether the hostnames dialed with the strategy are
+// resolved.
+func (c *DestHostResolutionConfig) resolves(strategy ProxyStrategy) bool {
+	for _, ps := range c.Strategies {
+		if ps == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvedHost is the cached resolution of a hostname. ready is closed
+// once the resolution ended, concurrent dials to the hostname wait for it
+// rather than resolving it again.
+type resolvedHost struct {
+	ready   chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// destHostResolver caches the resolutions of the destination hostnames.
+type destHostResolver struct {
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+// destHostAddresses is the context value of the addresses the destination
+// hostname of a dial resolved to, and the strategies routing by them.
+type destHostAddresses struct {
+	addrs      []string
+	strategies []ProxyStrategy
+}
+
+// resolvedAddressesFrom returns the addresses the destination hostname of
+// the dial resolved to if strategy routes by them, or nil.
+func resolvedAddressesFrom(ctx context.Context, strategy ProxyStrategy) []string {
+	resolved, ok := ctx.Value(destHostAddrs).(*destHostAddresses)
+	if !ok {
+		return nil
+	}
+	for _, ps := range resolved.strategies {
+		if ps == strategy {
+			return resolved.addrs
+		}
+	}
+	return nil
+}
+
+// resolveDestHost adds the addresses host resolves to to ctx, if the
+// hostnames dialed with one of the strategies of the server are resolved.
+// IP literals and hostnames failing to resolve are left to the strategies
+// as they are.
+func (s *ProxyServer) resolveDestHost(ctx context.Context, host string) context.Context {
+	var strategies []ProxyStrategy
+	for _, ps := range s.proxyStrategies {
+		if s.DestHostResolution.resolves(ps) {
+			strategies = append(strategies, ps)
+		}
+	}
+	if len(strategies) == 0 || host == "" {
+		return ctx
+	}
+	if ip, _ := util.ParseIPZone(host); ip != nil {
+		return ctx
+	}
+	addrs, err := s.lookupDestHost(host)
+	if err != nil {
+		util.V(util.LogBackendManager, 3).InfoS("Failed to resolve the destination host", "destHost", host, "err", err)
+		return ctx
+	}
+	util.V(util.LogBackendManager, 5).InfoS("Resolved the destination host", "destHost", host, "addresses", addrs)
+	return context.WithValue(ctx, destHostAddrs, &destHostAddresses{addrs: addrs, strategies: strategies})
+}
+
+// lookupDestHost returns the sorted addresses of host, from the cache if
+// its resolution has not expired.
+func (s *ProxyServer) lookupDestHost(host string) ([]string, error) {
+	config := s.DestHostResolution
+	r := &s.destHostResolver
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.hosts[host]
+	if ok && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		r.mu.Unlock()
+		// expires is only zero while the resolution is in progress
+		<-entry.ready
+		if entry.err != nil {
+			metrics.Metrics.DestHostResolutionInc(metrics.ResolutionFailed)
+		} else {
+			metrics.Metrics.DestHostResolutionInc(metrics.ResolutionCached)
+		}
+		return entry.addrs, entry.err
+	}
+	entry = &resolvedHost{ready: make(chan struct{})}
+	if r.hosts == nil {
+		r.hosts = make(map[string]*resolvedHost)
+	}
+	r.pruneLocked(now)
+	r.hosts[host] = entry
+	r.mu.Unlock()
+
+	resolver := config.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs = append([]string(nil), addrs...)
+	sort.Strings(addrs)
+	ttl := config.TTL
+	if err != nil {
+		addrs, ttl = nil, config.NegativeTTL
+		metrics.Metrics.DestHostResolutionInc(metrics.ResolutionFailed)
+	} else {
+		metrics.Metrics.DestHostResolutionInc(metrics.ResolutionResolved)
+	}
+
+	r.mu.Lock()
+	entry.addrs, entry.err = addrs, err
+	entry.expires = time.Now().Add(ttl)
+	if ttl <= 0 && r.hosts[host] == entry {
+		delete(r.hosts, host)
+	}
+	r.mu.Unlock()
+	close(entry.ready)
+	return addrs, err
+}
+
+// pruneLocked drops the expired resolutions, and arbitrary ones if the
+// cache is still full. It must be called with r.mu held.
+func (r *destHostResolver) pruneLocked(now time.Time) {
+	if len(r.hosts) < maxResolvedHosts {
+		return
+	}
+	for host, entry := range r.hosts {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(r.hosts, host)
+		}
+	}
+	for host, entry := range r.hosts {
+		if len(r.hosts) < maxResolvedHosts {
+			return
+		}
+		if !entry.expires.IsZero() {
+			delete(r.hosts, host)
+		}
+	}
+}
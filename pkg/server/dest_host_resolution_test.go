@@ -0,0 +1,156 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+// stubResolver resolves the hostnames of hosts and counts the lookups.
+type stubResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestDestHostResolution(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDestHost}, 1, nil, false)
+	conn := newFakeAgentConnectServer("agent1")
+	p.BackendManagers[0].AddBackend("10.0.0.5", pkgagent.IPv4, conn)
+	resolver := &stubResolver{hosts: map[string][]string{"db.example.com": {"10.0.0.7", "10.0.0.5"}}}
+
+	if _, _, err := p.getBackend("db.example.com:5432", "tcp", "", nil); err == nil {
+		t.Fatal("expected no backend for the hostname without resolution")
+	}
+	p.DestHostResolution = DestHostResolutionConfig{
+		Strategies:  []ProxyStrategy{ProxyStrategyDestHost},
+		Resolver:    resolver,
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+	}
+	for i := 0; i < 3; i++ {
+		be, _, err := p.getBackend("db.example.com:5432", "tcp", "", nil)
+		if err != nil {
+			t.Fatalf("expected a backend for the resolved hostname, got %v", err)
+		}
+		if be.(*backend).conn != conn {
+			t.Fatalf("expected the agent registered with 10.0.0.5, got %v", be)
+		}
+	}
+	if lookups := resolver.count(); lookups != 1 {
+		t.Errorf("expected the resolution to be cached, got %d lookups", lookups)
+	}
+
+	// IP literals are not resolved
+	if _, _, err := p.getBackend("10.0.0.5:5432", "tcp", "", nil); err != nil {
+		t.Fatalf("expected a backend for the IP, got %v", err)
+	}
+	if lookups := resolver.count(); lookups != 1 {
+		t.Errorf("expected no lookup of the IP, got %d lookups", lookups)
+	}
+
+	// failed resolutions are cached for the negative TTL
+	for i := 0; i < 2; i++ {
+		if _, _, err := p.getBackend("missing.example.com:80", "tcp", "", nil); err == nil {
+			t.Fatal("expected no backend for the unresolved hostname")
+		}
+	}
+	if lookups := resolver.count(); lookups != 2 {
+		t.Errorf("expected the failed resolution to be cached, got %d lookups", lookups)
+	}
+
+	// expired resolutions are resolved again
+	p.destHostResolver.mu.Lock()
+	p.destHostResolver.hosts["db.example.com"].expires = time.Now().Add(-time.Second)
+	p.destHostResolver.mu.Unlock()
+	if _, _, err := p.getBackend("db.example.com:5432", "tcp", "", nil); err != nil {
+		t.Fatalf("expected a backend for the resolved hostname, got %v", err)
+	}
+	if lookups := resolver.count(); lookups != 3 {
+		t.Errorf("expected the expired resolution to be resolved again, got %d lookups", lookups)
+	}
+}
+
+func TestDestHostResolutionPerStrategy(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDestHost}, 1, nil, false)
+	p.BackendManagers[0].AddBackend("10.0.0.5", pkgagent.IPv4, newFakeAgentConnectServer("agent1"))
+	resolver := &stubResolver{hosts: map[string][]string{"db.example.com": {"10.0.0.5"}}}
+	p.DestHostResolution = DestHostResolutionConfig{
+		Strategies: []ProxyStrategy{ProxyStrategyDestHostHash},
+		Resolver:   resolver,
+		TTL:        time.Minute,
+	}
+
+	if _, _, err := p.getBackend("db.example.com:5432", "tcp", "", nil); err == nil {
+		t.Fatal("expected no backend with the resolution enabled for another strategy")
+	}
+	if lookups := resolver.count(); lookups != 0 {
+		t.Errorf("expected no lookup, got %d lookups", lookups)
+	}
+}
+
+func TestDestHostHashResolution(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDestHostHash}, 1, nil, false)
+	for _, agentID := range []string{"agent1", "agent2", "agent3", "agent4"} {
+		p.BackendManagers[0].AddBackend(agentID, pkgagent.UID, newFakeAgentConnectServer(agentID))
+	}
+	p.DestHostResolution = DestHostResolutionConfig{
+		Strategies: []ProxyStrategy{ProxyStrategyDestHostHash},
+		Resolver: &stubResolver{hosts: map[string][]string{
+			"a.example.com": {"10.0.0.9"},
+			"b.example.com": {"10.0.0.9"},
+		}},
+		TTL: time.Minute,
+	}
+
+	want, _, err := p.getBackend("10.0.0.9:443", "tcp", "", nil)
+	if err != nil {
+		t.Fatalf("expected a backend, got %v", err)
+	}
+	for _, host := range []string{"a.example.com:443", "b.example.com:443"} {
+		be, _, err := p.getBackend(host, "tcp", "", nil)
+		if err != nil {
+			t.Fatalf("expected a backend for %s, got %v", host, err)
+		}
+		if be != want {
+			t.Errorf("expected %s to hash to the agent of its address %s, got %s", host, backendAgentID(want), backendAgentID(be))
+		}
+	}
+}
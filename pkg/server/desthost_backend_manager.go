@@ -19,8 +19,8 @@ package server
 import (
 	"context"
 
-	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
 type DestHostBackendManager struct {
@@ -35,7 +35,8 @@ func NewDestHostBackendManager() *DestHostBackendManager {
 			[]agent.IdentifierType{agent.IPv4, agent.IPv6, agent.Host})}
 }
 
-// Backend tries to get a backend associating to the request destination host.
+// Backend tries to get a backend associating to the request destination
+// host, or else to one of the addresses it resolved to.
 func (dibm *DestHostBackendManager) Backend(ctx context.Context) (Backend, error) {
 	dibm.mu.RLock()
 	defer dibm.mu.RUnlock()
@@ -43,12 +44,39 @@ func (dibm *DestHostBackendManager) Backend(ctx context.Context) (Backend, error
 		return nil, &ErrNotFound{}
 	}
 	destHost := ctx.Value(destHost).(string)
-	if destHost != "" {
-		bes, exist := dibm.backends[destHost]
-		if exist && len(bes) > 0 {
-			klog.V(5).InfoS("Get the backend through the DestHostBackendManager", "destHost", destHost)
-			return dibm.backends[destHost][0], nil
+	if destHost == "" {
+		return nil, &ErrNotFound{}
+	}
+	be, err := dibm.backendLocked(ctx, destHost)
+	if err == nil || ignoreNotFound(err) != nil {
+		return be, err
+	}
+	for _, addr := range resolvedAddressesFrom(ctx, ProxyStrategyDestHost) {
+		be, addrErr := dibm.backendLocked(ctx, addr)
+		if addrErr == nil {
+			return be, nil
 		}
+		if ignoreNotFound(err) == nil {
+			// keep the first error other than ErrNotFound
+			err = addrErr
+		}
+	}
+	return nil, err
+}
+
+// backendLocked returns the backend registered with the identifier id. It
+// must be called with dibm.mu held.
+func (dibm *DestHostBackendManager) backendLocked(ctx context.Context, id string) (Backend, error) {
+	bes, exist := dibm.backends[id]
+	if !exist || len(bes) == 0 {
+		return nil, &ErrNotFound{}
+	}
+	if _, err := dibm.capableAgentIDs([]string{id}, requiredCapabilitiesFrom(ctx)); err != nil {
+		return nil, err
+	}
+	if _, err := dibm.filterAgentIDs([]string{id}, agentFilterFrom(ctx)); err != nil {
+		return nil, err
 	}
-	return nil, &ErrNotFound{}
+	util.V(util.LogBackendManager, 5).InfoS("Get the backend through the DestHostBackendManager", "destHost", id)
+	return bes[0], nil
 }
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// hashRingReplicas is the number of points of each agent on the hash
+// ring, spreading the hosts evenly over the agents.
+const hashRingReplicas = 128
+
+// DestHostHashBackendManager picks the agent of a dial on a consistent hash
+// ring of the connected agents, keyed by the destination host, so that the
+// dials to a host go through the same agent. When agents join or leave,
+// only the hosts of the ring points they gain or lose move.
+type DestHostHashBackendManager struct {
+	*DefaultBackendStorage
+
+	// ringMu protects ring and ringVersion.
+	ringMu sync.Mutex
+	ring   *hashRing
+	// ringVersion is the agentsVersion of the storage the ring was built
+	// at.
+	ringVersion uint64
+}
+
+var _ BackendManager = &DestHostHashBackendManager{}
+
+// NewDestHostHashBackendManager returns a DestHostHashBackendManager.
+func NewDestHostHashBackendManager() *DestHostHashBackendManager {
+	return &DestHostHashBackendManager{
+		DefaultBackendStorage: NewDefaultBackendStorage(
+			[]agent.IdentifierType{agent.UID})}
+}
+
+// Backend picks the agent the destination host of the dial maps to on the
+// ring, skipping the agents the dial may not go through. Hostnames that
+// resolved are hashed by their first address. Dials without a destination
+// host are left to the next strategy.
+func (hbm *DestHostHashBackendManager) Backend(ctx context.Context) (Backend, error) {
+	host, _ := ctx.Value(destHost).(string)
+	if host == "" {
+		return nil, &ErrNotFound{}
+	}
+	if addrs := resolvedAddressesFrom(ctx, ProxyStrategyDestHostHash); len(addrs) > 0 {
+		host = addrs[0]
+	}
+	hbm.mu.RLock()
+	defer hbm.mu.RUnlock()
+	if len(hbm.backends) == 0 {
+		return nil, &ErrNotFound{}
+	}
+	agentIDs, err := hbm.capableAgentIDs(hbm.agentIDs, requiredCapabilitiesFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if agentIDs, err = hbm.filterAgentIDs(agentIDs, agentFilterFrom(ctx)); err != nil {
+		return nil, err
+	}
+	agentIDs = hbm.trackAgentIDs(agentIDs, trackFrom(ctx))
+	eligible := make(map[string]bool, len(agentIDs))
+	for _, agentID := range agentIDs {
+		eligible[agentID] = true
+	}
+	agentID, ok := hbm.currentRing().lookup(host, eligible)
+	if !ok {
+		return nil, &ErrNotFound{}
+	}
+	util.V(util.LogBackendManager, 4).InfoS("Picked agent on the hash ring as backend", "agentID", agentID, "destHost", host)
+	return hbm.backends[agentID][0], nil
+}
+
+// currentRing returns the ring of the connected agents, rebuilding it if
+// agents joined or left. It must be called with hbm.mu held.
+func (hbm *DestHostHashBackendManager) currentRing() *hashRing {
+	hbm.ringMu.Lock()
+	defer hbm.ringMu.Unlock()
+	if hbm.ring == nil || hbm.ringVersion != hbm.agentsVersion {
+		hbm.ring = newHashRing(hbm.agentIDs, hashRingReplicas)
+		hbm.ringVersion = hbm.agentsVersion
+		util.V(util.LogBackendManager, 3).InfoS("Rebalanced the hash ring", "agents", len(hbm.agentIDs))
+	}
+	return hbm.ring
+}
+
+// hashRing is a consistent hash ring of agents.
+type hashRing struct {
+	// points are the sorted hashes of the agents' points.
+	points []uint64
+	// agents maps the points to the agent they belong to.
+	agents map[uint64]string
+}
+
+func newHashRing(agentIDs []string, replicas int) *hashRing {
+	r := &hashRing{agents: make(map[uint64]string, len(agentIDs)*replicas)}
+	for _, agentID := range agentIDs {
+		for i := 0; i < replicas; i++ {
+			point := hashKey(agentID + "#" + strconv.Itoa(i))
+			if owner, ok := r.agents[point]; !ok {
+				r.points = append(r.points, point)
+			} else if owner < agentID {
+				// keep the owner of colliding points independent of the
+				// order of agentIDs
+				continue
+			}
+			r.agents[point] = agentID
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// lookup returns the first eligible agent at or after the point of key,
+// going clockwise around the ring.
+func (r *hashRing) lookup(key string, eligible map[string]bool) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for i := 0; i < len(r.points); i++ {
+		agentID := r.agents[r.points[(start+i)%len(r.points)]]
+		if eligible[agentID] {
+			return agentID, true
+		}
+	}
+	return "", false
+}
+
+// hashKey hashes key onto the ring. FNV-1a alone leaves similar keys, like
+// the addresses of a subnet, on neighbouring points, so its sum is mixed by
+// the splitmix64 finalizer to spread them around the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func hashBackendAgent(t *testing.T, p *DestHostHashBackendManager, conns map[*fakeCapableConnectServer]string, host string) string {
+	t.Helper()
+	be, err := p.Backend(genContext([]ProxyStrategy{ProxyStrategyDestHostHash}, host+":10250", "tcp"))
+	if err != nil {
+		t.Fatalf("expected a backend for %s, got %v", host, err)
+	}
+	return conns[be.(*backend).conn.(*fakeCapableConnectServer)]
+}
+
+func TestDestHostHashBackendManager(t *testing.T) {
+	p := NewDestHostHashBackendManager()
+	if _, err := p.Backend(genContext([]ProxyStrategy{ProxyStrategyDestHostHash}, "10.0.0.1:10250", "tcp")); ignoreNotFound(err) != nil || err == nil {
+		t.Errorf("expected ErrNotFound without agents, got %v", err)
+	}
+
+	conns := make(map[*fakeCapableConnectServer]string)
+	byAgent := make(map[string]*fakeCapableConnectServer)
+	for i := 0; i < 4; i++ {
+		agentID := fmt.Sprintf("agent-%d", i)
+		conn := newFakeCapableConnectServer("")
+		conns[conn] = agentID
+		byAgent[agentID] = conn
+		p.AddBackend(agentID, pkgagent.UID, conn)
+	}
+
+	var hosts []string
+	for i := 0; i < 200; i++ {
+		hosts = append(hosts, fmt.Sprintf("10.0.%d.%d", i/250, i%250+1))
+	}
+	before := make(map[string]string)
+	used := make(map[string]bool)
+	for _, host := range hosts {
+		agentID := hashBackendAgent(t, p, conns, host)
+		if again := hashBackendAgent(t, p, conns, host); again != agentID {
+			t.Fatalf("expected the dials to %s to stick to %s, got %s", host, agentID, again)
+		}
+		before[host] = agentID
+		used[agentID] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("expected the hosts to spread over the 4 agents, got %d", len(used))
+	}
+
+	// only the hosts of the leaving agent move
+	p.RemoveBackend("agent-2", pkgagent.UID, byAgent["agent-2"])
+	for _, host := range hosts {
+		agentID := hashBackendAgent(t, p, conns, host)
+		if before[host] != "agent-2" && agentID != before[host] {
+			t.Errorf("expected %s to stay on %s, got %s", host, before[host], agentID)
+		}
+		if agentID == "agent-2" {
+			t.Errorf("expected %s to move off the removed agent", host)
+		}
+	}
+
+	// and come back when it joins again
+	p.AddBackend("agent-2", pkgagent.UID, byAgent["agent-2"])
+	for _, host := range hosts {
+		if agentID := hashBackendAgent(t, p, conns, host); agentID != before[host] {
+			t.Errorf("expected %s to return to %s, got %s", host, before[host], agentID)
+		}
+	}
+}
+
+func TestHashRingIndependentOfOrder(t *testing.T) {
+	r1 := newHashRing([]string{"a", "b", "c"}, hashRingReplicas)
+	r2 := newHashRing([]string{"c", "a", "b"}, hashRingReplicas)
+	eligible := map[string]bool{"a": true, "b": true, "c": true}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("node-%d", i)
+		a1, _ := r1.lookup(key, eligible)
+		a2, _ := r2.lookup(key, eligible)
+		if a1 != a2 {
+			t.Errorf("expected %s to map to the same agent, got %s and %s", key, a1, a2)
+		}
+	}
+}
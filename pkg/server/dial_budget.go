@@ -0,0 +1,90 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// dialBudgetTTL is how long a budget is remembered after its last dial.
+	dialBudgetTTL = 5 * time.Minute
+	// maxDialBudgets bounds the number of budgets tracked at once.
+	maxDialBudgets = 10000
+)
+
+// DialBudgetTracker accounts the time spent dialing across the attempts of
+// frontends that re-dial a destination with the same budget token, so
+// that slow agents can be told apart from retry loops.
+type DialBudgetTracker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	budgets map[string]*dialBudget
+}
+
+type dialBudget struct {
+	attempts int
+	spent    time.Duration
+	lastSeen time.Time
+}
+
+// NewDialBudgetTracker returns a DialBudgetTracker forgetting budgets ttl
+// after their last dial.
+func NewDialBudgetTracker(ttl time.Duration) *DialBudgetTracker {
+	return &DialBudgetTracker{
+		ttl:     ttl,
+		budgets: make(map[string]*dialBudget),
+	}
+}
+
+// Account adds a dial that took elapsed to the budget of token and returns
+// the number of attempts and the cumulative time spent so far. A
+// successful dial completes the budget.
+func (t *DialBudgetTracker) Account(token string, elapsed time.Duration, success bool) (int, time.Duration) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.budgets[token]
+	if ok && now.Sub(b.lastSeen) > t.ttl {
+		ok = false
+	}
+	if !ok {
+		if len(t.budgets) >= maxDialBudgets {
+			t.expireLocked(now)
+		}
+		b = &dialBudget{}
+		if len(t.budgets) < maxDialBudgets {
+			t.budgets[token] = b
+		}
+	}
+	b.attempts++
+	b.spent += elapsed
+	b.lastSeen = now
+	if success {
+		delete(t.budgets, token)
+	}
+	return b.attempts, b.spent
+}
+
+func (t *DialBudgetTracker) expireLocked(now time.Time) {
+	for token, b := range t.budgets {
+		if now.Sub(b.lastSeen) > t.ttl {
+			delete(t.budgets, token)
+		}
+	}
+}
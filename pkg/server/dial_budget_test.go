@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialBudgetTracker(t *testing.T) {
+	tracker := NewDialBudgetTracker(time.Minute)
+
+	tracker.Account("token", time.Second, false)
+	attempts, spent := tracker.Account("token", 2*time.Second, true)
+	if attempts != 2 || spent != 3*time.Second {
+		t.Errorf("expected 2 attempts spending 3s, got %d attempts spending %v", attempts, spent)
+	}
+
+	// a successful dial completes the budget
+	attempts, spent = tracker.Account("token", time.Second, false)
+	if attempts != 1 || spent != time.Second {
+		t.Errorf("expected a new budget, got %d attempts spending %v", attempts, spent)
+	}
+
+	expiring := NewDialBudgetTracker(0)
+	expiring.Account("token", time.Second, false)
+	time.Sleep(time.Millisecond)
+	if attempts, _ := expiring.Account("token", time.Second, false); attempts != 1 {
+		t.Errorf("expected the expired budget to be forgotten, got %d attempts", attempts)
+	}
+}
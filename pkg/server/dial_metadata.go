@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// attestDialMetadata replaces any reserved metadata sent by the frontend
+// with values the server vouches for, so that agents can rely on them for
+// policy decisions and audit logs.
+func (s *ProxyServer) attestDialMetadata(dialReq *client.DialRequest, mode, identity string) {
+	md := make(map[string]string, len(dialReq.Metadata)+3)
+	for k, v := range dialReq.Metadata {
+		if !strings.HasPrefix(k, header.DialMetadataPrefix) {
+			md[k] = v
+		}
+	}
+	md[header.DialMetadataFrontendMode] = mode
+	md[header.DialMetadataServerID] = s.serverID
+	if identity != "" {
+		md[header.DialMetadataFrontendIdentity] = identity
+	}
+	dialReq.Metadata = md
+}
+
+// grpcFrontendIdentity returns the common name of the client certificate
+// presented on the frontend stream, or "" if there is none.
+func grpcFrontendIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return tlsIdentity(&tlsInfo.State)
+}
+
+func tlsIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
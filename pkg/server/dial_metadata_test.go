@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestAttestDialMetadata(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	dialReq := &client.DialRequest{
+		Metadata: map[string]string{
+			"request-uid":                       "abc",
+			header.DialMetadataFrontendIdentity: "spoofed",
+		},
+	}
+
+	p.attestDialMetadata(dialReq, "grpc", "kube-apiserver")
+
+	want := map[string]string{
+		"request-uid":                       "abc",
+		header.DialMetadataFrontendIdentity: "kube-apiserver",
+		header.DialMetadataFrontendMode:     "grpc",
+		header.DialMetadataServerID:         "server-1",
+	}
+	if !reflect.DeepEqual(dialReq.Metadata, want) {
+		t.Errorf("expected metadata %v, got %v", want, dialReq.Metadata)
+	}
+
+	dialReq = &client.DialRequest{
+		Metadata: map[string]string{header.DialMetadataFrontendIdentity: "spoofed"},
+	}
+	p.attestDialMetadata(dialReq, "http-connect", "")
+	if _, ok := dialReq.Metadata[header.DialMetadataFrontendIdentity]; ok {
+		t.Error("expected unauthenticated frontend identity to be dropped")
+	}
+}
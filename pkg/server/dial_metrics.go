@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// Error categories of the dial_e2e_duration_seconds metric.
+const (
+	dialErrorNone                = "none"
+	dialErrorNoBackend           = "no_backend"
+	dialErrorMissingCapabilities = "missing_capabilities"
+	dialErrorBackendOnPeer       = "backend_on_peer"
+	dialErrorAgentsSaturated     = "agents_saturated"
+	dialErrorUnauthorized        = "unauthorized"
+	dialErrorCanceled            = "canceled"
+	dialErrorFrontend            = "frontend"
+	dialErrorRejected            = "rejected"
+	dialErrorTimeout             = "timeout"
+	dialErrorRefused             = "refused"
+	dialErrorUnreachable         = "unreachable"
+	dialErrorDNS                 = "dns"
+	dialErrorOther               = "other"
+)
+
+// Phases of the dial_phase_duration_seconds metric, in the order a dial
+// goes through them.
+const (
+	// dialPhaseBackendSelection ends once a backend is picked for the
+	// DIAL_REQ received from the frontend.
+	dialPhaseBackendSelection = "backend_selection"
+	// dialPhaseAgentSend ends once the DIAL_REQ is sent to the agent.
+	dialPhaseAgentSend = "agent_send"
+	// dialPhaseAgent ends once the DIAL_RSP of the agent is received.
+	dialPhaseAgent = "agent"
+	// dialPhaseFrontendNotify ends once the DIAL_RSP is delivered to the
+	// frontend.
+	dialPhaseFrontendNotify = "frontend_notify"
+)
+
+// backendManagerStrategy returns the proxy strategy implemented by bm.
+func backendManagerStrategy(bm BackendManager) ProxyStrategy {
+	switch bm.(type) {
+	case *DestHostBackendManager:
+		return ProxyStrategyDestHost
+	case *DestHostHashBackendManager:
+		return ProxyStrategyDestHostHash
+	case *DefaultRouteBackendManager:
+		return ProxyStrategyDefaultRoute
+	case *LabelSelectorBackendManager:
+		return ProxyStrategyLabelSelector
+	default:
+		return ProxyStrategyDefault
+	}
+}
+
+// backendErrorCategory categorizes an error of getBackend or of the
+// authorization of the dial.
+func backendErrorCategory(err error) string {
+	switch err.(type) {
+	case *ErrMissingCapabilities:
+		return dialErrorMissingCapabilities
+	case *ErrBackendOnPeer:
+		return dialErrorBackendOnPeer
+	case *ErrUnauthorized:
+		return dialErrorUnauthorized
+	case *ErrAgentsSaturated:
+		return dialErrorAgentsSaturated
+	}
+	return dialErrorNoBackend
+}
+
+// dialErrorCode returns the code reported to frontends for an error of
+// getBackend.
+func dialErrorCode(err error) client.DialErrorCode {
+	switch err.(type) {
+	case *ErrNotFound:
+		return client.DialErrorCode_DIAL_ERROR_NO_AGENT
+	case *ErrAgentsSaturated:
+		return client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED
+	}
+	return client.DialErrorCode_DIAL_ERROR_UNSPECIFIED
+}
+
+// agentDialErrorCategory categorizes the error an agent reported in a
+// DIAL_RSP. Agents only report the error message, so it is matched
+// against the messages of the Go net package.
+func agentDialErrorCategory(dialErr string) string {
+	switch {
+	case dialErr == "":
+		return dialErrorNone
+	case strings.Contains(dialErr, "rejected by agent policy"):
+		return dialErrorRejected
+	case strings.Contains(dialErr, "timeout"):
+		return dialErrorTimeout
+	case strings.Contains(dialErr, "connection refused"):
+		return dialErrorRefused
+	case strings.Contains(dialErr, "no route to host"), strings.Contains(dialErr, "network is unreachable"):
+		return dialErrorUnreachable
+	case strings.Contains(dialErr, "no such host"), strings.Contains(dialErr, "server misbehaving"):
+		return dialErrorDNS
+	default:
+		return dialErrorOther
+	}
+}
+
+// observeDial records the end-to-end latency of the dial of frontend, ends
+// its trace span and accounts it to the dial budget the frontend sent, if
+// any.
+func (s *ProxyServer) observeDial(frontend *ProxyClientConnection, agentID, errorCategory string) {
+	elapsed := time.Since(frontend.start)
+	metrics.Metrics.ObserveDialE2ELatency(elapsed, agentID, string(frontend.strategy), errorCategory)
+	observeDialPhases(frontend)
+	if s.CanaryPercent > 0 && frontend.backend != nil {
+		metrics.Metrics.ObserveCanaryDial(elapsed, backendTrack(frontend.backend), errorCategory)
+	}
+	s.finishDialSpan(frontend, agentID, errorCategory)
+	if frontend.budgetToken == "" {
+		return
+	}
+	success := errorCategory == dialErrorNone
+	frontend.budgetAttempt, frontend.budgetSpent = s.dialBudgets.Account(frontend.budgetToken, elapsed, success)
+	metrics.Metrics.ObserveDialBudget(frontend.budgetSpent, frontend.budgetAttempt, success)
+}
+
+// markDialSent records that the DIAL_REQ of frontend was sent to the agent.
+func markDialSent(frontend *ProxyClientConnection) {
+	atomic.StoreInt64(&frontend.dialSent, time.Now().UnixNano())
+}
+
+// observeDialPhases records the latency of each phase the dial of frontend
+// completed, up to now.
+func observeDialPhases(frontend *ProxyClientConnection) {
+	if frontend.dialSelected.IsZero() {
+		return
+	}
+	metrics.Metrics.ObserveDialPhase(dialPhaseBackendSelection, frontend.dialSelected.Sub(frontend.start))
+	sent := atomic.LoadInt64(&frontend.dialSent)
+	if sent == 0 {
+		return
+	}
+	sentAt := time.Unix(0, sent)
+	metrics.Metrics.ObserveDialPhase(dialPhaseAgentSend, sentAt.Sub(frontend.dialSelected))
+	if frontend.dialResponded.IsZero() {
+		return
+	}
+	metrics.Metrics.ObserveDialPhase(dialPhaseAgent, frontend.dialResponded.Sub(sentAt))
+	metrics.Metrics.ObserveDialPhase(dialPhaseFrontendNotify, time.Since(frontend.dialResponded))
+}
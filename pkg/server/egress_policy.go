@@ -0,0 +1,328 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// EgressPolicyKey is the key of the EgressPolicy in the data of its
+// ConfigMap.
+const EgressPolicyKey = "policy.yaml"
+
+// EgressPolicy describes which frontends may reach which destinations
+// through which agents, like a NetworkPolicy of the egress through the
+// proxy servers. Once a policy is in place, dials matching none of its
+// rules are denied.
+type EgressPolicy struct {
+	Rules []EgressRule `json:"rules"`
+}
+
+// EgressRule allows its frontends to dial its destinations through its
+// agents.
+type EgressRule struct {
+	// Frontends are the names of frontend identities, "group:" followed
+	// by the name of a group, or "*". Empty matches any frontend.
+	Frontends []string `json:"frontends,omitempty"`
+	// To are the destinations, empty matches any.
+	To []EgressDestination `json:"to,omitempty"`
+	// Agents is a label selector of the agents the dials may be routed
+	// through, e.g. "zone=us-east-1a". Empty matches any agent.
+	Agents string `json:"agents,omitempty"`
+
+	agents labels.Selector
+}
+
+// EgressDestination matches destinations by address and port.
+type EgressDestination struct {
+	// CIDR matches destination IPs, e.g. 10.0.0.0/8.
+	CIDR string `json:"cidr,omitempty"`
+	// Host matches destination host names, "*" matching any sequence of
+	// characters, e.g. "*.svc.cluster.local".
+	Host string `json:"host,omitempty"`
+	// Ports are the destination ports, empty matches any.
+	Ports []int `json:"ports,omitempty"`
+	// Protocol is tcp or udp, empty matches both.
+	Protocol string `json:"protocol,omitempty"`
+
+	cidr *net.IPNet
+}
+
+// ParseEgressPolicy parses the YAML or JSON of an EgressPolicy.
+func ParseEgressPolicy(data []byte) (*EgressPolicy, error) {
+	policy := &EgressPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, err
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Agents != "" {
+			selector, err := labels.Parse(rule.Agents)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid agents %q: %v", i, rule.Agents, err)
+			}
+			rule.agents = selector
+		}
+		for j := range rule.To {
+			dest := &rule.To[j]
+			if (dest.CIDR == "") == (dest.Host == "") {
+				return nil, fmt.Errorf("rule %d: destination %d must have either a cidr or a host", i, j)
+			}
+			if dest.CIDR != "" {
+				_, cidr, err := net.ParseCIDR(dest.CIDR)
+				if err != nil {
+					return nil, fmt.Errorf("rule %d: destination %d: %v", i, j, err)
+				}
+				dest.cidr = cidr
+			}
+			switch dest.Protocol {
+			case "", "tcp", "udp":
+			default:
+				return nil, fmt.Errorf("rule %d: destination %d: protocol %q must be tcp or udp", i, j, dest.Protocol)
+			}
+			for _, port := range dest.Ports {
+				if port < 1 || port > 65535 {
+					return nil, fmt.Errorf("rule %d: destination %d: invalid port %d", i, j, port)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// evaluate returns whether identity may dial address over protocol, and
+// the agents the dial may be routed through, nil if any.
+func (p *EgressPolicy) evaluate(identity *FrontendIdentity, protocol, address string) (bool, agentFilter) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false, nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	var selectors []labels.Selector
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matchesFrontend(identity) || !rule.matchesDestination(protocol, host, port) {
+			continue
+		}
+		if rule.agents == nil {
+			return true, nil
+		}
+		selectors = append(selectors, rule.agents)
+	}
+	if len(selectors) == 0 {
+		return false, nil
+	}
+	return true, func(b *backend) bool {
+		set := b.labels()
+		for _, selector := range selectors {
+			if selector.Matches(set) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (r *EgressRule) matchesFrontend(identity *FrontendIdentity) bool {
+	if len(r.Frontends) == 0 {
+		return true
+	}
+	for _, subject := range r.Frontends {
+		if ruleSubjectMatches(subject, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EgressRule) matchesDestination(protocol, host string, port int) bool {
+	if len(r.To) == 0 {
+		return true
+	}
+	for i := range r.To {
+		if r.To[i].matches(protocol, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *EgressDestination) matches(protocol, host string, port int) bool {
+	if d.Protocol != "" && !strings.HasPrefix(protocol, d.Protocol) {
+		return false
+	}
+	if len(d.Ports) > 0 {
+		found := false
+		for _, p := range d.Ports {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if d.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && d.cidr.Contains(ip)
+	}
+	return matchPattern(d.Host, host)
+}
+
+// denyAllEgressPolicy is enforced while the EgressPolicy of a watcher is
+// missing, it has no rules and thus denies any dial.
+var denyAllEgressPolicy = &EgressPolicy{}
+
+// SetEgressPolicy enforces policy on subsequent dials, nil allows any.
+func (s *ProxyServer) SetEgressPolicy(policy *EgressPolicy) {
+	s.egressPolicy.Store(policy)
+}
+
+func (s *ProxyServer) currentEgressPolicy() *EgressPolicy {
+	policy, _ := s.egressPolicy.Load().(*EgressPolicy)
+	return policy
+}
+
+// enforceEgressPolicy checks that the frontend may dial address and each of
+// the candidates over protocol, and restricts the agents the dial is routed
+// through to those allowed to dial all of them.
+func (s *ProxyServer) enforceEgressPolicy(frontend *ProxyClientConnection, protocol, address string, candidates []string) error {
+	frontend.allowedAgents = nil
+	policy := s.currentEgressPolicy()
+	if policy == nil {
+		return nil
+	}
+	identity := frontend.authenticated
+	if identity == nil && frontend.identity != "" {
+		identity = &FrontendIdentity{Name: frontend.identity}
+	}
+	if policy == denyAllEgressPolicy {
+		return &ErrUnauthorized{Reason: fmt.Sprintf("no egress policy is in place, denying %q to dial %s", frontend.identity, address)}
+	}
+	var filters []agentFilter
+	for _, addr := range append([]string{address}, candidates...) {
+		allowed, agents := policy.evaluate(identity, protocol, addr)
+		if !allowed {
+			return &ErrUnauthorized{Reason: fmt.Sprintf("egress policy denies %q to dial %s", frontend.identity, addr)}
+		}
+		if agents != nil {
+			filters = append(filters, agents)
+		}
+	}
+	switch len(filters) {
+	case 0:
+	case 1:
+		frontend.allowedAgents = filters[0]
+	default:
+		frontend.allowedAgents = func(b *backend) bool {
+			for _, filter := range filters {
+				if !filter(b) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return nil
+}
+
+// EgressPolicyWatcher watches the ConfigMap holding the EgressPolicy of a
+// proxy server.
+type EgressPolicyWatcher struct {
+	server    *ProxyServer
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// allowMissing allows any dial while the ConfigMap does not exist.
+	allowMissing bool
+}
+
+// NewEgressPolicyWatcher returns an EgressPolicyWatcher enforcing the
+// EgressPolicy of the ConfigMap name in namespace on the dials of s. Any
+// dial is denied until the ConfigMap is synced and once it is deleted,
+// unless allowMissing. Invalid policies are ignored, keeping the previous
+// one.
+func NewEgressPolicyWatcher(s *ProxyServer, client kubernetes.Interface, namespace, name string, allowMissing bool) *EgressPolicyWatcher {
+	return &EgressPolicyWatcher{
+		server:       s,
+		client:       client,
+		namespace:    namespace,
+		name:         name,
+		allowMissing: allowMissing,
+	}
+}
+
+// Start watches the ConfigMap until stopCh is closed.
+func (w *EgressPolicyWatcher) Start(stopCh <-chan struct{}) {
+	w.server.SetEgressPolicy(w.missingPolicy())
+	factory := informers.NewSharedInformerFactoryWithOptions(w.client, 0,
+		informers.WithNamespace(w.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.name).String()
+		}))
+	factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: w.update,
+		UpdateFunc: func(_, obj interface{}) {
+			w.update(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err != nil || key != w.namespace+"/"+w.name {
+				return
+			}
+			klog.InfoS("Egress policy deleted", "namespace", w.namespace, "configMap", w.name, "allowMissing", w.allowMissing)
+			w.server.SetEgressPolicy(w.missingPolicy())
+		},
+	})
+	factory.Start(stopCh)
+}
+
+// missingPolicy returns the policy enforced while the ConfigMap does not
+// exist.
+func (w *EgressPolicyWatcher) missingPolicy() *EgressPolicy {
+	if w.allowMissing {
+		return nil
+	}
+	return denyAllEgressPolicy
+}
+
+func (w *EgressPolicyWatcher) update(obj interface{}) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok || configMap.Name != w.name {
+		return
+	}
+	policy, err := ParseEgressPolicy([]byte(configMap.Data[EgressPolicyKey]))
+	if err != nil {
+		klog.ErrorS(err, "Ignoring invalid egress policy", "namespace", w.namespace, "configMap", w.name)
+		return
+	}
+	klog.InfoS("Enforcing egress policy", "namespace", w.namespace, "configMap", w.name, "rules", len(policy.Rules))
+	w.server.SetEgressPolicy(policy)
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+const testEgressPolicy = `
+rules:
+- frontends: ["apiserver"]
+  to:
+  - cidr: 10.0.0.0/8
+    ports: [10250]
+    protocol: tcp
+  agents: zone=us-east-1a
+- frontends: ["group:admins"]
+- to:
+  - host: "*.svc.cluster.local"
+  agents: zone=us-west-1a
+`
+
+func TestParseEgressPolicy(t *testing.T) {
+	policy, err := ParseEgressPolicy([]byte(testEgressPolicy))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(policy.Rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(policy.Rules))
+	}
+
+	for _, invalid := range []string{
+		"rules: [{agents: 'zone in (a'}]",
+		"rules: [{to: [{cidr: 10.0.0.0}]}]",
+		"rules: [{to: [{cidr: 10.0.0.0/8, host: node1}]}]",
+		"rules: [{to: [{}]}]",
+		"rules: [{to: [{host: node1, ports: [0]}]}]",
+		"rules: [{to: [{host: node1, protocol: sctp}]}]",
+		"rules: [{from: [apiserver]}]",
+	} {
+		if _, err := ParseEgressPolicy([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for policy %q", invalid)
+		}
+	}
+}
+
+func TestEgressPolicyEvaluate(t *testing.T) {
+	policy, err := ParseEgressPolicy([]byte(testEgressPolicy))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	apiserver := &FrontendIdentity{Name: "apiserver"}
+	admin := &FrontendIdentity{Name: "alice", Groups: []string{"admins"}}
+	testCases := []struct {
+		identity *FrontendIdentity
+		protocol string
+		address  string
+		allowed  bool
+		filtered bool
+	}{
+		{identity: apiserver, protocol: "tcp", address: "10.1.2.3:10250", allowed: true, filtered: true},
+		{identity: apiserver, protocol: "udp", address: "10.1.2.3:10250"},
+		{identity: apiserver, protocol: "tcp", address: "10.1.2.3:22"},
+		{identity: apiserver, protocol: "tcp", address: "192.168.0.1:10250"},
+		{identity: apiserver, protocol: "tcp", address: "node1:10250"},
+		{identity: admin, protocol: "tcp", address: "192.168.0.1:22", allowed: true},
+		{protocol: "tcp", address: "web.default.svc.cluster.local:80", allowed: true, filtered: true},
+		{protocol: "tcp", address: "example.com:80"},
+	}
+	for _, tc := range testCases {
+		allowed, filter := policy.evaluate(tc.identity, tc.protocol, tc.address)
+		if allowed != tc.allowed {
+			t.Errorf("expected %v dialing %s over %s to be allowed %v, got %v", tc.identity, tc.address, tc.protocol, tc.allowed, allowed)
+		}
+		if (filter != nil) != tc.filtered {
+			t.Errorf("expected %v dialing %s to be restricted to some agents %v, got %v", tc.identity, tc.address, tc.filtered, filter != nil)
+		}
+	}
+}
+
+func TestEgressPolicyRestrictsAgents(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	east := newFakeLabeledConnectServer("zone=us-east-1a")
+	p.BackendManagers[0].AddBackend("east", pkgagent.UID, east)
+	p.BackendManagers[0].AddBackend("west", pkgagent.UID, newFakeLabeledConnectServer("zone=us-west-1a"))
+	policy, err := ParseEgressPolicy([]byte(testEgressPolicy))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	frontend := &ProxyClientConnection{authenticated: &FrontendIdentity{Name: "apiserver"}}
+	if err := p.authorizeDial(frontend, "tcp", "10.1.2.3:22", nil); err != nil {
+		t.Errorf("expected any dial to be allowed without egress policy, got %v", err)
+	}
+	p.SetEgressPolicy(policy)
+	if _, ok := p.authorizeDial(frontend, "tcp", "10.1.2.3:22", nil).(*ErrUnauthorized); !ok {
+		t.Error("expected the dial to be denied by the egress policy")
+	}
+	if err := p.authorizeDial(frontend, "tcp", "10.1.2.3:10250", nil); err != nil {
+		t.Fatalf("expected the dial to be allowed by the egress policy, got %v", err)
+	}
+	if _, ok := p.authorizeDial(frontend, "tcp", "10.1.2.3:10250", []string{"10.1.2.4:10250", "192.168.0.1:10250"}).(*ErrUnauthorized); !ok {
+		t.Error("expected the dial to be denied for a candidate denied by the egress policy")
+	}
+	if err := p.authorizeDial(frontend, "tcp", "10.1.2.3:10250", []string{"10.1.2.4:10250"}); err != nil {
+		t.Fatalf("expected the dial to be allowed with allowed candidates, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		be, _, err := p.getBackend("10.1.2.3:10250", "tcp", "", frontend.allowedAgents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be.(*backend).conn != east {
+			t.Fatal("expected the dial to be routed to the agent in us-east-1a")
+		}
+	}
+
+	p.SetEgressPolicy(nil)
+	if err := p.authorizeDial(frontend, "tcp", "10.1.2.3:22", nil); err != nil {
+		t.Errorf("expected any dial to be allowed once the egress policy is deleted, got %v", err)
+	}
+}
+
+func TestEgressPolicyWatcherFailsClosed(t *testing.T) {
+	frontend := &ProxyClientConnection{authenticated: &FrontendIdentity{Name: "apiserver"}}
+	// waitForDial waits until the dial of frontend to address is allowed
+	// or denied as expected.
+	waitForDial := func(p *ProxyServer, address string, allowed bool) {
+		t.Helper()
+		var err error
+		for deadline := time.Now().Add(wait.ForeverTestTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if err = p.authorizeDial(frontend, "tcp", address, nil); (err == nil) == allowed {
+				return
+			}
+		}
+		t.Fatalf("expected dialing %s to be allowed %v, got %v", address, allowed, err)
+	}
+
+	client := fake.NewSimpleClientset()
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	NewEgressPolicyWatcher(p, client, "kube-system", "egress-policy", false).Start(stopCh)
+	if _, ok := p.authorizeDial(frontend, "tcp", "10.1.2.3:10250", nil).(*ErrUnauthorized); !ok {
+		t.Error("expected dials to be denied until the egress policy is synced")
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "egress-policy"},
+		Data:       map[string]string{EgressPolicyKey: testEgressPolicy},
+	}
+	if _, err := client.CoreV1().ConfigMaps("kube-system").Create(context.Background(), configMap, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForDial(p, "10.1.2.3:10250", true)
+	waitForDial(p, "10.1.2.3:22", false)
+
+	if err := client.CoreV1().ConfigMaps("kube-system").Delete(context.Background(), "egress-policy", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForDial(p, "10.1.2.3:10250", false)
+
+	p = NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	NewEgressPolicyWatcher(p, client, "kube-system", "egress-policy", true).Start(stopCh)
+	if err := p.authorizeDial(frontend, "tcp", "10.1.2.3:22", nil); err != nil {
+		t.Errorf("expected any dial to be allowed without egress policy when allowed missing, got %v", err)
+	}
+}
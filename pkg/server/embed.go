@@ -0,0 +1,327 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// This file is the embedding API of the proxy server, for programs running
+// it in-process instead of as the proxy-server binary. Options, Hooks,
+// FrontendMode, Server and the functions and methods on them are kept
+// backward compatible: fields and methods may be added, but none are
+// removed or change meaning without a deprecation first. The ProxyServer
+// returned by Server.ProxyServer and the rest of this package carry no
+// such guarantee.
+
+const (
+	// defaultEmbeddedScaleHintsInterval is the default sampling interval
+	// of the scale hints of embedded servers, as of the binary.
+	defaultEmbeddedScaleHintsInterval = 15 * time.Second
+	// defaultEmbeddedPeaksWindow is the default rolling window of the
+	// peaks of embedded servers, as of the binary.
+	defaultEmbeddedPeaksWindow = 24 * time.Hour
+)
+
+// FrontendMode is the protocol frontends speak on a listener.
+type FrontendMode string
+
+const (
+	// FrontendGRPC serves the Proxy service of konnectivity-client.
+	FrontendGRPC FrontendMode = "grpc"
+	// FrontendHTTPConnect serves HTTP CONNECT requests.
+	FrontendHTTPConnect FrontendMode = "http-connect"
+)
+
+// Hooks are called on the lifecycle events of an embedded server. Nil
+// hooks are skipped. They are called synchronously and must not block.
+type Hooks struct {
+	// AgentConnected is called with the ID of each agent whose Connect
+	// stream is established.
+	AgentConnected func(agentID string)
+	// AgentDisconnected is called with the ID of each agent whose Connect
+	// stream ended, once for every AgentConnected.
+	AgentDisconnected func(agentID string)
+	// Started is called once Run serves all the registered listeners.
+	Started func()
+	// Stopping is called when Run begins shutting down.
+	Stopping func()
+}
+
+func (h Hooks) agentConnected(agentID string) {
+	if h.AgentConnected != nil {
+		h.AgentConnected(agentID)
+	}
+}
+
+func (h Hooks) agentDisconnected(agentID string) {
+	if h.AgentDisconnected != nil {
+		h.AgentDisconnected(agentID)
+	}
+}
+
+func (h Hooks) started() {
+	if h.Started != nil {
+		h.Started()
+	}
+}
+
+func (h Hooks) stopping() {
+	if h.Stopping != nil {
+		h.Stopping()
+	}
+}
+
+// Options configures an embedded Server.
+type Options struct {
+	// ServerID is the unique ID of the server among its replicas. It is
+	// required.
+	ServerID string
+	// ServerCount is the number of replicas of the server agents should
+	// connect to, 0 is 1.
+	ServerCount int
+	// ProxyStrategies are the strategies picking the agent of each dial,
+	// in order. Empty is ProxyStrategyDefault.
+	ProxyStrategies []ProxyStrategy
+	// AgentAuthentication authenticates the agents with service account
+	// tokens. Nil accepts any agent.
+	AgentAuthentication *AgentTokenAuthenticationOptions
+	// FrontendServerOptions are the options of the gRPC server of the
+	// FrontendGRPC listeners, e.g. their credentials.
+	FrontendServerOptions []grpc.ServerOption
+	// AgentServerOptions are the options of the gRPC server of the
+	// backend listeners, e.g. their credentials and keepalive.
+	AgentServerOptions []grpc.ServerOption
+	// ShutdownTimeout bounds the graceful shutdown of Run, after which the
+	// remaining connections are closed. 0 closes them at once.
+	ShutdownTimeout time.Duration
+	// Hooks are called on the lifecycle events of the server.
+	Hooks Hooks
+}
+
+// registeredListener is a listener registered with a Server.
+type registeredListener struct {
+	mode FrontendMode
+	lis  net.Listener
+}
+
+// Server is a proxy server embedded in another program. Listeners are
+// registered before Run serves them.
+type Server struct {
+	opts  Options
+	proxy *ProxyServer
+
+	// mu protects the fields below.
+	mu        sync.Mutex
+	frontends []registeredListener
+	backends  []net.Listener
+	running   bool
+}
+
+// New returns an embedded Server configured with opts.
+func New(opts Options) (*Server, error) {
+	if opts.ServerID == "" {
+		return nil, fmt.Errorf("server ID is required")
+	}
+	if opts.ServerCount < 0 {
+		return nil, fmt.Errorf("server count %d must not be negative", opts.ServerCount)
+	}
+	if opts.ServerCount == 0 {
+		opts.ServerCount = 1
+	}
+	if opts.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout %v must not be negative", opts.ShutdownTimeout)
+	}
+	if len(opts.ProxyStrategies) == 0 {
+		opts.ProxyStrategies = []ProxyStrategy{ProxyStrategyDefault}
+	}
+	for _, ps := range opts.ProxyStrategies {
+		if _, err := GenProxyStrategiesFromStr(string(ps)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.AgentAuthentication == nil {
+		opts.AgentAuthentication = &AgentTokenAuthenticationOptions{}
+	}
+
+	proxy := NewProxyServer(opts.ServerID, opts.ProxyStrategies, opts.ServerCount, opts.AgentAuthentication, false)
+	proxy.ScaleHints.Interval = defaultEmbeddedScaleHintsInterval
+	proxy.Peaks.Window = defaultEmbeddedPeaksWindow
+	proxy.hooks = opts.Hooks
+	return &Server{opts: opts, proxy: proxy}, nil
+}
+
+// RegisterFrontend registers a listener served to frontends speaking mode.
+func (s *Server) RegisterFrontend(mode FrontendMode, lis net.Listener) error {
+	switch mode {
+	case FrontendGRPC, FrontendHTTPConnect:
+	default:
+		return fmt.Errorf("unknown frontend mode %q", mode)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return fmt.Errorf("cannot register a frontend listener of a running server")
+	}
+	s.frontends = append(s.frontends, registeredListener{mode: mode, lis: lis})
+	return nil
+}
+
+// RegisterBackend registers a listener served to agents.
+func (s *Server) RegisterBackend(lis net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return fmt.Errorf("cannot register a backend listener of a running server")
+	}
+	s.backends = append(s.backends, lis)
+	return nil
+}
+
+// Ready reports if the server has an agent connected, and why not
+// otherwise.
+func (s *Server) Ready() (bool, string) {
+	return s.proxy.Readiness.Ready()
+}
+
+// Run serves the registered listeners until ctx is done or one of them
+// fails, then shuts the server down and closes the listeners. It returns
+// nil once ctx is done, the error of the failed listener otherwise. A
+// Server runs once.
+func (s *Server) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return fmt.Errorf("server is already running")
+	}
+	s.running = true
+	frontends, backends := s.frontends, s.backends
+	s.mu.Unlock()
+	if len(backends) == 0 {
+		return fmt.Errorf("no backend listener registered")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.proxy.RunScaleHints(runCtx.Done())
+	go s.proxy.RunPeaks(runCtx.Done())
+	go s.proxy.RunConnJanitor(runCtx.Done())
+
+	errCh := make(chan error, len(frontends)+len(backends))
+	var grpcFrontend *grpc.Server
+	var httpFrontend *http.Server
+	for _, f := range frontends {
+		switch f.mode {
+		case FrontendGRPC:
+			if grpcFrontend == nil {
+				grpcFrontend = grpc.NewServer(s.opts.FrontendServerOptions...)
+				client.RegisterProxyServiceServer(grpcFrontend, s.proxy)
+			}
+			go serveGRPC(grpcFrontend, f.lis, errCh)
+		case FrontendHTTPConnect:
+			if httpFrontend == nil {
+				tunnel := &Tunnel{Server: s.proxy}
+				httpFrontend = &http.Server{
+					Handler:        tunnel,
+					MaxHeaderBytes: tunnel.HTTPServerMaxHeaderBytes(),
+				}
+			}
+			go serveHTTP(httpFrontend, f.lis, errCh)
+		}
+	}
+	backend := grpc.NewServer(s.opts.AgentServerOptions...)
+	agent.RegisterAgentServiceServer(backend, s.proxy)
+	for _, lis := range backends {
+		go serveGRPC(backend, lis, errCh)
+	}
+	klog.V(1).InfoS("Embedded proxy server started", "serverID", s.opts.ServerID,
+		"frontendListeners", len(frontends), "backendListeners", len(backends))
+	s.opts.Hooks.started()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+		klog.ErrorS(err, "Embedded proxy server listener failed", "serverID", s.opts.ServerID)
+	}
+	klog.V(1).InfoS("Embedded proxy server stopping", "serverID", s.opts.ServerID)
+	s.opts.Hooks.stopping()
+
+	deadline := time.Now().Add(s.opts.ShutdownTimeout)
+	if grpcFrontend != nil {
+		stopGRPC(grpcFrontend, time.Until(deadline))
+	}
+	if httpFrontend != nil {
+		stopHTTP(httpFrontend, deadline)
+	}
+	stopGRPC(backend, time.Until(deadline))
+	return err
+}
+
+// serveGRPC serves lis with srv, reporting a failure to errCh.
+func serveGRPC(srv *grpc.Server, lis net.Listener, errCh chan<- error) {
+	if err := srv.Serve(lis); err != nil {
+		errCh <- fmt.Errorf("failed to serve %s: %v", lis.Addr(), err)
+	}
+}
+
+// serveHTTP serves lis with srv, reporting a failure to errCh.
+func serveHTTP(srv *http.Server, lis net.Listener, errCh chan<- error) {
+	if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+		errCh <- fmt.Errorf("failed to serve %s: %v", lis.Addr(), err)
+	}
+}
+
+// stopGRPC stops srv gracefully, closing the connections still open after
+// timeout.
+func stopGRPC(srv *grpc.Server, timeout time.Duration) {
+	if timeout <= 0 {
+		srv.Stop()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
+
+// stopHTTP shuts srv down gracefully, closing the connections still open
+// at deadline.
+func stopHTTP(srv *http.Server, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestNewOptions(t *testing.T) {
+	testcases := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "defaults", opts: Options{ServerID: "server"}},
+		{name: "no server ID", opts: Options{}, wantErr: true},
+		{name: "negative server count", opts: Options{ServerID: "server", ServerCount: -1}, wantErr: true},
+		{name: "negative shutdown timeout", opts: Options{ServerID: "server", ShutdownTimeout: -time.Second}, wantErr: true},
+		{name: "unknown strategy", opts: Options{ServerID: "server", ProxyStrategies: []ProxyStrategy{"unknown"}}, wantErr: true},
+		{name: "strategies", opts: Options{ServerID: "server", ProxyStrategies: []ProxyStrategy{ProxyStrategyDestHost, ProxyStrategyDefault}}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := New(tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if s.proxy.serverCount != 1 {
+				t.Errorf("expected server count 1, got %d", s.proxy.serverCount)
+			}
+			if len(s.proxy.BackendManagers) == 0 {
+				t.Errorf("expected backend managers, got none")
+			}
+		})
+	}
+}
+
+func TestRegisterListeners(t *testing.T) {
+	s, err := New(Options{ServerID: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if err := s.RegisterFrontend("unknown", lis); err == nil {
+		t.Errorf("expected an error registering an unknown frontend mode, got none")
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Errorf("expected an error running without backend listener, got none")
+	}
+	if err := s.RegisterBackend(lis); err == nil {
+		t.Errorf("expected an error registering a listener of a running server, got none")
+	}
+}
+
+func TestRunLifecycle(t *testing.T) {
+	started := make(chan struct{})
+	stopping := make(chan struct{})
+	connected := make(chan string, 1)
+	disconnected := make(chan string, 1)
+	s, err := New(Options{
+		ServerID: "server",
+		Hooks: Hooks{
+			AgentConnected:    func(agentID string) { connected <- agentID },
+			AgentDisconnected: func(agentID string) { disconnected <- agentID },
+			Started:           func() { close(started) },
+			Stopping:          func() { close(stopping) },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFrontend(FrontendGRPC, frontendListener); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterBackend(backendListener); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+	waitForHook(t, started, "started")
+
+	conn, err := grpc.Dial(backendListener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	streamCtx := metadata.AppendToOutgoingContext(context.Background(), header.AgentID, "agent")
+	stream, err := agent.NewAgentServiceClient(conn).Connect(streamCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case agentID := <-connected:
+		if agentID != "agent" {
+			t.Errorf("expected agent %q connected, got %q", "agent", agentID)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the agent connected, got none")
+	}
+
+	cancel()
+	waitForHook(t, stopping, "stopping")
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("expected Run to return nil, got %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected Run to return")
+	}
+	select {
+	case agentID := <-disconnected:
+		if agentID != "agent" {
+			t.Errorf("expected agent %q disconnected, got %q", "agent", agentID)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the agent disconnected, got none")
+	}
+}
+
+func waitForHook(t *testing.T, ch <-chan struct{}, event string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the server %s, timed out", event)
+	}
+}
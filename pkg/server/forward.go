@@ -0,0 +1,186 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// forwardConnID is the connection ID of the single connection tunneled by
+// a Forward stream.
+const forwardConnID = 1
+
+// PortForwardConfig configures the destinations agents may reach through
+// their port-forward listeners, e.g. for cluster components to reach the
+// apiserver through the proxy.
+type PortForwardConfig struct {
+	// Destinations are the host:port addresses agents may forward
+	// connections to. Forwarding is disabled if there are none.
+	Destinations []string
+	// DialTimeout bounds the dial of the destinations, 0 does not.
+	DialTimeout time.Duration
+}
+
+// allowed returns whether agents may forward connections to address.
+func (c *PortForwardConfig) allowed(address string) bool {
+	for _, dest := range c.Destinations {
+		if dest == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward tunnels a connection accepted by a port-forward listener of the
+// agent to a destination on the network of the proxy server.
+func (s *ProxyServer) Forward(stream agent.AgentService_ForwardServer) error {
+	metrics.Metrics.ConnectionInc(metrics.Forward)
+	defer metrics.Metrics.ConnectionDec(metrics.Forward)
+
+	agentID, err := agentID(stream)
+	if err != nil {
+		return err
+	}
+	if err := s.authenticateAgent(stream.Context(), agentID); err != nil {
+		return err
+	}
+	if len(s.PortForward.Destinations) == 0 {
+		return status.Error(codes.Unimplemented, "port forwarding is disabled")
+	}
+
+	pkt, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if pkt.Type != client.PacketType_DIAL_REQ {
+		return status.Errorf(codes.InvalidArgument, "expected DIAL_REQ, got %v", pkt.Type)
+	}
+	req := pkt.GetDialRequest()
+	klog.V(3).InfoS("Forward request from agent", "agentID", agentID, "address", req.Address, "dialID", req.Random)
+
+	conn, err := s.dialForward(req)
+	resp := &client.DialResponse{Random: req.Random}
+	if err != nil {
+		klog.V(2).InfoS("Failed to forward connection", "agentID", agentID, "address", req.Address, "err", err)
+		resp.Error = err.Error()
+	} else {
+		resp.ConnectID = forwardConnID
+	}
+	if err := stream.Send(&client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: resp},
+	}); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+	if conn == nil {
+		return nil
+	}
+	defer conn.Close()
+
+	// The destination is read until it is closed, by either end.
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		s.serveForwardDestination(stream, conn, agentID)
+	}()
+
+	for {
+		pkt, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				klog.V(2).InfoS("Forward stream read failure", "agentID", agentID, "address", req.Address, "err", err)
+			}
+			break
+		}
+		if pkt.Type == client.PacketType_CLOSE_REQ {
+			break
+		}
+		if pkt.Type != client.PacketType_DATA {
+			klog.V(5).InfoS("Ignoring packet on forward stream", "type", pkt.Type, "agentID", agentID)
+			continue
+		}
+		if _, err := conn.Write(pkt.GetData().Data); err != nil {
+			klog.V(2).InfoS("Failed to write to forward destination", "agentID", agentID, "address", req.Address, "err", err)
+			break
+		}
+	}
+	conn.Close()
+	<-readDone
+	return nil
+}
+
+// dialForward dials the destination of a forwarded connection, if allowed.
+func (s *ProxyServer) dialForward(req *client.DialRequest) (net.Conn, error) {
+	if !s.PortForward.allowed(req.Address) {
+		return nil, fmt.Errorf("forwarding to %q is not allowed", req.Address)
+	}
+	protocol := req.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" {
+		return nil, fmt.Errorf("forwarding over %q is not supported", protocol)
+	}
+	return net.DialTimeout(protocol, req.Address, s.PortForward.DialTimeout)
+}
+
+// serveForwardDestination sends the DATA read from the destination of a
+// forwarded connection to the agent, then CLOSE_RSP once it is closed.
+func (s *ProxyServer) serveForwardDestination(stream agent.AgentService_ForwardServer, conn net.Conn, agentID string) {
+	buf := s.getPacketBuffer()
+	defer s.putPacketBuffer(buf)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := &client.Packet{
+				Type: client.PacketType_DATA,
+				Payload: &client.Packet_Data{Data: &client.Data{
+					ConnectID: forwardConnID,
+					Data:      append([]byte(nil), buf[:n]...),
+				}},
+			}
+			if err := stream.Send(data); err != nil {
+				klog.V(2).InfoS("Failed to send DATA on forward stream", "agentID", agentID, "err", err)
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	closeRsp := &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: forwardConnID}},
+	}
+	if err := stream.Send(closeRsp); err != nil {
+		klog.V(5).InfoS("Failed to send CLOSE_RSP on forward stream", "agentID", agentID, "err", err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// fakeForwardServer is a Forward stream of agent1, receiving the packets
+// written to recv and delivering the packets sent to sent.
+type fakeForwardServer struct {
+	grpc.ServerStream
+	recv chan *client.Packet
+	sent chan *client.Packet
+}
+
+func newFakeForwardServer() *fakeForwardServer {
+	return &fakeForwardServer{recv: make(chan *client.Packet, 10), sent: make(chan *client.Packet, 10)}
+}
+
+func (f *fakeForwardServer) Context() context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(header.AgentID, "agent1"))
+}
+
+func (f *fakeForwardServer) Send(pkt *client.Packet) error {
+	f.sent <- pkt
+	return nil
+}
+
+func (f *fakeForwardServer) Recv() (*client.Packet, error) {
+	pkt, ok := <-f.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return pkt, nil
+}
+
+func (f *fakeForwardServer) next(t *testing.T) *client.Packet {
+	t.Helper()
+	select {
+	case pkt := <-f.sent:
+		return pkt
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("timed out waiting for a packet")
+		return nil
+	}
+}
+
+func dialRequestPacket(address string) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{Protocol: "tcp", Address: address, Random: 42}},
+	}
+}
+
+func TestForward(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{}, false)
+	p.PortForward.Destinations = []string{lis.Addr().String()}
+	stream := newFakeForwardServer()
+	done := make(chan error)
+	go func() { done <- p.Forward(stream) }()
+
+	stream.recv <- dialRequestPacket(lis.Addr().String())
+	resp := stream.next(t)
+	if resp.Type != client.PacketType_DIAL_RSP || resp.GetDialResponse().Error != "" || resp.GetDialResponse().Random != 42 {
+		t.Fatalf("expected a successful DIAL_RSP, got %v", resp)
+	}
+	connID := resp.GetDialResponse().ConnectID
+
+	stream.recv <- dataPacket(connID, "hello")
+	if data := stream.next(t); data.Type != client.PacketType_DATA || string(data.GetData().Data) != "hello" {
+		t.Errorf("expected the echoed DATA, got %v", data)
+	}
+
+	stream.recv <- &client.Packet{
+		Type:    client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connID}},
+	}
+	if closeRsp := stream.next(t); closeRsp.Type != client.PacketType_CLOSE_RSP {
+		t.Errorf("expected CLOSE_RSP, got %v", closeRsp)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestForwardDestinationNotAllowed(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{}, false)
+	p.PortForward.Destinations = []string{"kubernetes.default.svc:443"}
+	stream := newFakeForwardServer()
+	stream.recv <- dialRequestPacket("10.0.0.1:22")
+	if err := p.Forward(stream); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if resp := stream.next(t); resp.GetDialResponse().GetError() == "" {
+		t.Errorf("expected the dial to be rejected, got %v", resp)
+	}
+}
+
+func TestForwardDisabled(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{}, false)
+	if err := p.Forward(newFakeForwardServer()); err == nil {
+		t.Error("expected port forwarding to be disabled")
+	}
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// FrontendIdentity is the authenticated identity of a frontend.
+type FrontendIdentity struct {
+	// Name is the common name of the client certificate, or the user of
+	// the token.
+	Name   string
+	Groups []string
+}
+
+// FrontendAuthenticator authenticates the frontend of a Proxy stream.
+type FrontendAuthenticator interface {
+	// Authenticate returns the identity of the frontend of the stream
+	// with context ctx, or an error if it cannot be authenticated.
+	Authenticate(ctx context.Context) (*FrontendIdentity, error)
+}
+
+// FrontendAuthorizer decides which frontends may dial which destinations.
+type FrontendAuthorizer interface {
+	// Authorize returns an error if identity may not dial address over
+	// protocol. identity is nil if the frontends are not authenticated.
+	Authorize(identity *FrontendIdentity, protocol, address string) error
+}
+
+// ErrUnauthorized indicates that the frontend was not allowed to dial.
+type ErrUnauthorized struct {
+	Reason string
+}
+
+// Error returns the error message.
+func (e *ErrUnauthorized) Error() string {
+	return "dial not authorized: " + e.Reason
+}
+
+// CertificateAuthenticator authenticates frontends by their client
+// certificate, verified against the CA of the frontend port.
+type CertificateAuthenticator struct {
+	// AllowedNames are the common names and DNS, URI and email subject
+	// alternative names of which a certificate must have one. Empty
+	// accepts any verified certificate.
+	AllowedNames []string
+}
+
+var _ FrontendAuthenticator = &CertificateAuthenticator{}
+
+// Authenticate returns the common name of the verified client certificate
+// as the identity, and its organizations as the groups.
+func (a *CertificateAuthenticator) Authenticate(ctx context.Context) (*FrontendIdentity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("failed to get peer from context")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("no verified client certificate")
+	}
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	if len(a.AllowedNames) > 0 && !certificateHasName(cert, a.AllowedNames) {
+		return nil, fmt.Errorf("client certificate %q has none of the allowed names", cert.Subject.CommonName)
+	}
+	return &FrontendIdentity{Name: cert.Subject.CommonName, Groups: cert.Subject.Organization}, nil
+}
+
+func certificateHasName(cert *x509.Certificate, allowed []string) bool {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		for _, a := range allowed {
+			if name != "" && name == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenAuthenticator authenticates frontends by the bearer token they send
+// in the authorization metadata of the stream.
+type TokenAuthenticator struct {
+	tokens map[string]*FrontendIdentity
+}
+
+var _ FrontendAuthenticator = &TokenAuthenticator{}
+
+// NewTokenAuthenticatorFromFile returns a TokenAuthenticator accepting the
+// tokens of file, a CSV file in the format of the static token file of the
+// Kubernetes apiserver: token,user,uid,"group1,group2". The uid is ignored.
+func NewTokenAuthenticatorFromFile(file string) (*TokenAuthenticator, error) {
+	tokens, err := readTokenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAuthenticator{tokens: tokens}, nil
+}
+
+// readTokenFile returns the identities of the tokens of file, in the
+// format of the static token file of the Kubernetes apiserver.
+func readTokenFile(file string) (map[string]*FrontendIdentity, error) {
+	records, err := readCredentialFile(file, "token")
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]*FrontendIdentity)
+	for i, record := range records {
+		if _, ok := tokens[record[0]]; ok {
+			return nil, fmt.Errorf("line %d of token file %s repeats a token", i+1, file)
+		}
+		tokens[record[0]] = credentialIdentity(record)
+	}
+	return tokens, nil
+}
+
+// readCredentialFile reads the records of a CSV file of the format
+// secret,user,uid,"group1,group2", where secret is a kind.
+func readCredentialFile(file, kind string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s file %s: %v", kind, file, err)
+	}
+	for i, record := range records {
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("line %d of %s file %s must have a %s and a user", i+1, kind, file, kind)
+		}
+	}
+	return records, nil
+}
+
+// credentialIdentity returns the identity of a record of a credential
+// file.
+func credentialIdentity(record []string) *FrontendIdentity {
+	identity := &FrontendIdentity{Name: record[1]}
+	if len(record) > 3 && record[3] != "" {
+		identity.Groups = strings.Split(record[3], ",")
+	}
+	return identity
+}
+
+// Authenticate returns the identity of the bearer token of the stream.
+func (a *TokenAuthenticator) Authenticate(ctx context.Context) (*FrontendIdentity, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("failed to retrieve metadata from context")
+	}
+	authorization := md.Get("authorization")
+	if len(authorization) != 1 {
+		return nil, fmt.Errorf("expected one authorization header, got %d", len(authorization))
+	}
+	token := strings.TrimPrefix(authorization[0], "Bearer ")
+	if token == authorization[0] {
+		return nil, fmt.Errorf("authorization header is not a bearer token")
+	}
+	for t, identity := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+// FrontendAuthorizationRule allows a subject to dial a destination.
+type FrontendAuthorizationRule struct {
+	// Subject is the name of an identity, "group:" followed by the name
+	// of a group, or "*" for any frontend.
+	Subject string
+	// Destination is a host:port pattern in which "*" matches any
+	// sequence of characters, e.g. "*:10250" or "10.0.*:443".
+	Destination string
+}
+
+// RuleAuthorizer allows the dials matching one of its rules.
+type RuleAuthorizer struct {
+	Rules []FrontendAuthorizationRule
+}
+
+var _ FrontendAuthorizer = &RuleAuthorizer{}
+
+// ParseFrontendAuthorizationRules parses subject=destination rules, see
+// FrontendAuthorizationRule.
+func ParseFrontendAuthorizationRules(rules []string) ([]FrontendAuthorizationRule, error) {
+	var parsed []FrontendAuthorizationRule
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || i == len(rule)-1 {
+			return nil, fmt.Errorf("invalid rule %q, expected subject=destination", rule)
+		}
+		parsed = append(parsed, FrontendAuthorizationRule{Subject: rule[:i], Destination: rule[i+1:]})
+	}
+	return parsed, nil
+}
+
+// Authorize allows the dial if a rule of a subject of identity matches
+// address.
+func (a *RuleAuthorizer) Authorize(identity *FrontendIdentity, protocol, address string) error {
+	for _, rule := range a.Rules {
+		if ruleSubjectMatches(rule.Subject, identity) && matchPattern(rule.Destination, address) {
+			return nil
+		}
+	}
+	name := ""
+	if identity != nil {
+		name = identity.Name
+	}
+	return &ErrUnauthorized{Reason: fmt.Sprintf("%q may not dial %s", name, address)}
+}
+
+func ruleSubjectMatches(subject string, identity *FrontendIdentity) bool {
+	if subject == "*" {
+		return true
+	}
+	if identity == nil {
+		return false
+	}
+	if group := strings.TrimPrefix(subject, "group:"); group != subject {
+		for _, g := range identity.Groups {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+	return subject == identity.Name
+}
+
+// matchPattern reports whether s matches pattern, in which "*" matches
+// any sequence of characters.
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// authenticateFrontend returns the identity of the frontend of the stream
+// with context ctx, nil if frontends are not authenticated. Any of the
+// FrontendAuthenticators may authenticate it.
+func (s *ProxyServer) authenticateFrontend(ctx context.Context) (*FrontendIdentity, error) {
+	if len(s.FrontendAuthenticators) == 0 || isRelayed(ctx) {
+		// relayed dials were authenticated by the relaying peer
+		return nil, nil
+	}
+	var errs []string
+	for _, a := range s.FrontendAuthenticators {
+		identity, err := a.Authenticate(ctx)
+		if err == nil {
+			return identity, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("failed to authenticate frontend: %s", strings.Join(errs, "; "))
+}
+
+// authorizerValue wraps the FrontendAuthorizer of a ProxyServer, so that
+// authorizers of different types can be swapped in its atomic.Value.
+type authorizerValue struct {
+	FrontendAuthorizer
+}
+
+// SetFrontendAuthorizer changes the FrontendAuthorizer deciding which
+// destinations the frontends may dial, nil allows any. Dials already
+// authorized are not affected.
+func (s *ProxyServer) SetFrontendAuthorizer(authorizer FrontendAuthorizer) {
+	s.frontendAuthorizer.Store(authorizerValue{authorizer})
+}
+
+func (s *ProxyServer) currentFrontendAuthorizer() FrontendAuthorizer {
+	v, _ := s.frontendAuthorizer.Load().(authorizerValue)
+	return v.FrontendAuthorizer
+}
+
+// authorizeDial checks that the frontend may dial address over protocol,
+// per the FrontendAuthorizer and the egress policy. The agent may dial any
+// of the candidate addresses instead, so each of them must be allowed too.
+func (s *ProxyServer) authorizeDial(frontend *ProxyClientConnection, protocol, address string, candidates []string) error {
+	if frontend.relayed {
+		return nil
+	}
+	if authorizer := s.currentFrontendAuthorizer(); authorizer != nil {
+		for _, addr := range append([]string{address}, candidates...) {
+			if err := authorizer.Authorize(frontend.authenticated, protocol, addr); err != nil {
+				return err
+			}
+		}
+	}
+	return s.enforceEgressPolicy(frontend, protocol, address, candidates)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestCertificateAuthenticator(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "apiserver", Organization: []string{"system:masters"}},
+		DNSNames: []string{"kube-apiserver.example.com"},
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}}})
+	testCases := []struct {
+		desc         string
+		ctx          context.Context
+		allowedNames []string
+		wantError    bool
+	}{
+		{desc: "any verified certificate", ctx: ctx},
+		{desc: "allowed common name", ctx: ctx, allowedNames: []string{"apiserver"}},
+		{desc: "allowed subject alternative name", ctx: ctx, allowedNames: []string{"kube-apiserver.example.com"}},
+		{desc: "name not allowed", ctx: ctx, allowedNames: []string{"scheduler"}, wantError: true},
+		{desc: "no peer", ctx: context.Background(), wantError: true},
+		{
+			desc:      "no verified certificate",
+			ctx:       peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}}),
+			wantError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := &CertificateAuthenticator{AllowedNames: tc.allowedNames}
+			identity, err := a.Authenticate(tc.ctx)
+			if tc.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			want := &FrontendIdentity{Name: "apiserver", Groups: []string{"system:masters"}}
+			if !reflect.DeepEqual(identity, want) {
+				t.Errorf("expected %v, got %v", want, identity)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontend-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens.csv")
+	if err := ioutil.WriteFile(file, []byte("secret1,apiserver,uid1,\"system:masters,admins\"\nsecret2,scheduler\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewTokenAuthenticatorFromFile(file)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testCases := []struct {
+		authorization string
+		want          *FrontendIdentity
+	}{
+		{authorization: "Bearer secret1", want: &FrontendIdentity{Name: "apiserver", Groups: []string{"system:masters", "admins"}}},
+		{authorization: "Bearer secret2", want: &FrontendIdentity{Name: "scheduler"}},
+		{authorization: "Bearer secret3"},
+		{authorization: "secret1"},
+	}
+	for _, tc := range testCases {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", tc.authorization))
+		identity, err := a.Authenticate(ctx)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %v", tc.authorization, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected no error for %q, got %v", tc.authorization, err)
+		}
+		if !reflect.DeepEqual(identity, tc.want) {
+			t.Errorf("expected %v for %q, got %v", tc.want, tc.authorization, identity)
+		}
+	}
+}
+
+func TestRuleAuthorizer(t *testing.T) {
+	rules, err := ParseFrontendAuthorizationRules([]string{"apiserver=*:10250", "group:admins=*", "*=10.0.*:443"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	a := &RuleAuthorizer{Rules: rules}
+	apiserver := &FrontendIdentity{Name: "apiserver"}
+	admin := &FrontendIdentity{Name: "alice", Groups: []string{"admins"}}
+	testCases := []struct {
+		identity *FrontendIdentity
+		address  string
+		allowed  bool
+	}{
+		{identity: apiserver, address: "node1:10250", allowed: true},
+		{identity: apiserver, address: "node1:22"},
+		{identity: apiserver, address: "10.0.1.2:443", allowed: true},
+		{identity: admin, address: "node1:22", allowed: true},
+		{address: "10.0.1.2:443", allowed: true},
+		{address: "10.1.1.2:443"},
+	}
+	for _, tc := range testCases {
+		err := a.Authorize(tc.identity, "tcp", tc.address)
+		if tc.allowed && err != nil {
+			t.Errorf("expected %v to be allowed to dial %s, got %v", tc.identity, tc.address, err)
+		}
+		if !tc.allowed {
+			if _, ok := err.(*ErrUnauthorized); !ok {
+				t.Errorf("expected %v not to be allowed to dial %s, got %v", tc.identity, tc.address, err)
+			}
+		}
+	}
+
+	for _, rule := range []string{"apiserver", "=node1:22", "apiserver="} {
+		if _, err := ParseFrontendAuthorizationRules([]string{rule}); err == nil {
+			t.Errorf("expected an error for rule %q", rule)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"node1:22", "node1:22", true},
+		{"node1:22", "node1:222", false},
+		{"*:10250", "node1:10250", true},
+		{"*:10250", "node1:102500", false},
+		{"10.0.*:*", "10.0.1.2:443", true},
+		{"10.0.*:*", "10.1.1.2:443", false},
+		{"a*a", "a", false},
+		{"[::1]:*", "[::1]:80", true},
+	}
+	for _, tc := range testCases {
+		if got := matchPattern(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("expected matchPattern(%q, %q) to be %v, got %v", tc.pattern, tc.s, tc.want, got)
+		}
+	}
+}
+
+// contextProxyServer is a recordingProxyServer with a context.
+type contextProxyServer struct {
+	recordingProxyServer
+	ctx context.Context
+}
+
+func (f *contextProxyServer) Context() context.Context {
+	return f.ctx
+}
+
+func TestProxyRejectsUnauthenticatedFrontend(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.FrontendAuthenticators = []FrontendAuthenticator{&CertificateAuthenticator{}}
+	stream := &contextProxyServer{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{})}
+	if err := p.Proxy(stream); err == nil {
+		t.Fatal("expected the stream of the unauthenticated frontend to be rejected")
+	}
+}
+
+func TestServeRecvFrontendUnauthorizedDial(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.SetFrontendAuthorizer(&RuleAuthorizer{Rules: []FrontendAuthorizationRule{{Subject: "apiserver", Destination: "*:10250"}}})
+	stream := &contextProxyServer{ctx: context.Background()}
+
+	recvCh := make(chan *client.Packet, 1)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{Protocol: "tcp", Address: "node1:22", Random: 1}},
+	}
+	close(recvCh)
+	p.serveRecvFrontend(stream, recvCh, &FrontendIdentity{Name: "apiserver"})
+
+	if len(stream.sent) != 1 || stream.sent[0].Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expected a DIAL_RSP, got %v", stream.sent)
+	}
+	resp := stream.sent[0].GetDialResponse()
+	if want := (&ErrUnauthorized{Reason: `"apiserver" may not dial node1:22`}).Error(); resp.Error != want {
+		t.Errorf("expected error %q, got %q", want, resp.Error)
+	}
+	if resp.ErrorCode != client.DialErrorCode_DIAL_ERROR_UNSPECIFIED {
+		t.Errorf("expected no retryable error code, got %v", resp.ErrorCode)
+	}
+}
+
+func TestServeRecvFrontendUnauthorizedCandidate(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.SetFrontendAuthorizer(&RuleAuthorizer{Rules: []FrontendAuthorizationRule{{Subject: "apiserver", Destination: "*:10250"}}})
+	stream := &contextProxyServer{ctx: context.Background()}
+
+	recvCh := make(chan *client.Packet, 1)
+	recvCh <- &client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol:   "tcp",
+			Address:    "node1:10250",
+			Candidates: []string{"10.0.0.1:10250", "10.0.0.1:22"},
+			Random:     1,
+		}},
+	}
+	close(recvCh)
+	p.serveRecvFrontend(stream, recvCh, &FrontendIdentity{Name: "apiserver"})
+
+	if len(stream.sent) != 1 || stream.sent[0].Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expected a DIAL_RSP, got %v", stream.sent)
+	}
+	resp := stream.sent[0].GetDialResponse()
+	if want := (&ErrUnauthorized{Reason: `"apiserver" may not dial 10.0.0.1:22`}).Error(); resp.Error != want {
+		t.Errorf("expected error %q, got %q", want, resp.Error)
+	}
+}
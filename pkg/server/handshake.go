@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+var errHandshakeBudgetExceeded = errors.New("TLS handshake budget exceeded")
+
+// handshakeCredentials wraps the TLS transport credentials of the agent
+// server, recording handshake metrics and bounding the number of
+// concurrent handshakes.
+type handshakeCredentials struct {
+	credentials.TransportCredentials
+
+	// budget holds a token per handshake in progress, nil leaves the
+	// handshakes unbounded.
+	budget chan struct{}
+	// maxWait is how long a handshake waits for a token before the
+	// connection is rejected.
+	maxWait time.Duration
+}
+
+// NewHandshakeCredentials returns creds limited to maxConcurrent concurrent
+// server handshakes. Handshakes beyond the budget wait up to maxWait for a
+// handshake in progress to finish and are rejected afterwards, so that a
+// reconnect storm of agents queues up rather than pinning all CPUs with
+// full handshakes. Rejected agents retry with backoff, and mostly resume
+// their sessions later on. maxConcurrent 0 leaves handshakes unbounded.
+func NewHandshakeCredentials(creds credentials.TransportCredentials, maxConcurrent int, maxWait time.Duration) credentials.TransportCredentials {
+	c := &handshakeCredentials{TransportCredentials: creds, maxWait: maxWait}
+	if maxConcurrent > 0 {
+		c.budget = make(chan struct{}, maxConcurrent)
+	}
+	return c
+}
+
+func (c *handshakeCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	if c.budget != nil {
+		if !c.acquire() {
+			metrics.Metrics.ObserveAgentHandshake(time.Since(start), metrics.HandshakeRejected)
+			return nil, nil, errHandshakeBudgetExceeded
+		}
+		defer func() { <-c.budget }()
+	}
+
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	result := metrics.HandshakeFull
+	if err != nil {
+		result = metrics.HandshakeFailed
+	} else if tlsInfo, ok := authInfo.(credentials.TLSInfo); ok && tlsInfo.State.DidResume {
+		result = metrics.HandshakeResumed
+	}
+	metrics.Metrics.ObserveAgentHandshake(time.Since(start), result)
+	return conn, authInfo, err
+}
+
+func (c *handshakeCredentials) acquire() bool {
+	select {
+	case c.budget <- struct{}{}:
+		return true
+	default:
+	}
+
+	metrics.Metrics.HandshakeWaitingInc()
+	defer metrics.Metrics.HandshakeWaitingDec()
+	timer := time.NewTimer(c.maxWait)
+	defer timer.Stop()
+	select {
+	case c.budget <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *handshakeCredentials) Clone() credentials.TransportCredentials {
+	return &handshakeCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		budget:               c.budget,
+		maxWait:              c.maxWait,
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// blockingCredentials are transport credentials whose server handshakes
+// block until release is closed.
+type blockingCredentials struct {
+	credentials.TransportCredentials
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return rawConn, credentials.TLSInfo{}, nil
+}
+
+func (c *blockingCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	panic("unexpected client handshake")
+}
+
+func (c *blockingCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func TestHandshakeBudget(t *testing.T) {
+	inner := &blockingCredentials{started: make(chan struct{}, 2), release: make(chan struct{})}
+	creds := NewHandshakeCredentials(inner, 1, 10*time.Millisecond)
+
+	first := make(chan error)
+	go func() {
+		_, _, err := creds.ServerHandshake(nil)
+		first <- err
+	}()
+	<-inner.started
+
+	// The budget is spent by the first handshake.
+	if _, _, err := creds.Clone().ServerHandshake(nil); err != errHandshakeBudgetExceeded {
+		t.Errorf("expected the handshake to be rejected, got %v", err)
+	}
+
+	close(inner.release)
+	if err := <-first; err != nil {
+		t.Errorf("expected the first handshake to succeed, got %v", err)
+	}
+	if _, _, err := creds.ServerHandshake(nil); err != nil {
+		t.Errorf("expected a handshake within the budget to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// frontendProtocolVersion is the highest version of the protocol between
+// frontends and the server spoken by this build. It must match the
+// ProtocolVersion of the konnectivity-client.
+const frontendProtocolVersion = 1
+
+// SupportedFeatures are the HELLO features this build of the server can
+// advertise to agents.
+var SupportedFeatures = []string{header.FeatureCompression, header.FeatureFlowControl, header.FeatureResumption, header.FeatureIdleWarning}
+
+// RecordBuildInfo sets the konnectivity_build_info metric of the server to
+// the running build, agent protocol version and supported features.
+func RecordBuildInfo() {
+	v := util.GetVersionInfo()
+	metrics.Metrics.SetBuildInfo(v.GitVersion, v.GitCommit, v.GoVersion, pkgagent.ProtocolVersion, SupportedFeatures)
+}
+
+func helloPacket(version int, features []string) *client.Packet {
+	return &client.Packet{
+		Type: client.PacketType_HELLO,
+		Payload: &client.Packet_Hello{
+			Hello: &client.Hello{
+				ProtocolVersion: int32(version),
+				Features:        features,
+			},
+		},
+	}
+}
+
+// frontendFeatures are the features the server advertises to frontends.
+// The idle warnings of agents are forwarded to the frontends handling
+// them.
+func (s *ProxyServer) frontendFeatures() []string {
+	return []string{header.FeatureIdleWarning}
+}
+
+// agentFeatures returns the features the server advertises to the agent
+// of the Connect stream context ctx. DATA compressed by the agent is
+// always accepted, whether the server or the frontend asked for it.
+func (s *ProxyServer) agentFeatures(ctx context.Context) []string {
+	features := []string{header.FeatureCompression, header.FeatureIdleWarning}
+	if s.agentProtocolVersion(ctx) >= pkgagent.ProtocolVersionAck {
+		features = append(features, header.FeatureFlowControl)
+	}
+	if s.Sessions.Grace > 0 {
+		features = append(features, header.FeatureResumption)
+	}
+	return features
+}
+
+// handleFrontendHello answers the HELLO of a frontend with the features of
+// the server.
+func (s *ProxyServer) handleFrontendHello(stream client.ProxyService_ProxyServer, hello *client.Hello) {
+	klog.V(4).InfoS("Frontend said hello", "serverID", s.serverID, "protocolVersion", hello.ProtocolVersion, "features", hello.Features)
+	version := pkgagent.NegotiateProtocolVersion(frontendProtocolVersion, int(hello.ProtocolVersion))
+	if err := stream.Send(helloPacket(version, s.frontendFeatures())); err != nil {
+		klog.ErrorS(err, "HELLO to frontend failed", "serverID", s.serverID)
+	}
+}
+
+// handleAgentHello records the features of the agent of b, and answers
+// its HELLO with those of the server.
+func (s *ProxyServer) handleAgentHello(b Backend, agentID string, hello *client.Hello) {
+	klog.V(2).InfoS("Agent said hello", "serverID", s.serverID, "agentID", agentID, "protocolVersion", hello.ProtocolVersion, "features", hello.Features)
+	if be, ok := b.(*backend); ok {
+		be.setHello(hello)
+	}
+	version, features := s.agentProtocolVersion(b.Context()), s.agentFeatures(b.Context())
+	klog.InfoS("Negotiated features with agent", "serverID", s.serverID, "agentID", agentID, "protocolVersion", version, "features", pkgagent.NegotiatedFeatures(features, hello.Features))
+	pkt := helloPacket(version, features)
+	if err := b.Send(pkt); err != nil {
+		klog.ErrorS(err, "HELLO to agent failed", "serverID", s.serverID, "agentID", agentID)
+	}
+}
+
+func (b *backend) setHello(hello *client.Hello) {
+	b.helloMu.Lock()
+	defer b.helloMu.Unlock()
+	b.hello = hello
+}
+
+// agentSupports reports whether the agent of b advertised feature in its
+// HELLO. Agents which did not say hello are assumed to support it,
+// features being gated by their capabilities then.
+func agentSupports(b Backend, feature string) bool {
+	be, ok := b.(*backend)
+	if !ok {
+		// relayed dials are checked by the peer serving the agent
+		return true
+	}
+	be.helloMu.Lock()
+	defer be.helloMu.Unlock()
+	if be.hello == nil {
+		return true
+	}
+	for _, f := range be.hello.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// frontendSupports reports whether frontend advertised feature in its
+// HELLO. Unlike agents, frontends which did not say hello, such as
+// http-connect ones, are assumed not to support it: packets they do not
+// know are dropped by them.
+func frontendSupports(frontend *ProxyClientConnection, feature string) bool {
+	if frontend.hello == nil {
+		return false
+	}
+	for _, f := range frontend.hello.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
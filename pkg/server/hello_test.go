@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestHandleAgentHello(t *testing.T) {
+	s := &ProxyServer{DataCompression: "gzip"}
+	conn := newResumingConnectServer()
+	be := newBackend(conn)
+	if !agentSupports(be, header.FeatureCompression) {
+		t.Errorf("expected agents which did not say hello to be assumed to support %s", header.FeatureCompression)
+	}
+
+	s.handleAgentHello(be, "agent1", &client.Hello{ProtocolVersion: pkgagent.ProtocolVersionHello, Features: []string{header.FeatureUDP}})
+	sent := conn.sentPackets()
+	if len(sent) != 1 || sent[0].Type != client.PacketType_HELLO {
+		t.Fatalf("expected the hello to be answered, got %v", sent)
+	}
+	// The agent did not announce a protocol version in the Connect
+	// header, flow control is not advertised.
+	if e, a := []string{header.FeatureCompression, header.FeatureIdleWarning}, sent[0].GetHello().Features; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected features %v, got %v", e, a)
+	}
+	if !agentSupports(be, header.FeatureUDP) || agentSupports(be, header.FeatureCompression) {
+		t.Errorf("expected the agent to only support %s", header.FeatureUDP)
+	}
+
+	dialReq := &client.DialRequest{}
+	frontend := &ProxyClientConnection{backend: be}
+	s.requestCompression(dialReq, frontend)
+	if dialReq.Compression != "" || frontend.requestedCompression != "" {
+		t.Errorf("expected no compression to be requested from the agent, got %q", dialReq.Compression)
+	}
+	frontend.backend = &recordingBackend{}
+	s.requestCompression(dialReq, frontend)
+	if dialReq.Compression != "gzip" {
+		t.Errorf("expected relayed dials to request compression, got %q", dialReq.Compression)
+	}
+}
+
+// recordingProxyServer records the packets sent to a frontend.
+type recordingProxyServer struct {
+	client.ProxyService_ProxyServer
+	sent []*client.Packet
+}
+
+func (f *recordingProxyServer) Send(pkt *client.Packet) error {
+	f.sent = append(f.sent, pkt)
+	return nil
+}
+
+func TestHandleFrontendHello(t *testing.T) {
+	s := &ProxyServer{}
+	stream := &recordingProxyServer{}
+	s.handleFrontendHello(stream, &client.Hello{ProtocolVersion: 5})
+	if len(stream.sent) != 1 || stream.sent[0].Type != client.PacketType_HELLO {
+		t.Fatalf("expected the hello to be answered, got %v", stream.sent)
+	}
+	hello := stream.sent[0].GetHello()
+	want := []string{header.FeatureIdleWarning}
+	if hello.ProtocolVersion != frontendProtocolVersion || !reflect.DeepEqual(hello.Features, want) {
+		t.Errorf("expected version %d with features %v, got %v", frontendProtocolVersion, want, hello)
+	}
+}
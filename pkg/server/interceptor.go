@@ -0,0 +1,171 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// PacketDirection is the direction of an intercepted DATA payload.
+type PacketDirection string
+
+const (
+	// DirectionToAgent is data sent by the frontend to the destination.
+	DirectionToAgent PacketDirection = "to_agent"
+	// DirectionFromAgent is data sent by the destination to the frontend.
+	DirectionFromAgent PacketDirection = "from_agent"
+)
+
+// ConnectionMetadata describes the connection an intercepted DATA payload
+// belongs to.
+type ConnectionMetadata struct {
+	ConnectionID int64
+	AgentID      string
+	// FrontendMode is grpc or http-connect, FrontendIdentity the common
+	// name of the frontend's client certificate, if any.
+	FrontendMode        string
+	FrontendIdentity    string
+	Protocol            string
+	Destination         string
+	DestinationHostname string
+}
+
+// InterceptDecision is the outcome of inspecting a DATA payload. The zero
+// value allows the payload.
+type InterceptDecision struct {
+	// Deny drops the payload and closes the connection.
+	Deny bool
+	// Reason tells why the connection was denied, it is logged and
+	// recorded in the audit log.
+	Reason string
+	// Annotations are recorded with the audit events of the connection,
+	// e.g. the classification of its content. Later annotations of a key
+	// replace earlier ones.
+	Annotations map[string]string
+}
+
+// PacketInterceptor inspects the DATA payloads exchanged between frontends
+// and agents, e.g. to scan node-bound traffic for data-loss-prevention.
+// Payloads are seen as sent by the frontend: compressed if the frontend
+// negotiated compression with the agent itself. InterceptData is called
+// concurrently for different connections, and for the two directions of a
+// connection; it must not retain or modify data.
+type PacketInterceptor interface {
+	InterceptData(conn *ConnectionMetadata, direction PacketDirection, data []byte) InterceptDecision
+}
+
+// RegisterPacketInterceptor adds interceptor to the interceptors run, in
+// registration order, on the DATA payloads of every connection. The first
+// interceptor denying a payload stops the others. It must be called before
+// the server starts serving.
+func (s *ProxyServer) RegisterPacketInterceptor(interceptor PacketInterceptor) {
+	s.interceptors = append(s.interceptors, interceptor)
+}
+
+// interceptData runs the registered interceptors on the DATA payload of
+// pkt, and reports whether it may be forwarded. Once a payload was denied,
+// all further payloads of the connection are dropped and the agent is
+// asked to close the connection, which closes the frontend in turn.
+func (s *ProxyServer) interceptData(frontend *ProxyClientConnection, direction PacketDirection, pkt *client.Packet) bool {
+	if len(s.interceptors) == 0 {
+		return true
+	}
+	if atomic.LoadInt32(&frontend.denied) != 0 {
+		return false
+	}
+	meta := &ConnectionMetadata{
+		ConnectionID:        frontend.connectID,
+		AgentID:             frontend.agentID,
+		FrontendMode:        frontend.Mode,
+		FrontendIdentity:    frontend.identity,
+		Protocol:            frontend.protocol,
+		Destination:         frontend.address,
+		DestinationHostname: frontend.hostname,
+	}
+	for _, interceptor := range s.interceptors {
+		decision := interceptor.InterceptData(meta, direction, pkt.GetData().Data)
+		frontend.annotate(decision.Annotations)
+		if decision.Deny {
+			s.denyConnection(frontend, direction, decision.Reason)
+			return false
+		}
+	}
+	return true
+}
+
+// denyConnection closes the connection of frontend once, on behalf of an
+// interceptor denying its data.
+func (s *ProxyServer) denyConnection(frontend *ProxyClientConnection, direction PacketDirection, reason string) {
+	if !atomic.CompareAndSwapInt32(&frontend.denied, 0, 1) {
+		return
+	}
+	frontend.annotate(map[string]string{annotationDeniedReason: reason})
+	metrics.Metrics.InterceptDenialInc(string(direction))
+	klog.V(2).InfoS("Packet interceptor denied the connection", "serverID", s.serverID, "agentID", frontend.agentID, "connectionID", frontend.connectID, "direction", direction, "reason", reason)
+	if frontend.backend == nil {
+		return
+	}
+	closeReq := &client.Packet{
+		Type: client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{
+			CloseRequest: &client.CloseRequest{
+				ConnectID: frontend.connectID,
+			},
+		},
+	}
+	if err := frontend.backend.Send(closeReq); err != nil {
+		klog.ErrorS(err, "Failed to close the denied connection", "serverID", s.serverID, "agentID", frontend.agentID, "connectionID", frontend.connectID)
+	}
+}
+
+// annotationDeniedReason is the annotation recording why an interceptor
+// denied the connection.
+const annotationDeniedReason = "konnectivity.io/denied-reason"
+
+// annotate records annotations with the audit events of the connection.
+func (c *ProxyClientConnection) annotate(annotations map[string]string) {
+	if len(annotations) == 0 {
+		return
+	}
+	c.amu.Lock()
+	defer c.amu.Unlock()
+	if c.annotations == nil {
+		c.annotations = make(map[string]string, len(annotations))
+	}
+	for k, v := range annotations {
+		c.annotations[k] = v
+	}
+}
+
+// annotationsCopy returns a copy of the annotations of the connection, nil
+// if it has none.
+func (c *ProxyClientConnection) annotationsCopy() map[string]string {
+	c.amu.Lock()
+	defer c.amu.Unlock()
+	if len(c.annotations) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string, len(c.annotations))
+	for k, v := range c.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
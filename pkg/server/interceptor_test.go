@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+type interceptorFunc func(conn *ConnectionMetadata, direction PacketDirection, data []byte) InterceptDecision
+
+func (f interceptorFunc) InterceptData(conn *ConnectionMetadata, direction PacketDirection, data []byte) InterceptDecision {
+	return f(conn, direction, data)
+}
+
+type recordingBackend struct {
+	sent []*client.Packet
+}
+
+func (b *recordingBackend) Send(p *client.Packet) error {
+	b.sent = append(b.sent, p)
+	return nil
+}
+
+func (b *recordingBackend) Context() context.Context {
+	return context.Background()
+}
+
+func dataPacket(connID int64, data string) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: connID, Data: []byte(data)}},
+	}
+}
+
+func TestPacketInterceptors(t *testing.T) {
+	s := NewProxyServer("server", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	var calls int
+	s.RegisterPacketInterceptor(interceptorFunc(func(conn *ConnectionMetadata, direction PacketDirection, data []byte) InterceptDecision {
+		calls++
+		if conn.Destination != "10.0.0.1:443" || conn.ConnectionID != 7 {
+			t.Errorf("unexpected connection metadata %+v", conn)
+		}
+		return InterceptDecision{Annotations: map[string]string{"dlp/scanned": "true"}}
+	}))
+	s.RegisterPacketInterceptor(interceptorFunc(func(conn *ConnectionMetadata, direction PacketDirection, data []byte) InterceptDecision {
+		if direction == DirectionFromAgent && bytes.Contains(data, []byte("secret")) {
+			return InterceptDecision{Deny: true, Reason: "secret in response"}
+		}
+		return InterceptDecision{}
+	}))
+
+	be := &recordingBackend{}
+	frontend := &ProxyClientConnection{connectID: 7, address: "10.0.0.1:443", backend: be}
+	if !s.interceptData(frontend, DirectionToAgent, dataPacket(7, "GET / HTTP/1.1")) {
+		t.Error("expected the request to be allowed")
+	}
+	if s.interceptData(frontend, DirectionFromAgent, dataPacket(7, "the secret")) {
+		t.Error("expected the response to be denied")
+	}
+	if len(be.sent) != 1 || be.sent[0].Type != client.PacketType_CLOSE_REQ || be.sent[0].GetCloseRequest().ConnectID != 7 {
+		t.Errorf("expected a CLOSE_REQ for the denied connection, got %v", be.sent)
+	}
+	if s.interceptData(frontend, DirectionToAgent, dataPacket(7, "more")) {
+		t.Error("expected data of a denied connection to be dropped")
+	}
+	if calls != 2 {
+		t.Errorf("expected the interceptors not to run once the connection was denied, got %d calls", calls)
+	}
+	if len(be.sent) != 1 {
+		t.Errorf("expected a single CLOSE_REQ, got %v", be.sent)
+	}
+	want := map[string]string{"dlp/scanned": "true", annotationDeniedReason: "secret in response"}
+	if got := frontend.annotationsCopy(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected annotations %v, got %v", want, got)
+	}
+}
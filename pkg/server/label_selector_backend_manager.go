@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/labels"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// LabelSelectorBackendManager picks the agents whose labels match the label
+// selector sent by the frontend with the dial.
+type LabelSelectorBackendManager struct {
+	*DefaultBackendStorage
+}
+
+var _ BackendManager = &LabelSelectorBackendManager{}
+
+// NewLabelSelectorBackendManager returns a LabelSelectorBackendManager.
+func NewLabelSelectorBackendManager() *LabelSelectorBackendManager {
+	return &LabelSelectorBackendManager{
+		DefaultBackendStorage: NewDefaultBackendStorage(
+			[]pkgagent.IdentifierType{pkgagent.UID})}
+}
+
+// Backend picks a random agent whose labels match the label selector of
+// the dial. Dials without a label selector are left to the next strategy.
+func (lsbm *LabelSelectorBackendManager) Backend(ctx context.Context) (Backend, error) {
+	selector := labelSelectorFrom(ctx)
+	if selector == nil {
+		return nil, &ErrNotFound{}
+	}
+	lsbm.mu.RLock()
+	defer lsbm.mu.RUnlock()
+	var matching []string
+	for _, agentID := range lsbm.agentIDs {
+		if bes := lsbm.backends[agentID]; len(bes) > 0 && selector.Matches(bes[0].labels()) {
+			matching = append(matching, agentID)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, &ErrNotFound{}
+	}
+	agentIDs, err := lsbm.capableAgentIDs(matching, requiredCapabilitiesFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if agentIDs, err = lsbm.filterAgentIDs(agentIDs, agentFilterFrom(ctx)); err != nil {
+		return nil, err
+	}
+	agentIDs = lsbm.trackAgentIDs(agentIDs, trackFrom(ctx))
+	agentID := agentIDs[lsbm.random.Intn(len(agentIDs))]
+	util.V(util.LogBackendManager, 4).InfoS("Picked agent matching the label selector as backend", "agentID", agentID, "selector", selector.String())
+	return lsbm.backends[agentID][0], nil
+}
+
+// labels returns the labels announced by the agent when it connected.
+func (b *backend) labels() labels.Set {
+	md, ok := metadata.FromIncomingContext(b.Context())
+	if !ok {
+		return nil
+	}
+	agentLabels := md.Get(header.AgentLabels)
+	if len(agentLabels) == 0 {
+		return nil
+	}
+	set, err := pkgagent.ParseAgentLabels(agentLabels[0])
+	if err != nil {
+		util.V(util.LogBackendManager, 2).InfoS("Ignoring invalid agent labels", "labels", agentLabels[0], "err", err)
+		return nil
+	}
+	return set
+}
+
+// labelSelectorFrom returns the label selector getBackend stored in ctx,
+// nil if the dial has none.
+func labelSelectorFrom(ctx context.Context) labels.Selector {
+	selector, _ := ctx.Value(dialLabelSelector).(labels.Selector)
+	return selector
+}
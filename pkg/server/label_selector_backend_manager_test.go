@@ -0,0 +1,82 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/labels"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func newFakeLabeledConnectServer(agentLabels string) *fakeCapableConnectServer {
+	md := metadata.Pairs(header.AgentLabels, agentLabels)
+	return &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func TestLabelSelectorBackendManager(t *testing.T) {
+	east := newFakeLabeledConnectServer("zone=us-east-1a,network=mgmt")
+	west := newFakeLabeledConnectServer("zone=us-west-1a")
+	p := NewLabelSelectorBackendManager()
+	p.AddBackend("east", pkgagent.UID, east)
+	p.AddBackend("west", pkgagent.UID, west)
+	p.AddBackend("unlabeled", pkgagent.UID, newFakeCapableConnectServer(""))
+
+	if _, err := p.Backend(genContext(nil, "10.0.0.1:443", "tcp")); ignoreNotFound(err) != nil || err == nil {
+		t.Errorf("expected ErrNotFound for a dial without label selector, got %v", err)
+	}
+
+	selectorCtx := func(selector string) context.Context {
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return context.WithValue(genContext(nil, "10.0.0.1:443", "tcp"), dialLabelSelector, sel)
+	}
+	for i := 0; i < 10; i++ {
+		be, err := p.Backend(selectorCtx("zone=us-east-1a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be.(*backend).conn != east {
+			t.Fatal("expected the dial to be routed to the agent in us-east-1a")
+		}
+		if be, err = p.Backend(selectorCtx("network!=mgmt,zone")); err != nil {
+			t.Fatal(err)
+		}
+		if be.(*backend).conn != west {
+			t.Fatal("expected the dial to be routed to the agent outside the mgmt network")
+		}
+	}
+	if _, err := p.Backend(selectorCtx("zone=eu-central-1a")); ignoreNotFound(err) != nil || err == nil {
+		t.Errorf("expected ErrNotFound without matching agent, got %v", err)
+	}
+}
+
+func TestGetBackendInvalidLabelSelector(t *testing.T) {
+	s := NewProxyServer("server", []ProxyStrategy{ProxyStrategyLabelSelector, ProxyStrategyDefault}, 1, nil, false)
+	s.BackendManagers[1].AddBackend("agent", pkgagent.UID, new(fakeAgentServiceConnectServer))
+	if _, strategy, err := s.getBackend("10.0.0.1:443", "tcp", "", nil); err != nil || strategy != ProxyStrategyDefault {
+		t.Errorf("expected the default strategy to pick a backend for a dial without label selector, got %q, %v", strategy, err)
+	}
+	if _, _, err := s.getBackend("10.0.0.1:443", "tcp", "zone in (us-east-1a", nil); err == nil {
+		t.Error("expected an error for an invalid label selector")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// agentLeaseReapInterval is the interval between checks of the agent
+// Leases.
+const agentLeaseReapInterval = 10 * time.Second
+
+// AgentLeaseReaper evicts connected agents whose Lease expired more than
+// a grace period ago. The gRPC stream of an agent whose node froze can
+// stay open long after the agent stopped serving it, while its Lease is
+// no longer renewed.
+type AgentLeaseReaper struct {
+	server *ProxyServer
+	// grace is the time.Duration grace period, accessed atomically.
+	grace int64
+	list  func() ([]*coordinationv1.Lease, error)
+}
+
+// NewAgentLeaseReaper returns an AgentLeaseReaper for the agents of s,
+// watching the agent Leases in namespace. The informer backing the reaper
+// runs until stopCh is closed.
+func NewAgentLeaseReaper(s *ProxyServer, client kubernetes.Interface, namespace string, grace time.Duration, stopCh <-chan struct{}) *AgentLeaseReaper {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = pkgagent.LeaseLabel
+		}),
+	)
+	lister := factory.Coordination().V1().Leases().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	return &AgentLeaseReaper{
+		server: s,
+		grace:  int64(grace),
+		list: func() ([]*coordinationv1.Lease, error) {
+			return lister.Leases(namespace).List(labels.Everything())
+		},
+	}
+}
+
+// SetGracePeriod changes the grace period of subsequent checks.
+func (r *AgentLeaseReaper) SetGracePeriod(grace time.Duration) {
+	atomic.StoreInt64(&r.grace, int64(grace))
+}
+
+// Run periodically reaps agents until stopCh is closed.
+func (r *AgentLeaseReaper) Run(stopCh <-chan struct{}) {
+	wait.Until(func() { r.reap(time.Now()) }, agentLeaseReapInterval, stopCh)
+}
+
+// reap evicts the connected agents whose Lease expired before now minus
+// the grace period. Agents without a Lease are left alone, they may not
+// hold one.
+func (r *AgentLeaseReaper) reap(now time.Time) {
+	leases, err := r.list()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list agent leases")
+		return
+	}
+	expiries := make(map[string]time.Time)
+	for _, lease := range leases {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if expiry.After(expiries[*lease.Spec.HolderIdentity]) {
+			expiries[*lease.Spec.HolderIdentity] = expiry
+		}
+	}
+	grace := time.Duration(atomic.LoadInt64(&r.grace))
+	for _, agentID := range r.server.connectedAgents() {
+		expiry, ok := expiries[agentID]
+		if !ok || now.Before(expiry.Add(grace)) {
+			continue
+		}
+		count := r.server.EvictAgent(agentID, metrics.EvictionLeaseExpired)
+		klog.InfoS("Evicted agent with expired lease", "agentID", agentID, "expiry", expiry, "streams", count)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func TestAgentLeaseReaper(t *testing.T) {
+	now := time.Now()
+	lease := func(agentID string, renewed time.Time) *coordinationv1.Lease {
+		duration := int32(40)
+		renewTime := metav1.NewMicroTime(renewed)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "konnectivity-agent-" + agentID,
+				Namespace: "kube-system",
+				Labels:    map[string]string{pkgagent.LeaseLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &agentID,
+				RenewTime:            &renewTime,
+				LeaseDurationSeconds: &duration,
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		lease("alive", now),
+		// Expired, but still within the grace period.
+		lease("late", now.Add(-time.Minute)),
+		lease("frozen", now.Add(-5*time.Minute)),
+	)
+
+	s := NewProxyServer("", []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{}, false)
+	evictChs := make(map[string]<-chan struct{})
+	for _, agentID := range []string{"alive", "late", "frozen", "leaseless"} {
+		evictChs[agentID] = s.trackAgentStream(agentID, new(fakeAgentServiceConnectServer))
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := NewAgentLeaseReaper(s, client, "kube-system", time.Minute, stopCh)
+	r.reap(now)
+
+	for agentID, evictCh := range evictChs {
+		var evicted bool
+		select {
+		case <-evictCh:
+			evicted = true
+		default:
+		}
+		if expected := agentID == "frozen"; evicted != expected {
+			t.Errorf("expected agent %q evicted %v, got %v", agentID, expected, evicted)
+		}
+	}
+	if got := len(s.connectedAgents()); got != 3 {
+		t.Errorf("expected 3 connected agents, got %d", got)
+	}
+}
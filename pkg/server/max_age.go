@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"math/rand"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// drainPollInterval is how often a draining agent stream checks whether
+// its connections closed.
+const drainPollInterval = time.Second
+
+// AgentConnectionAgeConfig bounds the lifetime of the Connect streams of
+// the agents, so that agents periodically authenticate again and the load
+// balancer in front of the proxy servers can rebalance them.
+//
+// Once a stream reached its age, the proxy server stops routing dials
+// through it. The connections of a resumable session migrate to the stream
+// of the agent reconnecting and resuming the session, the stream ends
+// right away. Otherwise the stream ends once its connections closed, or
+// after DrainTimeout.
+type AgentConnectionAgeConfig struct {
+	// MaxAge is the maximum age of a stream, 0 leaves it unbounded.
+	MaxAge time.Duration
+	// Jitter is the fraction of MaxAge by which the age of each stream is
+	// randomly shortened, so that the streams established together, e.g.
+	// after a proxy server restart, are not cycled together.
+	Jitter float64
+	// DrainTimeout bounds how long the connections of a stream which is
+	// not resumable are waited for. 0 waits until they closed.
+	DrainTimeout time.Duration
+}
+
+// lifetime returns the jittered age of a new stream, 0 if unbounded.
+func (c AgentConnectionAgeConfig) lifetime() time.Duration {
+	if c.MaxAge <= 0 {
+		return 0
+	}
+	jitter := time.Duration(rand.Float64() * c.Jitter * float64(c.MaxAge)) /* #nosec G404 */
+	return c.MaxAge - jitter
+}
+
+// drainSession stops routing dials through the session and waits until
+// its connections closed, the stream ended or the drain timeout elapsed.
+func (s *ProxyServer) drainSession(session *agentSession, stopCh <-chan error) {
+	s.removeBackend(session.agentID, session.stream)
+	var timeout <-chan time.Time
+	if s.AgentConnectionAge.DrainTimeout > 0 {
+		timer := time.NewTimer(s.AgentConnectionAge.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for !s.sessionDrained(session) {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			klog.V(2).InfoS("Timed out draining agent stream", "agentID", session.agentID, "serverID", s.serverID, "connections", len(s.sessionFrontends(session)))
+			return
+		case <-stopCh:
+			return
+		case <-session.evictCh:
+			return
+		}
+	}
+}
+
+// sessionDrained reports whether the session has neither pending dials
+// nor connections.
+func (s *ProxyServer) sessionDrained(session *agentSession) bool {
+	if len(s.sessionFrontends(session)) > 0 {
+		return false
+	}
+	for _, frontend := range s.PendingDial.list() {
+		if frontend.backend == session.backend {
+			return false
+		}
+	}
+	return true
+}
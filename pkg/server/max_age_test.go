@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestAgentConnectionLifetime(t *testing.T) {
+	if lifetime := (AgentConnectionAgeConfig{}).lifetime(); lifetime != 0 {
+		t.Errorf("expected no lifetime without max age, got %v", lifetime)
+	}
+	config := AgentConnectionAgeConfig{MaxAge: time.Hour, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		if lifetime := config.lifetime(); lifetime > time.Hour || lifetime < 45*time.Minute {
+			t.Fatalf("expected a lifetime between 45m and 1h, got %v", lifetime)
+		}
+	}
+}
+
+func newDrainTestSession(p *ProxyServer) *agentSession {
+	conn := newFakeAgentConnectServer("agent1")
+	be := p.addBackend("agent1", conn)
+	p.addFrontend("agent1", 1, &ProxyClientConnection{Mode: "grpc", backend: be, agentID: "agent1", connectID: 1})
+	return &agentSession{agentID: "agent1", stream: conn, backend: be}
+}
+
+func TestDrainSessionWaitsForConnections(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	session := newDrainTestSession(p)
+
+	done := make(chan struct{})
+	go func() {
+		p.drainSession(session, make(chan error))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if n := p.BackendManagers[0].NumBackends(); n != 0 {
+		t.Errorf("expected no dials to be routed through the draining stream, got %d backends", n)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected the drain to wait for the connection")
+	default:
+	}
+
+	p.removeFrontend("agent1", 1)
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected the drain to end once the connection closed")
+	}
+}
+
+func TestDrainSessionTimeout(t *testing.T) {
+	p := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	p.AgentConnectionAge.DrainTimeout = 10 * time.Millisecond
+	session := newDrainTestSession(p)
+
+	done := make(chan struct{})
+	go func() {
+		p.drainSession(session, make(chan error))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected the drain to time out")
+	}
+}
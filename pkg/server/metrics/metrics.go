@@ -17,6 +17,9 @@ limitations under the License.
 package metrics
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,6 +34,85 @@ const (
 
 	// Connect is the AgentService method used to establish next hop.
 	Connect = "Connect"
+
+	// Forward is the AgentService method tunneling the connections of
+	// agent port-forward listeners.
+	Forward = "Forward"
+
+	// AgentIDOther is the agent_id label value of agents beyond the
+	// agent ID label limit.
+	AgentIDOther = "other"
+
+	// HandshakeFull, HandshakeResumed, HandshakeFailed and
+	// HandshakeRejected are the result label values of agent TLS
+	// handshakes.
+	HandshakeFull     = "full"
+	HandshakeResumed  = "resumed"
+	HandshakeFailed   = "failed"
+	HandshakeRejected = "rejected"
+
+	// EvictionLeaseExpired is the reason label value of agent connections
+	// evicted because the agent's Lease expired.
+	EvictionLeaseExpired = "lease_expired"
+	// EvictionSendFailure is the reason label value of agent connections
+	// ended because packets could not be sent to them.
+	EvictionSendFailure = "send_failure"
+	// EvictionMaxAge is the reason label value of agent connections ended
+	// because they reached their maximum age.
+	EvictionMaxAge = "max_age"
+
+	// SessionResumed and SessionExpired are the result label values of
+	// broken agent sessions, resumed by the agent or expired.
+	SessionResumed = "resumed"
+	SessionExpired = "expired"
+
+	// MigrationMigrated and MigrationFailed are the result label values
+	// of connections migrated to another agent when theirs disconnected.
+	MigrationMigrated = "migrated"
+	MigrationFailed   = "failed"
+
+	// ResolutionCached, ResolutionResolved and ResolutionFailed are the
+	// result label values of the resolutions of the destination hostnames
+	// of the destHost strategies, answered from the cache, resolved or
+	// failed.
+	ResolutionCached   = "cached"
+	ResolutionResolved = "resolved"
+	ResolutionFailed   = "failed"
+
+	// SpilloverUtilization and SpilloverUnavailable are the reason label
+	// values of the dials spilled over to agents outside the zone of the
+	// server, because its agents were utilized beyond the spillover
+	// threshold or none was available.
+	SpilloverUtilization = "utilization"
+	SpilloverUnavailable = "unavailable"
+
+	// ConnPendingDial and ConnEstablished are the state label values of
+	// the connection table entries, pending dials and established
+	// frontend connections.
+	ConnPendingDial = "pending_dial"
+	ConnEstablished = "established"
+
+	// ConnIdleTimeout and ConnMaxLifetime are the reason label values of
+	// the established connections closed by the connection janitor.
+	ConnIdleTimeout = "idle_timeout"
+	ConnMaxLifetime = "max_lifetime"
+
+	// BreakerOpen and BreakerHalfOpen are the state label values of the
+	// circuit breakers of agents. Agents with closed breakers are not
+	// reported.
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+
+	// QueueMemory and QueueDisk are the location label values of the
+	// packets queued to frontends, in memory or spilled to disk.
+	QueueMemory = "memory"
+	QueueDisk   = "disk"
+
+	// ConnectHeaderBytes and ConnectHeaderCount are the reason label
+	// values of the HTTP CONNECT requests rejected because their headers
+	// were too large or too many.
+	ConnectHeaderBytes = "header_bytes"
+	ConnectHeaderCount = "header_count"
 )
 
 var (
@@ -49,6 +131,45 @@ type ServerMetrics struct {
 	httpConnections   prometheus.Gauge
 	backend           *prometheus.GaugeVec
 	pendingDials      *prometheus.GaugeVec
+	e2eLatencies      *prometheus.HistogramVec
+	dialPhases        *prometheus.HistogramVec
+	dialBudgets       *prometheus.HistogramVec
+	handshakes        *prometheus.HistogramVec
+	handshakesWaiting prometheus.Gauge
+	agentEvictions    *prometheus.CounterVec
+	canaryDials       *prometheus.HistogramVec
+	interceptDenials  *prometheus.CounterVec
+	agentNacks        *prometheus.CounterVec
+	sendRetries       prometheus.Counter
+	bandwidthThrottle *prometheus.CounterVec
+	dataCheckpoints   *prometheus.CounterVec
+	sessions          *prometheus.CounterVec
+	migrations        *prometheus.CounterVec
+	resolutions       *prometheus.CounterVec
+	zoneSpillovers    *prometheus.CounterVec
+	zoneUtilization   prometheus.Gauge
+	sequenceGaps      prometheus.Counter
+	scaleHints        *prometheus.GaugeVec
+	connTable         *prometheus.GaugeVec
+	connsReaped       *prometheus.CounterVec
+	connsExpired      *prometheus.CounterVec
+	breakers          *prometheus.GaugeVec
+	breakerTrips      *prometheus.CounterVec
+	anomalies         prometheus.Counter
+	buildInfo         *prometheus.GaugeVec
+	sendQueued        *prometheus.GaugeVec
+	sendOverflows     *prometheus.CounterVec
+	auditQueued       prometheus.Gauge
+	auditDropped      prometheus.Counter
+	connectHeaders    prometheus.Histogram
+	connectRejected   *prometheus.CounterVec
+
+	// amu protects the following.
+	amu sync.Mutex
+	// agentIDLabelLimit is the number of distinct agent IDs used as
+	// agent_id label values. 0 leaves the label empty.
+	agentIDLabelLimit int
+	agentIDLabels     map[string]bool
 }
 
 // newServerMetrics create a new ServerMetrics, configured with default metric names.
@@ -111,12 +232,416 @@ func newServerMetrics() *ServerMetrics {
 		[]string{},
 	)
 
+	e2eLatencies := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dial_e2e_duration_seconds",
+			Help:      "Latency from receiving a DIAL_REQ from the frontend to delivering the DIAL_RSP to it in seconds, partitioned by agent, proxy strategy and error category.",
+			Buckets:   latencyBuckets,
+		},
+		[]string{
+			"agent_id",
+			"strategy",
+			"error_category",
+		},
+	)
+	dialPhases := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dial_phase_duration_seconds",
+			Help:      "Latency of each phase of a dial in seconds: backend_selection, agent_send, agent (until the agent's DIAL_RSP) and frontend_notify.",
+			Buckets:   latencyBuckets,
+		},
+		[]string{
+			"phase",
+		},
+	)
+	dialBudgets := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dial_budget_spent_seconds",
+			Help:      "Cumulative time spent dialing across the attempts of frontends re-dialing with the same budget token in seconds, partitioned by attempt and result.",
+			Buckets:   latencyBuckets,
+		},
+		[]string{
+			"attempt",
+			"result",
+		},
+	)
+	handshakes := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "agent_tls_handshake_duration_seconds",
+			Help:      "Latency of TLS handshakes of agent connections in seconds, including the time spent waiting for the handshake budget, partitioned by result: full, resumed, failed or rejected for exceeding the budget.",
+			Buckets:   latencyBuckets,
+		},
+		[]string{
+			"result",
+		},
+	)
+	handshakesWaiting := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "agent_tls_handshakes_waiting",
+			Help:      "Number of agent TLS handshakes waiting for the handshake budget",
+		},
+	)
+
+	agentEvictions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "agent_evictions_total",
+			Help:      "Number of agent connections evicted by the proxy server, by reason",
+		},
+		[]string{
+			"reason",
+		},
+	)
+
+	canaryDials := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "canary_dial_duration_seconds",
+			Help:      "End-to-end latency of dials routed while canary routing is enabled, by track (canary or stable) of the agent and error category",
+			Buckets:   latencyBuckets,
+		},
+		[]string{
+			"track",
+			"error_category",
+		},
+	)
+
+	interceptDenials := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "intercepted_connection_denials_total",
+			Help:      "Number of connections closed because a packet interceptor denied their data, by direction (to_agent or from_agent) of the denied data",
+		},
+		[]string{
+			"direction",
+		},
+	)
+
+	agentNacks := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "agent_nacks_total",
+			Help:      "Number of packets agents answered with NACK as they do not support their type, by packet type",
+		},
+		[]string{
+			"packet_type",
+		},
+	)
+
+	sendRetries := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backend_send_retries_total",
+			Help:      "Number of packets the proxy server retried sending to an agent after a transient failure",
+		},
+	)
+
+	bandwidthThrottle := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "bandwidth_throttled_seconds_total",
+			Help:      "Total time DATA packets were delayed by the bandwidth limits, by direction (to_agent or from_agent)",
+		},
+		[]string{
+			"direction",
+		},
+	)
+
+	dataCheckpoints := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "data_checkpoints_total",
+			Help:      "Number of byte-count checkpoints received from agents, by whether the bytes received on the connection matched (match or mismatch)",
+		},
+		[]string{
+			"result",
+		},
+	)
+
+	sessions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "agent_session_resumptions_total",
+			Help:      "Number of broken agent sessions, by result (resumed or expired)",
+		},
+		[]string{
+			"result",
+		},
+	)
+
+	migrations := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connection_migrations_total",
+			Help:      "Number of connections migrated to another agent after theirs disconnected, by result (migrated or failed)",
+		},
+		[]string{
+			"result",
+		},
+	)
+
+	resolutions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dest_host_resolutions_total",
+			Help:      "Number of resolutions of destination hostnames for the destHost strategies, by result (cached, resolved or failed)",
+		},
+		[]string{
+			"result",
+		},
+	)
+
+	zoneSpillovers := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "zone_spillover_dials_total",
+			Help:      "Number of dials routed through agents outside the zone of the server with zone affinity, by reason (utilization or unavailable)",
+		},
+		[]string{
+			"reason",
+		},
+	)
+
+	zoneUtilization := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "zone_utilization",
+			Help:      "Share of the connection capacity of the agents in the zone of the server used by their connections, as of the last dial with zone affinity",
+		},
+	)
+
+	auditQueued := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_queue_bytes",
+			Help:      "Bytes of audit events queued on disk while the audit log could not be written",
+		},
+	)
+
+	auditDropped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_events_dropped_total",
+			Help:      "Number of audit events dropped because neither the audit log nor the audit queue could take them",
+		},
+	)
+
+	connectHeaders := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "http_connect_header_bytes",
+			Help:      "Size in bytes of the request headers of HTTP CONNECT requests",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 7),
+		},
+	)
+
+	connectRejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "http_connect_rejected_total",
+			Help:      "Number of HTTP CONNECT requests rejected because of their request headers, by reason (header_bytes or header_count)",
+		},
+		[]string{
+			"reason",
+		},
+	)
+
+	sequenceGaps := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "data_sequence_gaps_total",
+			Help:      "Number of gaps in the sequence numbers of DATA received from agents, i.e. DATA lost on the way and requested again",
+		},
+	)
+
+	scaleHints := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "scale_hints",
+			Help:      "Load figures of the proxy server replica for autoscalers, by hint: active_connections, pending_dials, cpu_utilization or load, the highest ratio of the figures to their targets",
+		},
+		[]string{
+			"hint",
+		},
+	)
+
+	connTable := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connection_table_entries",
+			Help:      "Number of pending dials and established connections by agent, refreshed by the connection janitor",
+		},
+		[]string{
+			"state",
+			"agent_id",
+		},
+	)
+
+	connsReaped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connection_table_reaped_total",
+			Help:      "Number of pending dials and established connections reaped by the connection janitor after being idle beyond the TTL",
+		},
+		[]string{
+			"state",
+		},
+	)
+
+	connsExpired := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connections_expired_total",
+			Help:      "Number of established connections closed by the connection janitor after going without DATA for the idle timeout or exceeding the maximum lifetime",
+		},
+		[]string{
+			"reason",
+		},
+	)
+
+	breakers := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_breakers",
+			Help:      "Number of agents whose circuit breaker is open, i.e. which are skipped by the backend selection, or half-open after the cooldown",
+		},
+		[]string{
+			"state",
+		},
+	)
+
+	breakerTrips := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_breaker_trips_total",
+			Help:      "Number of times the circuit breaker of an agent tripped after consecutive dial failures",
+		},
+		[]string{
+			"agent_id",
+		},
+	)
+
+	anomalies := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "destination_anomalies_total",
+			Help:      "Number of times a frontend identity dialed an unusual number of destinations it never dialed before",
+		},
+	)
+
+	sendQueued := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "send_queue_packets",
+			Help:      "Number of packets queued to be sent to frontends, by location (memory or disk)",
+		},
+		[]string{
+			"location",
+		},
+	)
+
+	sendOverflows := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "send_queue_overflows_total",
+			Help:      "Number of times the send queue of a frontend connection was full, by overflow policy",
+		},
+		[]string{
+			"policy",
+		},
+	)
+
+	// buildInfo shares its name with the build info of the agent, told
+	// apart by the component label.
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "konnectivity_build_info",
+			Help:        "Build of the running binary and the protocol it speaks, always 1",
+			ConstLabels: prometheus.Labels{"component": subsystem},
+		},
+		[]string{
+			"version",
+			"git_commit",
+			"go_version",
+			"protocol_version",
+			"capabilities",
+		},
+	)
+
 	prometheus.MustRegister(latencies)
 	prometheus.MustRegister(frontendLatencies)
 	prometheus.MustRegister(connections)
 	prometheus.MustRegister(httpConnections)
 	prometheus.MustRegister(backend)
 	prometheus.MustRegister(pendingDials)
+	prometheus.MustRegister(e2eLatencies)
+	prometheus.MustRegister(dialPhases)
+	prometheus.MustRegister(dialBudgets)
+	prometheus.MustRegister(handshakes)
+	prometheus.MustRegister(handshakesWaiting)
+	prometheus.MustRegister(agentEvictions)
+	prometheus.MustRegister(canaryDials)
+	prometheus.MustRegister(interceptDenials)
+	prometheus.MustRegister(agentNacks)
+	prometheus.MustRegister(sendRetries)
+	prometheus.MustRegister(bandwidthThrottle)
+	prometheus.MustRegister(dataCheckpoints)
+	prometheus.MustRegister(sessions)
+	prometheus.MustRegister(migrations)
+	prometheus.MustRegister(resolutions)
+	prometheus.MustRegister(zoneSpillovers)
+	prometheus.MustRegister(zoneUtilization)
+	prometheus.MustRegister(sequenceGaps)
+	prometheus.MustRegister(scaleHints)
+	prometheus.MustRegister(connTable)
+	prometheus.MustRegister(connsReaped)
+	prometheus.MustRegister(connsExpired)
+	prometheus.MustRegister(breakers)
+	prometheus.MustRegister(breakerTrips)
+	prometheus.MustRegister(anomalies)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(sendQueued)
+	prometheus.MustRegister(sendOverflows)
+	prometheus.MustRegister(auditQueued)
+	prometheus.MustRegister(auditDropped)
+	prometheus.MustRegister(connectHeaders)
+	prometheus.MustRegister(connectRejected)
 	return &ServerMetrics{
 		latencies:         latencies,
 		frontendLatencies: frontendLatencies,
@@ -124,6 +649,39 @@ func newServerMetrics() *ServerMetrics {
 		httpConnections:   httpConnections,
 		backend:           backend,
 		pendingDials:      pendingDials,
+		e2eLatencies:      e2eLatencies,
+		dialPhases:        dialPhases,
+		dialBudgets:       dialBudgets,
+		handshakes:        handshakes,
+		handshakesWaiting: handshakesWaiting,
+		agentEvictions:    agentEvictions,
+		canaryDials:       canaryDials,
+		interceptDenials:  interceptDenials,
+		agentNacks:        agentNacks,
+		sendRetries:       sendRetries,
+		bandwidthThrottle: bandwidthThrottle,
+		dataCheckpoints:   dataCheckpoints,
+		sessions:          sessions,
+		migrations:        migrations,
+		resolutions:       resolutions,
+		zoneSpillovers:    zoneSpillovers,
+		zoneUtilization:   zoneUtilization,
+		sequenceGaps:      sequenceGaps,
+		scaleHints:        scaleHints,
+		connTable:         connTable,
+		connsReaped:       connsReaped,
+		connsExpired:      connsExpired,
+		breakers:          breakers,
+		breakerTrips:      breakerTrips,
+		anomalies:         anomalies,
+		buildInfo:         buildInfo,
+		sendQueued:        sendQueued,
+		sendOverflows:     sendOverflows,
+		auditQueued:       auditQueued,
+		auditDropped:      auditDropped,
+		connectHeaders:    connectHeaders,
+		connectRejected:   connectRejected,
+		agentIDLabels:     make(map[string]bool),
 	}
 }
 
@@ -131,6 +689,29 @@ func newServerMetrics() *ServerMetrics {
 func (a *ServerMetrics) Reset() {
 	a.latencies.Reset()
 	a.frontendLatencies.Reset()
+	a.e2eLatencies.Reset()
+	a.dialPhases.Reset()
+	a.dialBudgets.Reset()
+	a.handshakes.Reset()
+	a.agentEvictions.Reset()
+	a.canaryDials.Reset()
+	a.interceptDenials.Reset()
+	a.agentNacks.Reset()
+	a.bandwidthThrottle.Reset()
+	a.dataCheckpoints.Reset()
+	a.sessions.Reset()
+	a.migrations.Reset()
+	a.resolutions.Reset()
+	a.zoneSpillovers.Reset()
+	a.scaleHints.Reset()
+	a.connTable.Reset()
+	a.connsReaped.Reset()
+	a.connsExpired.Reset()
+	a.breakers.Reset()
+	a.breakerTrips.Reset()
+	a.sendQueued.Reset()
+	a.sendOverflows.Reset()
+	a.connectRejected.Reset()
 }
 
 // ObserveDialLatency records the latency of dial to the remote endpoint.
@@ -138,6 +719,184 @@ func (a *ServerMetrics) ObserveDialLatency(elapsed time.Duration) {
 	a.latencies.WithLabelValues().Observe(elapsed.Seconds())
 }
 
+// SetAgentIDLabelLimit sets the number of distinct agent IDs used as
+// agent_id label values. Agents seen after the limit is reached are
+// reported as AgentIDOther. 0 leaves the label empty.
+func (a *ServerMetrics) SetAgentIDLabelLimit(limit int) {
+	a.amu.Lock()
+	defer a.amu.Unlock()
+	a.agentIDLabelLimit = limit
+}
+
+func (a *ServerMetrics) agentIDLabel(agentID string) string {
+	a.amu.Lock()
+	defer a.amu.Unlock()
+	if a.agentIDLabelLimit == 0 || agentID == "" {
+		return ""
+	}
+	if a.agentIDLabels[agentID] {
+		return agentID
+	}
+	if len(a.agentIDLabels) < a.agentIDLabelLimit {
+		a.agentIDLabels[agentID] = true
+		return agentID
+	}
+	return AgentIDOther
+}
+
+// ObserveDialE2ELatency records the latency from receiving a DIAL_REQ to
+// delivering its DIAL_RSP. agentID is empty if no agent was picked.
+func (a *ServerMetrics) ObserveDialE2ELatency(elapsed time.Duration, agentID, strategy, errorCategory string) {
+	a.e2eLatencies.With(prometheus.Labels{
+		"agent_id":       a.agentIDLabel(agentID),
+		"strategy":       strategy,
+		"error_category": errorCategory,
+	}).Observe(elapsed.Seconds())
+}
+
+// ObserveDialPhase records the latency of a phase of a dial.
+func (a *ServerMetrics) ObserveDialPhase(phase string, elapsed time.Duration) {
+	a.dialPhases.WithLabelValues(phase).Observe(elapsed.Seconds())
+}
+
+// ObserveCanaryDial records the end-to-end latency of a dial routed while
+// canary routing is enabled, separated by the track of the agent.
+func (a *ServerMetrics) ObserveCanaryDial(elapsed time.Duration, track, errorCategory string) {
+	a.canaryDials.With(prometheus.Labels{
+		"track":          track,
+		"error_category": errorCategory,
+	}).Observe(elapsed.Seconds())
+}
+
+// ObserveDialBudget records the cumulative time spent by the attempts of a
+// dial budget so far. Attempts from the fifth on share the "5+" label.
+func (a *ServerMetrics) ObserveDialBudget(spent time.Duration, attempt int, success bool) {
+	attemptLabel := strconv.Itoa(attempt)
+	if attempt >= 5 {
+		attemptLabel = "5+"
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	a.dialBudgets.With(prometheus.Labels{
+		"attempt": attemptLabel,
+		"result":  result,
+	}).Observe(spent.Seconds())
+}
+
+// ObserveAgentHandshake records the latency and result of an agent TLS
+// handshake.
+func (a *ServerMetrics) ObserveAgentHandshake(elapsed time.Duration, result string) {
+	a.handshakes.WithLabelValues(result).Observe(elapsed.Seconds())
+}
+
+// HandshakeWaitingInc increments the number of agent TLS handshakes
+// waiting for the handshake budget.
+func (a *ServerMetrics) HandshakeWaitingInc() { a.handshakesWaiting.Inc() }
+
+// HandshakeWaitingDec decrements the number of agent TLS handshakes
+// waiting for the handshake budget.
+func (a *ServerMetrics) HandshakeWaitingDec() { a.handshakesWaiting.Dec() }
+
+// AgentEvictionInc increments the number of agent connections evicted
+// for reason.
+func (a *ServerMetrics) AgentEvictionInc(reason string) {
+	a.agentEvictions.WithLabelValues(reason).Inc()
+}
+
+// SessionResumptionInc increments the number of broken agent sessions
+// with result.
+func (a *ServerMetrics) SessionResumptionInc(result string) {
+	a.sessions.WithLabelValues(result).Inc()
+}
+
+// ConnectionMigrationInc increments the number of connections migrated to
+// another agent with result.
+func (a *ServerMetrics) ConnectionMigrationInc(result string) {
+	a.migrations.WithLabelValues(result).Inc()
+}
+
+// DestHostResolutionInc increments the number of resolutions of
+// destination hostnames with result.
+func (a *ServerMetrics) DestHostResolutionInc(result string) {
+	a.resolutions.WithLabelValues(result).Inc()
+}
+
+// ZoneSpilloverInc increments the number of dials spilled over to another
+// zone for reason.
+func (a *ServerMetrics) ZoneSpilloverInc(reason string) {
+	a.zoneSpillovers.WithLabelValues(reason).Inc()
+}
+
+// SetZoneUtilization sets the utilization of the agents in the zone of
+// the server.
+func (a *ServerMetrics) SetZoneUtilization(utilization float64) {
+	a.zoneUtilization.Set(utilization)
+}
+
+// SetAuditQueueBytes sets the bytes of audit events queued on disk.
+func (a *ServerMetrics) SetAuditQueueBytes(bytes int64) {
+	a.auditQueued.Set(float64(bytes))
+}
+
+// AuditEventDroppedInc increments the number of audit events dropped.
+func (a *ServerMetrics) AuditEventDroppedInc() {
+	a.auditDropped.Inc()
+}
+
+// ObserveConnectHeaders records the size in bytes of the request headers
+// of an HTTP CONNECT request.
+func (a *ServerMetrics) ObserveConnectHeaders(bytes int) {
+	a.connectHeaders.Observe(float64(bytes))
+}
+
+// ConnectRejectedInc increments the number of HTTP CONNECT requests
+// rejected for the given reason.
+func (a *ServerMetrics) ConnectRejectedInc(reason string) {
+	a.connectRejected.WithLabelValues(reason).Inc()
+}
+
+// DataSequenceGapInc increments the number of gaps detected in the DATA
+// received from agents.
+func (a *ServerMetrics) DataSequenceGapInc() {
+	a.sequenceGaps.Inc()
+}
+
+// InterceptDenialInc increments the number of connections closed because
+// a packet interceptor denied their data sent in direction.
+func (a *ServerMetrics) InterceptDenialInc(direction string) {
+	a.interceptDenials.WithLabelValues(direction).Inc()
+}
+
+// AgentNackInc increments the number of packets of packetType agents
+// answered with NACK.
+func (a *ServerMetrics) AgentNackInc(packetType string) {
+	a.agentNacks.WithLabelValues(packetType).Inc()
+}
+
+// SendRetryInc increments the number of packets retried to be sent to an
+// agent.
+func (a *ServerMetrics) SendRetryInc() {
+	a.sendRetries.Inc()
+}
+
+// ObserveBandwidthThrottle records a delay of DATA sent in direction by the
+// bandwidth limits.
+func (a *ServerMetrics) ObserveBandwidthThrottle(direction string, delay time.Duration) {
+	a.bandwidthThrottle.WithLabelValues(direction).Add(delay.Seconds())
+}
+
+// ObserveDataCheckpoint records a byte-count checkpoint received from an
+// agent, and whether it matched the bytes received.
+func (a *ServerMetrics) ObserveDataCheckpoint(match bool) {
+	result := "match"
+	if !match {
+		result = "mismatch"
+	}
+	a.dataCheckpoints.WithLabelValues(result).Inc()
+}
+
 // ObserveFrontendWriteLatency records the latency of dial to the remote endpoint.
 func (a *ServerMetrics) ObserveFrontendWriteLatency(elapsed time.Duration) {
 	a.frontendLatencies.WithLabelValues().Observe(elapsed.Seconds())
@@ -164,7 +923,80 @@ func (a *ServerMetrics) SetBackendCount(count int) {
 	a.backend.WithLabelValues().Set(float64(count))
 }
 
+// SetScaleHints sets the load figures served to autoscalers.
+func (a *ServerMetrics) SetScaleHints(activeConnections, pendingDials int, cpuUtilization, load float64) {
+	a.scaleHints.WithLabelValues("active_connections").Set(float64(activeConnections))
+	a.scaleHints.WithLabelValues("pending_dials").Set(float64(pendingDials))
+	a.scaleHints.WithLabelValues("cpu_utilization").Set(cpuUtilization)
+	a.scaleHints.WithLabelValues("load").Set(load)
+}
+
 // SetPendingDialCount sets the number of pending dials.
 func (a *ServerMetrics) SetPendingDialCount(count int) {
 	a.pendingDials.WithLabelValues().Set(float64(count))
 }
+
+// SetConnectionTableCounts sets the number of pending dials and of
+// established connections by agent ID.
+func (a *ServerMetrics) SetConnectionTableCounts(pending, established map[string]int) {
+	a.connTable.Reset()
+	for state, counts := range map[string]map[string]int{ConnPendingDial: pending, ConnEstablished: established} {
+		labels := make(map[string]int)
+		for agentID, count := range counts {
+			labels[a.agentIDLabel(agentID)] += count
+		}
+		for agentID, count := range labels {
+			a.connTable.WithLabelValues(state, agentID).Set(float64(count))
+		}
+	}
+}
+
+// ConnectionReapedInc increments the number of connection table entries
+// in state reaped by the connection janitor.
+func (a *ServerMetrics) ConnectionReapedInc(state string) {
+	a.connsReaped.WithLabelValues(state).Inc()
+}
+
+// ConnectionExpiredInc increments the number of established connections
+// closed by the connection janitor for reason.
+func (a *ServerMetrics) ConnectionExpiredInc(reason string) {
+	a.connsExpired.WithLabelValues(reason).Inc()
+}
+
+// SetCircuitBreakerCounts sets the number of agents whose circuit breaker
+// is open and half-open.
+func (a *ServerMetrics) SetCircuitBreakerCounts(open, halfOpen int) {
+	a.breakers.WithLabelValues(BreakerOpen).Set(float64(open))
+	a.breakers.WithLabelValues(BreakerHalfOpen).Set(float64(halfOpen))
+}
+
+// CircuitBreakerTripInc increments the number of trips of the circuit
+// breaker of the agent.
+func (a *ServerMetrics) CircuitBreakerTripInc(agentID string) {
+	a.breakerTrips.WithLabelValues(a.agentIDLabel(agentID)).Inc()
+}
+
+// DestinationAnomalyInc increments the number of anomalies detected in the
+// destinations dialed by frontends.
+func (a *ServerMetrics) DestinationAnomalyInc() {
+	a.anomalies.Inc()
+}
+
+// SetBuildInfo records the build of the server, the highest version of
+// the agent protocol it speaks and the features it supports.
+func (a *ServerMetrics) SetBuildInfo(version, gitCommit, goVersion string, protocolVersion int, features []string) {
+	a.buildInfo.Reset()
+	a.buildInfo.WithLabelValues(version, gitCommit, goVersion, strconv.Itoa(protocolVersion), strings.Join(features, ",")).Set(1)
+}
+
+// AddSendQueuePackets adds delta to the number of packets queued to
+// frontends at location.
+func (a *ServerMetrics) AddSendQueuePackets(location string, delta int) {
+	a.sendQueued.WithLabelValues(location).Add(float64(delta))
+}
+
+// SendQueueOverflowInc increments the number of send queues found full,
+// handled by policy.
+func (a *ServerMetrics) SendQueueOverflowInc(policy string) {
+	a.sendOverflows.WithLabelValues(policy).Inc()
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// migrationRetryInterval is how often a migrating connection looks for an
+// agent to migrate to.
+const migrationRetryInterval = 250 * time.Millisecond
+
+var errMigrationClosed = errors.New("connection closed while migrating")
+
+// MigrationConfig configures the migration of connections whose agent
+// disconnected, e.g. when the agent of a node is replaced during an
+// upgrade. The destination is dialed again through another agent of this
+// server able to serve it, which resumes the connection: it keeps the
+// connectID known to the frontend and counts the DATA from the byte offsets
+// of the connection. Only connections whose frontend set the migratable
+// dial metadata are migrated; DATA in flight to the disconnected agent is
+// lost.
+type MigrationConfig struct {
+	// Timeout is how long a migratable connection waits for an agent to
+	// migrate to once its agent disconnected. 0 disables migration.
+	Timeout time.Duration
+}
+
+// connectionMigration is a connection waiting for the DIAL_RSP of its
+// resumed dial.
+type connectionMigration struct {
+	frontend *ProxyClientConnection
+	result   chan error
+}
+
+// prepareMigration keeps a copy of the dial request of a migratable
+// connection, to dial it again if its agent disconnects.
+func (s *ProxyServer) prepareMigration(dialReq *client.DialRequest, frontend *ProxyClientConnection) {
+	if s.Migration.Timeout <= 0 || dialReq.Metadata[header.DialMigratable] != "true" {
+		return
+	}
+	frontend.migrationDial = proto.Clone(dialReq).(*client.DialRequest)
+}
+
+// currentBackend returns the backend of the connection, waiting for a
+// migration in progress to end.
+func (c *ProxyClientConnection) currentBackend() Backend {
+	c.mmu.Lock()
+	migrating := c.migrating
+	c.mmu.Unlock()
+	if migrating != nil {
+		<-migrating
+	}
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+	return c.backend
+}
+
+// startMigration migrates the frontend connected through agentID, whose
+// backend disconnected, to another agent in the background. It returns
+// false if the connection is not migratable.
+func (s *ProxyServer) startMigration(agentID string, disconnected Backend, frontend *ProxyClientConnection) bool {
+	if s.Migration.Timeout <= 0 || frontend.migrationDial == nil {
+		return false
+	}
+	frontend.mmu.Lock()
+	frontend.migrating = make(chan struct{})
+	frontend.mmu.Unlock()
+	go func() {
+		newAgentID, err := s.migrate(disconnected, frontend)
+		if err != nil {
+			klog.V(2).InfoS("Failed to migrate connection, closing it", "serverID", s.serverID, "agentID", agentID, "connectionID", frontend.connectID, "err", err)
+			metrics.Metrics.ConnectionMigrationInc(metrics.MigrationFailed)
+			s.closeDisconnectedFrontend(agentID, frontend)
+		} else {
+			klog.V(2).InfoS("Migrated connection", "serverID", s.serverID, "fromAgentID", agentID, "agentID", newAgentID, "connectionID", frontend.connectID)
+			metrics.Metrics.ConnectionMigrationInc(metrics.MigrationMigrated)
+		}
+		frontend.mmu.Lock()
+		close(frontend.migrating)
+		frontend.migrating = nil
+		frontend.mmu.Unlock()
+	}()
+	return true
+}
+
+// migrate dials the destination of frontend again through agents other
+// than the disconnected one until one resumed the connection, or the
+// migration timed out. It returns the ID of the agent serving the
+// connection then.
+func (s *ProxyServer) migrate(disconnected Backend, frontend *ProxyClientConnection) (string, error) {
+	deadline := time.Now().Add(s.Migration.Timeout)
+	for {
+		b, err := s.migrationBackend(disconnected, frontend)
+		if err == nil {
+			var agentID string
+			agentID, err = s.resumeDial(b, frontend, deadline)
+			if err == nil || err == errMigrationClosed {
+				return agentID, err
+			}
+		}
+		if time.Until(deadline) < migrationRetryInterval {
+			return "", err
+		}
+		time.Sleep(migrationRetryInterval)
+	}
+}
+
+// migrationBackend picks an agent supporting migration, other than the
+// disconnected one, the way the dial of frontend picked its agent.
+// Connections are not migrated to the agents of peer servers.
+func (s *ProxyServer) migrationBackend(disconnected Backend, frontend *ProxyClientConnection) (Backend, error) {
+	allowed := frontend.allowedAgents
+	filter := func(b *backend) bool {
+		return Backend(b) != disconnected && containsCapability(b.capabilities(), pkgagent.CapabilityMigrate) && (allowed == nil || allowed(b))
+	}
+	b, _, err := s.getBackend(frontend.address, frontend.protocol, frontend.labelSelector, filter)
+	return b, err
+}
+
+// resumeDial sends the dial request of frontend, resuming the connection,
+// to b and waits for the DIAL_RSP until deadline.
+func (s *ProxyServer) resumeDial(b Backend, frontend *ProxyClientConnection, deadline time.Time) (string, error) {
+	dialReq := proto.Clone(frontend.migrationDial).(*client.DialRequest)
+	dialReq.Random = rand.Int63() /* #nosec G404 */
+	dialReq.Resume = &client.ResumeConnection{
+		ConnectID:      frontend.connectID,
+		BytesToAgent:   atomic.LoadInt64(&frontend.bytesToAgent),
+		BytesFromAgent: atomic.LoadInt64(&frontend.bytesFromAgent),
+	}
+	m := &connectionMigration{frontend: frontend, result: make(chan error, 1)}
+	s.mgmu.Lock()
+	if s.migrations == nil {
+		s.migrations = make(map[int64]*connectionMigration)
+	}
+	s.migrations[dialReq.Random] = m
+	s.mgmu.Unlock()
+
+	err := b.Send(&client.Packet{
+		Type:    client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: dialReq},
+	})
+	if err == nil {
+		select {
+		case err = <-m.result:
+			return backendAgentID(b), err
+		case <-time.After(time.Until(deadline)):
+			err = fmt.Errorf("no DIAL_RSP within %v", s.Migration.Timeout)
+		}
+	}
+	if s.takeMigration(dialReq.Random) == nil {
+		// answered meanwhile
+		err = <-m.result
+		return backendAgentID(b), err
+	}
+	return "", err
+}
+
+// takeMigration removes the migration waiting for the DIAL_RSP of dialID,
+// nil if there is none.
+func (s *ProxyServer) takeMigration(dialID int64) *connectionMigration {
+	s.mgmu.Lock()
+	defer s.mgmu.Unlock()
+	m, ok := s.migrations[dialID]
+	if !ok {
+		return nil
+	}
+	delete(s.migrations, dialID)
+	return m
+}
+
+// completeMigration handles resp if it answers a resumed dial, returning
+// false otherwise. It is called by the goroutine serving the agent stream
+// of b, so that the connection moved to the agent before its DATA is
+// served.
+func (s *ProxyServer) completeMigration(b Backend, agentID string, resp *client.DialResponse) bool {
+	m := s.takeMigration(resp.Random)
+	if m == nil {
+		return false
+	}
+	frontend := m.frontend
+	switch {
+	case resp.Error != "":
+		m.result <- errors.New(resp.Error)
+	case !resp.Resumed || resp.ConnectID != frontend.connectID || resp.Compression != frontend.compression:
+		s.closeOrphan(b, agentID, resp.ConnectID)
+		m.result <- fmt.Errorf("agent %s did not resume the connection", agentID)
+	case !s.moveFrontend(frontend, agentID, b):
+		s.closeOrphan(b, agentID, resp.ConnectID)
+		m.result <- errMigrationClosed
+	default:
+		m.result <- nil
+	}
+	return true
+}
+
+// moveFrontend registers frontend as connected through the agent agentID
+// and b, returning false if it was removed meanwhile.
+func (s *ProxyServer) moveFrontend(frontend *ProxyClientConnection, agentID string, b Backend) bool {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+	conns := s.frontends[frontend.agentID]
+	if conns[frontend.connectID] != frontend {
+		return false
+	}
+	delete(conns, frontend.connectID)
+	if len(conns) == 0 {
+		delete(s.frontends, frontend.agentID)
+	}
+	if _, ok := s.frontends[agentID]; !ok {
+		s.frontends[agentID] = make(map[int64]*ProxyClientConnection)
+	}
+	s.frontends[agentID][frontend.connectID] = frontend
+
+	frontend.mmu.Lock()
+	defer frontend.mmu.Unlock()
+	frontend.agentID = agentID
+	frontend.backend = b
+	if frontend.replay != nil {
+		// The agent numbers the DATA of the connection afresh.
+		frontend.replay = nil
+		s.prepareReplay(b, frontend)
+	}
+	return true
+}
+
+// closeDisconnectedFrontend closes the frontend connected through agentID,
+// which disconnected.
+func (s *ProxyServer) closeDisconnectedFrontend(agentID string, frontend *ProxyClientConnection) {
+	if !s.removeFrontend(agentID, frontend.connectID) {
+		return
+	}
+	pkt := &client.Packet{
+		Type: client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{
+			CloseResponse: &client.CloseResponse{},
+		},
+	}
+	pkt.GetCloseResponse().ConnectID = frontend.connectID
+	if err := s.sendFromAgent(frontend, pkt); err != nil {
+		klog.ErrorS(err, "CLOSE_RSP to frontend failed", "serverID", s.serverID, "agentID", agentID)
+	}
+}
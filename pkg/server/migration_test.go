@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// startTestMigration migrates connection 7 of agent1, whose agent
+// disconnected, and returns the dial request resuming it on agent2.
+func startTestMigration(t *testing.T) (*ProxyServer, Backend, *recordingProxyServer, *ProxyClientConnection, *client.DialRequest) {
+	s := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	s.Migration.Timeout = wait.ForeverTestTimeout
+	stream := &resumingConnectServer{fakeCapableConnectServer: newFakeCapableConnectServer("migrate")}
+	b := s.addBackend("agent2", stream)
+
+	dialReq := &client.DialRequest{Protocol: "tcp", Address: "10.0.0.1:22", Metadata: map[string]string{header.DialMigratable: "true"}}
+	frontendStream := &recordingProxyServer{}
+	frontend := &ProxyClientConnection{
+		Mode:           "grpc",
+		Grpc:           frontendStream,
+		backend:        &recordingBackend{},
+		agentID:        "agent1",
+		connectID:      7,
+		protocol:       dialReq.Protocol,
+		address:        dialReq.Address,
+		bytesToAgent:   10,
+		bytesFromAgent: 20,
+	}
+	s.prepareMigration(dialReq, frontend)
+	s.addFrontend("agent1", 7, frontend)
+	if !s.startMigration("agent1", frontend.backend, frontend) {
+		t.Fatal("expected the connection to migrate")
+	}
+
+	var req *client.DialRequest
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, pkt := range stream.sentPackets() {
+			if pkt.Type == client.PacketType_DIAL_REQ {
+				req = pkt.GetDialRequest()
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the destination to be dialed again through agent2, got %v", err)
+	}
+	return s, b, frontendStream, frontend, req
+}
+
+func TestMigrateConnection(t *testing.T) {
+	s, b, _, frontend, req := startTestMigration(t)
+	resume := req.GetResume()
+	if req.Address != "10.0.0.1:22" || resume == nil || resume.ConnectID != 7 || resume.BytesToAgent != 10 || resume.BytesFromAgent != 20 {
+		t.Fatalf("expected the dial to resume connection 7 at offsets 10 and 20, got %v", req)
+	}
+
+	if !s.completeMigration(b, "agent2", &client.DialResponse{Random: req.Random, ConnectID: 7, Resumed: true}) {
+		t.Fatal("expected the DIAL_RSP to complete the migration")
+	}
+	if got := frontend.currentBackend(); got != b {
+		t.Errorf("expected the connection to go through agent2, got %v", got)
+	}
+	if _, err := s.getFrontend("agent2", 7); err != nil {
+		t.Errorf("expected the connection to be registered for agent2, got %v", err)
+	}
+	if _, err := s.getFrontend("agent1", 7); err == nil {
+		t.Error("expected the connection to be unregistered for agent1")
+	}
+	if s.completeMigration(b, "agent2", &client.DialResponse{Random: req.Random, ConnectID: 7, Resumed: true}) {
+		t.Error("expected a second DIAL_RSP not to be handled as a migration")
+	}
+}
+
+func TestMigrationNotResumedClosesConnection(t *testing.T) {
+	s, b, frontendStream, frontend, req := startTestMigration(t)
+
+	// An agent not resuming the connection assigns another connectID.
+	if !s.completeMigration(b, "agent2", &client.DialResponse{Random: req.Random, ConnectID: 1}) {
+		t.Fatal("expected the DIAL_RSP to complete the migration")
+	}
+	frontend.currentBackend()
+	if _, err := s.getFrontend("agent1", 7); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if len(frontendStream.sent) != 1 || frontendStream.sent[0].GetCloseResponse().GetConnectID() != 7 {
+		t.Errorf("expected CLOSE_RSP for connection 7, got %v", frontendStream.sent)
+	}
+}
+
+func TestStartMigrationRequiresOptIn(t *testing.T) {
+	s := NewProxyServer("server-1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	dialReq := &client.DialRequest{Protocol: "tcp", Address: "10.0.0.1:22", Metadata: map[string]string{header.DialMigratable: "true"}}
+
+	frontend := &ProxyClientConnection{}
+	s.prepareMigration(dialReq, frontend)
+	if s.startMigration("agent1", &recordingBackend{}, frontend) {
+		t.Error("expected no migration with migration disabled")
+	}
+
+	s.Migration.Timeout = time.Minute
+	frontend = &ProxyClientConnection{}
+	s.prepareMigration(&client.DialRequest{Protocol: "tcp", Address: "10.0.0.1:22"}, frontend)
+	if s.startMigration("agent1", &recordingBackend{}, frontend) {
+		t.Error("expected no migration of a connection not dialed as migratable")
+	}
+}
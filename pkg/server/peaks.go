@@ -0,0 +1,319 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// peakSampleInterval is how often the load of the server is sampled for
+// the peaks. Shorter bursts of connections are not accounted.
+const peakSampleInterval = time.Second
+
+// peakSaveInterval is how often the lifetime peaks are persisted, if they
+// changed.
+const peakSaveInterval = time.Minute
+
+// PeaksConfig configures the tracking of the peak load of the server.
+type PeaksConfig struct {
+	// Window is the length of the rolling window of the rolling peaks.
+	Window time.Duration
+	// File is where the lifetime peaks are persisted across restarts,
+	// none if empty.
+	File string
+}
+
+// Peak is the highest value of a load figure, and when it was reached.
+type Peak struct {
+	Value int64     `json:"value"`
+	Time  time.Time `json:"time,omitempty"`
+	// AgentID is the agent of per agent figures.
+	AgentID string `json:"agentID,omitempty"`
+}
+
+func (p *Peak) raise(value int64, at time.Time, agentID string) bool {
+	if value <= p.Value {
+		return false
+	}
+	*p = Peak{Value: value, Time: at, AgentID: agentID}
+	return true
+}
+
+// Peaks are the highest load figures of the server over a period.
+type Peaks struct {
+	// Connections is the number of concurrent frontend connections
+	// established through agents.
+	Connections Peak `json:"connections"`
+	// BusiestAgent is the number of concurrent connections established
+	// through a single agent.
+	BusiestAgent Peak `json:"busiestAgent"`
+	// Bandwidth is the DATA payload bytes relayed per second, in both
+	// directions.
+	Bandwidth Peak `json:"bandwidth"`
+	// Bytes is the DATA payload bytes relayed over the period.
+	Bytes int64 `json:"bytes"`
+}
+
+func (p *Peaks) merge(o Peaks) {
+	p.Connections.raise(o.Connections.Value, o.Connections.Time, o.Connections.AgentID)
+	p.BusiestAgent.raise(o.BusiestAgent.Value, o.BusiestAgent.Time, o.BusiestAgent.AgentID)
+	p.Bandwidth.raise(o.Bandwidth.Value, o.Bandwidth.Time, o.Bandwidth.AgentID)
+	p.Bytes += o.Bytes
+}
+
+// PeakReport is served on /debug/peaks of the admin port.
+type PeakReport struct {
+	// Since is when the lifetime peaks started being recorded, possibly
+	// before the server started if they are persisted.
+	Since    time.Time `json:"since"`
+	Lifetime Peaks     `json:"lifetime"`
+	// Window is the length of the rolling window of Rolling.
+	Window  string `json:"window"`
+	Rolling Peaks  `json:"rolling"`
+}
+
+// loadSample is the load of the server at a sample.
+type loadSample struct {
+	at           time.Time
+	connections  int64
+	busiestAgent string
+	busiestConns int64
+	// bytes relayed since the previous sample, over elapsed
+	bytes   int64
+	elapsed time.Duration
+}
+
+// peakBucket holds the peaks of a slice of the rolling window.
+type peakBucket struct {
+	start time.Time
+	peaks Peaks
+}
+
+// peakTracker tracks the lifetime and the rolling peaks of the server.
+type peakTracker struct {
+	// bytes relayed since the last sample, accessed atomically
+	bytes int64
+
+	mu       sync.Mutex
+	window   time.Duration
+	since    time.Time
+	lifetime Peaks
+	// changed is set when the lifetime peaks were not persisted yet
+	changed bool
+	// buckets of the rolling window, oldest first
+	buckets []peakBucket
+}
+
+func newPeakTracker() *peakTracker {
+	return &peakTracker{since: time.Now()}
+}
+
+// addBytes accounts n DATA payload bytes relayed.
+func (p *peakTracker) addBytes(n int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.bytes, int64(n))
+}
+
+// record raises the peaks with sample.
+func (p *peakTracker) record(sample loadSample) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var peaks Peaks
+	peaks.Connections.raise(sample.connections, sample.at, "")
+	peaks.BusiestAgent.raise(sample.busiestConns, sample.at, sample.busiestAgent)
+	if sample.elapsed > 0 {
+		peaks.Bandwidth.raise(int64(float64(sample.bytes)/sample.elapsed.Seconds()), sample.at, "")
+	}
+	peaks.Bytes = sample.bytes
+
+	before := p.lifetime
+	p.lifetime.merge(peaks)
+	if p.lifetime != before {
+		p.changed = true
+	}
+
+	// The window is made of 60 buckets, the oldest one expiring at once.
+	bucketLen := p.window / 60
+	if bucketLen < peakSampleInterval {
+		bucketLen = peakSampleInterval
+	}
+	start := sample.at.Truncate(bucketLen)
+	if n := len(p.buckets); n == 0 || p.buckets[n-1].start.Before(start) {
+		p.buckets = append(p.buckets, peakBucket{start: start})
+	}
+	p.buckets[len(p.buckets)-1].peaks.merge(peaks)
+	p.expire(sample.at)
+}
+
+// expire drops the buckets which left the rolling window at now.
+func (p *peakTracker) expire(now time.Time) {
+	i := 0
+	for i < len(p.buckets) && !p.buckets[i].start.After(now.Add(-p.window)) {
+		i++
+	}
+	p.buckets = p.buckets[i:]
+}
+
+// report returns the peaks at now.
+func (p *peakTracker) report(now time.Time) PeakReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(now)
+	r := PeakReport{Since: p.since, Lifetime: p.lifetime, Window: p.window.String()}
+	for _, b := range p.buckets {
+		r.Rolling.merge(b.peaks)
+	}
+	return r
+}
+
+// persistedPeaks is the content of PeaksConfig.File.
+type persistedPeaks struct {
+	Since    time.Time `json:"since"`
+	Lifetime Peaks     `json:"lifetime"`
+}
+
+// load restores the lifetime peaks persisted in file, if it exists.
+func (p *peakTracker) load(file string) error {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var persisted persistedPeaks
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.since = persisted.Since
+	p.lifetime.merge(persisted.Lifetime)
+	return nil
+}
+
+// save persists the lifetime peaks in file if they changed.
+func (p *peakTracker) save(file string) error {
+	p.mu.Lock()
+	if !p.changed {
+		p.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(persistedPeaks{Since: p.since, Lifetime: p.lifetime})
+	p.changed = false
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically, so that a crash leaves the previous
+	// peaks.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) /* #nosec G104 */
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() /* #nosec G104 */
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// LocalPeaks returns the peak load of the server.
+func (s *ProxyServer) LocalPeaks() PeakReport {
+	return s.peaks.report(time.Now())
+}
+
+// ServePeaks serves the LocalPeaks as JSON.
+func (s *ProxyServer) ServePeaks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.LocalPeaks()); err != nil {
+		klog.ErrorS(err, "Failed to serve the peaks")
+	}
+}
+
+// RunPeaks samples the load of the server for the peaks until stopCh is
+// closed, restoring and persisting the lifetime peaks if configured.
+func (s *ProxyServer) RunPeaks(stopCh <-chan struct{}) {
+	s.peaks.mu.Lock()
+	s.peaks.window = s.Peaks.Window
+	s.peaks.mu.Unlock()
+	if s.Peaks.File != "" {
+		if err := s.peaks.load(s.Peaks.File); err != nil {
+			klog.ErrorS(err, "Failed to restore the peaks, starting afresh", "file", s.Peaks.File)
+		}
+	}
+	save := func() {
+		if s.Peaks.File == "" {
+			return
+		}
+		if err := s.peaks.save(s.Peaks.File); err != nil {
+			klog.ErrorS(err, "Failed to persist the peaks", "file", s.Peaks.File)
+		}
+	}
+	defer save()
+
+	ticker := time.NewTicker(peakSampleInterval)
+	defer ticker.Stop()
+	saved := time.Now()
+	last := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			sample := s.loadSample(now)
+			sample.bytes = atomic.SwapInt64(&s.peaks.bytes, 0)
+			sample.elapsed = now.Sub(last)
+			last = now
+			s.peaks.record(sample)
+			if now.Sub(saved) >= peakSaveInterval {
+				save()
+				saved = now
+			}
+		}
+	}
+}
+
+// loadSample returns the connections established through agents at now.
+func (s *ProxyServer) loadSample(now time.Time) loadSample {
+	sample := loadSample{at: now}
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	for agentID, frontends := range s.frontends {
+		n := int64(len(frontends))
+		sample.connections += n
+		if n > sample.busiestConns {
+			sample.busiestAgent, sample.busiestConns = agentID, n
+		}
+	}
+	return sample
+}
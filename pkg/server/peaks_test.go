@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeakTracker(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := newPeakTracker()
+	p.window = time.Hour
+	p.record(loadSample{at: start, connections: 5, busiestAgent: "agent1", busiestConns: 4, bytes: 3000, elapsed: time.Second})
+	p.record(loadSample{at: start.Add(40 * time.Minute), connections: 3, busiestAgent: "agent2", busiestConns: 2, bytes: 1000, elapsed: 2 * time.Second})
+	p.record(loadSample{at: start.Add(90 * time.Minute), connections: 2, busiestAgent: "agent2", busiestConns: 1, bytes: 100, elapsed: time.Second})
+
+	r := p.report(start.Add(90 * time.Minute))
+	if r.Lifetime.Connections.Value != 5 || !r.Lifetime.Connections.Time.Equal(start) {
+		t.Errorf("expected 5 connections at %v, got %+v", start, r.Lifetime.Connections)
+	}
+	if r.Lifetime.BusiestAgent.Value != 4 || r.Lifetime.BusiestAgent.AgentID != "agent1" {
+		t.Errorf("expected agent1 with 4 connections, got %+v", r.Lifetime.BusiestAgent)
+	}
+	if r.Lifetime.Bandwidth.Value != 3000 || r.Lifetime.Bytes != 4100 {
+		t.Errorf("expected 3000 bytes per second and 4100 bytes, got %+v and %d", r.Lifetime.Bandwidth, r.Lifetime.Bytes)
+	}
+	// The first sample left the window.
+	if r.Rolling.Connections.Value != 3 || r.Rolling.BusiestAgent.AgentID != "agent2" || r.Rolling.Bandwidth.Value != 500 || r.Rolling.Bytes != 1100 {
+		t.Errorf("expected the rolling peaks of the last two samples, got %+v", r.Rolling)
+	}
+}
+
+func TestPeakTrackerPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peaks.json")
+	p := newPeakTracker()
+	p.window = time.Hour
+	p.record(loadSample{at: time.Now(), connections: 7, bytes: 10, elapsed: time.Second})
+	if err := p.save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newPeakTracker()
+	if err := restored.load(file); err != nil {
+		t.Fatal(err)
+	}
+	r := restored.report(time.Now())
+	if r.Lifetime.Connections.Value != 7 || r.Lifetime.Bytes != 10 || !r.Since.Equal(p.since) {
+		t.Errorf("expected the lifetime peaks to be restored, got %+v", r)
+	}
+	if r.Rolling.Connections.Value != 0 {
+		t.Errorf("expected no rolling peaks, got %+v", r.Rolling)
+	}
+
+	if err := newPeakTracker().load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("expected a missing file to be ignored, got %v", err)
+	}
+}
+
+func TestLoadSample(t *testing.T) {
+	s := &ProxyServer{frontends: map[string]map[int64]*ProxyClientConnection{
+		"agent1": {1: {}},
+		"agent2": {2: {}, 3: {}},
+	}}
+	sample := s.loadSample(time.Now())
+	if sample.connections != 3 || sample.busiestAgent != "agent2" || sample.busiestConns != 2 {
+		t.Errorf("expected 3 connections, 2 through agent2, got %+v", sample)
+	}
+}
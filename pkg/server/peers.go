@@ -0,0 +1,306 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// PeerRegistrationPath is the path proxy servers serve their registration
+// at to their peers.
+const PeerRegistrationPath = "/peers/registration"
+
+// PeerRegistration describes the backends connected to a proxy server, as
+// shared with the other proxy server replicas.
+type PeerRegistration struct {
+	ServerID string `json:"serverID"`
+	// Address is where frontends can reach the server, empty if the
+	// server doesn't advertise one.
+	Address string `json:"address,omitempty"`
+	// Hosts are the destination hosts served by agents connected to the
+	// server, as routed by the destHost strategy.
+	Hosts []string `json:"hosts,omitempty"`
+	// DefaultRoute is true if agents claiming the default route are
+	// connected to the server.
+	DefaultRoute bool `json:"defaultRoute,omitempty"`
+	// Backends is the number of agents connected to the server, as
+	// tracked by the default and defaultRoute strategies.
+	Backends int `json:"backends"`
+	// Zone is the zone of the server, empty if not configured.
+	Zone string `json:"zone,omitempty"`
+	// AgentAddress is where agents can reach the server directly, empty
+	// if the server doesn't advertise one.
+	AgentAddress string `json:"agentAddress,omitempty"`
+
+	// peerAddr is the peer port address the registration was fetched
+	// from, which dials are relayed to.
+	peerAddr string
+}
+
+// serves reports whether the server of r has a backend for a dial to host
+// with one of strategies.
+func (r *PeerRegistration) serves(host string, strategies []ProxyStrategy) bool {
+	for _, ps := range strategies {
+		switch ps {
+		case ProxyStrategyDestHost:
+			i := sort.SearchStrings(r.Hosts, host)
+			if i < len(r.Hosts) && r.Hosts[i] == host {
+				return true
+			}
+		case ProxyStrategyDefaultRoute:
+			if r.DefaultRoute {
+				return true
+			}
+		case ProxyStrategyDefault, ProxyStrategyDestHostHash:
+			if r.Backends > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrBackendOnPeer is returned by getBackend if no local agent serves a
+// dial, but one connected to a peer proxy server does.
+type ErrBackendOnPeer struct {
+	ServerID string
+	Address  string
+
+	peerAddr string
+}
+
+func (e *ErrBackendOnPeer) Error() string {
+	if e.Address == "" {
+		return fmt.Sprintf("No backend available on this proxy server, proxy server %s has one", e.ServerID)
+	}
+	return fmt.Sprintf("No backend available on this proxy server, proxy server %s at %s has one", e.ServerID, e.Address)
+}
+
+// LocalRegistration returns the registration of the backends connected to
+// this server.
+func (s *ProxyServer) LocalRegistration() PeerRegistration {
+	reg := PeerRegistration{
+		ServerID:     s.serverID,
+		Address:      s.PeerAdvertiseAddress,
+		Zone:         s.Topology.Zone,
+		AgentAddress: s.Topology.AgentAdvertiseAddress,
+	}
+	for _, bm := range s.BackendManagers {
+		switch bm := bm.(type) {
+		case *DestHostBackendManager:
+			reg.Hosts = bm.identifiers()
+		case *DefaultRouteBackendManager:
+			reg.DefaultRoute = bm.NumBackends() > 0
+			if n := bm.NumBackends(); n > reg.Backends {
+				reg.Backends = n
+			}
+		default:
+			if n := bm.NumBackends(); n > reg.Backends {
+				reg.Backends = n
+			}
+		}
+	}
+	return reg
+}
+
+// ServePeerRegistration serves the LocalRegistration as JSON.
+func (s *ProxyServer) ServePeerRegistration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.LocalRegistration()); err != nil {
+		klog.ErrorS(err, "Failed to serve the peer registration")
+	}
+}
+
+// peerLookup returns the error pointing the frontend to a peer server with
+// a backend for reqHost, nil if no peer is known to have one.
+func (s *ProxyServer) peerLookup(reqHost string) error {
+	if s.Peers == nil {
+		return nil
+	}
+	reg := s.Peers.Lookup(util.RemovePortFromHost(reqHost), s.proxyStrategies)
+	if reg == nil {
+		return nil
+	}
+	return &ErrBackendOnPeer{ServerID: reg.ServerID, Address: reg.Address, peerAddr: reg.peerAddr}
+}
+
+type peerEntry struct {
+	registration PeerRegistration
+	expires      time.Time
+}
+
+// PeerRegistry periodically fetches the registrations of the peer proxy
+// servers.
+type PeerRegistry struct {
+	serverID string
+	// peers are the host:port addresses of the peers. Host names are
+	// resolved on each refresh, so that a headless service lists all
+	// replicas.
+	peers    []string
+	client   *http.Client
+	interval time.Duration
+
+	mu            sync.RWMutex
+	registrations map[string]peerEntry // by peer address
+}
+
+// NewPeerRegistry returns a registry of the registrations of peers, fetched
+// every interval with client over https. Peers are host:port addresses,
+// client must have a TLS config authenticating them, as the registrations
+// decide where dials are sent. Registrations of the server serverID itself
+// are ignored.
+func NewPeerRegistry(serverID string, peers []string, client *http.Client, interval time.Duration) (*PeerRegistry, error) {
+	if t, ok := client.Transport.(*http.Transport); !ok || t.TLSClientConfig == nil {
+		return nil, fmt.Errorf("the peer registrations must be fetched over TLS")
+	}
+	return &PeerRegistry{
+		serverID:      serverID,
+		peers:         peers,
+		client:        client,
+		interval:      interval,
+		registrations: make(map[string]peerEntry),
+	}, nil
+}
+
+// Run refreshes the registrations every interval until stopCh is closed.
+func (r *PeerRegistry) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.refresh()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *PeerRegistry) refresh() {
+	var wg sync.WaitGroup
+	for _, addr := range r.resolvePeers() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			reg, err := r.fetch(addr)
+			if err != nil {
+				klog.V(2).InfoS("Failed to fetch the peer registration", "peer", addr, "err", err)
+				return
+			}
+			if reg.ServerID == r.serverID {
+				return
+			}
+			reg.peerAddr = addr
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			// Registrations survive two failed refreshes.
+			r.registrations[addr] = peerEntry{registration: *reg, expires: time.Now().Add(3 * r.interval)}
+		}(addr)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for addr, entry := range r.registrations {
+		if now.After(entry.expires) {
+			delete(r.registrations, addr)
+		}
+	}
+}
+
+// resolvePeers resolves the host names of the peers to addresses.
+func (r *PeerRegistry) resolvePeers() []string {
+	var addrs []string
+	for _, peer := range r.peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			klog.ErrorS(err, "Invalid peer address", "peer", peer)
+			continue
+		}
+		if net.ParseIP(host) != nil {
+			addrs = append(addrs, peer)
+			continue
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			klog.V(2).InfoS("Failed to resolve peer", "peer", peer, "err", err)
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
+
+func (r *PeerRegistry) fetch(addr string) (*PeerRegistration, error) {
+	resp, err := r.client.Get(fmt.Sprintf("https://%s%s", addr, PeerRegistrationPath))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer responded with %s", resp.Status)
+	}
+	var reg PeerRegistration
+	if err := json.NewDecoder(resp.Body).Decode(&reg); err != nil {
+		return nil, err
+	}
+	sort.Strings(reg.Hosts)
+	return &reg, nil
+}
+
+// Lookup returns the registration of a random peer with a backend for a
+// dial to host with one of strategies, nil if there is none.
+func (r *PeerRegistry) Lookup(host string, strategies []ProxyStrategy) *PeerRegistration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var candidates []PeerRegistration
+	now := time.Now()
+	for _, entry := range r.registrations {
+		if now.Before(entry.expires) && entry.registration.serves(host, strategies) {
+			candidates = append(candidates, entry.registration)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return &candidates[rand.Intn(len(candidates))] /* #nosec G404 */
+}
+
+// Registrations returns the current registrations of the peers.
+func (r *PeerRegistry) Registrations() []PeerRegistration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	regs := make([]PeerRegistration, 0, len(r.registrations))
+	for _, entry := range r.registrations {
+		regs = append(regs, entry.registration)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].ServerID < regs[j].ServerID })
+	return regs
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func TestPeerRegistry(t *testing.T) {
+	peer := NewProxyServer("peer", []ProxyStrategy{ProxyStrategyDestHost, ProxyStrategyDefault}, 2, nil, false)
+	peer.PeerAdvertiseAddress = "peer.example.com:8090"
+	peer.BackendManagers[0].AddBackend("10.0.0.2", pkgagent.IPv4, new(fakeAgentServiceConnectServer))
+	peer.BackendManagers[0].AddBackend("node-1", pkgagent.Host, new(fakeAgentServiceConnectServer))
+	peer.BackendManagers[1].AddBackend("agent-1", pkgagent.UID, new(fakeAgentServiceConnectServer))
+
+	want := PeerRegistration{
+		ServerID: "peer",
+		Address:  "peer.example.com:8090",
+		Hosts:    []string{"10.0.0.2", "node-1"},
+		Backends: 1,
+	}
+	if got := peer.LocalRegistration(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected registration %+v, got %+v", want, got)
+	}
+
+	self := NewProxyServer("self", []ProxyStrategy{ProxyStrategyDestHost}, 2, nil, false)
+	mux := http.NewServeMux()
+	mux.HandleFunc(PeerRegistrationPath, peer.ServePeerRegistration)
+	peerServer := httptest.NewTLSServer(mux)
+	defer peerServer.Close()
+	selfServer := httptest.NewTLSServer(http.HandlerFunc(self.ServePeerRegistration))
+	defer selfServer.Close()
+
+	registry, err := NewPeerRegistry("self", []string{
+		strings.TrimPrefix(peerServer.URL, "https://"),
+		strings.TrimPrefix(selfServer.URL, "https://"),
+	}, peerServer.Client(), time.Minute)
+	if err != nil {
+		t.Fatalf("expected a registry, got %v", err)
+	}
+	registry.refresh()
+	if regs := registry.Registrations(); len(regs) != 1 || regs[0].ServerID != "peer" {
+		t.Fatalf("expected the registration of the peer only, got %+v", regs)
+	}
+	self.Peers = registry
+
+	_, _, err = self.getBackend("node-1:10250", "tcp", "", nil)
+	if e, ok := err.(*ErrBackendOnPeer); !ok || e.ServerID != "peer" || e.Address != "peer.example.com:8090" {
+		t.Errorf("expected the dial to be pointed to the peer, got %v", err)
+	}
+	if _, _, err := self.getBackend("node-2:10250", "tcp", "", nil); err == nil || backendErrorCategory(err) != dialErrorNoBackend {
+		t.Errorf("expected no backend for a host unknown to the peer, got %v", err)
+	}
+}
+
+func TestPeerRegistryRequiresTLS(t *testing.T) {
+	if _, err := NewPeerRegistry("self", []string{"peer:8092"}, http.DefaultClient, time.Minute); err == nil {
+		t.Error("expected a client without TLS to be refused")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// PriorityWeights are the shares of the agent stream bandwidth each
+// priority gets when DATA of several priorities is queued.
+type PriorityWeights map[client.Priority]int
+
+// DefaultPriorityWeights favor interactive over streaming over bulk
+// traffic.
+var DefaultPriorityWeights = PriorityWeights{
+	client.Priority_PRIORITY_HIGH:   8,
+	client.Priority_PRIORITY_MEDIUM: 4,
+	client.Priority_PRIORITY_LOW:    1,
+}
+
+// priorityNames are the names of the priorities in flags and HTTP headers.
+var priorityNames = map[string]client.Priority{
+	"high":   client.Priority_PRIORITY_HIGH,
+	"medium": client.Priority_PRIORITY_MEDIUM,
+	"low":    client.Priority_PRIORITY_LOW,
+}
+
+// ParsePriority parses a priority name: "high", "medium" or "low". An
+// empty name is unspecified.
+func ParsePriority(name string) (client.Priority, error) {
+	if name == "" {
+		return client.Priority_PRIORITY_UNSPECIFIED, nil
+	}
+	p, ok := priorityNames[strings.ToLower(name)]
+	if !ok {
+		return client.Priority_PRIORITY_UNSPECIFIED, fmt.Errorf("unknown priority %q, must be high, medium or low", name)
+	}
+	return p, nil
+}
+
+// ParsePriorityWeights parses comma separated priority=weight pairs, e.g.
+// "high=8,medium=4,low=1". Priorities left out keep their default weight.
+func ParsePriorityWeights(s string) (PriorityWeights, error) {
+	weights := PriorityWeights{}
+	for p, w := range DefaultPriorityWeights {
+		weights[p] = w
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("priority weight %q must be priority=weight", pair)
+		}
+		p, err := ParsePriority(kv[0])
+		if err != nil || p == client.Priority_PRIORITY_UNSPECIFIED {
+			return nil, fmt.Errorf("priority weight %q: unknown priority %q", pair, kv[0])
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("priority weight %q: weight must be a positive integer", pair)
+		}
+		weights[p] = w
+	}
+	return weights, nil
+}
+
+// effectivePriority maps the unspecified priority to medium.
+func effectivePriority(p client.Priority) client.Priority {
+	switch p {
+	case client.Priority_PRIORITY_HIGH, client.Priority_PRIORITY_LOW:
+		return p
+	}
+	return client.Priority_PRIORITY_MEDIUM
+}
+
+// queuedPacket is a packet waiting to be sent by a priorityStream.
+type queuedPacket struct {
+	pkt  *client.Packet
+	tag  float64 // virtual finish time
+	sent chan error
+}
+
+// priorityStream sends the packets of an agent stream by weighted fair
+// queueing across the priorities of their connections, so that bulk
+// transfers can't delay interactive sessions while the stream is
+// congested. Packets other than DATA are sent with high priority.
+type priorityStream struct {
+	agent.AgentService_ConnectServer
+	weights PriorityWeights
+	// priority returns the priority of the connection connID.
+	priority func(connID int64) client.Priority
+
+	mu      sync.Mutex // mu protects the following
+	queues  map[client.Priority][]*queuedPacket
+	lastTag map[client.Priority]float64
+	virtual float64
+
+	ready chan struct{}
+}
+
+func newPriorityStream(stream agent.AgentService_ConnectServer, weights PriorityWeights, priority func(connID int64) client.Priority) *priorityStream {
+	s := &priorityStream{
+		AgentService_ConnectServer: stream,
+		weights:                    weights,
+		priority:                   priority,
+		queues:                     make(map[client.Priority][]*queuedPacket),
+		lastTag:                    make(map[client.Priority]float64),
+		ready:                      make(chan struct{}, 1),
+	}
+	go s.serve()
+	return s
+}
+
+// Send queues pkt and waits until it was sent.
+func (s *priorityStream) Send(pkt *client.Packet) error {
+	p := client.Priority_PRIORITY_HIGH
+	size := 1
+	if pkt.Type == client.PacketType_DATA {
+		p = effectivePriority(s.priority(pkt.GetData().ConnectID))
+		if n := len(pkt.GetData().Data); n > size {
+			size = n
+		}
+	}
+	weight := s.weights[p]
+	if weight < 1 {
+		weight = 1
+	}
+	q := &queuedPacket{pkt: pkt, sent: make(chan error, 1)}
+	s.mu.Lock()
+	start := s.virtual
+	if s.lastTag[p] > start {
+		start = s.lastTag[p]
+	}
+	q.tag = start + float64(size)/float64(weight)
+	s.lastTag[p] = q.tag
+	s.queues[p] = append(s.queues[p], q)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	select {
+	case err := <-q.sent:
+		return err
+	case <-s.Context().Done():
+		return s.Context().Err()
+	}
+}
+
+// next dequeues the packet with the earliest virtual finish time.
+func (s *priorityStream) next() *queuedPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next client.Priority
+	var q *queuedPacket
+	for p, queue := range s.queues {
+		if len(queue) > 0 && (q == nil || queue[0].tag < q.tag) {
+			next, q = p, queue[0]
+		}
+	}
+	if q == nil {
+		return nil
+	}
+	s.queues[next] = s.queues[next][1:]
+	s.virtual = q.tag
+	return q
+}
+
+func (s *priorityStream) serve() {
+	for {
+		q := s.next()
+		if q == nil {
+			select {
+			case <-s.ready:
+				continue
+			case <-s.Context().Done():
+				return
+			}
+		}
+		q.sent <- s.AgentService_ConnectServer.Send(q.pkt)
+	}
+}
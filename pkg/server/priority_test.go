@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// blockingConnectServer hands the sent packets over to sent, blocking
+// until they are received.
+type blockingConnectServer struct {
+	*fakeCapableConnectServer
+	sent chan *client.Packet
+}
+
+func (f *blockingConnectServer) Send(pkt *client.Packet) error {
+	f.sent <- pkt
+	return nil
+}
+
+func TestParsePriorityWeights(t *testing.T) {
+	weights, err := ParsePriorityWeights("high=10, low=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[client.Priority_PRIORITY_HIGH] != 10 || weights[client.Priority_PRIORITY_MEDIUM] != 4 || weights[client.Priority_PRIORITY_LOW] != 2 {
+		t.Errorf("unexpected weights %v", weights)
+	}
+	for _, invalid := range []string{"high", "urgent=1", "low=0", "medium=x"} {
+		if _, err := ParsePriorityWeights(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestPriorityStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := &blockingConnectServer{
+		fakeCapableConnectServer: &fakeCapableConnectServer{ctx: ctx},
+		sent:                     make(chan *client.Packet),
+	}
+	priorities := map[int64]client.Priority{1: client.Priority_PRIORITY_LOW, 2: client.Priority_PRIORITY_HIGH}
+	s := newPriorityStream(fake, DefaultPriorityWeights, func(connID int64) client.Priority {
+		return priorities[connID]
+	})
+
+	// the senders are waited for before the context is cancelled
+	var senders sync.WaitGroup
+	defer senders.Wait()
+	send := func(pkt *client.Packet) {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			if err := s.Send(pkt); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	queued := func(n int) {
+		for {
+			s.mu.Lock()
+			l := 0
+			for _, q := range s.queues {
+				l += len(q)
+			}
+			s.mu.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The first packet blocks the stream while the others queue up.
+	send(&client.Packet{Type: client.PacketType_CLOSE_REQ})
+	for {
+		s.mu.Lock()
+		dequeued := s.virtual > 0
+		s.mu.Unlock()
+		if dequeued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		send(dataPacket(1, "bulk transfer data"))
+		queued(i + 1)
+	}
+	send(dataPacket(2, "interactive data"))
+	queued(4)
+	if pkt := <-fake.sent; pkt.Type != client.PacketType_CLOSE_REQ {
+		t.Fatalf("expected CLOSE_REQ, got %v", pkt)
+	}
+
+	var order []int64
+	for i := 0; i < 4; i++ {
+		order = append(order, (<-fake.sent).GetData().ConnectID)
+	}
+	if order[0] != 2 {
+		t.Errorf("expected the high priority packet to be sent first, got connections %v", order)
+	}
+}
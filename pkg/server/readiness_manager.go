@@ -16,6 +16,15 @@ limitations under the license.
 
 package server
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
 // ReadinessManager supports checking if the proxy server is ready.
 type ReadinessManager interface {
 	// Ready returns if the proxy server is ready. If not, also return an
@@ -26,8 +35,157 @@ type ReadinessManager interface {
 var _ ReadinessManager = &DefaultBackendStorage{}
 
 func (s *DefaultBackendStorage) Ready() (bool, string) {
-	if s.NumBackends() == 0 {
+	s.mu.RLock()
+	count, emptySince := len(s.backends), s.emptySince
+	s.mu.RUnlock()
+	if count == 0 {
+		// Stay ready while the agents reconnect, if they were connected.
+		if !emptySince.IsZero() && time.Since(emptySince) < s.readinessGrace() {
+			return true, ""
+		}
 		return false, "no connection to any proxy agent"
 	}
 	return true, ""
 }
+
+// BackendReadinessConfig sets the agents a proxy server needs to be ready,
+// so that frontends are not routed to a server which can only fail dials.
+type BackendReadinessConfig struct {
+	// MinBackends is the least number of backends of the last proxy
+	// strategy, which routes the dials the others did not. Those are
+	// agents, but for the destHost strategy whose backends are the
+	// hosts and addresses of the agents.
+	MinBackends int
+	// RequiredIdentifiers are type=value agent identifiers, e.g.
+	// host=node-1 or uid=agent-1, which must each be registered with the
+	// backend manager of a proxy strategy using identifiers of the type.
+	RequiredIdentifiers []string
+}
+
+// requiredIdentifier is an agent identifier the readiness requires, with
+// the storages of the strategies registering identifiers of its type.
+type requiredIdentifier struct {
+	idType   pkgagent.IdentifierType
+	value    string
+	storages []*DefaultBackendStorage
+}
+
+// backendReadiness is the ReadinessManager of BackendReadinessConfig. The
+// base readiness must hold too. Once the requirements were met, the server
+// stays ready during the readiness grace period after they no longer are,
+// while agents reconnect.
+type backendReadiness struct {
+	base        ReadinessManager
+	fallback    BackendManager
+	minBackends int
+	required    []requiredIdentifier
+
+	mu sync.Mutex // protects the following
+	// met is whether the requirements were ever met, and unmetSince when
+	// they were last found unmet after that.
+	met        bool
+	unmetSince time.Time
+}
+
+var _ ReadinessManager = &backendReadiness{}
+
+// RequireBackends makes the readiness of the server require the agents of
+// config, in addition to its current readiness.
+func (s *ProxyServer) RequireBackends(config BackendReadinessConfig) error {
+	if len(s.BackendManagers) == 0 {
+		return fmt.Errorf("no proxy strategy")
+	}
+	r := &backendReadiness{
+		base:        s.Readiness,
+		fallback:    s.BackendManagers[len(s.BackendManagers)-1],
+		minBackends: config.MinBackends,
+	}
+	for _, id := range config.RequiredIdentifiers {
+		parts := strings.SplitN(id, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("required agent identifier %q must be type=value", id)
+		}
+		required := requiredIdentifier{idType: pkgagent.IdentifierType(parts[0]), value: parts[1]}
+		for _, bm := range s.BackendManagers {
+			if storage := backendStorage(bm); storage != nil && containIDType(storage.idTypes, required.idType) {
+				required.storages = append(required.storages, storage)
+			}
+		}
+		if len(required.storages) == 0 {
+			return fmt.Errorf("no proxy strategy registers the agent identifiers of type %q of %q", parts[0], id)
+		}
+		r.required = append(r.required, required)
+	}
+	s.Readiness = r
+	return nil
+}
+
+// backendStorage returns the storage of bm, nil if it has none.
+func backendStorage(bm BackendManager) *DefaultBackendStorage {
+	if storage, ok := bm.(interface{ storage() *DefaultBackendStorage }); ok {
+		return storage.storage()
+	}
+	return nil
+}
+
+func (s *DefaultBackendStorage) storage() *DefaultBackendStorage {
+	return s
+}
+
+// hasIdentifier reports whether a backend is registered under id.
+func (s *DefaultBackendStorage) hasIdentifier(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.backends[id]) > 0
+}
+
+func (r *backendReadiness) Ready() (bool, string) {
+	msg := r.unmet()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msg == "" {
+		r.met = true
+		r.unmetSince = time.Time{}
+		return r.base.Ready()
+	}
+	if r.met {
+		now := time.Now()
+		if r.unmetSince.IsZero() {
+			r.unmetSince = now
+		}
+		if now.Sub(r.unmetSince) < r.grace() {
+			return true, ""
+		}
+	}
+	return false, msg
+}
+
+// unmet returns why the requirements are not met, empty if they are.
+func (r *backendReadiness) unmet() string {
+	if n := r.fallback.NumBackends(); n < r.minBackends {
+		return fmt.Sprintf("%d proxy agent backends connected, %d required", n, r.minBackends)
+	}
+	for _, required := range r.required {
+		if !required.registered() {
+			return fmt.Sprintf("no connection to a proxy agent with identifier %s=%s", required.idType, required.value)
+		}
+	}
+	return ""
+}
+
+// grace returns the readiness grace period of the fallback strategy.
+func (r *backendReadiness) grace() time.Duration {
+	if storage := backendStorage(r.fallback); storage != nil {
+		return storage.readinessGrace()
+	}
+	return 0
+}
+
+func (id *requiredIdentifier) registered() bool {
+	for _, storage := range id.storages {
+		if storage.hasIdentifier(id.value) {
+			return true
+		}
+	}
+	return false
+}
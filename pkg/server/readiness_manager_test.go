@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+func TestRequireBackends(t *testing.T) {
+	s := NewProxyServer("server1", []ProxyStrategy{ProxyStrategyDestHost, ProxyStrategyDefault}, 1, nil, false)
+	if err := s.RequireBackends(BackendReadinessConfig{MinBackends: 2, RequiredIdentifiers: []string{"host=node-1"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	destHost, def := s.BackendManagers[0], s.BackendManagers[1]
+	conn1, conn2 := new(fakeAgentServiceConnectServer), new(fakeAgentServiceConnectServer)
+
+	if ready, _ := s.Readiness.Ready(); ready {
+		t.Error("expected not to be ready without agents")
+	}
+	def.AddBackend("agent1", pkgagent.UID, conn1)
+	destHost.AddBackend("node-1", pkgagent.Host, conn1)
+	if ready, msg := s.Readiness.Ready(); ready || msg != "1 proxy agent backends connected, 2 required" {
+		t.Errorf("expected not to be ready with one agent, got %v %q", ready, msg)
+	}
+	def.AddBackend("agent2", pkgagent.UID, conn2)
+	if ready, msg := s.Readiness.Ready(); !ready {
+		t.Errorf("expected to be ready, got %q", msg)
+	}
+	destHost.RemoveBackend("node-1", pkgagent.Host, conn1)
+	if ready, msg := s.Readiness.Ready(); ready || msg != "no connection to a proxy agent with identifier host=node-1" {
+		t.Errorf("expected not to be ready without the required agent, got %v %q", ready, msg)
+	}
+}
+
+func TestRequireBackendsGrace(t *testing.T) {
+	s := NewProxyServer("server1", []ProxyStrategy{ProxyStrategyDefault}, 1, nil, false)
+	s.SetBackendUpdates(BackendUpdateConfig{ReadinessGrace: time.Hour})
+	if err := s.RequireBackends(BackendReadinessConfig{MinBackends: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bm := s.BackendManagers[0]
+	conn1, conn2 := new(fakeAgentServiceConnectServer), new(fakeAgentServiceConnectServer)
+	bm.AddBackend("agent1", pkgagent.UID, conn1)
+	if ready, _ := s.Readiness.Ready(); ready {
+		t.Error("expected the grace period not to apply before the requirements were met")
+	}
+	bm.AddBackend("agent2", pkgagent.UID, conn2)
+	if ready, msg := s.Readiness.Ready(); !ready {
+		t.Errorf("expected to be ready, got %q", msg)
+	}
+	bm.RemoveBackend("agent2", pkgagent.UID, conn2)
+	if ready, _ := s.Readiness.Ready(); !ready {
+		t.Error("expected to stay ready within the grace period")
+	}
+}
+
+func TestRequireBackendsInvalidIdentifiers(t *testing.T) {
+	for _, id := range []string{"node-1", "host=", "uid=agent1"} {
+		s := NewProxyServer("server1", []ProxyStrategy{ProxyStrategyDestHost}, 1, nil, false)
+		if err := s.RequireBackends(BackendReadinessConfig{RequiredIdentifiers: []string{id}}); err == nil {
+			t.Errorf("expected %q to be rejected", id)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// proxyStrategyRelay is the strategy reported in metrics for dials relayed
+// to a peer proxy server.
+const proxyStrategyRelay ProxyStrategy = "peerRelay"
+
+// PeerRelay relays dials without a local backend to a peer proxy server
+// with one. Each relayed dial is a ProxyService stream to the peer port of
+// the peer, which serves it like the stream of a frontend.
+type PeerRelay struct {
+	dialOptions []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn // by peer address
+
+	// lastConnID is the last connection ID handed out to a relayed
+	// connection, updated atomically.
+	lastConnID int64
+}
+
+// NewPeerRelay returns a relay dialing peers with opts, which must
+// authenticate the peers.
+func NewPeerRelay(opts ...grpc.DialOption) *PeerRelay {
+	return &PeerRelay{
+		dialOptions: opts,
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+}
+
+// Close closes the connections to the peers.
+func (r *PeerRelay) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, conn := range r.conns {
+		conn.Close() /* #nosec G104 */
+		delete(r.conns, addr)
+	}
+}
+
+func (r *PeerRelay) clientConn(addr string) (*grpc.ClientConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(addr, r.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	r.conns[addr] = conn
+	return conn, nil
+}
+
+// forget closes the connection to a peer that failed, so that peers
+// which went away are not redialed forever.
+func (r *PeerRelay) forget(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.conns[addr]; ok {
+		conn.Close() /* #nosec G104 */
+		delete(r.conns, addr)
+	}
+}
+
+// relayBackend is the Backend of a relayed dial. The stream carries a
+// single connection, whose ID assigned by the agent on the peer is
+// replaced with one unique on this server, so that connections relayed
+// from agents of the same peer don't collide.
+type relayBackend struct {
+	mu     sync.Mutex // mu protects stream sends
+	stream client.ProxyService_ProxyClient
+	cancel context.CancelFunc
+
+	localConnID int64
+	peerConnID  int64 // updated atomically, 0 until the dial succeeded
+}
+
+var _ Backend = &relayBackend{}
+
+func (b *relayBackend) Send(p *client.Packet) error {
+	switch p.Type {
+	case client.PacketType_DATA:
+		p.GetData().ConnectID = b.toPeer(p.GetData().ConnectID)
+	case client.PacketType_CLOSE_REQ:
+		p.GetCloseRequest().ConnectID = b.toPeer(p.GetCloseRequest().ConnectID)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stream.Send(p)
+}
+
+func (b *relayBackend) Context() context.Context {
+	return b.stream.Context()
+}
+
+func (b *relayBackend) toPeer(connID int64) int64 {
+	if connID == b.localConnID {
+		return atomic.LoadInt64(&b.peerConnID)
+	}
+	return connID
+}
+
+// getBackendOrRelay picks a backend for the dial of frontend like
+// getBackend. If only a peer proxy server has a backend, the dial is
+// relayed to it unless relaying is disabled or frontend was relayed
+// already.
+func (s *ProxyServer) getBackendOrRelay(frontend *ProxyClientConnection, reqHost, protocol string) (Backend, ProxyStrategy, error) {
+	backend, strategy, err := s.getBackend(reqHost, protocol, frontend.labelSelector, frontend.allowedAgents)
+	peerErr, ok := err.(*ErrBackendOnPeer)
+	if !ok || s.PeerRelay == nil || frontend.relayed || peerErr.peerAddr == "" {
+		return backend, strategy, err
+	}
+	backend, err = s.relay(peerErr.ServerID, peerErr.peerAddr)
+	if err != nil {
+		klog.ErrorS(err, "Failed to relay the dial to the peer", "peerServerID", peerErr.ServerID, "peer", peerErr.peerAddr)
+		return nil, "", peerErr
+	}
+	klog.V(3).InfoS("Relaying dial to the peer", "host", reqHost, "peerServerID", peerErr.ServerID, "peer", peerErr.peerAddr)
+	return backend, proxyStrategyRelay, nil
+}
+
+// relay opens a relay stream to the peer serverID at addr, and routes the
+// packets it receives to the frontend like serveRecvBackend does for
+// agents.
+func (s *ProxyServer) relay(serverID, addr string) (Backend, error) {
+	conn, err := s.PeerRelay.clientConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.NewProxyServiceClient(conn).Proxy(ctx)
+	if err != nil {
+		cancel()
+		s.PeerRelay.forget(addr)
+		return nil, err
+	}
+	b := &relayBackend{
+		stream:      stream,
+		cancel:      cancel,
+		localConnID: atomic.AddInt64(&s.PeerRelay.lastConnID, 1),
+	}
+	go s.serveRelay(b, fmt.Sprintf("peer/%s", serverID))
+	return b, nil
+}
+
+// serveRelay receives the packets of the relay stream of b until the
+// relayed connection is closed or the stream fails.
+func (s *ProxyServer) serveRelay(b *relayBackend, agentID string) {
+	recvCh := make(chan *client.Packet, xfrChannelSize)
+	go s.serveRecvBackend(b, nil, agentID, recvCh)
+	defer close(recvCh)
+	defer b.cancel()
+
+	for {
+		pkt, err := b.stream.Recv()
+		if err != nil {
+			if err != io.EOF && status.Code(err) != codes.Canceled {
+				klog.ErrorS(err, "Relay stream read failure", "agentID", agentID, "connectionID", b.localConnID)
+			}
+			return
+		}
+		done := false
+		switch pkt.Type {
+		case client.PacketType_DIAL_RSP:
+			resp := pkt.GetDialResponse()
+			if _, ok := s.PendingDial.Get(resp.Random); !ok || resp.Error != "" {
+				// Nothing will be sent on a failed or
+				// abandoned dial.
+				done = true
+			} else {
+				atomic.StoreInt64(&b.peerConnID, resp.ConnectID)
+			}
+			resp.ConnectID = b.localConnID
+		case client.PacketType_DATA:
+			pkt.GetData().ConnectID = b.localConnID
+		case client.PacketType_CLOSE_RSP:
+			pkt.GetCloseResponse().ConnectID = b.localConnID
+			done = true
+		}
+		recvCh <- pkt
+		if done {
+			return
+		}
+	}
+}
+
+// relayedStream marks the streams of dials relayed by a peer proxy server.
+type relayedStream struct {
+	client.ProxyService_ProxyServer
+	ctx context.Context
+}
+
+func (r *relayedStream) Context() context.Context {
+	return r.ctx
+}
+
+type relayService struct {
+	server *ProxyServer
+}
+
+func (r *relayService) Proxy(stream client.ProxyService_ProxyServer) error {
+	ctx := context.WithValue(stream.Context(), relayedFrontend, true)
+	return r.server.Proxy(&relayedStream{ProxyService_ProxyServer: stream, ctx: ctx})
+}
+
+// RelayService returns the ProxyService serving dials relayed by peer
+// proxy servers on the peer port. Relayed dials are not relayed again,
+// and keep the metadata attested by the relaying peer.
+func (s *ProxyServer) RelayService() client.ProxyServiceServer {
+	return &relayService{server: s}
+}
+
+func isRelayed(ctx context.Context) bool {
+	relayed, _ := ctx.Value(relayedFrontend).(bool)
+	return relayed
+}
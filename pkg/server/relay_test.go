@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+type fakeRelayStream struct {
+	grpc.ClientStream
+	ctx  context.Context
+	recv chan *client.Packet
+	sent chan *client.Packet
+}
+
+func (f *fakeRelayStream) Send(p *client.Packet) error {
+	f.sent <- p
+	return nil
+}
+
+func (f *fakeRelayStream) Recv() (*client.Packet, error) {
+	select {
+	case p, ok := <-f.recv:
+		if !ok {
+			return nil, io.EOF
+		}
+		return p, nil
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	}
+}
+
+func (f *fakeRelayStream) Context() context.Context {
+	return f.ctx
+}
+
+type chanWriter chan []byte
+
+func (w chanWriter) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestRelayTranslatesConnectionIDs(t *testing.T) {
+	s := NewProxyServer("self", []ProxyStrategy{ProxyStrategyDefault}, 2, nil, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeRelayStream{
+		ctx:  ctx,
+		recv: make(chan *client.Packet),
+		sent: make(chan *client.Packet, 1),
+	}
+	b := &relayBackend{stream: stream, cancel: cancel, localConnID: 42}
+	go s.serveRelay(b, "peer/peer")
+
+	data := make(chanWriter, 1)
+	closed := make(chan struct{})
+	frontend := &ProxyClientConnection{
+		Mode:      "http-connect",
+		HTTP:      data,
+		CloseHTTP: func() error { close(closed); return nil },
+		connected: make(chan struct{}),
+		start:     time.Now(),
+		backend:   b,
+	}
+	s.PendingDial.Add(1, frontend)
+
+	stream.recv <- &client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{Random: 1, ConnectID: 7}},
+	}
+	<-frontend.connected
+	if frontend.connectID != 42 {
+		t.Errorf("expected the local connection ID 42, got %d", frontend.connectID)
+	}
+
+	if err := b.Send(&client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 42, Data: []byte("ping")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-stream.sent).GetData().ConnectID; got != 7 {
+		t.Errorf("expected DATA to the peer for connection 7, got %d", got)
+	}
+
+	stream.recv <- &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 7, Data: []byte("pong")}},
+	}
+	if got := string(<-data); got != "pong" {
+		t.Errorf("expected pong, got %q", got)
+	}
+
+	stream.recv <- &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: 7}},
+	}
+	<-closed
+	<-ctx.Done()
+	// The frontend is removed after CLOSE_RSP was sent to it.
+	deadline := time.Now().Add(wait.ForeverTestTimeout)
+	for {
+		if _, err := s.getFrontend("peer/peer", 42); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the relayed connection to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// ScaleHintsConfig configures the load figures served to autoscalers of
+// the proxy server replicas.
+type ScaleHintsConfig struct {
+	// Interval is how often the CPU utilization is sampled and the scale
+	// hint metrics are refreshed.
+	Interval time.Duration
+	// Targets of a replica. The load is the highest ratio of a figure to
+	// its target, figures with a zero target are ignored.
+	TargetConnections  int
+	TargetPendingDials int
+	TargetCPU          float64
+}
+
+// ScaleHints are load figures of a proxy server replica, served on
+// /scale-hints for the HorizontalPodAutoscaler, through an external
+// metrics adapter, or the KEDA metrics-api scaler.
+type ScaleHints struct {
+	// ActiveConnections is the number of frontend connections
+	// established through agents.
+	ActiveConnections int `json:"activeConnections"`
+	// PendingDials is the number of dials waiting for a DIAL_RSP.
+	PendingDials int `json:"pendingDials"`
+	// CPUUtilization is the share of the CPUs available to the process
+	// used during the last interval, mostly by the data path.
+	CPUUtilization float64 `json:"cpuUtilization"`
+	// Load is the highest ratio of the figures to their targets. Replicas
+	// are to be added above 1.
+	Load float64 `json:"load"`
+}
+
+// LocalScaleHints returns the current load figures of the server.
+func (s *ProxyServer) LocalScaleHints() ScaleHints {
+	hints := ScaleHints{ActiveConnections: s.frontendCount()}
+	hints.CPUUtilization, _ = s.cpuUtilization.Load().(float64)
+	if s.PendingDial != nil {
+		hints.PendingDials = s.PendingDial.Count()
+	}
+	ratio := func(value, target float64) {
+		if target > 0 && value/target > hints.Load {
+			hints.Load = value / target
+		}
+	}
+	ratio(float64(hints.ActiveConnections), float64(s.ScaleHints.TargetConnections))
+	ratio(float64(hints.PendingDials), float64(s.ScaleHints.TargetPendingDials))
+	ratio(hints.CPUUtilization, s.ScaleHints.TargetCPU)
+	return hints
+}
+
+// ServeScaleHints serves the LocalScaleHints as JSON.
+func (s *ProxyServer) ServeScaleHints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.LocalScaleHints()); err != nil {
+		klog.ErrorS(err, "Failed to serve the scale hints")
+	}
+}
+
+// RunScaleHints samples the CPU utilization and refreshes the scale hint
+// metrics every interval until stopCh is closed.
+func (s *ProxyServer) RunScaleHints(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(s.ScaleHints.Interval)
+	defer ticker.Stop()
+	sampler := &cpuSampler{procs: runtime.GOMAXPROCS(0)}
+	sampler.sample(util.ProcessCPUTime())
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if utilization, ok := sampler.sample(util.ProcessCPUTime()); ok {
+			s.cpuUtilization.Store(utilization)
+		}
+		hints := s.LocalScaleHints()
+		metrics.Metrics.SetScaleHints(hints.ActiveConnections, hints.PendingDials, hints.CPUUtilization, hints.Load)
+	}
+}
+
+// cpuSampler computes the CPU utilization between samples of the CPU time
+// of the process.
+type cpuSampler struct {
+	procs int
+	// cpu and at are the last successful sample, zero if there is none.
+	cpu time.Duration
+	at  time.Time
+	now func() time.Time
+}
+
+// sample records the CPU time of the process, and returns the utilization
+// since the previous sample, false if there is none.
+func (c *cpuSampler) sample(cpu time.Duration, err error) (float64, bool) {
+	if err != nil {
+		klog.V(4).InfoS("Failed to sample the CPU time", "err", err)
+		return 0, false
+	}
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	prevCPU, prevAt := c.cpu, c.at
+	c.cpu, c.at = cpu, now
+	if prevAt.IsZero() || !now.After(prevAt) {
+		return 0, false
+	}
+	return float64(cpu-prevCPU) / (float64(now.Sub(prevAt)) * float64(c.procs)), true
+}
+
+// frontendCount returns the number of frontend connections established
+// through agents.
+func (s *ProxyServer) frontendCount() int {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	count := 0
+	for _, frontends := range s.frontends {
+		count += len(frontends)
+	}
+	return count
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocalScaleHints(t *testing.T) {
+	s := &ProxyServer{
+		PendingDial: NewPendingDialManager(),
+		ScaleHints:  ScaleHintsConfig{TargetConnections: 4, TargetPendingDials: 10, TargetCPU: 0.5},
+		frontends: map[string]map[int64]*ProxyClientConnection{
+			"agent1": {1: {}, 2: {}},
+			"agent2": {1: {}},
+		},
+	}
+	s.PendingDial.Add(1, &ProxyClientConnection{})
+	s.cpuUtilization.Store(0.25)
+
+	hints := s.LocalScaleHints()
+	if hints.ActiveConnections != 3 || hints.PendingDials != 1 || hints.CPUUtilization != 0.25 {
+		t.Errorf("unexpected scale hints %+v", hints)
+	}
+	if hints.Load != 0.75 {
+		t.Errorf("expected the connections to load the replica at 0.75, got %v", hints.Load)
+	}
+
+	s.ScaleHints.TargetConnections = 0
+	if load := s.LocalScaleHints().Load; load != 0.5 {
+		t.Errorf("expected the CPU to load the replica at 0.5 without a connection target, got %v", load)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeScaleHints(w, httptest.NewRequest("GET", "/scale-hints", nil))
+	var served ScaleHints
+	if err := json.NewDecoder(w.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if served.ActiveConnections != 3 || served.Load != 0.5 {
+		t.Errorf("unexpected served scale hints %+v", served)
+	}
+}
+
+func TestCPUSampler(t *testing.T) {
+	now := time.Unix(0, 0)
+	sampler := &cpuSampler{procs: 2, now: func() time.Time { return now }}
+	if _, ok := sampler.sample(time.Second, nil); ok {
+		t.Error("expected no utilization from the first sample")
+	}
+
+	now = now.Add(10 * time.Second)
+	utilization, ok := sampler.sample(6*time.Second, nil)
+	if !ok || math.Abs(utilization-0.25) > 1e-9 {
+		t.Errorf("expected 5s of CPU over 10s on 2 CPUs to be a utilization of 0.25, got %v (%v)", utilization, ok)
+	}
+
+	now = now.Add(10 * time.Second)
+	if _, ok := sampler.sample(0, errors.New("unsupported")); ok {
+		t.Error("expected no utilization from a failed sample")
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// SendQueuePolicy is what the send queue of a connection does with the
+// packets received from the agent once it is full.
+type SendQueuePolicy string
+
+const (
+	// SendQueueBlock blocks the agent stream until the frontend caught
+	// up, applying backpressure to all connections of the agent.
+	SendQueueBlock SendQueuePolicy = "block"
+	// SendQueueDrop drops the queued packets and closes the connection.
+	SendQueueDrop SendQueuePolicy = "drop"
+	// SendQueueSpill writes the packets to a file on disk until the
+	// frontend caught up, for bulk transfers to slow frontends.
+	SendQueueSpill SendQueuePolicy = "spill"
+)
+
+// ParseSendQueuePolicy parses a send queue policy: "block", "drop" or
+// "spill".
+func ParseSendQueuePolicy(policy string) (SendQueuePolicy, error) {
+	switch p := SendQueuePolicy(policy); p {
+	case SendQueueBlock, SendQueueDrop, SendQueueSpill:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown send queue policy %q, must be block, drop or spill", policy)
+}
+
+// SendQueueConfig bounds the packets received from the agent that are
+// queued for each frontend connection, so that slow frontends can't
+// exhaust the memory of the server.
+type SendQueueConfig struct {
+	// Depth is the number of packets queued in memory per connection. 0
+	// sends the packets from the agent stream, without a queue.
+	Depth int
+	// Policy is what a full queue does with further packets.
+	Policy SendQueuePolicy
+	// SpillDir is the directory the spill policy writes its files to,
+	// the default directory for temporary files if empty.
+	SpillDir string
+}
+
+// errSendQueueOverflow is returned when a packet overflows a send queue
+// with the drop policy.
+var errSendQueueOverflow = errors.New("send queue overflow")
+
+// sendQueue queues the packets sent to a frontend, delivered in order by
+// serveSendQueue. CLOSE_RSP is always accepted, and closes the queue.
+type sendQueue struct {
+	connID   int64
+	depth    int
+	policy   SendQueuePolicy
+	spillDir string
+
+	mu   sync.Mutex // mu protects the following
+	cond *sync.Cond
+	// packets are the packets queued in memory, sent before the spilled
+	// ones.
+	packets []*client.Packet
+	// spill holds the spilled packets, length prefixed, read from
+	// spillRead and written at spillWrite. It is nil unless spilling.
+	spill      *os.File
+	spillRead  int64
+	spillWrite int64
+	spilled    int
+	// closed is set once CLOSE_RSP was queued, overflowed once the queue
+	// overflowed with the drop policy.
+	closed     bool
+	overflowed bool
+}
+
+func newSendQueue(connID int64, config SendQueueConfig) *sendQueue {
+	q := &sendQueue{
+		connID:   connID,
+		depth:    config.Depth,
+		policy:   config.Policy,
+		spillDir: config.SpillDir,
+	}
+	if q.policy == "" {
+		q.policy = SendQueueBlock
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// enqueue queues pkt, handling a full queue by the policy.
+func (q *sendQueue) enqueue(pkt *client.Packet) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("connection %d is closed", q.connID)
+	}
+	if pkt.Type == client.PacketType_CLOSE_RSP {
+		q.closed = true
+		return q.push(pkt)
+	}
+	if q.overflowed {
+		return errSendQueueOverflow
+	}
+	if q.spill == nil && len(q.packets) >= q.depth {
+		metrics.Metrics.SendQueueOverflowInc(string(q.policy))
+		switch q.policy {
+		case SendQueueDrop:
+			metrics.Metrics.AddSendQueuePackets(metrics.QueueMemory, -len(q.packets))
+			q.packets = nil
+			q.overflowed = true
+			return errSendQueueOverflow
+		case SendQueueSpill:
+			f, err := ioutil.TempFile(q.spillDir, "konnectivity-send-queue-")
+			if err != nil {
+				return fmt.Errorf("failed to spill the send queue of connection %d: %v", q.connID, err)
+			}
+			// The file is only reachable through its descriptor.
+			os.Remove(f.Name()) /* #nosec G104 */
+			q.spill = f
+		default:
+			for len(q.packets) >= q.depth && !q.closed {
+				q.cond.Wait()
+			}
+			if q.closed {
+				return fmt.Errorf("connection %d is closed", q.connID)
+			}
+		}
+	}
+	return q.push(pkt)
+}
+
+// push appends pkt to the spill file while spilling, to the packets in
+// memory otherwise. CLOSE_RSP is spilled too, to keep the order.
+func (q *sendQueue) push(pkt *client.Packet) error {
+	defer q.cond.Broadcast()
+	if q.spill == nil {
+		q.packets = append(q.packets, pkt)
+		metrics.Metrics.AddSendQueuePackets(metrics.QueueMemory, 1)
+		return nil
+	}
+	data, err := proto.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := q.spill.WriteAt(buf, q.spillWrite); err != nil {
+		return fmt.Errorf("failed to spill the send queue of connection %d: %v", q.connID, err)
+	}
+	q.spillWrite += int64(len(buf))
+	q.spilled++
+	metrics.Metrics.AddSendQueuePackets(metrics.QueueDisk, 1)
+	return nil
+}
+
+// dequeue waits for the next packet, nil once the queue is closed and
+// drained.
+func (q *sendQueue) dequeue() (*client.Packet, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.packets) == 0 && q.spilled == 0 {
+		if q.closed {
+			return nil, nil
+		}
+		q.cond.Wait()
+	}
+	defer q.cond.Broadcast()
+	if len(q.packets) > 0 {
+		pkt := q.packets[0]
+		q.packets[0] = nil
+		q.packets = q.packets[1:]
+		metrics.Metrics.AddSendQueuePackets(metrics.QueueMemory, -1)
+		return pkt, nil
+	}
+	return q.unspill()
+}
+
+// unspill reads the next spilled packet, and removes the spill file once
+// it is drained.
+func (q *sendQueue) unspill() (*client.Packet, error) {
+	var size [4]byte
+	if _, err := q.spill.ReadAt(size[:], q.spillRead); err != nil {
+		return nil, fmt.Errorf("failed to read the spilled send queue of connection %d: %v", q.connID, err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := q.spill.ReadAt(data, q.spillRead+4); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read the spilled send queue of connection %d: %v", q.connID, err)
+	}
+	q.spillRead += int64(4 + len(data))
+	q.spilled--
+	metrics.Metrics.AddSendQueuePackets(metrics.QueueDisk, -1)
+	if q.spilled == 0 {
+		q.closeSpill()
+	}
+	pkt := &client.Packet{}
+	if err := proto.Unmarshal(data, pkt); err != nil {
+		return nil, fmt.Errorf("failed to read the spilled send queue of connection %d: %v", q.connID, err)
+	}
+	return pkt, nil
+}
+
+func (q *sendQueue) closeSpill() {
+	if q.spill == nil {
+		return
+	}
+	q.spill.Close() /* #nosec G104 */
+	q.spill = nil
+	q.spillRead, q.spillWrite = 0, 0
+}
+
+// discard drops the queued packets and closes the queue, once the
+// packets can't be delivered anymore.
+func (q *sendQueue) discard() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metrics.Metrics.AddSendQueuePackets(metrics.QueueMemory, -len(q.packets))
+	metrics.Metrics.AddSendQueuePackets(metrics.QueueDisk, -q.spilled)
+	q.packets = nil
+	q.spilled = 0
+	q.closeSpill()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// queueSends queues the packets sent to frontend once it is connected
+// through agentID, if send queues are configured or the connection is
+// throttled.
+func (s *ProxyServer) queueSends(agentID string, frontend *ProxyClientConnection) {
+	if frontend.sendQueue != nil {
+		return
+	}
+	config := s.SendQueue
+	if config.Depth <= 0 {
+		if frontend.bandwidth == nil || frontend.bandwidth.fromAgent == nil {
+			return
+		}
+		config = SendQueueConfig{Depth: xfrChannelSize, Policy: SendQueueBlock}
+	}
+	frontend.sendQueue = newSendQueue(frontend.connectID, config)
+	go s.serveSendQueue(agentID, frontend)
+}
+
+// serveSendQueue delivers the queued packets of frontend, at its per
+// connection bandwidth limit, until CLOSE_RSP.
+func (s *ProxyServer) serveSendQueue(agentID string, frontend *ProxyClientConnection) {
+	q := frontend.sendQueue
+	var fromAgent *tokenBucket
+	if frontend.bandwidth != nil {
+		fromAgent = frontend.bandwidth.fromAgent
+	}
+	for {
+		pkt, err := q.dequeue()
+		if err != nil {
+			klog.ErrorS(err, "Failed to dequeue packet to frontend", "serverID", s.serverID, "agentID", agentID, "connectionID", frontend.connectID)
+			q.discard()
+			if s.removeFrontend(agentID, frontend.connectID) && frontend.backend != nil {
+				s.closeOrphan(frontend.backend, agentID, frontend.connectID)
+			}
+			if err := frontend.send(closeResponsePacket(frontend.connectID)); err != nil {
+				klog.V(2).InfoS("Failed to send CLOSE_RSP of closed connection", "serverID", s.serverID, "agentID", agentID, "connectionID", frontend.connectID, "err", err)
+			}
+			return
+		}
+		if pkt == nil {
+			return
+		}
+		if fromAgent != nil && pkt.Type == client.PacketType_DATA {
+			throttle(DirectionFromAgent, len(pkt.GetData().Data), fromAgent)
+		}
+		if err := frontend.send(pkt); err != nil {
+			klog.ErrorS(err, "send to client stream failure", "serverID", s.serverID, "agentID", agentID, "connectionID", frontend.connectID, "type", pkt.Type)
+		}
+	}
+}
+
+// closeOverflowing closes the connection of frontend whose send queue
+// overflowed with the drop policy.
+func (s *ProxyServer) closeOverflowing(frontend *ProxyClientConnection) {
+	if !s.removeFrontend(frontend.agentID, frontend.connectID) {
+		// closed meanwhile
+		return
+	}
+	klog.V(2).InfoS("Closing connection with overflowing send queue", "serverID", s.serverID, "agentID", frontend.agentID, "connectionID", frontend.connectID)
+	s.closeRemovedFrontend(frontend, "")
+}
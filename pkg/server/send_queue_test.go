@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestParseSendQueuePolicy(t *testing.T) {
+	for _, policy := range []string{"block", "drop", "spill"} {
+		if p, err := ParseSendQueuePolicy(policy); err != nil || string(p) != policy {
+			t.Errorf("expected policy %q, got %q, %v", policy, p, err)
+		}
+	}
+	if _, err := ParseSendQueuePolicy("discard"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestSendQueueSpill(t *testing.T) {
+	q := newSendQueue(1, SendQueueConfig{Depth: 2, Policy: SendQueueSpill, SpillDir: t.TempDir()})
+	for i := 0; i < 5; i++ {
+		if err := q.enqueue(dataPacket(1, fmt.Sprintf("data%d", i))); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if q.spilled != 3 {
+		t.Errorf("expected 3 spilled packets, got %d", q.spilled)
+	}
+	if err := q.enqueue(closeResponsePacket(1)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := q.enqueue(dataPacket(1, "late")); err == nil {
+		t.Error("expected an error for DATA after CLOSE_RSP")
+	}
+
+	for i := 0; i < 5; i++ {
+		pkt, err := q.dequeue()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if want := fmt.Sprintf("data%d", i); pkt.Type != client.PacketType_DATA || string(pkt.GetData().Data) != want {
+			t.Fatalf("expected DATA %q, got %v", want, pkt)
+		}
+	}
+	if pkt, err := q.dequeue(); err != nil || pkt.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expected CLOSE_RSP, got %v, %v", pkt, err)
+	}
+	if q.spill != nil {
+		t.Error("expected the spill file to be closed once drained")
+	}
+	if pkt, err := q.dequeue(); err != nil || pkt != nil {
+		t.Errorf("expected the queue to be drained, got %v, %v", pkt, err)
+	}
+}
+
+func TestSendQueueDrop(t *testing.T) {
+	q := newSendQueue(1, SendQueueConfig{Depth: 1, Policy: SendQueueDrop})
+	if err := q.enqueue(dataPacket(1, "data")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.enqueue(dataPacket(1, "overflow")); err != errSendQueueOverflow {
+			t.Errorf("expected %v, got %v", errSendQueueOverflow, err)
+		}
+	}
+	if err := q.enqueue(closeResponsePacket(1)); err != nil {
+		t.Fatalf("expected CLOSE_RSP to be queued, got %v", err)
+	}
+	if pkt, err := q.dequeue(); err != nil || pkt.Type != client.PacketType_CLOSE_RSP {
+		t.Errorf("expected the queued DATA to be dropped before CLOSE_RSP, got %v, %v", pkt, err)
+	}
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	q := newSendQueue(1, SendQueueConfig{Depth: 1, Policy: SendQueueBlock})
+	if err := q.enqueue(dataPacket(1, "first")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	queued := make(chan error, 1)
+	go func() {
+		queued <- q.enqueue(dataPacket(1, "second"))
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("expected the full queue to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if pkt, err := q.dequeue(); err != nil || string(pkt.GetData().Data) != "first" {
+		t.Fatalf("expected DATA %q, got %v, %v", "first", pkt, err)
+	}
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the blocked packet to be queued")
+	}
+	if pkt, err := q.dequeue(); err != nil || string(pkt.GetData().Data) != "second" {
+		t.Errorf("expected DATA %q, got %v, %v", "second", pkt, err)
+	}
+}
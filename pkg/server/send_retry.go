@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// SendRetryConfig bounds the retries of packets an agent stream failed to
+// send transiently. Retries back off exponentially from InitialBackoff to
+// MaxBackoff, at most MaxRetries times per packet. Each agent stream has a
+// budget of Budget retries, regained at Budget per minute, so that a
+// failing stream is not retried forever. A stream is declared dead, which
+// ends it and closes its frontend connections, once a packet can't be
+// sent within these bounds.
+type SendRetryConfig struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Budget         int
+}
+
+// retryingStream is an agent stream retrying transient Send failures.
+type retryingStream struct {
+	agent.AgentService_ConnectServer
+
+	config SendRetryConfig
+
+	mu        sync.Mutex // mu protects tokens and refilled
+	tokens    float64    // retries left in the budget
+	refilled  time.Time  // when tokens was last refilled
+	dead      chan struct{}
+	closeDead sync.Once
+}
+
+func newRetryingStream(stream agent.AgentService_ConnectServer, config SendRetryConfig) *retryingStream {
+	return &retryingStream{
+		AgentService_ConnectServer: stream,
+		config:                     config,
+		tokens:                     float64(config.Budget),
+		refilled:                   time.Now(),
+		dead:                       make(chan struct{}),
+	}
+}
+
+// Send sends p, retrying transient failures within the bounds of the
+// config. The stream is declared dead if they are exceeded.
+func (r *retryingStream) Send(p *client.Packet) error {
+	err := r.AgentService_ConnectServer.Send(p)
+	backoff := r.config.InitialBackoff
+	for retries := 0; err != nil && r.retriable(err); retries++ {
+		if retries >= r.config.MaxRetries || !r.spend() {
+			klog.V(2).InfoS("Declaring agent stream dead after failing to send packet", "type", p.Type, "retries", retries, "error", err)
+			r.closeDead.Do(func() { close(r.dead) })
+			return err
+		}
+		klog.V(4).InfoS("Retrying to send packet to agent", "type", p.Type, "backoff", backoff, "error", err)
+		metrics.Metrics.SendRetryInc()
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > r.config.MaxBackoff {
+			backoff = r.config.MaxBackoff
+		}
+		err = r.AgentService_ConnectServer.Send(p)
+	}
+	return err
+}
+
+// Dead is closed once the stream is declared dead.
+func (r *retryingStream) Dead() <-chan struct{} {
+	return r.dead
+}
+
+// retriable reports if the Send failure err may be transient. Failures of
+// ended streams are not.
+func (r *retryingStream) retriable(err error) bool {
+	if err == io.EOF || r.Context().Err() != nil {
+		return false
+	}
+	return status.Code(err) == codes.Unavailable
+}
+
+// spend takes a retry from the budget, it reports false if it is spent.
+func (r *retryingStream) spend() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	budget := float64(r.config.Budget)
+	r.tokens += now.Sub(r.refilled).Minutes() * budget
+	if r.tokens > budget {
+		r.tokens = budget
+	}
+	r.refilled = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
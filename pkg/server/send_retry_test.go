@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// failingConnectServer fails the first failures sends with err.
+type failingConnectServer struct {
+	*fakeCapableConnectServer
+	err      error
+	failures int
+	sent     int
+}
+
+func (f *failingConnectServer) Send(*client.Packet) error {
+	if f.failures > 0 {
+		f.failures--
+		return f.err
+	}
+	f.sent++
+	return nil
+}
+
+func newFailingConnectServer(err error, failures int) *failingConnectServer {
+	return &failingConnectServer{fakeCapableConnectServer: newFakeCapableConnectServer(""), err: err, failures: failures}
+}
+
+func isDead(r *retryingStream) bool {
+	select {
+	case <-r.Dead():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRetryingStream(t *testing.T) {
+	config := SendRetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Budget: 3}
+	unavailable := status.Error(codes.Unavailable, "transport is closing")
+	pkt := &client.Packet{Type: client.PacketType_DATA}
+
+	testCases := []struct {
+		name     string
+		err      error
+		failures int
+		wantErr  bool
+		wantDead bool
+	}{
+		{name: "transient failure", err: unavailable, failures: 2},
+		{name: "retries exceeded", err: unavailable, failures: 3, wantErr: true, wantDead: true},
+		{name: "stream ended", err: io.EOF, failures: 1, wantErr: true},
+		{name: "permanent failure", err: status.Error(codes.ResourceExhausted, "message too large"), failures: 1, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newFailingConnectServer(tc.err, tc.failures)
+			r := newRetryingStream(conn, config)
+			if err := r.Send(pkt); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if dead := isDead(r); dead != tc.wantDead {
+				t.Errorf("expected dead %v, got %v", tc.wantDead, dead)
+			}
+		})
+	}
+}
+
+func TestRetryingStreamBudget(t *testing.T) {
+	config := SendRetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Budget: 3}
+	conn := newFailingConnectServer(status.Error(codes.Unavailable, "transport is closing"), 2)
+	r := newRetryingStream(conn, config)
+	pkt := &client.Packet{Type: client.PacketType_DATA}
+	if err := r.Send(pkt); err != nil {
+		t.Fatalf("expected the retries to succeed, got %v", err)
+	}
+
+	// One retry is left in the budget.
+	conn.failures = 2
+	if err := r.Send(pkt); err == nil {
+		t.Error("expected the spent budget to fail the send")
+	}
+	if !isDead(r) {
+		t.Error("expected the stream to be dead once the budget is spent")
+	}
+	if conn.sent != 1 {
+		t.Errorf("expected 1 packet sent, got %d", conn.sent)
+	}
+}
@@ -24,18 +24,24 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 	"sigs.k8s.io/apiserver-network-proxy/proto/header"
@@ -43,6 +49,10 @@ import (
 
 const xfrChannelSize = 10
 
+// DefaultPacketChunkSize is the size of the reads from HTTP CONNECT
+// frontends, matching the gRPC window size.
+const DefaultPacketChunkSize = 1 << 15
+
 type key int
 
 type ProxyClientConnection struct {
@@ -55,10 +65,108 @@ type ProxyClientConnection struct {
 	agentID   string
 	start     time.Time
 	backend   Backend
+	strategy  ProxyStrategy // strategy of the BackendManager that picked backend
+	relayed   bool          // the dial was relayed by a peer proxy server
+
+	// labelSelector sent by the frontend, selecting the agents the dial
+	// is routed through by the labelSelector strategy
+	labelSelector string
+
+	// priority of the DATA sent to the agent, sent by the frontend
+	priority client.Priority
+
+	// hello is the HELLO of the frontend, nil if it did not send one
+	hello *client.Hello
+
+	// dial budget token sent by the frontend, and the attempt and
+	// cumulative dial time accounted to it once the dial completed
+	budgetToken   string
+	budgetAttempt int
+	budgetSpent   time.Duration
+
+	// times the dial picked a backend and received the DIAL_RSP, and
+	// dialSent the UnixNano time it sent the DIAL_REQ, accessed atomically
+	// as the DIAL_RSP may be handled first
+	dialSelected  time.Time
+	dialSent      int64
+	dialResponded time.Time
+
+	// trace context sent by the frontend, and the spans of the dial and
+	// of the connection lifetime, nil unless the frontend is traced
+	traceParent string
+	dialSpan    *tracing.Span
+	connSpan    *tracing.Span
+
+	// requestedCompression is the DATA compression the server asked the
+	// agent for on behalf of this frontend, and compression the one the
+	// agent accepted. Both are empty if the frontend negotiates itself.
+	requestedCompression string
+	compression          string
+
+	// authenticated is the identity of the frontend, nil if frontends are
+	// not authenticated.
+	authenticated *FrontendIdentity
+	// allowedAgents are the agents the egress policy allows the dial to
+	// be routed through, nil allows any.
+	allowedAgents agentFilter
+
+	// Audit information about the dial, and payload bytes transferred in
+	// each direction, updated atomically.
+	identity       string
+	protocol       string
+	address        string
+	hostname       string
+	bytesToAgent   int64
+	bytesFromAgent int64
+
+	// denied is set atomically once a packet interceptor denied the
+	// connection. amu protects annotations, recorded by the interceptors
+	// with the audit events.
+	denied      int32
+	amu         sync.Mutex
+	annotations map[string]string
+
+	// bandwidth throttles the DATA of the connection, nil if it is
+	// unlimited. It is set before connected is closed.
+	bandwidth *connectionBandwidth
+
+	// sendQueue queues the packets sent to the frontend, nil if they are
+	// sent from the agent stream. It is set before connected is closed.
+	sendQueue *sendQueue
+
+	// checkpoint counts the DATA exchanged with the agent for byte-count
+	// checkpoints, nil if they are disabled. It is set before the dial
+	// is pending.
+	checkpoint *dataCheckpoint
+
+	// replay numbers the DATA sent to the agent and keeps it to be sent
+	// again if the agent resumes its session, nil if the session is not
+	// resumable. It is set before the dial is pending.
+	replay *util.ReplayBuffer
+
+	// lastActive is the UnixNano time the dial was sent or DATA last
+	// went through the connection, accessed atomically. It is 0 until
+	// the dial is pending.
+	lastActive int64
+
+	// migrationDial is the dial request of a migratable connection, sent
+	// again to the agent it migrates to, nil if it is not migratable.
+	// A migration changes backend, agentID and replay under mmu, and
+	// closes migrating once it ended; the goroutine sending the DATA of
+	// the frontend waits for it with currentBackend.
+	migrationDial *client.DialRequest
+	mmu           sync.Mutex
+	migrating     chan struct{}
 }
 
 const (
 	destHost key = iota
+	requiredCaps
+	relayedFrontend
+	dialTrack
+	dialLabelSelector
+	dialAgentFilter
+	destHostAddrs
 )
 
 func (c *ProxyClientConnection) send(pkt *client.Packet) error {
@@ -102,6 +210,9 @@ func (pm *PendingDialManager) Add(random int64, clientConn *ProxyClientConnectio
 	defer pm.mu.Unlock()
 	pm.pendingDial[random] = clientConn
 	metrics.Metrics.SetPendingDialCount(len(pm.pendingDial))
+	if clientConn != nil {
+		clientConn.touch()
+	}
 }
 
 func (pm *PendingDialManager) Get(random int64) (*ProxyClientConnection, bool) {
@@ -111,6 +222,13 @@ func (pm *PendingDialManager) Get(random int64) (*ProxyClientConnection, bool) {
 	return clientConn, ok
 }
 
+// Count returns the number of pending dials.
+func (pm *PendingDialManager) Count() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return len(pm.pendingDial)
+}
+
 func (pm *PendingDialManager) Remove(random int64) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -118,6 +236,30 @@ func (pm *PendingDialManager) Remove(random int64) {
 	metrics.Metrics.SetPendingDialCount(len(pm.pendingDial))
 }
 
+// Take removes and returns the pending dial, false if there is none. Only
+// the caller which took a pending dial responds to its frontend.
+func (pm *PendingDialManager) Take(random int64) (*ProxyClientConnection, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	clientConn, ok := pm.pendingDial[random]
+	if ok {
+		delete(pm.pendingDial, random)
+		metrics.Metrics.SetPendingDialCount(len(pm.pendingDial))
+	}
+	return clientConn, ok
+}
+
+// list returns a copy of the pending dials.
+func (pm *PendingDialManager) list() map[int64]*ProxyClientConnection {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	dials := make(map[int64]*ProxyClientConnection, len(pm.pendingDial))
+	for random, clientConn := range pm.pendingDial {
+		dials[random] = clientConn
+	}
+	return dials
+}
+
 // ProxyServer
 type ProxyServer struct {
 	// BackendManagers contains a list of BackendManagers
@@ -145,8 +287,153 @@ type ProxyServer struct {
 
 	// agent authentication
 	AgentAuthenticationOptions *AgentTokenAuthenticationOptions
+	// RequireAgentCertificate rejects agents which did not present a
+	// client certificate verified against the cluster CA, on top of the
+	// token authentication if enabled.
+	RequireAgentCertificate bool
 
 	proxyStrategies []ProxyStrategy
+
+	// DataCompression is the compression algorithm the server requests
+	// for DATA payloads exchanged with agents. Empty disables it.
+	DataCompression string
+
+	// AuditLog records dials and closes. Nil disables auditing.
+	AuditLog *AuditLogger
+
+	dialBudgets *DialBudgetTracker
+
+	// Tracer records spans of dials and connections of traced frontends.
+	// Nil disables tracing.
+	Tracer *tracing.Tracer
+
+	// PacketBuffers pools the buffers HTTP CONNECT frontends are read
+	// into, its size bounds the payload of the DATA packets sent to agents.
+	PacketBuffers *util.BufferPool
+
+	// Peers shares backend registrations with the other proxy server
+	// replicas, so that frontends are pointed to a replica with a backend
+	// if this one has none. Nil disables sharing.
+	Peers *PeerRegistry
+	// PeerAdvertiseAddress is the address frontends can reach this
+	// server at, advertised to the peers.
+	PeerAdvertiseAddress string
+	// PeerRelay relays dials without a local backend to a peer with one,
+	// instead of pointing the frontend to it. Nil disables relaying.
+	PeerRelay *PeerRelay
+	// Topology configures the topology hints returned to agents.
+	Topology TopologyConfig
+
+	// interceptors inspect the DATA payloads of every connection.
+	interceptors []PacketInterceptor
+
+	// FrontendAuthenticators authenticate the frontends of Proxy streams,
+	// any of them may succeed. Empty accepts any frontend.
+	FrontendAuthenticators []FrontendAuthenticator
+	// frontendAuthorizer is the authorizerValue holding the
+	// FrontendAuthorizer deciding which destinations the frontends may
+	// dial, a nil one allows any.
+	frontendAuthorizer atomic.Value
+	// ConnectAuthenticator authenticates the Proxy-Authorization of HTTP
+	// CONNECT requests. Nil accepts any request.
+	ConnectAuthenticator *ConnectAuthenticator
+
+	// egressPolicy is the *EgressPolicy enforced on the dials of the
+	// frontends, none if it holds nil.
+	egressPolicy atomic.Value
+
+	// CanaryPercent is the percentage of dials routed through canary
+	// agents by the strategies picking a random agent. The other dials
+	// avoid canary agents. 0 disables canary routing.
+	CanaryPercent float64
+
+	// SendRetry bounds the retries of packets agent streams failed to
+	// send. The zero value disables retrying.
+	SendRetry SendRetryConfig
+
+	// SendQueue bounds the packets queued for each frontend connection.
+	SendQueue SendQueueConfig
+
+	// PriorityWeights schedules the packets sent to each agent by the
+	// priority of their connections, nil sends them in order.
+	PriorityWeights PriorityWeights
+
+	// Sessions configures the resumption of the sessions of agents whose
+	// Connect stream broke.
+	Sessions SessionConfig
+	// smu protects sessions, the parked sessions by token.
+	smu      sync.Mutex
+	sessions map[string]*agentSession
+
+	// Migration configures the migration of connections to another agent
+	// when theirs disconnected.
+	Migration MigrationConfig
+	// mgmu protects migrations, the resumed dials waiting for their
+	// DIAL_RSP by dial ID.
+	mgmu       sync.Mutex
+	migrations map[int64]*connectionMigration
+
+	// ScaleHints configures the load figures served to autoscalers.
+	ScaleHints ScaleHintsConfig
+	// cpuUtilization is the float64 CPU utilization last sampled by
+	// RunScaleHints.
+	cpuUtilization atomic.Value
+
+	// Peaks configures the tracking of the peak load of the server.
+	Peaks PeaksConfig
+	peaks *peakTracker
+
+	// PortForward configures the destinations agents may reach through their
+	// port-forward listeners.
+	PortForward PortForwardConfig
+
+	// CircuitBreaker configures the circuit breakers skipping agents whose
+	// dials keep failing.
+	CircuitBreaker CircuitBreakerConfig
+	breakers       circuitBreakers
+
+	// DestHostResolution configures the resolution of the hostnames
+	// dialed with the destHost strategies.
+	DestHostResolution DestHostResolutionConfig
+	destHostResolver   destHostResolver
+
+	// AnomalyDetection configures the detection of frontends dialing unusual
+	// destinations.
+	AnomalyDetection AnomalyConfig
+	anomalies        anomalyDetector
+
+	// AgentConnectionAge bounds the lifetime of the Connect streams of the
+	// agents.
+	AgentConnectionAge AgentConnectionAgeConfig
+
+	// ConnJanitor configures the sweeps of the pending dials and the
+	// frontends, reaping the entries leaked by lost packets.
+	ConnJanitor ConnJanitorConfig
+
+	// MaxAgentProtocolVersion is the highest protocol version negotiated
+	// with agents, 0 is pkgagent.ProtocolVersion.
+	MaxAgentProtocolVersion int
+
+	// CheckpointInterval is how often byte-count checkpoints are
+	// exchanged with agents on each connection, to detect DATA lost
+	// between the server and the agent. 0 disables checkpoints.
+	CheckpointInterval time.Duration
+
+	// bmu protects bandwidth, the limits throttling the DATA proxied per
+	// connection and per agent, and agentBandwidth, the buckets of the
+	// connected agents.
+	bmu            sync.Mutex
+	bandwidth      BandwidthLimits
+	agentBandwidth map[string]*agentBandwidth
+
+	// amu protects agentStreams.
+	amu sync.Mutex
+	// agentStreams holds a channel per Connect stream of each agent,
+	// closed to evict the stream.
+	agentStreams map[string]map[agent.AgentService_ConnectServer]chan struct{}
+
+	// hooks are the lifecycle hooks of an embedded server.
+	hooks Hooks
 }
 
 // AgentTokenAuthenticationOptions contains list of parameters required for agent token based authentication
@@ -162,11 +449,14 @@ var _ agent.AgentServiceServer = &ProxyServer{}
 
 var _ client.ProxyServiceServer = &ProxyServer{}
 
-func genContext(proxyStrategies []ProxyStrategy, reqHost string) context.Context {
+func genContext(proxyStrategies []ProxyStrategy, reqHost, protocol string) context.Context {
 	ctx := context.Background()
+	if required := requiredCapabilities(protocol); len(required) > 0 {
+		ctx = context.WithValue(ctx, requiredCaps, required)
+	}
 	for _, ps := range proxyStrategies {
 		switch ps {
-		case ProxyStrategyDestHost:
+		case ProxyStrategyDestHost, ProxyStrategyDestHostHash:
 			addr := util.RemovePortFromHost(reqHost)
 			ctx = context.WithValue(ctx, destHost, addr)
 		}
@@ -174,20 +464,72 @@ func genContext(proxyStrategies []ProxyStrategy, reqHost string) context.Context
 	return ctx
 }
 
-func (s *ProxyServer) getBackend(reqHost string) (Backend, error) {
-	ctx := genContext(s.proxyStrategies, reqHost)
-	for _, bm := range s.BackendManagers {
-		be, err := bm.Backend(ctx)
-		if err == nil {
-			return be, nil
+// getBackend picks a backend for a dial and returns the strategy of the
+// BackendManager it was picked by. labelSelector selects the agents the
+// labelSelector strategy picks from, it is ignored if empty. All strategies
+// only pick agents allowed, unless it is nil, and below the connection
+// capacity they advertised. With zone affinity, agents in the zone of the
+// server are preferred. The destHost strategies may route hostnames by
+// the addresses they resolve to, see DestHostResolutionConfig.
+func (s *ProxyServer) getBackend(reqHost, protocol, labelSelector string, allowed agentFilter) (Backend, ProxyStrategy, error) {
+	ctx := genContext(s.proxyStrategies, reqHost, protocol)
+	if host, _ := ctx.Value(destHost).(string); host != "" {
+		ctx = s.resolveDestHost(ctx, host)
+	}
+	if track := s.pickTrack(); track != "" {
+		ctx = context.WithValue(ctx, dialTrack, track)
+	}
+	capacity := &capacityFilter{s: s, allowed: s.agentFilter(allowed)}
+	filters := []agentFilter{capacity.filter}
+	zones := s.routeZone(capacity)
+	if zones != nil {
+		filters = zones.filters(capacity.filter)
+	}
+	if labelSelector != "" {
+		selector, err := labels.Parse(labelSelector)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid label selector %q: %v", labelSelector, err)
 		}
-		if ignoreNotFound(err) != nil {
-			// if can't find a backend through current BackendManager, move on
-			// to the next one
-			return nil, err
+		ctx = context.WithValue(ctx, dialLabelSelector, selector)
+	}
+	var missingErr *ErrMissingCapabilities
+	for _, bm := range s.BackendManagers {
+		// with zone affinity, each BackendManager picks from the agents
+		// of the preferred zone first
+		for _, filter := range filters {
+			be, err := bm.Backend(context.WithValue(ctx, dialAgentFilter, filter))
+			if err == nil {
+				if zones != nil {
+					zones.observe(be)
+				}
+				return be, backendManagerStrategy(bm), nil
+			}
+			if e, ok := err.(*ErrMissingCapabilities); ok {
+				// agents are available but not capable, try the next
+				// BackendManager and report the missing capabilities if
+				// none has a capable agent
+				if missingErr == nil {
+					missingErr = e
+				}
+				continue
+			}
+			if ignoreNotFound(err) != nil {
+				// if can't find a backend through current BackendManager, move on
+				// to the next one
+				return nil, "", err
+			}
 		}
 	}
-	return nil, &ErrNotFound{}
+	if missingErr != nil {
+		return nil, "", missingErr
+	}
+	if capacity.saturated {
+		return nil, "", &ErrAgentsSaturated{}
+	}
+	if err := s.peerLookup(reqHost); err != nil {
+		return nil, "", err
+	}
+	return nil, "", &ErrNotFound{}
 }
 
 func (s *ProxyServer) addBackend(agentID string, conn agent.AgentService_ConnectServer) (backend Backend) {
@@ -200,15 +542,15 @@ func (s *ProxyServer) addBackend(agentID string, conn agent.AgentService_Connect
 				break
 			}
 			for _, ipv4 := range agentIdentifiers.IPv4 {
-				klog.V(5).InfoS("Add the agent to DestHostBackendManager", "agent address", ipv4)
+				util.V(util.LogBackendManager, 5).InfoS("Add the agent to DestHostBackendManager", "agent address", ipv4)
 				s.BackendManagers[i].AddBackend(ipv4, pkgagent.IPv4, conn)
 			}
 			for _, ipv6 := range agentIdentifiers.IPv6 {
-				klog.V(5).InfoS("Add the agent to DestHostBackendManager", "agent address", ipv6)
+				util.V(util.LogBackendManager, 5).InfoS("Add the agent to DestHostBackendManager", "agent address", ipv6)
 				s.BackendManagers[i].AddBackend(ipv6, pkgagent.IPv6, conn)
 			}
 			for _, host := range agentIdentifiers.Host {
-				klog.V(5).InfoS("Add the agent to DestHostBackendManager", "agent address", host)
+				util.V(util.LogBackendManager, 5).InfoS("Add the agent to DestHostBackendManager", "agent address", host)
 				s.BackendManagers[i].AddBackend(host, pkgagent.Host, conn)
 			}
 		case *DefaultRouteBackendManager:
@@ -218,11 +560,11 @@ func (s *ProxyServer) addBackend(agentID string, conn agent.AgentService_Connect
 				break
 			}
 			if agentIdentifiers.DefaultRoute {
-				klog.V(5).InfoS("Add the agent to DefaultRouteBackendManager", "agentID", agentID)
+				util.V(util.LogBackendManager, 5).InfoS("Add the agent to DefaultRouteBackendManager", "agentID", agentID)
 				backend = s.BackendManagers[i].AddBackend(agentID, pkgagent.DefaultRoute, conn)
 			}
 		default:
-			klog.V(5).InfoS("Add the agent to DefaultBackendManager", "agentID", agentID)
+			util.V(util.LogBackendManager, 5).InfoS("Add the agent to DefaultBackendManager", "agentID", agentID)
 			backend = s.BackendManagers[i].AddBackend(agentID, pkgagent.UID, conn)
 		}
 	}
@@ -239,15 +581,15 @@ func (s *ProxyServer) removeBackend(agentID string, conn agent.AgentService_Conn
 				break
 			}
 			for _, ipv4 := range agentIdentifiers.IPv4 {
-				klog.V(5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", ipv4)
+				util.V(util.LogBackendManager, 5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", ipv4)
 				bm.RemoveBackend(ipv4, pkgagent.IPv4, conn)
 			}
 			for _, ipv6 := range agentIdentifiers.IPv6 {
-				klog.V(5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", ipv6)
+				util.V(util.LogBackendManager, 5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", ipv6)
 				bm.RemoveBackend(ipv6, pkgagent.IPv6, conn)
 			}
 			for _, host := range agentIdentifiers.Host {
-				klog.V(5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", host)
+				util.V(util.LogBackendManager, 5).InfoS("Remove the agent from the DestHostBackendManager", "agentHost", host)
 				bm.RemoveBackend(host, pkgagent.Host, conn)
 			}
 		case *DefaultRouteBackendManager:
@@ -257,18 +599,19 @@ func (s *ProxyServer) removeBackend(agentID string, conn agent.AgentService_Conn
 				break
 			}
 			if agentIdentifiers.DefaultRoute {
-				klog.V(5).InfoS("Remove the agent from the DefaultRouteBackendManager", "agentID", agentID)
+				util.V(util.LogBackendManager, 5).InfoS("Remove the agent from the DefaultRouteBackendManager", "agentID", agentID)
 				bm.RemoveBackend(agentID, pkgagent.DefaultRoute, conn)
 			}
 		default:
-			klog.V(5).InfoS("Remove the agent from the DefaultBackendManager", "agentID", agentID)
+			util.V(util.LogBackendManager, 5).InfoS("Remove the agent from the DefaultBackendManager", "agentID", agentID)
 			bm.RemoveBackend(agentID, pkgagent.UID, conn)
 		}
 	}
 }
 
 func (s *ProxyServer) addFrontend(agentID string, connID int64, p *ProxyClientConnection) {
-	klog.V(2).InfoS("Register frontend for agent", "frontend", p, "agentID", agentID, "connectionID", connID)
+	util.V(util.LogFrontend, 2).InfoS("Register frontend for agent", "frontend", p, "agentID", agentID, "connectionID", connID)
+	p.touch()
 	s.fmu.Lock()
 	defer s.fmu.Unlock()
 	if _, ok := s.frontends[agentID]; !ok {
@@ -277,24 +620,35 @@ func (s *ProxyServer) addFrontend(agentID string, connID int64, p *ProxyClientCo
 	s.frontends[agentID][connID] = p
 }
 
-func (s *ProxyServer) removeFrontend(agentID string, connID int64) {
+// removeFrontend removes the frontend, returning false if it was already
+// removed. Only the caller which removed a frontend sends it CLOSE_RSP.
+func (s *ProxyServer) removeFrontend(agentID string, connID int64) bool {
+	var removed *ProxyClientConnection
+	defer func() {
+		// audit after releasing fmu
+		if removed != nil {
+			finishConnectionSpan(removed)
+			s.auditClose(removed)
+		}
+	}()
 	s.fmu.Lock()
 	defer s.fmu.Unlock()
 	conns, ok := s.frontends[agentID]
 	if !ok {
-		klog.V(2).InfoS("Cannot find agent in the frontends", "agentID", agentID)
-		return
+		util.V(util.LogFrontend, 2).InfoS("Cannot find agent in the frontends", "agentID", agentID)
+		return false
 	}
 	if _, ok := conns[connID]; !ok {
-		klog.V(2).InfoS("Cannot find connection for agent in the frontends", "connectionID", connID, "agentID", agentID)
-		return
+		util.V(util.LogFrontend, 2).InfoS("Cannot find connection for agent in the frontends", "connectionID", connID, "agentID", agentID)
+		return false
 	}
-	klog.V(2).InfoS("Remove frontend for agent", "frontend", conns[connID], "agentID", agentID, "connectionID", connID)
+	util.V(util.LogFrontend, 2).InfoS("Remove frontend for agent", "frontend", conns[connID], "agentID", agentID, "connectionID", connID)
+	removed = conns[connID]
 	delete(s.frontends[agentID], connID)
 	if len(s.frontends[agentID]) == 0 {
 		delete(s.frontends, agentID)
 	}
-	return
+	return true
 }
 
 func (s *ProxyServer) getFrontend(agentID string, connID int64) (*ProxyClientConnection, error) {
@@ -311,6 +665,35 @@ func (s *ProxyServer) getFrontend(agentID string, connID int64) (*ProxyClientCon
 	return conn, nil
 }
 
+// streamFrontend returns the frontend of connection connID dialed through
+// the frontend stream, nil if it is not registered.
+func (s *ProxyServer) streamFrontend(stream client.ProxyService_ProxyServer, connID int64) *ProxyClientConnection {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	for _, conns := range s.frontends {
+		if frontend, ok := conns[connID]; ok && frontend.Mode == "grpc" && frontend.Grpc == stream {
+			return frontend
+		}
+	}
+	return nil
+}
+
+// streamFrontends returns the frontends of the connections dialed through
+// the grpc stream.
+func (s *ProxyServer) streamFrontends(stream client.ProxyService_ProxyServer) []*ProxyClientConnection {
+	var ret []*ProxyClientConnection
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	for _, conns := range s.frontends {
+		for _, frontend := range conns {
+			if frontend.Mode == "grpc" && frontend.Grpc == stream {
+				ret = append(ret, frontend)
+			}
+		}
+	}
+	return ret
+}
+
 func (s *ProxyServer) getFrontendsForBackendConn(agentID string, backend Backend) ([]*ProxyClientConnection, error) {
 	var ret []*ProxyClientConnection
 	s.fmu.RLock()
@@ -334,10 +717,14 @@ func NewProxyServer(serverID string, proxyStrategies []ProxyStrategy, serverCoun
 		switch ps {
 		case ProxyStrategyDestHost:
 			bms = append(bms, NewDestHostBackendManager())
+		case ProxyStrategyDestHostHash:
+			bms = append(bms, NewDestHostHashBackendManager())
 		case ProxyStrategyDefault:
 			bms = append(bms, NewDefaultBackendManager())
 		case ProxyStrategyDefaultRoute:
 			bms = append(bms, NewDefaultRouteBackendManager())
+		case ProxyStrategyLabelSelector:
+			bms = append(bms, NewLabelSelectorBackendManager())
 		default:
 			klog.V(4).InfoS("Unknonw proxy strategy", "strategy", ps)
 		}
@@ -346,6 +733,9 @@ func NewProxyServer(serverID string, proxyStrategies []ProxyStrategy, serverCoun
 	return &ProxyServer{
 		frontends:                  make(map[string](map[int64]*ProxyClientConnection)),
 		PendingDial:                NewPendingDialManager(),
+		peaks:                      newPeakTracker(),
+		ConnJanitor:                ConnJanitorConfig{Interval: DefaultConnJanitorInterval},
+		Topology:                   TopologyConfig{ZoneLabel: DefaultTopologyZoneLabel, SpilloverThreshold: DefaultSpilloverThreshold},
 		serverID:                   serverID,
 		serverCount:                serverCount,
 		BackendManagers:            bms,
@@ -354,6 +744,8 @@ func NewProxyServer(serverID string, proxyStrategies []ProxyStrategy, serverCoun
 		Readiness:          bms[0],
 		proxyStrategies:    proxyStrategies,
 		warnOnChannelLimit: warnOnChannelLimit,
+		dialBudgets:        NewDialBudgetTracker(dialBudgetTTL),
+		PacketBuffers:      util.NewBufferPool(DefaultPacketChunkSize),
 	}
 }
 
@@ -367,15 +759,21 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 		return fmt.Errorf("failed to get context")
 	}
 	userAgent := md.Get(header.UserAgent)
-	klog.V(2).InfoS("proxy request from client", "userAgent", userAgent)
+	util.V(util.LogFrontend, 2).InfoS("proxy request from client", "userAgent", userAgent)
+
+	identity, err := s.authenticateFrontend(stream.Context())
+	if err != nil {
+		klog.ErrorS(err, "Frontend authentication failed", "userAgent", userAgent, "serverID", s.serverID)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
 
 	recvCh := make(chan *client.Packet, xfrChannelSize)
 	stopCh := make(chan error)
 
-	go s.serveRecvFrontend(stream, recvCh)
+	go s.serveRecvFrontend(stream, recvCh, identity)
 
 	defer func() {
-		klog.V(2).InfoS("Receive channel on Proxy is stopping", "userAgent", userAgent, "serverID", s.serverID)
+		util.V(util.LogFrontend, 2).InfoS("Receive channel on Proxy is stopping", "userAgent", userAgent, "serverID", s.serverID)
 		close(recvCh)
 	}()
 
@@ -384,13 +782,13 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
-				klog.V(2).InfoS("Stream closed on Proxy", "userAgent", userAgent, "serverID", s.serverID)
+				util.V(util.LogFrontend, 2).InfoS("Stream closed on Proxy", "userAgent", userAgent, "serverID", s.serverID)
 				close(stopCh)
 				return
 			}
 			if err != nil {
 				if status.Code(err) == codes.Canceled {
-					klog.V(2).InfoS("Stream read from frontend cancelled", "userAgent", userAgent, "serverID", s.serverID)
+					util.V(util.LogFrontend, 2).InfoS("Stream read from frontend cancelled", "userAgent", userAgent, "serverID", s.serverID)
 				} else {
 					klog.ErrorS(err, "Stream read from frontend failure", "userAgent", userAgent, "serverID", s.serverID)
 				}
@@ -400,7 +798,7 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 			}
 
 			if s.warnOnChannelLimit && len(recvCh) >= xfrChannelSize {
-				klog.V(2).InfoS("Receive channel on Proxy is full", "userAgent", userAgent, "serverID", s.serverID)
+				util.V(util.LogFrontend, 2).InfoS("Receive channel on Proxy is full", "userAgent", userAgent, "serverID", s.serverID)
 			}
 			recvCh <- in
 		}
@@ -409,128 +807,221 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 	return <-stopCh
 }
 
-func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer, recvCh <-chan *client.Packet) {
-	klog.V(4).Infoln("start serving frontend stream")
+func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer, recvCh <-chan *client.Packet, identity *FrontendIdentity) {
+	util.V(util.LogFrontend, 4).Infoln("start serving frontend stream")
 
 	var firstConnID int64
 	// The first packet should be a DIAL_REQ, we will randomly get a
 	// backend from the BackendManger then.
 	var backend Backend
+	var frontend *ProxyClientConnection
+	var hello *client.Hello
 	var err error
+	// conns are the frontends of the connections the DATA of the stream
+	// was sent on, as a stream may carry several connections.
+	conns := make(map[int64]*ProxyClientConnection)
 
 	for pkt := range recvCh {
 		switch pkt.Type {
 		case client.PacketType_DIAL_REQ:
-			klog.V(5).Infoln("Received DIAL_REQ")
+			util.V(util.LogFrontend, 5).Infoln("Received DIAL_REQ")
 			random := pkt.GetDialRequest().Random
+			frontend = &ProxyClientConnection{
+				Mode:          "grpc",
+				Grpc:          stream,
+				connected:     make(chan struct{}),
+				start:         time.Now(),
+				identity:      grpcFrontendIdentity(stream.Context()),
+				budgetToken:   pkt.GetDialRequest().Metadata[header.DialBudgetToken],
+				relayed:       isRelayed(stream.Context()),
+				labelSelector: pkt.GetDialRequest().Metadata[header.DialLabelSelector],
+				priority:      pkt.GetDialRequest().Priority,
+				hello:         hello,
+				authenticated: identity,
+			}
+			if identity != nil {
+				frontend.identity = identity.Name
+			}
+			s.auditDialRequest(pkt.GetDialRequest(), frontend)
+			s.observeDestination(frontend, pkt.GetDialRequest().Address)
+			s.startDialSpan(pkt.GetDialRequest(), frontend)
 			// TODO: if we track what agent has historically served
 			// the address, then we can send the Dial_REQ to the
 			// same agent. That way we save the agent from creating
 			// a new connection to the address.
-			backend, err = s.getBackend(pkt.GetDialRequest().Address)
+			if err = s.authorizeDial(frontend, pkt.GetDialRequest().Protocol, pkt.GetDialRequest().Address, pkt.GetDialRequest().Candidates); err == nil {
+				backend, frontend.strategy, err = s.getBackendOrRelay(frontend, pkt.GetDialRequest().Address, pkt.GetDialRequest().Protocol)
+			}
 			if err != nil {
-				klog.ErrorS(err, "Failed to get a backend", "serverID", s.serverID, "dialID", random)
+				klog.ErrorS(err, "Failed to get a backend", "serverID", s.serverID, "dialID", random, "hostname", pkt.GetDialRequest().Hostname)
+				s.observeDial(frontend, "", backendErrorCategory(err))
+				s.auditDialResponse(random, 0, frontend, "", err.Error())
 
 				resp := &client.Packet{
 					Type: client.PacketType_DIAL_RSP,
 					Payload: &client.Packet_DialResponse{
 						DialResponse: &client.DialResponse{
-							Random: random,
-							Error:  err.Error(),
+							Random:    random,
+							Error:     err.Error(),
+							ErrorCode: dialErrorCode(err),
 						},
 					},
 				}
 				if err := stream.Send(resp); err != nil {
-					klog.V(5).InfoS("Failed to send DIAL_RSP for no backend", "error", err, "serverID", s.serverID, "dialID", random)
+					util.V(util.LogFrontend, 5).InfoS("Failed to send DIAL_RSP for no backend", "error", err, "serverID", s.serverID, "dialID", random)
+				}
+				if code := resp.GetDialResponse().ErrorCode; code == client.DialErrorCode_DIAL_ERROR_NO_AGENT || code == client.DialErrorCode_DIAL_ERROR_AGENTS_SATURATED {
+					// The frontend may retry the dial on this
+					// stream once an agent is available.
+					continue
 				}
 				// The Dial is failing; no reason to keep this goroutine.
 				return
 			}
-			s.PendingDial.Add(
-				random,
-				&ProxyClientConnection{
-					Mode:      "grpc",
-					Grpc:      stream,
-					connected: make(chan struct{}),
-					start:     time.Now(),
-					backend:   backend,
-				})
+			frontend.backend = backend
+			frontend.dialSelected = time.Now()
+			s.requestCompression(pkt.GetDialRequest(), frontend)
+			s.requestCheckpoints(pkt.GetDialRequest(), backend, frontend)
+			s.prepareReplay(backend, frontend)
+			if !frontend.relayed {
+				// relayed dials were attested by the relaying peer
+				s.attestDialMetadata(pkt.GetDialRequest(), frontend.Mode, frontend.identity)
+			}
+			s.prepareMigration(pkt.GetDialRequest(), frontend)
+			s.PendingDial.Add(random, frontend)
 			if err := backend.Send(pkt); err != nil {
 				klog.ErrorS(err, "DIAL_REQ to Backend failed", "serverID", s.serverID, "dialID", random)
 			} else {
-				klog.V(5).InfoS("DIAL_REQ sent to backend", "serverID", s.serverID, "dialID", random)
+				markDialSent(frontend)
+				util.V(util.LogFrontend, 5).InfoS("DIAL_REQ sent to backend", "serverID", s.serverID, "dialID", random)
 			}
 
 		case client.PacketType_CLOSE_REQ:
 			connID := pkt.GetCloseRequest().ConnectID
-			klog.V(5).InfoS("Received CLOSE_REQ", "connectionID", connID)
+			util.V(util.LogFrontend, 5).InfoS("Received CLOSE_REQ", "connectionID", connID)
 			if backend == nil {
-				klog.V(2).InfoS("Backend has not been initialized for requested connection. Client should send a Dial Request first",
+				util.V(util.LogFrontend, 2).InfoS("Backend has not been initialized for requested connection. Client should send a Dial Request first",
 					"serverID", s.serverID, "connectionID", connID)
 				continue
 			}
+			if frontend != nil && frontend.migrationDial != nil {
+				backend = frontend.currentBackend()
+			}
+			delete(conns, connID)
 			if err := backend.Send(pkt); err != nil {
 				// TODO: retry with other backends connecting to this agent.
 				klog.ErrorS(err, "CLOSE_REQ to Backend failed", "serverID", s.serverID, "connectionID", connID)
 			} else {
-				klog.V(5).InfoS("CLOSE_REQ sent to backend", "serverID", s.serverID, "connectionID", connID)
+				util.V(util.LogFrontend, 5).InfoS("CLOSE_REQ sent to backend", "serverID", s.serverID, "connectionID", connID)
 			}
 
 		case client.PacketType_DIAL_CLS:
 			random := pkt.GetCloseDial().Random
-			klog.V(5).InfoS("Received DIAL_CLOSE", "serverID", s.serverID, "dialID", random)
+			util.V(util.LogFrontend, 5).InfoS("Received DIAL_CLOSE", "serverID", s.serverID, "dialID", random)
 			// Currently not worrying about backend as we do not have an established connection,
-			s.PendingDial.Remove(random)
-			klog.V(5).InfoS("Removing pending dial request", "serverID", s.serverID, "dialID", random)
+			if pending, ok := s.PendingDial.Take(random); ok {
+				s.observeDial(pending, "", dialErrorCanceled)
+				s.audit(&AuditEvent{Type: AuditDialCanceled, DialID: random}, pending)
+			}
+			util.V(util.LogFrontend, 5).InfoS("Removing pending dial request", "serverID", s.serverID, "dialID", random)
 
 		case client.PacketType_DATA:
 			connID := pkt.GetData().ConnectID
 			data := pkt.GetData().Data
-			klog.V(5).InfoS("Received data from connection", "bytes", len(data), "connectionID", connID)
+			util.V(util.LogFrontend, 5).InfoS("Received data from connection", "bytes", len(data), "connectionID", connID)
 			if firstConnID == 0 {
 				firstConnID = connID
 			} else if firstConnID != connID {
-				klog.V(5).InfoS("Data does not match first connection id", "fistConnectionID", firstConnID, "connectionID", connID)
+				util.V(util.LogFrontend, 5).InfoS("Data does not match first connection id", "fistConnectionID", firstConnID, "connectionID", connID)
 			}
 
 			if backend == nil {
-				klog.V(2).InfoS("Backend has not been initialized for the connection. Client should send a Dial Request first", "connectionID", connID)
+				util.V(util.LogFrontend, 2).InfoS("Backend has not been initialized for the connection. Client should send a Dial Request first", "connectionID", connID)
 				continue
 			}
+			// The DATA is numbered and accounted by the frontend of its
+			// connection. Until the connection is registered, which
+			// happens right after its DIAL_RSP is sent, it can only be
+			// the one dialed last.
+			conn := frontend
+			if frontend != nil {
+				if c, ok := conns[connID]; ok {
+					conn = c
+				} else if c := s.streamFrontend(stream, connID); c != nil {
+					conns[connID] = c
+					conn = c
+				}
+			}
+			if conn != nil {
+				if conn.migrationDial != nil {
+					backend = conn.currentBackend()
+				}
+				if !s.interceptData(conn, DirectionToAgent, pkt) {
+					continue
+				}
+				atomic.AddInt64(&conn.bytesToAgent, int64(len(data)))
+				s.peaks.addBytes(len(data))
+				conn.touch()
+				select {
+				case <-conn.connected:
+					// compression has been settled by the DIAL_RSP
+					compressData(conn, pkt)
+					throttleToAgent(conn, len(data))
+				default:
+				}
+				if conn.replay != nil {
+					conn.replay.Add(pkt)
+				}
+			}
 			if err := backend.Send(pkt); err != nil {
 				// TODO: retry with other backends connecting to this agent.
 				klog.ErrorS(err, "DATA to Backend failed", "serverID", s.serverID, "connectionID", connID)
 				continue
 			}
-			klog.V(5).Infoln("DATA sent to Backend")
+			util.V(util.LogFrontend, 5).Infoln("DATA sent to Backend")
+			if conn != nil {
+				checkpointToAgent(backend, conn, connID, len(data))
+			}
+
+		case client.PacketType_HELLO:
+			hello = pkt.GetHello()
+			s.handleFrontendHello(stream, hello)
 
 		default:
-			klog.V(5).InfoS("Ignore packet coming from frontend",
+			util.V(util.LogFrontend, 5).InfoS("Ignore packet coming from frontend",
 				"type", pkt.Type, "serverID", s.serverID, "connectionID", firstConnID)
 		}
 	}
 
-	klog.V(5).InfoS("Close streaming", "serverID", s.serverID, "connectionID", firstConnID)
+	util.V(util.LogFrontend, 5).InfoS("Close streaming", "serverID", s.serverID, "connectionID", firstConnID)
 
-	pkt := &client.Packet{
-		Type: client.PacketType_CLOSE_REQ,
-		Payload: &client.Packet_CloseRequest{
-			CloseRequest: &client.CloseRequest{
-				ConnectID: firstConnID,
-			},
-		},
+	// The client went away, close every connection it dialed over the
+	// stream, including those it never sent DATA on.
+	firstClosed := false
+	for _, conn := range s.streamFrontends(stream) {
+		if err := conn.currentBackend().Send(closeRequestPacket(conn.connectID)); err != nil {
+			klog.ErrorS(err, "CLOSE_REQ to Backend failed", "serverID", s.serverID, "connectionID", conn.connectID)
+		}
+		firstClosed = firstClosed || conn.connectID == firstConnID
+	}
+	if firstClosed {
+		return
 	}
 
+	pkt := closeRequestPacket(firstConnID)
 	if backend == nil {
-		klog.V(2).InfoS("Backend has not been initialized for requested connection. Client should send a Dial Request first", "connectionID", firstConnID)
+		util.V(util.LogFrontend, 2).InfoS("Backend has not been initialized for requested connection. Client should send a Dial Request first", "connectionID", firstConnID)
 		return
 	}
+	if frontend != nil && frontend.migrationDial != nil {
+		backend = frontend.currentBackend()
+	}
 	if err := backend.Send(pkt); err != nil {
 		klog.ErrorS(err, "CLOSE_REQ to Backend failed", "serverID", s.serverID)
 	}
 }
 
-func agentID(stream agent.AgentService_ConnectServer) (string, error) {
+func agentID(stream grpc.ServerStream) (string, error) {
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
 		return "", fmt.Errorf("failed to get context")
@@ -633,6 +1124,42 @@ func (s *ProxyServer) authenticateAgentViaToken(ctx context.Context) error {
 	return nil
 }
 
+// authenticateAgentViaCertificate checks that the agent presented a client
+// certificate, verified during the TLS handshake.
+func authenticateAgentViaCertificate(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return fmt.Errorf("Failed to retrieve peer from context")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return fmt.Errorf("connection is not secured by TLS")
+	}
+	if len(tlsInfo.State.VerifiedChains) == 0 {
+		return fmt.Errorf("no verified client certificate")
+	}
+	klog.V(2).InfoS("Client successfully authenticated via certificate", "commonName", tlsIdentity(&tlsInfo.State))
+	return nil
+}
+
+// authenticateAgent authenticates the agent by certificate and token, as
+// configured.
+func (s *ProxyServer) authenticateAgent(ctx context.Context, agentID string) error {
+	if s.RequireAgentCertificate {
+		if err := authenticateAgentViaCertificate(ctx); err != nil {
+			klog.ErrorS(err, "Client authentication failed", "agentID", agentID)
+			return err
+		}
+	}
+	if s.AgentAuthenticationOptions.Enabled {
+		if err := s.authenticateAgentViaToken(ctx); err != nil {
+			klog.ErrorS(err, "Client authentication failed", "agentID", agentID)
+			return err
+		}
+	}
+	return nil
+}
+
 // Connect is for agent to connect to ProxyServer as next hop
 func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 	metrics.Metrics.ConnectionInc(metrics.Connect)
@@ -643,39 +1170,85 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 		return err
 	}
 
-	klog.V(2).InfoS("Connect request from agent", "agentID", agentID)
+	util.V(util.LogAgentStream, 2).InfoS("Connect request from agent", "agentID", agentID)
 
-	if s.AgentAuthenticationOptions.Enabled {
-		if err := s.authenticateAgentViaToken(stream.Context()); err != nil {
-			klog.ErrorS(err, "Client authentication failed", "agentID", agentID)
-			return err
-		}
+	if err := s.authenticateAgent(stream.Context(), agentID); err != nil {
+		return err
 	}
 
-	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.serverCount))
+	session, resumed := s.openSession(agentID, stream)
+	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.serverCount),
+		header.ProtocolVersion, strconv.Itoa(s.agentProtocolVersion(stream.Context())))
+	if session.token != "" {
+		h.Append(header.SessionToken, session.token)
+	}
+	if resumed {
+		h.Append(header.SessionResumed, "true")
+	}
+	var aged <-chan time.Time
+	if lifetime := s.AgentConnectionAge.lifetime(); lifetime > 0 {
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		aged = timer.C
+		h.Append(header.ConnectionDeadline, time.Now().Add(lifetime).Format(time.RFC3339))
+	}
+	s.appendTopologyHints(stream.Context(), agentID, h)
 	if err := stream.SendHeader(h); err != nil {
 		klog.ErrorS(err, "Failed to send server count back to agent", "agentID", agentID)
+		if resumed {
+			s.parkSession(session)
+		}
 		return err
 	}
+	klog.InfoS("Agent connected", "agentID", agentID, "serverID", s.serverID, "protocolVersion", s.agentProtocolVersion(stream.Context()),
+		"capabilities", pkgagent.FormatCapabilities(contextCapabilities(stream.Context())), "resumed", resumed)
+	s.hooks.agentConnected(agentID)
+	defer s.hooks.agentDisconnected(agentID)
+
+	// Packets are sent through the backends of the retrying stream,
+	// scheduled by priority if enabled.
+	retrying := newRetryingStream(stream, s.SendRetry)
+	stream = retrying
+	if s.PriorityWeights != nil {
+		stream = newPriorityStream(stream, s.PriorityWeights, func(connID int64) client.Priority {
+			frontend, err := s.getFrontend(agentID, connID)
+			if err != nil {
+				return client.Priority_PRIORITY_UNSPECIFIED
+			}
+			return frontend.priority
+		})
+	}
 
-	backend := s.addBackend(agentID, stream)
-	defer s.removeBackend(agentID, stream)
-
-	recvCh := make(chan *client.Packet, xfrChannelSize)
-
-	go s.serveRecvBackend(backend, stream, agentID, recvCh)
-
-	defer func() {
-		klog.V(2).InfoS("Receive channel on Connect is stopping", "agentID", agentID, "serverID", s.serverID)
-		close(recvCh)
-	}()
+	if resumed {
+		if err := s.resumeSession(session, stream); err != nil {
+			klog.ErrorS(err, "Failed to resume agent session", "agentID", agentID)
+			s.parkSession(session)
+			return err
+		}
+		util.V(util.LogAgentStream, 2).InfoS("Resumed agent session", "agentID", agentID, "serverID", s.serverID)
+		metrics.Metrics.SessionResumptionInc(metrics.SessionResumed)
+	} else {
+		s.startSession(session, stream)
+	}
 
-	stopCh := make(chan error)
+	// The receiving goroutine closes recvDone, an evicted stream returns
+	// before it and stream.Recv only fails once Connect returned.
+	recvDone := make(chan struct{})
+	session.recvDone = recvDone
+	acks := util.NewAckQueue()
+	go acks.Run(recvDone, func(ack *client.Packet) {
+		s.sendAck(session.backend, agentID, ack)
+	})
+	stopCh := make(chan error, 1)
 	go func() {
+		defer func() {
+			util.V(util.LogAgentStream, 2).InfoS("Receive channel on Connect is stopping", "agentID", agentID, "serverID", s.serverID)
+			close(recvDone)
+		}()
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
-				klog.V(2).InfoS("Stream closed on Connect", "agentID", agentID, "serverID", s.serverID)
+				util.V(util.LogAgentStream, 2).InfoS("Stream closed on Connect", "agentID", agentID, "serverID", s.serverID)
 				close(stopCh)
 				return
 			}
@@ -685,15 +1258,97 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 				close(stopCh)
 				return
 			}
+			deliver, ack := session.recordReceived(in)
+			if ack != nil {
+				acks.Add(ack)
+			}
+			if !deliver {
+				util.V(util.LogAgentStream, 4).InfoS("Dropping DATA out of sequence", "agentID", agentID, "connectionID", in.GetData().ConnectID, "seq", in.GetData().Seq)
+				continue
+			}
 
-			if s.warnOnChannelLimit && len(recvCh) >= xfrChannelSize {
-				klog.V(2).InfoS("Receive channel on Connect is full", "agentID", agentID, "serverID", s.serverID)
+			if s.warnOnChannelLimit && len(session.recvCh) >= xfrChannelSize {
+				util.V(util.LogAgentStream, 2).InfoS("Receive channel on Connect is full", "agentID", agentID, "serverID", s.serverID)
 			}
-			recvCh <- in
+			session.recvCh <- in
 		}
 	}()
 
-	return <-stopCh
+	evicted := false
+	select {
+	case err = <-stopCh:
+	case <-session.evictCh:
+		util.V(util.LogAgentStream, 2).InfoS("Evicted agent stream on Connect", "agentID", agentID, "serverID", s.serverID)
+		evicted = true
+		err = status.Error(codes.Unavailable, "agent connection evicted by the proxy server")
+	case <-retrying.Dead():
+		util.V(util.LogAgentStream, 2).InfoS("Ending agent stream failing to send packets on Connect", "agentID", agentID, "serverID", s.serverID)
+		metrics.Metrics.AgentEvictionInc(metrics.EvictionSendFailure)
+		err = status.Error(codes.Unavailable, "agent connection failed to send packets")
+	case <-aged:
+		util.V(util.LogAgentStream, 2).InfoS("Ending agent stream which reached its maximum age on Connect", "agentID", agentID, "serverID", s.serverID, "resumable", session.token != "")
+		metrics.Metrics.AgentEvictionInc(metrics.EvictionMaxAge)
+		if session.token == "" {
+			s.drainSession(session, stopCh)
+		}
+		err = status.Error(codes.Unavailable, "agent connection reached its maximum age")
+	}
+	if session.token == "" || evicted {
+		s.closeSession(session)
+	} else {
+		util.V(util.LogAgentStream, 2).InfoS("Keeping the agent session for resumption", "agentID", agentID, "serverID", s.serverID, "grace", s.Sessions.Grace)
+		s.parkSession(session)
+	}
+	return err
+}
+
+func (s *ProxyServer) trackAgentStream(agentID string, stream agent.AgentService_ConnectServer) <-chan struct{} {
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	if s.agentStreams == nil {
+		s.agentStreams = make(map[string]map[agent.AgentService_ConnectServer]chan struct{})
+	}
+	if s.agentStreams[agentID] == nil {
+		s.agentStreams[agentID] = make(map[agent.AgentService_ConnectServer]chan struct{})
+	}
+	evictCh := make(chan struct{})
+	s.agentStreams[agentID][stream] = evictCh
+	return evictCh
+}
+
+func (s *ProxyServer) untrackAgentStream(agentID string, stream agent.AgentService_ConnectServer) {
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	delete(s.agentStreams[agentID], stream)
+	if len(s.agentStreams[agentID]) == 0 {
+		delete(s.agentStreams, agentID)
+	}
+}
+
+// connectedAgents returns the IDs of the agents with a Connect stream.
+func (s *ProxyServer) connectedAgents() []string {
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	agentIDs := make([]string, 0, len(s.agentStreams))
+	for agentID := range s.agentStreams {
+		agentIDs = append(agentIDs, agentID)
+	}
+	return agentIDs
+}
+
+// EvictAgent ends the Connect streams of agentID, which removes its
+// backends and closes the frontends connected through them. It returns the
+// number of evicted streams.
+func (s *ProxyServer) EvictAgent(agentID, reason string) int {
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	streams := s.agentStreams[agentID]
+	for _, evictCh := range streams {
+		close(evictCh)
+		metrics.Metrics.AgentEvictionInc(reason)
+	}
+	delete(s.agentStreams, agentID)
+	return len(streams)
 }
 
 // route the packet back to the correct client
@@ -703,21 +1358,14 @@ func (s *ProxyServer) serveRecvBackend(backend Backend, stream agent.AgentServic
 		// TODO(#126): Frontends in PendingDial state that have not been added to the
 		//             list of frontends should also be closed.
 		frontends, _ := s.getFrontendsForBackendConn(agentID, backend)
-		klog.V(3).InfoS("Close frontends connected to agent",
+		util.V(util.LogAgentStream, 3).InfoS("Close frontends connected to agent",
 			"serverID", s.serverID, "count", len(frontends), "agentID", agentID)
 
 		for _, frontend := range frontends {
-			s.removeFrontend(agentID, frontend.connectID)
-			pkt := &client.Packet{
-				Type: client.PacketType_CLOSE_RSP,
-				Payload: &client.Packet_CloseResponse{
-					CloseResponse: &client.CloseResponse{},
-				},
-			}
-			pkt.GetCloseResponse().ConnectID = frontend.connectID
-			if err := frontend.send(pkt); err != nil {
-				klog.ErrorS(err, "CLOSE_RSP to frontend failed", "serverID", s.serverID, "agentID", agentID)
+			if s.startMigration(agentID, backend, frontend) {
+				continue
 			}
+			s.closeDisconnectedFrontend(agentID, frontend)
 		}
 	}()
 
@@ -725,29 +1373,50 @@ func (s *ProxyServer) serveRecvBackend(backend Backend, stream agent.AgentServic
 		switch pkt.Type {
 		case client.PacketType_DIAL_RSP:
 			resp := pkt.GetDialResponse()
-			klog.V(5).InfoS("Received DIAL_RSP", "dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
+			util.V(util.LogAgentStream, 5).InfoS("Received DIAL_RSP", "dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
+			if s.completeMigration(backend, agentID, resp) {
+				continue
+			}
 
-			if frontend, ok := s.PendingDial.Get(resp.Random); !ok {
-				klog.V(2).InfoS("DIAL_RSP not recognized; dropped", "dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
+			if frontend, ok := s.PendingDial.Take(resp.Random); !ok {
+				util.V(util.LogAgentStream, 2).InfoS("DIAL_RSP not recognized; dropped", "dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
+				if resp.Error == "" {
+					// The dial was canceled or reaped, close the
+					// connection the agent established for it.
+					s.closeOrphan(backend, agentID, resp.ConnectID)
+				}
 			} else {
+				frontend.dialResponded = time.Now()
 				dialErr := false
+				acceptCompression(resp, frontend)
+				auditErr := resp.Error
+				errorCategory := agentDialErrorCategory(resp.Error)
 				if resp.Error != "" {
 					klog.ErrorS(errors.New(resp.Error), "DIAL_RSP contains failure", "dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
 					dialErr = true
 				}
+				s.recordDial(agentID, resp.Error != "")
+				reportRouting(resp, agentID, frontend.strategy)
 				err := frontend.send(pkt)
-				s.PendingDial.Remove(resp.Random)
 				if err != nil {
 					klog.ErrorS(err, "DIAL_RSP send to frontend stream failure",
 						"dialID", resp.Random, "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
 					dialErr = true
+					if auditErr == "" {
+						auditErr = fmt.Sprintf("failed to send DIAL_RSP to frontend: %v", err)
+						errorCategory = dialErrorFrontend
+					}
 				}
+				s.observeDial(frontend, agentID, errorCategory)
+				s.auditDialResponse(resp.Random, resp.ConnectID, frontend, agentID, auditErr)
 				// Avoid adding the frontend if there was an error dialing the destination
 				if dialErr == true {
 					break
 				}
 				frontend.connectID = resp.ConnectID
 				frontend.agentID = agentID
+				s.limitBandwidth(agentID, frontend)
+				s.queueSends(agentID, frontend)
 				s.addFrontend(agentID, resp.ConnectID, frontend)
 				close(frontend.connected)
 				metrics.Metrics.ObserveDialLatency(time.Since(frontend.start))
@@ -755,39 +1424,124 @@ func (s *ProxyServer) serveRecvBackend(backend Backend, stream agent.AgentServic
 
 		case client.PacketType_DATA:
 			resp := pkt.GetData()
-			klog.V(5).InfoS("Received data from agent", "bytes", len(resp.Data), "agentID", agentID, "connectionID", resp.ConnectID)
+			util.V(util.LogAgentStream, 5).InfoS("Received data from agent", "bytes", len(resp.Data), "agentID", agentID, "connectionID", resp.ConnectID)
 			frontend, err := s.getFrontend(agentID, resp.ConnectID)
 			if err != nil {
 				klog.ErrorS(err, "could not get frontend client", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
 				break
 			}
-			if err := frontend.send(pkt); err != nil {
+			if err := decompressData(frontend, pkt); err != nil {
+				klog.ErrorS(err, "failed to decompress data from agent, closing the connection", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
+				s.closeUndecompressable(frontend, err)
+				break
+			}
+			countFromAgent(frontend, len(resp.Data))
+			if !s.interceptData(frontend, DirectionFromAgent, pkt) {
+				break
+			}
+			atomic.AddInt64(&frontend.bytesFromAgent, int64(len(resp.Data)))
+			s.peaks.addBytes(len(resp.Data))
+			frontend.touch()
+			if err := s.sendFromAgent(frontend, pkt); err != nil {
 				klog.ErrorS(err, "send to client stream failure", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
 			} else {
-				klog.V(5).InfoS("DATA sent to frontend")
+				util.V(util.LogAgentStream, 5).InfoS("DATA sent to frontend")
 			}
 
 		case client.PacketType_CLOSE_RSP:
 			resp := pkt.GetCloseResponse()
-			klog.V(5).InfoS("Received CLOSE_RSP", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
+			util.V(util.LogAgentStream, 5).InfoS("Received CLOSE_RSP", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
 			frontend, err := s.getFrontend(agentID, resp.ConnectID)
 			if err != nil {
 				// assuming it is already closed, just log it
-				klog.V(3).InfoS("could not get frontend client for closing", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID, "err", err)
+				util.V(util.LogAgentStream, 3).InfoS("could not get frontend client for closing", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID, "err", err)
 				break
 			}
-			if err := frontend.send(pkt); err != nil {
+			if !s.removeFrontend(agentID, resp.ConnectID) {
+				// closed meanwhile, e.g. reaped by the janitor
+				break
+			}
+			if err := s.sendFromAgent(frontend, pkt); err != nil {
 				// Normal when frontend closes it.
 				klog.ErrorS(err, "CLOSE_RSP send to client stream error", "serverID", s.serverID, "agentID", agentID, "connectionID", resp.ConnectID)
 			} else {
-				klog.V(5).InfoS("CLOSE_RSP sent to frontend", "connectionID", resp.ConnectID)
+				util.V(util.LogAgentStream, 5).InfoS("CLOSE_RSP sent to frontend", "connectionID", resp.ConnectID)
+			}
+			util.V(util.LogAgentStream, 5).InfoS("Close streaming", "agentID", agentID, "connectionID", resp.ConnectID)
+
+		case client.PacketType_IDLE_WARNING:
+			warning := pkt.GetIdleWarning()
+			util.V(util.LogAgentStream, 4).InfoS("Received IDLE_WARNING", "serverID", s.serverID, "agentID", agentID, "connectionID", warning.ConnectID, "closeIn", warning.CloseIn)
+			frontend, err := s.getFrontend(agentID, warning.ConnectID)
+			if err != nil {
+				util.V(util.LogAgentStream, 3).InfoS("could not get frontend client for idle warning", "serverID", s.serverID, "agentID", agentID, "connectionID", warning.ConnectID, "err", err)
+				break
+			}
+			if !frontendSupports(frontend, header.FeatureIdleWarning) {
+				break
+			}
+			if err := s.sendFromAgent(frontend, pkt); err != nil {
+				klog.ErrorS(err, "IDLE_WARNING send to client stream error", "serverID", s.serverID, "agentID", agentID, "connectionID", warning.ConnectID)
+			}
+
+		case client.PacketType_CHECKPOINT:
+			checkpoint := pkt.GetCheckpoint()
+			util.V(util.LogAgentStream, 5).InfoS("Received CHECKPOINT", "serverID", s.serverID, "agentID", agentID, "connectionID", checkpoint.ConnectID, "bytes", checkpoint.Bytes)
+			frontend, err := s.getFrontend(agentID, checkpoint.ConnectID)
+			if err != nil {
+				util.V(util.LogAgentStream, 3).InfoS("could not get frontend client for checkpoint", "serverID", s.serverID, "agentID", agentID, "connectionID", checkpoint.ConnectID, "err", err)
+				break
+			}
+			verifyCheckpoint(frontend, checkpoint)
+
+		case client.PacketType_ACK:
+			ack := pkt.GetAck()
+			util.V(util.LogAgentStream, 5).InfoS("Received ACK", "serverID", s.serverID, "agentID", agentID, "connectionID", ack.ConnectID, "seq", ack.Seq, "retransmit", ack.Retransmit)
+			frontend, err := s.getFrontend(agentID, ack.ConnectID)
+			if err != nil {
+				util.V(util.LogAgentStream, 3).InfoS("could not get frontend client for ack", "serverID", s.serverID, "agentID", agentID, "connectionID", ack.ConnectID, "err", err)
+				break
 			}
-			s.removeFrontend(agentID, resp.ConnectID)
-			klog.V(5).InfoS("Close streaming", "agentID", agentID, "connectionID", resp.ConnectID)
+			s.handleAck(backend, frontend, ack)
+
+		case client.PacketType_HELLO:
+			s.handleAgentHello(backend, agentID, pkt.GetHello())
+
+		case client.PacketType_NACK:
+			nack := pkt.GetNack()
+			util.V(util.LogAgentStream, 2).InfoS("Agent does not support a packet type", "type", nack.Type, "serverID", s.serverID, "agentID", agentID, "agentCapabilities", nack.Capabilities)
+			metrics.Metrics.AgentNackInc(nack.Type.String())
 
 		default:
-			klog.V(2).InfoS("Unrecognized packet", "packet", pkt, "serverID", s.serverID, "agentID", agentID)
+			util.V(util.LogAgentStream, 2).InfoS("Unrecognized packet", "packet", pkt, "serverID", s.serverID, "agentID", agentID)
+			// Let newer agents know the packet was not understood.
+			nack := &client.Packet{
+				Type:    client.PacketType_NACK,
+				Payload: &client.Packet_Nack{Nack: &client.Nack{Type: pkt.Type}},
+			}
+			if err := backend.Send(nack); err != nil {
+				klog.ErrorS(err, "NACK to Backend failed", "serverID", s.serverID, "agentID", agentID)
+			}
 		}
 	}
-	klog.V(5).InfoS("Close backend of agent", "backend", stream, "serverID", s.serverID, "agentID", agentID)
+	util.V(util.LogAgentStream, 5).InfoS("Close backend of agent", "backend", stream, "serverID", s.serverID, "agentID", agentID)
+}
+
+// reportRouting records in the DIAL_RSP resp the agent and the strategy
+// serving the dial. The agent reported by a peer the dial was relayed to is
+// kept, agentID names the peer if it reported none.
+func reportRouting(resp *client.DialResponse, agentID string, strategy ProxyStrategy) {
+	if strategy != proxyStrategyRelay {
+		resp.AgentID = agentID
+		resp.Strategy = string(strategy)
+		return
+	}
+	if resp.AgentID == "" {
+		resp.AgentID = agentID
+	}
+	if resp.Strategy != "" {
+		resp.Strategy = string(proxyStrategyRelay) + ":" + resp.Strategy
+	} else {
+		resp.Strategy = string(proxyStrategyRelay)
+	}
 }
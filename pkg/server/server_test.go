@@ -18,6 +18,8 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"reflect"
@@ -26,7 +28,9 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 
 	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -185,6 +189,52 @@ func TestAgentTokenAuthenticationErrorsToken(t *testing.T) {
 	}
 }
 
+func TestAgentCertificateAuthentication(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		authInfo  credentials.AuthInfo
+		noPeer    bool
+		wantError bool
+	}{
+		{
+			desc:      "no peer",
+			noPeer:    true,
+			wantError: true,
+		},
+		{
+			desc:      "no tls",
+			wantError: true,
+		},
+		{
+			desc:      "no client certificate",
+			authInfo:  credentials.TLSInfo{State: tls.ConnectionState{}},
+			wantError: true,
+		},
+		{
+			desc: "verified client certificate",
+			authInfo: credentials.TLSInfo{State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{}}},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			if !tc.noPeer {
+				ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: tc.authInfo})
+			}
+			err := authenticateAgentViaCertificate(ctx)
+			if tc.wantError && err == nil {
+				t.Error("expected an error, got nil")
+			}
+			if !tc.wantError && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
 func TestAddRemoveFrontends(t *testing.T) {
 	agent1ConnID1 := new(ProxyClientConnection)
 	agent1ConnID2 := new(ProxyClientConnection)
@@ -304,8 +354,9 @@ func TestServerProxyNoBackend(t *testing.T) {
 			Type: client.PacketType_DIAL_RSP,
 			Payload: &client.Packet_DialResponse{
 				DialResponse: &client.DialResponse{
-					Random: 111,
-					Error:  (&ErrNotFound{}).Error(),
+					Random:    111,
+					Error:     (&ErrNotFound{}).Error(),
+					ErrorCode: client.DialErrorCode_DIAL_ERROR_NO_AGENT,
 				}},
 		}
 
@@ -364,3 +415,53 @@ func TestServerProxyNormalClose(t *testing.T) {
 	}
 	baseServerProxyTestWithBackend(t, validate)
 }
+
+func TestReportRouting(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		resp         *client.DialResponse
+		agentID      string
+		strategy     ProxyStrategy
+		wantAgentID  string
+		wantStrategy string
+	}{
+		{
+			desc:         "agent",
+			resp:         &client.DialResponse{},
+			agentID:      "agent-1",
+			strategy:     ProxyStrategyDestHost,
+			wantAgentID:  "agent-1",
+			wantStrategy: "destHost",
+		},
+		{
+			desc:         "agent reporting routing",
+			resp:         &client.DialResponse{AgentID: "forged", Strategy: "forged"},
+			agentID:      "agent-1",
+			strategy:     ProxyStrategyDefault,
+			wantAgentID:  "agent-1",
+			wantStrategy: "default",
+		},
+		{
+			desc:         "relayed",
+			resp:         &client.DialResponse{AgentID: "agent-2", Strategy: "default"},
+			agentID:      "peer/server-2",
+			strategy:     proxyStrategyRelay,
+			wantAgentID:  "agent-2",
+			wantStrategy: "peerRelay:default",
+		},
+		{
+			desc:         "relayed to a peer not reporting routing",
+			resp:         &client.DialResponse{},
+			agentID:      "peer/server-2",
+			strategy:     proxyStrategyRelay,
+			wantAgentID:  "peer/server-2",
+			wantStrategy: "peerRelay",
+		},
+	}
+	for _, tc := range testCases {
+		reportRouting(tc.resp, tc.agentID, tc.strategy)
+		if tc.resp.AgentID != tc.wantAgentID || tc.resp.Strategy != tc.wantStrategy {
+			t.Errorf("%s: expected %q and %q, got %q and %q", tc.desc, tc.wantAgentID, tc.wantStrategy, tc.resp.AgentID, tc.resp.Strategy)
+		}
+	}
+}
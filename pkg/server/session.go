@@ -0,0 +1,376 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+var errSessionClosed = errors.New("agent session closed")
+
+// SessionConfig configures the resumption of agent sessions. An agent
+// whose Connect stream broke may reconnect within the grace period and
+// resume its session: its connections are kept, and the DATA lost with
+// the stream is sent again from bounded replay buffers.
+type SessionConfig struct {
+	// Grace is how long the connections of a broken session are kept
+	// for the agent to resume it. 0 disables resumption.
+	Grace time.Duration
+	// ReplayBufferSize is the number of DATA payload bytes kept per
+	// connection to be sent again. Connections missing more are closed
+	// when the session resumes.
+	ReplayBufferSize int
+}
+
+// agentSession serves the Connect streams of an agent: the first one, and
+// the ones resuming the session if it is resumable.
+type agentSession struct {
+	// token identifies a resumable session, empty if the session is not
+	// resumable.
+	token   string
+	agentID string
+
+	// stream is the *sessionStream of a resumable session, and the
+	// Connect stream otherwise. The backends of the agent wrap it.
+	stream  agent.AgentService_ConnectServer
+	backend Backend
+	recvCh  chan *client.Packet
+	evictCh <-chan struct{}
+
+	// sequenced sessions number the DATA of each connection: resumable
+	// sessions, and those of agents speaking ProtocolVersionAck.
+	sequenced bool
+	// received tracks the DATA received on each connection. It is only
+	// accessed by the goroutine receiving from the current stream, which
+	// closes recvDone once it ended.
+	received map[int64]*util.ReceiveWindow
+	recvDone chan struct{}
+
+	// expiry closes the session once parked for the grace period.
+	expiry *time.Timer
+}
+
+// sessionStream sends on the current Connect stream of a resumable
+// session. Sends wait while the session is parked, and go to the stream
+// resuming it.
+type sessionStream struct {
+	// The first stream of the session provides the agent metadata.
+	agent.AgentService_ConnectServer
+
+	mu      sync.Mutex // mu protects the following
+	current agent.AgentService_ConnectServer
+	changed chan struct{} // closed when current changes
+	closed  bool
+}
+
+func newSessionStream(stream agent.AgentService_ConnectServer) *sessionStream {
+	return &sessionStream{
+		AgentService_ConnectServer: stream,
+		current:                    stream,
+		changed:                    make(chan struct{}),
+	}
+}
+
+// Send sends pkt on the current stream. If that fails, pkt is sent again
+// on the stream resuming the session, and DATA resent from the replay
+// buffers is dropped by the agent as duplicate.
+func (s *sessionStream) Send(pkt *client.Packet) error {
+	for {
+		s.mu.Lock()
+		current, changed, closed := s.current, s.changed, s.closed
+		s.mu.Unlock()
+		if closed {
+			return errSessionClosed
+		}
+		if current != nil && current.Send(pkt) == nil {
+			return nil
+		}
+		<-changed
+	}
+}
+
+// swap replaces the current stream, nil while the session is parked.
+func (s *sessionStream) swap(stream agent.AgentService_ConnectServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = stream
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// close fails the pending and future sends.
+func (s *sessionStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// openSession returns the session the Connect stream of agentID resumes,
+// and true, or else a new session.
+func (s *ProxyServer) openSession(agentID string, stream agent.AgentService_ConnectServer) (*agentSession, bool) {
+	session := &agentSession{
+		agentID:   agentID,
+		sequenced: s.agentProtocolVersion(stream.Context()) >= pkgagent.ProtocolVersionAck,
+		received:  make(map[int64]*util.ReceiveWindow),
+	}
+	if s.Sessions.Grace <= 0 || !containsCapability(contextCapabilities(stream.Context()), pkgagent.CapabilityResume) {
+		return session, false
+	}
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if tokens := md.Get(header.SessionToken); len(tokens) == 1 {
+			if parked := s.claimSession(tokens[0]); parked != nil {
+				if parked.agentID == agentID {
+					return parked, true
+				}
+				klog.V(2).InfoS("Agent presented the session token of another agent", "agentID", agentID, "sessionAgentID", parked.agentID)
+				s.parkSession(parked)
+			}
+		}
+	}
+	session.token = newSessionToken()
+	session.sequenced = true
+	return session, false
+}
+
+// startSession registers the backend of a new session and serves the
+// packets received on its streams.
+func (s *ProxyServer) startSession(session *agentSession, stream agent.AgentService_ConnectServer) {
+	session.stream = stream
+	if session.token != "" {
+		session.stream = newSessionStream(stream)
+	}
+	session.recvCh = make(chan *client.Packet, xfrChannelSize)
+	s.addAgentBandwidth(session.agentID)
+	session.backend = s.addBackend(session.agentID, session.stream)
+	session.evictCh = s.trackAgentStream(session.agentID, session.stream)
+	go s.serveRecvBackend(session.backend, session.stream, session.agentID, session.recvCh)
+}
+
+// closeSession removes the backend of the session, which closes the
+// frontends connected through it once the packets received before were
+// served.
+func (s *ProxyServer) closeSession(session *agentSession) {
+	s.untrackAgentStream(session.agentID, session.stream)
+	s.removeBackend(session.agentID, session.stream)
+	s.removeAgentBandwidth(session.agentID)
+	if ss, ok := session.stream.(*sessionStream); ok {
+		ss.close()
+	}
+	go func() {
+		// An evicted stream may still be receiving.
+		<-session.recvDone
+		close(session.recvCh)
+	}()
+}
+
+// parkSession keeps the session for the agent to resume it within the
+// grace period, and closes it afterwards.
+func (s *ProxyServer) parkSession(session *agentSession) {
+	session.stream.(*sessionStream).swap(nil)
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*agentSession)
+	}
+	s.sessions[session.token] = session
+	session.expiry = time.AfterFunc(s.Sessions.Grace, func() {
+		if s.claimSession(session.token) != nil {
+			klog.V(2).InfoS("Agent session expired", "agentID", session.agentID)
+			metrics.Metrics.SessionResumptionInc(metrics.SessionExpired)
+			s.closeSession(session)
+		}
+	})
+}
+
+// claimSession removes the parked session of token, nil if there is none.
+func (s *ProxyServer) claimSession(token string) *agentSession {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	session, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, token)
+	session.expiry.Stop()
+	return session
+}
+
+// resumeSession exchanges RESUME packets with the agent on stream, sends
+// again the DATA the agent missed, and makes stream the current stream of
+// the session. Connections one side does not know anymore, or missing DATA
+// evicted from the replay buffers, are closed.
+func (s *ProxyServer) resumeSession(session *agentSession, stream agent.AgentService_ConnectServer) error {
+	// The previous stream was received entirely.
+	<-session.recvDone
+	pkt, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if pkt.Type != client.PacketType_RESUME {
+		return fmt.Errorf("expected RESUME from agent, got %v", pkt.Type)
+	}
+	agentConns := make(map[int64]int64)
+	for _, c := range pkt.GetResume().Connections {
+		agentConns[c.ConnectID] = c.LastSeq
+	}
+
+	frontends := s.sessionFrontends(session)
+	resume := &client.Resume{}
+	for _, frontend := range frontends {
+		resume.Connections = append(resume.Connections, &client.ResumeConnection{
+			ConnectID: frontend.connectID,
+			LastSeq:   session.lastReceived(frontend.connectID),
+		})
+	}
+	if err := stream.Send(&client.Packet{
+		Type:    client.PacketType_RESUME,
+		Payload: &client.Packet_Resume{Resume: resume},
+	}); err != nil {
+		return err
+	}
+
+	for _, frontend := range frontends {
+		connID := frontend.connectID
+		lastSeq, ok := agentConns[connID]
+		if !ok {
+			// The agent closed the connection, its CLOSE_RSP was lost.
+			session.recvCh <- closeResponsePacket(connID)
+			continue
+		}
+		delete(agentConns, connID)
+		if frontend.replay == nil {
+			continue
+		}
+		packets, ok := frontend.replay.Since(lastSeq)
+		if !ok {
+			klog.V(2).InfoS("Closing connection missing data evicted from the replay buffer", "agentID", session.agentID, "connectionID", connID)
+			packets = []*client.Packet{closeRequestPacket(connID)}
+		}
+		for _, p := range packets {
+			if err := stream.Send(p); err != nil {
+				return err
+			}
+		}
+	}
+	for connID := range agentConns {
+		// The connection is unknown to the server, e.g. its DIAL_RSP
+		// was lost.
+		if err := stream.Send(closeRequestPacket(connID)); err != nil {
+			return err
+		}
+	}
+	session.stream.(*sessionStream).swap(stream)
+	return nil
+}
+
+// sessionFrontends returns the frontends connected through the session.
+func (s *ProxyServer) sessionFrontends(session *agentSession) []*ProxyClientConnection {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	var frontends []*ProxyClientConnection
+	for _, frontend := range s.frontends[session.agentID] {
+		if b, ok := frontend.backend.(*backend); ok && b.conn == session.stream {
+			frontends = append(frontends, frontend)
+		}
+	}
+	return frontends
+}
+
+// recordReceived records the seq of pkt received on a sequenced session.
+// It returns false if pkt is DATA received before or following a gap, and
+// the ACK to send to the agent if any.
+func (session *agentSession) recordReceived(pkt *client.Packet) (bool, *client.Packet) {
+	if !session.sequenced {
+		return true, nil
+	}
+	switch pkt.Type {
+	case client.PacketType_DATA:
+		data := pkt.GetData()
+		if data.Seq == 0 {
+			return true, nil
+		}
+		window, ok := session.received[data.ConnectID]
+		if !ok {
+			window = &util.ReceiveWindow{}
+			session.received[data.ConnectID] = window
+		}
+		return window.Receive(data.ConnectID, data.Seq)
+	case client.PacketType_CLOSE_RSP:
+		delete(session.received, pkt.GetCloseResponse().ConnectID)
+	}
+	return true, nil
+}
+
+// lastReceived returns the seq of the last DATA received in order on the
+// connection, 0 if none was.
+func (session *agentSession) lastReceived(connID int64) int64 {
+	if window, ok := session.received[connID]; ok {
+		return window.Last
+	}
+	return 0
+}
+
+// prepareReplay numbers the DATA the frontend sends to the agent and
+// keeps it until acknowledged, if backend serves a resumable session or
+// an agent speaking ProtocolVersionAck.
+func (s *ProxyServer) prepareReplay(b Backend, frontend *ProxyClientConnection) {
+	be, ok := b.(*backend)
+	if !ok {
+		return
+	}
+	if _, ok := be.conn.(*sessionStream); ok || s.agentProtocolVersion(be.conn.Context()) >= pkgagent.ProtocolVersionAck {
+		frontend.replay = util.NewReplayBuffer(s.Sessions.ReplayBufferSize)
+	}
+}
+
+func closeRequestPacket(connID int64) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{CloseRequest: &client.CloseRequest{ConnectID: connID}},
+	}
+}
+
+func closeResponsePacket(connID int64) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: connID}},
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// resumingConnectServer receives the packets of recv and records the
+// packets sent.
+type resumingConnectServer struct {
+	*fakeCapableConnectServer
+	recv chan *client.Packet
+
+	mu   sync.Mutex
+	sent []*client.Packet
+}
+
+func newResumingConnectServer() *resumingConnectServer {
+	return &resumingConnectServer{fakeCapableConnectServer: newFakeCapableConnectServer("resume"), recv: make(chan *client.Packet, 1)}
+}
+
+func (f *resumingConnectServer) Send(pkt *client.Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, pkt)
+	return nil
+}
+
+func (f *resumingConnectServer) Recv() (*client.Packet, error) {
+	return <-f.recv, nil
+}
+
+func (f *resumingConnectServer) sentPackets() []*client.Packet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*client.Packet(nil), f.sent...)
+}
+
+func TestSessionStream(t *testing.T) {
+	ss := newSessionStream(newFailingConnectServer(errors.New("stream broke"), 1))
+	errCh := make(chan error)
+	go func() {
+		errCh <- ss.Send(dataPacket(1, "a"))
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("expected the send to wait for the session to resume, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resumed := newResumingConnectServer()
+	ss.swap(resumed)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if sent := resumed.sentPackets(); len(sent) != 1 {
+		t.Fatalf("expected the packet to be sent on the resumed stream, got %d packets", len(sent))
+	}
+
+	ss.swap(nil)
+	go func() {
+		errCh <- ss.Send(dataPacket(1, "b"))
+	}()
+	ss.close()
+	if err := <-errCh; err != errSessionClosed {
+		t.Errorf("expected %v, got %v", errSessionClosed, err)
+	}
+}
+
+func TestRecordReceived(t *testing.T) {
+	seqData := func(connID, seq int64) *client.Packet {
+		pkt := dataPacket(connID, "a")
+		pkt.GetData().Seq = seq
+		return pkt
+	}
+	session := &agentSession{sequenced: true, received: make(map[int64]*util.ReceiveWindow)}
+	for i, tc := range []struct {
+		pkt        *client.Packet
+		want       bool
+		retransmit bool
+	}{
+		{pkt: seqData(1, 1), want: true},
+		{pkt: seqData(1, 2), want: true},
+		{pkt: seqData(1, 2), want: false},
+		{pkt: seqData(2, 1), want: true},
+		// DATA 2 of connection 2 was lost, it is requested once.
+		{pkt: seqData(2, 3), want: false, retransmit: true},
+		{pkt: seqData(2, 4), want: false},
+		{pkt: seqData(2, 2), want: true},
+		{pkt: dataPacket(1, "unnumbered"), want: true},
+		{pkt: closeResponsePacket(1), want: true},
+		{pkt: seqData(1, 1), want: true},
+	} {
+		got, ack := session.recordReceived(tc.pkt)
+		if got != tc.want {
+			t.Errorf("packet %d: expected %v, got %v", i, tc.want, got)
+		}
+		if retransmit := ack != nil && ack.GetAck().Retransmit; retransmit != tc.retransmit {
+			t.Errorf("packet %d: expected a retransmission request %v, got %v", i, tc.retransmit, ack)
+		}
+	}
+	if last := session.lastReceived(2); last != 2 {
+		t.Errorf("expected DATA 2 to be the last received on connection 2, got %d", last)
+	}
+
+	// Sessions which are not sequenced do not track DATA.
+	session = &agentSession{}
+	for i := 0; i < 2; i++ {
+		if ok, _ := session.recordReceived(seqData(1, 1)); !ok {
+			t.Error("expected DATA to be accepted")
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	ss := newSessionStream(newFakeCapableConnectServer("resume"))
+	session := &agentSession{
+		token:    "token",
+		agentID:  "agent",
+		stream:   ss,
+		recvCh:   make(chan *client.Packet, 1),
+		received: map[int64]*util.ReceiveWindow{1: {Last: 7}},
+		recvDone: make(chan struct{}),
+	}
+	close(session.recvDone)
+	b := newBackend(ss)
+
+	// Connection 1 missed DATA 2 and 3, connection 2 was closed by the
+	// agent and connection 3 missed evicted DATA.
+	replayed := &ProxyClientConnection{connectID: 1, backend: b, replay: util.NewReplayBuffer(1024)}
+	closed := &ProxyClientConnection{connectID: 2, backend: b}
+	evicted := &ProxyClientConnection{connectID: 3, backend: b, replay: util.NewReplayBuffer(1)}
+	for i := 0; i < 3; i++ {
+		replayed.replay.Add(dataPacket(1, "a"))
+		evicted.replay.Add(dataPacket(3, "a"))
+	}
+	s := &ProxyServer{frontends: map[string]map[int64]*ProxyClientConnection{
+		"agent": {1: replayed, 2: closed, 3: evicted},
+	}}
+
+	// Connection 4 is unknown to the server.
+	stream := newResumingConnectServer()
+	stream.recv <- &client.Packet{
+		Type: client.PacketType_RESUME,
+		Payload: &client.Packet_Resume{Resume: &client.Resume{Connections: []*client.ResumeConnection{
+			{ConnectID: 1, LastSeq: 1},
+			{ConnectID: 3, LastSeq: 0},
+			{ConnectID: 4, LastSeq: 0},
+		}}},
+	}
+	if err := s.resumeSession(session, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := stream.sentPackets()
+	if len(sent) == 0 || sent[0].Type != client.PacketType_RESUME {
+		t.Fatalf("expected RESUME to be sent first, got %v", sent)
+	}
+	lastSeqs := make(map[int64]int64)
+	for _, c := range sent[0].GetResume().Connections {
+		lastSeqs[c.ConnectID] = c.LastSeq
+	}
+	if len(lastSeqs) != 3 || lastSeqs[1] != 7 || lastSeqs[2] != 0 || lastSeqs[3] != 0 {
+		t.Errorf("expected the server to resume connections 1, 2 and 3, got %v", lastSeqs)
+	}
+
+	var seqs []int64
+	closeReqs := make(map[int64]bool)
+	for _, pkt := range sent[1:] {
+		switch pkt.Type {
+		case client.PacketType_DATA:
+			seqs = append(seqs, pkt.GetData().Seq)
+		case client.PacketType_CLOSE_REQ:
+			closeReqs[pkt.GetCloseRequest().ConnectID] = true
+		}
+	}
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Errorf("expected DATA 2 and 3 to be sent again, got %v", seqs)
+	}
+	if len(closeReqs) != 2 || !closeReqs[3] || !closeReqs[4] {
+		t.Errorf("expected connections 3 and 4 to be closed, got %v", closeReqs)
+	}
+	select {
+	case pkt := <-session.recvCh:
+		if pkt.Type != client.PacketType_CLOSE_RSP || pkt.GetCloseResponse().ConnectID != 2 {
+			t.Errorf("expected CLOSE_RSP of connection 2, got %v", pkt)
+		}
+	default:
+		t.Error("expected connection 2 to be closed")
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.current != stream {
+		t.Error("expected the resumed stream to be current")
+	}
+}
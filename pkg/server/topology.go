@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// DefaultTopologyZoneLabel is the default agent label holding the zone of
+// the agents.
+const DefaultTopologyZoneLabel = "topology.kubernetes.io/zone"
+
+// TopologyConfig configures the topology hints returned to connecting
+// agents: the peer servers in the zone of the agent, which agents
+// preferring them connect to directly. It also configures the routing of
+// dials through the agents in the zone of the server.
+type TopologyConfig struct {
+	// Hints enables returning hints. They require Peers.
+	Hints bool
+	// Zone is the zone of this server, shared with the peers.
+	Zone string
+	// ZoneAffinity routes dials through the agents in Zone, see
+	// zoneRouting. It requires Zone.
+	ZoneAffinity bool
+	// SpilloverThreshold is the utilization of the connection capacity
+	// of the agents in Zone, between 0 and 1, beyond which dials spill
+	// over to the agents of the other zones.
+	SpilloverThreshold float64
+	// ZoneLabel is the agent label holding the zone of the agents.
+	ZoneLabel string
+	// AgentAdvertiseAddress is the address agents can reach this server
+	// at directly, shared with the peers. Peers only hint servers with
+	// one.
+	AgentAdvertiseAddress string
+}
+
+// agentZone returns the zone of the agent connecting on ctx, from its
+// ZoneLabel label, empty if it announced none.
+func (s *ProxyServer) agentZone(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	agentLabels := md.Get(header.AgentLabels)
+	if len(agentLabels) == 0 {
+		return ""
+	}
+	set, err := pkgagent.ParseAgentLabels(agentLabels[0])
+	if err != nil {
+		return ""
+	}
+	return set[s.Topology.ZoneLabel]
+}
+
+// topologyHints returns the peer servers in zone agents can reach
+// directly, as serverID=address sorted by server ID.
+func (s *ProxyServer) topologyHints(zone string) []string {
+	if !s.Topology.Hints || zone == "" || s.Peers == nil {
+		return nil
+	}
+	var hints []string
+	for _, reg := range s.Peers.Registrations() {
+		if reg.Zone == zone && reg.AgentAddress != "" {
+			hints = append(hints, reg.ServerID+"="+reg.AgentAddress)
+		}
+	}
+	sort.Strings(hints)
+	return hints
+}
+
+// appendTopologyHints appends the topology hints for the agent connecting
+// on ctx to h.
+func (s *ProxyServer) appendTopologyHints(ctx context.Context, agentID string, h metadata.MD) {
+	zone := s.agentZone(ctx)
+	hints := s.topologyHints(zone)
+	if len(hints) == 0 {
+		return
+	}
+	util.V(util.LogAgentStream, 2).InfoS("Hinting the peer servers in the zone of the agent", "agentID", agentID, "zone", zone, "serverZone", s.Topology.Zone, "hints", hints)
+	h.Append(header.TopologyHints, strings.Join(hints, ","))
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestTopologyHints(t *testing.T) {
+	var peerAddrs []string
+	var peerClient *http.Client
+	for _, peer := range []struct {
+		id, zone, agentAddress string
+	}{
+		{id: "peer-b", zone: "zone-a", agentAddress: "10.0.1.2:8091"},
+		{id: "peer-a", zone: "zone-a", agentAddress: "10.0.1.1:8091"},
+		{id: "peer-c", zone: "zone-b", agentAddress: "10.0.2.1:8091"},
+		{id: "peer-d", zone: "zone-a"},
+	} {
+		s := NewProxyServer(peer.id, []ProxyStrategy{ProxyStrategyDefault}, 4, nil, false)
+		s.Topology.Zone = peer.zone
+		s.Topology.AgentAdvertiseAddress = peer.agentAddress
+		peerServer := httptest.NewTLSServer(http.HandlerFunc(s.ServePeerRegistration))
+		defer peerServer.Close()
+		peerAddrs = append(peerAddrs, strings.TrimPrefix(peerServer.URL, "https://"))
+		// The test servers share a certificate, any of their clients trusts all.
+		peerClient = peerServer.Client()
+	}
+	registry, err := NewPeerRegistry("self", peerAddrs, peerClient, time.Minute)
+	if err != nil {
+		t.Fatalf("expected a registry, got %v", err)
+	}
+	registry.refresh()
+
+	self := NewProxyServer("self", []ProxyStrategy{ProxyStrategyDefault}, 4, nil, false)
+	self.Topology.Zone = "zone-b"
+	self.Peers = registry
+
+	if hints := self.topologyHints("zone-a"); hints != nil {
+		t.Errorf("expected no hints while disabled, got %v", hints)
+	}
+	self.Topology.Hints = true
+
+	testcases := []struct {
+		name   string
+		labels string
+		want   []string
+	}{
+		{
+			name:   "agent in zone",
+			labels: "topology.kubernetes.io/zone=zone-a,tier=node",
+			want:   []string{"peer-a=10.0.1.1:8091", "peer-b=10.0.1.2:8091"},
+		},
+		{
+			name:   "agent in other zone",
+			labels: "topology.kubernetes.io/zone=zone-b",
+			want:   []string{"peer-c=10.0.2.1:8091"},
+		},
+		{
+			name:   "agent in zone without servers",
+			labels: "topology.kubernetes.io/zone=zone-c",
+		},
+		{
+			name:   "agent without zone",
+			labels: "tier=node",
+		},
+		{
+			name:   "invalid labels",
+			labels: "topology.kubernetes.io/zone",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(header.AgentLabels, tc.labels))
+			h := metadata.MD{}
+			self.appendTopologyHints(ctx, "agent", h)
+			var want []string
+			if len(tc.want) > 0 {
+				want = []string{strings.Join(tc.want, ",")}
+			}
+			if got := h.Get(header.TopologyHints); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected hints %v, got %v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
+)
+
+// startDialSpan starts the span of the dial of frontend if the frontend
+// sent a sampled trace context, and propagates the span to the agent.
+func (s *ProxyServer) startDialSpan(dialReq *client.DialRequest, frontend *ProxyClientConnection) {
+	frontend.traceParent = dialReq.Metadata[tracing.TraceParentKey]
+	frontend.dialSpan = s.Tracer.StartSpan("konnectivity-server.dial", frontend.traceParent)
+	if frontend.dialSpan == nil {
+		return
+	}
+	frontend.dialSpan.SetAttribute("frontend.mode", frontend.Mode)
+	frontend.dialSpan.SetAttribute("destination", dialReq.Address)
+	if dialReq.Hostname != "" {
+		frontend.dialSpan.SetAttribute("destination.hostname", dialReq.Hostname)
+	}
+	frontend.dialSpan.SetAttribute("dial.id", strconv.FormatInt(dialReq.Random, 10))
+	dialReq.Metadata[tracing.TraceParentKey] = frontend.dialSpan.TraceParent()
+}
+
+// finishDialSpan ends the dial span of frontend and, if the dial
+// succeeded, starts the span of the connection lifetime.
+func (s *ProxyServer) finishDialSpan(frontend *ProxyClientConnection, agentID, errorCategory string) {
+	if frontend.dialSpan == nil {
+		return
+	}
+	frontend.dialSpan.SetAttribute("agent.id", agentID)
+	frontend.dialSpan.SetAttribute("strategy", string(frontend.strategy))
+	if errorCategory != dialErrorNone {
+		frontend.dialSpan.Finish(errorCategory)
+		return
+	}
+	frontend.dialSpan.Finish("")
+	frontend.connSpan = s.Tracer.StartSpan("konnectivity-server.connection", frontend.traceParent)
+	frontend.connSpan.SetAttribute("agent.id", agentID)
+	frontend.connSpan.SetAttribute("destination", frontend.address)
+}
+
+// finishConnectionSpan ends the span of the connection lifetime of frontend.
+func finishConnectionSpan(frontend *ProxyClientConnection) {
+	if frontend.connSpan == nil {
+		return
+	}
+	frontend.connSpan.SetAttribute("connection.id", strconv.FormatInt(frontend.connectID, 10))
+	frontend.connSpan.SetAttribute("bytes.to_agent", strconv.FormatInt(atomic.LoadInt64(&frontend.bytesToAgent), 10))
+	frontend.connSpan.SetAttribute("bytes.from_agent", strconv.FormatInt(atomic.LoadInt64(&frontend.bytesFromAgent), 10))
+	frontend.connSpan.Finish("")
+}
@@ -22,46 +22,57 @@ import (
 	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/tracing"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
 
 // Tunnel implements Proxy based on HTTP Connect, which tunnels the traffic to
 // the agent registered in ProxyServer.
 type Tunnel struct {
 	Server *ProxyServer
+	// MaxHeaderBytes is the maximum size in bytes of the request line and
+	// headers of CONNECT requests. 0 means no limit beyond the one of the
+	// http.Server.
+	MaxHeaderBytes int
+	// MaxHeaderCount is the maximum number of headers of CONNECT
+	// requests. 0 means no limit.
+	MaxHeaderCount int
 }
 
 func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	metrics.Metrics.HTTPConnectionInc()
 	defer metrics.Metrics.HTTPConnectionDec()
 
-	klog.V(2).InfoS("Received request for host", "method", r.Method, "host", r.Host, "userAgent", r.UserAgent())
+	util.V(util.LogFrontend, 2).InfoS("Received request for host", "method", r.Method, "host", r.Host, "userAgent", r.UserAgent())
 	if r.TLS != nil {
-		klog.V(2).InfoS("TLS", "commonName", r.TLS.PeerCertificates[0].Subject.CommonName)
+		util.V(util.LogFrontend, 2).InfoS("TLS", "commonName", r.TLS.PeerCertificates[0].Subject.CommonName)
 	}
-	if r.Method != http.MethodConnect {
-		http.Error(w, "this proxy only supports CONNECT passthrough", http.StatusMethodNotAllowed)
+	if err := t.checkHeaderLimits(r); err != nil {
+		util.V(util.LogFrontend, 2).InfoS("Rejecting request", "host", r.Host, "userAgent", r.UserAgent(), "err", err)
+		http.Error(w, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
 		return
 	}
-
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+	if r.Method != http.MethodConnect {
+		http.Error(w, "this proxy only supports CONNECT passthrough", http.StatusMethodNotAllowed)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 
-	conn, bufrw, err := hijacker.Hijack()
+	identity, err := t.Server.authenticateConnect(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.V(util.LogFrontend, 2).InfoS("CONNECT authentication failed", "host", r.Host, "userAgent", r.UserAgent(), "err", err)
+		for _, challenge := range t.Server.ConnectAuthenticator.challenges() {
+			w.Header().Add("Proxy-Authenticate", challenge)
+		}
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
 		return
 	}
-	var closeOnce sync.Once
-	defer closeOnce.Do(func() { conn.Close() })
 
 	random := rand.Int63() /* #nosec G404 */
 	dialRequest := &client.Packet{
@@ -74,32 +85,89 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			},
 		},
 	}
-
-	klog.V(4).Infof("Set pending(rand=%d) to %v", random, w)
-	backend, err := t.Server.getBackend(r.Host)
+	if traceParent := r.Header.Get(tracing.TraceParentKey); traceParent != "" {
+		// CONNECT clients propagate their trace context as a header.
+		dialRequest.GetDialRequest().Metadata = map[string]string{tracing.TraceParentKey: traceParent}
+	}
+	priority, err := ParsePriority(r.Header.Get(header.PriorityHTTPHeader))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("currently no tunnels available: %v", err), http.StatusInternalServerError)
-		return
+		util.V(util.LogFrontend, 2).InfoS("Ignoring the priority of the request", "host", r.Host, "err", err)
 	}
+	dialRequest.GetDialRequest().Priority = priority
+	labelSelector := r.Header.Get(header.LabelSelectorHTTPHeader)
+	if labelSelector != "" {
+		// Carried in the metadata as well, for peers the dial is relayed to.
+		if dialRequest.GetDialRequest().Metadata == nil {
+			dialRequest.GetDialRequest().Metadata = map[string]string{}
+		}
+		dialRequest.GetDialRequest().Metadata[header.DialLabelSelector] = labelSelector
+	}
+
 	closed := make(chan struct{})
 	connected := make(chan struct{})
 	connection := &ProxyClientConnection{
-		Mode: "http-connect",
-		HTTP: io.ReadWriter(conn), // pass as ReadWriter so the caller must close with CloseHTTP
-		CloseHTTP: func() error {
-			closeOnce.Do(func() { conn.Close() })
-			close(closed)
-			return nil
-		},
-		connected: connected,
-		start:     time.Now(),
-		backend:   backend,
+		Mode:          "http-connect",
+		connected:     connected,
+		start:         time.Now(),
+		identity:      tlsIdentity(r.TLS),
+		authenticated: identity,
+
+		labelSelector: labelSelector,
+		priority:      priority,
+	}
+	t.Server.auditDialRequest(dialRequest.GetDialRequest(), connection)
+	t.Server.observeDestination(connection, dialRequest.GetDialRequest().Address)
+	t.Server.startDialSpan(dialRequest.GetDialRequest(), connection)
+	if err := t.Server.authorizeDial(connection, "tcp", r.Host, nil); err != nil {
+		util.V(util.LogFrontend, 2).InfoS("CONNECT not authorized", "host", r.Host, "userAgent", r.UserAgent(), "err", err)
+		t.Server.observeDial(connection, "", backendErrorCategory(err))
+		t.Server.auditDialResponse(random, 0, connection, "", err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	var closeOnce sync.Once
+	defer closeOnce.Do(func() { conn.Close() })
+
+	util.V(util.LogFrontend, 4).Infof("Set pending(rand=%d) to %v", random, w)
+	connection.HTTP = io.ReadWriter(conn) // pass as ReadWriter so the caller must close with CloseHTTP
+	connection.CloseHTTP = func() error {
+		closeOnce.Do(func() { conn.Close() })
+		close(closed)
+		return nil
+	}
+	backend, strategy, err := t.Server.getBackendOrRelay(connection, r.Host, "tcp")
+	if err != nil {
+		t.Server.observeDial(connection, "", backendErrorCategory(err))
+		t.Server.auditDialResponse(random, 0, connection, "", err.Error())
+		http.Error(w, fmt.Sprintf("currently no tunnels available: %v", err), http.StatusInternalServerError)
+		return
+	}
+	connection.backend = backend
+	connection.strategy = strategy
+	connection.dialSelected = time.Now()
+	t.Server.requestCompression(dialRequest.GetDialRequest(), connection)
+	t.Server.requestCheckpoints(dialRequest.GetDialRequest(), backend, connection)
+	t.Server.prepareReplay(backend, connection)
+	t.Server.attestDialMetadata(dialRequest.GetDialRequest(), connection.Mode, connection.identity)
 	t.Server.PendingDial.Add(random, connection)
 	if err := backend.Send(dialRequest); err != nil {
 		klog.ErrorS(err, "failed to tunnel dial request")
 		return
 	}
+	markDialSent(connection)
 	ctxt := backend.Context()
 	if ctxt.Err() != nil {
 		klog.ErrorS(err, "context reports failure")
@@ -107,7 +175,7 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case <-ctxt.Done():
-		klog.V(5).Infoln("context reports done")
+		util.V(util.LogFrontend, 5).Infoln("context reports done")
 	default:
 	}
 
@@ -127,23 +195,27 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err = backend.Send(packet); err != nil {
-			klog.V(2).InfoS("failed to send close request packet", "host", r.Host, "agentID", connection.agentID, "connectionID", connection.connectID)
+			util.V(util.LogFrontend, 2).InfoS("failed to send close request packet", "host", r.Host, "agentID", connection.agentID, "connectionID", connection.connectID)
 		}
 		conn.Close()
 	}()
 
-	klog.V(3).InfoS("Starting proxy to host", "host", r.Host)
-	pkt := make([]byte, 1<<15) // Match GRPC Window size
+	util.V(util.LogFrontend, 3).InfoS("Starting proxy to host", "host", r.Host)
+	pkt := t.Server.getPacketBuffer()
+	defer t.Server.putPacketBuffer(pkt)
 
 	connID := connection.connectID
 	agentID := connection.agentID
 	var acc int
 
 	for {
-		n, err := bufrw.Read(pkt[:])
+		n, err := bufrw.Read(pkt)
 		acc += n
+		atomic.AddInt64(&connection.bytesToAgent, int64(n))
+		t.Server.peaks.addBytes(n)
+		connection.touch()
 		if err == io.EOF {
-			klog.V(1).InfoS("EOF from host", "host", r.Host)
+			util.V(util.LogFrontend, 1).InfoS("EOF from host", "host", r.Host)
 			break
 		}
 		if err != nil {
@@ -160,17 +232,41 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				},
 			},
 		}
+		if !t.Server.interceptData(connection, DirectionToAgent, packet) {
+			continue
+		}
+		compressData(connection, packet)
+		throttleToAgent(connection, n)
+		if connection.replay != nil {
+			connection.replay.Add(packet)
+		}
 		err = backend.Send(packet)
 		if err != nil {
 			klog.ErrorS(err, "error sending packet")
 			break
 		}
-		klog.V(5).InfoS("Forwarding data on tunnel to agent",
+		checkpointToAgent(backend, connection, connID, n)
+		util.V(util.LogFrontend, 5).InfoS("Forwarding data on tunnel to agent",
 			"bytes", n,
 			"totalBytes", acc,
 			"agentID", connection.agentID,
 			"connectionID", connection.connectID)
 	}
 
-	klog.V(5).InfoS("Stopping transfer to host", "host", r.Host, "agentID", agentID, "connectionID", connID)
+	util.V(util.LogFrontend, 5).InfoS("Stopping transfer to host", "host", r.Host, "agentID", agentID, "connectionID", connID)
+}
+
+// getPacketBuffer returns a buffer to read frontend data into. Packets are
+// serialized by backend.Send, so the buffer can be reused once it returns.
+func (s *ProxyServer) getPacketBuffer() []byte {
+	if s.PacketBuffers == nil {
+		return make([]byte, DefaultPacketChunkSize)
+	}
+	return s.PacketBuffers.Get()
+}
+
+func (s *ProxyServer) putPacketBuffer(buf []byte) {
+	if s.PacketBuffers != nil {
+		s.PacketBuffers.Put(buf)
+	}
 }
@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+)
+
+// WebSocketPath is the HTTP path on which agents upgrade to a WebSocket
+// carrying the agent gRPC stream.
+const WebSocketPath = "/agent"
+
+var errListenerClosed = errors.New("websocket listener closed")
+
+// WebSocketListener is a net.Listener fed by WebSocket upgrades. Serve it as
+// an http.Handler and hand it to a grpc.Server as the listener, so agents
+// behind L7-only egress proxies can tunnel the agent service over HTTPS.
+// The grpc.Server needs WebSocketCredentials for the agents to be
+// authenticated by their client certificate.
+type WebSocketListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	ws        websocket.Server
+}
+
+// NewWebSocketListener returns a WebSocketListener reporting addr as its
+// address.
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	l := &WebSocketListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	l.ws = websocket.Server{
+		// Agents are not browsers; accept any (or no) Origin.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.handle,
+	}
+	return l
+}
+
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WebSocketPath {
+		http.NotFound(w, r)
+		return
+	}
+	l.ws.ServeHTTP(w, r)
+}
+
+func (l *WebSocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws, closed: make(chan struct{})}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		ws.Close() /* #nosec G104 */
+		return
+	}
+	klog.V(2).InfoS("Accepted agent websocket connection", "remoteAddr", ws.Request().RemoteAddr)
+	// The websocket is torn down when the handler returns, so block until
+	// the consumer is done with the connection.
+	<-conn.closed
+}
+
+// Accept implements net.Listener.
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close implements net.Listener.
+func (l *WebSocketListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wsConn signals the owning handler once the connection is closed.
+type wsConn struct {
+	*websocket.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
+
+// WebSocketCredentials returns the transport credentials of a grpc.Server
+// serving a WebSocketListener. As TLS is terminated by the HTTPS server,
+// they don't secure the connections themselves but report the TLS state
+// of the HTTPS requests upgraded to them, so that agents presenting a
+// client certificate are authenticated as on the agent port.
+func WebSocketCredentials() credentials.TransportCredentials {
+	return webSocketCredentials{}
+}
+
+type webSocketCredentials struct{}
+
+func (webSocketCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("websocket credentials only apply to servers")
+}
+
+func (webSocketCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	ws, ok := conn.(*wsConn)
+	if !ok || ws.Request().TLS == nil {
+		return nil, nil, errors.New("connection is not a websocket upgraded from HTTPS")
+	}
+	return conn, credentials.TLSInfo{
+		State:          *ws.Request().TLS,
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}, nil
+}
+
+func (webSocketCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls"}
+}
+
+func (c webSocketCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (webSocketCredentials) OverrideServerName(string) error {
+	return nil
+}
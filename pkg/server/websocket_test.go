@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestWebSocketCredentials(t *testing.T) {
+	l := NewWebSocketListener(&net.TCPAddr{})
+	defer l.Close()
+	ts := httptest.NewTLSServer(l)
+	defer ts.Close()
+
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	config, err := websocket.NewConfig("wss://"+addr+WebSocketPath, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: true} // #nosec G402
+	go func() {
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		ws.Read(make([]byte, 1)) // #nosec G104
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, authInfo, err := WebSocketCredentials().ServerHandshake(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tlsInfo, ok := authInfo.(credentials.TLSInfo)
+	if !ok || !tlsInfo.State.HandshakeComplete {
+		t.Errorf("expected the TLS state of the upgraded request, got %#v", authInfo)
+	}
+
+	if _, _, err := WebSocketCredentials().ServerHandshake(&net.TCPConn{}); err == nil {
+		t.Error("expected an error for a connection which is not a websocket")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"math/rand"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// DefaultSpilloverThreshold is the default utilization of the agents in
+// the zone of the server beyond which dials spill over to other zones.
+const DefaultSpilloverThreshold = 0.8
+
+// zoneRouting is the zone preference of a dial with zone affinity. Dials
+// are routed through the agents in the zone of the server, and through
+// those of the other zones if none is available. Once the agents in the
+// zone are utilized beyond the spillover threshold, a share of the dials
+// growing with the utilization spills over: they prefer the agents of the
+// other zones, trading the latency of crossing zones for the availability
+// of the agents in the zone.
+type zoneRouting struct {
+	s    *ProxyServer
+	zone string
+	// spill is whether the dial prefers the agents of the other zones.
+	spill bool
+}
+
+// routeZone returns the zone preference of a dial, nil without zone
+// affinity.
+func (s *ProxyServer) routeZone(capacity *capacityFilter) *zoneRouting {
+	config := s.Topology
+	if !config.ZoneAffinity || config.Zone == "" {
+		return nil
+	}
+	utilization := s.zoneUtilization(config.Zone, capacity)
+	metrics.Metrics.SetZoneUtilization(utilization)
+	share := spilloverShare(utilization, config.SpilloverThreshold)
+	z := &zoneRouting{s: s, zone: config.Zone}
+	if share > 0 {
+		z.spill = rand.Float64() < share /* #nosec G404 */
+	}
+	return z
+}
+
+// zoneUtilization returns the share of the connection capacity of the
+// agents in zone used by their connections, 0 if none advertised one.
+// Agents without capacity are not accounted, so that their zone only
+// spills over once they are unavailable.
+func (s *ProxyServer) zoneUtilization(zone string, capacity *capacityFilter) float64 {
+	maxConns := make(map[string]int)
+	s.amu.Lock()
+	for agentID, streams := range s.agentStreams {
+		for stream := range streams {
+			// the streams of an agent announce the same labels and
+			// capacity
+			ctx := stream.Context()
+			if max := contextMaxConnections(ctx); max > 0 && s.agentZone(ctx) == zone {
+				maxConns[agentID] = max
+			}
+			break
+		}
+	}
+	s.amu.Unlock()
+	if len(maxConns) == 0 {
+		return 0
+	}
+	var used, total int
+	counts := capacity.connectionCounts()
+	for agentID, max := range maxConns {
+		conns := counts[agentID]
+		if conns > max {
+			conns = max
+		}
+		used += conns
+		total += max
+	}
+	return float64(used) / float64(total)
+}
+
+// spilloverShare returns the share of the dials spilling over to other
+// zones at utilization: none up to threshold, growing linearly to all
+// once the zone is fully utilized.
+func spilloverShare(utilization, threshold float64) float64 {
+	switch {
+	case utilization <= threshold:
+		return 0
+	case utilization >= 1 || threshold >= 1:
+		return 1
+	}
+	return (utilization - threshold) / (1 - threshold)
+}
+
+// filters returns the agent filters a BackendManager picks with in turn,
+// restricting filter to the agents of the preferred zone, then to those of
+// the others.
+func (z *zoneRouting) filters(filter agentFilter) []agentFilter {
+	local := func(b *backend) bool {
+		return z.s.agentZone(b.Context()) == z.zone && filter(b)
+	}
+	others := func(b *backend) bool {
+		return z.s.agentZone(b.Context()) != z.zone && filter(b)
+	}
+	if z.spill {
+		return []agentFilter{others, local}
+	}
+	return []agentFilter{local, others}
+}
+
+// observe counts the dial routed through be if it left the zone of the
+// server.
+func (z *zoneRouting) observe(be Backend) {
+	zone := z.s.agentZone(be.Context())
+	if zone == z.zone {
+		return
+	}
+	reason := metrics.SpilloverUnavailable
+	if z.spill {
+		reason = metrics.SpilloverUtilization
+	}
+	util.V(util.LogBackendManager, 4).InfoS("Spilled the dial over to another zone", "zone", z.zone, "agentZone", zone, "agentID", backendAgentID(be), "reason", reason)
+	metrics.Metrics.ZoneSpilloverInc(reason)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func newFakeZoneConnectServer(agentID, zone, maxConnections string) *fakeCapableConnectServer {
+	md := metadata.Pairs(header.AgentID, agentID, header.AgentLabels, DefaultTopologyZoneLabel+"="+zone, header.AgentMaxConnections, maxConnections)
+	return &fakeCapableConnectServer{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func newZoneAffinityServer(strategies []ProxyStrategy) *ProxyServer {
+	p := NewProxyServer("server-1", strategies, 1, nil, false)
+	p.Topology.Zone = "zone-a"
+	p.Topology.ZoneAffinity = true
+	p.Topology.SpilloverThreshold = 0.5
+	return p
+}
+
+// zoneDials returns the number of dials routed through each agent.
+func zoneDials(t *testing.T, p *ProxyServer, host string, dials int) map[string]int {
+	t.Helper()
+	picked := make(map[string]int)
+	for i := 0; i < dials; i++ {
+		be, _, err := p.getBackend(host, "tcp", "", nil)
+		if err != nil {
+			t.Fatalf("expected a backend, got %v", err)
+		}
+		picked[backendAgentID(be)]++
+	}
+	return picked
+}
+
+func TestZoneAffinitySpillover(t *testing.T) {
+	p := newZoneAffinityServer([]ProxyStrategy{ProxyStrategyDefault})
+	for agentID, zone := range map[string]string{"local": "zone-a", "remote": "zone-b"} {
+		conn := newFakeZoneConnectServer(agentID, zone, "4")
+		p.BackendManagers[0].AddBackend(agentID, pkgagent.UID, conn)
+		p.trackAgentStream(agentID, conn)
+	}
+
+	testCases := []struct {
+		name        string
+		connections int
+		local       bool
+		remote      bool
+	}{
+		{name: "idle", connections: 0, local: true},
+		{name: "at threshold", connections: 2, local: true},
+		{name: "beyond threshold", connections: 3, local: true, remote: true},
+		{name: "saturated", connections: 4, remote: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 4; i++ {
+				p.removeFrontend("local", int64(i))
+			}
+			for i := 0; i < tc.connections; i++ {
+				p.addFrontend("local", int64(i), &ProxyClientConnection{})
+			}
+			picked := zoneDials(t, p, "10.0.0.1:80", 200)
+			if got := picked["local"] > 0; got != tc.local {
+				t.Errorf("expected dials through the local agent %v, got %v", tc.local, picked)
+			}
+			if got := picked["remote"] > 0; got != tc.remote {
+				t.Errorf("expected dials through the remote agent %v, got %v", tc.remote, picked)
+			}
+		})
+	}
+}
+
+func TestZoneAffinityUnavailable(t *testing.T) {
+	p := newZoneAffinityServer([]ProxyStrategy{ProxyStrategyDefault})
+	conn := newFakeZoneConnectServer("remote", "zone-b", "0")
+	p.BackendManagers[0].AddBackend("remote", pkgagent.UID, conn)
+	p.trackAgentStream("remote", conn)
+
+	if picked := zoneDials(t, p, "10.0.0.1:80", 10); picked["remote"] != 10 {
+		t.Errorf("expected the dials to go through the remote agent without local ones, got %v", picked)
+	}
+}
+
+func TestZoneAffinityKeepsStrategyOrder(t *testing.T) {
+	p := newZoneAffinityServer([]ProxyStrategy{ProxyStrategyDestHost, ProxyStrategyDefault})
+	local := newFakeZoneConnectServer("local", "zone-a", "0")
+	remote := newFakeZoneConnectServer("remote", "zone-b", "0")
+	for _, bm := range p.BackendManagers {
+		switch bm.(type) {
+		case *DestHostBackendManager:
+			bm.AddBackend("10.0.0.5", pkgagent.IPv4, remote)
+		default:
+			bm.AddBackend("local", pkgagent.UID, local)
+			bm.AddBackend("remote", pkgagent.UID, remote)
+		}
+	}
+
+	// the agent of the destination is preferred over the local agents of
+	// the next strategies
+	if picked := zoneDials(t, p, "10.0.0.5:80", 10); picked["remote"] != 10 {
+		t.Errorf("expected the dials to go through the agent of the destination, got %v", picked)
+	}
+	if picked := zoneDials(t, p, "10.0.0.6:80", 10); picked["local"] != 10 {
+		t.Errorf("expected the dials to go through the local agent, got %v", picked)
+	}
+}
+
+func TestSpilloverShare(t *testing.T) {
+	testCases := []struct {
+		utilization float64
+		threshold   float64
+		want        float64
+	}{
+		{utilization: 0, threshold: 0.8, want: 0},
+		{utilization: 0.8, threshold: 0.8, want: 0},
+		{utilization: 0.9, threshold: 0.8, want: 0.5},
+		{utilization: 1, threshold: 0.8, want: 1},
+		{utilization: 1, threshold: 1, want: 0},
+		{utilization: 0.5, threshold: 0, want: 0.5},
+	}
+	for _, tc := range testCases {
+		got := spilloverShare(tc.utilization, tc.threshold)
+		if got < tc.want-1e-9 || got > tc.want+1e-9 {
+			t.Errorf("spilloverShare(%v, %v): expected %v, got %v", tc.utilization, tc.threshold, tc.want, got)
+		}
+	}
+}
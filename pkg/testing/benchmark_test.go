@@ -0,0 +1,153 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// TestMain discards the logs while benchmarking, go test interleaves them
+// with the results read by hack/benchgate.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if flag.Lookup("test.bench").Value.String() != "" {
+		fs := flag.NewFlagSet("klog", flag.ExitOnError)
+		klog.InitFlags(fs)
+		fs.Set("logtostderr", "false")
+		fs.Set("stderrthreshold", "FATAL")
+		klog.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+var payloadSizes = []struct {
+	name string
+	size int
+}{
+	{"1KB", 1 << 10},
+	{"64KB", 64 << 10},
+	{"1MB", 1 << 20},
+}
+
+// benchmarkConn dials an echoing destination through a client, the proxy
+// server and the agent, connected in memory.
+func benchmarkConn(b *testing.B) net.Conn {
+	b.Helper()
+	h := NewHarness(Config{Dialer: echoDialer})
+	b.Cleanup(h.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.WaitForAgent(ctx); err != nil {
+		b.Fatalf("expect the agent to connect; got %v", err)
+	}
+	tunnel, err := h.NewTunnel(ctx)
+	if err != nil {
+		b.Fatalf("expect a tunnel; got %v", err)
+	}
+	conn, err := tunnel.DialContext(ctx, "tcp", "echo:80")
+	if err != nil {
+		b.Fatalf("expect the dial to succeed; got %v", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// BenchmarkDataPathRoundTrip measures the latency of sending a payload to
+// the destination and receiving it back.
+func BenchmarkDataPathRoundTrip(b *testing.B) {
+	for _, ps := range payloadSizes {
+		b.Run(ps.name, func(b *testing.B) {
+			conn := benchmarkConn(b)
+			payload, buf := make([]byte, ps.size), make([]byte, ps.size)
+			b.SetBytes(int64(ps.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDataPathThroughput measures the rate payloads are streamed to
+// the destination and back, with writes not waiting for the echo.
+func BenchmarkDataPathThroughput(b *testing.B) {
+	for _, ps := range payloadSizes {
+		b.Run(ps.name, func(b *testing.B) {
+			conn := benchmarkConn(b)
+			payload := make([]byte, ps.size)
+			b.SetBytes(int64(ps.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			errCh := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := conn.Write(payload); err != nil {
+						errCh <- err
+						return
+					}
+				}
+				errCh <- nil
+			}()
+			if _, err := io.CopyN(io.Discard, conn, int64(b.N)*int64(ps.size)); err != nil {
+				b.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkDial measures the latency of creating a single use tunnel and
+// dialing and closing its connection.
+func BenchmarkDial(b *testing.B) {
+	h := NewHarness(Config{Dialer: echoDialer})
+	defer h.Close()
+	ctx := context.Background()
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := h.WaitForAgent(waitCtx); err != nil {
+		b.Fatalf("expect the agent to connect; got %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tunnel, err := h.NewTunnel(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn, err := tunnel.DialContext(ctx, "tcp", "echo:80")
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
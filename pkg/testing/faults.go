@@ -0,0 +1,268 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testing runs a proxy server, an agent and clients in memory,
+// with faults injected in the streams between them, for integrators to
+// test the handling of the errors of the proxy.
+package testing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// Link is the stream a packet crosses.
+type Link string
+
+const (
+	// LinkFrontend is the stream between a client and the proxy server.
+	LinkFrontend Link = "frontend"
+	// LinkBackend is the stream between the agent and the proxy server.
+	LinkBackend Link = "backend"
+)
+
+// Direction is the direction a packet crosses a link in, seen from the
+// proxy server.
+type Direction string
+
+const (
+	// Inbound packets are received by the proxy server.
+	Inbound Direction = "inbound"
+	// Outbound packets are sent by the proxy server.
+	Outbound Direction = "outbound"
+)
+
+// Match selects the packets a fault applies to. Empty fields match any
+// packet.
+type Match struct {
+	Link      Link
+	Direction Direction
+	Types     []client.PacketType
+}
+
+func (m Match) matches(link Link, dir Direction, pkt *client.Packet) bool {
+	if m.Link != "" && m.Link != link {
+		return false
+	}
+	if m.Direction != "" && m.Direction != dir {
+		return false
+	}
+	if len(m.Types) == 0 {
+		return true
+	}
+	for _, t := range m.Types {
+		if pkt.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Fault alters the packets crossing the links of a Harness.
+type Fault interface {
+	// Inject returns the packets to forward in place of pkt, none to
+	// drop it, or an error to reset the stream with.
+	Inject(link Link, dir Direction, pkt *client.Packet) ([]*client.Packet, error)
+}
+
+// FaultFunc is a Fault calling itself.
+type FaultFunc func(link Link, dir Direction, pkt *client.Packet) ([]*client.Packet, error)
+
+// Inject calls f.
+func (f FaultFunc) Inject(link Link, dir Direction, pkt *client.Packet) ([]*client.Packet, error) {
+	return f(link, dir, pkt)
+}
+
+// countingFault applies inject to the first n packets selected by m, or
+// to all of them if n is not positive, and forwards the others as is.
+func countingFault(m Match, n int, inject func(*client.Packet) ([]*client.Packet, error)) Fault {
+	var mu sync.Mutex
+	seen := 0
+	return FaultFunc(func(link Link, dir Direction, pkt *client.Packet) ([]*client.Packet, error) {
+		if !m.matches(link, dir, pkt) {
+			return []*client.Packet{pkt}, nil
+		}
+		mu.Lock()
+		seen++
+		apply := n <= 0 || seen <= n
+		mu.Unlock()
+		if !apply {
+			return []*client.Packet{pkt}, nil
+		}
+		return inject(pkt)
+	})
+}
+
+// DropPackets drops the first n packets selected by m, all of them if n
+// is not positive.
+func DropPackets(m Match, n int) Fault {
+	return countingFault(m, n, func(*client.Packet) ([]*client.Packet, error) {
+		return nil, nil
+	})
+}
+
+// DelayPackets holds the packets selected by m for d before forwarding
+// them. Like a network delay, it holds the packets following them on the
+// stream too.
+func DelayPackets(m Match, d time.Duration) Fault {
+	return countingFault(m, 0, func(pkt *client.Packet) ([]*client.Packet, error) {
+		time.Sleep(d)
+		return []*client.Packet{pkt}, nil
+	})
+}
+
+// DuplicatePackets forwards the packets selected by m twice.
+func DuplicatePackets(m Match) Fault {
+	return countingFault(m, 0, func(pkt *client.Packet) ([]*client.Packet, error) {
+		return []*client.Packet{pkt, proto.Clone(pkt).(*client.Packet)}, nil
+	})
+}
+
+// ResetStream resets the stream carrying the n-th packet selected by m,
+// the first one if n is not positive, instead of forwarding it.
+func ResetStream(m Match, n int) Fault {
+	if n <= 0 {
+		n = 1
+	}
+	var mu sync.Mutex
+	seen := 0
+	return FaultFunc(func(link Link, dir Direction, pkt *client.Packet) ([]*client.Packet, error) {
+		if !m.matches(link, dir, pkt) {
+			return []*client.Packet{pkt}, nil
+		}
+		mu.Lock()
+		seen++
+		reset := seen == n
+		mu.Unlock()
+		if reset {
+			return nil, status.Errorf(codes.Unavailable, "stream reset by fault injection at %s packet", pkt.Type)
+		}
+		return []*client.Packet{pkt}, nil
+	})
+}
+
+// DelayDialResponse holds the DIAL_RSP packets sent by the agent for d.
+func DelayDialResponse(d time.Duration) Fault {
+	return DelayPackets(Match{Link: LinkBackend, Direction: Inbound, Types: []client.PacketType{client.PacketType_DIAL_RSP}}, d)
+}
+
+// DuplicateClose sends the clients every CLOSE_RSP packet twice.
+func DuplicateClose() Fault {
+	return DuplicatePackets(Match{Link: LinkFrontend, Direction: Outbound, Types: []client.PacketType{client.PacketType_CLOSE_RSP}})
+}
+
+// faultStream is a grpc.ServerStream injecting faults in the packets it
+// sends and receives.
+type faultStream struct {
+	grpc.ServerStream
+	link   Link
+	faults func() []Fault
+
+	// pending are the packets received, and left to be returned by
+	// RecvMsg, when a fault replaced a packet with several.
+	pending []*client.Packet
+
+	resetOnce sync.Once
+	reset     chan struct{}
+	resetErr  error
+}
+
+// inject runs pkt through the faults in order, resetting the stream if
+// any of them fails.
+func (s *faultStream) inject(dir Direction, pkt *client.Packet) ([]*client.Packet, error) {
+	pkts := []*client.Packet{pkt}
+	for _, f := range s.faults() {
+		var out []*client.Packet
+		for _, p := range pkts {
+			injected, err := f.Inject(s.link, dir, p)
+			if err != nil {
+				s.resetOnce.Do(func() {
+					s.resetErr = err
+					close(s.reset)
+				})
+				return nil, err
+			}
+			out = append(out, injected...)
+		}
+		pkts = out
+	}
+	return pkts, nil
+}
+
+func (s *faultStream) SendMsg(m interface{}) error {
+	pkt, ok := m.(*client.Packet)
+	if !ok {
+		return s.ServerStream.SendMsg(m)
+	}
+	pkts, err := s.inject(Outbound, pkt)
+	if err != nil {
+		return err
+	}
+	for _, p := range pkts {
+		if err := s.ServerStream.SendMsg(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *faultStream) RecvMsg(m interface{}) error {
+	pkt, ok := m.(*client.Packet)
+	if !ok {
+		return s.ServerStream.RecvMsg(m)
+	}
+	for len(s.pending) == 0 {
+		received := &client.Packet{}
+		if err := s.ServerStream.RecvMsg(received); err != nil {
+			return err
+		}
+		pkts, err := s.inject(Inbound, received)
+		if err != nil {
+			return err
+		}
+		s.pending = pkts
+	}
+	pkt.Reset()
+	proto.Merge(pkt, s.pending[0])
+	s.pending = s.pending[1:]
+	return nil
+}
+
+// streamInterceptor injects the faults in the streams of link. A reset
+// ends the stream right away, as seen by the peer, while its handler
+// notices on its next send or receive.
+func streamInterceptor(link Link, faults func() []Fault) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		fs := &faultStream{ServerStream: ss, link: link, faults: faults, reset: make(chan struct{})}
+		done := make(chan error, 1)
+		go func() {
+			done <- handler(srv, fs)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-fs.reset:
+			return fs.resetErr
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
+	clientproto "sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	agentproto "sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+const bufferSize = 1 << 20
+
+// Config configures a Harness.
+type Config struct {
+	// AgentID is the ID of the agent, a random one if empty.
+	AgentID string
+	// Faults are injected from the start, until replaced by SetFaults.
+	Faults []Fault
+	// Dialer dials the destinations of the agent. Nil dials the network.
+	Dialer agent.DestinationDialer
+}
+
+// Harness runs a proxy server and an agent connected in memory, for
+// clients to tunnel through with faults injected.
+type Harness struct {
+	// Server is the proxy server.
+	Server *server.ProxyServer
+	// Agent is the agent connected to Server.
+	Agent *agent.ClientSet
+
+	frontendListener *bufconn.Listener
+	backendListener  *bufconn.Listener
+	frontendServer   *grpc.Server
+	backendServer    *grpc.Server
+	stopCh           chan struct{}
+
+	// faults holds the []Fault injected.
+	faults atomic.Value
+}
+
+// NewHarness starts a proxy server and an agent connecting to it. Close
+// stops them.
+func NewHarness(cfg Config) *Harness {
+	agentID := cfg.AgentID
+	if agentID == "" {
+		agentID = uuid.New().String()
+	}
+	h := &Harness{
+		Server:           server.NewProxyServer(uuid.New().String(), []server.ProxyStrategy{server.ProxyStrategyDefault}, 1, &server.AgentTokenAuthenticationOptions{}, false),
+		frontendListener: bufconn.Listen(bufferSize),
+		backendListener:  bufconn.Listen(bufferSize),
+		stopCh:           make(chan struct{}),
+	}
+	h.SetFaults(cfg.Faults...)
+
+	h.frontendServer = grpc.NewServer(grpc.StreamInterceptor(streamInterceptor(LinkFrontend, h.currentFaults)))
+	clientproto.RegisterProxyServiceServer(h.frontendServer, h.Server)
+	go h.frontendServer.Serve(h.frontendListener)
+
+	h.backendServer = grpc.NewServer(grpc.StreamInterceptor(streamInterceptor(LinkBackend, h.currentFaults)))
+	agentproto.RegisterAgentServiceServer(h.backendServer, h.Server)
+	go h.backendServer.Serve(h.backendListener)
+
+	cc := agent.ClientSetConfig{
+		Address:       "bufconn",
+		AgentID:       agentID,
+		SyncInterval:  100 * time.Millisecond,
+		ProbeInterval: 100 * time.Millisecond,
+		DialOptions:   []grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(bufconnDialer(h.backendListener))},
+		Dialer:        cfg.Dialer,
+	}
+	h.Agent = cc.NewAgentClientSet(h.stopCh)
+	h.Agent.Serve()
+	return h
+}
+
+func bufconnDialer(l *bufconn.Listener) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}
+}
+
+func (h *Harness) currentFaults() []Fault {
+	return h.faults.Load().([]Fault)
+}
+
+// SetFaults replaces the faults injected in the packets crossing the
+// links from now on. They apply in order, each to the packets forwarded
+// by the previous one.
+func (h *Harness) SetFaults(faults ...Fault) {
+	h.faults.Store(append([]Fault(nil), faults...))
+}
+
+// WaitForAgent waits until the agent is connected to the proxy server.
+func (h *Harness) WaitForAgent(ctx context.Context) error {
+	return wait.PollImmediateUntil(10*time.Millisecond, func() (bool, error) {
+		ready, _ := h.Server.Readiness.Ready()
+		return ready, nil
+	}, ctx.Done())
+}
+
+// NewTunnel creates a single use tunnel through the proxy server.
+func (h *Harness) NewTunnel(ctx context.Context, opts ...grpc.DialOption) (client.Tunnel, error) {
+	opts = append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(bufconnDialer(h.frontendListener))}, opts...)
+	return client.CreateSingleUseGrpcTunnelWithContext(ctx, context.Background(), "bufconn", opts...)
+}
+
+// Close stops the agent and the proxy server.
+func (h *Harness) Close() {
+	close(h.stopCh)
+	h.frontendServer.Stop()
+	h.backendServer.Stop()
+}
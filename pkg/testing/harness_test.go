@@ -0,0 +1,148 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// echoDialer connects to in-memory destinations echoing their data.
+func echoDialer(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+func startHarness(t *testing.T, faults ...Fault) *Harness {
+	t.Helper()
+	h := NewHarness(Config{Faults: faults, Dialer: echoDialer})
+	t.Cleanup(h.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.WaitForAgent(ctx); err != nil {
+		t.Fatalf("expect the agent to connect; got %v", err)
+	}
+	return h
+}
+
+func dial(t *testing.T, h *Harness, timeout time.Duration) (net.Conn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tunnel, err := h.NewTunnel(ctx)
+	if err != nil {
+		t.Fatalf("expect a tunnel; got %v", err)
+	}
+	return tunnel.DialContext(ctx, "tcp", "echo:80")
+}
+
+func TestHarnessProxy(t *testing.T) {
+	h := startHarness(t)
+	conn, err := dial(t, h, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expect the dial to succeed; got %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expect hello; got %q (%v)", buf, err)
+	}
+}
+
+func TestHarnessDelayDialResponse(t *testing.T) {
+	delay := 200 * time.Millisecond
+	h := startHarness(t, DelayDialResponse(delay))
+	start := time.Now()
+	conn, err := dial(t, h, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expect the dial to succeed; got %v", err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("expect the dial to take at least %v; got %v", delay, elapsed)
+	}
+}
+
+func TestHarnessDropDialResponse(t *testing.T) {
+	h := startHarness(t, DropPackets(Match{Link: LinkFrontend, Types: []client.PacketType{client.PacketType_DIAL_RSP}}, 0))
+	if conn, err := dial(t, h, 500*time.Millisecond); err == nil {
+		conn.Close()
+		t.Error("expect the dial to time out without DIAL_RSP")
+	}
+}
+
+func TestHarnessResetStream(t *testing.T) {
+	h := startHarness(t)
+	conn, err := dial(t, h, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expect the dial to succeed; got %v", err)
+	}
+	defer conn.Close()
+
+	h.SetFaults(ResetStream(Match{Link: LinkFrontend, Direction: Outbound, Types: []client.PacketType{client.PacketType_DATA}}, 1))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("expect nil; got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Error("expect the read to fail after the stream reset")
+	}
+}
+
+func TestHarnessDuplicateClose(t *testing.T) {
+	h := startHarness(t, DuplicateClose())
+	for i := 0; i < 2; i++ {
+		conn, err := dial(t, h, 5*time.Second)
+		if err != nil {
+			t.Fatalf("expect the dial to succeed; got %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("expect nil; got %v", err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	pkt := &client.Packet{Type: client.PacketType_CLOSE_RSP}
+	for _, tc := range []struct {
+		match    Match
+		expected bool
+	}{
+		{Match{}, true},
+		{Match{Link: LinkFrontend}, true},
+		{Match{Link: LinkBackend}, false},
+		{Match{Direction: Inbound}, false},
+		{Match{Types: []client.PacketType{client.PacketType_DATA, client.PacketType_CLOSE_RSP}}, true},
+		{Match{Types: []client.PacketType{client.PacketType_DATA}}, false},
+	} {
+		if got := tc.match.matches(LinkFrontend, Outbound, pkt); got != tc.expected {
+			t.Errorf("expect %+v to match %v; got %v", tc.match, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	otlpQueueSize     = 2048
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpTimeout       = 10 * time.Second
+
+	instrumentationScope = "sigs.k8s.io/apiserver-network-proxy"
+)
+
+// OTLPExporter exports spans in batches to an OpenTelemetry collector
+// using the OTLP/HTTP protocol with JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *Span
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewOTLPExporter returns an exporter posting spans to endpoint, e.g.
+// http://otel-collector:4318/v1/traces.
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: otlpTimeout},
+		spans:    make(chan *Span, otlpQueueSize),
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpan queues span for export. Spans are dropped if the queue is
+// full, tracing must never slow down proxied traffic.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		klog.V(4).InfoS("Dropping span, export queue is full", "span", span.Name)
+	}
+}
+
+// Stop exports the queued spans and stops the exporter.
+func (e *OTLPExporter) Stop() {
+	e.stopOnce.Do(func() { close(e.stopCh) })
+	<-e.done
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			klog.ErrorS(err, "Failed to export spans", "endpoint", e.endpoint, "count", len(batch))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stopCh:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) export(spans []*Span) error {
+	body, err := json.Marshal(newExportRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types are the JSON encoding of the OTLP
+// ExportTraceServiceRequest, limited to the fields used here.
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOK     = 1
+	otlpStatusCodeError  = 2
+)
+
+func newExportRequest(spans []*Span) *otlpExportRequest {
+	byService := make(map[string][]otlpSpan)
+	var services []string
+	for _, s := range spans {
+		service := s.tracer.service
+		if _, ok := byService[service]; !ok {
+			services = append(services, service)
+		}
+		byService[service] = append(byService[service], newOTLPSpan(s))
+	}
+	req := &otlpExportRequest{}
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: "service.name", Value: otlpValue{StringValue: service}},
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: instrumentationScope},
+				Spans: byService[service],
+			}},
+		})
+	}
+	return req
+}
+
+func newOTLPSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+		Name:              s.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCodeOK},
+	}
+	if s.Parent.SpanID != ([8]byte{}) {
+		// root spans have no parent, which OTLP encodes by omitting it
+		span.ParentSpanID = hex.EncodeToString(s.Parent.SpanID[:])
+	}
+	for k, v := range s.Attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if s.Error != "" {
+		span.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.Error}
+	}
+	return span
+}
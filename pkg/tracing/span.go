@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+// Exporter ships ended spans to a tracing backend.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer starts spans of one service. A nil *Tracer starts no spans.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer returns a Tracer exporting the spans of service to exporter.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// StartSpan starts a span named name as a child of the span identified by
+// traceParent. Spans are only recorded for sampled parents, so StartSpan
+// returns nil if traceParent is empty, invalid or not sampled. All methods
+// of a nil *Span are no-ops.
+func (t *Tracer) StartSpan(name, traceParent string) *Span {
+	if t == nil || traceParent == "" {
+		return nil
+	}
+	parent, err := ParseTraceParent(traceParent)
+	if err != nil || !parent.Sampled {
+		return nil
+	}
+	return &Span{
+		tracer:     t,
+		Name:       name,
+		Parent:     parent,
+		Context:    parent.child(),
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	Name       string
+	Parent     SpanContext
+	Context    SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	// Error is the error the operation failed with, empty on success.
+	Error string
+}
+
+// TraceParent returns the traceparent identifying s, to propagate it to the
+// next hop.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.TraceParent()
+}
+
+// SetAttribute sets an attribute of s.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends s and exports it. errMsg is empty if the operation
+// succeeded. Only the first call has an effect.
+func (s *Span) Finish(errMsg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.Error = errMsg
+	s.mu.Unlock()
+	s.tracer.exporter.ExportSpan(s)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing records spans of dials and proxied connections. Trace
+// context is propagated between the konnectivity-client, the proxy server
+// and the agent in the W3C traceparent format through the DialRequest
+// metadata, and spans are exported with the OTLP/HTTP JSON protocol, so
+// they join the traces of OpenTelemetry instrumented callers. The
+// OpenTelemetry SDK is not used: its exporters and gRPC instrumentation
+// require newer grpc and protobuf modules than the konnectivity-client
+// module pins for the kube-apiserver.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TraceParentKey is the DialRequest metadata key carrying the W3C
+// traceparent of the span the dial belongs to.
+const TraceParentKey = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceParent parses a W3C traceparent header value, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent %q", traceParent)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("invalid traceparent %q", traceParent)
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("invalid trace ID in traceparent %q: %v", traceParent, err)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("invalid span ID in traceparent %q: %v", traceParent, err)
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q: %v", traceParent, err)
+	}
+	sc.Sampled = flags[0]&0x01 != 0
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q: all zero ID", traceParent)
+	}
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex digits", hex.EncodedLen(len(dst)))
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// IsValid reports whether neither the trace ID nor the span ID is zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a W3C traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// child returns a new span context within the trace of sc.
+func (sc SpanContext) child() SpanContext {
+	child := SpanContext{TraceID: sc.TraceID, Sampled: sc.Sampled}
+	for child.SpanID == [8]byte{} {
+		if _, err := rand.Read(child.SpanID[:]); err != nil {
+			panic(fmt.Sprintf("failed to generate span ID: %v", err))
+		}
+	}
+	return child
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceParent(t *testing.T) {
+	sc, err := ParseTraceParent(testTraceParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled {
+		t.Error("expected sampled span context")
+	}
+	if got := sc.TraceParent(); got != testTraceParent {
+		t.Errorf("expected %q, got %q", testTraceParent, got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestStartSpanSamplesByParent(t *testing.T) {
+	tracer := NewTracer("test", nil)
+	if span := tracer.StartSpan("dial", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); span != nil {
+		t.Error("expected no span for an unsampled parent")
+	}
+	if span := tracer.StartSpan("dial", ""); span != nil {
+		t.Error("expected no span without parent")
+	}
+
+	span := tracer.StartSpan("dial", testTraceParent)
+	if span == nil {
+		t.Fatal("expected a span for a sampled parent")
+	}
+	if span.Context.TraceID != span.Parent.TraceID || span.Context.SpanID == span.Parent.SpanID {
+		t.Errorf("expected a child span, got %s with parent %s", span.TraceParent(), span.Parent.TraceParent())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpExportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests <- req
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL)
+	tracer := NewTracer("konnectivity-server", exporter)
+	span := tracer.StartSpan("dial", testTraceParent)
+	span.SetAttribute("destination", "10.0.0.1:10250")
+	span.Finish("connection refused")
+	exporter.Stop()
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected one span, got %+v", req)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanID != "00f067aa0ba902b7" || got.Name != "dial" {
+		t.Errorf("unexpected span %+v", got)
+	}
+	if got.Status.Code != otlpStatusCodeError || got.Status.Message != "connection refused" {
+		t.Errorf("unexpected status %+v", got.Status)
+	}
+}
+
+func TestOTLPSpanOmitsMissingParent(t *testing.T) {
+	span := newOTLPSpan(&Span{Name: "dial", Context: SpanContext{SpanID: [8]byte{1}}})
+	encoded, err := json.Marshal(span)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if parent, ok := fields["parentSpanId"]; ok {
+		t.Errorf("expected no parent span ID for a root span, got %v", parent)
+	}
+}
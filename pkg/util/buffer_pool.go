@@ -0,0 +1,56 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "sync"
+
+// BufferPool hands out byte slices of a fixed size, reusing slices which
+// were returned with Put to avoid allocating a buffer per packet.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of buffers of size bytes.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Size returns the length of the buffers handed out by the pool.
+func (p *BufferPool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer of Size bytes. Its content is undefined.
+func (p *BufferPool) Get() []byte {
+	return (*p.pool.Get().(*[]byte))[:p.size]
+}
+
+// Put returns buf to the pool. The caller must not use buf afterwards.
+// Buffers which were not handed out by the pool are dropped.
+func (p *BufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "testing"
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(16)
+	buf := p.Get()
+	if len(buf) != 16 {
+		t.Fatalf("expected a 16 byte buffer, got %d", len(buf))
+	}
+	p.Put(buf[:3])
+	if buf := p.Get(); len(buf) != 16 {
+		t.Errorf("expected a resliced 16 byte buffer, got %d", len(buf))
+	}
+
+	// Foreign buffers must not leak into the pool.
+	p.Put(make([]byte, 8))
+	for i := 0; i < 10; i++ {
+		if buf := p.Get(); len(buf) != 16 || cap(buf) != 16 {
+			t.Fatalf("expected a 16 byte buffer, got len %d cap %d", len(buf), cap(buf))
+		}
+	}
+}
@@ -19,9 +19,11 @@ package util
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 )
 
 // getCACertPool loads CA certificates to pool
@@ -66,3 +68,37 @@ func GetClientTLSConfig(caFile, certFile, keyFile, serverName string, protos []s
 	tlsConfig.Certificates = []tls.Certificate{cert}
 	return tlsConfig, nil
 }
+
+// LoadSessionTicketKeys reads TLS session ticket keys from file, one base64
+// encoded 32 byte key per line, e.g. generated with
+// "openssl rand -base64 32". The first key encrypts new session tickets,
+// the others are only used to decrypt tickets, allowing keys to be rotated
+// without breaking resumption. Empty lines and lines starting with '#'
+// are ignored.
+func LoadSessionTicketKeys(file string) ([][32]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session ticket keys %s: %v", file, err)
+	}
+	var keys [][32]byte
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session ticket key on line %d of %s: %v", i+1, file, err)
+		}
+		var key [32]byte
+		if len(decoded) != len(key) {
+			return nil, fmt.Errorf("session ticket key on line %d of %s has %d bytes, expected %d", i+1, file, len(decoded), len(key))
+		}
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys in %s", file)
+	}
+	return keys, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSessionTicketKeys(t *testing.T) {
+	current := bytes.Repeat([]byte{1}, 32)
+	previous := bytes.Repeat([]byte{2}, 32)
+	testCases := []struct {
+		name    string
+		content string
+		want    [][]byte
+		wantErr bool
+	}{
+		{
+			name:    "rotated keys",
+			content: "# current\n" + base64.StdEncoding.EncodeToString(current) + "\n\n" + base64.StdEncoding.EncodeToString(previous) + "\n",
+			want:    [][]byte{current, previous},
+		},
+		{
+			name:    "short key",
+			content: base64.StdEncoding.EncodeToString(current[:16]),
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			content: "not a key",
+			wantErr: true,
+		},
+		{
+			name:    "no keys",
+			content: "# none yet\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(file, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadSessionTicketKeys(file)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %d keys", len(keys))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tc.want) {
+				t.Fatalf("expected %d keys, got %d", len(tc.want), len(keys))
+			}
+			for i := range keys {
+				if !bytes.Equal(keys[i][:], tc.want[i]) {
+					t.Errorf("unexpected key %d: %x", i, keys[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// CompressionGzip is the name of the gzip DATA payload compression.
+const CompressionGzip = "gzip"
+
+// MinCompressSize is the smallest payload worth compressing; smaller DATA
+// payloads are sent as-is even on compressed connections.
+const MinCompressSize = 256
+
+// MaxDecompressedSize bounds the size of decompressed DATA payloads. DATA
+// packets never exceed the 4MiB receive limit of the gRPC streams they
+// cross uncompressed, so larger payloads are refused rather than inflated
+// without bound.
+const MaxDecompressedSize = 4 << 20
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// SupportedCompression reports whether the named DATA payload compression
+// algorithm is implemented. Only gzip is currently supported.
+func SupportedCompression(algorithm string) bool {
+	return algorithm == CompressionGzip
+}
+
+// Compress compresses data with the named algorithm. The returned bool is
+// false, and data is returned unchanged, when compression would not make the
+// payload smaller.
+func Compress(algorithm string, data []byte) ([]byte, bool, error) {
+	if len(data) < MinCompressSize {
+		return data, false, nil
+	}
+	switch algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, false, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, false, err
+		}
+		if buf.Len() >= len(data) {
+			return data, false, nil
+		}
+		return buf.Bytes(), true, nil
+	default:
+		return nil, false, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+// Decompress reverses Compress. It fails on payloads decompressing to more
+// than MaxDecompressedSize.
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > MaxDecompressedSize {
+			return nil, fmt.Errorf("decompressed payload exceeds %d bytes", MaxDecompressedSize)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("kubectl logs "), 1000)
+
+	compressed, ok, err := Compress(CompressionGzip, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected repetitive payload to be compressed")
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("expected compressed size %d to be smaller than %d", len(compressed), len(data))
+	}
+
+	got, err := Decompress(CompressionGzip, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("round trip did not preserve the payload")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	compressed, ok, err := Compress(CompressionGzip, make([]byte, MaxDecompressedSize+1))
+	if err != nil || !ok {
+		t.Fatalf("expected the payload to be compressed, got %v", err)
+	}
+	if _, err := Decompress(CompressionGzip, compressed); err == nil {
+		t.Error("expected an error for a payload decompressing beyond the limit")
+	}
+
+	compressed, _, err = Compress(CompressionGzip, make([]byte, MaxDecompressedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Decompress(CompressionGzip, compressed); err != nil || len(got) != MaxDecompressedSize {
+		t.Errorf("expected a payload of the limit to decompress, got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCompressSkipsUnprofitablePayloads(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"small":  []byte("ping"),
+		"random": random,
+	} {
+		got, ok, err := Compress(CompressionGzip, data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ok || !bytes.Equal(got, data) {
+			t.Errorf("%s: expected payload to be left uncompressed", name)
+		}
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	if SupportedCompression("zstd") {
+		t.Error("zstd is not implemented")
+	}
+	if _, _, err := Compress("zstd", make([]byte, 1024)); err == nil {
+		t.Error("expected error for unsupported compression")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net"
+	"os"
+)
+
+// ListenLocal listens on the Unix domain socket name, replacing a socket
+// left over by a previous process.
+func ListenLocal(name string) (net.Listener, error) {
+	if fi, err := os.Stat(name); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", name)
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	pipePrefix = `\\.\pipe\`
+
+	// fileFlagFirstPipeInstance fails creating a pipe if another process
+	// already listens on it.
+	fileFlagFirstPipeInstance = 0x00080000
+	pipeBufferSize            = 64 << 10
+
+	// The pipe constants and functions below are missing from the
+	// golang.org/x/sys version this module is pinned to.
+	pipeAccessDuplex       = 0x00000003
+	pipeTypeByte           = 0x00000000
+	pipeReadmodeByte       = 0x00000000
+	pipeWait               = 0x00000000
+	pipeUnlimitedInstances = 255
+)
+
+var (
+	kernel32             = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateNamedPipeW = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = kernel32.NewProc("ConnectNamedPipe")
+)
+
+func createNamedPipe(name *uint16, flags, mode, maxInstances, outSize, inSize, defaultTimeout uint32, sa *windows.SecurityAttributes) (windows.Handle, error) {
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(flags), uintptr(mode), uintptr(maxInstances), uintptr(outSize), uintptr(inSize), uintptr(defaultTimeout), uintptr(unsafe.Pointer(sa)))
+	if windows.Handle(r) == windows.InvalidHandle {
+		return windows.InvalidHandle, err
+	}
+	return windows.Handle(r), nil
+}
+
+func connectNamedPipe(h windows.Handle, ov *windows.Overlapped) error {
+	if r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(ov))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// ListenLocal listens on the named pipe name if it starts with \\.\pipe\,
+// otherwise on the Unix domain socket name. Named pipes are accessible to
+// the local system, administrators and the creator of the pipe.
+func ListenLocal(name string) (net.Listener, error) {
+	if !strings.HasPrefix(name, pipePrefix) {
+		if fi, err := os.Stat(name); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(name); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", name)
+	}
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{name: name, path: path}
+	if l.handle, err = l.newInstance(true); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(name), Err: err}
+	}
+	return l, nil
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeListener accepts the clients of a named pipe. Each client connects
+// to its own instance of the pipe, the next instance is created as soon as
+// a client connected.
+type pipeListener struct {
+	name string
+	path *uint16
+
+	mu     sync.Mutex     // mu protects handle and closed
+	handle windows.Handle // instance waiting for the next client
+	closed bool
+}
+
+var _ net.Listener = &pipeListener{}
+
+func (l *pipeListener) newInstance(first bool) (windows.Handle, error) {
+	flags := uint32(pipeAccessDuplex | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= fileFlagFirstPipeInstance
+	}
+	mode := uint32(pipeTypeByte | pipeReadmodeByte | pipeWait)
+	return createNamedPipe(l.path, flags, mode, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, nil)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.handle
+	l.mu.Unlock()
+
+	ov, err := newOverlapped()
+	if err != nil {
+		return nil, err
+	}
+	err = connectNamedPipe(h, ov)
+	if err == windows.ERROR_PIPE_CONNECTED {
+		// The client connected before ConnectNamedPipe was called.
+		err = nil
+	} else {
+		_, err = complete(h, ov, err)
+	}
+	windows.CloseHandle(ov.HEvent)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+	}
+	if l.handle, err = l.newInstance(false); err != nil {
+		l.handle = windows.InvalidHandle
+		l.closed = true
+		windows.CloseHandle(h)
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+	}
+	return &pipeConn{handle: h, addr: pipeAddr(l.name)}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	// Closing the handle aborts a pending ConnectNamedPipe.
+	windows.CancelIoEx(l.handle, nil)
+	return windows.CloseHandle(l.handle)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// pipeDirection holds the deadline and the pending operation of the reads
+// or writes of a pipeConn.
+type pipeDirection struct {
+	mu       sync.Mutex
+	deadline time.Time
+	pending  *windows.Overlapped
+	expired  bool
+}
+
+// pipeConn is a client connection of a pipeListener. Reads and writes use
+// overlapped I/O, so that they don't block each other.
+type pipeConn struct {
+	handle    windows.Handle
+	addr      pipeAddr
+	read      pipeDirection
+	write     pipeDirection
+	closeOnce sync.Once
+}
+
+var _ net.Conn = &pipeConn{}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.do(&c.read, func(ov *windows.Overlapped) error {
+		return windows.ReadFile(c.handle, b, nil, ov)
+	})
+	switch {
+	case err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return n, io.EOF
+	case err == nil && n == 0 && len(b) > 0:
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := c.do(&c.write, func(ov *windows.Overlapped) error {
+			return windows.WriteFile(c.handle, b[written:], nil, ov)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// do runs the overlapped operation op and waits for it to complete. It is
+// canceled once the deadline of d expires.
+func (c *pipeConn) do(d *pipeDirection, op func(*windows.Overlapped) error) (int, error) {
+	ov, err := newOverlapped()
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(ov.HEvent)
+
+	d.mu.Lock()
+	if !d.deadline.IsZero() && !time.Now().Before(d.deadline) {
+		d.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	d.pending, d.expired = ov, false
+	if !d.deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(d.deadline), func() { c.cancel(d) })
+		defer timer.Stop()
+	}
+	d.mu.Unlock()
+
+	err = op(ov)
+	d.mu.Lock()
+	if err == windows.ERROR_IO_PENDING && d.expired {
+		// The deadline expired before the operation was started.
+		windows.CancelIoEx(c.handle, ov)
+	}
+	d.mu.Unlock()
+	n, err := complete(c.handle, ov, err)
+
+	d.mu.Lock()
+	d.pending = nil
+	expired := d.expired
+	d.mu.Unlock()
+	if err == windows.ERROR_OPERATION_ABORTED && expired {
+		return int(n), os.ErrDeadlineExceeded
+	}
+	return int(n), err
+}
+
+// cancel cancels the pending operation of d, its deadline expired.
+func (c *pipeConn) cancel(d *pipeDirection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending != nil {
+		d.expired = true
+		windows.CancelIoEx(c.handle, d.pending)
+	}
+}
+
+func (c *pipeConn) setDeadline(d *pipeDirection, t time.Time) {
+	d.mu.Lock()
+	d.deadline = t
+	expired := !t.IsZero() && !time.Now().Before(t)
+	d.mu.Unlock()
+	if expired {
+		c.cancel(d)
+	}
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of reads. A pending read is only
+// canceled by a deadline set before it started, or one already passed.
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+func (c *pipeConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		windows.CancelIoEx(c.handle, nil)
+		err = windows.CloseHandle(c.handle)
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// newOverlapped returns an overlapped structure with an event signaled on
+// completion, which the caller must close.
+func newOverlapped() (*windows.Overlapped, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &windows.Overlapped{HEvent: event}, nil
+}
+
+// complete waits for the overlapped operation of h started with ov, which
+// returned err, and returns the number of bytes it transferred.
+func complete(h windows.Handle, ov *windows.Overlapped, err error) (uint32, error) {
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+	var n uint32
+	err = windows.GetOverlappedResult(h, ov, &n, true)
+	return n, err
+}
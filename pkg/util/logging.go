@@ -0,0 +1,342 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+// Log formats, the text format being the one of klog.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log subsystems whose verbosity can be set apart from the global klog
+// verbosity.
+const (
+	// LogBackendManager logs the registration and selection of agents.
+	LogBackendManager = "backend-manager"
+	// LogFrontend logs the streams and connections of frontends.
+	LogFrontend = "frontend"
+	// LogAgentStream logs the packets exchanged on agent streams.
+	LogAgentStream = "agent-stream"
+)
+
+// LogSubsystems are the subsystems accepted by ParseLogLevels.
+var LogSubsystems = []string{LogBackendManager, LogFrontend, LogAgentStream}
+
+// MaxLogVerbosity bounds the klog verbosity levels probed and accepted.
+const MaxLogVerbosity = 10
+
+var (
+	// logLevelsMu protects logLevels.
+	logLevelsMu sync.RWMutex
+	// logLevels are the verbosity levels of the subsystems overriding the
+	// global klog verbosity.
+	logLevels = map[string]klog.Level{}
+)
+
+// SetLogFormat sets the format of the logs written to w. The JSON format
+// writes one object per line, holding the key/value pairs of structured
+// log calls.
+func SetLogFormat(format string, w io.Writer) error {
+	switch format {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		klog.SetLogger(&jsonLogger{w: w, mu: &sync.Mutex{}})
+	default:
+		return fmt.Errorf("unknown log format %q, must be %q or %q", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// ConfigureLogging sets the format of the logs written to stderr and the
+// verbosity levels of the subsystems, as parsed by ParseLogLevels.
+func ConfigureLogging(format, levels string) error {
+	parsed, err := ParseLogLevels(levels)
+	if err != nil {
+		return err
+	}
+	if err := SetLogFormat(format, os.Stderr); err != nil {
+		return err
+	}
+	SetLogLevels(parsed)
+	return nil
+}
+
+// ParseLogLevels parses a comma separated list of subsystem=level pairs,
+// e.g. "backend-manager=5,frontend=2".
+func ParseLogLevels(s string) (map[string]klog.Level, error) {
+	levels := map[string]klog.Level{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("log level %q must be subsystem=level", pair)
+		}
+		level, err := parseLogLevel(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+func parseLogLevel(subsystem, value string) (klog.Level, error) {
+	if !isLogSubsystem(subsystem) {
+		return 0, fmt.Errorf("unknown log subsystem %q, must be one of %s", subsystem, strings.Join(LogSubsystems, ", "))
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < 0 || v > MaxLogVerbosity {
+		return 0, fmt.Errorf("log level %q of %s must be between 0 and %d", value, subsystem, MaxLogVerbosity)
+	}
+	return klog.Level(v), nil
+}
+
+func isLogSubsystem(subsystem string) bool {
+	for _, s := range LogSubsystems {
+		if s == subsystem {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLogLevels replaces the verbosity levels of the subsystems. The
+// subsystems missing from levels log at the global klog verbosity.
+func SetLogLevels(levels map[string]klog.Level) {
+	copied := make(map[string]klog.Level, len(levels))
+	for s, l := range levels {
+		copied[s] = l
+	}
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+	logLevels = copied
+}
+
+// LogVerbosity returns the global klog verbosity level, which klog only
+// exposes through V.
+func LogVerbosity() klog.Level {
+	var v klog.Level
+	for v < MaxLogVerbosity && klog.V(v+1).Enabled() {
+		v++
+	}
+	return v
+}
+
+// V is klog.V for the logs of subsystem, enabled if level is at most the
+// verbosity of the subsystem when it is overridden.
+func V(subsystem string, level klog.Level) klog.Verbose {
+	logLevelsMu.RLock()
+	override, ok := logLevels[subsystem]
+	logLevelsMu.RUnlock()
+	if !ok {
+		return klog.V(level)
+	}
+	if level > override {
+		return klog.Verbose{}
+	}
+	if v := klog.V(level); v.Enabled() {
+		return v
+	}
+	// Enabled at a level above the global verbosity.
+	return klog.V(0)
+}
+
+// InstallLogLevels registers the handler of /debug/log-levels on mux. It
+// returns the global verbosity (v) and the levels of the subsystems on
+// GET, and sets those passed as query parameters on PUT, e.g.
+// PUT /debug/log-levels?v=2&frontend=5. An empty subsystem level restores
+// the global verbosity for the subsystem.
+func InstallLogLevels(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/log-levels", serveLogLevels)
+}
+
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := putLogLevels(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "v=%d\n", LogVerbosity())
+	logLevelsMu.RLock()
+	defer logLevelsMu.RUnlock()
+	for _, s := range LogSubsystems {
+		if l, ok := logLevels[s]; ok {
+			fmt.Fprintf(w, "%s=%d\n", s, l)
+		}
+	}
+}
+
+// putLogLevels applies the levels of the query of r, all or none of them.
+func putLogLevels(r *http.Request) error {
+	query := r.URL.Query()
+	var verbosity *klog.Level
+	logLevelsMu.RLock()
+	levels := make(map[string]klog.Level, len(logLevels))
+	for s, l := range logLevels {
+		levels[s] = l
+	}
+	logLevelsMu.RUnlock()
+	for key := range query {
+		value := query.Get(key)
+		if key == "v" {
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 || v > MaxLogVerbosity {
+				return fmt.Errorf("v %q must be a verbosity level between 0 and %d", value, MaxLogVerbosity)
+			}
+			l := klog.Level(v)
+			verbosity = &l
+			continue
+		}
+		if value == "" && isLogSubsystem(key) {
+			delete(levels, key)
+			continue
+		}
+		level, err := parseLogLevel(key, value)
+		if err != nil {
+			return err
+		}
+		levels[key] = level
+	}
+	if verbosity != nil {
+		if err := verbosity.Set(strconv.Itoa(int(*verbosity))); err != nil {
+			return err
+		}
+	}
+	SetLogLevels(levels)
+	klog.InfoS("Log levels changed", "verbosity", LogVerbosity(), "levels", levels)
+	return nil
+}
+
+// jsonLogger is a logr.Logger writing one JSON object per entry.
+type jsonLogger struct {
+	w  io.Writer
+	mu *sync.Mutex
+	// level is the verbosity of the entries, as passed to V.
+	level  int
+	name   string
+	values []interface{}
+}
+
+var _ logr.Logger = &jsonLogger{}
+
+func (l *jsonLogger) Enabled() bool {
+	return true
+}
+
+func (l *jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.write("info", msg, nil, keysAndValues)
+}
+
+func (l *jsonLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.write("error", msg, err, keysAndValues)
+}
+
+func (l *jsonLogger) V(level int) logr.Logger {
+	c := *l
+	c.level += level
+	return &c
+}
+
+func (l *jsonLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	c := *l
+	c.values = append(append([]interface{}(nil), l.values...), keysAndValues...)
+	return &c
+}
+
+func (l *jsonLogger) WithName(name string) logr.Logger {
+	c := *l
+	if c.name != "" {
+		name = c.name + "." + name
+	}
+	c.name = name
+	return &c
+}
+
+// write encodes an entry. The keys of the entry come first, followed by
+// the key/value pairs in order.
+func (l *jsonLogger) write(severity, msg string, err error, keysAndValues []interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	buf.WriteString(strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64))
+	writeJSONField(&buf, "severity", severity)
+	writeJSONField(&buf, "v", l.level)
+	if l.name != "" {
+		writeJSONField(&buf, "logger", l.name)
+	}
+	writeJSONField(&buf, "msg", msg)
+	if err != nil {
+		writeJSONField(&buf, "err", err.Error())
+	}
+	for _, kv := range [][]interface{}{l.values, keysAndValues} {
+		for i := 0; i < len(kv); i += 2 {
+			key := fmt.Sprint(kv[i])
+			var value interface{} = "(MISSING)"
+			if i+1 < len(kv) {
+				value = kv[i+1]
+			}
+			writeJSONField(&buf, key, value)
+		}
+	}
+	buf.WriteString("}\n")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes()) /* #nosec G104 */
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	k, _ := json.Marshal(key)
+	b, err := json.Marshal(value)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	buf.WriteByte(',')
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(b)
+}
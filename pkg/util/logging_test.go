@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := ParseLogLevels("backend-manager=5, frontend=0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(levels) != 2 || levels[LogBackendManager] != 5 || levels[LogFrontend] != 0 {
+		t.Errorf("expected backend-manager=5 and frontend=0, got %v", levels)
+	}
+	for _, s := range []string{"backend-manager", "unknown=1", "frontend=-1", "frontend=11", "agent-stream=high"} {
+		if _, err := ParseLogLevels(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestSubsystemVerbosity(t *testing.T) {
+	defer SetLogLevels(nil)
+	if LogVerbosity() != 0 {
+		t.Skipf("global verbosity %d is not the default", LogVerbosity())
+	}
+	SetLogLevels(map[string]klog.Level{LogFrontend: 4})
+	if !V(LogFrontend, 4).Enabled() {
+		t.Error("expected frontend logs at level 4 to be enabled")
+	}
+	if V(LogFrontend, 5).Enabled() {
+		t.Error("expected frontend logs at level 5 to be disabled")
+	}
+	if V(LogBackendManager, 1).Enabled() {
+		t.Error("expected backend manager logs to follow the global verbosity")
+	}
+}
+
+func TestLogLevelsHandler(t *testing.T) {
+	defer SetLogLevels(nil)
+	mux := http.NewServeMux()
+	InstallLogLevels(mux)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	v := LogVerbosity()
+	w := serve(http.MethodPut, "/debug/log-levels?agent-stream=6")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "agent-stream=6\n") {
+		t.Errorf("expected agent-stream to be set to 6, got %d %q", w.Code, w.Body.String())
+	}
+	if !V(LogAgentStream, 6).Enabled() {
+		t.Error("expected agent stream logs at level 6 to be enabled")
+	}
+	if w := serve(http.MethodPut, "/debug/log-levels?agent-stream=1&frontend=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid level to be rejected, got %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/debug/log-levels"); !strings.Contains(w.Body.String(), "agent-stream=6\n") {
+		t.Errorf("expected a rejected request to keep the levels, got %q", w.Body.String())
+	}
+	if w := serve(http.MethodPut, "/debug/log-levels?agent-stream="); strings.Contains(w.Body.String(), "agent-stream") {
+		t.Errorf("expected agent-stream to be reset, got %q", w.Body.String())
+	}
+	if LogVerbosity() != v {
+		t.Errorf("expected the global verbosity %d to be kept, got %d", v, LogVerbosity())
+	}
+	if w := serve(http.MethodPost, "/debug/log-levels"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", w.Code)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := (&jsonLogger{w: &buf, mu: &sync.Mutex{}}).WithName("server").WithValues("serverID", "s1")
+	l.V(2).Info("Agent connected", "agentID", "a1", "count", 3)
+	l.Error(errors.New("broken"), "Stream failed", "dangling")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %q", buf.String())
+	}
+	var info, failure map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &info); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failure); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[1], err)
+	}
+	for k, e := range map[string]interface{}{"severity": "info", "v": 2.0, "logger": "server", "msg": "Agent connected", "serverID": "s1", "agentID": "a1", "count": 3.0} {
+		if info[k] != e {
+			t.Errorf("expected %s %v, got %v", k, e, info[k])
+		}
+	}
+	for k, e := range map[string]interface{}{"severity": "error", "err": "broken", "dangling": "(MISSING)"} {
+		if failure[k] != e {
+			t.Errorf("expected %s %v, got %v", k, e, failure[k])
+		}
+	}
+}
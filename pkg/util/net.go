@@ -18,6 +18,7 @@ package util
 
 import (
 	"crypto/tls"
+	"net"
 	"strings"
 )
 
@@ -50,6 +51,33 @@ func RemovePortFromHost(host string) string {
 	return strings.Trim(host, "[]")
 }
 
+// ParseIPZone parses host as an IP literal, which may be an IPv6 address
+// with a zone such as fe80::1%eth0. It returns the IP and the zone, or a
+// nil IP if host is not an IP literal.
+func ParseIPZone(host string) (net.IP, string) {
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+		if zone == "" {
+			return nil, ""
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && !strings.Contains(host, ":")) {
+		// only IPv6 addresses have zones
+		return nil, ""
+	}
+	return ip, zone
+}
+
+// JoinIPZone returns the IP literal of ip with zone, if not empty.
+func JoinIPZone(ip net.IP, zone string) string {
+	if zone == "" {
+		return ip.String()
+	}
+	return ip.String() + "%" + zone
+}
+
 // GetAcceptedCiphers returns all the ciphers supported by the crypto/tls package
 func GetAcceptedCiphers() map[string]uint16 {
 	acceptedCiphers := make(map[string]uint16, len(tls.CipherSuites()))
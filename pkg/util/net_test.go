@@ -57,3 +57,40 @@ func TestRemovePortFromHost(t *testing.T) {
 		t.Run(st.name, tf)
 	}
 }
+
+func TestParseIPZone(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		ip     string
+		zone   string
+		joined string
+	}{
+		{"IPv4", "10.0.0.1", "10.0.0.1", "", "10.0.0.1"},
+		{"IPv6", "fe80::1", "fe80::1", "", "fe80::1"},
+		{"IPv6&Zone", "fe80::1%eth0", "fe80::1", "eth0", "fe80::1%eth0"},
+		{"IPv6&NumericZone", "fe80::1%2", "fe80::1", "2", "fe80::1%2"},
+		{"IPv4&Zone", "10.0.0.1%eth0", "", "", ""},
+		{"EmptyZone", "fe80::1%", "", "", ""},
+		{"Domain", "kubernetes.default.svc", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		st := tt
+		t.Run(st.name, func(t *testing.T) {
+			ip, zone := ParseIPZone(st.host)
+			if st.ip == "" {
+				if ip != nil {
+					t.Fatalf("\t%s\texpect %q to be rejected, but get %v%%%s", failed, st.host, ip, zone)
+				}
+				return
+			}
+			if ip.String() != st.ip || zone != st.zone {
+				t.Fatalf("\t%s\texpect %v%%%s, but get %v%%%s", failed, st.ip, st.zone, ip, zone)
+			}
+			if joined := JoinIPZone(ip, zone); joined != st.joined {
+				t.Fatalf("\t%s\texpect %v, but get %v", failed, st.joined, joined)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net"
+
+	"k8s.io/klog/v2"
+)
+
+// PeerCredentialListener accepts the Unix domain socket connections of
+// processes running as one of the allowed users or in one of the allowed
+// groups, as reported by SO_PEERCRED. Other connections are closed right
+// away. Peer credentials are only supported on Linux.
+type PeerCredentialListener struct {
+	*net.UnixListener
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+// NewPeerCredentialListener returns a listener accepting the connections
+// of lis whose peer runs with one of uids or gids.
+func NewPeerCredentialListener(lis *net.UnixListener, uids, gids []uint32) *PeerCredentialListener {
+	l := &PeerCredentialListener{
+		UnixListener: lis,
+		uids:         make(map[uint32]bool),
+		gids:         make(map[uint32]bool),
+	}
+	for _, uid := range uids {
+		l.uids[uid] = true
+	}
+	for _, gid := range gids {
+		l.gids[gid] = true
+	}
+	return l
+}
+
+// Accept waits for and returns the next connection of an allowed peer.
+func (l *PeerCredentialListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		uid, gid, err := peerCredentials(conn)
+		if err != nil {
+			klog.ErrorS(err, "Rejecting unix domain socket connection")
+			conn.Close()
+			continue
+		}
+		if !l.uids[uid] && !l.gids[gid] {
+			klog.V(2).InfoS("Rejecting unix domain socket connection of disallowed peer", "uid", uid, "gid", gid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPeerCredentialListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "peer-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	testCases := []struct {
+		name   string
+		uids   []uint32
+		gids   []uint32
+		accept bool
+	}{
+		{name: "allowed user", uids: []uint32{uid}, accept: true},
+		{name: "allowed group", uids: []uint32{uid + 1}, gids: []uint32{gid}, accept: true},
+		{name: "disallowed peer", uids: []uint32{uid + 1}, gids: []uint32{gid + 1}},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			socket := filepath.Join(dir, string(rune('a'+i))+".sock")
+			lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewPeerCredentialListener(lis, tc.uids, tc.gids)
+			defer l.Close()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			select {
+			case c := <-accepted:
+				c.Close()
+				if !tc.accept {
+					t.Error("expected the connection to be rejected")
+				}
+			case <-time.After(time.Second):
+				if tc.accept {
+					t.Error("expected the connection to be accepted")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// blockProfileRate is the rate last passed to runtime.SetBlockProfileRate
+// by SetBlockProfileRate, which the runtime does not report. Accessed
+// atomically.
+var blockProfileRate int64
+
+// SetBlockProfileRate sets the rate of the block profile, see
+// runtime.SetBlockProfileRate. 0 disables it.
+func SetBlockProfileRate(rate int) {
+	atomic.StoreInt64(&blockProfileRate, int64(rate))
+	runtime.SetBlockProfileRate(rate)
+}
+
+// InstallProfiling registers the pprof handlers under /debug/pprof/ on mux,
+// and the handlers of /debug/runtime/block-profile-rate and
+// /debug/runtime/mutex-profile-fraction. Those return the sampling rate of
+// the block and mutex profiles on GET, and set it to the rate query
+// parameter on PUT, so that contention can be profiled without restarting
+// the process.
+func InstallProfiling(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof", RedirectTo("/debug/pprof/"))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/runtime/block-profile-rate", profileRateHandler("block", func() int {
+		return int(atomic.LoadInt64(&blockProfileRate))
+	}, SetBlockProfileRate))
+	mux.Handle("/debug/runtime/mutex-profile-fraction", profileRateHandler("mutex", func() int {
+		return runtime.SetMutexProfileFraction(-1)
+	}, func(rate int) {
+		runtime.SetMutexProfileFraction(rate)
+	}))
+}
+
+// profileRateHandler serves the sampling rate of the profile named name.
+func profileRateHandler(name string, get func() int, set func(int)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			rate, err := strconv.Atoi(r.URL.Query().Get("rate"))
+			if err != nil || rate < 0 {
+				http.Error(w, "rate must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			set(rate)
+			klog.V(1).InfoS("Profile rate changed", "profile", name, "rate", rate)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", get())
+	})
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfileRateHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	InstallProfiling(mux)
+	defer SetBlockProfileRate(0)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	if w := serve(http.MethodPut, "/debug/runtime/block-profile-rate?rate=100"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "100" {
+		t.Errorf("expected the block profile rate to be set to 100, got %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(http.MethodGet, "/debug/runtime/block-profile-rate"); strings.TrimSpace(w.Body.String()) != "100" {
+		t.Errorf("expected block profile rate 100, got %q", w.Body.String())
+	}
+
+	prev := serve(http.MethodGet, "/debug/runtime/mutex-profile-fraction").Body.String()
+	if w := serve(http.MethodPut, "/debug/runtime/mutex-profile-fraction?rate=5"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "5" {
+		t.Errorf("expected the mutex profile fraction to be set to 5, got %d %q", w.Code, w.Body.String())
+	}
+	serve(http.MethodPut, "/debug/runtime/mutex-profile-fraction?rate="+strings.TrimSpace(prev))
+
+	for _, target := range []string{"/debug/runtime/block-profile-rate?rate=-1", "/debug/runtime/block-profile-rate?rate=fast"} {
+		if w := serve(http.MethodPut, target); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", target, w.Code)
+		}
+	}
+	if w := serve(http.MethodPost, "/debug/runtime/block-profile-rate?rate=1"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", w.Code)
+	}
+}
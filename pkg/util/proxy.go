@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialThroughHTTPProxy establishes a TCP connection to addr tunneled through
+// the HTTP CONNECT proxy at proxyURL. If proxyURL carries user info it is sent
+// to the proxy as basic Proxy-Authorization credentials.
+func DialThroughHTTPProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q", proxyURL.Scheme)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial egress proxy %s: %v", proxyAddr, err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)          /* #nosec G104 */
+		defer conn.SetDeadline(time.Time{}) /* #nosec G104 */
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("failed to send CONNECT to egress proxy %s: %v", proxyAddr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("failed to read CONNECT response from egress proxy %s: %v", proxyAddr, err)
+	}
+	res.Body.Close() /* #nosec G104 */
+	if res.StatusCode != http.StatusOK {
+		conn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("egress proxy %s refused CONNECT to %s: %s", proxyAddr, addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close() /* #nosec G104 */
+		return nil, fmt.Errorf("egress proxy %s sent unexpected data after CONNECT response", proxyAddr)
+	}
+	return conn, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RedactionMode tells how addresses and identifiers are redacted in logs.
+type RedactionMode string
+
+const (
+	// RedactionNone logs addresses and identifiers as is.
+	RedactionNone RedactionMode = "none"
+	// RedactionHash replaces them with a keyed hash, so that log lines
+	// about the same address can still be correlated.
+	RedactionHash RedactionMode = "hash"
+	// RedactionTruncate keeps their coarse part only: the /16 of IPv4 and
+	// the /48 of IPv6 addresses, the parent domain of hostnames and the
+	// first characters of identifiers.
+	RedactionTruncate RedactionMode = "truncate"
+)
+
+// ValidateRedactionMode checks that mode is a known RedactionMode.
+func ValidateRedactionMode(mode string) error {
+	switch RedactionMode(mode) {
+	case RedactionNone, RedactionHash, RedactionTruncate:
+		return nil
+	}
+	return fmt.Errorf("redaction mode %q must be one of %q, %q or %q", mode, RedactionNone, RedactionHash, RedactionTruncate)
+}
+
+const (
+	redactedHashLength     = 16
+	redactedIdentifierKeep = 8
+)
+
+// Redactor redacts addresses and identifiers before they are logged. Ports
+// and correlation IDs such as connection IDs are never redacted. A nil
+// *Redactor redacts nothing.
+type Redactor struct {
+	mode RedactionMode
+	key  []byte
+}
+
+// NewRedactor returns a Redactor for mode, nil for RedactionNone or an
+// unknown mode. key keys the hashes of RedactionHash, without a key
+// addresses can be recovered by hashing candidates.
+func NewRedactor(mode RedactionMode, key string) *Redactor {
+	if mode != RedactionHash && mode != RedactionTruncate {
+		return nil
+	}
+	return &Redactor{mode: mode, key: []byte(key)}
+}
+
+// Address redacts the host of addr, a host or host:port.
+func (r *Redactor) Address(addr string) string {
+	if r == nil || addr == "" {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.host(addr)
+	}
+	return net.JoinHostPort(r.host(host), port)
+}
+
+// Identifier redacts an identifier such as an agent ID.
+func (r *Redactor) Identifier(id string) string {
+	if r == nil || id == "" {
+		return id
+	}
+	if r.mode == RedactionHash {
+		return r.hash(id)
+	}
+	if len(id) <= redactedIdentifierKeep {
+		return "..."
+	}
+	return id[:redactedIdentifierKeep] + "..."
+}
+
+func (r *Redactor) host(host string) string {
+	if r.mode == RedactionHash {
+		return r.hash(host)
+	}
+	if ip, _ := ParseIPZone(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return fmt.Sprintf("%d.%d.x.x", ip4[0], ip4[1])
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) <= 2 {
+		return "x"
+	}
+	return "x." + strings.Join(labels[len(labels)-2:], ".")
+}
+
+func (r *Redactor) hash(s string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(s))
+	return "h-" + hex.EncodeToString(mac.Sum(nil))[:redactedHashLength]
+}
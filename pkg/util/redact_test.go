@@ -0,0 +1,71 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactorTruncate(t *testing.T) {
+	r := NewRedactor(RedactionTruncate, "")
+	testcases := []struct {
+		in, want string
+	}{
+		{"10.1.2.3:443", "10.1.x.x:443"},
+		{"10.1.2.3", "10.1.x.x"},
+		{"[fd00:1:2:3::4]:10250", "[fd00:1:2::/48]:10250"},
+		{"node-1.example.com:22", "x.example.com:22"},
+		{"localhost", "x"},
+		{"", ""},
+	}
+	for _, tc := range testcases {
+		if got := r.Address(tc.in); got != tc.want {
+			t.Errorf("Address(%q): expected %q, got %q", tc.in, tc.want, got)
+		}
+	}
+	if got := r.Identifier("3f2b8c1e-6f0a-4c5d-9e2f-1a2b3c4d5e6f"); got != "3f2b8c1e..." {
+		t.Errorf("expected truncated identifier, got %q", got)
+	}
+}
+
+func TestRedactorHash(t *testing.T) {
+	r := NewRedactor(RedactionHash, "key")
+	a, b := r.Address("10.1.2.3:443"), r.Address("10.1.2.3:80")
+	if strings.Contains(a, "10.1") || !strings.HasSuffix(a, ":443") {
+		t.Errorf("expected the host to be hashed and the port kept, got %q", a)
+	}
+	if strings.TrimSuffix(a, ":443") != strings.TrimSuffix(b, ":80") {
+		t.Errorf("expected the same host to hash the same, got %q and %q", a, b)
+	}
+	if NewRedactor(RedactionHash, "other").Address("10.1.2.3:443") == a {
+		t.Error("expected hashes to depend on the key")
+	}
+	if r.Identifier("agent-1") == r.Identifier("agent-2") {
+		t.Error("expected distinct identifiers to hash differently")
+	}
+}
+
+func TestRedactorNone(t *testing.T) {
+	r := NewRedactor(RedactionNone, "")
+	if got := r.Address("10.1.2.3:443"); got != "10.1.2.3:443" {
+		t.Errorf("expected no redaction, got %q", got)
+	}
+	if err := ValidateRedactionMode("sha1"); err == nil {
+		t.Error("expected an unknown redaction mode to be invalid")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sync"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// DefaultReplayBufferSize is the number of DATA payload bytes kept by
+// replay buffers created without a limit.
+const DefaultReplayBufferSize = 256 * 1024
+
+// AckInterval is the number of DATA packets received in order between two
+// ACKs.
+const AckInterval = 16
+
+// RetransmitTimeout is the time after which DATA missing after a gap is
+// requested again, in case the request or the retransmitted DATA was lost.
+const RetransmitTimeout = time.Second
+
+// ReplayBuffer numbers the DATA packets sent on a connection and keeps the
+// ones not acknowledged yet, up to a number of payload bytes, so that they
+// can be sent again when lost or on the stream resuming a broken agent
+// session.
+type ReplayBuffer struct {
+	mu      sync.Mutex
+	limit   int
+	size    int
+	seq     int64 // seq of the last packet added
+	packets []*client.Packet
+}
+
+// NewReplayBuffer returns a ReplayBuffer keeping up to limit bytes, or
+// DefaultReplayBufferSize if limit is not positive.
+func NewReplayBuffer(limit int) *ReplayBuffer {
+	if limit <= 0 {
+		limit = DefaultReplayBufferSize
+	}
+	return &ReplayBuffer{limit: limit}
+}
+
+// Add sets the seq of pkt, a DATA packet, and keeps a copy of it, evicting
+// the oldest packets beyond the limit. The payload is copied as callers
+// reuse it once sent.
+func (b *ReplayBuffer) Add(pkt *client.Packet) {
+	data := pkt.GetData()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	data.Seq = b.seq
+	b.packets = append(b.packets, &client.Packet{
+		Type: client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{
+			ConnectID:  data.ConnectID,
+			Data:       append([]byte(nil), data.Data...),
+			Compressed: data.Compressed,
+			Seq:        data.Seq,
+		}},
+	})
+	b.size += len(data.Data)
+	for len(b.packets) > 0 && b.size > b.limit {
+		b.dropFirst()
+	}
+}
+
+// Ack drops the packets up to seq, received by the peer.
+func (b *ReplayBuffer) Ack(seq int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.packets) > 0 && b.packets[0].GetData().Seq <= seq {
+		b.dropFirst()
+	}
+}
+
+func (b *ReplayBuffer) dropFirst() {
+	b.size -= len(b.packets[0].GetData().Data)
+	b.packets[0] = nil
+	b.packets = b.packets[1:]
+}
+
+// Since returns the packets following seq, the last one received by the
+// peer. It returns false if some of them were evicted already.
+func (b *ReplayBuffer) Since(seq int64) ([]*client.Packet, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq >= b.seq {
+		return nil, true
+	}
+	first := b.seq - int64(len(b.packets)) + 1
+	if seq+1 < first {
+		return nil, false
+	}
+	return append([]*client.Packet(nil), b.packets[seq+1-first:]...), true
+}
+
+// ReceiveWindow tracks the seq of the DATA received on a connection.
+type ReceiveWindow struct {
+	// Last is the seq of the last DATA received in order.
+	Last int64
+	// unacked is the number of DATA received since the last ACK.
+	unacked int
+	// requested is the seq requested again after a gap at requestedAt,
+	// so that the DATA following it is only requested again once
+	// RetransmitTimeout elapsed.
+	requested   int64
+	requestedAt time.Time
+}
+
+// Receive returns whether the DATA of seq is to be delivered, and the ACK
+// to send to the peer if any. Duplicate DATA is dropped, as is DATA
+// following a gap, which is requested again with an ACK asking to
+// retransmit, and again if it is still missing after RetransmitTimeout.
+// Unnumbered DATA is always delivered.
+func (w *ReceiveWindow) Receive(connID, seq int64) (bool, *client.Packet) {
+	switch {
+	case seq == 0:
+		return true, nil
+	case seq <= w.Last:
+		return false, nil
+	case seq > w.Last+1:
+		if w.requested == w.Last+1 && time.Since(w.requestedAt) < RetransmitTimeout {
+			return false, nil
+		}
+		w.requested, w.requestedAt = w.Last+1, time.Now()
+		w.unacked = 0
+		return false, AckPacket(connID, w.Last, true)
+	}
+	w.Last = seq
+	w.unacked++
+	if w.unacked < AckInterval {
+		return true, nil
+	}
+	w.unacked = 0
+	return true, AckPacket(connID, seq, false)
+}
+
+// AckQueue queues the ACKs of the DATA received on a stream, so that the
+// goroutine receiving it doesn't block sending them while the peer blocks
+// sending DATA. ACKs being cumulative, only the last one queued for each
+// connection is sent, unless an earlier one asked for retransmission.
+type AckQueue struct {
+	mu      sync.Mutex
+	pending map[int64]*client.Packet
+	ready   chan struct{}
+}
+
+// NewAckQueue returns an empty AckQueue.
+func NewAckQueue() *AckQueue {
+	return &AckQueue{
+		pending: make(map[int64]*client.Packet),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Add queues ack, replacing the ACK of its connection queued before. A
+// queued retransmission request is kept instead of a plain ACK, and of two
+// retransmission requests the one from the lowest seq, so that the DATA
+// lost is sent again.
+func (q *AckQueue) Add(ack *client.Packet) {
+	connID := ack.GetAck().ConnectID
+	q.mu.Lock()
+	if pending, ok := q.pending[connID]; ok && pending.GetAck().Retransmit {
+		if !ack.GetAck().Retransmit || ack.GetAck().Seq > pending.GetAck().Seq {
+			ack = pending
+		}
+	}
+	q.pending[connID] = ack
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the queued ACKs with send until stopCh is closed.
+func (q *AckQueue) Run(stopCh <-chan struct{}, send func(*client.Packet)) {
+	var acks []*client.Packet
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-q.ready:
+		}
+		q.mu.Lock()
+		for connID, ack := range q.pending {
+			acks = append(acks, ack)
+			delete(q.pending, connID)
+		}
+		q.mu.Unlock()
+		for i, ack := range acks {
+			send(ack)
+			acks[i] = nil
+		}
+		acks = acks[:0]
+	}
+}
+
+// AckPacket returns an ACK of the DATA up to seq on connection connID.
+func AckPacket(connID, seq int64, retransmit bool) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_ACK,
+		Payload: &client.Packet_Ack{Ack: &client.Ack{ConnectID: connID, Seq: seq, Retransmit: retransmit}},
+	}
+}
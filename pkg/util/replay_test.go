@@ -0,0 +1,181 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func replayData(s string) *client.Packet {
+	return &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: []byte(s)}},
+	}
+}
+
+func TestReplayBuffer(t *testing.T) {
+	b := NewReplayBuffer(8)
+	buf := []byte("abcd")
+	pkt := &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: buf}},
+	}
+	b.Add(pkt)
+	if seq := pkt.GetData().Seq; seq != 1 {
+		t.Fatalf("expected seq 1, got %d", seq)
+	}
+	// Callers reuse the payload once sent.
+	copy(buf, "wxyz")
+	b.Add(replayData("efgh"))
+
+	packets, ok := b.Since(0)
+	if !ok || len(packets) != 2 {
+		t.Fatalf("expected 2 packets since 0, got %d (%v)", len(packets), ok)
+	}
+	if got := string(packets[0].GetData().Data); got != "abcd" {
+		t.Errorf("expected the payload to be copied, got %q", got)
+	}
+	if packets, ok := b.Since(2); !ok || len(packets) != 0 {
+		t.Errorf("expected no packets since the last one, got %d (%v)", len(packets), ok)
+	}
+
+	// The first packet is evicted beyond 8 bytes.
+	b.Add(replayData("ijkl"))
+	if _, ok := b.Since(0); ok {
+		t.Error("expected packets since 0 to be evicted")
+	}
+	packets, ok = b.Since(1)
+	if !ok || len(packets) != 2 || packets[0].GetData().Seq != 2 || packets[1].GetData().Seq != 3 {
+		t.Errorf("expected packets 2 and 3 since 1, got %v (%v)", packets, ok)
+	}
+}
+
+func TestReplayBufferAck(t *testing.T) {
+	b := NewReplayBuffer(0)
+	for _, s := range []string{"a", "b", "c"} {
+		b.Add(replayData(s))
+	}
+	b.Ack(2)
+	packets, ok := b.Since(2)
+	if !ok || len(packets) != 1 || packets[0].GetData().Seq != 3 {
+		t.Errorf("expected packet 3 since 2, got %v (%v)", packets, ok)
+	}
+	if _, ok := b.Since(1); ok {
+		t.Error("expected acknowledged packets to be dropped")
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	var w ReceiveWindow
+	for seq := int64(1); seq < AckInterval; seq++ {
+		if ok, ack := w.Receive(1, seq); !ok || ack != nil {
+			t.Fatalf("expected DATA %d to be delivered without ACK, got %v, %v", seq, ok, ack)
+		}
+	}
+	ok, ack := w.Receive(1, AckInterval)
+	if !ok || ack == nil || ack.GetAck().Seq != AckInterval || ack.GetAck().Retransmit {
+		t.Fatalf("expected DATA %d to be acknowledged, got %v, %v", AckInterval, ok, ack)
+	}
+
+	// DATA following a gap is dropped, and the missing DATA requested once
+	// until the request times out.
+	ok, ack = w.Receive(1, AckInterval+2)
+	if ok || ack == nil || ack.GetAck().Seq != AckInterval || !ack.GetAck().Retransmit {
+		t.Fatalf("expected a retransmission request after DATA %d, got %v, %v", AckInterval, ok, ack)
+	}
+	if ok, ack := w.Receive(1, AckInterval+3); ok || ack != nil {
+		t.Errorf("expected DATA to be dropped without request, got %v, %v", ok, ack)
+	}
+	// The missing DATA is requested again once the request timed out.
+	w.requestedAt = w.requestedAt.Add(-RetransmitTimeout)
+	ok, ack = w.Receive(1, AckInterval+4)
+	if ok || ack == nil || ack.GetAck().Seq != AckInterval || !ack.GetAck().Retransmit {
+		t.Fatalf("expected another retransmission request, got %v, %v", ok, ack)
+	}
+	if ok, _ := w.Receive(1, AckInterval+1); !ok {
+		t.Error("expected the missing DATA to be delivered")
+	}
+	if ok, _ := w.Receive(1, AckInterval+1); ok {
+		t.Error("expected duplicate DATA to be dropped")
+	}
+	if ok, _ := w.Receive(1, 0); !ok {
+		t.Error("expected unnumbered DATA to be delivered")
+	}
+}
+
+func TestAckQueue(t *testing.T) {
+	q := NewAckQueue()
+	q.Add(AckPacket(1, 16, false))
+	q.Add(AckPacket(2, 16, false))
+	q.Add(AckPacket(1, 32, false))
+
+	sent := make(chan *client.Packet, 3)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go q.Run(stopCh, func(ack *client.Packet) { sent <- ack })
+
+	acks := map[int64]int64{}
+	for len(acks) < 2 {
+		select {
+		case ack := <-sent:
+			acks[ack.GetAck().ConnectID] = ack.GetAck().Seq
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the ACKs of 2 connections, got %v", acks)
+		}
+	}
+	if acks[1] != 32 || acks[2] != 16 {
+		t.Errorf("expected the last ACK of each connection, got %v", acks)
+	}
+	select {
+	case ack := <-sent:
+		t.Errorf("expected the ACKs of a connection to be coalesced, got %v", ack)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAckQueueKeepsRetransmit(t *testing.T) {
+	q := NewAckQueue()
+	q.Add(AckPacket(1, 16, true))
+	q.Add(AckPacket(1, 32, false))
+	q.Add(AckPacket(2, 16, true))
+	q.Add(AckPacket(2, 8, true))
+	q.Add(AckPacket(2, 24, true))
+
+	sent := make(chan *client.Packet, 2)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go q.Run(stopCh, func(ack *client.Packet) { sent <- ack })
+
+	acks := map[int64]*client.Ack{}
+	for len(acks) < 2 {
+		select {
+		case ack := <-sent:
+			acks[ack.GetAck().ConnectID] = ack.GetAck()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the ACKs of 2 connections, got %v", acks)
+		}
+	}
+	if ack := acks[1]; !ack.Retransmit || ack.Seq != 16 {
+		t.Errorf("expected the retransmission request to be kept, got %v", ack)
+	}
+	if ack := acks[2]; !ack.Retransmit || ack.Seq != 8 {
+		t.Errorf("expected the retransmission request from the lowest seq, got %v", ack)
+	}
+}
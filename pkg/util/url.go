@@ -35,3 +35,16 @@ func PrettyPrintURL(urlEncode string) string {
 	}
 	return strings.TrimSuffix(buf.String(), ",")
 }
+
+// RedactURL returns rawURL with any password replaced, so that it is safe
+// to log. Unparsable input is returned as an empty string.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// GitVersion and GitCommit identify the build. They are set at link time,
+// e.g. -ldflags "-X sigs.k8s.io/apiserver-network-proxy/pkg/util.GitCommit=$(git rev-parse HEAD)".
+var (
+	GitVersion = ""
+	GitCommit  = ""
+)
+
+// VersionInfo describes the build of a binary.
+type VersionInfo struct {
+	GitVersion string `json:"gitVersion"`
+	GitCommit  string `json:"gitCommit"`
+	GoVersion  string `json:"goVersion"`
+	Platform   string `json:"platform"`
+}
+
+// GetVersionInfo returns the build of the running binary. The version
+// falls back to the module version recorded by the Go toolchain if it was
+// not set at link time.
+func GetVersionInfo() VersionInfo {
+	info := VersionInfo{
+		GitVersion: GitVersion,
+		GitCommit:  GitCommit,
+		GoVersion:  runtime.Version(),
+		Platform:   fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+	}
+	if info.GitVersion == "" {
+		info.GitVersion = "unknown"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+			info.GitVersion = bi.Main.Version
+		}
+	}
+	return info
+}
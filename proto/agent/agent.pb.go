@@ -43,17 +43,18 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 func init() { proto.RegisterFile("proto/agent/agent.proto", fileDescriptor_656b6c96a18ce683) }
 
 var fileDescriptor_656b6c96a18ce683 = []byte{
-	// 155 bytes of a gzipped FileDescriptorProto
+	// 163 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2f, 0x28, 0xca, 0x2f,
 	0xc9, 0xd7, 0x4f, 0x4c, 0x4f, 0xcd, 0x2b, 0x81, 0x90, 0x7a, 0x60, 0x11, 0x29, 0xdd, 0xec, 0xfc,
 	0xbc, 0xbc, 0xd4, 0xe4, 0x92, 0xcc, 0xb2, 0xcc, 0x92, 0x4a, 0xdd, 0xe4, 0x9c, 0x4c, 0x90, 0x02,
-	0x88, 0x62, 0x28, 0x07, 0x42, 0x41, 0x94, 0x1b, 0x19, 0x72, 0xf1, 0x38, 0x82, 0x74, 0x07, 0xa7,
+	0x88, 0x62, 0x28, 0x07, 0x42, 0x41, 0x94, 0x1b, 0x85, 0x70, 0xf1, 0x38, 0x82, 0x74, 0x07, 0xa7,
 	0x16, 0x95, 0x65, 0x26, 0xa7, 0x0a, 0x29, 0x72, 0xb1, 0x3b, 0x43, 0x0c, 0x10, 0x62, 0xd7, 0x0b,
-	0x48, 0x4c, 0xce, 0x4e, 0x2d, 0x91, 0x82, 0x31, 0x94, 0x18, 0x34, 0x18, 0x0d, 0x18, 0x9d, 0x0c,
-	0xa3, 0xf4, 0x8b, 0x33, 0xd3, 0x8b, 0xf5, 0xb2, 0x2d, 0x8a, 0xf5, 0x32, 0xf3, 0xf5, 0x13, 0x0b,
-	0x32, 0x8b, 0x53, 0x8b, 0xca, 0x52, 0x8b, 0x74, 0xf3, 0x52, 0x4b, 0xca, 0xf3, 0x8b, 0xb2, 0x75,
-	0x0b, 0x8a, 0xf2, 0x2b, 0x2a, 0xf5, 0x91, 0x1c, 0x98, 0xc4, 0x06, 0xe6, 0x18, 0x03, 0x02, 0x00,
-	0x00, 0xff, 0xff, 0x85, 0x25, 0x82, 0x73, 0xb6, 0x00, 0x00, 0x00,
+	0x48, 0x4c, 0xce, 0x4e, 0x2d, 0x91, 0x82, 0x31, 0x94, 0x18, 0x34, 0x18, 0x0d, 0x18, 0x41, 0x4a,
+	0xdc, 0xf2, 0x8b, 0xca, 0x13, 0x8b, 0x52, 0x70, 0x29, 0x71, 0x32, 0x8c, 0xd2, 0x2f, 0xce, 0x4c,
+	0x2f, 0xd6, 0xcb, 0xb6, 0x28, 0xd6, 0xcb, 0xcc, 0xd7, 0x4f, 0x2c, 0xc8, 0x2c, 0x4e, 0x2d, 0x2a,
+	0x4b, 0x2d, 0xd2, 0xcd, 0x4b, 0x2d, 0x29, 0xcf, 0x2f, 0xca, 0xd6, 0x2d, 0x28, 0xca, 0xaf, 0xa8,
+	0xd4, 0x47, 0xf2, 0x43, 0x12, 0x1b, 0x98, 0x63, 0x0c, 0x18, 0x00, 0x34, 0x64, 0x9c, 0x34, 0xd9,
+	0x00, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -70,6 +71,10 @@ const _ = grpc.SupportPackageIsVersion4
 type AgentServiceClient interface {
 	// Agent Identifier?
 	Connect(ctx context.Context, opts ...grpc.CallOption) (AgentService_ConnectClient, error)
+	// Forward tunnels a connection accepted by a port-forward listener of
+	// the agent to a destination on the network of the proxy server. The
+	// agent sends a DIAL_REQ, then the DATA and CLOSE_REQ of the connection.
+	Forward(ctx context.Context, opts ...grpc.CallOption) (AgentService_ForwardClient, error)
 }
 
 type agentServiceClient struct {
@@ -111,10 +116,45 @@ func (x *agentServiceConnectClient) Recv() (*client.Packet, error) {
 	return m, nil
 }
 
+func (c *agentServiceClient) Forward(ctx context.Context, opts ...grpc.CallOption) (AgentService_ForwardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_AgentService_serviceDesc.Streams[1], "/AgentService/Forward", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentServiceForwardClient{stream}
+	return x, nil
+}
+
+type AgentService_ForwardClient interface {
+	Send(*client.Packet) error
+	Recv() (*client.Packet, error)
+	grpc.ClientStream
+}
+
+type agentServiceForwardClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentServiceForwardClient) Send(m *client.Packet) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentServiceForwardClient) Recv() (*client.Packet, error) {
+	m := new(client.Packet)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // AgentServiceServer is the server API for AgentService service.
 type AgentServiceServer interface {
 	// Agent Identifier?
 	Connect(AgentService_ConnectServer) error
+	// Forward tunnels a connection accepted by a port-forward listener of
+	// the agent to a destination on the network of the proxy server. The
+	// agent sends a DIAL_REQ, then the DATA and CLOSE_REQ of the connection.
+	Forward(AgentService_ForwardServer) error
 }
 
 // UnimplementedAgentServiceServer can be embedded to have forward compatible implementations.
@@ -124,6 +164,9 @@ type UnimplementedAgentServiceServer struct {
 func (*UnimplementedAgentServiceServer) Connect(srv AgentService_ConnectServer) error {
 	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
 }
+func (*UnimplementedAgentServiceServer) Forward(srv AgentService_ForwardServer) error {
+	return status.Errorf(codes.Unimplemented, "method Forward not implemented")
+}
 
 func RegisterAgentServiceServer(s *grpc.Server, srv AgentServiceServer) {
 	s.RegisterService(&_AgentService_serviceDesc, srv)
@@ -155,6 +198,32 @@ func (x *agentServiceConnectServer) Recv() (*client.Packet, error) {
 	return m, nil
 }
 
+func _AgentService_Forward_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServiceServer).Forward(&agentServiceForwardServer{stream})
+}
+
+type AgentService_ForwardServer interface {
+	Send(*client.Packet) error
+	Recv() (*client.Packet, error)
+	grpc.ServerStream
+}
+
+type agentServiceForwardServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentServiceForwardServer) Send(m *client.Packet) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentServiceForwardServer) Recv() (*client.Packet, error) {
+	m := new(client.Packet)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _AgentService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "AgentService",
 	HandlerType: (*AgentServiceServer)(nil),
@@ -166,6 +235,12 @@ var _AgentService_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Forward",
+			Handler:       _AgentService_Forward_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "proto/agent/agent.proto",
 }
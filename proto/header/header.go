@@ -21,6 +21,38 @@ const (
 	ServerID         = "serverID"
 	AgentID          = "agentID"
 	AgentIdentifiers = "agentIdentifiers"
+	// AgentCapabilities is the comma separated list of optional features
+	// supported by the agent.
+	AgentCapabilities = "agentCapabilities"
+	// AgentCanary is "true" for agents running a release under
+	// validation, which proxy servers route a share of dials through.
+	AgentCanary = "agentCanary"
+	// AgentLabels is the comma separated list of key=value labels of the
+	// agent, matched against the label selector of dials.
+	AgentLabels = "agentLabels"
+	// AgentMaxConnections is the maximum number of connections the agent
+	// serves concurrently for each proxy server. Proxy servers route
+	// dials through other agents beyond it. Absent or 0 is unlimited.
+	AgentMaxConnections = "agentMaxConnections"
+	// SessionToken identifies a resumable agent session. Proxy servers
+	// send it to agents supporting resumption, which send it back when
+	// reconnecting to resume the session.
+	SessionToken = "sessionToken"
+	// SessionResumed is "true" if the proxy server resumed the session
+	// of the SessionToken sent by the agent.
+	SessionResumed = "sessionResumed"
+	// ProtocolVersion is the highest protocol version an agent supports.
+	// Proxy servers answer with the version negotiated, the lowest of
+	// both sides. Peers not sending it speak version 1.
+	ProtocolVersion = "protocolVersion"
+	// ConnectionDeadline is when the proxy server ends the Connect stream
+	// for having reached its maximum age, in RFC 3339 format. Agents
+	// reconnect afterwards.
+	ConnectionDeadline = "connectionDeadline"
+	// TopologyHints is the comma separated list of serverID=address of
+	// the peer proxy servers in the zone of the agent, which it may
+	// prefer to connect to directly.
+	TopologyHints = "topologyHints"
 	// AuthenticationTokenContextKey will be used as a key to store authentication tokens in grpc call
 	// (https://tools.ietf.org/html/rfc6750#section-2.1)
 	AuthenticationTokenContextKey = "Authorization"
@@ -32,3 +64,65 @@ const (
 	// UserAgent is used to provide the client information in a proxy request
 	UserAgent = "user-agent"
 )
+
+// Reserved keys of the DialRequest metadata map. Values under
+// DialMetadataPrefix are attested by the proxy server; anything a
+// frontend sends under this prefix is dropped.
+const (
+	DialMetadataPrefix = "konnectivity.io/"
+	// DialMetadataFrontendIdentity is the common name of the frontend's
+	// client certificate, if any.
+	DialMetadataFrontendIdentity = DialMetadataPrefix + "frontend-identity"
+	// DialMetadataFrontendMode is the frontend mode, grpc or http-connect.
+	DialMetadataFrontendMode = DialMetadataPrefix + "frontend-mode"
+	// DialMetadataServerID is the ID of the proxy server forwarding the dial.
+	DialMetadataServerID = DialMetadataPrefix + "server-id"
+)
+
+// DialBudgetToken is the DialRequest metadata key of the budget token a
+// frontend sends with every attempt to dial the same destination. It must
+// match DialBudgetTokenKey of the konnectivity-client.
+const DialBudgetToken = "dial-budget-token"
+
+// DialLabelSelector is the DialRequest metadata key of the label selector
+// of the agents a frontend wants its dial routed through. It must match
+// LabelSelectorKey of the konnectivity-client.
+const DialLabelSelector = "label-selector"
+
+// DialNetworkNamespace is the DialRequest metadata key of the name of the
+// network namespace the agent dials the destination in. It must match
+// NetworkNamespaceKey of the konnectivity-client.
+const DialNetworkNamespace = "network-namespace"
+
+// DialMigratable is the DialRequest metadata key marking the connection as
+// migratable to another agent if its agent disconnects. It must match
+// MigratableKey of the konnectivity-client.
+const DialMigratable = "migratable"
+
+// LabelSelectorHTTPHeader is the header of HTTP CONNECT requests carrying
+// the label selector of the agents the dial is routed through.
+const LabelSelectorHTTPHeader = "X-Konnectivity-Label-Selector"
+
+// PriorityHTTPHeader is the header of HTTP CONNECT requests carrying the
+// priority of the connection: "high", "medium" or "low".
+const PriorityHTTPHeader = "X-Konnectivity-Priority"
+
+// Features advertised in HELLO packets. They must match the Feature
+// constants of the konnectivity-client.
+const (
+	// FeatureFlowControl means the peer acknowledges the DATA it received,
+	// so that the sender can bound the data in flight.
+	FeatureFlowControl = "flow-control"
+	// FeatureUDP means the peer relays UDP connections. Reserved, no
+	// build relays UDP yet.
+	FeatureUDP = "udp"
+	// FeatureCompression means the peer compresses DATA payloads.
+	FeatureCompression = "compression"
+	// FeatureResumption means the peer resumes its session after the
+	// stream broke.
+	FeatureResumption = "resumption"
+	// FeatureIdleWarning means the peer takes part in idle warnings:
+	// agents send IDLE_WARNING packets before they close idle connections,
+	// proxy servers forward them to the frontends, which handle them.
+	FeatureIdleWarning = "idle-warning"
+)
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
 	pkgagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
@@ -124,7 +125,8 @@ func TestConcurrentClientRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	ps.BackendManagers = []server.BackendManager{newSingleTimeGetter(server.NewDefaultBackendManager())}
+	bm := newSingleTimeGetter(server.NewDefaultBackendManager())
+	ps.BackendManagers = []server.BackendManager{bm}
 
 	stopCh := make(chan struct{})
 	defer close(stopCh)
@@ -132,6 +134,13 @@ func TestConcurrentClientRequest(t *testing.T) {
 	runAgent(proxy.agent, stopCh)
 	runAgent(proxy.agent, stopCh)
 
+	// Wait for both agents to register on proxy server
+	wait.Poll(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+		bm.mu.Lock()
+		defer bm.mu.Unlock()
+		return len(bm.backends) == 2, nil
+	})
+
 	client1 := getTestClient(proxy.front, t)
 	client2 := getTestClient(proxy.front, t)
 	var wg sync.WaitGroup
@@ -1,8 +1,11 @@
 package tests
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -75,6 +78,111 @@ func TestProxy_ConcurrencyGRPC(t *testing.T) {
 	wg.Wait()
 }
 
+// This test verifies that the DATA of several connections sharing one
+// tunnel keeps flowing both ways, with the agent acknowledging the numbered
+// DATA of each connection.
+func TestProxy_SustainedThroughputGRPC(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	proxy, cleanup, err := runGRPCProxyServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	runAgent(proxy.agent, stopCh)
+
+	// Wait for agent to register on proxy server
+	wait.Poll(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+		ready, _ := proxy.server.Readiness.Ready()
+		return ready, nil
+	})
+
+	tunnel, err := client.CreateSingleUseGrpcTunnel(ctx, proxy.front, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, chunk := 8<<20, 32<<10
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, 4)
+	transfer := func() {
+		defer wg.Done()
+
+		conn, err := tunnel.DialContext(ctx, "tcp", ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+
+		go func() {
+			for sent := 0; sent < length; sent += chunk {
+				if _, err := conn.Write(data[sent : sent+chunk]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		received := make([]byte, length)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(received, data) {
+			t.Error("expect the data to be echoed unchanged")
+		}
+	}
+
+	concurrency := cap(conns)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go transfer()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("expect the transfers to complete within a minute")
+	}
+
+	// The single use tunnel ends once the first connection is closed.
+	close(conns)
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
 func TestProxy_ConcurrencyHTTP(t *testing.T) {
 	ctx := context.Background()
 	length := 1 << 20
@@ -58,6 +58,7 @@ func TestClientReconnects(t *testing.T) {
 }
 
 type testAgentServerImpl struct {
+	agent.UnimplementedAgentServiceServer
 	onConnect func(agent.AgentService_ConnectServer) error
 }
 